@@ -0,0 +1,219 @@
+// Command devstack brings up a one-command local environment: it starts a
+// LocalStack container (SQS + S3) with the docker CLI, creates the job queue
+// and bucket, writes the resulting settings to an env file, and runs the
+// service against it with `go run ./app` and the dev profile, so every restart
+// rebuilds from source.
+//
+//	go run ./cmd/devstack            # start everything, run the service
+//	go run ./cmd/devstack -run=false # infrastructure + env file only
+//	go run ./cmd/devstack -down      # remove the container
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+// region is the region everything is created in; LocalStack accepts any.
+const region = "us-east-1"
+
+// options are the command-line flags.
+type options struct {
+	container string        // Docker container name
+	image     string        // LocalStack image
+	port      int           // Host port for the LocalStack edge endpoint
+	queue     string        // SQS queue name
+	bucket    string        // S3 bucket name
+	envFile   string        // Where to write the dev settings
+	run       bool          // Run the service after setup
+	down      bool          // Remove the container and exit
+	wait      time.Duration // How long to wait for LocalStack to become healthy
+}
+
+func main() {
+	var o options
+	flag.StringVar(&o.container, "name", "go-microservice-localstack", "docker container name")
+	flag.StringVar(&o.image, "image", "localstack/localstack:3", "LocalStack image")
+	flag.IntVar(&o.port, "port", 4566, "host port for LocalStack")
+	flag.StringVar(&o.queue, "queue", "jobs-dev", "SQS queue name")
+	flag.StringVar(&o.bucket, "bucket", "jobs-dev", "S3 bucket name")
+	flag.StringVar(&o.envFile, "env-file", ".env.dev", "env file to write")
+	flag.BoolVar(&o.run, "run", true, "run the service (go run ./app) after setup")
+	flag.BoolVar(&o.down, "down", false, "stop and remove the LocalStack container, then exit")
+	flag.DurationVar(&o.wait, "wait", 90*time.Second, "how long to wait for LocalStack to become healthy")
+	flag.Parse()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if err := devstack(ctx, o); err != nil {
+		slog.Error("devstack failed", "error", err)
+		os.Exit(1)
+	}
+}
+
+// devstack runs the whole flow for o.
+func devstack(ctx context.Context, o options) error {
+	if o.down {
+		return docker(ctx, "rm", "-f", o.container)
+	}
+	if err := startLocalStack(ctx, o); err != nil {
+		return err
+	}
+	endpoint := fmt.Sprintf("http://localhost:%d", o.port)
+	if err := waitHealthy(ctx, endpoint, o.wait); err != nil {
+		return err
+	}
+	queueURL, err := createResources(ctx, endpoint, o)
+	if err != nil {
+		return err
+	}
+
+	env := serviceEnv(o, endpoint, queueURL)
+	if err := writeEnvFile(o.envFile, env); err != nil {
+		return err
+	}
+	slog.Info("dev environment ready", "env_file", o.envFile, "queue_url", queueURL, "bucket", o.bucket)
+	if !o.run {
+		fmt.Printf("set -a; . ./%s; set +a; go run ./app\n", o.envFile)
+		return nil
+	}
+
+	cmd := exec.CommandContext(ctx, "go", "run", "./app")
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	// On Ctrl-C, let the service shut down gracefully instead of killing it.
+	cmd.Cancel = func() error { return cmd.Process.Signal(syscall.SIGTERM) }
+	cmd.WaitDelay = 30 * time.Second
+	if err := cmd.Run(); err != nil && ctx.Err() == nil {
+		return fmt.Errorf("service exited: %w", err)
+	}
+	return nil
+}
+
+// docker runs a docker CLI command, passing its output through.
+func docker(ctx context.Context, args ...string) error {
+	cmd := exec.CommandContext(ctx, "docker", args...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("docker %s: %w", args[0], err)
+	}
+	return nil
+}
+
+// startLocalStack starts the container unless it is already running.
+func startLocalStack(ctx context.Context, o options) error {
+	out, err := exec.CommandContext(ctx, "docker", "inspect", "-f", "{{.State.Running}}", o.container).Output()
+	if err == nil && strings.TrimSpace(string(out)) == "true" {
+		slog.Info("LocalStack already running", "container", o.container)
+		return nil
+	}
+	// A stopped container with the same name would block docker run.
+	exec.CommandContext(ctx, "docker", "rm", "-f", o.container).Run()
+	slog.Info("starting LocalStack", "container", o.container, "image", o.image)
+	return docker(ctx, "run", "-d", "--name", o.container,
+		"-p", fmt.Sprintf("%d:4566", o.port),
+		"-e", "SERVICES=sqs,s3",
+		o.image)
+}
+
+// waitHealthy polls LocalStack's health endpoint until SQS and S3 are up.
+func waitHealthy(ctx context.Context, endpoint string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ready := func(state string) bool { return state == "running" || state == "available" }
+	for {
+		var health struct {
+			Services map[string]string `json:"services"`
+		}
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, endpoint+"/_localstack/health", nil)
+		if resp, err := http.DefaultClient.Do(req); err == nil {
+			json.NewDecoder(resp.Body).Decode(&health)
+			resp.Body.Close()
+			if ready(health.Services["sqs"]) && ready(health.Services["s3"]) {
+				return nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return errors.New("LocalStack did not become healthy in time")
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// createResources creates the queue and bucket (both idempotent) and returns
+// the queue URL.
+func createResources(ctx context.Context, endpoint string, o options) (string, error) {
+	cfg, err := config.LoadDefaultConfig(ctx,
+		config.WithRegion(region),
+		config.WithCredentialsProvider(aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "test", SecretAccessKey: "test"}, nil
+		})),
+	)
+	if err != nil {
+		return "", fmt.Errorf("load AWS config: %w", err)
+	}
+	sqsClient := sqs.NewFromConfig(cfg, func(opt *sqs.Options) { opt.BaseEndpoint = aws.String(endpoint) })
+	s3Client := s3.NewFromConfig(cfg, func(opt *s3.Options) {
+		opt.BaseEndpoint = aws.String(endpoint)
+		opt.UsePathStyle = true
+	})
+
+	q, err := sqsClient.CreateQueue(ctx, &sqs.CreateQueueInput{QueueName: aws.String(o.queue)})
+	if err != nil {
+		return "", fmt.Errorf("create queue: %w", err)
+	}
+	if _, err := s3Client.CreateBucket(ctx, &s3.CreateBucketInput{Bucket: aws.String(o.bucket)}); err != nil &&
+		!strings.Contains(err.Error(), "BucketAlreadyOwnedByYou") {
+		return "", fmt.Errorf("create bucket: %w", err)
+	}
+	return aws.ToString(q.QueueUrl), nil
+}
+
+// serviceEnv is the environment the service runs with. S3 uses path-style
+// addressing, so no wildcard DNS is needed for bucket names;
+// STARTUP_WAIT_TIMEOUT rides out LocalStack restarts.
+func serviceEnv(o options, endpoint, queueURL string) []string {
+	return []string{
+		"APP_PROFILE=dev",
+		"AWS_REGION=" + region,
+		"AWS_ACCESS_KEY_ID=test",
+		"AWS_SECRET_ACCESS_KEY=test",
+		"AWS_ENDPOINT_URL=" + endpoint,
+		"S3_FORCE_PATH_STYLE=true",
+		"SQS_QUEUE_URL=" + queueURL,
+		"S3_BUCKET=" + o.bucket,
+		"RUN_MODE=both",
+		"STARTUP_WAIT_TIMEOUT=30s",
+		"ADMIN_TOKEN=dev",
+		"PAGINATION_SECRET=dev",
+	}
+}
+
+// writeEnvFile writes env as KEY=VALUE lines, sorted.
+func writeEnvFile(path string, env []string) error {
+	lines := slices.Sorted(slices.Values(env))
+	body := "# Written by go run ./cmd/devstack; safe to delete.\n" + strings.Join(lines, "\n") + "\n"
+	if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+		return fmt.Errorf("write env file: %w", err)
+	}
+	return nil
+}
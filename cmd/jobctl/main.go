@@ -0,0 +1,225 @@
+// Command jobctl is a command-line client for the job API.
+//
+//	jobctl submit [-parent ID -relation R] [-callback URL] TEXT   # TEXT "-" reads stdin
+//	jobctl get ID
+//	jobctl list [-limit N] [-sort F -order asc|desc | -view ID] [-all]
+//	jobctl validate [-dry-run] TEXT
+//
+// The API address comes from -addr or JOBCTL_ADDR (default
+// http://localhost:8080); -client-id and -tenant set the identity headers.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"go-microservice/internal/service"
+)
+
+// client calls the job API.
+type client struct {
+	addr     string
+	clientID string
+	tenant   string
+	http     *http.Client
+}
+
+func main() {
+	global := flag.NewFlagSet("jobctl", flag.ExitOnError)
+	c := &client{http: &http.Client{Timeout: 30 * time.Second}}
+	global.StringVar(&c.addr, "addr", envOr("JOBCTL_ADDR", "http://localhost:8080"), "API base URL")
+	global.StringVar(&c.clientID, "client-id", "", "X-Client-ID header")
+	global.StringVar(&c.tenant, "tenant", "", "X-Tenant-ID header")
+	global.Usage = usage
+	global.Parse(os.Args[1:])
+	if global.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	cmd, args := global.Arg(0), global.Args()[1:]
+	var err error
+	switch cmd {
+	case "submit":
+		err = c.submit(args)
+	case "get":
+		err = c.get(args)
+	case "list":
+		err = c.list(args)
+	case "validate":
+		err = c.validate(args)
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "jobctl:", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `usage: jobctl [-addr URL] [-client-id ID] [-tenant T] <command> [flags]
+
+commands:
+  submit [-parent ID -relation R] [-callback URL] TEXT
+                                         submit a job (TEXT "-" reads stdin)
+  get ID                                 print a job result
+  list [-limit N] [-sort F -order O | -view ID] [-all]
+                                         list jobs
+  validate [-dry-run] TEXT               validate a job without submitting`)
+}
+
+// envOr returns the value of name, or def when unset.
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// textArg returns the single TEXT argument, reading stdin for "-".
+func textArg(fs *flag.FlagSet) (string, error) {
+	if fs.NArg() != 1 {
+		return "", errors.New("expected exactly one TEXT argument")
+	}
+	if fs.Arg(0) != "-" {
+		return fs.Arg(0), nil
+	}
+	b, err := io.ReadAll(os.Stdin)
+	return string(b), err
+}
+
+func (c *client) submit(args []string) error {
+	fs := flag.NewFlagSet("submit", flag.ExitOnError)
+	var req service.JobRequest
+	fs.StringVar(&req.ParentID, "parent", "", "parent job ID")
+	fs.StringVar(&req.Relation, "relation", "", "relation to the parent: retry, chain, replay, workflow")
+	fs.StringVar(&req.CallbackURL, "callback", "", "URL the result is POSTed to once stored")
+	fs.Parse(args)
+	text, err := textArg(fs)
+	if err != nil {
+		return err
+	}
+	req.Text = text
+	var resp service.CreateJobResponse
+	if err := c.do(http.MethodPost, "/v1/jobs", req, &resp); err != nil {
+		return err
+	}
+	return printJSON(resp)
+}
+
+func (c *client) get(args []string) error {
+	if len(args) != 1 {
+		return errors.New("expected exactly one job ID")
+	}
+	var resp json.RawMessage
+	if err := c.do(http.MethodGet, "/v1/jobs/"+url.PathEscape(args[0]), nil, &resp); err != nil {
+		return err
+	}
+	return printJSON(resp)
+}
+
+func (c *client) list(args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	limit := fs.Int("limit", 50, "page size")
+	sort := fs.String("sort", "", "created_at, completed_at, duration or size")
+	order := fs.String("order", "", "asc or desc")
+	view := fs.String("view", "", "saved view ID")
+	all := fs.Bool("all", false, "follow next_page_token to the end")
+	fs.Parse(args)
+
+	q := url.Values{"limit": {strconv.Itoa(*limit)}}
+	for k, v := range map[string]string{"sort": *sort, "order": *order, "view": *view} {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	for {
+		var page service.JobListResponse
+		if err := c.do(http.MethodGet, "/v1/jobs?"+q.Encode(), nil, &page); err != nil {
+			return err
+		}
+		if err := printJSON(page.Jobs); err != nil {
+			return err
+		}
+		if !*all || page.NextPageToken == "" {
+			return nil
+		}
+		q.Set("page_token", page.NextPageToken)
+	}
+}
+
+func (c *client) validate(args []string) error {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "also run the processor on a truncated copy")
+	fs.Parse(args)
+	text, err := textArg(fs)
+	if err != nil {
+		return err
+	}
+	path := "/v1/jobs/validate"
+	if *dryRun {
+		path += "?dry_run=true"
+	}
+	var resp service.ValidationResponse
+	if err := c.do(http.MethodPost, path, service.JobRequest{Text: text}, &resp); err != nil {
+		return err
+	}
+	return printJSON(resp)
+}
+
+// do sends a JSON request and decodes a 2xx JSON response into out. Other
+// statuses are returned as errors carrying the response body.
+func (c *client) do(method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, c.addr+path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.clientID != "" {
+		req.Header.Set("X-Client-ID", c.clientID)
+	}
+	if c.tenant != "" {
+		req.Header.Set("X-Tenant-ID", c.tenant)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, bytes.TrimSpace(b))
+	}
+	return json.Unmarshal(b, out)
+}
+
+// printJSON writes v to stdout, indented.
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -0,0 +1,164 @@
+// Command migrate copies the service's stored data (results, artifacts,
+// index, lineage, creation records, tombstones, views) from one S3-compatible
+// store to another, optionally re-rooting keys under a new prefix. It is
+// throttled, verifies every copy, and resumes from its checkpoint when rerun
+// with the same -name. The cutover report is printed as JSON and stored at
+// the destination under migrations/{name}/report.json; the exit status is 0
+// only when the destination is ready for cutover.
+//
+//	migrate -name move-1 -src-bucket jobs -dst-bucket jobs-v2 -dst-prefix v2/ -rate 200
+//	migrate -name to-r2 -src-bucket jobs -dst-bucket jobs \
+//	    -dst-endpoint https://<account>.r2.cloudflarestorage.com -dst-region auto
+//
+// Credentials come from the default chain; with a -dst-endpoint, set
+// -dst-profile to use a different shared-config profile for the destination.
+// HTTPS_PROXY, NO_PROXY, TLS_CA_BUNDLE and TLS_MIN_VERSION apply as in the
+// service.
+//
+// To export to a lower environment, pass -scrub with scrub rules (JSON, or
+// @file; see internal/service/scrub.go) and SCRUB_HASH_KEY in the
+// environment: JSON objects are scrubbed and artifacts withheld.
+// Objects are copied server-side when both sides use the same store.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"go-microservice/internal/service"
+)
+
+// store holds the flags describing one side of the migration.
+type store struct {
+	bucket    string
+	prefix    string
+	region    string
+	endpoint  string
+	profile   string
+	pathStyle bool
+}
+
+// flags registers the store's flags with the given name prefix.
+func (s *store) flags(side, defBucket string) {
+	flag.StringVar(&s.bucket, side+"-bucket", defBucket, side+" bucket")
+	flag.StringVar(&s.prefix, side+"-prefix", "", side+" key layout root, e.g. v2/")
+	flag.StringVar(&s.region, side+"-region", envOr("AWS_REGION", "us-east-1"), side+" region")
+	flag.StringVar(&s.endpoint, side+"-endpoint", "", side+" S3-compatible endpoint URL (default AWS)")
+	flag.StringVar(&s.profile, side+"-profile", "", side+" shared-config profile (default chain when empty)")
+	flag.BoolVar(&s.pathStyle, side+"-path-style", false, side+" uses path-style bucket addressing")
+}
+
+// sameStore reports whether s and o address the same store with the same
+// credentials, so one client can serve both.
+func (s store) sameStore(o store) bool {
+	return s.region == o.region && s.endpoint == o.endpoint && s.profile == o.profile && s.pathStyle == o.pathStyle
+}
+
+// client builds an S3 client for s.
+func (s store) client(ctx context.Context) (*s3.Client, error) {
+	httpClient, err := service.AWSHTTPClient()
+	if err != nil {
+		return nil, err
+	}
+	opts := []func(*config.LoadOptions) error{config.WithRegion(s.region), config.WithHTTPClient(httpClient)}
+	if s.profile != "" {
+		opts = append(opts, config.WithSharedConfigProfile(s.profile))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("load AWS config: %w", err)
+	}
+	return s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if s.endpoint != "" {
+			o.BaseEndpoint = aws.String(s.endpoint)
+		}
+		o.UsePathStyle = s.pathStyle
+	}), nil
+}
+
+func main() {
+	var src, dst store
+	src.flags("src", os.Getenv("S3_BUCKET"))
+	dst.flags("dst", "")
+	name := flag.String("name", "", "migration name; rerun with the same name to resume (required)")
+	prefixes := flag.String("prefixes", "", "comma-separated logical prefixes to copy (default all)")
+	rate := flag.Float64("rate", 100, "maximum objects per second; 0 for no limit")
+	verify := flag.Bool("verify", true, "HeadObject each copy and compare size and ETag")
+	scrub := flag.String("scrub", "", "scrub rules (JSON or @file) for an export to a lower environment")
+	flag.Parse()
+
+	if *name == "" || src.bucket == "" || dst.bucket == "" {
+		fmt.Fprintln(os.Stderr, "migrate: -name, -src-bucket (or S3_BUCKET) and -dst-bucket are required")
+		flag.Usage()
+		os.Exit(2)
+	}
+	if src.bucket == dst.bucket && src.prefix == dst.prefix && src.sameStore(dst) {
+		fmt.Fprintln(os.Stderr, "migrate: destination must differ from source")
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	srcClient, err := src.client(ctx)
+	if err != nil {
+		slog.Error("source client", "error", err)
+		os.Exit(1)
+	}
+	dstClient := srcClient
+	if !src.sameStore(dst) {
+		if dstClient, err = dst.client(ctx); err != nil {
+			slog.Error("destination client", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	cfg := service.MigrationConfig{
+		Name:        *name,
+		Source:      service.MigrationEndpoint{Client: srcClient, Bucket: src.bucket, Prefix: src.prefix},
+		Destination: service.MigrationEndpoint{Client: dstClient, Bucket: dst.bucket, Prefix: dst.prefix},
+		Rate:        *rate,
+		Verify:      *verify,
+	}
+	if *prefixes != "" {
+		cfg.Prefixes = strings.Split(*prefixes, ",")
+	}
+	if *scrub != "" {
+		if cfg.Scrub, err = service.ParseScrubRules(*scrub, []byte(os.Getenv("SCRUB_HASH_KEY"))); err != nil {
+			fmt.Fprintln(os.Stderr, "migrate:", err)
+			os.Exit(2)
+		}
+	}
+
+	rep, err := service.Migrate(ctx, cfg)
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(rep)
+	if err != nil {
+		slog.Error("migration stopped; rerun with the same -name to resume", "error", err)
+		os.Exit(1)
+	}
+	if !rep.CutoverReady {
+		slog.Error("migration finished with failures; rerun with the same -name to retry them")
+		os.Exit(1)
+	}
+}
+
+// envOr returns the value of name, or def when unset.
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
@@ -0,0 +1,9 @@
+// Command scheduler runs scheduled storage maintenance (the janitor, every
+// JANITOR_INTERVAL) plus the health probes. Run exactly one.
+package main
+
+import "go-microservice/internal/service"
+
+func main() {
+	service.Run(service.Components{Scheduler: true})
+}
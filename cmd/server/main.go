@@ -0,0 +1,9 @@
+// Command server runs the job HTTP API only. Scale it on request load; run
+// cmd/worker and cmd/scheduler alongside it.
+package main
+
+import "go-microservice/internal/service"
+
+func main() {
+	service.Run(service.Components{API: true})
+}
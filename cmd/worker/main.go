@@ -0,0 +1,9 @@
+// Command worker runs the SQS job consumer only, plus the health probes.
+// Scale it on queue depth.
+package main
+
+import "go-microservice/internal/service"
+
+func main() {
+	service.Run(service.Components{Worker: true})
+}
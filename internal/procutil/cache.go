@@ -0,0 +1,128 @@
+// Response caching for downstream calls whose answers stay valid for a while.
+package procutil
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// defaultLoadTimeout bounds a cache load without CacheOptions.LoadTimeout.
+const defaultLoadTimeout = 30 * time.Second
+
+// CacheOptions configures a Cache.
+type CacheOptions struct {
+	TTL         time.Duration // How long a value is served; required
+	MaxEntries  int           // Values kept, the least recently used dropped first; 0 for no limit
+	LoadTimeout time.Duration // Bound on one load; default 30s
+}
+
+// Cache keeps the values of successful loads for a TTL. Concurrent misses
+// for a key share one load. It is safe for concurrent use; errors are never
+// cached.
+type Cache[V any] struct {
+	opts CacheOptions
+
+	mu      sync.Mutex
+	entries map[string]*list.Element // Of *cacheEntry[V]
+	order   *list.List               // Most recently used first
+	loads   singleflight.Group
+}
+
+// cacheEntry is a cached value.
+type cacheEntry[V any] struct {
+	key     string
+	value   V
+	expires time.Time
+}
+
+// NewCache returns an empty cache configured by opts.
+func NewCache[V any](opts CacheOptions) *Cache[V] {
+	if opts.LoadTimeout <= 0 {
+		opts.LoadTimeout = defaultLoadTimeout
+	}
+	return &Cache[V]{opts: opts, entries: map[string]*list.Element{}, order: list.New()}
+}
+
+// Get returns key's value while it is fresh.
+func (c *Cache[V]) Get(key string) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	e := el.Value.(*cacheEntry[V])
+	if time.Now().After(e.expires) {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		var zero V
+		return zero, false
+	}
+	c.order.MoveToFront(el)
+	return e.value, true
+}
+
+// Set stores value as key's for the TTL.
+func (c *Cache[V]) Set(key string, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expires := time.Now().Add(c.opts.TTL)
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(*cacheEntry[V])
+		e.value, e.expires = value, expires
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry[V]{key: key, value: value, expires: expires})
+	if c.opts.MaxEntries > 0 && c.order.Len() > c.opts.MaxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry[V]).key)
+	}
+}
+
+// Delete drops key's value, e.g. once the downstream reports it changed.
+func (c *Cache[V]) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.order.Remove(el)
+		delete(c.entries, key)
+	}
+}
+
+// GetOrLoad returns key's fresh value, or loads, caches and returns it. A
+// load already in flight for key is joined instead of starting another. The
+// load runs detached from any one caller's cancellation, bounded by
+// LoadTimeout, and each caller stops waiting when its own ctx ends.
+func (c *Cache[V]) GetOrLoad(ctx context.Context, key string, load func(context.Context) (V, error)) (V, error) {
+	if v, ok := c.Get(key); ok {
+		return v, nil
+	}
+	ch := c.loads.DoChan(key, func() (any, error) {
+		// A load that finished just before this one started has filled it.
+		if v, ok := c.Get(key); ok {
+			return v, nil
+		}
+		loadCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), c.opts.LoadTimeout)
+		defer cancel()
+		v, err := load(loadCtx)
+		if err == nil {
+			c.Set(key, v)
+		}
+		return v, err
+	})
+	select {
+	case <-ctx.Done():
+		var zero V
+		return zero, ctx.Err()
+	case res := <-ch:
+		v, _ := res.Val.(V)
+		return v, res.Err
+	}
+}
@@ -0,0 +1,111 @@
+// Token-bucket rate limits on calls to downstream APIs.
+package procutil
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ErrRateLimited is returned by Wait when a token would only come after
+// ctx's deadline. Retry retries it like any other error; the attempt usually
+// fails once the deadline nears.
+var ErrRateLimited = errors.New("rate limit: no token before the deadline")
+
+// Limiter admits calls at a steady rate, with bursts up to its burst. It is
+// safe for concurrent use.
+type Limiter struct {
+	rate  float64 // Tokens per second
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64   // May go negative: tokens promised to waiting callers
+	last   time.Time // When tokens was last brought up to date
+}
+
+// NewLimiter returns a limiter admitting rate calls per second, with bursts
+// of up to burst calls (at least 1). A rate of 0 or less admits everything.
+func NewLimiter(rate float64, burst int) *Limiter {
+	b := float64(max(burst, 1))
+	return &Limiter{rate: rate, burst: b, tokens: b, last: time.Now()}
+}
+
+// sharedLimiters are the limiters of SharedLimiter, by name.
+var (
+	sharedMu       sync.Mutex
+	sharedLimiters = map[string]*Limiter{}
+)
+
+// SharedLimiter returns the limiter called name, creating it with rate and
+// burst on first use; later calls get the same limiter whatever they pass.
+// Processors of different job types calling one API share its limit this
+// way.
+func SharedLimiter(name string, rate float64, burst int) *Limiter {
+	sharedMu.Lock()
+	defer sharedMu.Unlock()
+	l, ok := sharedLimiters[name]
+	if !ok {
+		l = NewLimiter(rate, burst)
+		sharedLimiters[name] = l
+	}
+	return l
+}
+
+// Allow takes a token if one is there now, reporting whether it did.
+func (l *Limiter) Allow() bool {
+	if l.rate <= 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(time.Now())
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// Wait takes a token, waiting for it as long as needed. It returns
+// ErrRateLimited at once, taking nothing, when the token would come after
+// ctx's deadline, and ctx's error if ctx ends while waiting.
+func (l *Limiter) Wait(ctx context.Context) error {
+	if l.rate <= 0 {
+		return ctx.Err()
+	}
+	l.mu.Lock()
+	now := time.Now()
+	l.refill(now)
+	l.tokens--
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	if deadline, ok := ctx.Deadline(); ok && now.Add(wait).After(deadline) {
+		l.tokens++
+		l.mu.Unlock()
+		return ErrRateLimited
+	}
+	l.mu.Unlock()
+	if wait == 0 {
+		return nil
+	}
+	trace.SpanFromContext(ctx).AddEvent("rate_limit_wait", trace.WithAttributes(attribute.String("wait", wait.String())))
+	if err := sleep(ctx, wait); err != nil {
+		l.mu.Lock()
+		l.tokens++ // Not used: the next caller may have it
+		l.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// refill brings l's tokens up to now. l.mu must be held.
+func (l *Limiter) refill(now time.Time) {
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+}
@@ -0,0 +1,34 @@
+// Package procutil holds the resilience helpers job processors share, so a
+// processor calling a downstream API handles its failures the same way as
+// every other:
+//
+//	var (
+//		geoLimit = procutil.SharedLimiter("geocoder", 20, 5)
+//		geoCache = procutil.NewCache[Place](procutil.CacheOptions{TTL: time.Hour, MaxEntries: 10_000})
+//	)
+//
+//	func geocode(jc *service.JobContext, address string) (Place, error) {
+//		return geoCache.GetOrLoad(jc, address, func(ctx context.Context) (Place, error) {
+//			return procutil.Retry(ctx, procutil.DefaultPolicy, func(ctx context.Context) (Place, error) {
+//				if err := geoLimit.Wait(ctx); err != nil {
+//					return Place{}, err
+//				}
+//				return procutil.Timeout(ctx, 5*time.Second, func(ctx context.Context) (Place, error) {
+//					return callGeocoder(ctx, address)
+//				})
+//			})
+//		})
+//	}
+//
+// Everything takes a context — pass the *service.JobContext — and gives up
+// rather than run past its deadline: a retry, a rate limit wait or a timeout
+// that cannot finish before the job's deadline returns at once, so the job
+// fails its attempt cleanly and is redelivered with the worker's own backoff
+// instead of being cut off mid-call. Retries and rate limit waits are
+// recorded as events on the processing span.
+//
+// State is per process. A limiter caps one worker process, so the service
+// as a whole admits its rate times the worker replicas; size it for that, or
+// for WORKER_CONCURRENCY jobs sharing it. A cache is likewise per process:
+// key tenant-specific responses by tenant as well.
+package procutil
@@ -0,0 +1,131 @@
+// Bounded retries with full-jitter exponential backoff.
+package procutil
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Policy is how Retry retries a call.
+type Policy struct {
+	Attempts  int           // Calls in all, the first included; below 1 means 1
+	BaseDelay time.Duration // Longest wait before the first retry, doubling per retry
+	MaxDelay  time.Duration // Cap on any wait; 0 for none
+
+	// Retryable reports whether an error is worth another call. Nil retries
+	// every error but Permanent ones.
+	Retryable func(error) bool
+}
+
+// DefaultPolicy suits a downstream HTTP API: three calls within about a
+// second.
+var DefaultPolicy = Policy{Attempts: 3, BaseDelay: 200 * time.Millisecond, MaxDelay: 2 * time.Second}
+
+// permanentError marks an error Retry must not retry.
+type permanentError struct{ err error }
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent marks err as not worth retrying, e.g. a 4xx answer; Retry
+// returns it unwrapped at once. Permanent(nil) is nil.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err}
+}
+
+// retryAfterError carries the wait a downstream asked for.
+type retryAfterError struct {
+	err   error
+	after time.Duration
+}
+
+func (e *retryAfterError) Error() string { return e.err.Error() }
+func (e *retryAfterError) Unwrap() error { return e.err }
+
+// RetryAfter marks err as retryable no sooner than after, e.g. from a 429's
+// Retry-After header. Retry then waits at least that long, beyond MaxDelay
+// if need be. RetryAfter(nil, d) is nil.
+func RetryAfter(err error, after time.Duration) error {
+	if err == nil {
+		return nil
+	}
+	return &retryAfterError{err: err, after: after}
+}
+
+// Do calls fn until it succeeds, fails permanently or the policy's attempts
+// are used up, and returns its last error. See Retry.
+func Do(ctx context.Context, p Policy, fn func(context.Context) error) error {
+	_, err := Retry(ctx, p, func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, fn(ctx)
+	})
+	return err
+}
+
+// Retry calls fn until it succeeds, fails permanently or the policy's
+// attempts are used up, waiting a random time up to the backoff between
+// calls, and returns fn's last result. It stops early, returning the last
+// error, once ctx is done or the next wait would end past ctx's deadline.
+func Retry[T any](ctx context.Context, p Policy, fn func(context.Context) (T, error)) (T, error) {
+	for attempt := 1; ; attempt++ {
+		v, err := fn(ctx)
+		if err == nil {
+			return v, nil
+		}
+		var perm *permanentError
+		if errors.As(err, &perm) {
+			return v, perm.err
+		}
+		if attempt >= p.Attempts || ctx.Err() != nil || (p.Retryable != nil && !p.Retryable(err)) {
+			return v, err
+		}
+		wait := p.backoff(attempt)
+		var after *retryAfterError
+		if errors.As(err, &after) {
+			wait = max(wait, after.after)
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(wait).After(deadline) {
+			return v, err
+		}
+		trace.SpanFromContext(ctx).AddEvent("retry", trace.WithAttributes(
+			attribute.Int("attempt", attempt),
+			attribute.String("wait", wait.String()),
+			attribute.String("error", err.Error()),
+		))
+		if sleep(ctx, wait) != nil {
+			return v, err
+		}
+	}
+}
+
+// backoff returns a random wait before retry number attempt: up to
+// BaseDelay doubled attempt-1 times, capped at MaxDelay.
+func (p Policy) backoff(attempt int) time.Duration {
+	ceiling := p.BaseDelay << min(attempt-1, 30)
+	if ceiling <= 0 || (p.MaxDelay > 0 && ceiling > p.MaxDelay) {
+		ceiling = p.MaxDelay
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return rand.N(ceiling + 1)
+}
+
+// sleep waits for d, or returns ctx's error once it is done first.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
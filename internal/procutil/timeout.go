@@ -0,0 +1,41 @@
+// Per-call timeouts, told apart from the job's own deadline.
+package procutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// errCallTimeout is the cancellation cause of a Timeout's context.
+var errCallTimeout = errors.New("call timed out")
+
+// TimeoutError is returned by Timeout when its own limit ran out before the
+// call finished. It wraps the call's error, usually
+// context.DeadlineExceeded, and Retry retries it like any other.
+type TimeoutError struct {
+	After time.Duration // The limit
+	Err   error         // What the call returned
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("call timed out after %s: %v", e.After, e.Err)
+}
+
+func (e *TimeoutError) Unwrap() error { return e.Err }
+
+// Timeout calls fn with a context done after d, or at ctx's deadline if that
+// is sooner; fn must return once it is done. When d ran out first, a failed
+// call's error is a *TimeoutError; when ctx ended first — the job's deadline
+// passed — it is returned as fn gave it. A d that cannot fit before ctx's
+// deadline still runs fn, for whatever time is left.
+func Timeout[T any](ctx context.Context, d time.Duration, fn func(context.Context) (T, error)) (T, error) {
+	callCtx, cancel := context.WithTimeoutCause(ctx, d, errCallTimeout)
+	defer cancel()
+	v, err := fn(callCtx)
+	if err != nil && ctx.Err() == nil && errors.Is(context.Cause(callCtx), errCallTimeout) {
+		return v, &TimeoutError{After: d, Err: err}
+	}
+	return v, err
+}
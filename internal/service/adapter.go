@@ -0,0 +1,337 @@
+// Message adapters for producers that do not speak the envelope. Legacy
+// systems can feed the job queue before they are changed: MESSAGE_ADAPTERS
+// (JSON, or "@path" to a file) lists adapters that map fields of a foreign
+// message into a JobMessage,
+//
+//	[{"name": "orders",
+//	  "attributes": {"producer": "order-service"},
+//	  "match": {"$.kind": "render"},
+//	  "fields": {"text": "$.payload.body", "tenant": "$.customer.id", "id": "$.ref"}}]
+//
+// A received message that is not an envelope (no "v" of 1 or more) is given
+// to the first adapter whose attributes (SQS string message attributes) and
+// match (body paths) all hold the values listed; an adapter with neither
+// matches every such message, so put it last. Its fields map JobMessage
+// fields — text (required), id, tenant, type, created_at (RFC 3339) — to
+// paths: $ is the whole body, followed by .name, ['name'] or [index] steps.
+// A body that is not JSON is a string, so "$" maps a plain-text body. The
+// matched message becomes a job envelope whose headers are the message's
+// string attributes plus the adapter's name, and is processed, retried and
+// dead-lettered like any other.
+//
+// Without an id mapping the job ID is derived from the SQS message ID, so
+// redeliveries are the same job; a mapped id must satisfy JOB_ID_SCHEME. A
+// message no adapter matches is read as a bare JobMessage, as before.
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/google/uuid"
+)
+
+// MessageAdapter is one entry of MESSAGE_ADAPTERS.
+type MessageAdapter struct {
+	Name       string            `json:"name"`                 // Recorded in the envelope's adapter header
+	Attributes map[string]string `json:"attributes,omitempty"` // Message attributes that must have these values
+	Match      map[string]string `json:"match,omitempty"`      // Body paths that must hold these values
+	Fields     map[string]string `json:"fields"`               // JobMessage field name → body path
+}
+
+// adapterFields are the JobMessage fields an adapter may map.
+var adapterFields = map[string]bool{"id": true, "text": true, "tenant": true, "type": true, "created_at": true}
+
+// messageAdapter is a compiled MessageAdapter.
+type messageAdapter struct {
+	name       string
+	attributes map[string]string
+	match      []pathMatch
+	fields     map[string]jsonPath
+}
+
+// pathMatch is one match condition.
+type pathMatch struct {
+	path  jsonPath
+	value string
+}
+
+// messageAdapters are the configured adapters, in order.
+type messageAdapters []messageAdapter
+
+// newMessageAdapters returns the adapters configured by MESSAGE_ADAPTERS.
+func newMessageAdapters() (messageAdapters, error) {
+	raw := getenv("MESSAGE_ADAPTERS")
+	if raw == "" {
+		return nil, nil
+	}
+	data := []byte(raw)
+	if path, ok := cutAt(raw); ok {
+		var err error
+		if data, err = os.ReadFile(path); err != nil {
+			return nil, fmt.Errorf("read MESSAGE_ADAPTERS: %w", err)
+		}
+	}
+	var specs []MessageAdapter
+	if err := json.Unmarshal(data, &specs); err != nil {
+		return nil, fmt.Errorf("parse MESSAGE_ADAPTERS: %w", err)
+	}
+	as := make(messageAdapters, 0, len(specs))
+	for i, spec := range specs {
+		ad, err := compileAdapter(spec)
+		if err != nil {
+			return nil, fmt.Errorf("MESSAGE_ADAPTERS[%d]: %w", i, err)
+		}
+		as = append(as, ad)
+	}
+	return as, nil
+}
+
+// compileAdapter checks spec and parses its paths.
+func compileAdapter(spec MessageAdapter) (messageAdapter, error) {
+	if spec.Name == "" {
+		return messageAdapter{}, errors.New("name is required")
+	}
+	if _, ok := spec.Fields["text"]; !ok {
+		return messageAdapter{}, fmt.Errorf("adapter %s: fields must map text", spec.Name)
+	}
+	ad := messageAdapter{name: spec.Name, attributes: spec.Attributes, fields: map[string]jsonPath{}}
+	for field, p := range spec.Fields {
+		if !adapterFields[field] {
+			return messageAdapter{}, fmt.Errorf("adapter %s: unknown field %q (want id, text, tenant, type or created_at)", spec.Name, field)
+		}
+		path, err := parseJSONPath(p)
+		if err != nil {
+			return messageAdapter{}, fmt.Errorf("adapter %s: field %s: %w", spec.Name, field, err)
+		}
+		ad.fields[field] = path
+	}
+	for p, v := range spec.Match {
+		path, err := parseJSONPath(p)
+		if err != nil {
+			return messageAdapter{}, fmt.Errorf("adapter %s: match: %w", spec.Name, err)
+		}
+		ad.match = append(ad.match, pathMatch{path: path, value: v})
+	}
+	return ad, nil
+}
+
+// adapt rewrites a message that is not an envelope into a job envelope with
+// the first adapter that matches it. Envelopes and messages no adapter
+// matches are returned unchanged.
+func (as messageAdapters) adapt(m types.Message) (types.Message, error) {
+	if len(as) == 0 {
+		return m, nil
+	}
+	body := []byte(aws.ToString(m.Body))
+	var doc any
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if dec.Decode(&doc) != nil {
+		doc = string(body)
+	}
+	if obj, ok := doc.(map[string]any); ok {
+		if v, ok := obj["v"].(json.Number); ok {
+			if n, err := v.Int64(); err == nil && n >= 1 {
+				return m, nil
+			}
+		}
+	}
+	for _, ad := range as {
+		if !ad.matches(m, doc) {
+			continue
+		}
+		job, err := ad.jobMessage(m, doc)
+		if err != nil {
+			return m, fmt.Errorf("adapter %s: %w", ad.name, err)
+		}
+		raw, err := json.Marshal(job)
+		if err != nil {
+			return m, err
+		}
+		headers := stringAttributes(m.MessageAttributes)
+		if headers == nil {
+			headers = map[string]string{}
+		}
+		headers[envelopeHeaderAdapter] = ad.name
+		if job.Tenant != "" {
+			headers[envelopeHeaderTenant] = job.Tenant
+		}
+		env, err := json.Marshal(Envelope{Version: envelopeVersion, Type: messageTypeJob, Headers: headers, Body: raw})
+		if err != nil {
+			return m, err
+		}
+		m.Body = aws.String(string(env))
+		return m, nil
+	}
+	return m, nil
+}
+
+// matches reports whether every attribute and match condition holds.
+func (ad messageAdapter) matches(m types.Message, doc any) bool {
+	for name, want := range ad.attributes {
+		if v, ok := m.MessageAttributes[name]; !ok || aws.ToString(v.StringValue) != want {
+			return false
+		}
+	}
+	for _, c := range ad.match {
+		v, ok := c.path.lookup(doc)
+		if !ok {
+			return false
+		}
+		if s, err := scalarString(v); err != nil || s != c.value {
+			return false
+		}
+	}
+	return true
+}
+
+// jobMessage builds the JobMessage for m from its decoded body.
+func (ad messageAdapter) jobMessage(m types.Message, doc any) (JobMessage, error) {
+	var job JobMessage
+	for field, path := range ad.fields {
+		v, ok := path.lookup(doc)
+		if !ok {
+			if field == "text" {
+				return JobMessage{}, fmt.Errorf("text path %s not found", path)
+			}
+			continue
+		}
+		s, err := scalarString(v)
+		if err != nil {
+			return JobMessage{}, fmt.Errorf("%s at %s %w", field, path, err)
+		}
+		switch field {
+		case "id":
+			job.ID = s
+		case "text":
+			job.Text = s
+		case "tenant":
+			job.Tenant = s
+		case "type":
+			job.Type = s
+		case "created_at":
+			t, err := time.Parse(time.RFC3339Nano, s)
+			if err != nil {
+				return JobMessage{}, fmt.Errorf("created_at at %s must be RFC 3339", path)
+			}
+			job.CreatedAt = Timestamp{Time: t.UTC()}
+		}
+	}
+	if job.ID == "" {
+		job.ID = uuid.NewSHA1(uuid.NameSpaceURL, []byte("sqs:"+aws.ToString(m.MessageId))).String()
+	}
+	if job.CreatedAt.IsZero() {
+		job.CreatedAt = Now()
+		if sent := sentTime(m); !sent.IsZero() {
+			job.CreatedAt = Timestamp{Time: sent.UTC()}
+		}
+	}
+	return job, nil
+}
+
+// scalarString returns a string, number or boolean JSON (or YAML) value as
+// a string.
+func scalarString(v any) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	}
+	return "", errors.New("must be a string, number or boolean")
+}
+
+// jsonPath is a parsed path: object keys (string) and array indices (int)
+// from the document root.
+type jsonPath []any
+
+// parseJSONPath parses "$" followed by .name, ['name'] or [index] steps.
+func parseJSONPath(s string) (jsonPath, error) {
+	rest, ok := strings.CutPrefix(s, "$")
+	if !ok {
+		return nil, fmt.Errorf("path %q must start with $", s)
+	}
+	path := jsonPath{}
+	for rest != "" {
+		switch {
+		case rest[0] == '.':
+			end := strings.IndexAny(rest[1:], ".[") + 1
+			if end == 0 {
+				end = len(rest)
+			}
+			if end == 1 {
+				return nil, fmt.Errorf("path %q has an empty name", s)
+			}
+			path, rest = append(path, rest[1:end]), rest[end:]
+		case strings.HasPrefix(rest, "['"):
+			end := strings.Index(rest, "']")
+			if end < 0 {
+				return nil, fmt.Errorf("path %q has an unclosed ['", s)
+			}
+			path, rest = append(path, rest[2:end]), rest[end+2:]
+		case rest[0] == '[':
+			end := strings.IndexByte(rest, ']')
+			i, err := strconv.Atoi(rest[1:max(end, 1)])
+			if end < 0 || err != nil || i < 0 {
+				return nil, fmt.Errorf("path %q has an invalid index", s)
+			}
+			path, rest = append(path, i), rest[end+1:]
+		default:
+			return nil, fmt.Errorf("path %q: expected . or [ at %q", s, rest)
+		}
+	}
+	return path, nil
+}
+
+// lookup returns the value at p in doc.
+func (p jsonPath) lookup(doc any) (any, bool) {
+	for _, step := range p {
+		switch step := step.(type) {
+		case string:
+			obj, ok := doc.(map[string]any)
+			if !ok {
+				return nil, false
+			}
+			if doc, ok = obj[step]; !ok {
+				return nil, false
+			}
+		case int:
+			arr, ok := doc.([]any)
+			if !ok || step >= len(arr) {
+				return nil, false
+			}
+			doc = arr[step]
+		}
+	}
+	return doc, true
+}
+
+// String renders the path as written.
+func (p jsonPath) String() string {
+	var b strings.Builder
+	b.WriteByte('$')
+	for _, step := range p {
+		switch step := step.(type) {
+		case string:
+			fmt.Fprintf(&b, "['%s']", step)
+		case int:
+			fmt.Fprintf(&b, "[%d]", step)
+		}
+	}
+	return b.String()
+}
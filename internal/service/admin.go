@@ -0,0 +1,71 @@
+// Admin API access control. Operator endpoints under /admin/ require a bearer
+// token matching ADMIN_TOKEN; when the variable is unset the admin API is
+// disabled entirely rather than left open. With the event stream on
+// (eventstream.go), every admin request, refused ones included, is streamed
+// as an audit event.
+package service
+
+import (
+	"cmp"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// errCodeForbidden is returned when a caller may not use an endpoint.
+const errCodeForbidden = "forbidden"
+
+// requireAdmin wraps next so it only runs for requests bearing the admin token.
+func (a *App) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !a.isAdmin(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			writeError(w, http.StatusForbidden, ErrorDetail{Code: errCodeForbidden, Message: "admin token required"})
+			a.stream.recordAdmin(r, auditAdminDenied, http.StatusForbidden)
+			return
+		}
+		if a.stream == nil {
+			next(w, r)
+			return
+		}
+		sw := &statusWriter{ResponseWriter: w}
+		next(sw, r)
+		a.stream.recordAdmin(r, auditAdminRequest, cmp.Or(sw.status, http.StatusOK))
+	}
+}
+
+// statusWriter records the status of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int // 0 until the header is written
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap gives http.ResponseController the underlying writer, for flushes
+// and deadlines.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// isAdmin reports whether r carries "Authorization: Bearer <ADMIN_TOKEN>".
+// Always false when no admin token is configured.
+func (a *App) isAdmin(r *http.Request) bool {
+	if a.adminToken == "" {
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(a.adminToken)) == 1
+}
@@ -0,0 +1,131 @@
+// Load balancer draining on shutdown. An ALB keeps routing to a target until
+// its health checks fail or it is deregistered, so a process that closes its
+// listeners as soon as SIGTERM arrives drops the requests still in flight
+// from the load balancer. On shutdown the service instead:
+//
+//  1. fails /readyz ("draining"), so health checks take it out of rotation;
+//  2. with ALB_TARGET_GROUP_ARN set, deregisters itself from the target group
+//     (the task's IP from ECS task metadata, or ALB_TARGET_ID) so the ALB
+//     stops sending new connections right away;
+//  3. keeps serving for SHUTDOWN_DRAIN_DELAY while the ALB converges, and
+//     only then closes the listeners and drains in-flight requests.
+//
+// Deregistration failure is logged and shutdown continues: the health check
+// still takes the target out, only more slowly.
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	elbv2 "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2"
+	elbtypes "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2/types"
+)
+
+// ecsMetadataTimeout bounds the ECS task metadata lookup.
+const ecsMetadataTimeout = 2 * time.Second
+
+// albTarget identifies this process in an ALB target group.
+type albTarget struct {
+	client         *elbv2.Client
+	targetGroupARN string
+	id             string // IP (awsvpc tasks) or instance ID
+	port           int32
+}
+
+// newALBTarget returns the target to deregister on shutdown, or nil when
+// ALB_TARGET_GROUP_ARN is unset. The target ID is resolved lazily so startup
+// does not depend on the metadata endpoint.
+func newALBTarget(cfg aws.Config) *albTarget {
+	arn := getenv("ALB_TARGET_GROUP_ARN")
+	if arn == "" {
+		return nil
+	}
+	return &albTarget{
+		client:         elbv2.NewFromConfig(cfg),
+		targetGroupARN: arn,
+		id:             getenv("ALB_TARGET_ID"),
+		port:           int32(envInt("ALB_TARGET_PORT", 8080)),
+	}
+}
+
+// deregister removes the target from its target group.
+func (t *albTarget) deregister(ctx context.Context) error {
+	if t.id == "" {
+		ip, err := ecsTaskIP(ctx)
+		if err != nil {
+			return fmt.Errorf("resolve target ID: %w", err)
+		}
+		t.id = ip
+	}
+	ctx, cancel := context.WithTimeout(ctx, awsOpTimeout)
+	defer cancel()
+	_, err := t.client.DeregisterTargets(ctx, &elbv2.DeregisterTargetsInput{
+		TargetGroupArn: aws.String(t.targetGroupARN),
+		Targets:        []elbtypes.TargetDescription{{Id: aws.String(t.id), Port: aws.Int32(t.port)}},
+	})
+	return err
+}
+
+// ecsTaskIP returns this container's IPv4 address from the ECS task metadata
+// endpoint (v4). The endpoint is link-local, so it is called directly rather
+// than through the outbound proxy.
+func ecsTaskIP(ctx context.Context) (string, error) {
+	uri := os.Getenv("ECS_CONTAINER_METADATA_URI_V4")
+	if uri == "" {
+		return "", errors.New("not running on ECS; set ALB_TARGET_ID")
+	}
+	ctx, cancel := context.WithTimeout(ctx, ecsMetadataTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := (&http.Client{}).Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("task metadata: %s", resp.Status)
+	}
+	var meta struct {
+		Networks []struct {
+			IPv4Addresses []string `json:"IPv4Addresses"`
+		} `json:"Networks"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&meta); err != nil {
+		return "", fmt.Errorf("decode task metadata: %w", err)
+	}
+	for _, n := range meta.Networks {
+		if len(n.IPv4Addresses) > 0 {
+			return n.IPv4Addresses[0], nil
+		}
+	}
+	return "", errors.New("task metadata has no IPv4 address")
+}
+
+// drain takes the process out of load balancing before the listeners close:
+// readiness fails, the target is deregistered, and the listeners keep
+// serving for delay.
+func (a *App) drain(delay time.Duration) {
+	a.draining.Store(true)
+	if a.albTarget != nil {
+		if err := a.albTarget.deregister(context.Background()); err != nil {
+			slog.Error("failed to deregister from target group, relying on health checks", "target_group", a.albTarget.targetGroupARN, "error", err)
+		} else {
+			slog.Info("deregistered from target group", "target_group", a.albTarget.targetGroupARN, "target", a.albTarget.id)
+		}
+	}
+	if delay > 0 {
+		slog.Info("draining before closing listeners", "delay", delay)
+		time.Sleep(delay)
+	}
+}
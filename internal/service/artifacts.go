@@ -0,0 +1,172 @@
+// Job artifacts: named files a processor attaches to a result alongside the
+// Output string (e.g. summary.json, tokens.txt). They are stored under
+// jobs/{id}/artifacts/{name} before the result itself, so a visible result
+// always has its artifacts, and are served by GET /jobs/{id}/artifacts (a
+// listing with download links) and GET /jobs/{id}/artifacts/{name}.
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// maxArtifactNameLen bounds artifact names.
+const maxArtifactNameLen = 128
+
+// Artifact is a named file produced by a processor.
+type Artifact struct {
+	Name        string // File name, e.g. "summary.json"
+	ContentType string // MIME type; application/octet-stream when empty
+	Body        []byte // Contents
+}
+
+// ArtifactInfo is one entry in an artifact listing.
+type ArtifactInfo struct {
+	Name      string `json:"name"`       // File name
+	SizeBytes int64  `json:"size_bytes"` // Size in bytes
+	URL       string `json:"url"`        // Download path on this service
+}
+
+// ArtifactListResponse is the GET /jobs/{id}/artifacts response body.
+type ArtifactListResponse struct {
+	ID        string         `json:"id"`        // Job ID
+	Artifacts []ArtifactInfo `json:"artifacts"` // In name order
+}
+
+// artifactsPrefix is the S3 prefix of a job's artifacts.
+func artifactsPrefix(jobID string) string { return fmt.Sprintf("jobs/%s/artifacts/", jobID) }
+
+// validArtifactName reports whether name is usable as a single key segment
+// and download file name: letters, digits, '.', '_' and '-', not starting
+// with '.'.
+func validArtifactName(name string) bool {
+	if name == "" || len(name) > maxArtifactNameLen || name[0] == '.' {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// summaryArtifactName is the name of the built-in processors' artifact.
+const summaryArtifactName = "summary.json"
+
+// summaryArtifact is the summary.json artifact the built-in uppercase
+// processor attaches: basic counts of the input text.
+func summaryArtifact(text string) Artifact {
+	body, _ := json.Marshal(map[string]int{
+		"bytes": len(text),
+		"runes": len([]rune(text)),
+		"words": len(strings.Fields(text)),
+		"lines": strings.Count(text, "\n") + 1,
+	})
+	return Artifact{Name: summaryArtifactName, ContentType: "application/json", Body: body}
+}
+
+// putArtifacts stores a job's artifacts, with their keys under keyPrefix
+// (empty but in dry-run workers), and returns their names. Names must be
+// valid and unique.
+func (a *App) putArtifacts(ctx context.Context, keyPrefix, jobID string, artifacts []Artifact) ([]string, error) {
+	names := make([]string, 0, len(artifacts))
+	seen := make(map[string]bool, len(artifacts))
+	for _, art := range artifacts {
+		if !validArtifactName(art.Name) || seen[art.Name] {
+			return nil, fmt.Errorf("invalid or duplicate artifact name %q", art.Name)
+		}
+		seen[art.Name] = true
+		contentType := art.ContentType
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		putCtx, cancel := context.WithTimeout(ctx, awsOpTimeout)
+		err := a.store.Put(putCtx, keyPrefix+artifactsPrefix(jobID)+art.Name, art.Body, PutOptions{ContentType: contentType})
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("put artifact %s: %w", art.Name, err)
+		}
+		names = append(names, art.Name)
+	}
+	return names, nil
+}
+
+// listArtifacts handles GET /jobs/{id}/artifacts requests.
+// Returns the job's artifacts with download links, or 404 when the job has no
+// result.
+func (a *App) listArtifacts(w http.ResponseWriter, r *http.Request) {
+	jobID, ok := a.pathJobID(w, r)
+	if !ok {
+		return
+	}
+	resp := ArtifactListResponse{ID: jobID, Artifacts: []ArtifactInfo{}}
+	err := a.listObjects(r.Context(), artifactsPrefix(jobID), func(obj ObjectInfo) error {
+		name := path.Base(obj.Key)
+		resp.Artifacts = append(resp.Artifacts, ArtifactInfo{
+			Name:      name,
+			SizeBytes: obj.Size,
+			URL:       apiV1 + "/jobs/" + jobID + "/artifacts/" + name,
+		})
+		return nil
+	})
+	if err != nil {
+		writeStorageError(r.Context(), w, "ListObjectsV2", "failed to list artifacts", err)
+		return
+	}
+	if len(resp.Artifacts) == 0 {
+		// Distinguish "no artifacts" from "no such job".
+		exists, err := a.objectExists(r.Context(), fmt.Sprintf("jobs/%s.json", jobID))
+		if err != nil {
+			writeStorageError(r.Context(), w, "HeadObject", "failed to look up job", err)
+			return
+		}
+		if !exists {
+			http.Error(w, "job not found", http.StatusNotFound)
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// getArtifact handles GET /jobs/{id}/artifacts/{name} requests.
+// Streams the artifact with its stored content type as an attachment.
+func (a *App) getArtifact(w http.ResponseWriter, r *http.Request) {
+	jobID, ok := a.pathJobID(w, r)
+	if !ok {
+		return
+	}
+	name := r.PathValue("name")
+	if !validArtifactName(name) {
+		http.Error(w, "artifact not found", http.StatusNotFound)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), awsOpTimeout)
+	defer cancel()
+	body, info, err := a.store.Get(ctx, artifactsPrefix(jobID)+name)
+	if err != nil {
+		if classifyS3Error(err).Kind == s3NotFound {
+			http.Error(w, "artifact not found", http.StatusNotFound)
+			return
+		}
+		writeStorageError(r.Context(), w, "GetObject", "failed to read artifact", err)
+		return
+	}
+	defer body.Close()
+
+	w.Header().Set("Content-Type", info.ContentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	if _, err := io.Copy(w, body); err != nil && !errors.Is(err, context.Canceled) {
+		slog.WarnContext(ctx, "failed to stream artifact", "job_id", jobID, "artifact", name, "error", err)
+	}
+}
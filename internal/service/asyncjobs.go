@@ -0,0 +1,116 @@
+// Asynchronous request semantics for job creation (RFC 9110 §15.3.3, RFC
+// 7240). By default POST /jobs answers 201 with the new job's ID. A request
+// with "Prefer: respond-async", or every request under
+// JOB_CREATE_RESPONSE=async, instead gets 202 Accepted with
+//
+//	Location: /v1/jobs/{id}/status?redirect=true
+//
+// (and Preference-Applied: respond-async when it asked), the body unchanged.
+// The same goes for PUT /jobs/{id}, and for a duplicate or replayed
+// submission, which points at the original job. The Location is a status
+// monitor that generic HTTP clients can poll until it redirects:
+//
+//	queued, processing   200 with the status and Retry-After
+//	failed               the same while SQS may still redeliver it
+//	completed            303 See Other, Location: /v1/jobs/{id} (the result)
+//	final otherwise      303 See Other, Location: /v1/jobs/{id}/status
+//
+// A job is final once cancelled or deleted, once failed with MAX_ATTEMPTS
+// used up, and in any state once it is older than SQS keeps a message: its
+// message can no longer arrive, whatever MAX_ATTEMPTS or the queue's own
+// redrive policy say. A client following the redirect lands on the plain
+// status, a 200 carrying the final status and error, so every poll ends in a
+// redirect. Both 303s carry the status as their body too.
+//
+// Without redirect=true, GET /jobs/{id}/status answers as it always has.
+package service
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// JOB_CREATE_RESPONSE values.
+const (
+	createResponseCreated = "created"
+	createResponseAsync   = "async"
+)
+
+// preferRespondAsync is the RFC 7240 preference for an asynchronous answer.
+const preferRespondAsync = "respond-async"
+
+// monitorRetryAfter is the Retry-After of a status monitor poll for a job
+// still under way.
+const monitorRetryAfter = 2 * time.Second
+
+// sqsMaxRetention is the longest SQS keeps a message. A job older than that
+// will not run again.
+const sqsMaxRetention = 14 * 24 * time.Hour
+
+// jobMonitorURL is where a 202 from job creation says to poll.
+func jobMonitorURL(jobID string) string {
+	return "/v1/jobs/" + jobID + "/status?redirect=true"
+}
+
+// prefersAsync reports whether r carries "Prefer: respond-async".
+func prefersAsync(r *http.Request) bool {
+	for _, v := range r.Header.Values("Prefer") {
+		for pref := range strings.SplitSeq(v, ",") {
+			name, _, _ := strings.Cut(pref, ";")
+			if strings.EqualFold(strings.TrimSpace(name), preferRespondAsync) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeCreateResponse answers a job submission with resp and status: as is,
+// or as 202 pointing at the job's status monitor when the request or
+// JOB_CREATE_RESPONSE asks for asynchronous semantics.
+func (a *App) writeCreateResponse(w http.ResponseWriter, r *http.Request, status int, resp CreateJobResponse) {
+	asked := prefersAsync(r)
+	if asked || a.conf.JobCreateResponse == createResponseAsync {
+		if asked {
+			w.Header().Set("Preference-Applied", preferRespondAsync)
+		}
+		w.Header().Set("Location", jobMonitorURL(resp.ID))
+		status = http.StatusAccepted
+	}
+	writeJSON(w, status, resp)
+}
+
+// writeJobMonitor answers a GET /jobs/{id}/status?redirect=true poll for
+// status.
+func (a *App) writeJobMonitor(w http.ResponseWriter, status JobStatus) {
+	switch {
+	case status.Status == statusCompleted:
+		w.Header().Set("Location", "/v1/jobs/"+status.ID)
+		writeJSON(w, http.StatusSeeOther, status)
+	case a.finalStatus(status):
+		w.Header().Set("Location", "/v1/jobs/"+status.ID+"/status")
+		writeJSON(w, http.StatusSeeOther, status)
+	default:
+		w.Header().Set("Retry-After", strconv.Itoa(int(monitorRetryAfter.Seconds())))
+		writeJSON(w, http.StatusOK, status)
+	}
+}
+
+// finalStatus reports whether a job that has not completed never will.
+func (a *App) finalStatus(status JobStatus) bool {
+	switch status.Status {
+	case statusCancelled, statusDeleted:
+		return true
+	case statusFailed:
+		if a.retries.exhausted(status.Attempt) {
+			return true
+		}
+	}
+	since := status.CreatedAt
+	if since.IsZero() {
+		since = status.UpdatedAt
+	}
+	return !since.IsZero() && Now().Sub(since.Time) > sqsMaxRetention
+}
@@ -0,0 +1,55 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWriteJobMonitor(t *testing.T) {
+	a := &App{retries: retryPolicy{maxAttempts: 3}}
+	recent := Timestamp{Time: Now().Add(-time.Hour)}
+	expired := Timestamp{Time: Now().Add(-sqsMaxRetention - time.Hour)}
+	const id = "6f1c2b0e-3f4a-4b8e-9d2a-1c5e7f9a0b3d"
+	for _, tc := range []struct {
+		name       string
+		status     JobStatus
+		code       int
+		location   string
+		retryAfter bool
+	}{
+		{"queued", JobStatus{Status: statusQueued, CreatedAt: recent}, http.StatusOK, "", true},
+		{"processing", JobStatus{Status: statusProcessing, CreatedAt: recent, Attempt: 1}, http.StatusOK, "", true},
+		{"failed with attempts left", JobStatus{Status: statusFailed, CreatedAt: recent, Attempt: 2}, http.StatusOK, "", true},
+		{"completed", JobStatus{Status: statusCompleted, CreatedAt: recent}, http.StatusSeeOther, "/v1/jobs/" + id, false},
+		{"failed after MAX_ATTEMPTS", JobStatus{Status: statusFailed, CreatedAt: recent, Attempt: 3}, http.StatusSeeOther, "/v1/jobs/" + id + "/status", false},
+		{"cancelled", JobStatus{Status: statusCancelled, CreatedAt: recent}, http.StatusSeeOther, "/v1/jobs/" + id + "/status", false},
+		{"deleted", JobStatus{Status: statusDeleted, CreatedAt: recent}, http.StatusSeeOther, "/v1/jobs/" + id + "/status", false},
+		{"queued past SQS retention", JobStatus{Status: statusQueued, CreatedAt: expired}, http.StatusSeeOther, "/v1/jobs/" + id + "/status", false},
+		{"failed past SQS retention", JobStatus{Status: statusFailed, UpdatedAt: expired, Attempt: 1}, http.StatusSeeOther, "/v1/jobs/" + id + "/status", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.status.ID = id
+			w := httptest.NewRecorder()
+			a.writeJobMonitor(w, tc.status)
+			if w.Code != tc.code {
+				t.Errorf("status code = %d, want %d", w.Code, tc.code)
+			}
+			if got := w.Header().Get("Location"); got != tc.location {
+				t.Errorf("Location = %q, want %q", got, tc.location)
+			}
+			if got := w.Header().Get("Retry-After") != ""; got != tc.retryAfter {
+				t.Errorf("Retry-After sent = %v, want %v", got, tc.retryAfter)
+			}
+		})
+	}
+
+	// Without MAX_ATTEMPTS, a failed job may be retried until SQS drops it.
+	unlimited := &App{retries: retryPolicy{}}
+	w := httptest.NewRecorder()
+	unlimited.writeJobMonitor(w, JobStatus{ID: id, Status: statusFailed, CreatedAt: recent, Attempt: 50})
+	if w.Code != http.StatusOK || w.Header().Get("Retry-After") == "" {
+		t.Errorf("failed job without MAX_ATTEMPTS answered %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+}
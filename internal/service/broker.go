@@ -0,0 +1,130 @@
+// In-process pub/sub for job lifecycle events. createJob publishes enqueued
+// events and the worker publishes completed and failed ones; features that
+// push job progress to clients (server-sent events, long-poll waits,
+// WebSockets, webhooks) subscribe instead of polling S3. Delivery is
+// at-most-once: publishing never blocks, each subscriber has a bounded
+// buffer, and a subscriber whose buffer is full is evicted (its channel
+// closed) rather than slowing the publisher or silently missing events.
+// Events only reach subscribers in the same process — in a split deployment
+// the API does not see the worker's events.
+package service
+
+import (
+	"context"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// defaultSubscriberBuffer is the per-subscriber buffer when subscribe is
+// given none.
+const defaultSubscriberBuffer = 64
+
+// JobEvent is a job lifecycle event.
+type JobEvent struct {
+	Type   jobEvent  `json:"type"`            // enqueued, completed or failed
+	JobID  string    `json:"job_id"`          // Job the event is about
+	Tenant string    `json:"tenant"`          // Submitting tenant
+	At     Timestamp `json:"at"`              // When the event happened
+	Error  string    `json:"error,omitempty"` // Failure reason, for failed events
+}
+
+// subscription is one subscriber's event stream.
+type subscription struct {
+	events  chan JobEvent
+	filter  func(JobEvent) bool // nil accepts every event
+	evicted bool                // Closed because the buffer filled; guarded by broker.mu
+}
+
+// Events returns the subscriber's channel. It is closed when the subscription
+// is cancelled or evicted.
+func (s *subscription) Events() <-chan JobEvent {
+	return s.events
+}
+
+// eventBroker fans job events out to subscribers. Safe for concurrent use.
+type eventBroker struct {
+	mu    sync.Mutex
+	subs  map[*subscription]struct{}
+	sinks []func(context.Context, JobEvent) // Given every event; never evicted
+}
+
+// newEventBroker returns a broker with no subscribers.
+func newEventBroker() *eventBroker {
+	return &eventBroker{subs: make(map[*subscription]struct{})}
+}
+
+// subscribe registers a subscriber for events matching filter (nil for all)
+// with a buffer of size events (defaultSubscriberBuffer when size <= 0). The
+// returned cancel function unsubscribes; it is safe to call more than once
+// and after eviction.
+func (b *eventBroker) subscribe(filter func(JobEvent) bool, size int) (*subscription, func()) {
+	if size <= 0 {
+		size = defaultSubscriberBuffer
+	}
+	s := &subscription{events: make(chan JobEvent, size), filter: filter}
+	b.mu.Lock()
+	b.subs[s] = struct{}{}
+	b.mu.Unlock()
+	brokerSubscribers.Add(context.Background(), 1)
+	return s, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.removeLocked(context.Background(), s, false)
+	}
+}
+
+// addSink has fn called with every event published from now on. fn must not
+// block; unlike a subscriber it is never evicted.
+func (b *eventBroker) addSink(fn func(context.Context, JobEvent)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sinks = append(b.sinks, fn)
+}
+
+// removeLocked drops s and closes its channel unless already removed. The
+// caller must hold b.mu.
+func (b *eventBroker) removeLocked(ctx context.Context, s *subscription, evict bool) {
+	if _, ok := b.subs[s]; !ok {
+		return
+	}
+	delete(b.subs, s)
+	s.evicted = evict
+	close(s.events)
+	brokerSubscribers.Add(ctx, -1)
+	if evict {
+		brokerEvictions.Add(ctx, 1)
+	}
+}
+
+// wasEvicted reports whether s was closed because it fell behind, as opposed
+// to being cancelled.
+func (b *eventBroker) wasEvicted(s *subscription) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return s.evicted
+}
+
+// publish delivers ev to every matching subscriber without blocking,
+// evicting those whose buffer is full.
+func (b *eventBroker) publish(ctx context.Context, ev JobEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	typeAttr := metric.WithAttributes(attribute.String("type", ev.Type.String()))
+	brokerPublished.Add(ctx, 1, typeAttr)
+	for _, sink := range b.sinks {
+		sink(ctx, ev)
+	}
+	for s := range b.subs {
+		if s.filter != nil && !s.filter(ev) {
+			continue
+		}
+		select {
+		case s.events <- ev:
+			brokerDelivered.Add(ctx, 1, typeAttr)
+		default:
+			b.removeLocked(ctx, s, true)
+		}
+	}
+}
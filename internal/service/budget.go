@@ -0,0 +1,274 @@
+// Daily AWS cost guardrails. SQS and S3 bill per request and data leaving
+// AWS bills per byte, so a busy loop — a worker polling an empty queue with
+// short waits, a retry storm, a runaway scan — can run up a bill long before
+// anyone looks. The budgets cap what one process may spend per UTC day:
+//
+//	AWS_BUDGET_SQS_CALLS       SQS requests, every retry attempt counted
+//	AWS_BUDGET_S3_CALLS        S3 requests, likewise
+//	AWS_BUDGET_TRANSFER_BYTES  request plus response bodies of those calls, an
+//	                           estimate of data transfer (same-region traffic
+//	                           is free, so this overstates it there)
+//
+// Each is unset (0) by default; setting any turns the guardrails on. They are
+// per process: split an account-wide budget over the tasks that run.
+//
+// A budget past AWS_BUDGET_WARN_PERCENT (default 80) logs a warning, and one
+// used up logs an error, once each per day, both counted in
+// aws.budget.alerts{budget,level}. The worker then polls less often: its wait
+// before each receive grows from nothing at the warning level to
+// AWS_BUDGET_MAX_POLL_DELAY (default 5m) at 100% of the SQS budget, and stays
+// there while it is used up. Calls are never refused — a used-up budget
+// slows the service rather than stopping it. Usage resets at midnight UTC
+// and is shown at GET /admin/budgets.
+package service
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Budget names, as used in settings, metrics and the report.
+const (
+	budgetSQSCalls      = "sqs_calls"
+	budgetS3Calls       = "s3_calls"
+	budgetTransferBytes = "transfer_bytes"
+)
+
+// Budget states in the report and alerts.
+const (
+	budgetOK        = "ok"
+	budgetWarning   = "warning"
+	budgetExhausted = "exhausted"
+)
+
+// budgetIdleSQSCalls is the SQS calls a day of 20-second long polls on an
+// empty queue makes: the least a worker needs to stay responsive.
+const budgetIdleSQSCalls = 24 * 60 * 3
+
+// budgetNames orders the budgets in the report.
+var budgetNames = []string{budgetSQSCalls, budgetS3Calls, budgetTransferBytes}
+
+// awsBudget meters AWS calls against the daily budgets. Safe for concurrent
+// use.
+type awsBudget struct {
+	limits       map[string]int64 // By budget; 0 for none
+	warnAt       float64          // AWS_BUDGET_WARN_PERCENT as a share
+	maxPollDelay time.Duration    // AWS_BUDGET_MAX_POLL_DELAY
+
+	mu      sync.Mutex
+	day     time.Time         // Midnight UTC of the day being counted
+	used    map[string]int64  // By budget, today
+	alerted map[string]string // Highest state alerted today, by budget
+}
+
+// newAWSBudget returns the budgets configured by the AWS_BUDGET_* variables,
+// or nil when none is set.
+func newAWSBudget() (*awsBudget, error) {
+	b := &awsBudget{
+		limits: map[string]int64{
+			budgetSQSCalls:      int64(envInt("AWS_BUDGET_SQS_CALLS", 0)),
+			budgetS3Calls:       int64(envInt("AWS_BUDGET_S3_CALLS", 0)),
+			budgetTransferBytes: int64(envInt("AWS_BUDGET_TRANSFER_BYTES", 0)),
+		},
+		warnAt:       envFloat("AWS_BUDGET_WARN_PERCENT", 80) / 100,
+		maxPollDelay: envDuration("AWS_BUDGET_MAX_POLL_DELAY", 5*time.Minute),
+		used:         map[string]int64{},
+		alerted:      map[string]string{},
+	}
+	enabled := false
+	for name, limit := range b.limits {
+		if limit < 0 {
+			return nil, fmt.Errorf("the %s budget must not be negative", name)
+		}
+		enabled = enabled || limit > 0
+	}
+	if !enabled {
+		return nil, nil
+	}
+	if b.warnAt <= 0 || b.warnAt > 1 {
+		return nil, fmt.Errorf("AWS_BUDGET_WARN_PERCENT must be between 0 and 100")
+	}
+	if b.maxPollDelay < 0 {
+		return nil, fmt.Errorf("AWS_BUDGET_MAX_POLL_DELAY must not be negative")
+	}
+	b.day = utcDay(time.Now())
+	return b, nil
+}
+
+// utcDay returns midnight UTC of t's day.
+func utcDay(t time.Time) time.Time {
+	return t.UTC().Truncate(24 * time.Hour)
+}
+
+// apply meters every call of the clients built from apiOptions afterwards.
+func (b *awsBudget) apply(apiOptions *[]func(*middleware.Stack) error) {
+	*apiOptions = append(*apiOptions, func(stack *middleware.Stack) error {
+		// Inside the retry loop: AWS bills every attempt.
+		return stack.Deserialize.Add(middleware.DeserializeMiddlewareFunc("CostBudget", b.handleDeserialize), middleware.After)
+	})
+}
+
+// handleDeserialize meters one attempt of an SQS or S3 call. Calls a
+// circuit breaker refused never get here.
+func (b *awsBudget) handleDeserialize(ctx context.Context, in middleware.DeserializeInput, next middleware.DeserializeHandler) (middleware.DeserializeOutput, middleware.Metadata, error) {
+	var calls string
+	switch awsmiddleware.GetServiceID(ctx) {
+	case sqs.ServiceID:
+		calls = budgetSQSCalls
+	case s3.ServiceID:
+		calls = budgetS3Calls
+	default:
+		return next.HandleDeserialize(ctx, in)
+	}
+	var bytes int64
+	if req, ok := in.Request.(*smithyhttp.Request); ok {
+		if n, ok, _ := req.StreamLength(); ok {
+			bytes += n
+		}
+	}
+	out, md, err := next.HandleDeserialize(ctx, in)
+	if resp, ok := out.RawResponse.(*smithyhttp.Response); ok && resp.ContentLength > 0 {
+		bytes += resp.ContentLength
+	}
+	b.add(ctx, calls, 1)
+	b.add(ctx, budgetTransferBytes, bytes)
+	return out, md, err
+}
+
+// add counts n against budget, alerting when it crosses a threshold.
+func (b *awsBudget) add(ctx context.Context, budget string, n int64) {
+	if n == 0 {
+		return
+	}
+	budgetConsumed.Add(ctx, n, metric.WithAttributes(attribute.String("budget", budget)))
+	b.mu.Lock()
+	b.rollover(time.Now())
+	b.used[budget] += n
+	used, limit := b.used[budget], b.limits[budget]
+	state := b.state(budget)
+	alert := state != budgetOK && state != b.alerted[budget]
+	if alert {
+		b.alerted[budget] = state
+	}
+	b.mu.Unlock()
+	if !alert {
+		return
+	}
+	budgetAlerts.Add(ctx, 1, metric.WithAttributes(attribute.String("budget", budget), attribute.String("level", state)))
+	if state == budgetExhausted {
+		slog.ErrorContext(ctx, "AWS budget used up for today; the worker polls at its slowest", "budget", budget,
+			"used", used, "limit", limit, "poll_delay", b.maxPollDelay.String())
+		return
+	}
+	slog.WarnContext(ctx, "AWS budget nearly used up for today; the worker polls less often", "budget", budget,
+		"used", used, "limit", limit, "warn_percent", b.warnAt*100)
+}
+
+// rollover starts a new day's counts once t is past the current day; b.mu
+// must be held.
+func (b *awsBudget) rollover(t time.Time) {
+	if day := utcDay(t); day.After(b.day) {
+		b.day = day
+		clear(b.used)
+		clear(b.alerted)
+	}
+}
+
+// state returns budget's state; b.mu must be held.
+func (b *awsBudget) state(budget string) string {
+	limit := b.limits[budget]
+	switch used := b.used[budget]; {
+	case limit == 0:
+		return budgetOK
+	case used >= limit:
+		return budgetExhausted
+	case float64(used) >= b.warnAt*float64(limit):
+		return budgetWarning
+	}
+	return budgetOK
+}
+
+// pollDelay returns how long the worker waits before its next receive: 0
+// below the warning level of the SQS budget, rising linearly to
+// maxPollDelay when it is used up. A nil budget never delays.
+func (b *awsBudget) pollDelay() time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rollover(time.Now())
+	limit := b.limits[budgetSQSCalls]
+	if limit == 0 {
+		return 0
+	}
+	share := float64(b.used[budgetSQSCalls]) / float64(limit)
+	if share < b.warnAt {
+		return 0
+	}
+	if share >= 1 {
+		return b.maxPollDelay
+	}
+	return time.Duration((share - b.warnAt) / (1 - b.warnAt) * float64(b.maxPollDelay))
+}
+
+// BudgetReport is the GET /admin/budgets response.
+type BudgetReport struct {
+	Day         string        `json:"day"`           // UTC date counted, YYYY-MM-DD
+	ResetsAt    Timestamp     `json:"resets_at"`     // Next midnight UTC
+	WarnPercent float64       `json:"warn_percent"`  // AWS_BUDGET_WARN_PERCENT
+	PollDelayMs int64         `json:"poll_delay_ms"` // The worker's current wait before each receive
+	Budgets     []BudgetUsage `json:"budgets"`
+}
+
+// BudgetUsage is one budget's consumption today.
+type BudgetUsage struct {
+	Name    string  `json:"name"`              // sqs_calls, s3_calls or transfer_bytes
+	Used    int64   `json:"used"`              // Calls, or bytes
+	Limit   int64   `json:"limit,omitempty"`   // Absent when unset
+	Percent float64 `json:"percent,omitempty"` // Of limit
+	State   string  `json:"state"`             // ok, warning or exhausted
+}
+
+// report returns today's consumption.
+func (b *awsBudget) report() BudgetReport {
+	delay := b.pollDelay()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	rep := BudgetReport{
+		Day:         b.day.Format(time.DateOnly),
+		ResetsAt:    Timestamp{Time: b.day.Add(24 * time.Hour)},
+		WarnPercent: b.warnAt * 100,
+		PollDelayMs: delay.Milliseconds(),
+	}
+	for _, name := range budgetNames {
+		u := BudgetUsage{Name: name, Used: b.used[name], Limit: b.limits[name], State: b.state(name)}
+		if u.Limit > 0 {
+			u.Percent = float64(u.Used) * 100 / float64(u.Limit)
+		}
+		rep.Budgets = append(rep.Budgets, u)
+	}
+	return rep
+}
+
+// getBudgets handles GET /admin/budgets requests.
+// → 200 BudgetReport; 404 when no budget is set.
+func (a *App) getBudgets(w http.ResponseWriter, r *http.Request) {
+	if a.budget == nil {
+		http.Error(w, "AWS budgets disabled", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, a.budget.report())
+}
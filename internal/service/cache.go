@@ -0,0 +1,225 @@
+// In-memory cache of completed job results. Results are immutable once the
+// worker has written them, so GET /jobs/{id} can serve repeat reads without
+// another S3 call and keep answering while S3 is unavailable. Misses are
+// coalesced: a burst of pollers waiting on the same job shares one S3 read.
+// With RESULT_PREFETCH=true, results are also read into the cache as their
+// jobs complete, ahead of the submitter's first GET.
+package service
+
+import (
+	"container/list"
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"golang.org/x/sync/singleflight"
+)
+
+// prefetchConcurrency bounds the S3 reads prefetchResults runs at once.
+const prefetchConcurrency = 8
+
+// Result sources, reported in X-Cache and the results.reads metric.
+const (
+	resultFromCache     = "hit"       // Served from the cache
+	resultFromS3        = "miss"      // This request's own S3 read
+	resultFromCoalesced = "coalesced" // Shared another request's in-flight S3 read
+)
+
+// loadResult returns jobID's result and where it came from: the cache, or S3
+// through fetchShared, so concurrent misses for one job make a single
+// GetObject. Each caller stops waiting when its own ctx ends. Errors are
+// fetchResult's.
+func (a *App) loadResult(ctx context.Context, jobID string) (JobResult, string, error) {
+	if cached, ok := a.results.get(jobID); ok {
+		resultReads.Add(ctx, 1, metric.WithAttributes(attribute.String("source", resultFromCache)))
+		return cached, resultFromCache, nil
+	}
+	select {
+	case <-ctx.Done():
+		return JobResult{}, "", ctx.Err()
+	case res := <-a.fetchShared(ctx, jobID, 0):
+		source := resultFromS3
+		if res.Shared {
+			source = resultFromCoalesced
+		}
+		resultReads.Add(ctx, 1, metric.WithAttributes(attribute.String("source", source)))
+		if res.Err != nil {
+			return JobResult{}, source, res.Err
+		}
+		return res.Val.(JobResult), source, nil
+	}
+}
+
+// fetchShared reads jobID's result from S3 through resultFetches, joining a
+// read already in flight for it, and caches it for ttl (0 for the cache's
+// own TTL). The read is detached from any one caller's cancellation and
+// bounded by awsOpTimeout.
+func (a *App) fetchShared(ctx context.Context, jobID string, ttl time.Duration) <-chan singleflight.Result {
+	return a.resultFetches.DoChan(jobID, func() (any, error) {
+		// A flight that finished just before this one started has filled the cache.
+		if cached, ok := a.results.get(jobID); ok {
+			return cached, nil
+		}
+		fetchCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), awsOpTimeout)
+		defer cancel()
+		result, err := a.fetchResult(fetchCtx, jobID)
+		if err == nil {
+			a.results.putFor(jobID, result, ttl)
+		}
+		return result, err
+	})
+}
+
+// prefetchResults warms the cache with each job's result as it completes,
+// for window: the submitter almost always fetches it within seconds, and the
+// read then costs no S3 call. Completion events come from a.events until ctx
+// is cancelled. Prefetching is best effort — when prefetchConcurrency reads
+// are already running the event is skipped, and if the subscription falls
+// behind it is simply renewed.
+func (a *App) prefetchResults(ctx context.Context, window time.Duration) {
+	slots := make(chan struct{}, prefetchConcurrency)
+	completed := func(ev JobEvent) bool { return ev.Type == eventCompleted }
+	for {
+		sub, unsubscribe := a.events.subscribe(completed, 0)
+	events:
+		for {
+			select {
+			case <-ctx.Done():
+				unsubscribe()
+				return
+			case ev, ok := <-sub.Events():
+				if !ok {
+					break events
+				}
+				select {
+				case slots <- struct{}{}:
+					go func() {
+						defer func() { <-slots }()
+						a.prefetchResult(ctx, ev.JobID, window)
+					}()
+				default:
+					resultPrefetches.Add(ctx, 1, metric.WithAttributes(attribute.String("outcome", "skipped")))
+				}
+			}
+		}
+		unsubscribe()
+	}
+}
+
+// prefetchResult caches jobID's result for window unless it is cached
+// already.
+func (a *App) prefetchResult(ctx context.Context, jobID string, window time.Duration) {
+	outcome := "prefetched"
+	defer func() {
+		resultPrefetches.Add(ctx, 1, metric.WithAttributes(attribute.String("outcome", outcome)))
+	}()
+	if _, ok := a.results.get(jobID); ok {
+		outcome = "cached"
+		return
+	}
+	if res := <-a.fetchShared(ctx, jobID, window); res.Err != nil {
+		outcome = "failed"
+		slog.DebugContext(ctx, "result prefetch failed", "job_id", jobID, "error", res.Err)
+	}
+}
+
+// resultCache is a bounded LRU of JobResults with a per-entry TTL. It is safe
+// for concurrent use. A nil *resultCache is a valid, always-empty cache, so
+// callers need no enabled checks.
+type resultCache struct {
+	mu      sync.Mutex
+	max     int
+	ttl     time.Duration
+	order   *list.List               // front = most recently used
+	entries map[string]*list.Element // job ID -> element holding *cacheEntry
+}
+
+// cacheEntry is a single cached result and its expiry.
+type cacheEntry struct {
+	id      string
+	result  JobResult
+	expires time.Time
+}
+
+// newResultCache returns a cache holding at most max entries for ttl each, or
+// nil (a disabled cache) when max or ttl is not positive.
+func newResultCache(max int, ttl time.Duration) *resultCache {
+	if max <= 0 || ttl <= 0 {
+		return nil
+	}
+	return &resultCache{
+		max:     max,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: make(map[string]*list.Element, max),
+	}
+}
+
+// get returns the cached result for id, if present and not expired.
+func (c *resultCache) get(id string) (JobResult, bool) {
+	if c == nil {
+		return JobResult{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[id]
+	if !ok {
+		return JobResult{}, false
+	}
+	entry := el.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.order.Remove(el)
+		delete(c.entries, id)
+		return JobResult{}, false
+	}
+	c.order.MoveToFront(el)
+	return entry.result, true
+}
+
+// remove drops id's result, e.g. once it has been deleted.
+func (c *resultCache) remove(id string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[id]; ok {
+		c.order.Remove(el)
+		delete(c.entries, id)
+	}
+}
+
+// put stores result under id for the cache's TTL, evicting the least recently
+// used entry when full.
+func (c *resultCache) put(id string, result JobResult) {
+	c.putFor(id, result, 0)
+}
+
+// putFor is put with a shorter lifetime: ttl, or the cache's TTL when ttl is
+// not positive or longer.
+func (c *resultCache) putFor(id string, result JobResult, ttl time.Duration) {
+	if c == nil {
+		return
+	}
+	if ttl <= 0 || ttl > c.ttl {
+		ttl = c.ttl
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expires := time.Now().Add(ttl)
+	if el, ok := c.entries[id]; ok {
+		entry := el.Value.(*cacheEntry)
+		entry.result, entry.expires = result, expires
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[id] = c.order.PushFront(&cacheEntry{id: id, result: result, expires: expires})
+	if c.order.Len() > c.max {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).id)
+	}
+}
@@ -0,0 +1,164 @@
+// Clock skew. Signed page tokens, TTLs, schedules and AWS SigV4 signatures all
+// trust the local clock, and a host whose clock drifts (broken NTP) breaks
+// them in confusing ways: AWS rejects requests signed more than 5 minutes
+// off, and page tokens issued by another replica look expired, or issued in
+// the future.
+//
+// CLOCK_SKEW_TOLERANCE is the drift tolerated between replicas: page tokens
+// are accepted up to that much past their TTL. The trusted time source is AWS
+// itself — every response carries a Date header — read from the service
+// named by CLOCK_SOURCE (s3, the default, or sqs). GET /admin/clock measures
+// the local clock against it, and the startup bucket check logs a warning
+// when the skew exceeds the tolerance. Date has one-second resolution, so
+// the measurement is good to about half a second either way.
+package service
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// sigV4MaxSkew is how far off a SigV4 signature's time may be before AWS
+// rejects the request.
+const sigV4MaxSkew = 5 * time.Minute
+
+// errCodeClockUnavailable means the trusted time source could not be reached.
+const errCodeClockUnavailable = "clock_source_unavailable"
+
+// Clock statuses reported by GET /admin/clock.
+const (
+	clockOK     = "ok"     // Within CLOCK_SKEW_TOLERANCE
+	clockSkewed = "skewed" // Beyond the tolerance: tokens and schedules drift
+	clockUnsafe = "unsafe" // Beyond the SigV4 window: AWS calls are rejected
+)
+
+// clockConfig is the trusted time source and the tolerated skew.
+type clockConfig struct {
+	source    string        // AWS service whose Date header is the reference: s3 or sqs
+	tolerance time.Duration // Skew tolerated between replicas
+}
+
+// newClockConfig returns the settings from CLOCK_SOURCE and
+// CLOCK_SKEW_TOLERANCE.
+func newClockConfig() (clockConfig, error) {
+	c := clockConfig{
+		source:    getenv("CLOCK_SOURCE"),
+		tolerance: max(envDuration("CLOCK_SKEW_TOLERANCE", 30*time.Second), 0),
+	}
+	switch c.source {
+	case "":
+		c.source = "s3"
+	case "s3", "sqs":
+	default:
+		return clockConfig{}, fmt.Errorf("CLOCK_SOURCE must be s3 or sqs, got %q", c.source)
+	}
+	return c, nil
+}
+
+// ClockReport is the GET /admin/clock body.
+type ClockReport struct {
+	Source      string    `json:"source"`        // s3 or sqs
+	LocalTime   Timestamp `json:"local_time"`    // Local clock at the midpoint of the call
+	ServerTime  Timestamp `json:"server_time"`   // The response's Date header (whole seconds)
+	SkewMs      int64     `json:"skew_ms"`       // Local minus server time; positive when the local clock is ahead
+	RoundTripMs int64     `json:"round_trip_ms"` // Duration of the reference call
+	ToleranceMs int64     `json:"tolerance_ms"`  // CLOCK_SKEW_TOLERANCE
+	Status      string    `json:"status"`        // ok, skewed or unsafe
+}
+
+// newClockReport compares the local clock with serverTime, the Date of a
+// response to a call that ran from start to end.
+func newClockReport(cfg clockConfig, serverTime, start, end time.Time) ClockReport {
+	rtt := end.Sub(start)
+	local := start.Add(rtt / 2)
+	// Date is truncated to the second; the middle of that second is the best
+	// estimate.
+	skew := local.Sub(serverTime.Add(500 * time.Millisecond))
+	rep := ClockReport{
+		Source:      cfg.source,
+		LocalTime:   Timestamp{Time: local.UTC()},
+		ServerTime:  Timestamp{Time: serverTime.UTC()},
+		SkewMs:      skew.Milliseconds(),
+		RoundTripMs: rtt.Milliseconds(),
+		ToleranceMs: cfg.tolerance.Milliseconds(),
+		Status:      clockOK,
+	}
+	switch abs := max(skew, -skew); {
+	case abs > sigV4MaxSkew:
+		rep.Status = clockUnsafe
+	case abs > cfg.tolerance:
+		rep.Status = clockSkewed
+	}
+	return rep
+}
+
+// measureClock makes one cheap call to the trusted time source and reports
+// the local clock against its Date.
+func (a *App) measureClock(ctx context.Context) (ClockReport, error) {
+	ctx, cancel := context.WithTimeout(ctx, awsOpTimeout)
+	defer cancel()
+	var md middleware.Metadata
+	start := time.Now()
+	switch a.clock.source {
+	case "":
+		return ClockReport{}, errors.New("no AWS time source: storage and queue are both local")
+	case "sqs":
+		out, err := a.sqsClient.GetQueueAttributes(ctx, &sqs.GetQueueAttributesInput{
+			QueueUrl:       aws.String(a.sqsURL),
+			AttributeNames: []types.QueueAttributeName{types.QueueAttributeNameCreatedTimestamp},
+		})
+		if err != nil {
+			return ClockReport{}, err
+		}
+		md = out.ResultMetadata
+	default:
+		out, err := a.s3Client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(a.s3Bucket)})
+		if err != nil {
+			return ClockReport{}, err
+		}
+		md = out.ResultMetadata
+	}
+	end := time.Now()
+	serverTime, ok := awsmiddleware.GetServerTime(md)
+	if !ok {
+		return ClockReport{}, fmt.Errorf("%s response carried no Date header", a.clock.source)
+	}
+	return newClockReport(a.clock, serverTime, start, end), nil
+}
+
+// checkClockSkew adds a startup hint when the local clock is beyond the
+// tolerance. Failures to measure are left to the startup checks that own
+// those calls.
+func (a *App) checkClockSkew(ctx context.Context, startup *StartupReport) {
+	rep, err := a.measureClock(ctx)
+	if err != nil || rep.Status == clockOK {
+		return
+	}
+	startup.hint("CLOCK_SKEW_TOLERANCE",
+		fmt.Sprintf("the local clock is %dms off the %s clock (%s), beyond the %s tolerance", rep.SkewMs, rep.Source, rep.Status, a.clock.tolerance),
+		"check NTP on the host")
+}
+
+// getClock handles GET /admin/clock requests.
+// → 200 ClockReport; 502 when the time source cannot be reached.
+func (a *App) getClock(w http.ResponseWriter, r *http.Request) {
+	rep, err := a.measureClock(r.Context())
+	if err != nil {
+		slog.WarnContext(r.Context(), "clock check failed", "source", a.clock.source, "error", err)
+		writeError(w, http.StatusBadGateway, ErrorDetail{Code: errCodeClockUnavailable, Message: "failed to reach the " + cmp.Or(a.clock.source, "AWS") + " time source", Retryable: true})
+		return
+	}
+	writeJSON(w, http.StatusOK, rep)
+}
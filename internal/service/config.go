@@ -0,0 +1,510 @@
+// Service configuration. Settings are environment variables, layered:
+//
+//  1. the process environment;
+//  2. CONFIG_FILE, a YAML (.yaml, .yml) or JSON (.json) file mapping setting
+//     names to values, e.g. {"JOB_TIMEOUT": "45s", "WORKER_CONCURRENCY": 4};
+//  3. the APP_PROFILE defaults (profile.go);
+//  4. the built-in defaults.
+//
+// The file and the profile only fill in variables the layer above left
+// unset, so everything reading the environment sees them. The settings Run
+// itself uses are parsed into Config at startup, where every invalid value
+// is reported at once before the process exits; subsystems parse their own
+// (newRetryPolicy, newClockConfig, …) through getenv and the env helpers.
+// Every setting read either way is listed, with secrets redacted, by GET
+// /admin/config.
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.yaml.in/yaml/v2"
+)
+
+// Config is the settings Run reads, parsed and validated. Field tags name
+// the environment variable; secret ones are redacted by GET /admin/config.
+type Config struct {
+	Region           string `env:"AWS_REGION"`
+	EndpointURL      string `env:"AWS_ENDPOINT_URL"`     // Emulator for SQS and S3 (endpoint.go)
+	SQSEndpointURL   string `env:"AWS_ENDPOINT_URL_SQS"` // Overrides AWS_ENDPOINT_URL for SQS
+	S3EndpointURL    string `env:"AWS_ENDPOINT_URL_S3"`  // Overrides AWS_ENDPOINT_URL for S3
+	S3PathStyle      bool   `env:"S3_FORCE_PATH_STYLE"`
+	QueueURL         string `env:"SQS_QUEUE_URL"`
+	QueueBackend     string `env:"QUEUE_BACKEND"` // sqs or memory (queue.go)
+	FIFOGroupBy      string `env:"FIFO_GROUP_BY"` // Request field grouping a FIFO queue's jobs (fifo.go)
+	Bucket           string `env:"S3_BUCKET"`
+	StorageBackend   string `env:"STORAGE_BACKEND"`         // s3 or filesystem (store.go)
+	StorageDir       string `env:"STORAGE_DIR"`             // Root of the filesystem backend
+	StorageDualFrom  string `env:"STORAGE_DUAL_WRITE_FROM"` // Old store written alongside during a migration (dualstore.go)
+	ListenAddrs      string `env:"LISTEN_ADDRS"`            // Empty: defaultListenAddr, or the systemd sockets
+	AdminToken       string `env:"ADMIN_TOKEN" secret:"true"`
+	MirrorToken      string `env:"MIRROR_TOKEN" secret:"true"`
+	PaginationSecret string `env:"PAGINATION_SECRET" secret:"true"`
+
+	PageTokenTTL        time.Duration `env:"PAGE_TOKEN_TTL"`
+	JobTimeout          time.Duration `env:"JOB_TIMEOUT"`
+	WorkerConcurrency   int           `env:"WORKER_CONCURRENCY"`
+	WorkerDryRun        bool          `env:"WORKER_DRY_RUN"`        // Shadow worker: results to WorkerDryRunPrefix, messages left (shadow.go)
+	WorkerDryRunPrefix  string        `env:"WORKER_DRY_RUN_PREFIX"` // Where a shadow worker writes
+	WorkerShutdownGrace time.Duration `env:"WORKER_SHUTDOWN_GRACE"` // Processing allowed to go on after the shutdown signal
+	MaxBodyBytes        int           `env:"MAX_BODY_BYTES"`
+	DuplicateWindow     time.Duration `env:"DUPLICATE_WINDOW"`
+	IdempotencyTTL      time.Duration `env:"IDEMPOTENCY_TTL"`
+	ClientJobIDs        bool          `env:"CLIENT_JOB_IDS"`      // PUT /jobs/{id} creates jobs under the caller's IDs (jobput.go)
+	JobCreateResponse   string        `env:"JOB_CREATE_RESPONSE"` // created, or async: 202 with a status monitor Location (asyncjobs.go)
+	StartupWaitTimeout  time.Duration `env:"STARTUP_WAIT_TIMEOUT"`
+	ShutdownTimeout     time.Duration `env:"SHUTDOWN_TIMEOUT"` // 0: derived from the components
+	ShutdownDrainDelay  time.Duration `env:"SHUTDOWN_DRAIN_DELAY"`
+
+	ResultCacheSize      int           `env:"RESULT_CACHE_SIZE"`
+	ResultCacheTTL       time.Duration `env:"RESULT_CACHE_TTL"`
+	ResultPrefetch       bool          `env:"RESULT_PREFETCH"`
+	ResultPrefetchWindow time.Duration `env:"RESULT_PREFETCH_WINDOW"`
+
+	LoadShedding            bool          `env:"LOAD_SHEDDING"`
+	IntakeThrottle          bool          `env:"INTAKE_THROTTLE"`
+	CaptureProfileOnSIGUSR1 bool          `env:"CAPTURE_PROFILE_ON_SIGUSR1"`
+	ProfileCPUDuration      time.Duration `env:"PROFILE_CPU_DURATION"`
+
+	JanitorInterval       time.Duration `env:"JANITOR_INTERVAL"`
+	JanitorDryRun         bool          `env:"JANITOR_DRY_RUN"`
+	JanitorPayloadGrace   time.Duration `env:"JANITOR_PAYLOAD_GRACE"`
+	JanitorUploadGrace    time.Duration `env:"JANITOR_UPLOAD_GRACE"`
+	JanitorTombstoneGrace time.Duration `env:"JANITOR_TOMBSTONE_GRACE"`
+	JanitorCreateGrace    time.Duration `env:"JANITOR_CREATE_GRACE"`
+	ReconcileInterval     time.Duration `env:"RECONCILE_INTERVAL"`
+	ReconcileRepair       bool          `env:"RECONCILE_REPAIR"`
+	RedriveInterval       time.Duration `env:"REDRIVE_INTERVAL"`
+
+	SQSBufferDir            string        `env:"SQS_BUFFER_DIR"`
+	SQSBufferMaxMessages    int           `env:"SQS_BUFFER_MAX_MESSAGES"`
+	SQSBufferFlushInterval  time.Duration `env:"SQS_BUFFER_FLUSH_INTERVAL"`
+	StorageStatsInterval    time.Duration `env:"STORAGE_STATS_INTERVAL"`
+	StorageStatsPrefixDepth int           `env:"STORAGE_STATS_PREFIX_DEPTH"`
+	StorageStatsMaxObjects  int           `env:"STORAGE_STATS_MAX_OBJECTS"`
+}
+
+// defaultConfig returns the built-in defaults.
+func defaultConfig() Config {
+	return Config{
+		Region:                  "us-east-1",
+		QueueBackend:            queueSQS,
+		JobCreateResponse:       createResponseCreated,
+		StorageBackend:          storageS3,
+		StorageDir:              "data",
+		PageTokenTTL:            24 * time.Hour,
+		JobTimeout:              defaultJobTimeout,
+		WorkerConcurrency:       1,
+		WorkerDryRunPrefix:      "shadow/",
+		MaxBodyBytes:            maxBodyBytes,
+		DuplicateWindow:         10 * time.Second,
+		IdempotencyTTL:          24 * time.Hour,
+		ResultCacheSize:         1000,
+		ResultCacheTTL:          5 * time.Minute,
+		ResultPrefetchWindow:    30 * time.Second,
+		ProfileCPUDuration:      30 * time.Second,
+		JanitorDryRun:           true,
+		JanitorPayloadGrace:     sqsMaxRetention,
+		JanitorUploadGrace:      24 * time.Hour,
+		JanitorTombstoneGrace:   7 * 24 * time.Hour,
+		JanitorCreateGrace:      time.Hour,
+		ReconcileRepair:         true,
+		SQSBufferMaxMessages:    10000,
+		SQSBufferFlushInterval:  5 * time.Second,
+		StorageStatsInterval:    time.Hour,
+		StorageStatsPrefixDepth: 1,
+		StorageStatsMaxObjects:  1_000_000,
+	}
+}
+
+// LoadConfig reads Config from the environment over the defaults and
+// validates it. The error lists every invalid setting.
+func LoadConfig() (Config, error) {
+	c := defaultConfig()
+	var errs []error
+	v := reflect.ValueOf(&c).Elem()
+	for i := range v.NumField() {
+		f := v.Type().Field(i)
+		name := f.Tag.Get("env")
+		field := v.Field(i)
+		def := formatSetting(field)
+		if f.Tag.Get("secret") == "true" {
+			settingsMu.Lock()
+			secretSettings[name] = true
+			settingsMu.Unlock()
+		}
+		recordSetting(name, def)
+		raw := os.Getenv(name)
+		if raw == "" {
+			continue
+		}
+		if err := parseSetting(field, raw); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	errs = append(errs, c.validate()...)
+	return c, errors.Join(errs...)
+}
+
+// parseSetting sets field from its text form.
+func parseSetting(field reflect.Value, raw string) error {
+	switch field.Interface().(type) {
+	case string:
+		field.SetString(raw)
+	case time.Duration:
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q (e.g. 30s, 5m, 24h)", raw)
+		}
+		field.SetInt(int64(d))
+	case int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", raw)
+		}
+		field.SetInt(int64(n))
+	case bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q (true or false)", raw)
+		}
+		field.SetBool(b)
+	default:
+		return fmt.Errorf("unsupported setting type %s", field.Type())
+	}
+	return nil
+}
+
+// formatSetting renders field the way it would be written in the
+// environment.
+func formatSetting(field reflect.Value) string {
+	switch v := field.Interface().(type) {
+	case time.Duration:
+		if v == 0 {
+			return ""
+		}
+		return v.String()
+	case int:
+		return strconv.Itoa(v)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return field.String()
+}
+
+// validate checks values the types alone do not constrain.
+func (c Config) validate() []error {
+	var errs []error
+	required := func(name, v string) {
+		if v == "" {
+			errs = append(errs, fmt.Errorf("%s is required", name))
+		}
+	}
+	atLeast := func(name string, v, lo int) {
+		if v < lo {
+			errs = append(errs, fmt.Errorf("%s must be at least %d, not %d", name, lo, v))
+		}
+	}
+	notNegative := func(name string, d time.Duration) {
+		if d < 0 {
+			errs = append(errs, fmt.Errorf("%s must not be negative, not %s", name, d))
+		}
+	}
+	switch c.QueueBackend {
+	case queueSQS:
+		required("SQS_QUEUE_URL", c.QueueURL)
+	case queueMemory:
+	default:
+		errs = append(errs, fmt.Errorf("QUEUE_BACKEND must be %s or %s, not %q", queueSQS, queueMemory, c.QueueBackend))
+	}
+	if c.JobCreateResponse != createResponseCreated && c.JobCreateResponse != createResponseAsync {
+		errs = append(errs, fmt.Errorf("JOB_CREATE_RESPONSE must be %s or %s, not %q", createResponseCreated, createResponseAsync, c.JobCreateResponse))
+	}
+	if !validFIFOGroupBy(c.FIFOGroupBy) {
+		errs = append(errs, fmt.Errorf("FIFO_GROUP_BY must be %s, %s or %s, not %q", fifoGroupTenant, fifoGroupType, fifoGroupParentID, c.FIFOGroupBy))
+	}
+	for name, v := range map[string]string{
+		"AWS_ENDPOINT_URL": c.EndpointURL, "AWS_ENDPOINT_URL_SQS": c.SQSEndpointURL, "AWS_ENDPOINT_URL_S3": c.S3EndpointURL,
+	} {
+		if err := validEndpoint(name, v); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	switch c.StorageBackend {
+	case storageS3:
+		required("S3_BUCKET", c.Bucket)
+	case storageFilesystem:
+		required("STORAGE_DIR", c.StorageDir)
+	default:
+		errs = append(errs, fmt.Errorf("STORAGE_BACKEND must be %s or %s, not %q", storageS3, storageFilesystem, c.StorageBackend))
+	}
+	if c.StorageDualFrom != "" {
+		backend, location, err := parseStoreURL(c.StorageDualFrom)
+		same := backend == c.StorageBackend &&
+			(backend == storageS3 && location == c.Bucket || backend == storageFilesystem && filepath.Clean(location) == filepath.Clean(c.StorageDir))
+		switch {
+		case err != nil:
+			errs = append(errs, fmt.Errorf("STORAGE_DUAL_WRITE_FROM: %w", err))
+		case same:
+			errs = append(errs, fmt.Errorf("STORAGE_DUAL_WRITE_FROM must name another store than the one STORAGE_BACKEND selects, not %q", c.StorageDualFrom))
+		}
+	}
+	atLeast("WORKER_CONCURRENCY", c.WorkerConcurrency, 1)
+	if c.WorkerDryRun && !validShadowPrefix(c.WorkerDryRunPrefix) {
+		errs = append(errs, fmt.Errorf("WORKER_DRY_RUN_PREFIX must be a key prefix ending in / outside the service's own prefixes, not %q", c.WorkerDryRunPrefix))
+	}
+	atLeast("MAX_BODY_BYTES", c.MaxBodyBytes, 1)
+	atLeast("RESULT_CACHE_SIZE", c.ResultCacheSize, 0)
+	atLeast("SQS_BUFFER_MAX_MESSAGES", c.SQSBufferMaxMessages, 1)
+	atLeast("STORAGE_STATS_PREFIX_DEPTH", c.StorageStatsPrefixDepth, 1)
+	atLeast("STORAGE_STATS_MAX_OBJECTS", c.StorageStatsMaxObjects, 1)
+	if c.JobTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("JOB_TIMEOUT must be positive, not %s", c.JobTimeout))
+	}
+	if c.IdempotencyTTL < time.Minute {
+		errs = append(errs, fmt.Errorf("IDEMPOTENCY_TTL must be at least 1m, not %s", c.IdempotencyTTL))
+	}
+	for name, d := range map[string]time.Duration{
+		"PAGE_TOKEN_TTL": c.PageTokenTTL, "DUPLICATE_WINDOW": c.DuplicateWindow,
+		"STARTUP_WAIT_TIMEOUT": c.StartupWaitTimeout, "SHUTDOWN_TIMEOUT": c.ShutdownTimeout,
+		"SHUTDOWN_DRAIN_DELAY": c.ShutdownDrainDelay, "RESULT_CACHE_TTL": c.ResultCacheTTL,
+		"RESULT_PREFETCH_WINDOW": c.ResultPrefetchWindow, "PROFILE_CPU_DURATION": c.ProfileCPUDuration,
+		"JANITOR_INTERVAL": c.JanitorInterval, "JANITOR_PAYLOAD_GRACE": c.JanitorPayloadGrace,
+		"JANITOR_UPLOAD_GRACE": c.JanitorUploadGrace, "JANITOR_TOMBSTONE_GRACE": c.JanitorTombstoneGrace,
+		"JANITOR_CREATE_GRACE": c.JanitorCreateGrace, "RECONCILE_INTERVAL": c.ReconcileInterval,
+		"REDRIVE_INTERVAL": c.RedriveInterval, "SQS_BUFFER_FLUSH_INTERVAL": c.SQSBufferFlushInterval,
+		"STORAGE_STATS_INTERVAL": c.StorageStatsInterval, "WORKER_SHUTDOWN_GRACE": c.WorkerShutdownGrace,
+	} {
+		notNegative(name, d)
+	}
+	slices.SortFunc(errs, func(a, b error) int { return strings.Compare(a.Error(), b.Error()) })
+	return errs
+}
+
+// Sources of a setting's value, as reported by GET /admin/config.
+const (
+	sourceEnv     = "env"
+	sourceFile    = "file"
+	sourceProfile = "profile"
+	sourceDefault = "default"
+)
+
+// settings records every setting read, for GET /admin/config.
+var (
+	settingsMu     sync.Mutex
+	settingsRead   = map[string]string{} // name → built-in default, as text
+	settingSources = map[string]string{} // name → sourceFile or sourceProfile when one filled it in
+	// secretSettings holds the names always redacted: Config fields tagged
+	// secret, and the secrets read outside Config whose names the patterns
+	// of isSecretSetting miss.
+	secretSettings = map[string]bool{
+		"SCRUB_HASH_KEY": true, // HMAC key of scrubbed values; with it, hashed values can be confirmed by guessing
+	}
+)
+
+// recordSetting notes that name was read with default def.
+func recordSetting(name, def string) {
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	if _, ok := settingsRead[name]; !ok || def != "" {
+		settingsRead[name] = def
+	}
+}
+
+// setSettingSource records that src filled in name.
+func setSettingSource(name, src string) {
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	settingSources[name] = src
+}
+
+// settingSource returns which layer name's value came from.
+func settingSource(name string) string {
+	settingsMu.Lock()
+	src, ok := settingSources[name]
+	settingsMu.Unlock()
+	switch {
+	case ok:
+		return src
+	case os.Getenv(name) != "":
+		return sourceEnv
+	}
+	return sourceDefault
+}
+
+// getenv is os.Getenv for settings: the read is recorded for GET
+// /admin/config.
+func getenv(name string) string {
+	recordSetting(name, "")
+	return os.Getenv(name)
+}
+
+// loadConfigFile applies CONFIG_FILE beneath the process environment. It
+// runs before applyProfile, so file values also take precedence over the
+// profile.
+func loadConfigFile() error {
+	path := os.Getenv("CONFIG_FILE")
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read CONFIG_FILE: %w", err)
+	}
+	values := map[string]any{}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		err = dec.Decode(&values)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &values)
+	default:
+		return fmt.Errorf("CONFIG_FILE must end in .yaml, .yml or .json, not %q", ext)
+	}
+	if err != nil {
+		return fmt.Errorf("parse CONFIG_FILE %s: %w", path, err)
+	}
+	for _, k := range slices.Sorted(maps.Keys(values)) {
+		if !validSettingName(k) {
+			return fmt.Errorf("CONFIG_FILE %s: %q is not a setting name (UPPER_SNAKE_CASE)", path, k)
+		}
+		v, err := scalarString(values[k])
+		if values[k] == nil {
+			v, err = "", nil
+		}
+		if err != nil {
+			return fmt.Errorf("CONFIG_FILE %s: %s %w", path, k, err)
+		}
+		if _, set := os.LookupEnv(k); set {
+			slog.Info("config file setting overridden by environment", "file", path, "name", k)
+			continue
+		}
+		os.Setenv(k, v)
+		setSettingSource(k, sourceFile)
+	}
+	slog.Info("config file applied", "file", path, "settings", len(values))
+	return nil
+}
+
+// validSettingName reports whether k looks like an environment variable
+// setting: upper-case letters, digits and underscores.
+func validSettingName(k string) bool {
+	if k == "" {
+		return false
+	}
+	for _, r := range k {
+		if (r < 'A' || r > 'Z') && (r < '0' || r > '9') && r != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// hintUnreadConfigFile adds a startup hint for each CONFIG_FILE entry no part
+// of the service read during startup — most likely misspelt. Call it once
+// startup is done.
+func hintUnreadConfigFile(rep *StartupReport) {
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	for _, name := range slices.Sorted(maps.Keys(settingSources)) {
+		if _, read := settingsRead[name]; !read && settingSources[name] == sourceFile {
+			rep.hint(name, "CONFIG_FILE sets it but this service does not read it", "check its spelling, or remove it from the file")
+		}
+	}
+}
+
+// isSecretSetting reports whether name's value must be redacted.
+func isSecretSetting(name string) bool {
+	settingsMu.Lock()
+	secret := secretSettings[name]
+	settingsMu.Unlock()
+	if secret {
+		return true
+	}
+	for _, s := range []string{"TOKEN", "SECRET", "PASSWORD", "PRIVATE_KEY", "CREDENTIAL"} {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactSetting returns value as GET /admin/config shows it: secrets
+// replaced, and any password in a URL removed.
+func redactSetting(name, value string) string {
+	if value == "" {
+		return ""
+	}
+	if isSecretSetting(name) {
+		return "[redacted]"
+	}
+	if u, err := url.Parse(value); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), "redacted")
+			return u.String()
+		}
+	}
+	return value
+}
+
+// ConfigSetting is one entry of a ConfigReport.
+type ConfigSetting struct {
+	Name    string `json:"name"`
+	Value   string `json:"value"`             // Effective value; secrets are redacted
+	Default string `json:"default,omitempty"` // Built-in default, where it has a fixed one
+	Source  string `json:"source"`            // env, file, profile or default
+}
+
+// ConfigReport is the GET /admin/config body.
+type ConfigReport struct {
+	File     string          `json:"file,omitempty"`    // CONFIG_FILE
+	Profile  string          `json:"profile,omitempty"` // APP_PROFILE
+	Settings []ConfigSetting `json:"settings"`          // Every setting read, by name
+}
+
+// getConfig handles GET /admin/config requests.
+// Lists every setting the service has read with its effective value (secrets
+// redacted), built-in default and source.
+func (a *App) getConfig(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, configReport())
+}
+
+// configReport returns every setting read so far, secrets redacted.
+func configReport() ConfigReport {
+	settingsMu.Lock()
+	names := slices.Sorted(maps.Keys(settingsRead))
+	defaults := maps.Clone(settingsRead)
+	settingsMu.Unlock()
+
+	rep := ConfigReport{File: os.Getenv("CONFIG_FILE"), Profile: os.Getenv("APP_PROFILE"), Settings: []ConfigSetting{}}
+	for _, name := range names {
+		value := os.Getenv(name)
+		src := settingSource(name)
+		if src == sourceDefault {
+			value = defaults[name]
+		}
+		rep.Settings = append(rep.Settings, ConfigSetting{
+			Name:    name,
+			Value:   redactSetting(name, value),
+			Default: redactSetting(name, defaults[name]),
+			Source:  src,
+		})
+	}
+	return rep
+}
@@ -0,0 +1,163 @@
+// Transactional job creation. POST /jobs touches two systems — S3 (lineage
+// and the job's creation record) and SQS — that cannot share a transaction,
+// so createJob orders the writes to make every failure compensable:
+//
+//  1. write status/{id}.json in state "pending";
+//  2. send the message (or spool it to the send buffer);
+//  3. update the record to "queued" (or "buffered").
+//
+// If step 1 fails nothing was sent; if step 2 fails the record and any
+// lineage are deleted again before the error is returned. A sent SQS message
+// cannot be recalled, so a failed step 3 is only logged: the job runs and
+// produces its result regardless. What compensation itself fails to undo is
+// found by the invariant checker in the janitor: a record still "pending"
+// after the create grace period with no result is a half-created job.
+package service
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// statusPrefix is the key prefix of job creation records.
+const statusPrefix = "status/"
+
+// Creation record states; jobstatus.go maps them to the API's statuses.
+const (
+	createPending    = "pending"    // Record written, message not yet confirmed sent
+	createQueued     = "queued"     // Message sent to SQS
+	createBuffered   = "buffered"   // Message spooled to the local send buffer
+	createProcessing = "processing" // A worker is running the job
+	createCompleted  = "completed"  // Result stored; set by the worker and the reconciler
+	createFailed     = "failed"     // The latest attempt failed; SQS may redeliver
+	createCancelled  = "cancelled"  // Cancelled before it ran; the worker drops the message (jobdelete.go)
+	createDeleted    = "deleted"    // Result deleted with DELETE /jobs/{id}
+)
+
+// errCodeQueueUnavailable means the job could not be enqueued and nothing was
+// kept; the request is safe to retry.
+const errCodeQueueUnavailable = "queue_unavailable"
+
+// queueRetryAfter is the Retry-After hint when enqueueing fails.
+const queueRetryAfter = 5 * time.Second
+
+// JobRecord is a job's creation record, status/{id}.json.
+type JobRecord struct {
+	ID         string    `json:"id"`                   // Job ID
+	State      string    `json:"state"`                // pending, queued, buffered, processing, completed, failed, cancelled or deleted
+	Tenant     string    `json:"tenant"`               // Submitting tenant
+	Type       string    `json:"type,omitempty"`       // Job type; absent on records from before it was kept
+	ParentID   string    `json:"parent_id,omitempty"`  // Lineage parent, so compensation can remove the child marker
+	CreatedAt  Timestamp `json:"created_at"`           // When the job was accepted
+	UpdatedAt  Timestamp `json:"updated_at"`           // Last state change
+	StartedAt  Timestamp `json:"started_at,omitzero"`  // When the latest attempt started (jobstatus.go)
+	FinishedAt Timestamp `json:"finished_at,omitzero"` // When the latest attempt ended
+	Attempt    int       `json:"attempt,omitempty"`    // Delivery attempt of the latest run
+	Error      string    `json:"error,omitempty"`      // Why the latest attempt failed
+
+	FirstReceivedAt Timestamp    `json:"first_received_at,omitzero"` // When SQS first delivered the job's message (deliveries.go)
+	Attempts        []JobAttempt `json:"attempts,omitempty"`         // The latest maxAttemptHistory attempts, oldest first
+
+	CallbackURL string `json:"callback_url,omitempty"` // Where the result is POSTed once stored (webhook.go)
+	Fingerprint string `json:"fingerprint,omitempty"`  // Of a PUT /jobs/{id} submission, to tell its repeats (jobput.go)
+}
+
+// statusKey is the S3 key of a job's creation record.
+func statusKey(id string) string { return statusPrefix + id + ".json" }
+
+// createdKeys lists everything a create writes to S3 for rec, the record
+// first.
+func createdKeys(rec JobRecord) []string {
+	keys := []string{statusKey(rec.ID)}
+	if rec.ParentID != "" {
+		keys = append(keys, lineageNodeKey(rec.ID), lineageChildrenPrefix(rec.ParentID)+rec.ID+".json")
+	}
+	return keys
+}
+
+// putJobRecord writes rec with the given state.
+func (a *App) putJobRecord(ctx context.Context, rec *JobRecord, state string) error {
+	rec.State, rec.UpdatedAt = state, Now()
+	return a.putJSON(ctx, statusKey(rec.ID), rec)
+}
+
+// markEnqueued moves rec out of pending once its message is sent or spooled.
+// Failure is logged only: the message cannot be recalled, and the job's
+// result satisfies the invariant once it runs.
+func (a *App) markEnqueued(ctx context.Context, rec *JobRecord, state string) {
+	if err := a.putJobRecord(ctx, rec, state); err != nil {
+		slog.WarnContext(ctx, "failed to update creation record", "job_id", rec.ID, "state", state, "error", err)
+	}
+}
+
+// compensateCreate undoes the S3 writes of a create whose enqueue failed. It
+// runs detached from the request so a client disconnect cannot interrupt it;
+// what it fails to delete is left for the invariant checker.
+func (a *App) compensateCreate(ctx context.Context, rec JobRecord) {
+	ctx = context.WithoutCancel(ctx)
+	outcome := "compensated"
+	// Lineage before the record, so whatever is left is still discoverable.
+	keys := createdKeys(rec)
+	_, err := a.deleteKeys(ctx, keys[1:])
+	if err == nil {
+		_, err = a.deleteKeys(ctx, keys[:1])
+	}
+	if err != nil {
+		outcome = "failed"
+		slog.ErrorContext(ctx, "create compensation failed, job left half-created", "job_id", rec.ID, "error", err)
+	}
+	createCompensations.Add(ctx, 1, metric.WithAttributes(attribute.String("outcome", outcome)))
+}
+
+// checkHalfCreated is the creation invariant: every record still pending
+// after createGrace must have a result. Records that break it are reported
+// and, outside dry runs, removed along with their lineage.
+func (j *janitor) checkHalfCreated(ctx context.Context, rep *JanitorReport, now time.Time) error {
+	a := j.app
+	var lineage, records []string
+	err := a.listObjects(ctx, statusPrefix, func(obj ObjectInfo) error {
+		if now.Sub(obj.LastModified) < j.cfg.createGrace {
+			return nil
+		}
+		key := obj.Key
+		var rec JobRecord
+		if err := a.getJSON(ctx, key, &rec); err != nil {
+			return err
+		}
+		if rec.State != createPending {
+			return nil
+		}
+		id := strings.TrimSuffix(strings.TrimPrefix(key, statusPrefix), ".json")
+		exists, err := a.objectExists(ctx, fmt.Sprintf("jobs/%s.json", id))
+		if err != nil || exists {
+			return err
+		}
+		slog.WarnContext(ctx, "half-created job", "job_id", id, "created_at", rec.CreatedAt)
+		rep.HalfCreatedJobs.add(key, obj.Size)
+		rec.ID = id
+		keys := createdKeys(rec)
+		records = append(records, keys[0])
+		lineage = append(lineage, keys[1:]...)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if !rep.DryRun {
+		// Lineage first, records last: a record left behind by a failed run is
+		// found again by the next one.
+		if _, err := a.deleteKeys(ctx, lineage); err != nil {
+			return err
+		}
+		n, err := a.deleteKeys(ctx, records)
+		rep.HalfCreatedJobs.Deleted = n
+		return err
+	}
+	return nil
+}
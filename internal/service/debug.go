@@ -0,0 +1,250 @@
+// Per-request debug mode. An admin request (Authorization: Bearer
+// ADMIN_TOKEN) with "X-Debug: true" gets a "_debug" member added to its JSON
+// object response, for latency investigations without a trace backend:
+//
+//	"_debug": {
+//	  "trace_id": "1-6720…",            X-Ray trace of the request
+//	  "total_ms": 41.7,                 handler time
+//	  "phases": [{"name": "validation", "start_ms": 0.1, "duration_ms": 0.3}, …],
+//	  "calls": [{"service": "SQS", "operation": "SendMessage", "request_id": "…",
+//	             "attempts": 1, "start_ms": 12.0, "duration_ms": 25.4}, …]
+//	}
+//
+// Phases are the steps handlers mark with debugPhase (validation, queue
+// send, storage reads and writes); calls are every AWS call the request made,
+// retries included, with the request IDs AWS support asks for. Responses that
+// are not a JSON object, and callers without the admin token, are served as
+// usual. The response is buffered while it is built, so keep the header to
+// investigations.
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go/middleware"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// headerDebug asks for the _debug response section.
+const headerDebug = "X-Debug"
+
+// DebugInfo is the _debug section of a debug-mode response.
+type DebugInfo struct {
+	TraceID string       `json:"trace_id,omitempty"` // X-Ray form
+	TotalMs float64      `json:"total_ms"`           // From the request reaching the service to the response
+	Phases  []DebugPhase `json:"phases"`             // Handler steps, in start order
+	Calls   []DebugCall  `json:"calls"`              // AWS calls, in start order
+}
+
+// DebugPhase is one timed handler step.
+type DebugPhase struct {
+	Name       string  `json:"name"`
+	StartMs    float64 `json:"start_ms"` // Since the request reached the service
+	DurationMs float64 `json:"duration_ms"`
+}
+
+// DebugCall is one AWS call made for the request.
+type DebugCall struct {
+	Service    string  `json:"service"`   // SQS, S3, …
+	Operation  string  `json:"operation"` // SendMessage, GetObject, …
+	RequestID  string  `json:"request_id,omitempty"`
+	HostID     string  `json:"host_id,omitempty"` // S3's x-amz-id-2
+	Attempts   int     `json:"attempts"`          // Retries included
+	StartMs    float64 `json:"start_ms"`
+	DurationMs float64 `json:"duration_ms"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// debugTrace collects the timings of one debug-mode request.
+type debugTrace struct {
+	start time.Time
+
+	mu      sync.Mutex
+	traceID string
+	phases  []DebugPhase
+	calls   []DebugCall
+}
+
+// debugKey is the context key of a request's debugTrace.
+type debugKey struct{}
+
+// debugTraceFrom returns ctx's debugTrace, nil outside debug mode.
+func debugTraceFrom(ctx context.Context) *debugTrace {
+	t, _ := ctx.Value(debugKey{}).(*debugTrace)
+	return t
+}
+
+// sinceStart returns the milliseconds from the request's start to at.
+func (t *debugTrace) sinceStart(at time.Time) float64 {
+	return millis(at.Sub(t.start))
+}
+
+// millis returns d in milliseconds, to the microsecond.
+func millis(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// noteSpan records ctx's trace ID, the first time one is seen.
+func (t *debugTrace) noteSpan(ctx context.Context) {
+	if t.traceID == "" {
+		if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+			t.traceID = xrayTraceID(sc.TraceID())
+		}
+	}
+}
+
+// debugPhase starts timing the handler step name; call the returned function
+// when it ends. Outside debug mode both cost nothing.
+func debugPhase(ctx context.Context, name string) func() {
+	t := debugTraceFrom(ctx)
+	if t == nil {
+		return func() {}
+	}
+	start := time.Now()
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.noteSpan(ctx)
+		t.phases = append(t.phases, DebugPhase{Name: name, StartMs: t.sinceStart(start), DurationMs: millis(time.Since(start))})
+	}
+}
+
+// appendDebugMiddleware records the AWS calls of debug-mode requests, for
+// every client built from the options afterwards.
+func appendDebugMiddleware(apiOptions *[]func(*middleware.Stack) error) {
+	*apiOptions = append(*apiOptions, func(stack *middleware.Stack) error {
+		// Outside the retry loop: one entry per call, with its attempts.
+		return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("DebugTrace", handleDebugCall), middleware.After)
+	})
+}
+
+// handleDebugCall times one SDK call made under a debugTrace.
+func handleDebugCall(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+	t := debugTraceFrom(ctx)
+	if t == nil {
+		return next.HandleInitialize(ctx, in)
+	}
+	start := time.Now()
+	out, md, err := next.HandleInitialize(ctx, in)
+	call := DebugCall{
+		Service:    awsmiddleware.GetServiceID(ctx),
+		Operation:  awsmiddleware.GetOperationName(ctx),
+		Attempts:   1,
+		StartMs:    t.sinceStart(start),
+		DurationMs: millis(time.Since(start)),
+	}
+	call.RequestID, _ = awsmiddleware.GetRequestIDMetadata(md)
+	call.HostID, _ = s3.GetHostIDMetadata(md)
+	if results, ok := retry.GetAttemptResults(md); ok && len(results.Results) > 0 {
+		call.Attempts = len(results.Results)
+	}
+	if err != nil {
+		call.Error = err.Error()
+		var respErr *awshttp.ResponseError
+		if call.RequestID == "" && errors.As(err, &respErr) {
+			call.RequestID = respErr.ServiceRequestID()
+		}
+	}
+	t.mu.Lock()
+	t.noteSpan(ctx)
+	t.calls = append(t.calls, call)
+	t.mu.Unlock()
+	return out, md, err
+}
+
+// debugMode serves admin requests asking for it with a debugTrace, and adds
+// the trace to their JSON object responses.
+func (a *App) debugMode(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.EqualFold(r.Header.Get(headerDebug), "true") || !a.isAdmin(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		t := &debugTrace{start: time.Now()}
+		dw := &debugWriter{ResponseWriter: w}
+		next.ServeHTTP(dw, r.WithContext(context.WithValue(r.Context(), debugKey{}, t)))
+		dw.finish(t)
+	})
+}
+
+// debugWriter holds back a JSON response until the debug section can be
+// added to it; other responses pass straight through.
+type debugWriter struct {
+	http.ResponseWriter
+	status   int  // 0 until WriteHeader
+	buffered bool // The response is JSON and held in body
+	body     bytes.Buffer
+}
+
+func (w *debugWriter) WriteHeader(status int) {
+	if w.status != 0 {
+		return
+	}
+	w.status = status
+	w.buffered = strings.HasPrefix(w.Header().Get("Content-Type"), "application/json")
+	if !w.buffered {
+		w.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (w *debugWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.buffered {
+		return w.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap gives http.ResponseController the underlying writer.
+func (w *debugWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// finish writes a held response with t added as its _debug member.
+func (w *debugWriter) finish(t *debugTrace) {
+	if !w.buffered {
+		return
+	}
+	body := bytes.TrimRight(w.body.Bytes(), " \t\r\n")
+	t.mu.Lock()
+	info := DebugInfo{TraceID: t.traceID, TotalMs: millis(time.Since(t.start)), Phases: t.phases, Calls: t.calls}
+	t.mu.Unlock()
+	if info.Phases == nil {
+		info.Phases = []DebugPhase{}
+	}
+	if info.Calls == nil {
+		info.Calls = []DebugCall{}
+	}
+	section, err := json.Marshal(info)
+	if err == nil && len(body) >= 2 && body[0] == '{' && body[len(body)-1] == '}' {
+		var spliced bytes.Buffer
+		spliced.Write(body[:len(body)-1])
+		if len(bytes.TrimSpace(body[1:len(body)-1])) > 0 {
+			spliced.WriteByte(',')
+		}
+		spliced.WriteString(`"_debug":`)
+		spliced.Write(section)
+		spliced.WriteString("}\n")
+		body = spliced.Bytes()
+	} else {
+		body = w.body.Bytes()
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Header().Set("Cache-Control", "no-store")
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.Write(body)
+}
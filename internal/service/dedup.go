@@ -0,0 +1,110 @@
+// Short-window duplicate submission detection. Independently of explicit
+// idempotency keys, an identical POST /jobs body from the same principal within
+// DUPLICATE_WINDOW is treated as a client retry: the first job's ID is returned
+// instead of enqueuing again, which protects the queue from retry storms.
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// dedupPruneEvery bounds how many claims may pass between sweeps of expired
+// fingerprints, so memory stays proportional to traffic within one window.
+const dedupPruneEvery = 1024
+
+// duplicateDetector remembers recent submission fingerprints. It is safe for
+// concurrent use. A nil *duplicateDetector never reports duplicates.
+type duplicateDetector struct {
+	window time.Duration
+
+	mu     sync.Mutex
+	seen   map[string]dedupEntry // fingerprint -> first submission
+	claims int                   // claims since the last prune
+}
+
+// dedupEntry is the first job seen for a fingerprint.
+type dedupEntry struct {
+	jobID   string
+	expires time.Time
+}
+
+// newDuplicateDetector returns a detector with the given window, or nil
+// (disabled) when window is not positive.
+func newDuplicateDetector(window time.Duration) *duplicateDetector {
+	if window <= 0 {
+		return nil
+	}
+	return &duplicateDetector{window: window, seen: make(map[string]dedupEntry)}
+}
+
+// submissionFingerprint hashes the principal and the job-defining request
+// fields. Fields are length-prefixed so distinct inputs cannot collide by
+// concatenation.
+func submissionFingerprint(p Principal, req JobRequest) string {
+	h := sha256.New()
+	parts := []string{p.Tenant, p.ID, req.Text, req.Type, req.ParentID, req.Relation}
+	if req.CallbackURL != "" {
+		// Only when set, so fingerprints recorded without callbacks still match.
+		parts = append(parts, req.CallbackURL)
+	}
+	for _, part := range parts {
+		h.Write(binary.BigEndian.AppendUint64(nil, uint64(len(part))))
+		h.Write([]byte(part))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// claim records jobID for fingerprint fp unless an unexpired submission
+// already holds it, in which case it returns that job's ID and true. Claiming
+// before the SQS send means concurrent identical requests also collapse.
+func (d *duplicateDetector) claim(fp, jobID string) (string, bool) {
+	if d == nil {
+		return "", false
+	}
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if e, ok := d.seen[fp]; ok && now.Before(e.expires) {
+		return e.jobID, true
+	}
+	d.seen[fp] = dedupEntry{jobID: jobID, expires: now.Add(d.window)}
+	if d.claims++; d.claims >= dedupPruneEvery {
+		d.claims = 0
+		for k, e := range d.seen {
+			if !now.Before(e.expires) {
+				delete(d.seen, k)
+			}
+		}
+	}
+	return "", false
+}
+
+// release forgets fp if it is still held by jobID, used when the submission
+// failed so the client's retry is not reported as a duplicate of nothing.
+func (d *duplicateDetector) release(fp, jobID string) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if e, ok := d.seen[fp]; ok && e.jobID == jobID {
+		delete(d.seen, fp)
+	}
+}
+
+// peek reports the job holding an unexpired claim on fp without claiming it.
+func (d *duplicateDetector) peek(fp string) (string, bool) {
+	if d == nil {
+		return "", false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if e, ok := d.seen[fp]; ok && time.Now().Before(e.expires) {
+		return e.jobID, true
+	}
+	return "", false
+}
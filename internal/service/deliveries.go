@@ -0,0 +1,155 @@
+// Delivery history. A job that keeps coming back — its processor failing,
+// crashing the worker or outlasting the visibility timeout — is easy to miss
+// from the outside: it just stays queued or processing. So each delivery is
+// made visible twice over:
+//
+//   - In the job's status (GET /jobs/{id}/status): redeliveries, the
+//     attempt number less one; first_received_at, when SQS first handed the
+//     message out (ApproximateFirstReceiveTimestamp); and attempts, the last
+//     maxAttemptHistory deliveries with when each started and ended and how.
+//     Only deliveries that reach processing are attempts: a message received
+//     and put back untouched — a FIFO group's later messages released behind
+//     its head (fifo.go), a held message of a disabled type (jobflags.go),
+//     one released from fair-scheduling staging (fairsched.go) or at
+//     shutdown, one a dry-run worker looked at (shadow.go) — raises SQS's
+//     receive count but not the attempt, so it never uses up MAX_ATTEMPTS.
+//     An attempt left "processing" by a later one is "abandoned": the worker
+//     stopped or the message came back before it finished. One that found
+//     the result already stored by another delivery is "duplicate": it
+//     stores nothing, so a job has one result however often it arrives.
+//   - In metrics, for every message the worker receives:
+//     queue.message.age, time since it was sent, and
+//     queue.message.receive_count, its receive count, both by redelivered.
+//     A receive count creeping towards the queue's maxReceiveCount is the
+//     early warning of a message SQS will dead-letter on its own.
+package service
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// maxAttemptHistory is how many of its latest attempts a job record keeps.
+const maxAttemptHistory = 10
+
+// Attempt outcomes in a job's history.
+const (
+	attemptProcessing = "processing"
+	attemptCompleted  = "completed"
+	attemptFailed     = "failed"
+	attemptAbandoned  = "abandoned"
+	attemptDuplicate  = "duplicate"
+)
+
+// JobAttempt is one delivery of a job to a worker.
+type JobAttempt struct {
+	Attempt    int       `json:"attempt"`              // Attempt number (JobRecord.nextAttempt)
+	MessageID  string    `json:"message_id,omitempty"` // SQS message delivered; copies of a job each have their own
+	StartedAt  Timestamp `json:"started_at"`           // When the worker started it
+	FinishedAt Timestamp `json:"finished_at,omitzero"` // When it ended; absent while processing or abandoned
+	Outcome    string    `json:"outcome"`              // processing, completed, failed, abandoned or duplicate
+	Error      string    `json:"error,omitempty"`      // Why it failed
+}
+
+// firstReceiveTime returns when SQS first delivered message, or the zero
+// time when it did not say.
+func firstReceiveTime(m types.Message) time.Time {
+	ms, err := strconv.ParseInt(m.Attributes[string(types.MessageSystemAttributeNameApproximateFirstReceiveTimestamp)], 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.UnixMilli(ms)
+}
+
+// recordDelivery counts a received message, on its attempt'th delivery, in
+// the delivery metrics.
+func recordDelivery(ctx context.Context, message types.Message, attempt int) {
+	attrs := metric.WithAttributes(attribute.Bool("redelivered", attempt > 1))
+	messageReceiveCount.Record(ctx, int64(attempt), attrs)
+	if sent := sentTime(message); !sent.IsZero() {
+		messageAge.Record(ctx, max(time.Since(sent), 0).Seconds(), attrs)
+	}
+}
+
+// nextAttempt returns the number of a new attempt at rec's job on a
+// delivery of message messageID: one more than the latest recorded attempt
+// on that message, so receives that never reached processing do not count.
+// Another message of the job — a requeued, redriven or duplicate copy —
+// starts again from 1, as its SQS receive count does.
+func (rec JobRecord) nextAttempt(messageID string) int {
+	n := 0
+	for _, a := range rec.Attempts {
+		if a.MessageID == messageID {
+			n = max(n, a.Attempt)
+		}
+	}
+	return n + 1
+}
+
+// startAttempt adds the attempt'th delivery of message messageID, first
+// received at firstReceived, to rec's history, marking any attempt still
+// processing as abandoned.
+func (rec *JobRecord) startAttempt(messageID string, attempt int, firstReceived time.Time, now Timestamp) {
+	if rec.FirstReceivedAt.IsZero() && !firstReceived.IsZero() {
+		rec.FirstReceivedAt = Timestamp{Time: firstReceived}
+	}
+	for i := range rec.Attempts {
+		if rec.Attempts[i].Outcome == attemptProcessing {
+			rec.Attempts[i].Outcome = attemptAbandoned
+		}
+	}
+	rec.Attempts = append(rec.Attempts, JobAttempt{Attempt: attempt, MessageID: messageID, StartedAt: now, Outcome: attemptProcessing})
+	if n := len(rec.Attempts); n > maxAttemptHistory {
+		rec.Attempts = rec.Attempts[n-maxAttemptHistory:]
+	}
+}
+
+// finishAttempt records in rec how the attempt that run started ended, and
+// returns the job's state after it. rec may have moved on since: a stored
+// result completes the job, whichever delivery stored it, unless it has been
+// cancelled or deleted meanwhile, and a failure fails it only while no later
+// attempt has started. An attempt that found the result already stored ends
+// as a duplicate.
+func (rec *JobRecord) finishAttempt(run JobRecord, jobErr error, now Timestamp) string {
+	latest := len(rec.Attempts) == 0
+	if n := len(run.Attempts); n > 0 {
+		started := run.Attempts[n-1]
+		done := JobAttempt{Attempt: started.Attempt, MessageID: started.MessageID, StartedAt: started.StartedAt, FinishedAt: now, Outcome: attemptCompleted}
+		switch {
+		case errors.Is(jobErr, errJobFinished):
+			done.Outcome = attemptDuplicate
+		case jobErr != nil:
+			done.Outcome, done.Error = attemptFailed, jobErr.Error()
+		}
+		// A delivery is one receive of one message.
+		i := slices.IndexFunc(rec.Attempts, func(a JobAttempt) bool {
+			return a.Attempt == done.Attempt && a.MessageID == done.MessageID
+		})
+		latest = latest || i == len(rec.Attempts)-1
+		if i >= 0 {
+			rec.Attempts[i] = done
+		} else if rec.Attempts = append(rec.Attempts, done); len(rec.Attempts) > maxAttemptHistory {
+			rec.Attempts = rec.Attempts[len(rec.Attempts)-maxAttemptHistory:]
+		}
+	}
+	switch {
+	case rec.State == createCancelled, rec.State == createDeleted:
+		return rec.State
+	case jobErr == nil, errors.Is(jobErr, errJobFinished):
+		if rec.State != createCompleted {
+			rec.FinishedAt, rec.Error = now, ""
+		}
+		return createCompleted
+	case latest:
+		rec.FinishedAt, rec.Error = now, jobErr.Error()
+		return createFailed
+	}
+	return rec.State
+}
@@ -0,0 +1,391 @@
+package service
+
+// The delivery harness runs the worker's message handling against the
+// in-memory queue and a filesystem store, injecting what SQS's at-least-once
+// delivery allows — duplicate copies, deliveries finishing out of order, a
+// visibility timeout running out mid-job — and checks the end state: one
+// result, and an attempt history that says what happened.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/google/uuid"
+)
+
+// gatedType is a job type whose processor waits for the harness: each call
+// hands gateEntered a channel and runs once the test closes it.
+const gatedType = "harness-gated"
+
+var gateEntered = make(chan chan struct{})
+
+// flakyType is a job type whose processor fails a job's first attempt.
+const flakyType = "harness-flaky"
+
+var registerProcessors = sync.OnceFunc(func() {
+	RegisterProcessor(gatedType, ProcessorFunc(func(jc *JobContext, text string) (string, []Artifact, error) {
+		release := make(chan struct{})
+		gateEntered <- release
+		<-release
+		return "gated " + text, nil, nil
+	}))
+	RegisterProcessor(flakyType, ProcessorFunc(func(jc *JobContext, text string) (string, []Artifact, error) {
+		if jc.Attempt == 1 {
+			return "", nil, errors.New("first attempt fails")
+		}
+		return "flaky " + text, nil, nil
+	}))
+})
+
+// deliveryHarness is a worker App on the memory queue and a temporary store.
+type deliveryHarness struct {
+	t     *testing.T
+	app   *App
+	ctx   context.Context
+	group string // FIFO message group of submitted jobs, on a FIFO queue
+}
+
+func newDeliveryHarness(t *testing.T) *deliveryHarness {
+	t.Helper()
+	registerProcessors()
+	if err := initInstruments(); err != nil {
+		t.Fatal(err)
+	}
+	store, err := newFilesystemStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &App{
+		conf:       defaultConfig(),
+		queue:      newMemoryQueue(),
+		sqsURL:     memoryQueueURL,
+		store:      store,
+		results:    newResultCache(0, 0),
+		throughput: newThroughputTracker(),
+		jobTimeout: time.Minute,
+		retries:    newRetryPolicy(),
+		events:     newEventBroker(),
+		typeFlags:  newJobTypeSwitches(),
+		secrets:    newSecretCache(nil),
+	}
+	a.locks = newLockManager(a)
+	a.hooks = newHookRunner(a)
+	if a.jobIDs, err = newJobIDScheme(); err != nil {
+		t.Fatal(err)
+	}
+	if a.adapters, err = newMessageAdapters(); err != nil {
+		t.Fatal(err)
+	}
+	return &deliveryHarness{t: t, app: a, ctx: t.Context()}
+}
+
+// submit records a queued job of type typ, as POST /jobs does, and sends its
+// message; it returns the job ID and the message body, for resending.
+func (h *deliveryHarness) submit(typ string) (string, string) {
+	h.t.Helper()
+	id := uuid.NewString()
+	msg := JobMessage{ID: id, Text: "hello", Type: typ, Tenant: defaultTenant, CreatedAt: Now()}
+	env, err := newEnvelope(h.ctx, messageTypeJob, msg, map[string]string{envelopeHeaderTenant: msg.Tenant, envelopeHeaderGroup: h.group})
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	body, err := json.Marshal(env)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	rec := JobRecord{ID: id, Tenant: msg.Tenant, Type: typ, CreatedAt: msg.CreatedAt}
+	if err := h.app.putJobRecord(h.ctx, &rec, createQueued); err != nil {
+		h.t.Fatal(err)
+	}
+	h.send(string(body))
+	return id, string(body)
+}
+
+// send queues a copy of body; on a FIFO queue, in the group its envelope
+// names, and never deduplicated.
+func (h *deliveryHarness) send(body string) {
+	h.t.Helper()
+	var opts SendOptions
+	if isFIFOQueue(h.app.sqsURL) {
+		opts = fifoOptions("", body, SendOptions{DeduplicationID: uuid.NewString()})
+	}
+	if err := h.app.queue.Send(h.ctx, h.app.sqsURL, body, nil, opts); err != nil {
+		h.t.Fatal(err)
+	}
+}
+
+// receive takes the next visible message.
+func (h *deliveryHarness) receive() types.Message {
+	h.t.Helper()
+	msgs, err := h.app.queue.Receive(h.ctx, h.app.sqsURL, 1, 0)
+	if err != nil || len(msgs) != 1 {
+		h.t.Fatalf("receive: %d messages, error %v", len(msgs), err)
+	}
+	return msgs[0]
+}
+
+// expire ends message's visibility timeout, as if its worker had outlasted
+// it, so SQS hands the message out again.
+func (h *deliveryHarness) expire(message types.Message) {
+	h.t.Helper()
+	if err := h.app.queue.ChangeVisibility(h.ctx, h.app.sqsURL, aws.ToString(message.ReceiptHandle), 0); err != nil {
+		h.t.Fatal(err)
+	}
+}
+
+// handle runs the worker on message in the background; the returned channel
+// closes when it is done.
+func (h *deliveryHarness) handle(message types.Message) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.app.handleMessage(h.ctx, message)
+	}()
+	return done
+}
+
+// entered waits for a gated processor call to start and returns its release.
+func (h *deliveryHarness) entered() chan struct{} {
+	h.t.Helper()
+	select {
+	case release := <-gateEntered:
+		return release
+	case <-time.After(5 * time.Second):
+		h.t.Fatal("processor was not called")
+		return nil
+	}
+}
+
+// wait waits for a handle to finish.
+func (h *deliveryHarness) wait(done <-chan struct{}) {
+	h.t.Helper()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		h.t.Fatal("message handling did not finish")
+	}
+}
+
+// record reads jobID's creation record.
+func (h *deliveryHarness) record(jobID string) JobRecord {
+	h.t.Helper()
+	rec, _, err := h.app.getJobRecord(h.ctx, jobID)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	return rec
+}
+
+// assertSingleResult checks jobID has exactly one stored result, written by
+// the processor, and that the queue is empty.
+func (h *deliveryHarness) assertSingleResult(jobID, output string) {
+	h.t.Helper()
+	var results int
+	for obj, err := range h.app.store.List(h.ctx, jobsPrefix, ListOptions{}) {
+		if err != nil {
+			h.t.Fatal(err)
+		}
+		if resultKeyID(obj.Key) == jobID {
+			results++
+		}
+	}
+	if results != 1 {
+		h.t.Fatalf("job has %d results, want 1", results)
+	}
+	var result JobResult
+	if err := h.app.getJSON(h.ctx, jobsPrefix+jobID+".json", &result); err != nil {
+		h.t.Fatal(err)
+	}
+	if result.Output != output {
+		h.t.Errorf("result output = %q, want %q", result.Output, output)
+	}
+	depth, err := h.app.queue.Depth(h.ctx, h.app.sqsURL)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	if depth != (QueueDepth{}) {
+		h.t.Errorf("queue left with %+v", depth)
+	}
+}
+
+// assertAttempts checks the record is completed with the given attempt
+// outcomes, oldest first.
+func (h *deliveryHarness) assertAttempts(jobID string, want ...JobAttempt) {
+	h.t.Helper()
+	rec := h.record(jobID)
+	if rec.State != createCompleted {
+		h.t.Errorf("record state = %s, want %s", rec.State, createCompleted)
+	}
+	if len(rec.Attempts) != len(want) {
+		h.t.Fatalf("attempts = %+v, want %d", rec.Attempts, len(want))
+	}
+	for i, w := range want {
+		if got := rec.Attempts[i]; got.Attempt != w.Attempt || got.Outcome != w.Outcome {
+			h.t.Errorf("attempt %d = %d %s, want %d %s", i, got.Attempt, got.Outcome, w.Attempt, w.Outcome)
+		}
+	}
+}
+
+func TestDuplicateDeliveryAfterCompletion(t *testing.T) {
+	h := newDeliveryHarness(t)
+	id, body := h.submit("")
+	h.wait(h.handle(h.receive()))
+	// SQS delivers a second copy of a message it already handed out.
+	h.send(body)
+	h.wait(h.handle(h.receive()))
+
+	h.assertSingleResult(id, "HELLO")
+	h.assertAttempts(id, JobAttempt{Attempt: 1, Outcome: attemptCompleted})
+}
+
+func TestRedeliveryRecordsMissingHooks(t *testing.T) {
+	h := newDeliveryHarness(t)
+	id, body := h.submit("")
+	h.wait(h.handle(h.receive()))
+	var task HookTask
+	if err := h.app.getJSON(h.ctx, hookTaskKey(id), &task); err != nil {
+		t.Fatalf("no hook task after the result was stored: %v", err)
+	}
+
+	// The worker died after storing the result, before recording its hooks
+	// and finishing the job; SQS redelivers the message.
+	if _, err := h.app.deleteKeys(h.ctx, []string{hookTaskKey(id)}); err != nil {
+		t.Fatal(err)
+	}
+	rec := h.record(id)
+	if err := h.app.putJobRecord(h.ctx, &rec, createProcessing); err != nil {
+		t.Fatal(err)
+	}
+	h.send(body)
+	h.wait(h.handle(h.receive()))
+
+	h.assertSingleResult(id, "HELLO")
+	task = HookTask{}
+	if err := h.app.getJSON(h.ctx, hookTaskKey(id), &task); err != nil {
+		t.Fatalf("hook task not recorded again: %v", err)
+	}
+	if want := h.app.hooks.names(); !slices.Equal(task.Hooks, want) || task.SizeBytes == 0 {
+		t.Errorf("recorded task %+v, want hooks %v on the stored result", task, want)
+	}
+
+	// A task still pending is left as it is.
+	task.Attempts = 3
+	if err := h.app.putJSON(h.ctx, hookTaskKey(id), task); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.app.putJobRecord(h.ctx, &rec, createProcessing); err != nil {
+		t.Fatal(err)
+	}
+	h.send(body)
+	h.wait(h.handle(h.receive()))
+	if err := h.app.getJSON(h.ctx, hookTaskKey(id), &task); err != nil || task.Attempts != 3 {
+		t.Errorf("pending task replaced: %+v, %v", task, err)
+	}
+}
+
+func TestRedeliveryAfterFailure(t *testing.T) {
+	h := newDeliveryHarness(t)
+	id, _ := h.submit(flakyType)
+	first := h.receive()
+	h.wait(h.handle(first))
+	if rec := h.record(id); rec.State != createFailed {
+		t.Fatalf("record state after a failed attempt = %s, want %s", rec.State, createFailed)
+	}
+	// The failed message comes back once its backoff has passed.
+	h.expire(first)
+	h.wait(h.handle(h.receive()))
+
+	h.assertSingleResult(id, "flaky hello")
+	h.assertAttempts(id, JobAttempt{Attempt: 1, Outcome: attemptFailed}, JobAttempt{Attempt: 2, Outcome: attemptCompleted})
+}
+
+func TestDuplicateCopiesInFlightTogether(t *testing.T) {
+	h := newDeliveryHarness(t)
+	id, body := h.submit(gatedType)
+	h.send(body)
+	first := h.handle(h.receive())
+	r1 := h.entered()
+	second := h.handle(h.receive())
+	r2 := h.entered()
+	close(r1)
+	h.wait(first)
+	close(r2)
+	h.wait(second)
+
+	h.assertSingleResult(id, "gated hello")
+	// Both copies are first deliveries of their own message.
+	h.assertAttempts(id, JobAttempt{Attempt: 1, Outcome: attemptCompleted}, JobAttempt{Attempt: 1, Outcome: attemptDuplicate})
+}
+
+func TestVisibilityTimeoutExpiry(t *testing.T) {
+	h := newDeliveryHarness(t)
+	id, _ := h.submit(gatedType)
+	first := h.receive()
+	slow := h.handle(first)
+	r1 := h.entered()
+	// The first worker outlasts the visibility timeout and the message
+	// comes back; the redelivery finishes first.
+	h.expire(first)
+	second := h.receive()
+	if attempt := receiveAttempt(second); attempt != 2 {
+		t.Fatalf("redelivery attempt = %d, want 2", attempt)
+	}
+	fast := h.handle(second)
+	close(h.entered())
+	h.wait(fast)
+	close(r1)
+	h.wait(slow)
+
+	h.assertSingleResult(id, "gated hello")
+	h.assertAttempts(id, JobAttempt{Attempt: 1, Outcome: attemptDuplicate}, JobAttempt{Attempt: 2, Outcome: attemptCompleted})
+}
+
+func TestStaleDeliveryFinishesFirst(t *testing.T) {
+	h := newDeliveryHarness(t)
+	id, _ := h.submit(gatedType)
+	first := h.receive()
+	stale := h.handle(first)
+	r1 := h.entered()
+	h.expire(first)
+	redelivered := h.handle(h.receive())
+	r2 := h.entered()
+	// Reordered: the abandoned first delivery finishes before the second.
+	close(r1)
+	h.wait(stale)
+	close(r2)
+	h.wait(redelivered)
+
+	// The stale delivery's receipt is no longer valid, so it is the
+	// redelivery that deletes the message.
+	h.assertSingleResult(id, "gated hello")
+	h.assertAttempts(id, JobAttempt{Attempt: 1, Outcome: attemptCompleted}, JobAttempt{Attempt: 2, Outcome: attemptDuplicate})
+}
+
+func TestDeliveryAfterDeleteIsDropped(t *testing.T) {
+	h := newDeliveryHarness(t)
+	id, body := h.submit("")
+	h.wait(h.handle(h.receive()))
+	if _, err := h.app.deleteStoredResult(h.ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	rec := h.record(id)
+	if err := h.app.putJobRecord(h.ctx, &rec, createDeleted); err != nil {
+		t.Fatal(err)
+	}
+	h.send(body)
+	h.wait(h.handle(h.receive()))
+
+	if exists, err := h.app.objectExists(h.ctx, jobsPrefix+id+".json"); err != nil || exists {
+		t.Fatalf("deleted job's result was stored again (exists %v, error %v)", exists, err)
+	}
+	if rec := h.record(id); rec.State != createDeleted || len(rec.Attempts) != 1 {
+		t.Errorf("record = %s with %d attempts, want deleted with 1", rec.State, len(rec.Attempts))
+	}
+}
@@ -0,0 +1,301 @@
+// Diagnostics bundles. GET /admin/diagnostics returns one zip archive with
+// what support otherwise collects piece by piece for an incident ticket, all
+// from the process that answers:
+//
+//	manifest.json        when and where the bundle was taken, and what is in it
+//	startup-report.json  the startup report (startupreport.go)
+//	config.json          every setting read, secrets redacted, as GET /admin/config
+//	errors.json          the last diagnosticsLogSamples WARN and ERROR log records
+//	worker.json          the worker's state: loop heartbeat, circuit breakers,
+//	                     disabled job types, queued hook tasks and buffered sends
+//	metrics.json         the current value of every metric instrument
+//	goroutines.txt       every goroutine's stack
+//
+// A section that cannot be produced is left out and its error recorded in
+// the manifest. Behind a load balancer each request reaches one replica;
+// X-Served-By in the response names it.
+package service
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+// diagnosticsLogSamples is how many WARN and ERROR records a process keeps
+// for its bundles.
+const diagnosticsLogSamples = 200
+
+// processStarted is when the process started, near enough.
+var processStarted = time.Now()
+
+// recentLogs holds the latest WARN and ERROR records, for errors.json.
+var recentLogs = &logRing{}
+
+// DiagnosticsManifest is manifest.json.
+type DiagnosticsManifest struct {
+	CreatedAt Timestamp         `json:"created_at"`
+	Host      string            `json:"host"`
+	Version   string            `json:"version"`          // As in the startup report
+	Uptime    string            `json:"uptime"`           // Since the process started
+	Files     []string          `json:"files"`            // In the archive, this one included
+	Errors    map[string]string `json:"errors,omitempty"` // Sections left out, and why
+}
+
+// LogSample is a log record kept for errors.json.
+type LogSample struct {
+	Time    Timestamp      `json:"time"`
+	Level   string         `json:"level"`
+	Message string         `json:"msg"`
+	Attrs   map[string]any `json:"attrs,omitempty"`
+}
+
+// WorkerState is worker.json.
+type WorkerState struct {
+	Readiness      string                     `json:"readiness"`                // As /readyz reports it before checking dependencies
+	Running        bool                       `json:"running"`                  // The worker loop runs in this process
+	Concurrency    int                        `json:"concurrency"`              // WORKER_CONCURRENCY
+	LastBeat       Timestamp                  `json:"last_beat,omitzero"`       // The loop's last progress
+	Stalled        bool                       `json:"stalled"`                  // No progress for longer than the systemd watchdog allows
+	DryRunPrefix   string                     `json:"dry_run_prefix,omitempty"` // WORKER_DRY_RUN_PREFIX of a shadow worker
+	Breakers       map[string]string          `json:"breakers,omitempty"`       // AWS circuit breakers by service: closed, open or half_open
+	DisabledTypes  map[string]DisabledJobType `json:"disabled_types"`           // This process's copy of the job type flags
+	HookTasks      int                        `json:"hook_tasks"`               // Result hook tasks waiting for this process's runners
+	SendBuffered   int                        `json:"send_buffered"`            // Messages in the local SQS send buffer
+	StreamBuffered int                        `json:"stream_buffered"`          // Events waiting for the Firehose stream
+	Goroutines     int                        `json:"goroutines"`
+}
+
+// getDiagnostics handles GET /admin/diagnostics requests.
+// → 200 with the diagnostics bundle of this process as a zip attachment.
+func (a *App) getDiagnostics(w http.ResponseWriter, r *http.Request) {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	now := time.Now().UTC()
+	manifest := DiagnosticsManifest{
+		CreatedAt: Timestamp{Time: now},
+		Host:      host,
+		Version:   "unknown",
+		Uptime:    time.Since(processStarted).Round(time.Second).String(),
+		Files:     []string{"manifest.json"},
+		Errors:    map[string]string{},
+	}
+	if a.startup != nil {
+		manifest.Version = a.startup.Version
+	}
+
+	sections := map[string]func() ([]byte, error){
+		"startup-report.json": func() ([]byte, error) {
+			if a.startup == nil {
+				return nil, errors.New("no startup report")
+			}
+			return json.MarshalIndent(a.startup, "", "  ")
+		},
+		"config.json":  func() ([]byte, error) { return json.MarshalIndent(configReport(), "", "  ") },
+		"errors.json":  func() ([]byte, error) { return json.MarshalIndent(recentLogs.samples(), "", "  ") },
+		"worker.json":  func() ([]byte, error) { return json.MarshalIndent(a.workerState(), "", "  ") },
+		"metrics.json": func() ([]byte, error) { return collectMetrics(r.Context()) },
+		"goroutines.txt": func() ([]byte, error) {
+			var buf bytes.Buffer
+			err := pprof.Lookup("goroutine").WriteTo(&buf, 2)
+			return buf.Bytes(), err
+		},
+	}
+	var archive bytes.Buffer
+	zw := zip.NewWriter(&archive)
+	for _, name := range slices.Sorted(maps.Keys(sections)) {
+		body, err := sections[name]()
+		if err == nil {
+			err = writeZipFile(zw, name, now, body)
+		}
+		if err != nil {
+			manifest.Errors[name] = err.Error()
+			continue
+		}
+		manifest.Files = append(manifest.Files, name)
+	}
+	body, err := json.MarshalIndent(manifest, "", "  ")
+	if err == nil {
+		err = writeZipFile(zw, "manifest.json", now, body)
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to build the diagnostics bundle: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="diagnostics-%s-%s.zip"`, fileNameSafe(host), now.Format("20060102T150405Z")))
+	w.Header().Set("X-Served-By", host)
+	w.Write(archive.Bytes())
+}
+
+// writeZipFile adds a file called name holding body to zw.
+func writeZipFile(zw *zip.Writer, name string, modified time.Time, body []byte) error {
+	f, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modified})
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(body)
+	return err
+}
+
+// fileNameSafe replaces the characters of s that do not belong in a file
+// name.
+func fileNameSafe(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == '.' || r == '_' || ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9') {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// collectMetrics returns the current value of every metric instrument.
+func collectMetrics(ctx context.Context) ([]byte, error) {
+	if metricsReader == nil {
+		return nil, errors.New("telemetry is not set up")
+	}
+	var rm metricdata.ResourceMetrics
+	if err := metricsReader.Collect(ctx, &rm); err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(rm.ScopeMetrics, "", "  ")
+}
+
+// workerState returns worker.json.
+func (a *App) workerState() WorkerState {
+	st := WorkerState{
+		Readiness:     a.readinessStatus(),
+		Concurrency:   a.workerCount,
+		DisabledTypes: a.typeFlags.current.Load().Disabled,
+		Goroutines:    runtime.NumGoroutine(),
+	}
+	if st.DisabledTypes == nil {
+		st.DisabledTypes = map[string]DisabledJobType{}
+	}
+	if beat := a.workerBeat.Load(); beat != 0 {
+		st.Running = true
+		st.LastBeat = Timestamp{Time: time.Unix(0, beat).UTC()}
+		st.Stalled = time.Since(st.LastBeat.Time) > a.workerStallTimeout()
+	}
+	if a.shadow != nil {
+		st.DryRunPrefix = a.shadow.prefix
+	}
+	if a.resilience != nil {
+		st.Breakers = a.resilience.states()
+	}
+	if a.hooks != nil {
+		st.HookTasks = len(a.hooks.tasks)
+	}
+	if a.sendBuffer != nil {
+		if pending, err := a.sendBuffer.pending(); err == nil {
+			st.SendBuffered = len(pending)
+		}
+	}
+	if a.stream != nil {
+		st.StreamBuffered = len(a.stream.events)
+	}
+	return st
+}
+
+// logRing keeps the latest diagnosticsLogSamples WARN and ERROR records.
+type logRing struct {
+	mu      sync.Mutex
+	records []LogSample // Oldest first
+}
+
+// add keeps s, forgetting the oldest record when full.
+func (l *logRing) add(s LogSample) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.records) >= diagnosticsLogSamples {
+		l.records = slices.Delete(l.records, 0, len(l.records)-diagnosticsLogSamples+1)
+	}
+	l.records = append(l.records, s)
+}
+
+// samples returns the kept records, oldest first.
+func (l *logRing) samples() []LogSample {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return slices.Clone(l.records)
+}
+
+// sampleHandler decorates a slog.Handler, keeping WARN and ERROR records in
+// recentLogs as well.
+type sampleHandler struct {
+	slog.Handler
+	attrs []slog.Attr // From WithAttrs, qualified by their groups
+	group string      // Prefix of attribute names, from WithGroup
+}
+
+func (h *sampleHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= slog.LevelWarn {
+		s := LogSample{Time: Timestamp{Time: r.Time.UTC()}, Level: r.Level.String(), Message: r.Message, Attrs: map[string]any{}}
+		for _, attr := range h.attrs {
+			addSampleAttr(s.Attrs, "", attr)
+		}
+		r.Attrs(func(attr slog.Attr) bool {
+			addSampleAttr(s.Attrs, h.group, attr)
+			return true
+		})
+		recentLogs.add(s)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *sampleHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	qualified := slices.Clone(h.attrs)
+	for _, attr := range attrs {
+		attr.Key = h.group + attr.Key
+		qualified = append(qualified, attr)
+	}
+	return &sampleHandler{Handler: h.Handler.WithAttrs(attrs), attrs: qualified, group: h.group}
+}
+
+func (h *sampleHandler) WithGroup(name string) slog.Handler {
+	return &sampleHandler{Handler: h.Handler.WithGroup(name), attrs: h.attrs, group: h.group + name + "."}
+}
+
+// addSampleAttr adds attr to m under prefix, flattening groups and
+// rendering values that have no JSON form of their own as text.
+func addSampleAttr(m map[string]any, prefix string, attr slog.Attr) {
+	v := attr.Value.Resolve()
+	switch v.Kind() {
+	case slog.KindGroup:
+		for _, member := range v.Group() {
+			addSampleAttr(m, prefix+attr.Key+".", member)
+		}
+	case slog.KindString, slog.KindInt64, slog.KindUint64, slog.KindFloat64, slog.KindBool:
+		m[prefix+attr.Key] = v.Any()
+	case slog.KindAny:
+		if err, ok := v.Any().(error); ok {
+			m[prefix+attr.Key] = err.Error()
+		} else if raw, err := json.Marshal(v.Any()); err == nil {
+			m[prefix+attr.Key] = json.RawMessage(raw)
+		} else {
+			m[prefix+attr.Key] = v.String()
+		}
+	default:
+		m[prefix+attr.Key] = v.String()
+	}
+}
@@ -0,0 +1,175 @@
+// Runtime profiling. Every process serves net/http/pprof under /debug/pprof/
+// (admin token required) for interactive use, and can capture a profile set —
+// a CPU profile plus heap, allocs and goroutine snapshots — to S3 under
+// diagnostics/{host}/{time}/, either on SIGUSR1 (CAPTURE_PROFILE_ON_SIGUSR1)
+// or via POST /admin/diagnostics/profile. Captured CPU profiles from
+// production workers feed `make pgo`, which merges them into default.pgo for
+// profile-guided builds.
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	httppprof "net/http/pprof"
+	"os"
+	"os/signal"
+	"runtime/pprof"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// diagnosticsPrefix is the key prefix of captured profiles.
+	diagnosticsPrefix = "diagnostics/"
+	// maxProfileDuration bounds the CPU profile length of a capture.
+	maxProfileDuration = 5 * time.Minute
+)
+
+// snapshotProfiles are the point-in-time profiles stored with each capture.
+var snapshotProfiles = []string{"heap", "allocs", "goroutine"}
+
+// errCaptureBusy is returned when a capture is requested while one runs.
+var errCaptureBusy = errors.New("profile capture already in progress")
+
+// profileCapturer serialises profile captures; the runtime allows only one
+// CPU profile at a time.
+type profileCapturer struct {
+	running sync.Mutex
+}
+
+// ProfileCaptureResponse is the POST /admin/diagnostics/profile response body.
+type ProfileCaptureResponse struct {
+	Prefix   string   `json:"prefix"`   // S3 prefix the profiles are written under
+	Files    []string `json:"files"`    // File names that will appear under Prefix
+	Duration string   `json:"duration"` // CPU profile length
+}
+
+// registerPprof serves net/http/pprof under /debug/pprof/ for admins. CPU
+// profiles and traces must be shorter than the server's 30s WriteTimeout.
+func (a *App) registerPprof(mux *router) {
+	mux.HandleFunc("GET /debug/pprof/", a.requireAdmin(httppprof.Index))
+	mux.HandleFunc("GET /debug/pprof/cmdline", a.requireAdmin(httppprof.Cmdline))
+	mux.HandleFunc("GET /debug/pprof/profile", a.requireAdmin(httppprof.Profile))
+	// Symbol lookups are GET ?0x… or POST; an any-method pattern would
+	// conflict with the GET subtree above.
+	mux.HandleFunc("GET /debug/pprof/symbol", a.requireAdmin(httppprof.Symbol))
+	mux.HandleFunc("POST /debug/pprof/symbol", a.requireAdmin(httppprof.Symbol))
+	mux.HandleFunc("GET /debug/pprof/trace", a.requireAdmin(httppprof.Trace))
+}
+
+// captureFiles lists the files a capture writes.
+func captureFiles() []string {
+	files := []string{"cpu.pprof"}
+	for _, name := range snapshotProfiles {
+		files = append(files, name+".pprof")
+	}
+	return files
+}
+
+// capturePrefix returns the S3 prefix for a capture started now.
+func capturePrefix() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s%s/%s/", diagnosticsPrefix, host, time.Now().UTC().Format("20060102T150405Z"))
+}
+
+// captureProfiles records a CPU profile for cpuDuration, then the snapshot
+// profiles, and uploads all of them under prefix. The caller must hold
+// p.running.
+func (a *App) captureProfiles(ctx context.Context, prefix string, cpuDuration time.Duration) error {
+	var cpu bytes.Buffer
+	if err := pprof.StartCPUProfile(&cpu); err != nil {
+		return fmt.Errorf("start CPU profile: %w", err)
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(cpuDuration):
+	}
+	pprof.StopCPUProfile()
+
+	profiles := map[string][]byte{"cpu.pprof": cpu.Bytes()}
+	for _, name := range snapshotProfiles {
+		var buf bytes.Buffer
+		if err := pprof.Lookup(name).WriteTo(&buf, 0); err != nil {
+			return fmt.Errorf("write %s profile: %w", name, err)
+		}
+		profiles[name+".pprof"] = buf.Bytes()
+	}
+
+	// Upload even if ctx was cancelled (shutdown): the profile is most useful
+	// exactly then.
+	for name, body := range profiles {
+		putCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), awsOpTimeout)
+		err := a.store.Put(putCtx, prefix+name, body, PutOptions{ContentType: "application/octet-stream"})
+		cancel()
+		if err != nil {
+			return fmt.Errorf("upload %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// startCapture runs a capture in the background and returns its prefix, or
+// errCaptureBusy.
+func (a *App) startCapture(ctx context.Context, cpuDuration time.Duration) (string, error) {
+	if !a.profiler.running.TryLock() {
+		return "", errCaptureBusy
+	}
+	prefix := capturePrefix()
+	go func() {
+		defer a.profiler.running.Unlock()
+		slog.Info("profile capture started", "prefix", prefix, "cpu_duration", cpuDuration.String())
+		if err := a.captureProfiles(ctx, prefix, cpuDuration); err != nil {
+			slog.Error("profile capture failed", "prefix", prefix, "error", err)
+			return
+		}
+		slog.Info("profile capture stored", "bucket", a.s3Bucket, "prefix", prefix)
+	}()
+	return prefix, nil
+}
+
+// profileOnSignal starts a capture on every SIGUSR1 until ctx is cancelled.
+func (a *App) profileOnSignal(ctx context.Context, cpuDuration time.Duration) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGUSR1)
+	defer signal.Stop(sig)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sig:
+			if _, err := a.startCapture(ctx, cpuDuration); err != nil {
+				slog.Warn("SIGUSR1 profile capture skipped", "error", err)
+			}
+		}
+	}
+}
+
+// captureProfile handles POST /admin/diagnostics/profile?duration=30s
+// requests. Starts a capture → 202 with the S3 prefix it will be stored
+// under; 409 while another capture runs.
+func (a *App) captureProfile(w http.ResponseWriter, r *http.Request) {
+	d := 30 * time.Second
+	if v := r.URL.Query().Get("duration"); v != "" {
+		parsed, err := time.ParseDuration(v)
+		if err != nil || parsed <= 0 || parsed > maxProfileDuration {
+			http.Error(w, fmt.Sprintf("duration must be a positive duration up to %s", maxProfileDuration), http.StatusBadRequest)
+			return
+		}
+		d = parsed
+	}
+	// Detach from the request: the capture outlives the response.
+	prefix, err := a.startCapture(context.WithoutCancel(r.Context()), d)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, ProfileCaptureResponse{Prefix: prefix, Files: captureFiles(), Duration: d.String()})
+}
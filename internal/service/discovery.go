@@ -0,0 +1,110 @@
+// API discovery for generic HTTP tooling. OPTIONS on any route (unless the
+// route handles OPTIONS itself) answers 204 with the methods it allows and,
+// for job and view resources, RFC 8288 Link headers to the resources around
+// it, so a client can navigate from a job to its status, artifacts and
+// lineage without knowing the URL layout:
+//
+//	OPTIONS /v1/jobs/42
+//	Allow: GET, HEAD, DELETE, OPTIONS
+//	Link: </v1/jobs>; rel="collection", </v1/jobs/42/status>; rel="related"; title="status", …
+//
+// Links always point at /v1, also from the unversioned paths (versioning.go).
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// discoveryMethods are the methods OPTIONS probes the routes for.
+var discoveryMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodPost,
+	http.MethodPut, http.MethodPatch, http.MethodDelete,
+}
+
+// resourceLink is one Link header entry.
+type resourceLink struct {
+	path  string // Target, using the route's wildcards, e.g. /v1/jobs/{id}/status
+	rel   string // Registered relation type
+	title string // Tells "related" links apart
+}
+
+// resourceLinks are the links OPTIONS reports, by route path.
+var resourceLinks = map[string][]resourceLink{
+	"/v1/jobs/{id}": {
+		{path: "/v1/jobs", rel: "collection"},
+		{path: "/v1/jobs/{id}/status", rel: "related", title: "status"},
+		{path: "/v1/jobs/{id}/artifacts", rel: "related", title: "artifacts"},
+		{path: "/v1/jobs/{id}/lineage", rel: "related", title: "lineage"},
+		{path: "/v1/jobs/{id}/callback", rel: "related", title: "callback"},
+	},
+	"/v1/jobs/{id}/status":           {{path: "/v1/jobs/{id}", rel: "up"}},
+	"/v1/jobs/{id}/artifacts":        {{path: "/v1/jobs/{id}", rel: "up"}},
+	"/v1/jobs/{id}/artifacts/{name}": {{path: "/v1/jobs/{id}/artifacts", rel: "up"}},
+	"/v1/jobs/{id}/lineage":          {{path: "/v1/jobs/{id}", rel: "up"}},
+	"/v1/jobs/{id}/callback":         {{path: "/v1/jobs/{id}", rel: "up"}},
+	"/v1/views/{id}":                 {{path: "/v1/views", rel: "collection"}},
+}
+
+// options answers an OPTIONS request for r's path, reporting false when no
+// route matches it with any method.
+func (rt *router) options(w http.ResponseWriter, r *http.Request) bool {
+	var allow []string
+	var route string
+	for _, m := range discoveryMethods {
+		probe := r.WithContext(r.Context())
+		probe.Method = m
+		if _, pattern := rt.Handler(probe); pattern != "" {
+			allow = append(allow, m)
+			route = pattern
+		}
+	}
+	if len(allow) == 0 {
+		return false
+	}
+	// Patterns are "METHOD /path", or just "/path" for any method.
+	if _, path, ok := strings.Cut(route, " "); ok {
+		route = path
+	}
+	w.Header().Set("Allow", strings.Join(append(allow, http.MethodOptions), ", "))
+	links, ok := resourceLinks[route]
+	if !ok {
+		links = resourceLinks[apiV1+route]
+	}
+	if len(links) > 0 {
+		vars := routeVars(route, r.URL.EscapedPath())
+		entries := make([]string, 0, len(links))
+		for _, l := range links {
+			entry := fmt.Sprintf("<%s>; rel=%q", expandRoute(l.path, vars), l.rel)
+			if l.title != "" {
+				entry += fmt.Sprintf("; title=%q", l.title)
+			}
+			entries = append(entries, entry)
+		}
+		w.Header().Set("Link", strings.Join(entries, ", "))
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// routeVars returns the wildcard values of path, which route matched, still
+// escaped.
+func routeVars(route, path string) map[string]string {
+	vars := map[string]string{}
+	routeSegs, pathSegs := strings.Split(route, "/"), strings.Split(path, "/")
+	for i, seg := range routeSegs {
+		if i < len(pathSegs) && strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}") {
+			vars[seg] = pathSegs[i]
+		}
+	}
+	return vars
+}
+
+// expandRoute fills the wildcards of a link target.
+func expandRoute(path string, vars map[string]string) string {
+	for name, value := range vars {
+		path = strings.ReplaceAll(path, name, value)
+	}
+	return path
+}
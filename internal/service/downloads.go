@@ -0,0 +1,130 @@
+// Presigned result downloads. GET /jobs/{id} reads the result through the
+// service, which is wasteful for large results: every byte crosses S3 → task
+// → client. GET /jobs/{id}/download instead returns a presigned S3 URL for
+// jobs/{id}.json, valid for DOWNLOAD_URL_TTL (default 15m, at most 7 days;
+// 0 turns the endpoint off), which the client fetches from S3 directly. The
+// result is served as an attachment named {id}.json.
+//
+// The URL is signed with the service's own credentials, so it stops working
+// when they expire even within the TTL — with the temporary credentials of
+// an ECS task role that can be well under an hour. The URL is a bearer
+// credential for the one object: it is returned with Cache-Control: no-store
+// and never logged. Only available on S3 storage.
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// maxDownloadURLTTL is the longest a SigV4 presigned URL may be valid.
+const maxDownloadURLTTL = 7 * 24 * time.Hour
+
+// downloadLinks presigns result downloads.
+type downloadLinks struct {
+	presign *s3.PresignClient
+	bucket  string
+	ttl     time.Duration // DOWNLOAD_URL_TTL
+}
+
+// DownloadLink is the GET /jobs/{id}/download response.
+type DownloadLink struct {
+	URL       string    `json:"url"`            // Presigned GET of the result, straight from S3
+	Method    string    `json:"method"`         // Always GET
+	ExpiresAt Timestamp `json:"expires_at"`     // When the URL stops working, at the latest
+	Size      int64     `json:"size"`           // Of the result, in bytes
+	ETag      string    `json:"etag,omitempty"` // Of the result
+}
+
+// newDownloadLinks returns the presigner configured by DOWNLOAD_URL_TTL for
+// store, or nil when it is off or results are not in S3.
+func newDownloadLinks(store *s3Store) (*downloadLinks, error) {
+	ttl := envDuration("DOWNLOAD_URL_TTL", 15*time.Minute)
+	if ttl < 0 || ttl > maxDownloadURLTTL {
+		return nil, fmt.Errorf("DOWNLOAD_URL_TTL must be between 0 and %s", maxDownloadURLTTL)
+	}
+	if ttl == 0 || store == nil {
+		return nil, nil
+	}
+	return &downloadLinks{presign: s3.NewPresignClient(store.client), bucket: store.bucket, ttl: ttl}, nil
+}
+
+// link presigns a download of jobID's result.
+func (d *downloadLinks) link(ctx context.Context, jobID string, head ObjectInfo) (DownloadLink, error) {
+	ctx, cancel := context.WithTimeout(ctx, awsOpTimeout)
+	defer cancel()
+	expires := Now().Add(d.ttl)
+	req, err := d.presign.PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket:                     aws.String(d.bucket),
+		Key:                        aws.String(fmt.Sprintf("jobs/%s.json", jobID)),
+		ResponseContentType:        aws.String("application/json"),
+		ResponseContentDisposition: aws.String(fmt.Sprintf("attachment; filename=%q", jobID+".json")),
+	}, s3.WithPresignExpires(d.ttl))
+	if err != nil {
+		return DownloadLink{}, err
+	}
+	return DownloadLink{URL: req.URL, Method: req.Method, ExpiresAt: Timestamp{Time: expires}, Size: head.Size, ETag: head.ETag}, nil
+}
+
+// adoptResult copies jobID's result into the new store of a dual-write
+// cutover when only the old one has it, so a URL for the new store finds it.
+func (a *App) adoptResult(ctx context.Context, jobID string) error {
+	d, ok := a.store.(*dualStore)
+	if !ok {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, awsOpTimeout)
+	defer cancel()
+	return d.adopt(ctx, fmt.Sprintf("jobs/%s.json", jobID))
+}
+
+// downloadJob handles GET /jobs/{id}/download requests.
+// → 200 DownloadLink for a stored result; a job without one is answered as
+// GET /jobs/{id} would (202 with its status, 404, 410), an archived result
+// with its restore state; 404 when presigned downloads are off.
+func (a *App) downloadJob(w http.ResponseWriter, r *http.Request) {
+	if a.downloads == nil {
+		http.Error(w, "presigned downloads disabled", http.StatusNotFound)
+		return
+	}
+	jobID, ok := a.pathJobID(w, r)
+	if !ok {
+		return
+	}
+	ctx := r.Context()
+	if err := a.adoptResult(ctx, jobID); err != nil {
+		writeStorageError(ctx, w, "HeadObject", "failed to look up job", err)
+		return
+	}
+	head, err := a.headResult(ctx, jobID)
+	if err != nil {
+		f := classifyS3Error(err)
+		if f.Kind == s3NotFound {
+			a.storageHealth.recordOK()
+			a.writePendingJob(w, r, jobID)
+			return
+		}
+		if f.degradesStorage() {
+			a.storageHealth.recordError()
+		}
+		writeStorageError(ctx, w, "HeadObject", "failed to look up job", err)
+		return
+	}
+	a.storageHealth.recordOK()
+	if head.Archived && restoreInfo(jobID, head).Status != restoreAvailable {
+		a.writeArchivedJob(w, r, jobID)
+		return
+	}
+	link, err := a.downloads.link(ctx, jobID, head)
+	if err != nil {
+		writeStorageError(ctx, w, "GetObject", "failed to presign download", err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, link)
+}
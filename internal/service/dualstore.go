@@ -0,0 +1,271 @@
+// Dual-write storage, for moving the service to a new backend without
+// downtime. With STORAGE_DUAL_WRITE_FROM naming the old store
+// (s3://bucket or file://dir), STORAGE_BACKEND and its settings name the new
+// one, and App.store writes to both:
+//
+//   - puts go to the new store, under the caller's conditions, then to the
+//     old store unconditionally, so a rollback finds every write there;
+//   - reads prefer the new store and fall back to the old one; an object
+//     found only in the old store is first copied into the new one, so the
+//     ETags callers use for conditional writes always come from the new
+//     store, and a conditional put of such a key sees it as existing;
+//   - listings merge both stores, the new one's copy winning;
+//   - deletes apply to both, so a deleted object cannot reappear through
+//     the fallback.
+//
+// A cutover runs dual-write on every process, backfills with POST
+// /admin/migrations or cmd/migrate, waits for storage.dual.divergence to go
+// quiet, and then drops STORAGE_DUAL_WRITE_FROM. Divergence is counted by
+// kind: fallback (read from the old store only), mirror_failed (the old
+// store missed a write, which is logged and not returned), and mismatch (a
+// sampled read, STORAGE_DUAL_VERIFY_PERCENT of them, found the stores
+// holding different bytes).
+//
+// S3-only features (retention, uploads, extended payloads, migrations,
+// presigned downloads) follow the new store, when it is S3.
+package service
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"iter"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Kinds of dual-write divergence.
+const (
+	divergenceFallback     = "fallback"
+	divergenceMirrorFailed = "mirror_failed"
+	divergenceMismatch     = "mismatch"
+)
+
+// dualStore writes to a new and an old store and reads from the new one
+// first.
+type dualStore struct {
+	primary ResultStore // The new store, authoritative
+	old     ResultStore // The store being migrated from
+	from    string      // STORAGE_DUAL_WRITE_FROM, for reports
+	verify  float64     // STORAGE_DUAL_VERIFY_PERCENT: share of reads compared with the old store
+}
+
+// parseStoreURL returns the backend and location of an s3://bucket or
+// file://dir store URL.
+func parseStoreURL(raw string) (backend, location string, err error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", "", err
+	}
+	switch u.Scheme {
+	case "s3":
+		if u.Host == "" || strings.Trim(u.Path, "/") != "" {
+			return "", "", fmt.Errorf("%q is not s3://bucket", raw)
+		}
+		return storageS3, u.Host, nil
+	case "file":
+		if dir := u.Host + u.Path; dir != "" {
+			return storageFilesystem, dir, nil
+		}
+		return "", "", fmt.Errorf("%q names no directory", raw)
+	}
+	return "", "", fmt.Errorf("%q is not an s3:// or file:// URL", raw)
+}
+
+// newDualStore returns primary writing through to the store at
+// STORAGE_DUAL_WRITE_FROM.
+func newDualStore(primary ResultStore, from string, client *s3.Client) (*dualStore, error) {
+	backend, location, err := parseStoreURL(from)
+	if err != nil {
+		return nil, fmt.Errorf("STORAGE_DUAL_WRITE_FROM: %w", err)
+	}
+	d := &dualStore{
+		primary: primary,
+		from:    from,
+		verify:  min(max(envFloat("STORAGE_DUAL_VERIFY_PERCENT", 1), 0), 100),
+	}
+	if backend == storageS3 {
+		d.old = newS3Store(client, location)
+	} else if d.old, err = newFilesystemStore(location); err != nil {
+		return nil, fmt.Errorf("STORAGE_DUAL_WRITE_FROM: %w", err)
+	}
+	return d, nil
+}
+
+// diverged counts a divergence of kind at key.
+func (d *dualStore) diverged(ctx context.Context, kind, key string) {
+	storageDivergence.Add(ctx, 1, metric.WithAttributes(attribute.String("kind", kind), attribute.String("prefix", keyPrefixOf(key))))
+}
+
+// keyPrefixOf returns the first element of key ("jobs/"), bounding the
+// divergence metric's cardinality.
+func keyPrefixOf(key string) string {
+	if i := strings.Index(key, "/"); i >= 0 {
+		return key[:i+1]
+	}
+	return key
+}
+
+func (d *dualStore) Put(ctx context.Context, key string, body []byte, opts PutOptions) error {
+	if opts.IfNoneMatch || opts.IfMatch != "" {
+		// The condition is the new store's: bring the key over first.
+		if err := d.adopt(ctx, key); err != nil {
+			return err
+		}
+	}
+	if err := d.primary.Put(ctx, key, body, opts); err != nil {
+		return err
+	}
+	d.mirror(ctx, key, body, opts.ContentType)
+	return nil
+}
+
+// mirror writes body to the old store, counting a failure rather than
+// returning it.
+func (d *dualStore) mirror(ctx context.Context, key string, body []byte, contentType string) {
+	if err := d.old.Put(ctx, key, body, PutOptions{ContentType: contentType}); err != nil {
+		d.diverged(ctx, divergenceMirrorFailed, key)
+		slog.WarnContext(ctx, "dual-write to the old store failed", "key", key, "error", err)
+	}
+}
+
+// adopt copies key from the old store into the new one when only the old
+// store has it.
+func (d *dualStore) adopt(ctx context.Context, key string) error {
+	_, err := d.primary.Head(ctx, key)
+	if err == nil || classifyS3Error(err).Kind != s3NotFound {
+		return err
+	}
+	_, err = d.copyOver(ctx, key)
+	return err
+}
+
+// copyOver copies key, missing from the new store, from the old one, and
+// reports whether the old store had it.
+func (d *dualStore) copyOver(ctx context.Context, key string) (bool, error) {
+	body, info, err := d.old.Get(ctx, key)
+	if err != nil {
+		if classifyS3Error(err).Kind == s3NotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	defer body.Close()
+	raw, err := io.ReadAll(body)
+	if err != nil {
+		return false, fmt.Errorf("read %s from the old store: %w", key, err)
+	}
+	d.diverged(ctx, divergenceFallback, key)
+	err = d.primary.Put(ctx, key, raw, PutOptions{ContentType: info.ContentType, IfNoneMatch: true})
+	if err != nil && classifyS3Error(err).Status != http.StatusPreconditionFailed {
+		return false, fmt.Errorf("copy %s to the new store: %w", key, err)
+	}
+	// On a 412 it was written since, and that copy is newer.
+	return true, nil
+}
+
+func (d *dualStore) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	body, info, err := d.primary.Get(ctx, key)
+	switch {
+	case err != nil && classifyS3Error(err).Kind == s3NotFound:
+		found, copyErr := d.copyOver(ctx, key)
+		if copyErr != nil {
+			return nil, ObjectInfo{}, copyErr
+		}
+		if found {
+			body, info, err = d.primary.Get(ctx, key)
+		}
+	case err == nil && rand.Float64()*100 < d.verify:
+		body = d.compare(ctx, key, body)
+	}
+	return body, info, err
+}
+
+// compare reads key from the old store and counts a mismatch with body,
+// which it returns re-readable.
+func (d *dualStore) compare(ctx context.Context, key string, body io.ReadCloser) io.ReadCloser {
+	defer body.Close()
+	raw, err := io.ReadAll(body)
+	if err != nil {
+		return io.NopCloser(errReader{err})
+	}
+	oldBody, _, err := d.old.Get(ctx, key)
+	switch {
+	case err == nil:
+		oldRaw, err := io.ReadAll(oldBody)
+		oldBody.Close()
+		if err == nil && !bytes.Equal(raw, oldRaw) {
+			d.diverged(ctx, divergenceMismatch, key)
+			slog.WarnContext(ctx, "dual-write stores differ", "key", key, "size", len(raw), "old_size", len(oldRaw))
+		}
+	case classifyS3Error(err).Kind == s3NotFound:
+		d.diverged(ctx, divergenceMismatch, key)
+		slog.WarnContext(ctx, "dual-write old store lacks an object", "key", key)
+	}
+	return io.NopCloser(bytes.NewReader(raw))
+}
+
+// errReader fails every read with err.
+type errReader struct{ err error }
+
+func (r errReader) Read([]byte) (int, error) { return 0, r.err }
+
+func (d *dualStore) Head(ctx context.Context, key string) (ObjectInfo, error) {
+	info, err := d.primary.Head(ctx, key)
+	if err != nil && classifyS3Error(err).Kind == s3NotFound {
+		if info, oldErr := d.old.Head(ctx, key); oldErr == nil {
+			d.diverged(ctx, divergenceFallback, key)
+			return info, nil
+		}
+	}
+	return info, err
+}
+
+func (d *dualStore) List(ctx context.Context, prefix string, opts ListOptions) iter.Seq2[ObjectInfo, error] {
+	return func(yield func(ObjectInfo, error) bool) {
+		nextNew, stopNew := iter.Pull2(d.primary.List(ctx, prefix, opts))
+		defer stopNew()
+		nextOld, stopOld := iter.Pull2(d.old.List(ctx, prefix, opts))
+		defer stopOld()
+		newObj, newErr, newOK := nextNew()
+		oldObj, oldErr, oldOK := nextOld()
+		for newOK || oldOK {
+			var obj ObjectInfo
+			var err error
+			switch {
+			case newOK && newErr != nil:
+				obj, err = newObj, newErr
+			case oldOK && oldErr != nil:
+				obj, err = oldObj, oldErr
+			case !oldOK || (newOK && newObj.Key <= oldObj.Key):
+				if oldOK && newObj.Key == oldObj.Key {
+					oldObj, oldErr, oldOK = nextOld()
+				}
+				obj = newObj
+				newObj, newErr, newOK = nextNew()
+			default:
+				obj = oldObj
+				oldObj, oldErr, oldOK = nextOld()
+			}
+			if !yield(obj, err) || err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (d *dualStore) Delete(ctx context.Context, keys []string) (int, error) {
+	// The old store first: a key left there would be read back.
+	if _, err := d.old.Delete(ctx, keys); err != nil {
+		return 0, fmt.Errorf("delete from the old store: %w", err)
+	}
+	return d.primary.Delete(ctx, keys)
+}
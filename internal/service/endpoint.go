@@ -0,0 +1,62 @@
+// Custom AWS endpoints for local development and integration tests. With
+// AWS_ENDPOINT_URL the SQS and S3 clients talk to an emulator instead of
+// AWS — LocalStack for both, or ElasticMQ for SQS and MinIO for S3 via the
+// per-service AWS_ENDPOINT_URL_SQS and AWS_ENDPOINT_URL_S3, which take
+// precedence. S3_FORCE_PATH_STYLE=true addresses buckets as
+// {endpoint}/{bucket} instead of {bucket}.{endpoint}, which MinIO and a
+// LocalStack without wildcard DNS need. Unset, the clients resolve the
+// regional AWS endpoints as usual.
+package service
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+// sqsEndpoint returns the endpoint the SQS client uses; "" for AWS.
+func (c Config) sqsEndpoint() string {
+	if c.SQSEndpointURL != "" {
+		return c.SQSEndpointURL
+	}
+	return c.EndpointURL
+}
+
+// s3Endpoint returns the endpoint the S3 client uses; "" for AWS.
+func (c Config) s3Endpoint() string {
+	if c.S3EndpointURL != "" {
+		return c.S3EndpointURL
+	}
+	return c.EndpointURL
+}
+
+// validEndpoint checks an endpoint setting: an absolute http or https URL.
+func validEndpoint(name, v string) error {
+	if v == "" {
+		return nil
+	}
+	u, err := url.Parse(v)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%s must be an http or https URL, not %q", name, v)
+	}
+	return nil
+}
+
+// sqsOptions points an SQS client at the configured endpoint.
+func (c Config) sqsOptions(o *sqs.Options) {
+	if ep := c.sqsEndpoint(); ep != "" {
+		o.BaseEndpoint = aws.String(ep)
+	}
+}
+
+// s3Options points an S3 client at the configured endpoint and addressing
+// style.
+func (c Config) s3Options(o *s3.Options) {
+	if ep := c.s3Endpoint(); ep != "" {
+		o.BaseEndpoint = aws.String(ep)
+	}
+	o.UsePathStyle = c.S3PathStyle
+}
@@ -0,0 +1,62 @@
+// Typed environment-variable helpers for optional settings. They are meant for
+// startup only: an unparsable value is a misconfiguration and exits the
+// process, the same as a missing required variable. Reads are recorded for
+// GET /admin/config (config.go).
+package service
+
+import (
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+)
+
+// envInt returns the integer value of name, or def when unset.
+func envInt(name string, def int) int {
+	recordSetting(name, strconv.Itoa(def))
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		slog.Error("invalid integer environment variable", "name", name, "value", v)
+		os.Exit(1)
+	}
+	return n
+}
+
+// envDuration returns the duration value of name (e.g. "30s", "5m"), or def
+// when unset.
+func envDuration(name string, def time.Duration) time.Duration {
+	if def != 0 {
+		recordSetting(name, def.String())
+	} else {
+		recordSetting(name, "")
+	}
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		slog.Error("invalid duration environment variable", "name", name, "value", v)
+		os.Exit(1)
+	}
+	return d
+}
+
+// envFloat returns the floating-point value of name, or def when unset.
+func envFloat(name string, def float64) float64 {
+	recordSetting(name, strconv.FormatFloat(def, 'g', -1, 64))
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		slog.Error("invalid number environment variable", "name", name, "value", v)
+		os.Exit(1)
+	}
+	return f
+}
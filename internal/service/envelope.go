@@ -0,0 +1,116 @@
+// Queue message envelope. Every message the service puts on a queue is an
+// Envelope: a format version, a message type, a headers map for cross-cutting
+// metadata, and the typed body — for jobs, a JobMessage. The wire format is
+// defined in pkg/contract, which producers outside the service use too:
+//
+//	{"v":1,"type":"job","headers":{"traceparent":"…","tenant":"acme","request-id":"…"},"body":{"id":"…",…}}
+//
+// Headers carry the trace context (under the propagator's own names, e.g.
+// traceparent and X-Amzn-Trace-Id), the submitting tenant and the client's
+// X-Request-ID. Keeping them inside the message rather than in SQS message
+// attributes means they survive any transport, the local send buffer
+// included, unchanged.
+//
+// Workers still accept the bare JobMessage bodies earlier versions sent, with
+// trace context in the message attributes, so messages already queued or
+// spooled keep working. Older workers do not understand envelopes: deploy
+// workers before the API.
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+
+	"go-microservice/pkg/contract"
+)
+
+// envelopeVersion is the envelope format this version writes, and the
+// newest it reads.
+const envelopeVersion = contract.EnvelopeVersion
+
+// Message types.
+const messageTypeJob = contract.TypeJob // Body is a JobMessage
+
+// Envelope header names, besides the trace context.
+const (
+	envelopeHeaderTenant        = contract.HeaderTenant
+	envelopeHeaderRequestID     = contract.HeaderRequestID
+	envelopeHeaderPriorAttempts = contract.HeaderPriorAttempts // Updated on each trip through the DLQ (redrive.go)
+	envelopeHeaderAdapter       = "adapter"                    // MESSAGE_ADAPTERS entry that built the envelope (adapter.go)
+)
+
+// headerRequestID is the client's request ID, carried to the worker.
+const headerRequestID = "X-Request-ID"
+
+// Envelope is the body of every queue message: contract.Envelope, with the
+// worker's methods.
+type Envelope contract.Envelope
+
+// newEnvelope wraps body as a message of type typ, with ctx's trace context
+// and the non-empty headers given.
+func newEnvelope(ctx context.Context, typ string, body any, headers map[string]string) (Envelope, error) {
+	env, err := contract.NewEnvelope(ctx, typ, body, headers)
+	return Envelope(env), err
+}
+
+// openEnvelope decodes a received message. A bare JobMessage from before
+// envelopes is wrapped as a version 0 job envelope whose headers are the
+// message's string attributes.
+func openEnvelope(message types.Message) (Envelope, error) {
+	body := []byte(aws.ToString(message.Body))
+	var env Envelope
+	if err := json.Unmarshal(body, &env); err != nil {
+		return Envelope{}, fmt.Errorf("failed to unmarshal message: %w", err)
+	}
+	switch {
+	case env.Version == 0:
+		return Envelope{Type: messageTypeJob, Headers: stringAttributes(message.MessageAttributes), Body: body}, nil
+	case env.Version > envelopeVersion:
+		return Envelope{}, fmt.Errorf("unsupported message envelope version %d (this version reads up to %d)", env.Version, envelopeVersion)
+	}
+	return env, nil
+}
+
+// traceContext returns ctx continuing the trace in the envelope's headers.
+func (e Envelope) traceContext(ctx context.Context) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(e.Headers))
+}
+
+// decodeBody decodes the body of a message of type typ into v, failing on a
+// message of any other type.
+func (e Envelope) decodeBody(typ string, v any) error {
+	if e.Type != typ {
+		return fmt.Errorf("unexpected message type %q, want %q", e.Type, typ)
+	}
+	if err := json.Unmarshal(e.Body, v); err != nil {
+		return fmt.Errorf("failed to unmarshal %s message: %w", typ, err)
+	}
+	return nil
+}
+
+// priorAttempts returns the deliveries recorded in the prior-attempts header,
+// or 0.
+func (e Envelope) priorAttempts() int {
+	n, _ := strconv.Atoi(e.Headers[envelopeHeaderPriorAttempts])
+	return max(n, 0)
+}
+
+// withPriorAttempts returns a current-version copy of the envelope recording
+// n deliveries so far.
+func (e Envelope) withPriorAttempts(n int) Envelope {
+	e.Version = envelopeVersion
+	e.Headers = maps.Clone(e.Headers)
+	if e.Headers == nil {
+		e.Headers = map[string]string{}
+	}
+	e.Headers[envelopeHeaderPriorAttempts] = strconv.Itoa(n)
+	return e
+}
@@ -0,0 +1,67 @@
+// Structured JSON error responses. Plain http.Error text is fine for simple
+// client mistakes, but failures a client should react to programmatically
+// (retry later, back off) carry a stable machine-readable code.
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Error codes returned in ErrorBody.Code.
+const (
+	// errCodeStorageUnavailable means the result store could not be reached;
+	// the request is safe to retry.
+	errCodeStorageUnavailable = "storage_unavailable"
+)
+
+// ErrorBody is the JSON error envelope: {"error":{"code":...,"message":...}}.
+type ErrorBody struct {
+	Error ErrorDetail `json:"error"`
+}
+
+// ErrorDetail describes a single API error.
+type ErrorDetail struct {
+	Code      string       `json:"code"`                // Stable machine-readable error code
+	Message   string       `json:"message"`             // Human-readable description
+	Retryable bool         `json:"retryable,omitempty"` // Whether retrying the same request may succeed
+	Fields    []FieldError `json:"fields,omitempty"`    // Invalid request fields, for invalid_request
+}
+
+// FieldError is one invalid field of a request body.
+type FieldError struct {
+	Field   string `json:"field"`   // JSON field name
+	Message string `json:"message"` // What is wrong, e.g. "text is required"
+}
+
+// Error returns the message.
+func (e FieldError) Error() string { return e.Message }
+
+// fieldErrors is a request that failed validation on one or more fields.
+type fieldErrors []FieldError
+
+// Error joins the field messages.
+func (e fieldErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, f := range e {
+		msgs[i] = f.Message
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// writeError writes a JSON error envelope with the given status.
+func writeError(w http.ResponseWriter, status int, detail ErrorDetail) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ErrorBody{Error: detail})
+}
+
+// writeRetryableError writes a retryable JSON error with a Retry-After hint.
+func writeRetryableError(w http.ResponseWriter, status int, code, message string, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+	writeError(w, status, ErrorDetail{Code: code, Message: message, Retryable: true})
+}
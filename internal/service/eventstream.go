@@ -0,0 +1,341 @@
+// Event streaming to a data lake. With EVENTS_FIREHOSE_STREAM naming an
+// Amazon Data Firehose stream, every process streams its job lifecycle
+// events (enqueued, completed, failed, as published on the broker) and its
+// audit events (every request to an admin endpoint, allowed or refused) to
+// it, one StreamEvent per record, as a JSON line. The records follow
+// docs/event-stream.avsc, so Firehose can deliver them as they are
+// (newline-delimited JSON) or convert them to Parquet or ORC with that
+// schema. The schema only gains optional fields; anything else bumps
+// schema_version.
+//
+// Events are batched in the background: a batch is sent with PutRecordBatch
+// once it holds EVENTS_FIREHOSE_BATCH_SIZE records (500 at most, 4 MiB in
+// all) or EVENTS_FIREHOSE_FLUSH_INTERVAL after its first event. Records
+// Firehose rejects, throttled ones included, are resent with backoff up to
+// EVENTS_FIREHOSE_MAX_ATTEMPTS attempts per batch; whatever is left is
+// written to the bucket as one object,
+// events/failed/{yyyy}/{MM}/{dd}/{HH}/{time}-{id}.jsonl, in the same format,
+// so it can be loaded next to Firehose's own delivery.
+//
+// Recording an event never blocks: while Firehose is slow the events wait in
+// a buffer of EVENTS_FIREHOSE_BUFFER, and once that is full further events
+// are dropped and counted (events.stream.records, outcome "dropped"). Shutdown
+// sends what is buffered, within SHUTDOWN_TIMEOUT. Delivery is at least once;
+// deduplicate on event_id.
+package service
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/firehose"
+	"github.com/aws/aws-sdk-go-v2/service/firehose/types"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// eventsFailedPrefix holds the batches Firehose did not take.
+const eventsFailedPrefix = "events/failed/"
+
+// streamSchemaVersion is StreamEvent's schema_version.
+const streamSchemaVersion = 1
+
+// Firehose's PutRecordBatch limits.
+const (
+	firehoseMaxBatchRecords = 500
+	firehoseMaxBatchBytes   = 4 << 20
+	firehoseMaxRecordBytes  = 1000 << 10
+)
+
+// Backoff between attempts at a batch.
+const (
+	streamBackoffBase = 500 * time.Millisecond
+	streamBackoffMax  = 10 * time.Second
+)
+
+// Kinds of streamed event.
+const (
+	streamKindJob   = "job"
+	streamKindAudit = "audit"
+)
+
+// Types of audit event.
+const (
+	auditAdminRequest = "admin_request" // An admin endpoint ran
+	auditAdminDenied  = "admin_denied"  // An admin endpoint was refused for want of the token
+)
+
+// Outcomes of a streamed event, for events.stream.records.
+const (
+	streamDelivered = "delivered" // Firehose took it
+	streamFallback  = "fallback"  // Written to events/failed/
+	streamDropped   = "dropped"   // The buffer was full
+	streamLost      = "lost"      // Neither Firehose nor the bucket took it
+)
+
+// StreamEvent is one record of the event stream, as described by
+// docs/event-stream.avsc. Fields that do not apply to an event are omitted.
+type StreamEvent struct {
+	SchemaVersion int       `json:"schema_version"`     // streamSchemaVersion
+	EventID       string    `json:"event_id"`           // Unique; repeated only by redelivery
+	Kind          string    `json:"kind"`               // job or audit
+	Type          string    `json:"type"`               // job: enqueued, completed, failed; audit: admin_request, admin_denied
+	At            Timestamp `json:"at"`                 // When the event happened
+	Source        string    `json:"source"`             // Host name of the process that recorded it
+	JobID         string    `json:"job_id,omitempty"`   // Job events: the job
+	Tenant        string    `json:"tenant,omitempty"`   // Job events: the submitting tenant; audit events: the caller's
+	Error         string    `json:"error,omitempty"`    // Failed job events: why
+	Actor         string    `json:"actor,omitempty"`    // Audit events: the caller (X-Client-ID or client IP)
+	Action        string    `json:"action,omitempty"`   // Audit events: the route, "POST /admin/redrive/run"
+	Resource      string    `json:"resource,omitempty"` // Audit events: the request path
+	Status        int       `json:"status,omitempty"`   // Audit events: the response status
+}
+
+// eventStream batches StreamEvents to Firehose.
+type eventStream struct {
+	app           *App // For the fallback writes
+	client        *firehose.Client
+	name          string        // EVENTS_FIREHOSE_STREAM
+	batchSize     int           // EVENTS_FIREHOSE_BATCH_SIZE: records per PutRecordBatch
+	flushInterval time.Duration // EVENTS_FIREHOSE_FLUSH_INTERVAL: longest an event waits for its batch to fill
+	maxAttempts   int           // EVENTS_FIREHOSE_MAX_ATTEMPTS: sends of a batch before the fallback
+	source        string
+
+	events chan StreamEvent // EVENTS_FIREHOSE_BUFFER long
+	stop   chan struct{}    // Closed by close
+	done   chan struct{}    // Closed once run has sent what was buffered
+}
+
+// newEventStream returns the stream configured by EVENTS_FIREHOSE_STREAM and
+// its settings, or nil when it is unset.
+func newEventStream(a *App, client *firehose.Client) *eventStream {
+	name := getenv("EVENTS_FIREHOSE_STREAM")
+	if name == "" {
+		return nil
+	}
+	source, _ := os.Hostname()
+	return &eventStream{
+		app:           a,
+		client:        client,
+		name:          name,
+		batchSize:     min(max(envInt("EVENTS_FIREHOSE_BATCH_SIZE", firehoseMaxBatchRecords), 1), firehoseMaxBatchRecords),
+		flushInterval: max(envDuration("EVENTS_FIREHOSE_FLUSH_INTERVAL", 5*time.Second), 100*time.Millisecond),
+		maxAttempts:   max(envInt("EVENTS_FIREHOSE_MAX_ATTEMPTS", 5), 1),
+		source:        source,
+		events:        make(chan StreamEvent, max(envInt("EVENTS_FIREHOSE_BUFFER", 10_000), 1)),
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+}
+
+// record queues ev for the stream without blocking, dropping it when the
+// buffer is full. A nil stream records nothing.
+func (s *eventStream) record(ctx context.Context, ev StreamEvent) {
+	if s == nil {
+		return
+	}
+	ev.SchemaVersion = streamSchemaVersion
+	ev.EventID = uuid.NewString()
+	ev.Source = s.source
+	if ev.At.IsZero() {
+		ev.At = Now()
+	}
+	select {
+	case s.events <- ev:
+	default:
+		s.counted(ctx, streamDropped, ev.Kind, 1)
+	}
+}
+
+// recordJob is the broker sink streaming job lifecycle events.
+func (s *eventStream) recordJob(ctx context.Context, ev JobEvent) {
+	s.record(ctx, StreamEvent{Kind: streamKindJob, Type: ev.Type.String(), At: ev.At, JobID: ev.JobID, Tenant: ev.Tenant, Error: ev.Error})
+}
+
+// recordAdmin streams an audit event of type typ for an admin request
+// answered with status.
+func (s *eventStream) recordAdmin(r *http.Request, typ string, status int) {
+	p := principalFromRequest(r)
+	s.record(r.Context(), StreamEvent{
+		Kind:     streamKindAudit,
+		Type:     typ,
+		Tenant:   p.Tenant,
+		Actor:    p.ID,
+		Action:   cmp.Or(r.Pattern, r.Method+" "+r.URL.Path),
+		Resource: r.URL.Path,
+		Status:   status,
+	})
+}
+
+// counted adds n events of kind to events.stream.records under outcome.
+func (s *eventStream) counted(ctx context.Context, outcome, kind string, n int) {
+	streamRecords.Add(ctx, int64(n), metric.WithAttributes(attribute.String("outcome", outcome), attribute.String("kind", kind)))
+}
+
+// streamRecord is a StreamEvent encoded for Firehose.
+type streamRecord struct {
+	kind string
+	data []byte // One JSON line
+}
+
+// run batches events until close is called, then sends what is left.
+func (s *eventStream) run() {
+	defer close(s.done)
+	var batch []streamRecord
+	var size int
+	timer := time.NewTimer(s.flushInterval)
+	timer.Stop()
+	flush := func() {
+		s.send(context.Background(), batch)
+		batch, size = nil, 0
+		timer.Stop()
+	}
+	add := func(ev StreamEvent) {
+		data, err := json.Marshal(ev)
+		if err != nil || len(data)+1 > firehoseMaxRecordBytes {
+			s.counted(context.Background(), streamDropped, ev.Kind, 1)
+			slog.Warn("dropping unstreamable event", "kind", ev.Kind, "type", ev.Type, "size", len(data), "error", err)
+			return
+		}
+		data = append(data, '\n')
+		if size+len(data) > firehoseMaxBatchBytes {
+			flush()
+		}
+		if len(batch) == 0 {
+			timer.Reset(s.flushInterval)
+		}
+		batch = append(batch, streamRecord{kind: ev.Kind, data: data})
+		size += len(data)
+		if len(batch) >= s.batchSize {
+			flush()
+		}
+	}
+	for {
+		select {
+		case ev := <-s.events:
+			add(ev)
+		case <-timer.C:
+			flush()
+		case <-s.stop:
+			for len(s.events) > 0 {
+				add(<-s.events)
+			}
+			if len(batch) > 0 {
+				flush()
+			}
+			return
+		}
+	}
+}
+
+// start runs the stream in the background.
+func (s *eventStream) start() {
+	go s.run()
+}
+
+// close sends the buffered events, waiting until ctx ends at most.
+func (s *eventStream) close(ctx context.Context) {
+	if s == nil {
+		return
+	}
+	close(s.stop)
+	select {
+	case <-s.done:
+	case <-ctx.Done():
+		slog.Error("event stream did not send its buffered events before SHUTDOWN_TIMEOUT", "buffered", len(s.events))
+	}
+}
+
+// send delivers batch, resending rejected records with backoff and writing
+// those left after the last attempt to the fallback.
+func (s *eventStream) send(ctx context.Context, batch []streamRecord) {
+	pending := batch
+	for attempt := 1; len(pending) > 0; attempt++ {
+		rejected, err := s.put(ctx, pending)
+		s.countBatch(ctx, streamDelivered, pending, rejected)
+		pending = rejected
+		if len(pending) == 0 {
+			return
+		}
+		if attempt >= s.maxAttempts {
+			slog.Warn("Firehose did not take events; writing them to the bucket", "stream", s.name, "records", len(pending), "attempts", attempt, "error", err)
+			s.fallback(ctx, pending)
+			return
+		}
+		d := streamBackoffBase << min(attempt-1, 10)
+		time.Sleep(min(d, streamBackoffMax))
+	}
+}
+
+// countBatch counts the records of sent missing from rejected under
+// outcome.
+func (s *eventStream) countBatch(ctx context.Context, outcome string, sent, rejected []streamRecord) {
+	n := map[string]int{}
+	for _, r := range sent {
+		n[r.kind]++
+	}
+	for _, r := range rejected {
+		n[r.kind]--
+	}
+	for kind, count := range n {
+		if count > 0 {
+			s.counted(ctx, outcome, kind, count)
+		}
+	}
+}
+
+// put sends records in one PutRecordBatch and returns those Firehose
+// rejected, every one when the call failed.
+func (s *eventStream) put(ctx context.Context, records []streamRecord) ([]streamRecord, error) {
+	ctx, cancel := context.WithTimeout(ctx, awsOpTimeout)
+	defer cancel()
+	in := &firehose.PutRecordBatchInput{DeliveryStreamName: aws.String(s.name), Records: make([]types.Record, len(records))}
+	for i, r := range records {
+		in.Records[i] = types.Record{Data: r.data}
+	}
+	out, err := s.client.PutRecordBatch(ctx, in)
+	if err != nil {
+		return records, err
+	}
+	if aws.ToInt32(out.FailedPutCount) == 0 {
+		return nil, nil
+	}
+	var rejected []streamRecord
+	var first error
+	for i, entry := range out.RequestResponses {
+		if entry.ErrorCode != nil && i < len(records) {
+			rejected = append(rejected, records[i])
+			if first == nil {
+				first = fmt.Errorf("%s: %s", aws.ToString(entry.ErrorCode), aws.ToString(entry.ErrorMessage))
+			}
+		}
+	}
+	return rejected, first
+}
+
+// fallback writes records to one object under eventsFailedPrefix.
+func (s *eventStream) fallback(ctx context.Context, records []streamRecord) {
+	now := time.Now().UTC()
+	key := fmt.Sprintf("%s%s/%s-%s.jsonl", eventsFailedPrefix, now.Format("2006/01/02/15"), now.Format("20060102T150405.000Z"), uuid.NewString())
+	var body bytes.Buffer
+	for _, r := range records {
+		body.Write(r.data)
+	}
+	ctx, cancel := context.WithTimeout(ctx, awsOpTimeout)
+	defer cancel()
+	if err := s.app.store.Put(ctx, key, body.Bytes(), PutOptions{ContentType: "application/x-ndjson"}); err != nil {
+		s.countBatch(ctx, streamLost, records, nil)
+		slog.Error("failed to write undelivered events to the bucket; they are lost", "key", key, "records", len(records), "error", err)
+		return
+	}
+	s.countBatch(ctx, streamFallback, records, nil)
+}
@@ -0,0 +1,239 @@
+// Large messages in the Amazon SQS Extended Client Library format. Producers
+// using that library (Java, Python, …) store bodies too large for SQS in S3
+// and send a pointer instead:
+//
+//	["software.amazon.payloadoffloading.PayloadS3Pointer",{"s3BucketName":"…","s3Key":"…"}]
+//
+// with the original size in an ExtendedPayloadSize message attribute
+// (SQSLargePayloadSize in older versions). The worker and the redriver
+// resolve such a pointer before opening the message, so those producers can
+// send JobMessages or envelopes straight to the job queue. Pointers may only
+// name the job bucket or one listed in SQS_EXTENDED_BUCKETS. As with the
+// library, the payload is deleted once its job has been processed; a failed
+// job's payload is kept with its failure record.
+//
+// The service writes the format too, storing a body it sends — new jobs,
+// buffered sends, dead-letter forwards and redrives — at payloads/{id}.json
+// and sending a pointer in its place. SQS_EXTENDED_PRODUCE picks which:
+//
+//	auto   (default) messages SQS would reject: over 256 KiB, the SQS limit,
+//	       counting attributes as SQS does; only with S3 storage
+//	true   also any body longer than SQS_EXTENDED_THRESHOLD bytes
+//	false  none; a message too large for SQS fails with errMessageTooLarge,
+//	       which POST /jobs answers with 413
+//
+// Offloaded messages count in queue.messages.offloaded{reason}. Workers have
+// read pointers since before the service wrote them; a worker that does not
+// would fail the job. A job that arrived as a pointer and is too large to
+// send inline cannot be forwarded to DLQ_URL or redriven unless offloading
+// is on.
+package service
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// payloadPointerClass is the first element of an Extended Client pointer.
+const payloadPointerClass = "software.amazon.payloadoffloading.PayloadS3Pointer"
+
+// Message attributes that mark an Extended Client pointer.
+const (
+	attrExtendedPayloadSize = "ExtendedPayloadSize"
+	attrLegacyPayloadSize   = "SQSLargePayloadSize"
+)
+
+// sqsMaxMessageBytes is the largest message body SQS accepts.
+const sqsMaxMessageBytes = 256 << 10
+
+// SQS_EXTENDED_PRODUCE values.
+const (
+	produceAuto   = "auto"
+	produceAlways = "true"
+	produceNever  = "false"
+)
+
+// Reasons a sent body is offloaded, the reason attribute of
+// queue.messages.offloaded.
+const (
+	offloadThreshold = "threshold"  // Over SQS_EXTENDED_THRESHOLD
+	offloadSizeLimit = "size_limit" // Over the SQS limit
+)
+
+// errMessageTooLarge is returned for a message SQS would reject for its size
+// when offloading is off.
+var errMessageTooLarge = errors.New("message is over the 256 KiB SQS limit")
+
+// maxPointerPayloadBytes caps a payload read through a pointer: the largest
+// job body, JSON-escaped, with room to spare.
+const maxPointerPayloadBytes = 16 << 20
+
+// payloadPointer is the object half of an Extended Client pointer.
+type payloadPointer struct {
+	Bucket string `json:"s3BucketName"`
+	Key    string `json:"s3Key"`
+}
+
+// extendedPayloads is the Extended Client configuration.
+type extendedPayloads struct {
+	produce   string   // SQS_EXTENDED_PRODUCE: auto, true or false
+	threshold int      // Body length above which a sent body is offloaded under true
+	buckets   []string // Buckets pointers may name, the job bucket included
+}
+
+// newExtendedPayloads returns the settings from SQS_EXTENDED_PRODUCE,
+// SQS_EXTENDED_THRESHOLD and SQS_EXTENDED_BUCKETS.
+func newExtendedPayloads(jobBucket string) (extendedPayloads, error) {
+	p := extendedPayloads{
+		produce:   cmp.Or(getenv("SQS_EXTENDED_PRODUCE"), produceAuto),
+		threshold: min(max(envInt("SQS_EXTENDED_THRESHOLD", sqsMaxMessageBytes), 0), sqsMaxMessageBytes),
+		buckets:   []string{jobBucket},
+	}
+	for b := range strings.SplitSeq(getenv("SQS_EXTENDED_BUCKETS"), ",") {
+		if b = strings.TrimSpace(b); b != "" {
+			p.buckets = append(p.buckets, b)
+		}
+	}
+	if p.produce != produceAuto && p.produce != produceAlways && p.produce != produceNever {
+		return extendedPayloads{}, fmt.Errorf("SQS_EXTENDED_PRODUCE must be auto, true or false, not %q", p.produce)
+	}
+	return p, nil
+}
+
+// offloadReason returns why a message of size bytes (messageSize) with a
+// body of bodyLen bytes is offloaded, or "" when it is sent inline.
+func (p extendedPayloads) offloadReason(bodyLen, size int) string {
+	switch {
+	case p.produce == produceNever:
+		return ""
+	case size > sqsMaxMessageBytes:
+		return offloadSizeLimit
+	case p.produce == produceAlways && bodyLen > p.threshold:
+		return offloadThreshold
+	}
+	return ""
+}
+
+// messageSize returns the size of a message as SQS counts it against its
+// limit: the body and each attribute's name, data type and value.
+func messageSize(body string, attrs map[string]types.MessageAttributeValue) int {
+	n := len(body)
+	for name, v := range attrs {
+		n += len(name) + len(aws.ToString(v.DataType)) + len(aws.ToString(v.StringValue)) + len(v.BinaryValue)
+	}
+	return n
+}
+
+// isPointer reports whether m carries an Extended Client pointer.
+func isPointer(m types.Message) bool {
+	_, ok := m.MessageAttributes[attrExtendedPayloadSize]
+	_, legacy := m.MessageAttributes[attrLegacyPayloadSize]
+	return ok || legacy
+}
+
+// parsePointer decodes an Extended Client pointer body.
+func parsePointer(body string) (payloadPointer, error) {
+	var parts []json.RawMessage
+	var class string
+	var ptr payloadPointer
+	if json.Unmarshal([]byte(body), &parts) != nil || len(parts) != 2 ||
+		json.Unmarshal(parts[0], &class) != nil || class != payloadPointerClass ||
+		json.Unmarshal(parts[1], &ptr) != nil || ptr.Bucket == "" || ptr.Key == "" {
+		return payloadPointer{}, errors.New("message has an extended payload attribute but no valid S3 pointer")
+	}
+	return ptr, nil
+}
+
+// resolvePayload returns m with an Extended Client pointer replaced by the
+// body it points to, and the pointer; a message without one is returned
+// unchanged with a nil pointer.
+func (a *App) resolvePayload(ctx context.Context, m types.Message) (types.Message, *payloadPointer, error) {
+	if !isPointer(m) {
+		return m, nil, nil
+	}
+	ptr, err := parsePointer(aws.ToString(m.Body))
+	if err != nil {
+		return m, nil, err
+	}
+	if !slices.Contains(a.payloads.buckets, ptr.Bucket) {
+		return m, nil, fmt.Errorf("extended payload bucket %q is not allowed (SQS_EXTENDED_BUCKETS)", ptr.Bucket)
+	}
+	ctx, cancel := context.WithTimeout(ctx, awsOpTimeout)
+	defer cancel()
+	out, err := a.s3Client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(ptr.Bucket), Key: aws.String(ptr.Key)})
+	if err != nil {
+		recordS3Error(ctx, "GetObject", classifyS3Error(err))
+		return m, nil, fmt.Errorf("failed to read extended payload s3://%s/%s: %w", ptr.Bucket, ptr.Key, err)
+	}
+	defer out.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(out.Body, maxPointerPayloadBytes+1))
+	if err != nil {
+		return m, nil, fmt.Errorf("failed to read extended payload s3://%s/%s: %w", ptr.Bucket, ptr.Key, err)
+	}
+	if len(body) > maxPointerPayloadBytes {
+		return m, nil, fmt.Errorf("extended payload exceeds %d bytes", maxPointerPayloadBytes)
+	}
+	m.Body = aws.String(string(body))
+	m.MessageAttributes = maps.Clone(m.MessageAttributes)
+	delete(m.MessageAttributes, attrExtendedPayloadSize)
+	delete(m.MessageAttributes, attrLegacyPayloadSize)
+	return m, &ptr, nil
+}
+
+// deletePayload removes a processed job's payload.
+func (a *App) deletePayload(ctx context.Context, ptr payloadPointer) error {
+	ctx, cancel := context.WithTimeout(ctx, awsOpTimeout)
+	defer cancel()
+	_, err := a.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(ptr.Bucket), Key: aws.String(ptr.Key)})
+	if err != nil {
+		recordS3Error(ctx, "DeleteObject", classifyS3Error(err))
+	}
+	return err
+}
+
+// offloadPayload stores body at payloads/{jobID}.json and returns the pointer
+// body and attributes to send in its place. Attributes already given are
+// kept.
+func (a *App) offloadPayload(ctx context.Context, jobID, body string, attrs map[string]types.MessageAttributeValue) (string, map[string]types.MessageAttributeValue, error) {
+	if jobID == "" {
+		jobID = uuid.New().String()
+	}
+	ptr := payloadPointer{Bucket: a.s3Bucket, Key: payloadsPrefix + jobID + ".json"}
+	_, err := a.s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(ptr.Bucket),
+		Key:         aws.String(ptr.Key),
+		Body:        strings.NewReader(body),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		recordS3Error(ctx, "PutObject", classifyS3Error(err))
+		return "", nil, fmt.Errorf("failed to offload message body: %w", err)
+	}
+	raw, _ := json.Marshal([]any{payloadPointerClass, ptr})
+	attrs = maps.Clone(attrs)
+	if attrs == nil {
+		attrs = map[string]types.MessageAttributeValue{}
+	}
+	attrs[attrExtendedPayloadSize] = types.MessageAttributeValue{DataType: aws.String("Number"), StringValue: aws.String(strconv.Itoa(len(body)))}
+	return string(raw), attrs, nil
+}
+
+// countOffloaded counts a body offloaded for reason.
+func countOffloaded(ctx context.Context, reason string) {
+	messagesOffloaded.Add(ctx, 1, metric.WithAttributes(attribute.String("reason", reason)))
+}
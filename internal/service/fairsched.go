@@ -0,0 +1,375 @@
+// Fair scheduling across tenants in the worker. SQS hands out messages in
+// roughly the order they were sent, so without it one tenant flooding the
+// queue holds every worker until its backlog is through. With
+// FAIR_SCHEDULING=true the worker instead receives into a staging buffer of
+// FAIR_STAGING_SIZE messages, one FIFO per tenant (the envelope's tenant
+// header), and a dispatcher hands each free worker the next message by
+// smooth weighted round-robin over the tenants with staged work:
+//
+//	TENANT_WEIGHTS        acme=3,trial=1: a tenant's share of dispatches while
+//	                      others are waiting too (default weight 1)
+//	TENANT_MAX_IN_FLIGHT  messages of one tenant processed at once; 0 (the
+//	                      default) for no cap
+//
+// Round-robin alone is work-conserving: a tenant alone on the queue gets
+// every worker. A cap holds a tenant's further messages in staging even with
+// workers idle, but only as many as its cap: the rest are released back to
+// the queue for fairHoldDelay, so a capped tenant's backlog cannot fill
+// staging and stop the worker receiving other tenants' messages. A release
+// is not an attempt at the job (deliveries.go).
+//
+// Staged messages are invisible on the queue. A message staged for a third
+// of FAIR_STAGING_VISIBILITY — set it to the queue's visibility timeout — has
+// its visibility timeout set to it again, and once more at dispatch if it
+// waited a while, so waiting in staging neither lets it reappear for another
+// worker nor eats into the time its processing has. At shutdown those not yet dispatched are released
+// back to the queue at once. The intake throttle (throttle.go) limits
+// dispatches rather than receives.
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// fairHoldDelay is how long a message released by a tenant at its cap stays
+// hidden before it can be received again.
+const fairHoldDelay = 10 * time.Second
+
+// fairScheduler stages received messages by tenant and picks which one a
+// free worker takes next. Safe for concurrent use.
+type fairScheduler struct {
+	capacity    int            // FAIR_STAGING_SIZE
+	maxInFlight int            // TENANT_MAX_IN_FLIGHT; 0 for no cap
+	weights     map[string]int // TENANT_WEIGHTS; others weigh 1
+	visibility  time.Duration  // FAIR_STAGING_VISIBILITY: the visibility timeout staged messages are kept hidden with
+
+	ready chan struct{} // Signalled when a message may have become dispatchable
+	room  chan struct{} // Signalled when staging space was freed
+
+	mu         sync.Mutex
+	tenants    map[string]*fairTenant // Tenants with staged or in-flight messages
+	staged     int                    // Messages in staging, over every tenant
+	dispatched map[string]string      // Receipt handle → tenant, while in flight
+}
+
+// fairTenant is one tenant's staged and in-flight messages.
+type fairTenant struct {
+	name     string
+	weight   int
+	credit   int // Smooth weighted round-robin state
+	queue    []stagedMessage
+	inFlight int
+}
+
+// stagedMessage is a received message waiting for a worker.
+type stagedMessage struct {
+	message  types.Message
+	tenant   string
+	received time.Time
+	hidden   time.Time // When its visibility timeout was last set
+}
+
+// newFairScheduler returns the scheduler configured by FAIR_SCHEDULING and
+// the TENANT_* variables for a worker of workers goroutines, or nil when
+// fair scheduling is off.
+func newFairScheduler(workers int) (*fairScheduler, error) {
+	if getenv("FAIR_SCHEDULING") != "true" {
+		return nil, nil
+	}
+	s := &fairScheduler{
+		capacity:    envInt("FAIR_STAGING_SIZE", max(4*workers, maxReceiveBatch)),
+		maxInFlight: envInt("TENANT_MAX_IN_FLIGHT", 0),
+		visibility:  envDuration("FAIR_STAGING_VISIBILITY", memoryVisibilityTimeout),
+		weights:     map[string]int{},
+		ready:       make(chan struct{}, 1),
+		room:        make(chan struct{}, 1),
+		tenants:     map[string]*fairTenant{},
+		dispatched:  map[string]string{},
+	}
+	if s.capacity <= 0 || s.maxInFlight < 0 {
+		return nil, fmt.Errorf("FAIR_STAGING_SIZE must be positive and TENANT_MAX_IN_FLIGHT must not be negative")
+	}
+	if s.visibility < 3*time.Second || s.visibility > maxVisibilityTimeout {
+		return nil, fmt.Errorf("FAIR_STAGING_VISIBILITY must be between 3s and %s", maxVisibilityTimeout)
+	}
+	for _, entry := range strings.Split(getenv("TENANT_WEIGHTS"), ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		tenant, raw, ok := strings.Cut(entry, "=")
+		weight, err := strconv.Atoi(strings.TrimSpace(raw))
+		if tenant = strings.TrimSpace(tenant); !ok || tenant == "" || err != nil || weight <= 0 {
+			return nil, fmt.Errorf("TENANT_WEIGHTS entry %q must be tenant=weight with a positive integer weight", entry)
+		}
+		s.weights[tenant] = weight
+	}
+	return s, nil
+}
+
+// messageTenant returns the tenant that submitted message: the envelope's
+// tenant header, or for a bare job message its tenant field. Messages it
+// cannot tell, including those an adapter or the Extended Client still has
+// to resolve, count as defaultTenant.
+func messageTenant(message types.Message) string {
+	env, err := openEnvelope(message)
+	if err != nil {
+		return defaultTenant
+	}
+	if tenant := env.Headers[envelopeHeaderTenant]; tenant != "" {
+		return tenant
+	}
+	if env.Version == 0 {
+		var job JobMessage
+		if json.Unmarshal(env.Body, &job) == nil && job.Tenant != "" {
+			return job.Tenant
+		}
+	}
+	return defaultTenant
+}
+
+// space returns how many more messages staging takes.
+func (s *fairScheduler) space() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.capacity - s.staged
+}
+
+// stage adds received messages to their tenants' queues, and returns those
+// of tenants already holding as many staged messages as their cap allows in
+// flight, for the caller to release.
+func (s *fairScheduler) stage(ctx context.Context, msgs []types.Message) []types.Message {
+	now := time.Now()
+	var surplus []types.Message
+	s.mu.Lock()
+	for _, m := range msgs {
+		name := messageTenant(m)
+		t, ok := s.tenants[name]
+		if !ok {
+			t = &fairTenant{name: name, weight: s.weight(name)}
+			s.tenants[name] = t
+		}
+		if s.maxInFlight > 0 && len(t.queue) >= s.maxInFlight {
+			surplus = append(surplus, m)
+			tenantReleased.Add(ctx, 1, metric.WithAttributes(attribute.String("tenant", name)))
+			continue
+		}
+		t.queue = append(t.queue, stagedMessage{message: m, tenant: name, received: now, hidden: now})
+		s.staged++
+		tenantStaged.Add(ctx, 1, metric.WithAttributes(attribute.String("tenant", name)))
+	}
+	s.mu.Unlock()
+	wake(s.ready)
+	return surplus
+}
+
+// due returns the staged messages whose visibility timeout was last set a
+// third of the staging visibility or more before now, and records it as set
+// now.
+func (s *fairScheduler) due(now time.Time) []types.Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var due []types.Message
+	for _, t := range s.tenants {
+		for i := range t.queue {
+			if now.Sub(t.queue[i].hidden) >= s.visibility/3 {
+				t.queue[i].hidden = now
+				due = append(due, t.queue[i].message)
+			}
+		}
+	}
+	return due
+}
+
+// weight returns tenant's TENANT_WEIGHTS weight.
+func (s *fairScheduler) weight(tenant string) int {
+	if w, ok := s.weights[tenant]; ok {
+		return w
+	}
+	return 1
+}
+
+// next takes the staged message a free worker should process next,
+// reporting false when no staged message may run now. Of the tenants with staged messages
+// and under their cap, each gains its weight in credit and the one with the
+// most is picked and pays the sum of their weights (smooth weighted
+// round-robin), which interleaves tenants in proportion to their weights.
+func (s *fairScheduler) next(ctx context.Context) (stagedMessage, bool) {
+	s.mu.Lock()
+	var pick *fairTenant
+	total := 0
+	for _, t := range s.tenants {
+		if len(t.queue) == 0 || (s.maxInFlight > 0 && t.inFlight >= s.maxInFlight) {
+			continue
+		}
+		t.credit += t.weight
+		total += t.weight
+		if pick == nil || t.credit > pick.credit || (t.credit == pick.credit && t.name < pick.name) {
+			pick = t
+		}
+	}
+	if pick == nil {
+		s.mu.Unlock()
+		return stagedMessage{}, false
+	}
+	pick.credit -= total
+	m := pick.queue[0]
+	pick.queue[0] = stagedMessage{}
+	pick.queue = pick.queue[1:]
+	pick.inFlight++
+	s.staged--
+	s.dispatched[aws.ToString(m.message.ReceiptHandle)] = pick.name
+	s.mu.Unlock()
+	wake(s.room)
+
+	attrs := metric.WithAttributes(attribute.String("tenant", m.tenant))
+	tenantStaged.Add(ctx, -1, attrs)
+	tenantInFlight.Add(ctx, 1, attrs)
+	tenantDispatched.Add(ctx, 1, attrs)
+	tenantStageWait.Record(ctx, time.Since(m.received).Seconds(), attrs)
+	return m, true
+}
+
+// finished records that a worker is done with message, freeing its tenant's
+// slot. A nil scheduler ignores it.
+func (s *fairScheduler) finished(ctx context.Context, message types.Message) {
+	if s == nil {
+		return
+	}
+	handle := aws.ToString(message.ReceiptHandle)
+	s.mu.Lock()
+	name, ok := s.dispatched[handle]
+	if !ok {
+		s.mu.Unlock()
+		return
+	}
+	delete(s.dispatched, handle)
+	t := s.tenants[name]
+	t.inFlight--
+	if t.inFlight == 0 && len(t.queue) == 0 {
+		// Forgotten while idle; a returning tenant starts with no credit.
+		delete(s.tenants, name)
+	}
+	s.mu.Unlock()
+	tenantInFlight.Add(ctx, -1, metric.WithAttributes(attribute.String("tenant", name)))
+	wake(s.ready)
+}
+
+// drain empties staging, returning the messages no worker took.
+func (s *fairScheduler) drain(ctx context.Context) []types.Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var left []types.Message
+	for name, t := range s.tenants {
+		for _, m := range t.queue {
+			left = append(left, m.message)
+		}
+		tenantStaged.Add(ctx, -int64(len(t.queue)), metric.WithAttributes(attribute.String("tenant", name)))
+		t.queue = nil
+		if t.inFlight == 0 {
+			delete(s.tenants, name)
+		}
+	}
+	s.staged = 0
+	return left
+}
+
+// dispatch hands staged messages to free workers through messages until
+// stop is closed. busy counts the messages handed over and not yet
+// finished, and freed is signalled as each finishes; workers is
+// WORKER_CONCURRENCY.
+func (a *App) dispatch(ctx context.Context, stop <-chan struct{}, messages chan<- types.Message, busy *atomic.Int32, freed <-chan struct{}, workers int) {
+	s := a.fair
+	for {
+		var waitFor <-chan struct{} = s.ready
+		if int(busy.Load()) >= a.throttle.concurrency(workers) {
+			// Every worker the throttle allows is busy.
+			waitFor = freed
+		} else if m, ok := s.next(ctx); ok {
+			message := m.message
+			if time.Since(m.hidden) >= s.visibility/10 {
+				// Its processing starts with a whole visibility timeout.
+				a.hideStaged(ctx, message)
+			}
+			busy.Add(1)
+			select {
+			case messages <- message:
+				continue
+			case <-stop:
+				busy.Add(-1)
+				a.releaseMessage(ctx, message)
+				s.finished(ctx, message)
+				return
+			}
+		}
+		select {
+		case <-stop:
+			return
+		case <-waitFor:
+		case <-time.After(throttleWait):
+		}
+	}
+}
+
+// keepStagedHidden sets the visibility timeout of staged messages again as
+// it runs down, until stop is closed.
+func (a *App) keepStagedHidden(ctx context.Context, stop <-chan struct{}) {
+	s := a.fair
+	ticker := time.NewTicker(s.visibility / 6)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			for _, message := range s.due(now) {
+				a.hideStaged(ctx, message)
+			}
+		}
+	}
+}
+
+// hideStaged sets a staged message's visibility timeout to the staging
+// visibility; on failure it may reappear before a worker takes it, to be
+// processed as a duplicate delivery.
+func (a *App) hideStaged(ctx context.Context, message types.Message) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), awsOpTimeout)
+	defer cancel()
+	if err := a.queue.ChangeVisibility(ctx, a.sqsURL, aws.ToString(message.ReceiptHandle), a.fair.visibility); err != nil {
+		recordSQSError(ctx, "ChangeMessageVisibility")
+		slog.WarnContext(ctx, "failed to extend visibility of staged message", "message_id", aws.ToString(message.MessageId), "error", err)
+	}
+}
+
+// releaseSurplus hands messages stage turned away back to the queue, hidden
+// for fairHoldDelay; one that fails comes back after its visibility timeout.
+func (a *App) releaseSurplus(ctx context.Context, msgs []types.Message) {
+	for _, message := range msgs {
+		rctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), awsOpTimeout)
+		if err := a.queue.ChangeVisibility(rctx, a.sqsURL, aws.ToString(message.ReceiptHandle), fairHoldDelay); err != nil {
+			recordSQSError(ctx, "ChangeMessageVisibility")
+			slog.WarnContext(ctx, "failed to release message of tenant at its cap", "message_id", aws.ToString(message.MessageId), "error", err)
+		}
+		cancel()
+	}
+}
+
+// wake signals whoever waits on ch without blocking.
+func wake(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
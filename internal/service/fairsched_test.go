@@ -0,0 +1,155 @@
+package service
+
+import (
+	"encoding/json"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/google/uuid"
+)
+
+// testScheduler returns a fair scheduler staging capacity messages, at most
+// maxInFlight of a tenant at once.
+func testScheduler(t *testing.T, capacity, maxInFlight int) *fairScheduler {
+	t.Helper()
+	if err := initInstruments(); err != nil {
+		t.Fatal(err)
+	}
+	return &fairScheduler{
+		capacity:    capacity,
+		maxInFlight: maxInFlight,
+		weights:     map[string]int{},
+		visibility:  memoryVisibilityTimeout,
+		ready:       make(chan struct{}, 1),
+		room:        make(chan struct{}, 1),
+		tenants:     map[string]*fairTenant{},
+		dispatched:  map[string]string{},
+	}
+}
+
+// tenantMessage returns the body of a job message of tenant.
+func tenantMessage(t *testing.T, tenant string) string {
+	t.Helper()
+	job := JobMessage{ID: uuid.NewString(), Text: "hello", Tenant: tenant, CreatedAt: Now()}
+	env, err := newEnvelope(t.Context(), messageTypeJob, job, map[string]string{envelopeHeaderTenant: tenant})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestFairSchedulerCaps(t *testing.T) {
+	s := testScheduler(t, 10, 2)
+	var msgs []types.Message
+	for i, tenant := range []string{"acme", "acme", "acme", "acme", "beta", "acme", "beta"} {
+		msgs = append(msgs, types.Message{ReceiptHandle: aws.String(strconv.Itoa(i)), Body: aws.String(tenantMessage(t, tenant))})
+	}
+	surplus := s.stage(t.Context(), msgs)
+	if len(surplus) != 3 || s.space() != 6 {
+		t.Fatalf("%d released, %d staging space left; want acme's 3 past its cap released, 6 left", len(surplus), s.space())
+	}
+
+	// Dispatch alternates between the tenants, each up to its cap.
+	var order []string
+	var taken []types.Message
+	for {
+		m, ok := s.next(t.Context())
+		if !ok {
+			break
+		}
+		order = append(order, m.tenant)
+		taken = append(taken, m.message)
+	}
+	if want := []string{"acme", "beta", "acme", "beta"}; !slices.Equal(order, want) {
+		t.Fatalf("dispatched %v, want %v", order, want)
+	}
+
+	// Capped acme, with workers free, gets another slot only once one of its
+	// messages finishes; room for it is staged meanwhile.
+	if surplus := s.stage(t.Context(), []types.Message{{ReceiptHandle: aws.String("a"), Body: aws.String(tenantMessage(t, "acme"))}}); len(surplus) != 0 {
+		t.Fatal("acme's next message released with nothing of its staged")
+	}
+	if m, ok := s.next(t.Context()); ok {
+		t.Fatalf("dispatched %s's message past the cap", m.tenant)
+	}
+	s.finished(t.Context(), taken[0])
+	if m, ok := s.next(t.Context()); !ok || m.tenant != "acme" {
+		t.Fatalf("after a finish dispatched %v %q, want acme's", ok, m.tenant)
+	}
+}
+
+func TestCappedTenantDoesNotBlockOthers(t *testing.T) {
+	h := newDeliveryHarness(t)
+	h.app.fair = testScheduler(t, 4, 1)
+	for range 12 {
+		h.send(tenantMessage(t, "acme"))
+	}
+	h.send(tenantMessage(t, "beta"))
+
+	// The worker loop, with acme's first message still processing: receive
+	// what staging has room for, and dispatch what may run.
+	var dispatched []string
+	for round := 0; round < 10 && !slices.Contains(dispatched, "beta"); round++ {
+		space := h.app.fair.space()
+		if space <= 0 {
+			t.Fatalf("staging full with %v dispatched: receiving stopped", dispatched)
+		}
+		msgs, err := h.app.queue.Receive(h.ctx, h.app.sqsURL, min(maxReceiveBatch, space), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.app.releaseSurplus(h.ctx, h.app.fair.stage(h.ctx, msgs))
+		for {
+			m, ok := h.app.fair.next(h.ctx)
+			if !ok {
+				break
+			}
+			dispatched = append(dispatched, m.tenant)
+		}
+	}
+	if want := []string{"acme", "beta"}; !slices.Equal(dispatched, want) {
+		t.Fatalf("dispatched %v, want %v", dispatched, want)
+	}
+	// acme's released messages are on the queue, hidden for fairHoldDelay.
+	depth, err := h.app.queue.Depth(h.ctx, h.app.sqsURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if depth.Visible != 0 || depth.InFlight != 13 {
+		t.Errorf("queue depth %+v, want all 13 messages hidden", depth)
+	}
+}
+
+func TestStagedMessagesStayHidden(t *testing.T) {
+	h := newDeliveryHarness(t)
+	h.app.fair = testScheduler(t, 4, 0)
+	h.send(tenantMessage(t, "acme"))
+	message := h.receive()
+	h.app.fair.stage(h.ctx, []types.Message{message})
+
+	if due := h.app.fair.due(time.Now()); len(due) != 0 {
+		t.Fatalf("%d messages due right after staging", len(due))
+	}
+	later := time.Now().Add(h.app.fair.visibility / 2)
+	due := h.app.fair.due(later)
+	if len(due) != 1 {
+		t.Fatalf("%d messages due half a visibility timeout after staging, want 1", len(due))
+	}
+	if again := h.app.fair.due(later); len(again) != 0 {
+		t.Fatal("a message was due again right after it was hidden")
+	}
+	// Its visibility timeout had run out; setting it again hides it.
+	h.expire(message)
+	h.app.hideStaged(h.ctx, due[0])
+	if msgs, err := h.app.queue.Receive(h.ctx, h.app.sqsURL, 1, 0); err != nil || len(msgs) != 0 {
+		t.Fatalf("staged message received again: %d messages, %v", len(msgs), err)
+	}
+}
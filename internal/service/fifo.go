@@ -0,0 +1,143 @@
+// SQS FIFO queues. A job queue whose URL ends in ".fifo" (SQS_QUEUE_URL, or
+// DLQ_URL for the dead-letter queue) is sent to as a FIFO queue: every
+// message gets a MessageGroupId and a MessageDeduplicationId, and SQS hands
+// out the messages of a group one at a time, in send order.
+//
+// The group is the job's FIFO_GROUP_BY request field:
+//
+//	tenant     the submitting tenant: each tenant's jobs run in order
+//	type       the job type
+//	parent_id  the parent job: a chain's children run in order
+//
+// Jobs without the field, and every job when FIFO_GROUP_BY is unset, are
+// their own group, so they run as concurrently as on a standard queue and
+// the queue only adds deduplication. The group travels in the envelope, so
+// requeued, redriven and dead-lettered copies keep it. A group waits while
+// its head job is retried (RETRY_BACKOFF_*), until the job succeeds or is
+// given up on.
+//
+// The deduplication ID is the job ID for a new job, so a send retried after
+// an ambiguous failure, or flushed from the send buffer after all, is
+// dropped by SQS within its five-minute window rather than run twice.
+// Resent copies use the ID of the message they were taken from.
+//
+// FIFO queues take no per-message delay: a held message of a disabled job
+// type stays on the queue, hidden for DISABLED_TYPE_REQUEUE_DELAY, instead of
+// being requeued behind its group. The memory backend treats a queue URL
+// ending in ".fifo" the same way.
+//
+// Messages released behind their group's head, and held ones, come back
+// with a higher SQS receive count, but they never reached processing, so
+// they are not attempts (deliveries.go) and do not use up MAX_ATTEMPTS. The
+// queue's own redrive policy counts every receive: its maxReceiveCount must
+// leave room for them.
+package service
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+
+	"go-microservice/pkg/contract"
+)
+
+// fifoSuffix ends the name of every FIFO queue.
+const fifoSuffix = ".fifo"
+
+// fifoDedupWindow is how long SQS drops a repeated deduplication ID.
+const fifoDedupWindow = 5 * time.Minute
+
+// Request fields FIFO_GROUP_BY can name.
+const (
+	fifoGroupTenant   = "tenant"
+	fifoGroupType     = "type"
+	fifoGroupParentID = "parent_id"
+)
+
+// envelopeHeaderGroup is the envelope header carrying a job's FIFO message
+// group.
+const envelopeHeaderGroup = contract.HeaderGroup
+
+// fifoIDPattern is what SQS accepts as a group or deduplication ID.
+var fifoIDPattern = regexp.MustCompile("^[!-~]{1,128}$")
+
+// isFIFOQueue reports whether queueURL names a FIFO queue.
+func isFIFOQueue(queueURL string) bool {
+	return strings.HasSuffix(queueURL, fifoSuffix)
+}
+
+// validFIFOGroupBy reports whether field can be FIFO_GROUP_BY.
+func validFIFOGroupBy(field string) bool {
+	switch field {
+	case "", fifoGroupTenant, fifoGroupType, fifoGroupParentID:
+		return true
+	}
+	return false
+}
+
+// fifoGroup returns the message group of a new job, "" when it has none of
+// its own.
+func (a *App) fifoGroup(req JobRequest, message JobMessage) string {
+	switch a.conf.FIFOGroupBy {
+	case fifoGroupTenant:
+		return message.Tenant
+	case fifoGroupType:
+		return cmp.Or(message.Type, defaultProcessorType)
+	case fifoGroupParentID:
+		return req.ParentID
+	}
+	return ""
+}
+
+// fifoID returns v as a group or deduplication ID, hashing one SQS would
+// reject.
+func fifoID(v string) string {
+	if fifoIDPattern.MatchString(v) {
+		return v
+	}
+	sum := sha256.Sum256([]byte(v))
+	return hex.EncodeToString(sum[:])
+}
+
+// fifoOptions fills in the group and deduplication ID of a message for
+// jobID sent to a FIFO queue: the group from the body's envelope, or the
+// job's own; the deduplication ID, unless set, the job ID.
+func fifoOptions(jobID, body string, opts SendOptions) SendOptions {
+	if opts.GroupID == "" {
+		var env Envelope
+		if json.Unmarshal([]byte(body), &env) == nil {
+			opts.GroupID = env.Headers[envelopeHeaderGroup]
+		}
+	}
+	opts.GroupID = fifoID(cmp.Or(opts.GroupID, jobID, opts.DeduplicationID))
+	opts.DeduplicationID = fifoID(cmp.Or(opts.DeduplicationID, jobID))
+	// Not allowed per message on a FIFO queue.
+	opts.Delay = 0
+	return opts
+}
+
+// headsOfGroups returns the messages of a FIFO receive that head their group
+// in it, releasing the rest: SQS keeps the group locked while its head is in
+// flight, so they come back, in order, once it is done with. A release is
+// not an attempt at the job.
+func (a *App) headsOfGroups(ctx context.Context, msgs []types.Message) []types.Message {
+	var heads []types.Message
+	seen := map[string]bool{}
+	for _, m := range msgs {
+		group := m.Attributes[string(types.MessageSystemAttributeNameMessageGroupId)]
+		if group != "" && seen[group] {
+			a.releaseMessage(ctx, m)
+			continue
+		}
+		seen[group] = true
+		heads = append(heads, m)
+	}
+	return heads
+}
@@ -0,0 +1,79 @@
+package service
+
+import "testing"
+
+func TestFIFOReleasesAreNotAttempts(t *testing.T) {
+	h := newDeliveryHarness(t)
+	h.app.sqsURL = memoryQueueURL + fifoSuffix
+	h.app.retries.maxAttempts = 2
+	h.app.retries.backoffBase = 0 // A failed head comes straight back
+	h.group = "acme"
+	ids := make([]string, 5)
+	for i := range ids {
+		typ := ""
+		if i == 3 {
+			typ = flakyType
+		}
+		ids[i], _ = h.submit(typ)
+	}
+
+	// The worker's loop: every receive returns the whole group, of which
+	// only the head runs and the rest are released behind it.
+	maxReceives := 0
+	for range 20 {
+		msgs, err := h.app.queue.Receive(h.ctx, h.app.sqsURL, maxReceiveBatch, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(msgs) == 0 {
+			break
+		}
+		heads := h.app.headsOfGroups(h.ctx, msgs)
+		if len(heads) != 1 {
+			t.Fatalf("%d heads of one group", len(heads))
+		}
+		maxReceives = max(maxReceives, receiveAttempt(heads[0]))
+		h.wait(h.handle(heads[0]))
+	}
+	if maxReceives <= h.app.retries.maxAttempts {
+		t.Fatalf("receive counts reached %d, not past MAX_ATTEMPTS: the releases were not exercised", maxReceives)
+	}
+
+	// Every job ran, in order, on its first attempt; the flaky one failed
+	// once and was retried, although its message had been received more
+	// often than MAX_ATTEMPTS allows attempts.
+	var finished Timestamp
+	for i, id := range ids {
+		want := []JobAttempt{{Attempt: 1, Outcome: attemptCompleted}}
+		if i == 3 {
+			want = []JobAttempt{{Attempt: 1, Outcome: attemptFailed}, {Attempt: 2, Outcome: attemptCompleted}}
+		}
+		h.assertAttempts(id, want...)
+		rec := h.record(id)
+		if rec.FinishedAt.Before(finished.Time) {
+			t.Errorf("job %d finished before the one sent ahead of it", i)
+		}
+		finished = rec.FinishedAt
+	}
+	h.assertSingleResult(ids[len(ids)-1], "HELLO")
+}
+
+func TestNextAttempt(t *testing.T) {
+	rec := JobRecord{Attempts: []JobAttempt{
+		{Attempt: 1, MessageID: "m1", Outcome: attemptFailed},
+		{Attempt: 2, MessageID: "m1", Outcome: attemptAbandoned},
+		{Attempt: 1, MessageID: "m2", Outcome: attemptDuplicate},
+	}}
+	for _, tc := range []struct {
+		messageID string
+		want      int
+	}{
+		{"m1", 3},
+		{"m2", 2},
+		{"m3", 1}, // A requeued or redriven copy starts again
+	} {
+		if got := rec.nextAttempt(tc.messageID); got != tc.want {
+			t.Errorf("nextAttempt(%s) = %d, want %d", tc.messageID, got, tc.want)
+		}
+	}
+}
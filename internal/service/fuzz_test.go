@@ -0,0 +1,206 @@
+package service
+
+// Fuzz targets for the parsers that take input from outside the service: job
+// submission bodies, queue messages (through the message adapters), and job
+// IDs in request paths. The seeds run as part of go test; run a target with
+// go test -fuzz=FuzzDecodeJobRequest ./internal/service to look for more.
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+func FuzzDecodeJobRequest(f *testing.F) {
+	for _, seed := range []struct{ contentType, body string }{
+		{"", `{"text":"hello"}`},
+		{"application/json", `{"text":"hello","type":"wordcount","parent_id":"6f1c2b0e-3f4a-4b8e-9d2a-1c5e7f9a0b3d","relation":"retry"}`},
+		{"application/json; charset=utf-8", `{"text":"héllo 😀"}`},
+		{"application/json", `{"txet":"typo"}`},
+		{"application/json", `{"text":"a"} {"text":"b"}`},
+		{"application/json", strings.Repeat("[", 40) + strings.Repeat("]", 40)},
+		{"text/plain", "hello world"},
+		{"text/plain; charset=us-ascii", "hello"},
+		{"text/plain; charset=iso-8859-1", "h\xe9llo"},
+		{"text/plain", "\xff\xfe"},
+		{"application/x-www-form-urlencoded", "text=hello+world&type=lowercase"},
+		{"application/x-www-form-urlencoded", "text=%ZZ"},
+		{"application/x-www-form-urlencoded", `  {"text":"sent by curl -d"}`},
+		{"multipart/form-data; boundary=x", "--x--"},
+		{"text/plain; charset=", ""},
+	} {
+		f.Add(seed.contentType, []byte(seed.body))
+	}
+	a := &App{jsonBodies: newJSONDecoder()}
+	f.Fuzz(func(t *testing.T, contentType string, body []byte) {
+		r := httptest.NewRequest(http.MethodPost, "/jobs", strings.NewReader(string(body)))
+		if contentType != "" {
+			r.Header.Set("Content-Type", contentType)
+		}
+		req, err := a.decodeJobRequest(r)
+		if err != nil {
+			// Every rejection must map to a client error.
+			if status, detail := jobRequestError(err); status < 400 || status > 499 || detail.Message == "" {
+				t.Fatalf("error %v answered %d %+v", err, status, detail)
+			}
+			return
+		}
+		if mediaType, _, _ := mime.ParseMediaType(contentType); mediaType == "text/plain" {
+			if req.Text != string(body) || !utf8.ValidString(req.Text) {
+				t.Fatalf("text/plain body %q decoded to text %q", body, req.Text)
+			}
+		}
+		// Whatever was accepted must survive a round trip through JSON.
+		raw, err := json.Marshal(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = httptest.NewRequest(http.MethodPost, "/jobs", strings.NewReader(string(raw)))
+		r.Header.Set("Content-Type", "application/json")
+		again, err := a.decodeJobRequest(r)
+		if err != nil {
+			t.Fatalf("re-encoded request %s rejected: %v", raw, err)
+		}
+		if again != req {
+			t.Fatalf("round trip changed %+v to %+v", req, again)
+		}
+	})
+}
+
+func FuzzOpenEnvelope(f *testing.F) {
+	for _, seed := range []string{
+		`{"v":1,"type":"job","headers":{"tenant":"acme","traceparent":"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},"body":{"id":"6f1c2b0e-3f4a-4b8e-9d2a-1c5e7f9a0b3d","text":"hello","created_at":"2026-01-02T03:04:05Z"}}`,
+		`{"id":"6f1c2b0e-3f4a-4b8e-9d2a-1c5e7f9a0b3d","text":"from before envelopes","created_at":"2026-01-02T03:04:05Z"}`,
+		`{"kind":"render","order":{"id":"A-17","note":"gift wrap","customer":"acme"}}`,
+		`{"kind":"render","order":{"id":42,"note":["not","scalar"]}}`,
+		`{"kind":"render","order":{"note":"no id"},"at":"yesterday"}`,
+		`{"v":2,"type":"job","body":{}}`,
+		`{"v":1,"type":"export","body":{"id":"x"}}`,
+		`{"v":-1}`,
+		`{"v":1.5,"text":"fractional version"}`,
+		`plain text`,
+		`[]`,
+		`null`,
+		``,
+	} {
+		f.Add(seed)
+	}
+	var adapters messageAdapters
+	for _, spec := range []MessageAdapter{
+		{Name: "orders", Match: map[string]string{"$.kind": "render"}, Fields: map[string]string{"id": "$.order.id", "text": "$.order.note", "tenant": "$.order.customer", "created_at": "$.at"}},
+		{Name: "notes", Fields: map[string]string{"text": "$.note", "type": "$.type"}},
+	} {
+		ad, err := compileAdapter(spec)
+		if err != nil {
+			f.Fatal(err)
+		}
+		adapters = append(adapters, ad)
+	}
+	f.Fuzz(func(t *testing.T, body string) {
+		message := types.Message{MessageId: aws.String("fuzz"), Body: aws.String(body)}
+		adapted, err := adapters.adapt(message)
+		if err != nil {
+			return
+		}
+		env, err := openEnvelope(adapted)
+		if err != nil {
+			if aws.ToString(adapted.Body) != body {
+				t.Fatalf("adapted message does not open: %v\n%s", err, aws.ToString(adapted.Body))
+			}
+			return
+		}
+		if env.Version > envelopeVersion {
+			t.Fatalf("opened envelope of version %d", env.Version)
+		}
+		var job JobMessage
+		err = env.decodeBody(messageTypeJob, &job)
+		if aws.ToString(adapted.Body) != body {
+			// An adapter built this envelope: it must hold a job.
+			if err != nil {
+				t.Fatalf("adapted envelope does not decode: %v\n%s", err, aws.ToString(adapted.Body))
+			}
+			if job.ID == "" || job.CreatedAt.IsZero() || env.Headers[envelopeHeaderAdapter] == "" {
+				t.Fatalf("adapted job is incomplete: %+v, headers %v", job, env.Headers)
+			}
+		}
+	})
+}
+
+func FuzzJobIDCanonical(f *testing.F) {
+	for _, seed := range []string{
+		"6f1c2b0e-3f4a-4b8e-9d2a-1c5e7f9a0b3d",
+		"6F1C2B0E-3F4A-4B8E-9D2A-1C5E7F9A0B3D",
+		"{6f1c2b0e-3f4a-4b8e-9d2a-1c5e7f9a0b3d}",
+		"urn:uuid:6f1c2b0e-3f4a-4b8e-9d2a-1c5e7f9a0b3d",
+		"6f1c2b0e3f4a4b8e9d2a1c5e7f9a0b3d",
+		"order-17.v2_retry",
+		"ÖRDER-17",
+		"ｏｒｄｅｒ",         // Fullwidth letters
+		"order\u200b17", // Zero-width space
+		"%2e%2e",
+		"%2Fetc%2Fpasswd",
+		"a%00b",
+		"..",
+		".",
+		"../status",
+		"a/b",
+		"a b",
+		strings.Repeat("x", maxOpaqueJobIDLen+1),
+		"",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, id string) {
+		for _, scheme := range []jobIDScheme{jobIDUUID, jobIDOpaque} {
+			canon, err := scheme.canonical(id)
+			if err != nil {
+				continue
+			}
+			// A canonical ID is its own canonical form, and safe as a single
+			// storage key segment.
+			if again, err := scheme.canonical(canon); err != nil || again != canon {
+				t.Fatalf("%s: canonical(%q) = %q, but canonical(%q) = %q, %v", scheme, id, canon, canon, again, err)
+			}
+			if canon == "." || canon == ".." || strings.IndexFunc(canon, invalidOpaqueIDRune) >= 0 || len(canon) > maxOpaqueJobIDLen {
+				t.Fatalf("%s: canonical(%q) = %q is not a safe ID", scheme, id, canon)
+			}
+			if scheme == jobIDUUID && (len(canon) != 36 || canon != strings.ToLower(canon)) {
+				t.Fatalf("uuid: canonical(%q) = %q is not a lower-case UUID", id, canon)
+			}
+		}
+
+		// The ID as it arrives in a request path, percent-encoded.
+		for _, scheme := range []jobIDScheme{jobIDUUID, jobIDOpaque} {
+			a := &App{jobIDs: scheme}
+			var got string
+			reached := false
+			mux := http.NewServeMux()
+			mux.HandleFunc("GET /jobs/{id}", func(w http.ResponseWriter, r *http.Request) {
+				reached = true
+				got, _ = a.pathJobID(w, r)
+			})
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/jobs/"+url.PathEscape(id), nil))
+			if !reached {
+				// Not routed to {id} (empty, or cleaned away like ".."):
+				// the mux answers without a job ID.
+				continue
+			}
+			want, err := scheme.canonical(id)
+			switch {
+			case err != nil && rec.Code != http.StatusBadRequest:
+				t.Fatalf("%s: path ID %q answered %d, want 400", scheme, id, rec.Code)
+			case err == nil && got != want:
+				t.Fatalf("%s: path ID %q read as %q, want %q", scheme, id, got, want)
+			}
+		}
+	})
+}
@@ -0,0 +1,57 @@
+// Dependency health tracking. Request paths report the outcome of calls to a
+// backing service so readiness can say a dependency is degraded without
+// issuing probes of its own.
+package service
+
+import (
+	"sync"
+	"time"
+)
+
+// degradedWindow is how long a dependency stays marked degraded after its most
+// recent failure when no success has been seen since.
+const degradedWindow = 30 * time.Second
+
+// dependencyHealth records the latest success and failure of calls to one
+// dependency. It is safe for concurrent use.
+type dependencyHealth struct {
+	mu      sync.Mutex
+	lastOK  time.Time
+	lastErr time.Time
+	oks     int // Successes since the last takeCounts
+	errs    int // Failures since the last takeCounts
+}
+
+// recordOK notes a successful call.
+func (h *dependencyHealth) recordOK() {
+	h.mu.Lock()
+	h.lastOK = time.Now()
+	h.oks++
+	h.mu.Unlock()
+}
+
+// recordError notes a failed call (infrastructure failures only — a missing
+// object is a valid answer, not a failure).
+func (h *dependencyHealth) recordError() {
+	h.mu.Lock()
+	h.lastErr = time.Now()
+	h.errs++
+	h.mu.Unlock()
+}
+
+// degraded reports whether the most recent call failed within degradedWindow.
+func (h *dependencyHealth) degraded() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return !h.lastErr.IsZero() && h.lastErr.After(h.lastOK) && time.Since(h.lastErr) < degradedWindow
+}
+
+// takeCounts returns the successes and failures recorded since the previous
+// call and resets them. The load shedder is its only caller.
+func (h *dependencyHealth) takeCounts() (oks, errs int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	oks, errs = h.oks, h.errs
+	h.oks, h.errs = 0, 0
+	return oks, errs
+}
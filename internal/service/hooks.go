@@ -0,0 +1,606 @@
+// Result post-processing hooks. Work that follows a stored result — sort
+// index entries, search indexing, previews, notifications — runs as a chain
+// of hooks after the result's PutObject, outside the job's processing, so a
+// failing auxiliary system never fails or delays the job itself:
+//
+//	RegisterResultHook("thumbnail", ResultHookFunc(func(ctx context.Context, r StoredResult) error {
+//		return renderPreview(ctx, r.ID, r.Output)
+//	}))
+//
+// The built-in "index" hook, which writes the sort index entries
+// (jobindex.go), runs first; registered hooks follow in registration order,
+// then the built-in "callback" hook for jobs submitted with a callback_url
+// (webhook.go).
+// Storing a result (processMessage, POST /jobs/import) records a task at
+// hooks/pending/{id}.json naming every hook, and a worker runs it at once
+// when the result was stored in its own process. A delivery that stores the
+// result but cannot record the task fails; the delivery retrying it finds
+// the result stored and records the task if it is missing. Each hook runs under
+// HOOK_TIMEOUT; those that fail are retried with their own backoff
+// (HOOK_RETRY_BACKOFF_BASE doubling to HOOK_RETRY_BACKOFF_MAX) until
+// HOOK_MAX_ATTEMPTS, then moved to hooks/failed/{id}/{hook}.json — the hooks'
+// dead-letter area — for GET /admin/hooks/failed and POST
+// /admin/hooks/failed/retry. Every HOOK_SWEEP_INTERVAL each worker claims due
+// tasks, including those a crashed or full process left behind, with a
+// conditional write, so one worker runs each.
+//
+// Hooks run at least once: make them idempotent. A task whose result has been
+// deleted is dropped.
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Key prefixes of hook tasks and of hooks that ran out of attempts.
+const (
+	hooksPendingPrefix = "hooks/pending/"
+	hooksFailedPrefix  = "hooks/failed/"
+)
+
+// indexHookName is the built-in hook writing sort index entries.
+const indexHookName = "index"
+
+// hookQueueSize bounds the tasks waiting for a worker's hook runners; tasks
+// beyond it wait for the sweep.
+const hookQueueSize = 256
+
+// ResultHook is a step run after a job's result is stored. An error is
+// retried; the hook must be idempotent.
+type ResultHook interface {
+	RunHook(ctx context.Context, result StoredResult) error
+}
+
+// ResultHookFunc adapts a function to a ResultHook.
+type ResultHookFunc func(ctx context.Context, result StoredResult) error
+
+// RunHook calls f.
+func (f ResultHookFunc) RunHook(ctx context.Context, result StoredResult) error {
+	return f(ctx, result)
+}
+
+// StoredResult is the result a hook runs on.
+type StoredResult struct {
+	JobResult
+	Key         string // Object key of the result
+	SizeBytes   int64  // Stored size of the result
+	CallbackURL string // The job's callback_url; empty for none
+}
+
+// namedHook is a hook in the chain.
+type namedHook struct {
+	name string
+	hook ResultHook
+}
+
+// resultHooks are the registered hooks, in registration order.
+var resultHooks []namedHook
+
+// RegisterResultHook adds h to the end of the hook chain as name. Call it
+// before Run, e.g. from a binary's init function; registering a name twice
+// panics. Names become object keys: letters, digits, '.', '_' and '-'.
+func RegisterResultHook(name string, h ResultHook) {
+	if !lockNamePattern.MatchString(name) || name == indexHookName || name == callbackHookName {
+		panic(fmt.Sprintf("invalid result hook name %q", name))
+	}
+	for _, nh := range resultHooks {
+		if nh.name == name {
+			panic(fmt.Sprintf("result hook %q registered twice", name))
+		}
+	}
+	resultHooks = append(resultHooks, namedHook{name: name, hook: h})
+}
+
+// HookTask is hooks/pending/{id}.json: the hooks still to run on a result.
+type HookTask struct {
+	JobID       string    `json:"job_id"`
+	Key         string    `json:"key"`                    // Result key
+	SizeBytes   int64     `json:"size_bytes"`             // Stored size of the result
+	CallbackURL string    `json:"callback_url,omitempty"` // For the callback hook
+	Hooks       []string  `json:"hooks"`                  // Still to run, in chain order
+	Attempts    int       `json:"attempts"`               // Runs that left hooks failing
+	LastError   string    `json:"last_error,omitempty"`   // Failures of the last run
+	CreatedAt   Timestamp `json:"created_at"`             // When the result was stored
+	NextAt      Timestamp `json:"next_at"`                // Earliest next run
+	LeaseUntil  Timestamp `json:"lease_until,omitzero"`   // A runner holds it until then
+}
+
+// HookFailure is hooks/failed/{id}/{hook}.json: a hook that ran out of
+// attempts on a result.
+type HookFailure struct {
+	JobID       string    `json:"job_id"`
+	Hook        string    `json:"hook"`
+	Key         string    `json:"key"` // Result key
+	SizeBytes   int64     `json:"size_bytes"`
+	CallbackURL string    `json:"callback_url,omitempty"` // For the callback hook
+	Attempts    int       `json:"attempts"`
+	Error       string    `json:"error"` // Why the last attempt failed
+	FailedAt    Timestamp `json:"failed_at"`
+}
+
+// HookFailuresResponse is the GET /admin/hooks/failed response body.
+type HookFailuresResponse struct {
+	Failures []HookFailure `json:"failures"`
+}
+
+// HookRetryResponse is the POST /admin/hooks/failed/retry response body.
+type HookRetryResponse struct {
+	Requeued int      `json:"requeued"` // Failed hooks moved back to pending tasks
+	Errors   []string `json:"errors,omitempty"`
+}
+
+// hookRunner runs the hook chain on stored results.
+type hookRunner struct {
+	app         *App
+	chain       []namedHook
+	policy      retryPolicy   // HOOK_MAX_ATTEMPTS and backoff between runs
+	timeout     time.Duration // HOOK_TIMEOUT: bound on one hook call
+	concurrency int           // HOOK_CONCURRENCY: tasks a worker runs at once
+	sweep       time.Duration // HOOK_SWEEP_INTERVAL: how often due tasks are claimed
+
+	tasks   chan HookTask // Stored in this process, for its runners
+	running bool          // Runners started: this process runs hooks
+}
+
+// newHookRunner returns a runner for the built-in and registered hooks with
+// the settings from the HOOK_* variables.
+func newHookRunner(a *App) *hookRunner {
+	chain := append([]namedHook{{name: indexHookName, hook: ResultHookFunc(a.indexHook)}}, resultHooks...)
+	if a.webhooks != nil {
+		// Last, so the receiver hears of a result that is already indexed.
+		chain = append(chain, namedHook{name: callbackHookName, hook: ResultHookFunc(a.webhooks.deliver)})
+	}
+	return &hookRunner{
+		app:   a,
+		chain: chain,
+		policy: retryPolicy{
+			maxAttempts: max(envInt("HOOK_MAX_ATTEMPTS", 8), 0),
+			backoffBase: max(envDuration("HOOK_RETRY_BACKOFF_BASE", 30*time.Second), time.Second),
+			backoffMax:  envDuration("HOOK_RETRY_BACKOFF_MAX", time.Hour),
+		},
+		timeout:     max(envDuration("HOOK_TIMEOUT", 30*time.Second), time.Second),
+		concurrency: max(envInt("HOOK_CONCURRENCY", 2), 1),
+		sweep:       envDuration("HOOK_SWEEP_INTERVAL", time.Minute),
+		tasks:       make(chan HookTask, hookQueueSize),
+	}
+}
+
+// names returns the hooks of the chain, in order.
+func (hr *hookRunner) names() []string {
+	names := make([]string, len(hr.chain))
+	for i, nh := range hr.chain {
+		names[i] = nh.name
+	}
+	return names
+}
+
+// lease is how long a runner holds a task: long enough to run every hook.
+func (hr *hookRunner) lease() time.Duration {
+	return time.Duration(len(hr.chain))*hr.timeout + 2*awsOpTimeout
+}
+
+// start runs the hook runners and the sweep until ctx is cancelled. Only
+// workers start them; other processes record tasks for the workers.
+func (hr *hookRunner) start(ctx context.Context) {
+	hr.running = true
+	for range hr.concurrency {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return // Queued tasks are recorded; the sweep runs them
+				case task := <-hr.tasks:
+					hr.run(ctx, task)
+				}
+			}
+		}()
+	}
+	if hr.sweep > 0 {
+		go hr.loop(ctx)
+	}
+}
+
+// enqueue records a task for every hook on result, the callback hook only
+// with a callbackURL, and hands it to this process's runners when it has
+// them. An error means the task was not recorded: the hooks would never run
+// if the caller went on as if it had been.
+func (hr *hookRunner) enqueue(ctx context.Context, result JobResult, size int64, callbackURL string) error {
+	task := hr.newTask(result.ID, size, callbackURL)
+	if err := hr.app.putJSON(ctx, hookTaskKey(result.ID), task); err != nil {
+		return fmt.Errorf("failed to record result hooks: %w", err)
+	}
+	hr.handOff(task)
+	return nil
+}
+
+// resume records the task of jobID's result, stored by an earlier delivery,
+// unless it has one: that delivery may have died, or failed to record the
+// task, after storing the result. If its hooks had already run they run
+// again; they are idempotent.
+func (hr *hookRunner) resume(ctx context.Context, jobID, callbackURL string) error {
+	hctx, cancel := context.WithTimeout(ctx, awsOpTimeout)
+	defer cancel()
+	info, err := hr.app.store.Head(hctx, jobsPrefix+jobID+".json")
+	if err != nil {
+		return fmt.Errorf("failed to read result: %w", err)
+	}
+	task := hr.newTask(jobID, info.Size, callbackURL)
+	raw, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+	err = hr.app.store.Put(hctx, hookTaskKey(jobID), raw, PutOptions{ContentType: "application/json", IfNoneMatch: true})
+	switch {
+	case err != nil && classifyS3Error(err).Status == http.StatusPreconditionFailed:
+		return nil // Still pending
+	case err != nil:
+		return fmt.Errorf("failed to record result hooks: %w", err)
+	}
+	slog.InfoContext(ctx, "recorded missing result hooks", "job_id", jobID, "hooks", task.Hooks)
+	hr.handOff(task)
+	return nil
+}
+
+// newTask returns a task running every hook on jobID's result, the callback
+// hook only with a callbackURL, leased to this process's runners when it
+// has them.
+func (hr *hookRunner) newTask(jobID string, size int64, callbackURL string) HookTask {
+	now := time.Now()
+	hooks := slices.DeleteFunc(hr.names(), func(name string) bool { return name == callbackHookName })
+	if callbackURL != "" {
+		// Even if this process cannot deliver it: the failure is then listed
+		// with the failed hooks instead of the callback going missing.
+		hooks = append(hooks, callbackHookName)
+	}
+	task := HookTask{
+		JobID:       jobID,
+		Key:         jobsPrefix + jobID + ".json",
+		SizeBytes:   size,
+		CallbackURL: callbackURL,
+		Hooks:       hooks,
+		CreatedAt:   Now(),
+		NextAt:      Timestamp{Time: now.UTC()},
+	}
+	if hr.running {
+		task.LeaseUntil = Timestamp{Time: now.Add(hr.lease()).UTC()}
+	}
+	return task
+}
+
+// handOff gives a recorded task to this process's runners, if it has them.
+func (hr *hookRunner) handOff(task HookTask) {
+	if !hr.running {
+		return
+	}
+	select {
+	case hr.tasks <- task:
+	default:
+		// The runners are behind; the sweep takes it once the lease ends.
+	}
+}
+
+// run runs task's hooks on its result, then deletes the task, reschedules
+// the hooks that failed, or moves those out of attempts to hooks/failed/.
+func (hr *hookRunner) run(ctx context.Context, task HookTask) {
+	// Hooks in progress finish at shutdown; an interrupted task is taken by
+	// another worker's sweep once its lease ends.
+	ctx = context.WithoutCancel(ctx)
+	ctx, span := tracer.Start(ctx, "runResultHooks")
+	defer span.End()
+	span.SetAttributes(attribute.String("job.id", task.JobID))
+
+	var result StoredResult
+	switch err := hr.app.getJSON(ctx, task.Key, &result.JobResult); {
+	case err != nil && classifyS3Error(err).Kind == s3NotFound:
+		slog.InfoContext(ctx, "result deleted, dropping its hooks", "job_id", task.JobID, "hooks", task.Hooks)
+		hr.deleteTask(ctx, task.JobID)
+		return
+	case err != nil:
+		hr.reschedule(ctx, task, task.Hooks, fmt.Sprintf("read result: %v", err))
+		return
+	}
+	result.Key, result.SizeBytes, result.CallbackURL = task.Key, task.SizeBytes, task.CallbackURL
+
+	var failed, errs []string
+	for _, name := range task.Hooks {
+		hook := hr.lookup(name)
+		if hook == nil {
+			// Registered by another build; this one cannot run it.
+			failed = append(failed, name)
+			errs = append(errs, name+": not registered in this build")
+			continue
+		}
+		hctx, cancel := context.WithTimeout(ctx, hr.timeout)
+		err := hook.RunHook(hctx, result)
+		cancel()
+		outcome := "ok"
+		if err != nil {
+			outcome = "retry"
+			failed = append(failed, name)
+			errs = append(errs, name+": "+err.Error())
+		}
+		hookRuns.Add(ctx, 1, metric.WithAttributes(attribute.String("hook", name), attribute.String("outcome", outcome)))
+	}
+	if len(failed) == 0 {
+		hr.deleteTask(ctx, task.JobID)
+		return
+	}
+	hr.reschedule(ctx, task, failed, strings.Join(errs, "; "))
+}
+
+// lookup returns the hook named name, or nil.
+func (hr *hookRunner) lookup(name string) ResultHook {
+	for _, nh := range hr.chain {
+		if nh.name == name {
+			return nh.hook
+		}
+	}
+	return nil
+}
+
+// reschedule records a run of task that left hooks failing with errMsg:
+// they run again after the backoff, or move to hooks/failed/ once out of
+// attempts.
+func (hr *hookRunner) reschedule(ctx context.Context, task HookTask, hooks []string, errMsg string) {
+	task.Attempts++
+	task.Hooks, task.LastError = hooks, errMsg
+	task.LeaseUntil = Timestamp{}
+	if !hr.policy.exhausted(task.Attempts) {
+		task.NextAt = Timestamp{Time: time.Now().Add(hr.policy.backoff(task.Attempts)).UTC()}
+		if err := hr.app.putJSON(ctx, hookTaskKey(task.JobID), task); err != nil {
+			slog.WarnContext(ctx, "failed to reschedule result hooks", "job_id", task.JobID, "error", err)
+		}
+		slog.WarnContext(ctx, "result hooks failed, will retry", "job_id", task.JobID, "hooks", hooks,
+			"attempt", task.Attempts, "next_at", task.NextAt, "error", errMsg)
+		return
+	}
+	for _, name := range hooks {
+		f := HookFailure{
+			JobID:       task.JobID,
+			Hook:        name,
+			Key:         task.Key,
+			SizeBytes:   task.SizeBytes,
+			CallbackURL: task.CallbackURL,
+			Attempts:    task.Attempts,
+			Error:       errMsg,
+			FailedAt:    Now(),
+		}
+		if err := hr.app.putJSON(ctx, hookFailureKey(task.JobID, name), f); err != nil {
+			// Keep the task, so the next sweep tries again.
+			slog.ErrorContext(ctx, "failed to record failed result hook", "job_id", task.JobID, "hook", name, "error", err)
+			return
+		}
+		hookRuns.Add(ctx, 1, metric.WithAttributes(attribute.String("hook", name), attribute.String("outcome", "failed")))
+	}
+	slog.ErrorContext(ctx, "result hooks failed permanently", "job_id", task.JobID, "hooks", hooks,
+		"attempts", task.Attempts, "error", errMsg)
+	hr.deleteTask(ctx, task.JobID)
+}
+
+// deleteTask removes jobID's task.
+func (hr *hookRunner) deleteTask(ctx context.Context, jobID string) {
+	if _, err := hr.app.deleteKeys(ctx, []string{hookTaskKey(jobID)}); err != nil {
+		// Its hooks run again on the next sweep; they are idempotent.
+		slog.WarnContext(ctx, "failed to delete result hook task", "job_id", jobID, "error", err)
+	}
+}
+
+// loop claims and runs due tasks every sweep interval until ctx is cancelled.
+func (hr *hookRunner) loop(ctx context.Context) {
+	ticker := time.NewTicker(hr.sweep)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := hr.sweepOnce(ctx); err != nil && ctx.Err() == nil {
+			slog.Warn("result hook sweep failed", "error", err)
+		}
+	}
+}
+
+// sweepOnce runs the pending tasks that are due and not held by a runner.
+func (hr *hookRunner) sweepOnce(ctx context.Context) error {
+	var keys []string
+	if err := hr.app.listObjects(ctx, hooksPendingPrefix, func(obj ObjectInfo) error {
+		keys = append(keys, obj.Key)
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if ctx.Err() != nil {
+			return nil
+		}
+		task, ok, err := hr.claim(ctx, key)
+		if err != nil {
+			slog.WarnContext(ctx, "failed to claim result hook task", "key", key, "error", err)
+			continue
+		}
+		if ok {
+			hr.run(ctx, task)
+		}
+	}
+	return nil
+}
+
+// claim takes the task at key when it is due and its lease has ended,
+// reporting false when it is not, or another worker took it first.
+func (hr *hookRunner) claim(ctx context.Context, key string) (HookTask, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, awsOpTimeout)
+	defer cancel()
+	body, info, err := hr.app.store.Get(ctx, key)
+	if err != nil {
+		if classifyS3Error(err).Kind == s3NotFound {
+			return HookTask{}, false, nil // Finished since the listing
+		}
+		return HookTask{}, false, err
+	}
+	var task HookTask
+	err = json.NewDecoder(body).Decode(&task)
+	body.Close()
+	if err != nil {
+		return HookTask{}, false, fmt.Errorf("decode %s: %w", key, err)
+	}
+	now := time.Now()
+	if now.Before(task.NextAt.Time) || now.Before(task.LeaseUntil.Add(hr.app.clock.tolerance)) {
+		return HookTask{}, false, nil
+	}
+	task.LeaseUntil = Timestamp{Time: now.Add(hr.lease()).UTC()}
+	raw, err := json.Marshal(task)
+	if err != nil {
+		return HookTask{}, false, fmt.Errorf("encode %s: %w", key, err)
+	}
+	if err := hr.app.store.Put(ctx, key, raw, PutOptions{ContentType: "application/json", IfMatch: info.ETag}); err != nil {
+		if classifyS3Error(err).Status == http.StatusPreconditionFailed {
+			return HookTask{}, false, nil
+		}
+		return HookTask{}, false, err
+	}
+	return task, true, nil
+}
+
+// indexHook is the built-in hook writing result's sort index entries.
+func (a *App) indexHook(ctx context.Context, result StoredResult) error {
+	return a.writeIndexEntries(ctx, newJobSummary(result.JobResult, result.SizeBytes))
+}
+
+// hookTaskKey returns the key of jobID's hook task.
+func hookTaskKey(jobID string) string { return hooksPendingPrefix + jobID + ".json" }
+
+// hookFailureKey returns the key of hook's failure on jobID's result.
+func hookFailureKey(jobID, hook string) string {
+	return hooksFailedPrefix + jobID + "/" + hook + ".json"
+}
+
+// listHookFailures handles GET /admin/hooks/failed requests.
+// → 200 HookFailuresResponse with every hook that ran out of attempts,
+// oldest job first; ?job_id= narrows it to one job's.
+func (a *App) listHookFailures(w http.ResponseWriter, r *http.Request) {
+	prefix, ok := a.hookFailuresPrefix(w, r)
+	if !ok {
+		return
+	}
+	ctx := r.Context()
+	resp := HookFailuresResponse{Failures: []HookFailure{}}
+	err := a.listObjects(ctx, prefix, func(obj ObjectInfo) error {
+		var f HookFailure
+		if err := a.getJSON(ctx, obj.Key, &f); err != nil {
+			if classifyS3Error(err).Kind == s3NotFound {
+				return nil // Retried since the listing
+			}
+			return err
+		}
+		resp.Failures = append(resp.Failures, f)
+		return nil
+	})
+	if err != nil {
+		writeStorageError(ctx, w, "ListObjectsV2", "failed to list failed hooks", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// retryHookFailures handles POST /admin/hooks/failed/retry requests.
+// Moves failed hooks (?job_id= for one job's) back to pending tasks with
+// fresh attempts, for the next sweep → 200 HookRetryResponse. Repeat it to
+// retry those listed in errors.
+func (a *App) retryHookFailures(w http.ResponseWriter, r *http.Request) {
+	prefix, ok := a.hookFailuresPrefix(w, r)
+	if !ok {
+		return
+	}
+	ctx := r.Context()
+	byJob := map[string][]HookFailure{}
+	var order []string
+	err := a.listObjects(ctx, prefix, func(obj ObjectInfo) error {
+		var f HookFailure
+		if err := a.getJSON(ctx, obj.Key, &f); err != nil {
+			if classifyS3Error(err).Kind == s3NotFound {
+				return nil
+			}
+			return err
+		}
+		if _, seen := byJob[f.JobID]; !seen {
+			order = append(order, f.JobID)
+		}
+		byJob[f.JobID] = append(byJob[f.JobID], f)
+		return nil
+	})
+	if err != nil {
+		writeStorageError(ctx, w, "ListObjectsV2", "failed to list failed hooks", err)
+		return
+	}
+	resp := HookRetryResponse{}
+	for _, jobID := range order {
+		n, err := a.requeueHooks(ctx, byJob[jobID])
+		resp.Requeued += n
+		if err != nil {
+			resp.Errors = append(resp.Errors, jobID+": "+err.Error())
+		}
+	}
+	slog.InfoContext(ctx, "failed result hooks requeued", "requeued", resp.Requeued, "errors", len(resp.Errors))
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// requeueHooks adds one job's failed hooks to its pending task, creating it
+// if needed, and deletes their failure records. It returns how many were
+// requeued.
+func (a *App) requeueHooks(ctx context.Context, failures []HookFailure) (int, error) {
+	first := failures[0]
+	task := HookTask{
+		JobID:       first.JobID,
+		Key:         first.Key,
+		SizeBytes:   first.SizeBytes,
+		CallbackURL: first.CallbackURL,
+		CreatedAt:   Now(),
+		NextAt:      Now(),
+	}
+	// A task may still be pending for hooks that have not failed yet.
+	if err := a.getJSON(ctx, hookTaskKey(first.JobID), &task); err != nil && classifyS3Error(err).Kind != s3NotFound {
+		return 0, err
+	}
+	task.Attempts, task.NextAt = 0, Now()
+	keys := make([]string, 0, len(failures))
+	for _, f := range failures {
+		if !slices.Contains(task.Hooks, f.Hook) {
+			task.Hooks = append(task.Hooks, f.Hook)
+		}
+		keys = append(keys, hookFailureKey(f.JobID, f.Hook))
+	}
+	if err := a.putJSON(ctx, hookTaskKey(first.JobID), task); err != nil {
+		return 0, err
+	}
+	if _, err := a.deleteKeys(ctx, keys); err != nil {
+		// Requeued, and listed as failed until the next retry removes them.
+		return len(failures), err
+	}
+	return len(failures), nil
+}
+
+// hookFailuresPrefix returns the prefix of the failures r asks for, or
+// writes 400 for an invalid job_id.
+func (a *App) hookFailuresPrefix(w http.ResponseWriter, r *http.Request) (string, bool) {
+	id := r.URL.Query().Get("job_id")
+	if id == "" {
+		return hooksFailedPrefix, true
+	}
+	id, err := a.jobIDs.canonical(id)
+	if err != nil {
+		http.Error(w, "job_id "+err.Error(), http.StatusBadRequest)
+		return "", false
+	}
+	return hooksFailedPrefix + id + "/", true
+}
@@ -0,0 +1,221 @@
+// Idempotency keys for POST /jobs. A client that may retry a submission —
+// after a timeout, a dropped connection, a crash — sends the same
+// Idempotency-Key header each time. The first request claims the key by
+// writing idempotency/{hash}.json with a conditional put, so concurrent
+// retries on any replica cannot both win; the record holds the job ID and a
+// fingerprint of the request. A later request with the key then:
+//
+//   - gets 200 with the original job ID and "replayed": true once the job
+//     has been created, without enqueuing again;
+//   - gets 409 idempotency_key_in_use while the first request is still
+//     creating it (retry shortly);
+//   - gets 422 idempotency_key_reused if its body differs from the first.
+//
+// Keys are scoped to the principal (tenant and client ID) and kept for
+// IDEMPOTENCY_TTL (default 24h); after that the key may be reused and the
+// janitor deletes the record. A create that fails releases its key, so the
+// retry creates the job. A claim whose request died before writing the
+// creation record is taken over after idempotencyClaimTimeout.
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// headerIdempotencyKey carries the client's idempotency key.
+const headerIdempotencyKey = "Idempotency-Key"
+
+// headerIdempotentReplayed is set to "true" on a replayed response.
+const headerIdempotentReplayed = "Idempotent-Replayed"
+
+// idempotencyPrefix is the key prefix of idempotency records.
+const idempotencyPrefix = "idempotency/"
+
+// maxIdempotencyKeyLen bounds an Idempotency-Key value.
+const maxIdempotencyKeyLen = 255
+
+// idempotencyClaimTimeout is how long a claim may go without a creation
+// record before another request with the key takes it over. It is well past
+// the few awsOpTimeout-bounded calls a create makes before writing one.
+const idempotencyClaimTimeout = time.Minute
+
+// Error codes for idempotency key failures.
+const (
+	errCodeInvalidIdempotencyKey = "invalid_idempotency_key"
+	errCodeIdempotencyKeyInUse   = "idempotency_key_in_use"
+	errCodeIdempotencyKeyReused  = "idempotency_key_reused"
+)
+
+// IdempotencyRecord is idempotency/{hash}.json.
+type IdempotencyRecord struct {
+	JobID       string    `json:"job_id"`      // Job created for the key
+	Fingerprint string    `json:"fingerprint"` // submissionFingerprint of the request
+	CreatedAt   Timestamp `json:"created_at"`  // When the key was claimed
+}
+
+// idempotencyClaim is a key held by the current request.
+type idempotencyClaim struct {
+	key string // S3 key of the record
+}
+
+// Outcomes of claimIdempotencyKey other than a fresh claim.
+var (
+	errIdempotencyInUse  = errors.New("a request with this idempotency key is still in progress")
+	errIdempotencyReused = errors.New("idempotency key was already used with a different request")
+)
+
+// idempotencyRecordKey is the S3 key of the record for key sent by p. The
+// key is hashed so any client value is a safe object name.
+func idempotencyRecordKey(p Principal, key string) string {
+	h := submissionFingerprint(p, JobRequest{Text: key})
+	return idempotencyPrefix + h + ".json"
+}
+
+// validIdempotencyKey reports whether key is 1 to maxIdempotencyKeyLen
+// printable ASCII characters.
+func validIdempotencyKey(key string) bool {
+	if key == "" || len(key) > maxIdempotencyKeyLen {
+		return false
+	}
+	for i := range len(key) {
+		if key[i] < 0x20 || key[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// claimIdempotencyKey claims the record at key for jobID. If the key is
+// already held by a finished create of the same request, it returns that
+// job's ID and a nil claim. It returns errIdempotencyInUse or
+// errIdempotencyReused when the request must be refused.
+func (a *App) claimIdempotencyKey(ctx context.Context, key, fingerprint, jobID string) (*idempotencyClaim, string, error) {
+	rec := IdempotencyRecord{JobID: jobID, Fingerprint: fingerprint, CreatedAt: Now()}
+	err := a.putIdempotencyRecord(ctx, key, rec, PutOptions{IfNoneMatch: true})
+	if err == nil {
+		return &idempotencyClaim{key: key}, "", nil
+	}
+	if classifyS3Error(err).Status != http.StatusPreconditionFailed {
+		return nil, "", err
+	}
+
+	prior, etag, err := a.getIdempotencyRecord(ctx, key)
+	if err != nil {
+		if classifyS3Error(err).Kind == s3NotFound {
+			// Released between our put and get: the first create failed.
+			return nil, "", errIdempotencyInUse
+		}
+		return nil, "", err
+	}
+	age := time.Since(prior.CreatedAt.Time)
+	if age < a.idempotency {
+		if prior.Fingerprint != fingerprint {
+			return nil, "", errIdempotencyReused
+		}
+		created, err := a.objectExists(ctx, statusKey(prior.JobID))
+		if err != nil {
+			return nil, "", err
+		}
+		if created {
+			return nil, prior.JobID, nil
+		}
+		if age < idempotencyClaimTimeout {
+			return nil, "", errIdempotencyInUse
+		}
+	}
+	// Expired, or abandoned before the job was created: take the key over,
+	// unless another request has just done so.
+	err = a.putIdempotencyRecord(ctx, key, rec, PutOptions{IfMatch: etag})
+	if err != nil {
+		if classifyS3Error(err).Status == http.StatusPreconditionFailed {
+			return nil, "", errIdempotencyInUse
+		}
+		return nil, "", err
+	}
+	return &idempotencyClaim{key: key}, "", nil
+}
+
+// putIdempotencyRecord writes rec to key with the conditions in opts.
+func (a *App) putIdempotencyRecord(ctx context.Context, key string, rec IdempotencyRecord, opts PutOptions) error {
+	body, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("encode %s: %w", key, err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, awsOpTimeout)
+	defer cancel()
+	opts.ContentType = "application/json"
+	return a.store.Put(ctx, key, body, opts)
+}
+
+// getIdempotencyRecord reads the record at key and its ETag.
+func (a *App) getIdempotencyRecord(ctx context.Context, key string) (IdempotencyRecord, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, awsOpTimeout)
+	defer cancel()
+	body, info, err := a.store.Get(ctx, key)
+	if err != nil {
+		return IdempotencyRecord{}, "", err
+	}
+	defer body.Close()
+	var rec IdempotencyRecord
+	if err := json.NewDecoder(body).Decode(&rec); err != nil {
+		return IdempotencyRecord{}, "", fmt.Errorf("decode %s: %w", key, err)
+	}
+	return rec, info.ETag, nil
+}
+
+// release deletes the record of a create that failed, so a retry with the
+// key creates the job. Like compensateCreate it runs detached from the
+// request. A nil claim is a no-op.
+func (c *idempotencyClaim) release(ctx context.Context, a *App) {
+	if c == nil {
+		return
+	}
+	ctx = context.WithoutCancel(ctx)
+	if _, err := a.deleteKeys(ctx, []string{c.key}); err != nil {
+		// The claim is taken over after idempotencyClaimTimeout.
+		slog.WarnContext(ctx, "failed to release idempotency key", "key", c.key, "error", err)
+	}
+}
+
+// idempotencyError writes the response for an error from claimIdempotencyKey.
+func idempotencyError(ctx context.Context, w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errIdempotencyInUse):
+		w.Header().Set("Retry-After", "1")
+		writeError(w, http.StatusConflict, ErrorDetail{Code: errCodeIdempotencyKeyInUse, Message: err.Error(), Retryable: true})
+	case errors.Is(err, errIdempotencyReused):
+		writeError(w, http.StatusUnprocessableEntity, ErrorDetail{Code: errCodeIdempotencyKeyReused, Message: err.Error()})
+	default:
+		writeStorageError(ctx, w, "PutObject", "failed to record idempotency key", err)
+	}
+}
+
+// cleanIdempotency deletes idempotency records older than IDEMPOTENCY_TTL.
+func (j *janitor) cleanIdempotency(ctx context.Context, rep *JanitorReport, now time.Time) error {
+	a := j.app
+	var doomed []string
+	err := a.listObjects(ctx, idempotencyPrefix, func(obj ObjectInfo) error {
+		if now.Sub(obj.LastModified) < a.idempotency {
+			return nil
+		}
+		key := obj.Key
+		rep.ExpiredIdempotencyKeys.add(key, obj.Size)
+		doomed = append(doomed, key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if !rep.DryRun {
+		n, err := a.deleteKeys(ctx, doomed)
+		rep.ExpiredIdempotencyKeys.Deleted = n
+		return err
+	}
+	return nil
+}
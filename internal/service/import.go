@@ -0,0 +1,192 @@
+// Result import. POST /jobs/import lets a trusted system (admin token)
+// register a result computed elsewhere — typically when backfilling history
+// into the job store — without going through the queue or a processor. The
+// result is validated as strictly as one the worker would produce, stored
+// with provenance metadata saying where it came from, and indexed, so it is
+// indistinguishable from a native result to GET /jobs and the listings.
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// maxImportSkew bounds how far in the future imported timestamps may be.
+	maxImportSkew = 5 * time.Minute
+	// maxProvenanceLen caps provenance string fields.
+	maxProvenanceLen = 256
+)
+
+// Provenance records where an imported result came from.
+type Provenance struct {
+	Source     string    `json:"source"`                // Producing system, e.g. "legacy-batch"
+	ExternalID string    `json:"external_id,omitempty"` // The result's ID in the producing system
+	ImportedBy string    `json:"imported_by"`           // Principal that imported it
+	ImportedAt Timestamp `json:"imported_at"`           // When it was imported
+}
+
+// ImportArtifact is an artifact in an ImportRequest.
+type ImportArtifact struct {
+	Name        string `json:"name"`                   // Artifact name (letters, digits, . _ -)
+	ContentType string `json:"content_type,omitempty"` // Defaults to application/octet-stream
+	Content     []byte `json:"content"`                // Base64 in JSON
+}
+
+// ImportRequest is the POST /jobs/import request body.
+type ImportRequest struct {
+	ID          string           `json:"id,omitempty"`        // Job ID (a UUID); generated when absent
+	Text        string           `json:"text"`                // Original input
+	Output      string           `json:"output"`              // Computed output
+	CreatedAt   Timestamp        `json:"created_at"`          // When the job was originally submitted
+	ProcessedAt Timestamp        `json:"processed_at"`        // When it was originally processed
+	Artifacts   []ImportArtifact `json:"artifacts,omitempty"` // Attached artifacts
+	Source      string           `json:"source"`              // Producing system
+	ExternalID  string           `json:"external_id,omitempty"`
+}
+
+// ImportResponse is the POST /jobs/import response body.
+type ImportResponse struct {
+	ID        string   `json:"id"`                  // Job ID the result is stored under
+	Artifacts []string `json:"artifacts,omitempty"` // Stored artifact names
+}
+
+// errJobExists is returned when an import targets an existing result.
+var errJobExists = errors.New("a result with this id already exists")
+
+// validateImport checks req, canonicalises its ID under ids and fills in a
+// generated one when it has none.
+func validateImport(req *ImportRequest, now time.Time, ids jobIDScheme) error {
+	if req.ID == "" {
+		req.ID = uuid.New().String()
+	}
+	id, err := ids.canonical(req.ID)
+	if err != nil {
+		return fmt.Errorf("id %w", err)
+	}
+	req.ID = id
+	switch {
+	case req.Text == "" || req.Output == "":
+		return errors.New("text and output are required")
+	case req.Source == "":
+		return errors.New("source is required")
+	case len(req.Source) > maxProvenanceLen || len(req.ExternalID) > maxProvenanceLen:
+		return fmt.Errorf("source and external_id must be at most %d bytes", maxProvenanceLen)
+	case req.CreatedAt.IsZero() || req.ProcessedAt.IsZero():
+		return errors.New("created_at and processed_at are required")
+	case req.ProcessedAt.Before(req.CreatedAt.Time):
+		return errors.New("processed_at must not be before created_at")
+	case req.ProcessedAt.After(now.Add(maxImportSkew)):
+		return errors.New("processed_at is in the future")
+	}
+	seen := make(map[string]bool, len(req.Artifacts))
+	for _, art := range req.Artifacts {
+		if !validArtifactName(art.Name) || seen[art.Name] {
+			return fmt.Errorf("invalid or duplicate artifact name %q", art.Name)
+		}
+		seen[art.Name] = true
+	}
+	return nil
+}
+
+// importJob handles POST /jobs/import requests.
+// Admin only. Validates and stores an externally computed result with its
+// provenance and indexes it → 201 ImportResponse; 400 on invalid input, 409
+// when a result with the id already exists. Nothing is enqueued.
+func (a *App) importJob(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+	var req ImportRequest
+	if err := a.decodeJSON(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateImport(&req, time.Now(), a.jobIDs); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	key := fmt.Sprintf("jobs/%s.json", req.ID)
+	// Checked before the artifacts so an import never overwrites another
+	// job's; the conditional put below closes the remaining race.
+	exists, err := a.objectExists(ctx, key)
+	if err != nil {
+		writeStorageError(ctx, w, "HeadObject", "failed to check for an existing result", err)
+		return
+	}
+	if exists {
+		http.Error(w, errJobExists.Error(), http.StatusConflict)
+		return
+	}
+
+	artifacts := make([]Artifact, len(req.Artifacts))
+	for i, art := range req.Artifacts {
+		artifacts[i] = Artifact{Name: art.Name, ContentType: art.ContentType, Body: art.Content}
+	}
+	names, err := a.putArtifacts(ctx, "", req.ID, artifacts)
+	if err != nil {
+		writeStorageError(ctx, w, "PutObject", "failed to store artifacts", err)
+		return
+	}
+
+	result := JobResult{
+		ID:          req.ID,
+		Text:        req.Text,
+		Output:      req.Output,
+		Artifacts:   names,
+		CreatedAt:   Timestamp{Time: req.CreatedAt.UTC()},
+		ProcessedAt: Timestamp{Time: req.ProcessedAt.UTC()},
+		Provenance: &Provenance{
+			Source:     req.Source,
+			ExternalID: req.ExternalID,
+			ImportedBy: principalFromRequest(r).ID,
+			ImportedAt: Now(),
+		},
+	}
+	size, err := a.putResultIfAbsent(ctx, result)
+	if errors.Is(err, errJobExists) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		writeStorageError(ctx, w, "PutObject", "failed to store result", err)
+		return
+	}
+
+	if err := a.hooks.enqueue(ctx, result, size, ""); err != nil {
+		// The result is stored: a retried import would conflict with it.
+		slog.WarnContext(ctx, "result hooks will not run", "job_id", req.ID, "error", err)
+	}
+	rec := JobRecord{ID: req.ID, Tenant: principalFromRequest(r).Tenant, Type: result.Type, CreatedAt: result.CreatedAt}
+	if err := a.putJobRecord(ctx, &rec, createCompleted); err != nil {
+		slog.WarnContext(ctx, "failed to write creation record for import", "job_id", req.ID, "error", err)
+	}
+	slog.InfoContext(ctx, "result imported", "job_id", req.ID, "source", req.Source, "external_id", req.ExternalID)
+	writeJSON(w, http.StatusCreated, ImportResponse{ID: req.ID, Artifacts: names})
+}
+
+// putResultIfAbsent stores result at jobs/{id}.json unless an object is
+// already there (errJobExists), and returns the stored size.
+func (a *App) putResultIfAbsent(ctx context.Context, result JobResult) (int64, error) {
+	body, err := json.Marshal(result)
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, awsOpTimeout)
+	defer cancel()
+	err = a.store.Put(ctx, fmt.Sprintf("jobs/%s.json", result.ID), body, PutOptions{ContentType: "application/json", IfNoneMatch: true})
+	if err != nil {
+		if classifyS3Error(err).Status == http.StatusPreconditionFailed {
+			return 0, errJobExists
+		}
+		return 0, err
+	}
+	return int64(len(body)), nil
+}
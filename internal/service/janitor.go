@@ -0,0 +1,386 @@
+// Storage janitor. Periodically (JANITOR_INTERVAL) or on demand via the admin
+// API, it finds and deletes storage that no job will ever read again:
+//
+//   - orphaned payloads: objects under payloads/ older than the payload grace
+//     period whose job never produced a result (by then the message is past
+//     SQS's maximum retention, so the job can no longer run);
+//   - incomplete multipart uploads older than the upload grace period;
+//   - tombstoned results: tombstones/{id}.json markers older than the
+//     tombstone grace period, removed together with jobs/{id}.json and the
+//     job's artifacts;
+//   - half-created jobs: creation records still pending after the create
+//     grace period with no result (see createtx.go);
+//   - expired idempotency keys: records under idempotency/ older than
+//     IDEMPOTENCY_TTL (see idempotency.go).
+//
+// Dry-run mode (the default) only reports what would be deleted.
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Key prefixes the janitor manages.
+const (
+	payloadsPrefix   = "payloads/"
+	tombstonesPrefix = "tombstones/"
+)
+
+// janitorSampleSize caps the example keys kept per category in a report.
+const janitorSampleSize = 20
+
+// janitorConfig controls what the janitor considers stale.
+type janitorConfig struct {
+	dryRun         bool          // report only, delete nothing
+	payloadGrace   time.Duration // age after which an unattached payload is orphaned
+	uploadGrace    time.Duration // age after which a multipart upload is abandoned
+	tombstoneGrace time.Duration // time a tombstoned result is kept before purge
+	createGrace    time.Duration // age after which a pending creation record with no result is half-created
+}
+
+// Tombstone marks a job result as deleted; the result is kept until the
+// tombstone grace period has passed, then purged by the janitor.
+type Tombstone struct {
+	ID        string    `json:"id"`         // Job ID
+	DeletedAt Timestamp `json:"deleted_at"` // When the job was deleted
+}
+
+// tombstoneKey is the S3 key of a job's tombstone.
+func tombstoneKey(id string) string { return tombstonesPrefix + id + ".json" }
+
+// CleanupCategory summarises one kind of cleanup in a JanitorReport.
+type CleanupCategory struct {
+	Found   int      `json:"found"`            // Candidates found
+	Deleted int      `json:"deleted"`          // Actually deleted (0 in dry-run)
+	Bytes   int64    `json:"bytes"`            // Size of candidates, where known
+	Sample  []string `json:"sample,omitempty"` // First few keys, for inspection
+}
+
+// add records one candidate.
+func (c *CleanupCategory) add(key string, size int64) {
+	c.Found++
+	c.Bytes += size
+	if len(c.Sample) < janitorSampleSize {
+		c.Sample = append(c.Sample, key)
+	}
+}
+
+// JanitorReport is the outcome of one janitor run.
+type JanitorReport struct {
+	StartedAt              Timestamp       `json:"started_at"`
+	FinishedAt             Timestamp       `json:"finished_at"`
+	DryRun                 bool            `json:"dry_run"`
+	OrphanedPayloads       CleanupCategory `json:"orphaned_payloads"`
+	AbortedUploads         CleanupCategory `json:"aborted_uploads"`
+	PurgedTombstones       CleanupCategory `json:"purged_tombstones"`
+	HalfCreatedJobs        CleanupCategory `json:"half_created_jobs"` // Creation records that broke the create invariant
+	ExpiredIdempotencyKeys CleanupCategory `json:"expired_idempotency_keys"`
+	Errors                 []string        `json:"errors,omitempty"`
+	BytesReclaimable       int64           `json:"bytes_reclaimable"` // Sum of candidate sizes
+	ResultsPurged          int             `json:"results_purged"`    // jobs/{id}.json removed with tombstones
+	ArtifactsPurged        int             `json:"artifacts_purged"`  // jobs/{id}/artifacts/* removed with tombstones
+}
+
+// janitor runs cleanups and keeps the last report. A run in progress blocks
+// another from starting.
+type janitor struct {
+	app *App
+	cfg janitorConfig
+
+	running sync.Mutex
+	mu      sync.Mutex
+	last    *JanitorReport
+}
+
+// errJanitorBusy is returned when a run is requested while one is in progress.
+var errJanitorBusy = errors.New("janitor run already in progress")
+
+// run performs one cleanup pass; dryRun overrides the configured mode.
+func (j *janitor) run(ctx context.Context, dryRun bool) (*JanitorReport, error) {
+	if !j.running.TryLock() {
+		return nil, errJanitorBusy
+	}
+	defer j.running.Unlock()
+
+	rep := &JanitorReport{StartedAt: Now(), DryRun: dryRun}
+	now := time.Now()
+	if err := j.cleanPayloads(ctx, rep, now); err != nil {
+		rep.Errors = append(rep.Errors, "payloads: "+err.Error())
+	}
+	if err := j.cleanUploads(ctx, rep, now); err != nil {
+		rep.Errors = append(rep.Errors, "multipart uploads: "+err.Error())
+	}
+	if err := j.cleanTombstones(ctx, rep, now); err != nil {
+		rep.Errors = append(rep.Errors, "tombstones: "+err.Error())
+	}
+	if err := j.checkHalfCreated(ctx, rep, now); err != nil {
+		rep.Errors = append(rep.Errors, "half-created jobs: "+err.Error())
+	}
+	if err := j.cleanIdempotency(ctx, rep, now); err != nil {
+		rep.Errors = append(rep.Errors, "idempotency keys: "+err.Error())
+	}
+	rep.BytesReclaimable = rep.OrphanedPayloads.Bytes + rep.AbortedUploads.Bytes + rep.PurgedTombstones.Bytes
+	rep.FinishedAt = Now()
+
+	j.mu.Lock()
+	j.last = rep
+	j.mu.Unlock()
+	slog.Info("janitor run complete", "dry_run", dryRun,
+		"orphaned_payloads", rep.OrphanedPayloads.Found, "aborted_uploads", rep.AbortedUploads.Found,
+		"purged_tombstones", rep.PurgedTombstones.Found, "half_created_jobs", rep.HalfCreatedJobs.Found,
+		"expired_idempotency_keys", rep.ExpiredIdempotencyKeys.Found,
+		"bytes_reclaimable", rep.BytesReclaimable,
+		"errors", len(rep.Errors))
+	return rep, nil
+}
+
+// cleanPayloads deletes payloads older than payloadGrace with no job result.
+func (j *janitor) cleanPayloads(ctx context.Context, rep *JanitorReport, now time.Time) error {
+	a := j.app
+	var doomed []string
+	err := a.listObjects(ctx, payloadsPrefix, func(obj ObjectInfo) error {
+		if now.Sub(obj.LastModified) < j.cfg.payloadGrace {
+			return nil
+		}
+		key := obj.Key
+		id := strings.TrimPrefix(key, payloadsPrefix)
+		if i := strings.IndexAny(id, "./"); i >= 0 {
+			id = id[:i]
+		}
+		exists, err := a.objectExists(ctx, fmt.Sprintf("jobs/%s.json", id))
+		if err != nil || exists {
+			return err
+		}
+		rep.OrphanedPayloads.add(key, obj.Size)
+		doomed = append(doomed, key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if !rep.DryRun {
+		n, err := a.deleteKeys(ctx, doomed)
+		rep.OrphanedPayloads.Deleted = n
+		return err
+	}
+	return nil
+}
+
+// cleanUploads aborts multipart uploads started more than uploadGrace ago.
+func (j *janitor) cleanUploads(ctx context.Context, rep *JanitorReport, now time.Time) error {
+	a := j.app
+	if !a.onS3() {
+		return nil // Nothing to abort outside S3
+	}
+	p := s3.NewListMultipartUploadsPaginator(a.s3Client, &s3.ListMultipartUploadsInput{Bucket: aws.String(a.s3Bucket)})
+	for p.HasMorePages() {
+		pageCtx, cancel := context.WithTimeout(ctx, awsOpTimeout)
+		page, err := p.NextPage(pageCtx)
+		cancel()
+		if err != nil {
+			return err
+		}
+		for _, u := range page.Uploads {
+			if now.Sub(aws.ToTime(u.Initiated)) < j.cfg.uploadGrace {
+				continue
+			}
+			rep.AbortedUploads.add(aws.ToString(u.Key), 0)
+			if rep.DryRun {
+				continue
+			}
+			abortCtx, cancel := context.WithTimeout(ctx, awsOpTimeout)
+			_, err := a.s3Client.AbortMultipartUpload(abortCtx, &s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(a.s3Bucket),
+				Key:      u.Key,
+				UploadId: u.UploadId,
+			})
+			cancel()
+			if err != nil {
+				return fmt.Errorf("abort upload %s: %w", aws.ToString(u.Key), err)
+			}
+			rep.AbortedUploads.Deleted++
+		}
+	}
+	return nil
+}
+
+// cleanTombstones purges results whose tombstone is older than tombstoneGrace,
+// then the tombstone itself.
+func (j *janitor) cleanTombstones(ctx context.Context, rep *JanitorReport, now time.Time) error {
+	a := j.app
+	var doomed, artifacts, failures []string
+	err := a.listObjects(ctx, tombstonesPrefix, func(obj ObjectInfo) error {
+		key := obj.Key
+		var ts Tombstone
+		if err := a.getJSON(ctx, key, &ts); err != nil {
+			return err
+		}
+		if ts.DeletedAt.IsZero() || now.Sub(ts.DeletedAt.Time) < j.cfg.tombstoneGrace {
+			return nil
+		}
+		id := strings.TrimSuffix(path.Base(key), ".json")
+		rep.PurgedTombstones.add(key, obj.Size)
+		if err := a.listObjects(ctx, artifactsPrefix(id), func(art ObjectInfo) error {
+			artifacts = append(artifacts, art.Key)
+			return nil
+		}); err != nil {
+			return err
+		}
+		// Artifacts, failure record and result first, tombstone last: if the run
+		// dies in between, the tombstone is still there for the next run to
+		// finish the job.
+		failures = append(failures, failureKey(id))
+		doomed = append(doomed, fmt.Sprintf("jobs/%s.json", id), key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if !rep.DryRun {
+		n, err := a.deleteKeys(ctx, artifacts)
+		rep.ArtifactsPurged = n
+		if err != nil {
+			return err
+		}
+		if _, err := a.deleteKeys(ctx, failures); err != nil {
+			return err
+		}
+		n, err = a.deleteKeys(ctx, doomed)
+		rep.PurgedTombstones.Deleted = n / 2
+		rep.ResultsPurged = n / 2
+		return err
+	}
+	return nil
+}
+
+// listObjects calls fn for every object under prefix, stopping at fn's
+// first error.
+func (a *App) listObjects(ctx context.Context, prefix string, fn func(ObjectInfo) error) error {
+	for obj, err := range a.store.List(ctx, prefix, ListOptions{}) {
+		if err != nil {
+			return err
+		}
+		if err := fn(obj); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// objectExists reports whether key exists.
+func (a *App) objectExists(ctx context.Context, key string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, awsOpTimeout)
+	defer cancel()
+	_, err := a.store.Head(ctx, key)
+	if err != nil {
+		if classifyS3Error(err).Kind == s3NotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// getJSON reads key and decodes it into v.
+func (a *App) getJSON(ctx context.Context, key string, v any) error {
+	return getJSONFrom(ctx, a.store, key, v)
+}
+
+// putJSON encodes v and writes it to key.
+func (a *App) putJSON(ctx context.Context, key string, v any) error {
+	return putJSONTo(ctx, a.store, key, v)
+}
+
+// getJSONFrom reads key from store and decodes it into v.
+func getJSONFrom(ctx context.Context, store ResultStore, key string, v any) error {
+	ctx, cancel := context.WithTimeout(ctx, awsOpTimeout)
+	defer cancel()
+	body, _, err := store.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	if err := json.NewDecoder(body).Decode(v); err != nil {
+		return fmt.Errorf("decode %s: %w", key, err)
+	}
+	return nil
+}
+
+// putJSONTo encodes v and writes it to key in store.
+func putJSONTo(ctx context.Context, store ResultStore, key string, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("encode %s: %w", key, err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, awsOpTimeout)
+	defer cancel()
+	return store.Put(ctx, key, body, PutOptions{ContentType: "application/json"})
+}
+
+// deleteKeys deletes keys in order and returns how many were deleted.
+func (a *App) deleteKeys(ctx context.Context, keys []string) (int, error) {
+	return a.store.Delete(ctx, keys)
+}
+
+// loop runs the janitor every interval until ctx is cancelled.
+func (j *janitor) loop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if _, err := j.run(ctx, j.cfg.dryRun); err != nil {
+			slog.Warn("scheduled janitor run skipped", "error", err)
+		}
+	}
+}
+
+// runJanitor handles POST /admin/janitor/run requests.
+// Runs a cleanup pass synchronously and returns its report. ?dry_run=false is
+// required to actually delete; the default is a dry run regardless of config.
+func (a *App) runJanitor(w http.ResponseWriter, r *http.Request) {
+	dryRun := true
+	if v := r.URL.Query().Get("dry_run"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, "dry_run must be a boolean", http.StatusBadRequest)
+			return
+		}
+		dryRun = b
+	}
+	rep, err := a.janitor.run(r.Context(), dryRun)
+	if errors.Is(err, errJanitorBusy) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	writeJSON(w, http.StatusOK, rep)
+}
+
+// getJanitorReport handles GET /admin/janitor/report requests.
+// Returns the last janitor report, or 404 if none has run yet.
+func (a *App) getJanitorReport(w http.ResponseWriter, r *http.Request) {
+	a.janitor.mu.Lock()
+	rep := a.janitor.last
+	a.janitor.mu.Unlock()
+	if rep == nil {
+		http.Error(w, "no janitor run yet", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, rep)
+}
@@ -0,0 +1,81 @@
+// The execution environment handed to job processors. A JobContext bundles
+// what a processor may need — the job's identity, tenant and delivery
+// attempt, a deadline, a job-scoped logger and the processing span — so every
+// processor gets the same inputs whether it runs in the worker, a validation
+// dry run or an admin test, and a test can build one with newJobContext.
+package service
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// defaultJobTimeout bounds one processing attempt when JOB_TIMEOUT is unset.
+// It should stay below the queue's visibility timeout, or a slow job is
+// redelivered while still running.
+const defaultJobTimeout = 30 * time.Second
+
+// JobContext is a job's execution environment. The embedded Context carries
+// the processing span and is done at the job's deadline (or earlier, when the
+// parent's deadline is sooner); pass it to any I/O the processor does. Log
+// with the Logger's *Context methods and the JobContext itself, so lines carry
+// the trace as well as the job attributes.
+type JobContext struct {
+	context.Context
+
+	JobID   string       // Job being processed; empty for dry runs
+	Tenant  string       // Submitting tenant
+	Attempt int          // Delivery attempt, 1 on first delivery
+	DryRun  bool         // Output is discarded: validation dry run or admin test
+	Logger  *slog.Logger // Default logger with job_id, tenant and attempt attached
+	Span    trace.Span   // Span of this processing attempt
+
+	locks  *lockManager // Where Lock takes leases; nil gives always-free locks (locks.go)
+	heldMu sync.Mutex
+	held   []*Lock // Taken through this context, released when processing ends
+
+	secrets *jobSecrets // Secrets the job type declares; nil in dry runs (secrets.go)
+}
+
+// newJobContext derives a JobContext from ctx, with a deadline timeout from
+// now unless ctx's own deadline is sooner. The caller must call the returned
+// cancel function when processing ends.
+func newJobContext(ctx context.Context, jobID, tenant string, attempt int, timeout time.Duration) (*JobContext, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	if tenant == "" {
+		tenant = defaultTenant
+	}
+	jc := &JobContext{
+		Context: ctx,
+		JobID:   jobID,
+		Tenant:  tenant,
+		Attempt: attempt,
+		Logger:  slog.Default().With("job_id", jobID, "tenant", tenant, "attempt", attempt),
+		Span:    trace.SpanFromContext(ctx),
+	}
+	return jc, cancel
+}
+
+// newDryRunContext returns a JobContext for running a processor on a sample
+// whose output is discarded.
+func newDryRunContext(ctx context.Context, tenant string) (*JobContext, context.CancelFunc) {
+	jc, cancel := newJobContext(ctx, "", tenant, 1, defaultJobTimeout)
+	jc.DryRun = true
+	return jc, cancel
+}
+
+// receiveAttempt returns the SQS delivery attempt of message, or 1 when the
+// receive count was not requested.
+func receiveAttempt(message types.Message) int {
+	n, err := strconv.Atoi(message.Attributes[string(types.MessageSystemAttributeNameApproximateReceiveCount)])
+	if err != nil || n < 1 {
+		return 1
+	}
+	return n
+}
@@ -0,0 +1,184 @@
+// Job cancellation and deletion. DELETE /jobs/{id} does what the job's state
+// allows:
+//
+//   - a job still waiting to run (queued, buffered, or failed and awaiting
+//     redelivery) is cancelled: its creation record moves to "cancelled" and
+//     the worker drops the message instead of processing it — 202;
+//   - a job with a stored result, or a failure record once it has used
+//     MAX_ATTEMPTS, has the result, failure record, artifacts and sort index
+//     entries deleted and its record moved to "deleted" — 204;
+//   - a job a worker is running cannot be interrupted — 409, retry once it
+//     finishes.
+//
+// Record changes are conditional on the version read, so a cancel cannot
+// overwrite the worker moving the job to processing, nor the other way
+// round. Deleting is permanent (there is no grace period, unlike retention)
+// and idempotent: a repeat gets 204. Other replicas may serve a deleted
+// result from their caches for up to RESULT_CACHE_TTL.
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+)
+
+// errCodeJobProcessing means a worker is running the job, so it can neither
+// be cancelled nor deleted yet.
+const errCodeJobProcessing = "job_processing"
+
+// errJobCancelled is returned by processMessage for a job cancelled while
+// queued; the worker deletes its message without processing it.
+var errJobCancelled = errors.New("job was cancelled")
+
+// getJobRecord reads jobID's creation record and its ETag.
+func (a *App) getJobRecord(ctx context.Context, jobID string) (JobRecord, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, awsOpTimeout)
+	defer cancel()
+	body, info, err := a.store.Get(ctx, statusKey(jobID))
+	if err != nil {
+		return JobRecord{}, "", err
+	}
+	defer body.Close()
+	var rec JobRecord
+	if err := json.NewDecoder(body).Decode(&rec); err != nil {
+		return JobRecord{}, "", fmt.Errorf("decode %s: %w", statusKey(jobID), err)
+	}
+	rec.ID = jobID
+	return rec, info.ETag, nil
+}
+
+// putJobRecordIf writes rec with the given state if the stored record is
+// still at etag.
+func (a *App) putJobRecordIf(ctx context.Context, rec *JobRecord, state, etag string) error {
+	rec.State, rec.UpdatedAt = state, Now()
+	body, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("encode %s: %w", statusKey(rec.ID), err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, awsOpTimeout)
+	defer cancel()
+	return a.store.Put(ctx, statusKey(rec.ID), body, PutOptions{ContentType: "application/json", IfMatch: etag})
+}
+
+// deleteJob handles DELETE /jobs/{id} requests.
+// → 202 JobStatus "cancelled" when the job had not run yet; 204 when its
+// result or failure record has been deleted (or already was); 409
+// job_processing while a worker runs it, or (retryable) when its status
+// changed under the request; 404 when the job never existed. S3 failures
+// return the usual storage errors.
+func (a *App) deleteJob(w http.ResponseWriter, r *http.Request) {
+	jobID, ok := a.pathJobID(w, r)
+	if !ok {
+		return
+	}
+	ctx := r.Context()
+	rec, etag, err := a.getJobRecord(ctx, jobID)
+	hasRecord := err == nil
+	if err != nil && classifyS3Error(err).Kind != s3NotFound {
+		writeStorageError(ctx, w, "GetObject", "failed to read job status", err)
+		return
+	}
+	// The record comes first: a worker storing the result after this check
+	// changes the record too, so the conditional write below catches it.
+	stored, err := a.deleteStoredResult(ctx, jobID)
+	if err != nil {
+		writeStorageError(ctx, w, "DeleteObjects", "failed to delete job result", err)
+		return
+	}
+	if !hasRecord {
+		if !stored {
+			http.Error(w, "job not found", http.StatusNotFound)
+			return
+		}
+		// Jobs from before status tracking have only a result.
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	state := createCancelled
+	switch {
+	case stored, rec.State == createCompleted, rec.State == createDeleted:
+		state = createDeleted
+	case rec.State == createProcessing:
+		writeError(w, http.StatusConflict, ErrorDetail{Code: errCodeJobProcessing, Message: "the job is being processed; delete it once it has finished"})
+		return
+	case rec.State == createCancelled:
+		writeJSON(w, http.StatusAccepted, newJobStatus(rec))
+		return
+	}
+	if rec.State != state {
+		if err := a.putJobRecordIf(ctx, &rec, state, etag); err != nil {
+			if classifyS3Error(err).Status == http.StatusPreconditionFailed {
+				writeRetryableError(w, http.StatusConflict, errCodeJobProcessing, "the job's status changed during the request; retry", storageRetryAfter)
+				return
+			}
+			if !stored {
+				writeStorageError(ctx, w, "PutObject", "failed to cancel job", err)
+				return
+			}
+			// The result is gone, which is what matters; GET still answers
+			// from the record, as for a purged result.
+			slog.WarnContext(ctx, "failed to mark job deleted", "job_id", jobID, "error", err)
+		}
+	}
+	if state == createDeleted {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	slog.InfoContext(ctx, "job cancelled", "job_id", jobID, "previous_state", rec.State)
+	writeJSON(w, http.StatusAccepted, newJobStatus(rec))
+}
+
+// deleteStoredResult deletes jobID's result or failure record, with its
+// artifacts, sort index entries, callback delivery record and cached copy,
+// and reports whether there was one.
+func (a *App) deleteStoredResult(ctx context.Context, jobID string) (bool, error) {
+	resultKey := jobsPrefix + jobID + ".json"
+	var records, extras []string // Result and failure record; what hangs off them
+	headCtx, cancel := context.WithTimeout(ctx, awsOpTimeout)
+	head, err := a.store.Head(headCtx, resultKey)
+	cancel()
+	switch {
+	case err == nil:
+		var result JobResult
+		if err := a.getJSON(ctx, resultKey, &result); err == nil {
+			extras = append(extras, indexKeys(newJobSummary(result, head.Size))...)
+		} else if classifyS3Error(err).Kind != s3NotFound {
+			// Index entries are best effort; a stale one lists a missing job.
+			slog.WarnContext(ctx, "failed to read result for index cleanup", "job_id", jobID, "error", err)
+		}
+		records = append(records, resultKey)
+	case classifyS3Error(err).Kind != s3NotFound:
+		return false, err
+	}
+	failed, err := a.objectExists(ctx, failureKey(jobID))
+	if err != nil {
+		return false, err
+	}
+	if failed {
+		records = append(records, failureKey(jobID))
+	}
+	if len(records) == 0 {
+		return false, nil
+	}
+	extras = append(extras, callbackKey(jobID))
+	if err := a.listObjects(ctx, artifactsPrefix(jobID), func(obj ObjectInfo) error {
+		extras = append(extras, obj.Key)
+		return nil
+	}); err != nil {
+		return false, err
+	}
+	// Records last, so a failed run leaves them for a retry to find.
+	if _, err := a.deleteKeys(ctx, extras); err != nil {
+		return false, err
+	}
+	if _, err := a.deleteKeys(ctx, records); err != nil {
+		return false, err
+	}
+	a.results.remove(jobID)
+	return true, nil
+}
@@ -0,0 +1,416 @@
+// Job type switches. An operator can disable a job type at runtime, e.g. to
+// contain an incident in one processor, without a deploy:
+//
+//	PUT    /admin/job-types/{type}/disabled  {"reason": "...", "action": "requeue"}
+//	DELETE /admin/job-types/{type}/disabled
+//
+// The switches live in one flag object, flags/job-types.json, written with
+// conditional puts so concurrent changes are never lost. Every process keeps
+// a copy refreshed every JOB_TYPE_FLAGS_REFRESH (default 15s); the process
+// that made a change applies it at once.
+//
+// While a type is disabled, POST /jobs (and POST /jobs/validate) refuse it
+// with 403 job_type_disabled and the reason. The worker takes messages of
+// the type off the queue without processing them, per the switch's action:
+//
+//   - requeue (default): sends the message again, delayed by
+//     DISABLED_TYPE_REQUEUE_DELAY (default 5m, at most 15m), so it is
+//     retried until the type is enabled. The copy is a new message with a
+//     fresh receive count, so the queue's redrive policy never dead-letters
+//     it for being held. On a FIFO queue the message is hidden in place
+//     instead (fifo.go): each hold then raises its receive count, which the
+//     redrive policy does count, though MAX_ATTEMPTS does not (holds never
+//     reach processing, deliveries.go).
+//   - park: stores it under parked/{type}/ until the type is enabled again,
+//     when DELETE sends every parked message back to the queue.
+package service
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// jobTypeFlagsKey is the S3 key of the flag object.
+const jobTypeFlagsKey = "flags/job-types.json"
+
+// parkedPrefix is the key prefix of parked messages.
+const parkedPrefix = "parked/"
+
+// maxRequeueDelay is the longest delay SQS allows on a message.
+const maxRequeueDelay = 15 * time.Minute
+
+// flagUpdateAttempts bounds the read-modify-write retries of a flag change
+// that loses a race with another.
+const flagUpdateAttempts = 3
+
+// errCodeJobTypeDisabled means the submission's job type is switched off.
+const errCodeJobTypeDisabled = "job_type_disabled"
+
+// Actions the worker takes on messages of a disabled type.
+const (
+	disabledRequeue = "requeue"
+	disabledPark    = "park"
+)
+
+// JobTypeFlags is flags/job-types.json.
+type JobTypeFlags struct {
+	Disabled map[string]DisabledJobType `json:"disabled"` // By job type
+}
+
+// DisabledJobType is the switch of one disabled job type.
+type DisabledJobType struct {
+	Reason     string    `json:"reason"`                // Shown to clients whose submissions are refused
+	Action     string    `json:"action"`                // requeue or park
+	DisabledBy string    `json:"disabled_by,omitempty"` // X-Client-ID of the operator
+	DisabledAt Timestamp `json:"disabled_at"`
+}
+
+// DisableJobTypeRequest is the PUT /admin/job-types/{type}/disabled body.
+type DisableJobTypeRequest struct {
+	Reason string `json:"reason"`           // Required
+	Action string `json:"action,omitempty"` // requeue (default) or park
+}
+
+// EnableJobTypeResponse is the DELETE /admin/job-types/{type}/disabled
+// response body.
+type EnableJobTypeResponse struct {
+	Type     string   `json:"type"`
+	Unparked int      `json:"unparked"`         // Parked messages sent back to the queue
+	Errors   []string `json:"errors,omitempty"` // Parked messages that could not be; retry the DELETE
+}
+
+// ParkedMessage is parked/{type}/{id}.json: a message held while its type
+// was disabled.
+type ParkedMessage struct {
+	JobID    string          `json:"job_id"`
+	Envelope json.RawMessage `json:"envelope"` // Message body to send again
+	ParkedAt Timestamp       `json:"parked_at"`
+}
+
+// jobTypeDisabledError is returned by validateJobRequest for a disabled type.
+type jobTypeDisabledError struct {
+	typ    string
+	reason string
+}
+
+func (e *jobTypeDisabledError) Error() string {
+	return fmt.Sprintf("job type %s is disabled: %s", e.typ, e.reason)
+}
+
+// errFlagsContended is returned when a flag change keeps losing races.
+var errFlagsContended = errors.New("job type flags are being changed concurrently; retry")
+
+// jobTypeSwitches is this process's copy of the flag object.
+type jobTypeSwitches struct {
+	current      atomic.Pointer[JobTypeFlags]
+	refresh      time.Duration // How often the copy is re-read
+	requeueDelay time.Duration // Delay of a requeued message
+}
+
+// newJobTypeSwitches returns switches with nothing disabled, configured by
+// JOB_TYPE_FLAGS_REFRESH and DISABLED_TYPE_REQUEUE_DELAY.
+func newJobTypeSwitches() *jobTypeSwitches {
+	s := &jobTypeSwitches{
+		refresh:      envDuration("JOB_TYPE_FLAGS_REFRESH", 15*time.Second),
+		requeueDelay: min(max(envDuration("DISABLED_TYPE_REQUEUE_DELAY", 5*time.Minute), 0), maxRequeueDelay),
+	}
+	s.current.Store(&JobTypeFlags{})
+	return s
+}
+
+// disabled returns the switch of typ, "" meaning the default type, and
+// whether it is disabled.
+func (s *jobTypeSwitches) disabled(typ string) (DisabledJobType, bool) {
+	if typ == "" {
+		typ = defaultProcessorType
+	}
+	d, ok := s.current.Load().Disabled[typ]
+	return d, ok
+}
+
+// checkJobType returns a jobTypeDisabledError when typ is disabled.
+func (s *jobTypeSwitches) checkJobType(typ string) error {
+	if d, off := s.disabled(typ); off {
+		return &jobTypeDisabledError{typ: typ, reason: d.Reason}
+	}
+	return nil
+}
+
+// loadJobTypeFlags reads the flag object and its ETag; a missing object is
+// no flags and an empty ETag.
+func (a *App) loadJobTypeFlags(ctx context.Context) (JobTypeFlags, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, awsOpTimeout)
+	defer cancel()
+	body, info, err := a.store.Get(ctx, jobTypeFlagsKey)
+	if err != nil {
+		if classifyS3Error(err).Kind == s3NotFound {
+			return JobTypeFlags{}, "", nil
+		}
+		return JobTypeFlags{}, "", err
+	}
+	defer body.Close()
+	var flags JobTypeFlags
+	if err := json.NewDecoder(body).Decode(&flags); err != nil {
+		return JobTypeFlags{}, "", fmt.Errorf("decode %s: %w", jobTypeFlagsKey, err)
+	}
+	return flags, info.ETag, nil
+}
+
+// refreshJobTypeFlags replaces this process's copy with the stored flags,
+// keeping the old copy when they cannot be read.
+func (a *App) refreshJobTypeFlags(ctx context.Context) {
+	flags, _, err := a.loadJobTypeFlags(ctx)
+	if err != nil {
+		slog.WarnContext(ctx, "failed to refresh job type flags", "error", err)
+		return
+	}
+	a.typeFlags.current.Store(&flags)
+}
+
+// loop refreshes the flags every refresh interval until ctx is cancelled.
+func (s *jobTypeSwitches) loop(ctx context.Context, a *App) {
+	ticker := time.NewTicker(s.refresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.refreshJobTypeFlags(ctx)
+		}
+	}
+}
+
+// updateJobTypeFlags applies change to the stored flags with a conditional
+// put, re-reading and retrying when another change got there first. On
+// success this process's copy is the result.
+func (a *App) updateJobTypeFlags(ctx context.Context, change func(*JobTypeFlags)) (JobTypeFlags, error) {
+	for range flagUpdateAttempts {
+		flags, etag, err := a.loadJobTypeFlags(ctx)
+		if err != nil {
+			return JobTypeFlags{}, err
+		}
+		if flags.Disabled == nil {
+			flags.Disabled = map[string]DisabledJobType{}
+		}
+		change(&flags)
+		body, err := json.Marshal(flags)
+		if err != nil {
+			return JobTypeFlags{}, fmt.Errorf("encode %s: %w", jobTypeFlagsKey, err)
+		}
+		opts := PutOptions{ContentType: "application/json", IfNoneMatch: etag == "", IfMatch: etag}
+		pctx, cancel := context.WithTimeout(ctx, awsOpTimeout)
+		err = a.store.Put(pctx, jobTypeFlagsKey, body, opts)
+		cancel()
+		if err == nil {
+			a.typeFlags.current.Store(&flags)
+			return flags, nil
+		}
+		if classifyS3Error(err).Status != http.StatusPreconditionFailed {
+			return JobTypeFlags{}, err
+		}
+	}
+	return JobTypeFlags{}, errFlagsContended
+}
+
+// heldJobType returns the job ID and type of a job message whose type is
+// disabled, with its switch; ok is false for every other message.
+func (a *App) heldJobType(env Envelope) (jobID, typ string, d DisabledJobType, ok bool) {
+	if env.Type != messageTypeJob {
+		return "", "", DisabledJobType{}, false
+	}
+	var job JobMessage
+	if err := json.Unmarshal(env.Body, &job); err != nil {
+		return "", "", DisabledJobType{}, false // processMessage reports it
+	}
+	if job.Type == "" {
+		job.Type = defaultProcessorType
+	}
+	d, ok = a.typeFlags.disabled(job.Type)
+	// An ID that is not canonical is reported by processMessage once the
+	// type is enabled; a parked copy is keyed by message ID instead.
+	id, err := a.jobIDs.canonical(job.ID)
+	if err != nil {
+		id = ""
+	}
+	return id, job.Type, d, ok
+}
+
+// holdMessage takes a message of a disabled job type off the queue by
+// requeueing or parking it; on a FIFO queue, a requeued message is hidden in
+// place instead, keeping its place in its group. On failure the message is
+// left alone and reappears after its visibility timeout.
+func (a *App) holdMessage(ctx context.Context, message types.Message, payload *payloadPointer, env Envelope, jobID, typ string, d DisabledJobType) {
+	hideOnly := d.Action != disabledPark && isFIFOQueue(a.sqsURL)
+	body, err := json.Marshal(env)
+	if err == nil {
+		sctx, cancel := context.WithTimeout(ctx, awsOpTimeout)
+		switch {
+		case d.Action == disabledPark:
+			key := parkedPrefix + typ + "/" + cmp.Or(jobID, aws.ToString(message.MessageId)) + ".json"
+			err = a.putJSON(ctx, key, ParkedMessage{JobID: jobID, Envelope: body, ParkedAt: Now()})
+		case hideOnly:
+			if err = a.queue.ChangeVisibility(sctx, a.sqsURL, aws.ToString(message.ReceiptHandle), a.typeFlags.requeueDelay); err != nil {
+				recordSQSError(ctx, "ChangeMessageVisibility")
+			}
+		default:
+			err = a.sendWith(sctx, a.sqsURL, jobID, string(body), nil, SendOptions{
+				Delay:           a.typeFlags.requeueDelay,
+				DeduplicationID: aws.ToString(message.MessageId),
+			})
+		}
+		cancel()
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to hold message of disabled job type", "job_id", jobID, "type", typ, "action", d.Action, "error", err)
+		return
+	}
+	heldJobs.Add(ctx, 1, metric.WithAttributes(attribute.String("type", typ), attribute.String("action", d.Action)))
+	slog.InfoContext(ctx, "held message of disabled job type", "job_id", jobID, "type", typ, "action", d.Action)
+	if hideOnly {
+		return
+	}
+
+	dctx, cancel := context.WithTimeout(ctx, awsOpTimeout)
+	defer cancel()
+	if err := a.queue.Delete(dctx, a.sqsURL, aws.ToString(message.ReceiptHandle)); err != nil {
+		// Redelivered and held again: a duplicate that processing tolerates.
+		recordSQSError(ctx, "DeleteMessage")
+		slog.ErrorContext(ctx, "failed to delete held message", "job_id", jobID, "error", err)
+		return
+	}
+	if payload != nil {
+		if err := a.deletePayload(ctx, *payload); err != nil {
+			slog.WarnContext(ctx, "failed to delete extended payload", "bucket", payload.Bucket, "key", payload.Key, "error", err)
+		}
+	}
+}
+
+// unpark sends the messages parked for typ back to the queue.
+func (a *App) unpark(ctx context.Context, typ string, resp *EnableJobTypeResponse) error {
+	var sent []string
+	err := a.listObjects(ctx, parkedPrefix+typ+"/", func(obj ObjectInfo) error {
+		key := obj.Key
+		var pm ParkedMessage
+		err := a.getJSON(ctx, key, &pm)
+		if err == nil {
+			sctx, cancel := context.WithTimeout(ctx, awsOpTimeout)
+			// Deduplicated per parking, not per job: the job's own ID may
+			// have been sent moments ago.
+			dedup := fmt.Sprintf("%s@%d", key, pm.ParkedAt.UnixMilli())
+			err = a.sendWith(sctx, a.sqsURL, pm.JobID, string(pm.Envelope), nil, SendOptions{DeduplicationID: dedup})
+			cancel()
+		}
+		if err != nil {
+			resp.Errors = append(resp.Errors, fmt.Sprintf("%s: %v", key, err))
+			return nil
+		}
+		sent = append(sent, key)
+		return nil
+	})
+	n, delErr := a.deleteKeys(ctx, sent)
+	resp.Unparked = n
+	return errors.Join(err, delErr)
+}
+
+// getJobTypeFlags handles GET /admin/job-types/flags requests.
+// Reads the stored flags → 200 JobTypeFlags.
+func (a *App) getJobTypeFlags(w http.ResponseWriter, r *http.Request) {
+	flags, _, err := a.loadJobTypeFlags(r.Context())
+	if err != nil {
+		writeStorageError(r.Context(), w, "GetObject", "failed to read job type flags", err)
+		return
+	}
+	if flags.Disabled == nil {
+		flags.Disabled = map[string]DisabledJobType{}
+	}
+	a.typeFlags.current.Store(&flags)
+	writeJSON(w, http.StatusOK, flags)
+}
+
+// disableJobType handles PUT /admin/job-types/{type}/disabled requests.
+// Disables the type → 200 DisabledJobType; 404 for an unknown type, 400
+// without a reason or with an unknown action, 409 when the flags keep
+// changing underneath.
+func (a *App) disableJobType(w http.ResponseWriter, r *http.Request) {
+	typ := r.PathValue("type")
+	if _, ok := processors[typ]; !ok {
+		http.Error(w, "unknown job type", http.StatusNotFound)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+	var req DisableJobTypeRequest
+	if err := a.decodeJSON(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(req.Reason) == "" {
+		http.Error(w, "reason is required", http.StatusBadRequest)
+		return
+	}
+	if req.Action == "" {
+		req.Action = disabledRequeue
+	}
+	if req.Action != disabledRequeue && req.Action != disabledPark {
+		http.Error(w, "action must be requeue or park", http.StatusBadRequest)
+		return
+	}
+	d := DisabledJobType{Reason: req.Reason, Action: req.Action, DisabledBy: r.Header.Get("X-Client-ID"), DisabledAt: Now()}
+	_, err := a.updateJobTypeFlags(r.Context(), func(f *JobTypeFlags) {
+		f.Disabled[typ] = d
+	})
+	if err != nil {
+		flagUpdateError(r.Context(), w, err)
+		return
+	}
+	slog.WarnContext(r.Context(), "job type disabled", "type", typ, "reason", d.Reason, "action", d.Action, "by", d.DisabledBy)
+	writeJSON(w, http.StatusOK, d)
+}
+
+// enableJobType handles DELETE /admin/job-types/{type}/disabled requests.
+// Enables the type and sends its parked messages back to the queue → 200
+// EnableJobTypeResponse. Idempotent: on an enabled type it only retries
+// parked messages that failed to send before.
+func (a *App) enableJobType(w http.ResponseWriter, r *http.Request) {
+	typ := r.PathValue("type")
+	ctx := r.Context()
+	var was bool
+	_, err := a.updateJobTypeFlags(ctx, func(f *JobTypeFlags) {
+		_, was = f.Disabled[typ]
+		delete(f.Disabled, typ)
+	})
+	if err != nil {
+		flagUpdateError(ctx, w, err)
+		return
+	}
+	if was {
+		slog.InfoContext(ctx, "job type enabled", "type", typ, "by", r.Header.Get("X-Client-ID"))
+	}
+	resp := EnableJobTypeResponse{Type: typ}
+	if err := a.unpark(context.WithoutCancel(ctx), typ, &resp); err != nil {
+		resp.Errors = append(resp.Errors, err.Error())
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// flagUpdateError writes the response for an error from updateJobTypeFlags.
+func flagUpdateError(ctx context.Context, w http.ResponseWriter, err error) {
+	if errors.Is(err, errFlagsContended) {
+		writeError(w, http.StatusConflict, ErrorDetail{Code: "flags_contended", Message: err.Error(), Retryable: true})
+		return
+	}
+	writeStorageError(ctx, w, "PutObject", "failed to update job type flags", err)
+}
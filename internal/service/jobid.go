@@ -0,0 +1,87 @@
+// Job ID validation. Every job ID taken from a client — the {id} of
+// /jobs/{id}/… and a POST /jobs parent_id — is checked against the ID scheme
+// and put in canonical form before it goes anywhere near an S3 key, so a
+// malformed ID gets a 400 invalid_job_id instead of becoming a storage lookup.
+//
+// JOB_ID_SCHEME selects the scheme:
+//
+//	uuid    (default) the IDs this service generates. Any form uuid.Parse
+//	        accepts (upper case, braces, urn:uuid:) is canonicalised to
+//	        lower-case 8-4-4-4-12, so /jobs/{ID} and /jobs/{id} are one job.
+//	opaque  IDs from another generator: 1–128 of A–Z a–z 0–9 . _ -, not
+//	        "." or "..", used as given.
+package service
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// errCodeInvalidJobID means a job ID is not valid under the ID scheme.
+const errCodeInvalidJobID = "invalid_job_id"
+
+// maxOpaqueJobIDLen bounds opaque job IDs.
+const maxOpaqueJobIDLen = 128
+
+// jobIDScheme is the JOB_ID_SCHEME job IDs are validated against.
+type jobIDScheme string
+
+// Job ID schemes.
+const (
+	jobIDUUID   jobIDScheme = "uuid"
+	jobIDOpaque jobIDScheme = "opaque"
+)
+
+// newJobIDScheme returns the configured scheme.
+func newJobIDScheme() (jobIDScheme, error) {
+	switch s := jobIDScheme(getenv("JOB_ID_SCHEME")); s {
+	case "":
+		return jobIDUUID, nil
+	case jobIDUUID, jobIDOpaque:
+		return s, nil
+	default:
+		return "", fmt.Errorf("JOB_ID_SCHEME must be %s or %s, got %q", jobIDUUID, jobIDOpaque, s)
+	}
+}
+
+// canonical returns id in canonical form, or an error for the client saying
+// why it is invalid, worded to follow the field's name ("must be a UUID").
+func (s jobIDScheme) canonical(id string) (string, error) {
+	if id == "" {
+		return "", errors.New("is required")
+	}
+	if s == jobIDOpaque {
+		if len(id) > maxOpaqueJobIDLen {
+			return "", fmt.Errorf("must be at most %d characters", maxOpaqueJobIDLen)
+		}
+		if id == "." || id == ".." || strings.IndexFunc(id, invalidOpaqueIDRune) >= 0 {
+			return "", errors.New("may only contain letters, digits, '.', '_' and '-'")
+		}
+		return id, nil
+	}
+	u, err := uuid.Parse(id)
+	if err != nil {
+		return "", errors.New("must be a UUID")
+	}
+	return u.String(), nil
+}
+
+// invalidOpaqueIDRune reports whether c may not appear in an opaque job ID.
+func invalidOpaqueIDRune(c rune) bool {
+	return !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '_' || c == '-')
+}
+
+// pathJobID returns the canonical {id} of r, or writes a 400 invalid_job_id
+// and returns false.
+func (a *App) pathJobID(w http.ResponseWriter, r *http.Request) (string, bool) {
+	id, err := a.jobIDs.canonical(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, ErrorDetail{Code: errCodeInvalidJobID, Message: "job id " + err.Error()})
+		return "", false
+	}
+	return id, true
+}
@@ -0,0 +1,211 @@
+// Sorted job listing. S3 only lists keys in ascending order, so when the worker
+// stores a result it also writes empty index objects whose keys sort by each
+// supported field, in both directions:
+//
+//	index/{field}/{asc|desc}/{value}_{id}_{created_ms}_{completed_ms}_{size}
+//
+// value is the field as a fixed-width decimal (inverted for desc), and the
+// trailing fields let a listing be rendered from keys alone, without reading
+// each result. GET /jobs?sort=duration&order=desc then lists one index prefix.
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// indexPrefix is the key prefix of sort index entries.
+const indexPrefix = "index/"
+
+// Sortable job list fields.
+const (
+	sortCreatedAt   = "created_at"   // Accepted by POST /jobs
+	sortCompletedAt = "completed_at" // Result stored by the worker
+	sortDuration    = "duration"     // completed_at - created_at
+	sortSize        = "size"         // Stored result size in bytes
+)
+
+// sortFields lists the indexed fields in the order entries are written.
+var sortFields = []string{sortCreatedAt, sortCompletedAt, sortDuration, sortSize}
+
+// jobSort is a requested list order.
+type jobSort struct {
+	field string
+	desc  bool
+}
+
+// parseJobSort reads ?sort= and ?order= (asc or desc, default desc). ok is
+// false when no sort was requested, meaning plain ID order.
+func parseJobSort(sort, order string) (s jobSort, ok bool, err error) {
+	if sort == "" {
+		if order != "" {
+			return jobSort{}, false, errors.New("order requires sort")
+		}
+		return jobSort{}, false, nil
+	}
+	switch sort {
+	case sortCreatedAt, sortCompletedAt, sortDuration, sortSize:
+	default:
+		return jobSort{}, false, fmt.Errorf("sort must be one of %s", strings.Join(sortFields, ", "))
+	}
+	switch order {
+	case "", "desc":
+		return jobSort{field: sort, desc: true}, true, nil
+	case "asc":
+		return jobSort{field: sort}, true, nil
+	default:
+		return jobSort{}, false, errors.New("order must be asc or desc")
+	}
+}
+
+// String is the canonical form bound into page tokens.
+func (s jobSort) String() string { return "sort=" + s.field + ":" + s.direction() }
+
+func (s jobSort) direction() string {
+	if s.desc {
+		return "desc"
+	}
+	return "asc"
+}
+
+// prefix is the index prefix listing entries in this order.
+func (s jobSort) prefix() string { return indexPrefix + s.field + "/" + s.direction() + "/" }
+
+// valueKey returns the index key prefix of entries with sort value v: v as a
+// fixed-width decimal, inverted for descending order.
+func (s jobSort) valueKey(v int64) string {
+	if s.desc {
+		v = math.MaxInt64 - v
+	}
+	return fmt.Sprintf("%s%019d", s.prefix(), v)
+}
+
+// sortValue returns summary's value for field, and false when it is unknown
+// (results of jobs submitted before created_at was recorded).
+func sortValue(field string, sum JobSummary) (int64, bool) {
+	switch field {
+	case sortCreatedAt:
+		return sum.CreatedAt.UnixMilli(), !sum.CreatedAt.IsZero()
+	case sortCompletedAt:
+		return sum.CompletedAt.UnixMilli(), !sum.CompletedAt.IsZero()
+	case sortDuration:
+		if sum.DurationMs == nil {
+			return 0, false
+		}
+		return *sum.DurationMs, true
+	case sortSize:
+		return sum.SizeBytes, true
+	}
+	return 0, false
+}
+
+// indexKeys returns every index entry for sum.
+func indexKeys(sum JobSummary) []string {
+	suffix := fmt.Sprintf("_%s_%d_%d_%d", sum.ID, sum.CreatedAt.UnixMilli(), sum.CompletedAt.UnixMilli(), sum.SizeBytes)
+	var keys []string
+	for _, field := range sortFields {
+		v, ok := sortValue(field, sum)
+		if !ok {
+			continue
+		}
+		for _, s := range []jobSort{{field, false}, {field, true}} {
+			keys = append(keys, s.valueKey(max(v, 0))+suffix)
+		}
+	}
+	return keys
+}
+
+// parseIndexKey decodes the job summary carried by an index entry key.
+func parseIndexKey(key string) (JobSummary, bool) {
+	parts := strings.Split(key[strings.LastIndex(key, "/")+1:], "_")
+	if len(parts) != 5 || parts[1] == "" {
+		return JobSummary{}, false
+	}
+	var n [3]int64
+	for i, p := range parts[2:] {
+		v, err := strconv.ParseInt(p, 10, 64)
+		if err != nil {
+			return JobSummary{}, false
+		}
+		n[i] = v
+	}
+	sum := JobSummary{ID: parts[1], CompletedAt: Timestamp{Time: time.UnixMilli(n[1]).UTC()}, SizeBytes: n[2]}
+	if n[0] != 0 {
+		sum.CreatedAt = Timestamp{Time: time.UnixMilli(n[0]).UTC()}
+		d := n[1] - n[0]
+		sum.DurationMs = &d
+	}
+	return sum, true
+}
+
+// newJobSummary builds the summary indexed for a stored result.
+func newJobSummary(result JobResult, size int64) JobSummary {
+	sum := JobSummary{ID: result.ID, SizeBytes: size, CreatedAt: result.CreatedAt, CompletedAt: result.ProcessedAt}
+	if !result.CreatedAt.IsZero() {
+		d := result.ProcessedAt.Sub(result.CreatedAt.Time).Milliseconds()
+		sum.DurationMs = &d
+	}
+	return sum
+}
+
+// writeIndex writes sum's index entries concurrently. Entries are best
+// effort: a job missing from a sorted view is still readable by ID.
+func (a *App) writeIndex(ctx context.Context, sum JobSummary) {
+	if err := a.writeIndexEntries(ctx, sum); err != nil {
+		f := classifyS3Error(err)
+		slog.WarnContext(ctx, "failed to write job index entries", append([]any{"job_id", sum.ID, "error", err}, f.logAttrs()...)...)
+	}
+}
+
+// writeIndexEntries writes sum's index entries concurrently, returning the
+// failures.
+func (a *App) writeIndexEntries(ctx context.Context, sum JobSummary) error {
+	keys := indexKeys(sum)
+	errs := make([]error, len(keys))
+	var wg sync.WaitGroup
+	for i, key := range keys {
+		wg.Go(func() {
+			putCtx, cancel := context.WithTimeout(ctx, awsOpTimeout)
+			defer cancel()
+			errs[i] = a.store.Put(putCtx, key, nil, PutOptions{})
+		})
+	}
+	wg.Wait()
+	err := errors.Join(errs...)
+	if err != nil {
+		recordS3Error(ctx, "PutObject", classifyS3Error(err))
+	}
+	return err
+}
+
+// listSorted reads up to limit summaries passing f from the s index after
+// startAfter, stopping early at the far end of rng (created_at sorts only),
+// and returns the key to resume after, or "" when the listing is exhausted.
+func (a *App) listSorted(ctx context.Context, s jobSort, rng createdRange, f jobFilter, startAfter string, limit int) (JobListResponse, string, error) {
+	entries := func(yield func(listEntry, error) bool) {
+		for obj, err := range a.store.List(ctx, s.prefix(), ListOptions{StartAfter: startAfter, PageSize: limit}) {
+			if err != nil {
+				yield(listEntry{}, err)
+				return
+			}
+			sum, ok := parseIndexKey(obj.Key)
+			if !ok {
+				continue
+			}
+			if s.field == sortCreatedAt && rng.past(s, sum) {
+				return
+			}
+			if !yield(listEntry{key: obj.Key, sum: sum}, nil) {
+				return
+			}
+		}
+	}
+	return a.fillPage(ctx, entries, f, limit)
+}
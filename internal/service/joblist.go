@@ -0,0 +1,357 @@
+// Job listing. GET /jobs pages through stored job results under the jobs/
+// prefix in key order, resuming from a signed page token. A caller sees only
+// its own tenant's jobs: results and index entries do not say whose job they
+// are, so each listed job's creation record is read to tell. Keys are not
+// partitioned by tenant, so a request scans at most listScanLimit of them,
+// whatever share is the caller's: a page cut short by the bound still has a
+// next_page_token, to resume where the scan stopped.
+package service
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"iter"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// defaultPageSize and maxPageSize bound ?limit= on list endpoints.
+	defaultPageSize = 50
+	maxPageSize     = 1000
+
+	// jobsPrefix is the key prefix of stored job results.
+	jobsPrefix = "jobs/"
+
+	// listRecordReads bounds the creation records a listing reads at once.
+	listRecordReads = 16
+
+	// listScanLimit bounds the keys, and so the creation records, one
+	// listing request reads.
+	listScanLimit = 2 * maxPageSize
+)
+
+// JobSummary is one entry in a job list.
+type JobSummary struct {
+	ID          string    `json:"id"`                    // Job ID
+	SizeBytes   int64     `json:"size_bytes"`            // Size of the stored result
+	CreatedAt   Timestamp `json:"created_at"`            // When the job was accepted; null when unknown
+	CompletedAt Timestamp `json:"completed_at"`          // When the result was written
+	DurationMs  *int64    `json:"duration_ms,omitempty"` // completed_at - created_at, when both are known
+}
+
+// JobListResponse is the GET /jobs response body.
+type JobListResponse struct {
+	Jobs          []JobSummary `json:"jobs"`
+	NextPageToken string       `json:"next_page_token,omitempty"` // Absent on the last page
+}
+
+// listEntry is a job a listing came across: the key it was listed under and
+// the summary rendered from it.
+type listEntry struct {
+	key string
+	sum JobSummary
+}
+
+// jobFilter selects the jobs a listing returns, by their creation records.
+type jobFilter struct {
+	tenant  string       // Caller's tenant; only its jobs are listed
+	typ     string       // Job type, or "" for any
+	status  string       // Status the record must report, when listing records rather than results
+	created createdRange // Bounds on created_at, when listing records
+}
+
+// match reports whether the job of rec passes f. A job without a record —
+// stored before records were kept — counts as defaultTenant's, and a record
+// without a type as the default type's.
+func (f jobFilter) match(rec JobRecord) bool {
+	if cmp.Or(rec.Tenant, defaultTenant) != f.tenant {
+		return false
+	}
+	if f.typ != "" && cmp.Or(rec.Type, defaultProcessorType) != f.typ {
+		return false
+	}
+	if f.status == "" {
+		return true
+	}
+	return rec.ID != "" && publicStatus(rec.State) == f.status && f.created.contains(rec.CreatedAt.Time)
+}
+
+// recordKeyID returns the job ID of a creation record key (status/{id}.json),
+// or "" for any other key.
+func recordKeyID(key string) string {
+	name, ok := strings.CutPrefix(key, statusPrefix)
+	if !ok {
+		return ""
+	}
+	id, ok := strings.CutSuffix(name, ".json")
+	if !ok || id == "" || strings.ContainsAny(id, "./") {
+		return ""
+	}
+	return id
+}
+
+// resultKeyID returns the job ID of a result key (jobs/{id}.json), or "" for
+// any other object under jobs/ (status, failure records, ...).
+func resultKeyID(key string) string {
+	name, ok := strings.CutPrefix(key, jobsPrefix)
+	if !ok {
+		return ""
+	}
+	id, ok := strings.CutSuffix(name, ".json")
+	if !ok || id == "" || strings.ContainsAny(id, "./") {
+		return ""
+	}
+	return id
+}
+
+// parsePageSize reads ?limit=, defaulting to defaultPageSize.
+func parsePageSize(r *http.Request) (int, error) {
+	v := r.URL.Query().Get("limit")
+	if v == "" {
+		return defaultPageSize, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 || n > maxPageSize {
+		return 0, errors.New("limit must be between 1 and " + strconv.Itoa(maxPageSize))
+	}
+	return n, nil
+}
+
+// writePageTokenError reports a page token that failed verification.
+func writePageTokenError(w http.ResponseWriter, err error) {
+	writeError(w, http.StatusBadRequest, ErrorDetail{Code: errCodeInvalidPageToken, Message: err.Error()})
+}
+
+// listJobs handles GET /jobs requests.
+// Returns up to ?limit= summaries of the caller's tenant's jobs and a
+// next_page_token to resume from, in
+// ID order or, with ?sort=created_at|completed_at|duration|size and
+// ?order=asc|desc (default desc), from the matching sort index. ?view={id}
+// applies a saved view instead. Tokens are bound to the caller's tenant and
+// sort or view and expire after PAGE_TOKEN_TTL.
+func (a *App) listJobs(w http.ResponseWriter, r *http.Request) {
+	limit, err := parsePageSize(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, ErrorDetail{Code: errCodeInvalidRequest, Message: err.Error()})
+		return
+	}
+	sort, sorted, err := parseJobSort(r.URL.Query().Get("sort"), r.URL.Query().Get("order"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, ErrorDetail{Code: errCodeInvalidRequest, Message: err.Error()})
+		return
+	}
+	p := principalFromRequest(r)
+	tenant := p.Tenant
+	const kind = "jobs"
+	query := ""
+	if sorted {
+		query = sort.String()
+	}
+
+	// A saved view supplies its own order and filters.
+	filter := jobFilter{tenant: tenant}
+	var rng createdRange
+	if id := r.URL.Query().Get("view"); id != "" {
+		if sorted {
+			writeError(w, http.StatusBadRequest, ErrorDetail{Code: errCodeInvalidRequest, Message: "view cannot be combined with sort or order"})
+			return
+		}
+		v, err := a.loadView(r, p, id)
+		switch {
+		case errors.Is(err, errViewNotFound):
+			writeError(w, http.StatusNotFound, ErrorDetail{Code: errCodeNotFound, Message: err.Error()})
+			return
+		case err != nil:
+			writeStorageError(r.Context(), w, "GetObject", "failed to read view", err)
+			return
+		}
+		sort, sorted = jobSort{field: sortCreatedAt, desc: v.Order != "asc"}, true
+		rng = v.viewRange()
+		query = "view=" + v.ID + ";" + sort.String()
+		filter.typ = v.Filter.Type
+		if v.Filter.Status != "" && v.Filter.Status != statusCompleted {
+			// Only stored results are indexed: jobs in other states come
+			// from their creation records, in ID order.
+			sorted = false
+			filter.status, filter.created = v.Filter.Status, rng
+		}
+	}
+
+	startAfter := ""
+	if sorted {
+		startAfter = rng.startKey(sort)
+	}
+	if tok := r.URL.Query().Get("page_token"); tok != "" {
+		if startAfter, err = a.pageTokens.verify(tok, kind, tenant, query); err != nil {
+			writePageTokenError(w, err)
+			return
+		}
+	}
+
+	var (
+		resp JobListResponse
+		last string
+	)
+	switch {
+	case filter.status != "":
+		resp, last, err = a.listRecords(r.Context(), filter, startAfter, limit)
+	case sorted:
+		resp, last, err = a.listSorted(r.Context(), sort, rng, filter, startAfter, limit)
+	default:
+		resp, last, err = a.listResults(r.Context(), filter, startAfter, limit)
+	}
+	if err != nil {
+		writeStorageError(r.Context(), w, "ListObjectsV2", "failed to list jobs", err)
+		return
+	}
+	if last != "" {
+		resp.NextPageToken = a.pageTokens.issue(kind, tenant, query, last)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// listResults reads up to limit summaries of results passing f after
+// startAfter. It returns the key to resume after, or "" when the listing is
+// exhausted.
+func (a *App) listResults(ctx context.Context, f jobFilter, startAfter string, limit int) (JobListResponse, string, error) {
+	entries := func(yield func(listEntry, error) bool) {
+		for obj, err := range a.store.List(ctx, jobsPrefix, ListOptions{StartAfter: startAfter, PageSize: limit}) {
+			if err != nil {
+				yield(listEntry{}, err)
+				return
+			}
+			id := resultKeyID(obj.Key)
+			if id == "" {
+				continue
+			}
+			sum := JobSummary{ID: id, SizeBytes: obj.Size, CompletedAt: Timestamp{Time: obj.LastModified.UTC()}}
+			if !yield(listEntry{key: obj.Key, sum: sum}, nil) {
+				return
+			}
+		}
+	}
+	return a.fillPage(ctx, entries, f, limit)
+}
+
+// listRecords reads up to limit summaries of jobs whose creation records pass
+// f after startAfter, in job ID order. It returns the key to resume after, or
+// "" when the listing is exhausted.
+func (a *App) listRecords(ctx context.Context, f jobFilter, startAfter string, limit int) (JobListResponse, string, error) {
+	entries := func(yield func(listEntry, error) bool) {
+		for obj, err := range a.store.List(ctx, statusPrefix, ListOptions{StartAfter: startAfter, PageSize: limit}) {
+			if err != nil {
+				yield(listEntry{}, err)
+				return
+			}
+			id := recordKeyID(obj.Key)
+			if id == "" {
+				continue
+			}
+			if !yield(listEntry{key: obj.Key, sum: JobSummary{ID: id}}, nil) {
+				return
+			}
+		}
+	}
+	return a.fillPage(ctx, entries, f, limit)
+}
+
+// fillPage takes entries until limit of them pass f, reading the creation
+// records of as many at a time as the page still lacks, or until it has
+// taken listScanLimit. It returns the key to resume after, or "" when
+// entries ran out.
+func (a *App) fillPage(ctx context.Context, entries iter.Seq2[listEntry, error], f jobFilter, limit int) (JobListResponse, string, error) {
+	resp := JobListResponse{Jobs: []JobSummary{}}
+	var batch []listEntry
+	take := func() (string, error) {
+		recs, err := a.listedRecords(ctx, batch, f)
+		if err != nil {
+			return "", err
+		}
+		for i, e := range batch {
+			if !f.match(recs[i]) {
+				continue
+			}
+			resp.Jobs = append(resp.Jobs, e.sum.withRecord(recs[i]))
+			if len(resp.Jobs) == limit {
+				// A full page may be followed by an empty one; clients
+				// simply stop when next_page_token is absent.
+				return e.key, nil
+			}
+		}
+		batch = batch[:0]
+		return "", nil
+	}
+	scanned := 0
+	for e, err := range entries {
+		if err != nil {
+			return resp, "", err
+		}
+		batch = append(batch, e)
+		scanned++
+		if scanned < listScanLimit && len(batch) < limit-len(resp.Jobs) {
+			continue
+		}
+		if last, err := take(); err != nil || last != "" {
+			return resp, last, err
+		}
+		if scanned == listScanLimit {
+			// A short page, or an empty one: the rest of the keys may be
+			// any tenant's.
+			return resp, e.key, nil
+		}
+	}
+	if len(batch) == 0 {
+		return resp, "", nil
+	}
+	last, err := take()
+	return resp, last, err
+}
+
+// withRecord fills in the created_at an entry lacks from its job's record:
+// results listed in ID order carry none.
+func (sum JobSummary) withRecord(rec JobRecord) JobSummary {
+	if !sum.CreatedAt.IsZero() || rec.CreatedAt.IsZero() {
+		return sum
+	}
+	sum.CreatedAt = rec.CreatedAt
+	if !sum.CompletedAt.IsZero() {
+		d := sum.CompletedAt.Sub(sum.CreatedAt.Time).Milliseconds()
+		sum.DurationMs = &d
+	}
+	return sum
+}
+
+// listedRecords reads the creation records of entries' jobs, a zero record
+// for a job without one. When f filters by type, a listed result whose record
+// does not say its type is read for it.
+func (a *App) listedRecords(ctx context.Context, entries []listEntry, f jobFilter) ([]JobRecord, error) {
+	recs := make([]JobRecord, len(entries))
+	errs := make([]error, len(entries))
+	slots := make(chan struct{}, listRecordReads)
+	var wg sync.WaitGroup
+	for i, e := range entries {
+		slots <- struct{}{}
+		wg.Go(func() {
+			defer func() { <-slots }()
+			if err := a.getJSON(ctx, statusKey(e.sum.ID), &recs[i]); err != nil && classifyS3Error(err).Kind != s3NotFound {
+				errs[i] = err
+				return
+			}
+			if f.typ == "" || recs[i].Type != "" || strings.HasPrefix(e.key, statusPrefix) {
+				return
+			}
+			var result JobResult
+			if err := a.getJSON(ctx, jobsPrefix+e.sum.ID+".json", &result); err != nil && classifyS3Error(err).Kind != s3NotFound {
+				errs[i] = err
+				return
+			}
+			recs[i].Type = result.Type
+		})
+	}
+	wg.Wait()
+	return recs, errors.Join(errs...)
+}
@@ -0,0 +1,67 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFillPageBoundsTheScan(t *testing.T) {
+	store, err := newFilesystemStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &App{store: store}
+	// Another tenant's jobs, listScanLimit of them, ahead of the caller's.
+	keys := make([]string, listScanLimit+3)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("%s%05d.json", jobsPrefix, i)
+		if i >= listScanLimit {
+			id := fmt.Sprintf("%05d", i)
+			if err := a.putJSON(t.Context(), statusKey(id), JobRecord{ID: id, Tenant: "acme"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	scanned := 0
+	entries := func(from int) func(yield func(listEntry, error) bool) {
+		return func(yield func(listEntry, error) bool) {
+			for _, key := range keys[from:] {
+				scanned++
+				if !yield(listEntry{key: key, sum: JobSummary{ID: resultKeyID(key)}}, nil) {
+					return
+				}
+			}
+		}
+	}
+	f := jobFilter{tenant: "acme"}
+
+	resp, last, err := a.fillPage(t.Context(), entries(0), f, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Jobs) != 0 || last != keys[listScanLimit-1] || scanned != listScanLimit {
+		t.Fatalf("first page: %d jobs, resume after %q, %d scanned; want none, after %q, %d", len(resp.Jobs), last, scanned, keys[listScanLimit-1], listScanLimit)
+	}
+	resp, last, err = a.fillPage(t.Context(), entries(listScanLimit), f, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Jobs) != 3 || last != "" {
+		t.Fatalf("second page: %d jobs, resume after %q; want 3, at the end", len(resp.Jobs), last)
+	}
+}
+
+func TestListJobsErrors(t *testing.T) {
+	a := &App{}
+	for _, query := range []string{"limit=0", "sort=colour", "view=v1&sort=size"} {
+		w := httptest.NewRecorder()
+		a.listJobs(w, httptest.NewRequest(http.MethodGet, "/v1/jobs?"+query, nil))
+		var body ErrorBody
+		if err := json.NewDecoder(w.Body).Decode(&body); err != nil || w.Code != http.StatusBadRequest || body.Error.Code != errCodeInvalidRequest {
+			t.Errorf("%s: %d %+v, %v; want 400 %s", query, w.Code, body.Error, err, errCodeInvalidRequest)
+		}
+	}
+}
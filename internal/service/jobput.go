@@ -0,0 +1,117 @@
+// Client-supplied job IDs. With CLIENT_JOB_IDS=true, PUT /jobs/{id} creates
+// a job under the caller's own ID — a correlation ID it already has — with
+// the same body as POST /jobs. The ID is validated against JOB_ID_SCHEME, so
+// with the default uuid scheme it must be a UUID, and is used in canonical
+// form.
+//
+// The PUT is idempotent on the ID: its creation record is written only if
+// absent (If-None-Match), carrying a fingerprint of the payload and tenant.
+// A repeat of the same submission, from any client of the tenant, gets 200
+// with "replayed": true and enqueues nothing; the same ID with a different
+// payload, or taken by a job created any other way, gets 409
+// job_id_conflict; a repeat while the first PUT is still creating the job
+// gets a retryable 409 job_id_in_use. The ID stays taken for as long as the
+// job's record or result is kept, deleted jobs included. Idempotency-Key and
+// the duplicate window do not apply: the ID already does their work.
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+)
+
+// Errors of PUT /jobs/{id}.
+const (
+	errCodeJobIDConflict = "job_id_conflict" // The ID belongs to a different job
+	errCodeJobIDInUse    = "job_id_in_use"   // A PUT of the ID is still creating its job; retry
+)
+
+// putFingerprint is the fingerprint a PUT's creation record keeps: of the
+// payload and tenant, not of the client, so a retry from another address
+// still matches.
+func putFingerprint(p Principal, req JobRequest) string {
+	return submissionFingerprint(Principal{Tenant: p.Tenant}, req)
+}
+
+// putJob handles PUT /jobs/{id} requests.
+// → 201 {"id"} for a new job, 200 {"id","replayed":true} for a repeat of it,
+// 409 job_id_conflict / job_id_in_use as above, and otherwise what POST /jobs
+// answers; 404 unless CLIENT_JOB_IDS is on.
+func (a *App) putJob(w http.ResponseWriter, r *http.Request) {
+	if !a.conf.ClientJobIDs {
+		http.Error(w, "client-supplied job IDs disabled", http.StatusNotFound)
+		return
+	}
+	jobID, ok := a.pathJobID(w, r)
+	if !ok {
+		return
+	}
+	a.submitJob(w, r, jobID)
+}
+
+// claimJobID writes rec as the pending creation record of a PUT's job unless
+// its ID is taken, and otherwise answers the PUT. It reports whether rec was
+// written.
+func (a *App) claimJobID(ctx context.Context, w http.ResponseWriter, r *http.Request, rec *JobRecord) bool {
+	rec.State, rec.UpdatedAt = createPending, Now()
+	err := a.putRecordIfAbsent(ctx, rec)
+	if err == nil {
+		// A result without a record: a job from before status tracking, or
+		// an imported one.
+		exists, err := a.objectExists(ctx, fmt.Sprintf("jobs/%s.json", rec.ID))
+		if err == nil && !exists {
+			return true
+		}
+		// Only the record is ours: the lineage keys are the existing job's.
+		if _, delErr := a.deleteKeys(context.WithoutCancel(ctx), []string{statusKey(rec.ID)}); delErr != nil {
+			slog.ErrorContext(ctx, "failed to remove creation record of a taken job ID", "job_id", rec.ID, "error", delErr)
+		}
+		if err != nil {
+			writeStorageError(ctx, w, "HeadObject", "failed to look up job", err)
+			return false
+		}
+		writeError(w, http.StatusConflict, ErrorDetail{Code: errCodeJobIDConflict, Message: fmt.Sprintf("job %s already exists", rec.ID)})
+		return false
+	}
+	if classifyS3Error(err).Status != http.StatusPreconditionFailed {
+		writeStorageError(ctx, w, "PutObject", "failed to record job", err)
+		return false
+	}
+
+	var prior JobRecord
+	if err := a.getJSON(ctx, statusKey(rec.ID), &prior); err != nil {
+		if classifyS3Error(err).Kind == s3NotFound {
+			// Removed between our put and get: another PUT's create failed.
+			writeError(w, http.StatusConflict, ErrorDetail{Code: errCodeJobIDInUse, Message: fmt.Sprintf("job %s is being created; retry", rec.ID), Retryable: true})
+			return false
+		}
+		writeStorageError(ctx, w, "GetObject", "failed to read job status", err)
+		return false
+	}
+	switch {
+	case prior.Fingerprint == "":
+		writeError(w, http.StatusConflict, ErrorDetail{Code: errCodeJobIDConflict, Message: fmt.Sprintf("job %s already exists", rec.ID)})
+	case prior.Fingerprint != rec.Fingerprint:
+		writeError(w, http.StatusConflict, ErrorDetail{Code: errCodeJobIDConflict, Message: fmt.Sprintf("job %s already exists with a different payload", rec.ID)})
+	case prior.State == createPending:
+		writeError(w, http.StatusConflict, ErrorDetail{Code: errCodeJobIDInUse, Message: fmt.Sprintf("job %s is being created; retry", rec.ID), Retryable: true})
+	default:
+		a.writeCreateResponse(w, r, http.StatusOK, CreateJobResponse{ID: rec.ID, Replayed: true})
+	}
+	return false
+}
+
+// putRecordIfAbsent writes rec unless its job has a record already, failing
+// with a 412 then.
+func (a *App) putRecordIfAbsent(ctx context.Context, rec *JobRecord) error {
+	body, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("encode %s: %w", statusKey(rec.ID), err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, awsOpTimeout)
+	defer cancel()
+	return a.store.Put(ctx, statusKey(rec.ID), body, PutOptions{ContentType: "application/json", IfNoneMatch: true})
+}
@@ -0,0 +1,275 @@
+// Job status lifecycle. The creation record (status/{id}.json, see
+// createtx.go) is written when POST /jobs accepts a job and, from then on,
+// kept current by the worker, so a job that has no result yet can be told
+// apart from one that never existed:
+//
+//	queued      accepted; waiting in (or on its way to) the queue
+//	processing  a worker is running it (attempt counts SQS deliveries;
+//	            each is kept in its history, deliveries.go)
+//	completed   the result is stored
+//	failed      the last attempt failed; the job returns to processing on
+//	            its next delivery, unless it has used MAX_ATTEMPTS (retry.go)
+//	cancelled   cancelled with DELETE /jobs/{id} before it ran (jobdelete.go)
+//	deleted     its result was deleted with DELETE /jobs/{id}
+//
+// GET /jobs/{id}/status reports the status; GET /jobs/{id} still returns the
+// result once there is one, and the status until then. The result is
+// authoritative: a stored result means completed whatever the record says,
+// which covers the record update racing a fast worker. Status writes are
+// best effort — a failed update is logged and never fails the job.
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// Job statuses reported by the API.
+const (
+	statusQueued     = "queued"
+	statusProcessing = "processing"
+	statusCompleted  = "completed"
+	statusFailed     = "failed"
+	statusCancelled  = "cancelled"
+	statusDeleted    = "deleted"
+)
+
+// JobStatus is the GET /jobs/{id}/status body, and the GET /jobs/{id} body
+// until the job completes.
+type JobStatus struct {
+	ID         string    `json:"id"`                   // Job ID
+	Status     string    `json:"status"`               // queued, processing, completed, failed, cancelled or deleted
+	CreatedAt  Timestamp `json:"created_at"`           // When the job was accepted
+	UpdatedAt  Timestamp `json:"updated_at"`           // Last status change
+	StartedAt  Timestamp `json:"started_at,omitzero"`  // When the latest attempt started
+	FinishedAt Timestamp `json:"finished_at,omitzero"` // When the latest attempt ended
+	Attempt    int       `json:"attempt,omitempty"`    // Delivery attempt of the latest run
+	Error      string    `json:"error,omitempty"`      // Failure reason, when failed
+
+	Redeliveries    int          `json:"redeliveries,omitempty"`     // Deliveries after the first: attempt less one
+	FirstReceivedAt Timestamp    `json:"first_received_at,omitzero"` // When a worker first received the job
+	Attempts        []JobAttempt `json:"attempts,omitempty"`         // The latest attempts, oldest first
+}
+
+// publicStatus maps a record state to the status the API reports.
+func publicStatus(state string) string {
+	switch state {
+	case createProcessing:
+		return statusProcessing
+	case createCompleted:
+		return statusCompleted
+	case createFailed:
+		return statusFailed
+	case createCancelled:
+		return statusCancelled
+	case createDeleted:
+		return statusDeleted
+	}
+	// pending, queued and buffered are all waiting to run.
+	return statusQueued
+}
+
+// newJobStatus returns rec as the API reports it.
+func newJobStatus(rec JobRecord) JobStatus {
+	return JobStatus{
+		ID:         rec.ID,
+		Status:     publicStatus(rec.State),
+		CreatedAt:  rec.CreatedAt,
+		UpdatedAt:  rec.UpdatedAt,
+		StartedAt:  rec.StartedAt,
+		FinishedAt: rec.FinishedAt,
+		Attempt:    rec.Attempt,
+		Error:      rec.Error,
+
+		Redeliveries:    max(rec.Attempt-1, 0),
+		FirstReceivedAt: rec.FirstReceivedAt,
+		Attempts:        rec.Attempts,
+	}
+}
+
+// loadJobStatus reads jobID's status. It returns errJobNotFound when there is
+// no record, and otherwise the S3 error. A record not yet completed is
+// checked against the result, which wins.
+func (a *App) loadJobStatus(ctx context.Context, jobID string) (JobStatus, error) {
+	var rec JobRecord
+	if err := a.getJSON(ctx, statusKey(jobID), &rec); err != nil {
+		if classifyS3Error(err).Kind == s3NotFound {
+			return JobStatus{}, errJobNotFound
+		}
+		return JobStatus{}, err
+	}
+	rec.ID = jobID
+	status := newJobStatus(rec)
+	if status.Status != statusCompleted && status.Status != statusDeleted {
+		done, err := a.objectExists(ctx, fmt.Sprintf("jobs/%s.json", jobID))
+		if err != nil {
+			return JobStatus{}, err
+		}
+		if done {
+			status.Status, status.Error = statusCompleted, ""
+		}
+	}
+	return status, nil
+}
+
+// getJobStatus handles GET /jobs/{id}/status requests.
+// → 200 JobStatus; 404 when the job never existed (or its record has been
+// cleaned up); S3 failures return the usual storage errors. With
+// ?redirect=true it is the status monitor of an asynchronous create
+// (asyncjobs.go): 303 to the result once completed, 303 to the plain status
+// once final otherwise, and Retry-After until then.
+func (a *App) getJobStatus(w http.ResponseWriter, r *http.Request) {
+	jobID, ok := a.pathJobID(w, r)
+	if !ok {
+		return
+	}
+	status, err := a.loadJobStatus(r.Context(), jobID)
+	switch {
+	case errors.Is(err, errJobNotFound):
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	case err != nil:
+		writeStorageError(r.Context(), w, "GetObject", "failed to read job status", err)
+		return
+	}
+	if redirect, _ := strconv.ParseBool(r.URL.Query().Get("redirect")); redirect {
+		a.writeJobMonitor(w, status)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// writePendingJob answers GET /jobs/{id} for a job without a result: 202 with
+// its status while it is queued or processing, 200 with the status once it
+// has failed or been cancelled, 410 once it has completed and its result has
+// been purged or deleted, and 404 when there is no record either.
+func (a *App) writePendingJob(w http.ResponseWriter, r *http.Request, jobID string) {
+	var rec JobRecord
+	if err := a.getJSON(r.Context(), statusKey(jobID), &rec); err != nil {
+		if classifyS3Error(err).Kind == s3NotFound {
+			http.Error(w, "job not found", http.StatusNotFound)
+			return
+		}
+		writeStorageError(r.Context(), w, "GetObject", "failed to read job status", err)
+		return
+	}
+	rec.ID = jobID
+	status := newJobStatus(rec)
+	switch status.Status {
+	case statusFailed, statusCancelled:
+		writeJSON(w, http.StatusOK, status)
+	case statusDeleted:
+		writeJSON(w, http.StatusGone, status)
+	case statusCompleted:
+		// Completed, but the result has since been removed (retention.go).
+		writePurgedJob(w, status)
+	default:
+		writeJSON(w, http.StatusAccepted, status)
+	}
+}
+
+// errJobFinished is returned by processMessage for a duplicate delivery: the
+// job already has its result, or was deleted. The worker deletes the message
+// without storing anything.
+var errJobFinished = errors.New("job already finished")
+
+// recordUpdateTries bounds the rounds markProcessing and markFinished make
+// against concurrent updates of a record.
+const recordUpdateTries = 3
+
+// markProcessing records that an attempt at msg's job, on a delivery of
+// message, has started and returns the record for markFinished; its Attempt
+// is the attempt's number (JobRecord.nextAttempt). It returns nil when the
+// record could not be read: the status is then left alone rather than
+// overwritten, and the attempt is the receive count. It returns
+// errJobCancelled for a job cancelled with DELETE /jobs/{id}, and
+// errJobFinished for one already completed or deleted; the record is updated
+// only if neither has changed it since it was read.
+func (a *App) markProcessing(ctx context.Context, msg JobMessage, message types.Message) (*JobRecord, error) {
+	messageID := aws.ToString(message.MessageId)
+	var rec JobRecord
+	var err error
+	for range recordUpdateTries {
+		var etag string
+		rec, etag, err = a.getJobRecord(ctx, msg.ID)
+		if err != nil {
+			if classifyS3Error(err).Kind != s3NotFound {
+				slog.WarnContext(ctx, "failed to read job record, not tracking status", "job_id", msg.ID, "error", err)
+				return nil, nil
+			}
+			// Jobs from before status tracking have no record.
+			rec = JobRecord{Tenant: msg.Tenant, Type: msg.Type, CreatedAt: msg.CreatedAt}
+		}
+		if err := rec.settled(); err != nil {
+			return nil, err
+		}
+		attempt := rec.nextAttempt(messageID)
+		rec.ID, rec.Attempt, rec.StartedAt, rec.Error = msg.ID, attempt, Now(), ""
+		rec.FinishedAt = Timestamp{}
+		rec.startAttempt(messageID, attempt, firstReceiveTime(message), rec.StartedAt)
+		if etag == "" {
+			err = a.putJobRecord(ctx, &rec, createProcessing)
+		} else {
+			err = a.putJobRecordIf(ctx, &rec, createProcessing, etag)
+		}
+		// On a 412 it changed since it was read: cancelled, or a duplicate
+		// delivery started or finished. Decide again on the current record.
+		if err == nil || classifyS3Error(err).Status != http.StatusPreconditionFailed {
+			break
+		}
+	}
+	if err != nil {
+		slog.WarnContext(ctx, "failed to update job record", "job_id", msg.ID, "state", createProcessing, "error", err)
+	}
+	return &rec, nil
+}
+
+// settled returns the error a new attempt at rec's job stops with:
+// errJobCancelled or errJobFinished, or nil when the job is still to run.
+func (rec JobRecord) settled() error {
+	switch rec.State {
+	case createCancelled:
+		return errJobCancelled
+	case createCompleted, createDeleted:
+		return errJobFinished
+	}
+	return nil
+}
+
+// markFinished records the outcome of the attempt markProcessing started as
+// run. Another delivery of the job may have changed the record since, so the
+// outcome is merged into the current record (JobRecord.finishAttempt), which
+// is written only if it is still current.
+func (a *App) markFinished(ctx context.Context, run *JobRecord, jobErr error) {
+	ctx = context.WithoutCancel(ctx)
+	var err error
+	for range recordUpdateTries {
+		rec, etag, getErr := a.getJobRecord(ctx, run.ID)
+		if getErr != nil {
+			if classifyS3Error(getErr).Kind != s3NotFound {
+				err = getErr
+				break
+			}
+			rec, etag = *run, "" // Its markProcessing write failed
+		}
+		state := rec.finishAttempt(*run, jobErr, Now())
+		if etag == "" {
+			err = a.putJobRecord(ctx, &rec, state)
+		} else {
+			err = a.putJobRecordIf(ctx, &rec, state, etag)
+		}
+		if err == nil || classifyS3Error(err).Status != http.StatusPreconditionFailed {
+			break
+		}
+	}
+	if err != nil {
+		slog.WarnContext(ctx, "failed to update job record", "job_id", run.ID, "error", err)
+	}
+}
@@ -0,0 +1,312 @@
+// Job type discovery. GET /job-types lists every registered processor with
+// what a client needs to submit one: JSON Schemas of the POST /jobs body and
+// of the stored result, the defaults that apply to its jobs (JOB_TIMEOUT,
+// MAX_ATTEMPTS, and the result retention from the bucket's lifecycle rules
+// on jobs/), and example requests with the output they produce.
+//
+// The catalog is generated from the processor registry. A processor
+// documents itself by implementing Describer, e.g. by registering a
+// DescribedProcessor; one that does not is still listed, without a
+// description or examples. Example outputs are produced by running the
+// processor on the example text once, in a dry-run JobContext.
+package service
+
+import (
+	"context"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// retentionCacheTTL is how long the bucket's lifecycle rules are cached.
+const retentionCacheTTL = 10 * time.Minute
+
+// JobTypeSpec documents a job type.
+type JobTypeSpec struct {
+	Description string   // What the processor does
+	Input       string   // What the text is expected to be
+	Output      string   // What the output is
+	Artifacts   []string // Names of the artifacts it attaches
+	Examples    []string // Example texts; their outputs are generated
+
+	// Secrets the processor needs, by name: Secrets Manager ARNs whose
+	// values it reads with jc.Secret(name) (secrets.go).
+	Secrets map[string]string
+}
+
+// Describer is implemented by processors that document their job type.
+type Describer interface {
+	Describe() JobTypeSpec
+}
+
+// DescribedProcessor is a Processor with its JobTypeSpec.
+type DescribedProcessor struct {
+	Processor
+	Spec JobTypeSpec
+}
+
+// Describe returns d.Spec.
+func (d DescribedProcessor) Describe() JobTypeSpec {
+	return d.Spec
+}
+
+// JobType is one entry of the GET /job-types response.
+type JobType struct {
+	Type         string           `json:"type"`               // Value of JobRequest.Type
+	Default      bool             `json:"default"`            // Used when a submission names no type
+	Description  string           `json:"description"`        // What the processor does
+	Enabled      bool             `json:"enabled"`            // False while disabled by an operator (jobflags.go)
+	Disabled     *DisabledJobType `json:"disabled,omitempty"` // Why, while disabled
+	InputSchema  map[string]any   `json:"input_schema"`       // JSON Schema of the POST /jobs body
+	OutputSchema map[string]any   `json:"output_schema"`      // JSON Schema of the GET /jobs/{id} result
+	Defaults     JobTypeDefaults  `json:"defaults"`           // Options that apply to its jobs
+	Examples     []JobTypeExample `json:"examples"`           // Example submissions and their outputs
+	Secrets      []string         `json:"secrets,omitempty"`  // Names of the secrets it is given (not their values)
+}
+
+// JobTypeDefaults are the options a job of a type runs with.
+type JobTypeDefaults struct {
+	TimeoutSeconds float64          `json:"timeout_seconds"` // Deadline of one processing attempt
+	MaxAttempts    int              `json:"max_attempts"`    // Deliveries before giving up; 0 retries forever
+	Retention      *ResultRetention `json:"retention"`       // Result lifecycle; null when it cannot be read
+}
+
+// ResultRetention is the bucket lifecycle that applies to results. A null
+// field means results are never archived or deleted.
+type ResultRetention struct {
+	ArchiveAfterDays *int32 `json:"archive_after_days"` // Moved to an archive storage class (retention.go)
+	ExpireAfterDays  *int32 `json:"expire_after_days"`  // Deleted
+}
+
+// JobTypeExample is an example submission and what it produces.
+type JobTypeExample struct {
+	Request   JobRequest `json:"request"`         // POST /jobs body
+	Output    string     `json:"output"`          // Result output
+	Artifacts []string   `json:"artifacts"`       // Names of attached artifacts
+	Error     string     `json:"error,omitempty"` // Processor error on the example
+}
+
+// JobTypesResponse is the GET /job-types response body.
+type JobTypesResponse struct {
+	Types []JobType `json:"types"`
+}
+
+// jobTypeCatalog caches what GET /job-types reports.
+type jobTypeCatalog struct {
+	once  sync.Once
+	types []JobType // Everything but the defaults, which are filled per request
+
+	mu          sync.Mutex
+	retention   *ResultRetention
+	retentionAt time.Time // When retention was read; zero before the first read
+}
+
+// builtinSpecs document the built-in processors.
+var builtinSpecs = map[string]JobTypeSpec{
+	"uppercase": {
+		Description: "Converts the text to upper case.",
+		Input:       "Any UTF-8 text.",
+		Output:      "The text in upper case.",
+		Artifacts:   []string{summaryArtifactName},
+		Examples:    []string{"hello world"},
+	},
+	"lowercase": {
+		Description: "Converts the text to lower case.",
+		Input:       "Any UTF-8 text.",
+		Output:      "The text in lower case.",
+		Artifacts:   []string{summaryArtifactName},
+		Examples:    []string{"Hello World"},
+	},
+	"wordcount": {
+		Description: "Counts the whitespace-separated words in the text.",
+		Input:       "Any UTF-8 text.",
+		Output:      "The number of words, in decimal.",
+		Artifacts:   []string{summaryArtifactName},
+		Examples:    []string{"the quick brown fox"},
+	},
+}
+
+// describeProcessor returns the spec of the processor registered as typ.
+func describeProcessor(typ string, p Processor) JobTypeSpec {
+	if d, ok := p.(Describer); ok {
+		return d.Describe()
+	}
+	return builtinSpecs[typ]
+}
+
+// jobInputSchema returns the JSON Schema of a POST /jobs body for typ.
+func jobInputSchema(typ string, spec JobTypeSpec) map[string]any {
+	required := []string{"text"}
+	if typ != defaultProcessorType {
+		required = append(required, "type")
+	}
+	return map[string]any{
+		"$schema":  "https://json-schema.org/draft/2020-12/schema",
+		"type":     "object",
+		"required": required,
+		"properties": map[string]any{
+			"text":      map[string]any{"type": "string", "description": spec.Input},
+			"type":      map[string]any{"const": typ},
+			"parent_id": map[string]any{"type": "string", "description": "Parent job for lineage tracking"},
+			"relation":  map[string]any{"enum": slices.Sorted(maps.Keys(validRelations)), "default": relationChain},
+		},
+		"additionalProperties": false,
+	}
+}
+
+// jobOutputSchema returns the JSON Schema of a GET /jobs/{id} result for typ.
+func jobOutputSchema(typ string, spec JobTypeSpec) map[string]any {
+	artifacts := map[string]any{"type": "string"}
+	if len(spec.Artifacts) > 0 {
+		artifacts = map[string]any{"enum": spec.Artifacts}
+	}
+	timestamp := map[string]any{"type": []string{"string", "null"}, "format": "date-time"}
+	return map[string]any{
+		"$schema":  "https://json-schema.org/draft/2020-12/schema",
+		"type":     "object",
+		"required": []string{"id", "text", "output", "processed_at", "status"},
+		"properties": map[string]any{
+			"id":           map[string]any{"type": "string"},
+			"type":         map[string]any{"const": typ},
+			"text":         map[string]any{"type": "string"},
+			"output":       map[string]any{"type": "string", "description": spec.Output},
+			"artifacts":    map[string]any{"type": "array", "items": artifacts},
+			"created_at":   timestamp,
+			"processed_at": timestamp,
+			"status":       map[string]any{"const": "completed"},
+		},
+	}
+}
+
+// buildJobTypes generates the catalog from the processor registry, running
+// each example through its processor.
+func buildJobTypes(ctx context.Context) []JobType {
+	var types []JobType
+	for _, typ := range processorTypes() {
+		p := processors[typ]
+		spec := describeProcessor(typ, p)
+		jt := JobType{
+			Type:         typ,
+			Default:      typ == defaultProcessorType,
+			Description:  spec.Description,
+			InputSchema:  jobInputSchema(typ, spec),
+			OutputSchema: jobOutputSchema(typ, spec),
+			Examples:     make([]JobTypeExample, 0, len(spec.Examples)),
+			Secrets:      slices.Sorted(maps.Keys(spec.Secrets)),
+		}
+		for _, text := range spec.Examples {
+			jc, cancel := newDryRunContext(ctx, "")
+			output, artifacts, err := p.Process(jc, text)
+			cancel()
+			ex := JobTypeExample{Request: JobRequest{Text: text, Type: typ}, Output: output, Artifacts: make([]string, 0, len(artifacts))}
+			if err != nil {
+				ex.Error = err.Error()
+			}
+			for _, art := range artifacts {
+				ex.Artifacts = append(ex.Artifacts, art.Name)
+			}
+			jt.Examples = append(jt.Examples, ex)
+		}
+		types = append(types, jt)
+	}
+	return types
+}
+
+// resultRetention returns the lifecycle that applies to results, read from
+// the bucket at most every retentionCacheTTL. It returns nil when the rules
+// cannot be read. Outside S3 results are kept forever.
+func (a *App) resultRetention(ctx context.Context) *ResultRetention {
+	if !a.onS3() {
+		return &ResultRetention{}
+	}
+	c := &a.jobTypes
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.retentionAt.IsZero() && time.Since(c.retentionAt) < retentionCacheTTL {
+		return c.retention
+	}
+	ctx, cancel := context.WithTimeout(ctx, awsOpTimeout)
+	defer cancel()
+	out, err := a.s3Client.GetBucketLifecycleConfiguration(ctx, &s3.GetBucketLifecycleConfigurationInput{Bucket: aws.String(a.s3Bucket)})
+	switch {
+	case err != nil && classifyS3Error(err).Code == "NoSuchLifecycleConfiguration":
+		c.retention = &ResultRetention{}
+	case err != nil:
+		slog.WarnContext(ctx, "failed to read bucket lifecycle rules", "error", err)
+		c.retention = nil
+	default:
+		c.retention = lifecycleRetention(out.Rules, "jobs/x.json")
+	}
+	c.retentionAt = time.Now()
+	return c.retention
+}
+
+// lifecycleRetention returns the earliest archive transition and expiration
+// among the enabled rules that apply to every object like key. Rules
+// filtered on tags or object size apply only to some results and are
+// ignored.
+func lifecycleRetention(rules []s3types.LifecycleRule, key string) *ResultRetention {
+	ret := &ResultRetention{}
+	earliest := func(cur *int32, days *int32) *int32 {
+		if days == nil || (cur != nil && *cur <= *days) {
+			return cur
+		}
+		return days
+	}
+	for _, rule := range rules {
+		if rule.Status != s3types.ExpirationStatusEnabled {
+			continue
+		}
+		prefix := aws.ToString(rule.Prefix) // Rules written before filters existed
+		if f := rule.Filter; f != nil {
+			if f.Tag != nil || f.And != nil || f.ObjectSizeGreaterThan != nil || f.ObjectSizeLessThan != nil {
+				continue
+			}
+			prefix = aws.ToString(f.Prefix)
+		}
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if rule.Expiration != nil {
+			ret.ExpireAfterDays = earliest(ret.ExpireAfterDays, rule.Expiration.Days)
+		}
+		for _, t := range rule.Transitions {
+			switch t.StorageClass {
+			case s3types.TransitionStorageClassGlacier, s3types.TransitionStorageClassDeepArchive:
+				ret.ArchiveAfterDays = earliest(ret.ArchiveAfterDays, t.Days)
+			}
+		}
+	}
+	return ret
+}
+
+// listJobTypes handles GET /job-types requests.
+// Lists the registered job types → 200 JobTypesResponse, sorted by type.
+func (a *App) listJobTypes(w http.ResponseWriter, r *http.Request) {
+	c := &a.jobTypes
+	c.once.Do(func() { c.types = buildJobTypes(context.WithoutCancel(r.Context())) })
+
+	defaults := JobTypeDefaults{
+		TimeoutSeconds: a.jobTimeout.Seconds(),
+		MaxAttempts:    a.retries.maxAttempts,
+		Retention:      a.resultRetention(r.Context()),
+	}
+	resp := JobTypesResponse{Types: make([]JobType, 0, len(c.types))}
+	for _, jt := range c.types {
+		jt.Defaults = defaults
+		jt.Enabled = true
+		if d, off := a.typeFlags.disabled(jt.Type); off {
+			jt.Enabled, jt.Disabled = false, &d
+		}
+		resp.Types = append(resp.Types, jt)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
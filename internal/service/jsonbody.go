@@ -0,0 +1,167 @@
+// Hardened decoding of JSON request bodies. Every JSON body (POST /jobs and
+// the other endpoints that take JSON) goes through a jsonDecoder, which
+//
+//   - accepts exactly one document: anything but whitespace after it is
+//     rejected rather than silently ignored;
+//   - refuses nesting deeper than JSON_MAX_DEPTH before decoding anything;
+//   - with JSON_STRICT=true, rejects fields the endpoint does not define
+//     (a misspelt "txet" fails instead of being dropped); job submissions
+//     always do;
+//   - reports errors with their line and column and, where known, the field,
+//     so a client can find the mistake: `invalid JSON at line 3, column 12:
+//     field "parent_id" must be a string, not number`.
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"unicode/utf8"
+)
+
+// jsonDecoder decodes request bodies under the configured limits.
+type jsonDecoder struct {
+	strict   bool // Reject fields the target type does not define
+	maxDepth int  // Deepest object/array nesting accepted
+}
+
+// newJSONDecoder returns the decoder configured by JSON_STRICT and
+// JSON_MAX_DEPTH.
+func newJSONDecoder() jsonDecoder {
+	return jsonDecoder{
+		strict:   getenv("JSON_STRICT") == "true",
+		maxDepth: max(envInt("JSON_MAX_DEPTH", 32), 1),
+	}
+}
+
+// decode decodes body, a complete request body, into v. Errors are meant for
+// the client.
+func (d jsonDecoder) decode(body []byte, v any) error {
+	if off, ok := jsonDepthExceeds(body, d.maxDepth); ok {
+		return fmt.Errorf("invalid JSON at %s: nesting deeper than %d levels", jsonPosition(body, off), d.maxDepth)
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	if d.strict {
+		dec.DisallowUnknownFields()
+	}
+	if err := dec.Decode(v); err != nil {
+		return describeJSONError(body, err)
+	}
+	if rest := bytes.TrimLeft(body[dec.InputOffset():], " \t\r\n"); len(rest) > 0 {
+		return fmt.Errorf("invalid JSON at %s: unexpected data after the document", jsonPosition(body, int64(len(body)-len(rest))))
+	}
+	return nil
+}
+
+// describeJSONError turns a decoding error into a client-facing message with
+// the position of the problem.
+func describeJSONError(body []byte, err error) error {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.Is(err, io.EOF):
+		return errors.New("invalid JSON: request body is empty")
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return fmt.Errorf("invalid JSON at %s: document ends unexpectedly", jsonPosition(body, int64(len(body))))
+	case errors.As(err, &syntaxErr):
+		return fmt.Errorf("invalid JSON at %s: %s", jsonPosition(body, syntaxErr.Offset), syntaxErr.Error())
+	case errors.As(err, &typeErr):
+		what := "a value of this type"
+		if typeErr.Field != "" {
+			what = fmt.Sprintf("field %q", typeErr.Field)
+		}
+		// Offset is just past the offending value.
+		return fmt.Errorf("invalid JSON at %s: %s must be %s, not %s",
+			jsonPosition(body, typeErr.Offset), what, jsonKind(typeErr.Type), typeErr.Value)
+	}
+	// DisallowUnknownFields reports no position; find the key instead.
+	if name, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		if off := jsonKeyOffset(body, name); off >= 0 {
+			return fmt.Errorf("invalid JSON at %s: unknown field %s", jsonPosition(body, off), name)
+		}
+		return fmt.Errorf("invalid JSON: unknown field %s", name)
+	}
+	// A field's own UnmarshalJSON (timestamps, enums) rejected its value.
+	return fmt.Errorf("invalid JSON: %s", strings.TrimPrefix(err.Error(), "json: "))
+}
+
+// jsonDepthExceeds reports whether data nests objects and arrays deeper than
+// limit, and the offset where it first does. It only tracks strings and
+// brackets, so it runs in one pass before any decoding work.
+func jsonDepthExceeds(data []byte, limit int) (int64, bool) {
+	depth, inString, escaped := 0, false, false
+	for i, c := range data {
+		switch {
+		case inString:
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				inString = false
+			}
+		case c == '"':
+			inString = true
+		case c == '{' || c == '[':
+			if depth++; depth > limit {
+				return int64(i), true
+			}
+		case c == '}' || c == ']':
+			depth--
+		}
+	}
+	return 0, false
+}
+
+// jsonKeyOffset returns the offset of the first object key quotedName (with
+// its quotes) in data, or -1.
+func jsonKeyOffset(data []byte, quotedName string) int64 {
+	for from := 0; ; {
+		i := bytes.Index(data[from:], []byte(quotedName))
+		if i < 0 {
+			return -1
+		}
+		at := from + i
+		from = at + len(quotedName)
+		if rest := bytes.TrimLeft(data[from:], " \t\r\n"); len(rest) > 0 && rest[0] == ':' {
+			return int64(at)
+		}
+	}
+}
+
+// jsonPosition renders a byte offset in data as "line L, column C", both
+// 1-based, counting columns in characters.
+func jsonPosition(data []byte, offset int64) string {
+	offset = min(max(offset, 0), int64(len(data)))
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	col := utf8.RuneCount(before[bytes.LastIndexByte(before, '\n')+1:]) + 1
+	return fmt.Sprintf("line %d, column %d", line, col)
+}
+
+// jsonKind names the JSON type expected for a Go type.
+func jsonKind(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "a base64 string"
+		}
+		return "an array"
+	case reflect.Struct, reflect.Map:
+		return "an object"
+	}
+	return "a " + t.String()
+}
@@ -0,0 +1,210 @@
+// Job lineage: parent/child relationships between jobs (retries, chained jobs,
+// replays, workflow steps). A job submitted with parent_id gets two small S3
+// objects — its own node at lineage/{id}.json and a child marker at
+// lineage/{parent}/children/{id}.json — so GET /jobs/{id}/lineage can walk
+// ancestors by following parent links and descendants by listing markers.
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Lineage relations a job can have to its parent.
+const (
+	relationRetry    = "retry"    // re-run of a failed parent
+	relationChain    = "chain"    // consumes the parent's output
+	relationReplay   = "replay"   // re-run of a parent for comparison/backfill
+	relationWorkflow = "workflow" // step of a workflow rooted at the parent
+)
+
+// validRelations is the set accepted in JobRequest.Relation.
+var validRelations = map[string]bool{
+	relationRetry: true, relationChain: true, relationReplay: true, relationWorkflow: true,
+}
+
+const (
+	// lineageMaxDepth bounds the ancestor walk and the descendant BFS depth.
+	lineageMaxDepth = 32
+	// lineageMaxNodes bounds the number of descendants returned.
+	lineageMaxNodes = 500
+)
+
+// LineageNode is one job in a lineage graph.
+type LineageNode struct {
+	ID        string    `json:"id"`                  // Job ID
+	ParentID  string    `json:"parent_id,omitempty"` // Parent job ID; empty for a root
+	Relation  string    `json:"relation,omitempty"`  // Relation to the parent
+	CreatedAt Timestamp `json:"created_at"`          // When the job was submitted
+	Depth     int       `json:"depth"`               // Distance from the requested job (ancestors negative)
+}
+
+// LineageResponse is the GET /jobs/{id}/lineage response body.
+type LineageResponse struct {
+	ID          string        `json:"id"`          // Requested job ID
+	Ancestors   []LineageNode `json:"ancestors"`   // Parent first, root last
+	Descendants []LineageNode `json:"descendants"` // Breadth-first, nearest first
+	Truncated   bool          `json:"truncated"`   // Depth or node limit was hit
+}
+
+// lineageNodeKey is the S3 key of a job's lineage node.
+func lineageNodeKey(id string) string { return fmt.Sprintf("lineage/%s.json", id) }
+
+// lineageChildrenPrefix is the S3 prefix under which a job's child markers live.
+func lineageChildrenPrefix(id string) string { return fmt.Sprintf("lineage/%s/children/", id) }
+
+// validateLineage checks and normalises the lineage fields of req, defaulting
+// the relation to "chain" when only a parent is given.
+func validateLineage(req *JobRequest, ids jobIDScheme) *FieldError {
+	if req.ParentID == "" {
+		if req.Relation != "" {
+			return &FieldError{Field: "relation", Message: "relation requires parent_id"}
+		}
+		return nil
+	}
+	parent, err := ids.canonical(req.ParentID)
+	if err != nil {
+		return &FieldError{Field: "parent_id", Message: "parent_id " + err.Error()}
+	}
+	req.ParentID = parent
+	if req.Relation == "" {
+		req.Relation = relationChain
+	}
+	if !validRelations[req.Relation] {
+		return &FieldError{Field: "relation", Message: fmt.Sprintf("relation must be one of %s, %s, %s, %s",
+			relationRetry, relationChain, relationReplay, relationWorkflow)}
+	}
+	return nil
+}
+
+// recordLineage writes the node and parent's child marker for a new job.
+func (a *App) recordLineage(ctx context.Context, node LineageNode) error {
+	body, err := json.Marshal(node)
+	if err != nil {
+		return fmt.Errorf("marshal lineage node: %w", err)
+	}
+	for _, key := range []string{lineageNodeKey(node.ID), lineageChildrenPrefix(node.ParentID) + node.ID + ".json"} {
+		if err := a.store.Put(ctx, key, body, PutOptions{ContentType: "application/json"}); err != nil {
+			return fmt.Errorf("put lineage %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// loadLineageNode reads a job's lineage node. A job submitted without a parent
+// has no node; it is returned as a bare root (found=false).
+func (a *App) loadLineageNode(ctx context.Context, id string) (node LineageNode, found bool, err error) {
+	body, _, err := a.store.Get(ctx, lineageNodeKey(id))
+	if err != nil {
+		if classifyS3Error(err).Kind == s3NotFound {
+			return LineageNode{ID: id}, false, nil
+		}
+		return LineageNode{}, false, err
+	}
+	defer body.Close()
+	if err := json.NewDecoder(body).Decode(&node); err != nil {
+		return LineageNode{}, false, fmt.Errorf("decode lineage node %s: %w", id, err)
+	}
+	return node, true, nil
+}
+
+// childIDs lists the IDs of a job's direct children.
+func (a *App) childIDs(ctx context.Context, id string) ([]string, error) {
+	var ids []string
+	for obj, err := range a.store.List(ctx, lineageChildrenPrefix(id), ListOptions{}) {
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, strings.TrimSuffix(path.Base(obj.Key), ".json"))
+	}
+	return ids, nil
+}
+
+// getLineage handles GET /jobs/{id}/lineage requests.
+// Returns the job's ancestors (following parent links to the root) and its
+// descendants (breadth-first), bounded by lineageMaxDepth and lineageMaxNodes.
+func (a *App) getLineage(w http.ResponseWriter, r *http.Request) {
+	jobID, ok := a.pathJobID(w, r)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), awsOpTimeout)
+	defer cancel()
+
+	resp, err := a.buildLineage(ctx, jobID)
+	if err != nil {
+		f := classifyS3Error(err)
+		recordS3Error(ctx, "Lineage", f)
+		slog.ErrorContext(ctx, "failed to build lineage", append([]any{"job_id", jobID, "error", err}, f.logAttrs()...)...)
+		status, code, retryable := f.response()
+		writeError(w, status, ErrorDetail{Code: code, Message: "failed to read lineage", Retryable: retryable})
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// buildLineage assembles the lineage graph around jobID.
+func (a *App) buildLineage(ctx context.Context, jobID string) (LineageResponse, error) {
+	resp := LineageResponse{ID: jobID, Ancestors: []LineageNode{}, Descendants: []LineageNode{}}
+
+	// Ancestors: follow parent links, guarding against cycles.
+	self, _, err := a.loadLineageNode(ctx, jobID)
+	if err != nil {
+		return resp, err
+	}
+	visited := map[string]bool{jobID: true}
+	for parent, depth := self.ParentID, -1; parent != ""; depth-- {
+		if depth < -lineageMaxDepth || visited[parent] {
+			resp.Truncated = true
+			break
+		}
+		visited[parent] = true
+		node, _, err := a.loadLineageNode(ctx, parent)
+		if err != nil {
+			return resp, err
+		}
+		node.Depth = depth
+		resp.Ancestors = append(resp.Ancestors, node)
+		parent = node.ParentID
+	}
+
+	// Descendants: breadth-first over child markers.
+	frontier := []string{jobID}
+	for depth := 1; len(frontier) > 0; depth++ {
+		if depth > lineageMaxDepth {
+			resp.Truncated = true
+			break
+		}
+		var next []string
+		for _, id := range frontier {
+			children, err := a.childIDs(ctx, id)
+			if err != nil {
+				return resp, err
+			}
+			for _, child := range children {
+				if visited[child] {
+					continue
+				}
+				if len(resp.Descendants) >= lineageMaxNodes {
+					resp.Truncated = true
+					return resp, nil
+				}
+				visited[child] = true
+				node, _, err := a.loadLineageNode(ctx, child)
+				if err != nil {
+					return resp, err
+				}
+				node.Depth = depth
+				resp.Descendants = append(resp.Descendants, node)
+				next = append(next, child)
+			}
+		}
+		frontier = next
+	}
+	return resp, nil
+}
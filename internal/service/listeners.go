@@ -0,0 +1,186 @@
+// Listener configuration. LISTEN_ADDRS is a comma-separated list of
+// listeners the HTTP server serves on, all with the same routes:
+//
+//	:8080                                       all interfaces, IPv4 and IPv6 (default)
+//	tcp4://0.0.0.0:8080, tcp6://[::1]:8080      one address family only
+//	unix:///run/app/app.sock?mode=0660          Unix domain socket, e.g. for a sidecar proxy
+//	tcp://:8443?cert=/tls/tls.crt&key=/tls/tls.key&min_tls=1.3&client_ca=/tls/ca.pem
+//	systemd://https?cert=/tls/tls.crt&key=/tls/tls.key   socket passed by systemd (systemd.go)
+//
+// A bare host:port means tcp://. The query options are per listener: cert
+// and key turn on TLS (HTTP/2 is negotiated over it), min_tls sets its
+// minimum version (1.2 or 1.3, default 1.2), and client_ca requires client
+// certificates signed by that CA. mode sets a Unix socket's permissions;
+// a stale socket file left by a crash is removed before listening.
+package service
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// defaultListenAddr is used when LISTEN_ADDRS is unset.
+const defaultListenAddr = ":8080"
+
+// listenerSpec is one parsed LISTEN_ADDRS entry.
+type listenerSpec struct {
+	network string      // tcp, tcp4, tcp6, unix or systemd
+	address string      // host:port, the socket path for unix, or the FileDescriptorName for systemd
+	tls     *tls.Config // nil for plaintext
+	mode    os.FileMode // Unix socket permissions; 0 keeps the umask default
+}
+
+// String renders the listener for logs.
+func (l listenerSpec) String() string {
+	return l.network + "://" + l.address
+}
+
+// parseListenAddrs parses a LISTEN_ADDRS value.
+func parseListenAddrs(v string) ([]listenerSpec, error) {
+	var specs []listenerSpec
+	for _, entry := range strings.Split(v, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		spec, err := parseListener(entry)
+		if err != nil {
+			return nil, fmt.Errorf("listener %q: %w", entry, err)
+		}
+		specs = append(specs, spec)
+	}
+	if len(specs) == 0 {
+		return nil, errors.New("no listeners configured")
+	}
+	return specs, nil
+}
+
+// parseListener parses one listener entry.
+func parseListener(entry string) (listenerSpec, error) {
+	if !strings.Contains(entry, "://") {
+		entry = "tcp://" + entry
+	}
+	u, err := url.Parse(entry)
+	if err != nil {
+		return listenerSpec{}, err
+	}
+	spec := listenerSpec{network: u.Scheme}
+	switch u.Scheme {
+	case "tcp", "tcp4", "tcp6":
+		spec.address = u.Host
+		if _, _, err := net.SplitHostPort(spec.address); err != nil {
+			return listenerSpec{}, err
+		}
+	case "unix":
+		spec.address = u.Path
+		if spec.address == "" {
+			return listenerSpec{}, errors.New("unix listener needs a socket path")
+		}
+	case "systemd":
+		spec.address = u.Host
+		if spec.address == "" {
+			return listenerSpec{}, errors.New("systemd listener needs a FileDescriptorName")
+		}
+	default:
+		return listenerSpec{}, fmt.Errorf("unsupported scheme %q (want tcp, tcp4, tcp6, unix or systemd)", u.Scheme)
+	}
+
+	q := u.Query()
+	if m := q.Get("mode"); m != "" {
+		mode, err := strconv.ParseUint(m, 8, 32)
+		if err != nil || spec.network != "unix" {
+			return listenerSpec{}, errors.New("mode must be an octal permission on a unix listener")
+		}
+		spec.mode = os.FileMode(mode)
+	}
+	cert, key := q.Get("cert"), q.Get("key")
+	if cert == "" && key == "" {
+		if q.Has("min_tls") || q.Has("client_ca") {
+			return listenerSpec{}, errors.New("min_tls and client_ca need cert and key")
+		}
+		return spec, nil
+	}
+	spec.tls, err = listenerTLSConfig(cert, key, q.Get("min_tls"), q.Get("client_ca"))
+	return spec, err
+}
+
+// listenerTLSConfig builds a listener's server TLS configuration.
+func listenerTLSConfig(certFile, keyFile, minVersion, clientCA string) (*tls.Config, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("cert and key must be set together")
+	}
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load certificate: %w", err)
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{pair},
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+	if minVersion != "" {
+		version, ok := tlsVersions[minVersion]
+		if !ok {
+			return nil, fmt.Errorf("min_tls must be 1.2 or 1.3, got %q", minVersion)
+		}
+		cfg.MinVersion = version
+	}
+	if clientCA != "" {
+		pem, err := os.ReadFile(clientCA)
+		if err != nil {
+			return nil, fmt.Errorf("read client_ca: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("client_ca %s contains no PEM certificates", clientCA)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// listen opens the listener. A systemd listener takes every socket activated
+// under its name out of activated instead.
+func (l listenerSpec) listen(activated map[string][]net.Listener) ([]net.Listener, error) {
+	if l.network == "systemd" {
+		lns := activated[l.address]
+		if len(lns) == 0 {
+			return nil, fmt.Errorf("no socket named %q was passed by systemd", l.address)
+		}
+		delete(activated, l.address)
+		if l.tls != nil {
+			for i := range lns {
+				lns[i] = tls.NewListener(lns[i], l.tls)
+			}
+		}
+		return lns, nil
+	}
+	if l.network == "unix" {
+		// Only a leftover socket is removed; any other file is an error below.
+		if fi, err := os.Lstat(l.address); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(l.address)
+		}
+	}
+	ln, err := net.Listen(l.network, l.address)
+	if err != nil {
+		return nil, err
+	}
+	if l.mode != 0 {
+		if err := os.Chmod(l.address, l.mode); err != nil {
+			ln.Close()
+			return nil, fmt.Errorf("chmod socket: %w", err)
+		}
+	}
+	if l.tls != nil {
+		ln = tls.NewListener(ln, l.tls)
+	}
+	return []net.Listener{ln}, nil
+}
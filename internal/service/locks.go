@@ -0,0 +1,318 @@
+// Distributed locks for processors. Job types that touch a shared external
+// resource — an API with a single-writer rule, a file on a share, an account
+// that must not be debited twice at once — serialize access with
+// jc.Lock(name) instead of inventing their own locking:
+//
+//	lock, err := jc.Lock("ledger-" + account)
+//	if err != nil {
+//		return "", nil, err // jc's deadline passed while waiting
+//	}
+//	defer lock.Unlock()
+//
+// A lock is a lease kept in locks/{name}.json and claimed with a conditional
+// put, so exactly one holder across all workers and replicas wins, on either
+// storage backend. The holder renews the lease every third of LOCK_TTL while
+// it holds it; a worker that dies stops renewing and its lease expires, after
+// which (plus CLOCK_SKEW_TOLERANCE) another job takes it over. A holder whose
+// renewal fails — storage unreachable, or the lease taken over after a long
+// stall — sees lock.Lost() close and must stop touching the resource.
+//
+// Locks still held when the processor returns are released for it. Dry runs
+// get locks that are always free, since their output is discarded.
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// locksPrefix is the key prefix of lock leases.
+const locksPrefix = "locks/"
+
+// Bounds of the wait between attempts to take a held lock.
+const (
+	lockRetryInitial = 250 * time.Millisecond
+	lockRetryMax     = 5 * time.Second
+)
+
+// lockNamePattern is what a lock name may contain; names become object keys.
+var lockNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,127}$`)
+
+// ErrLockHeld is returned by TryLock when another holder has the lock.
+var ErrLockHeld = errors.New("lock is held by another job")
+
+// errLockLost is returned by renewals once the lease has been taken over.
+var errLockLost = errors.New("lock lease was taken over")
+
+// LockRecord is locks/{name}.json.
+type LockRecord struct {
+	Owner      string    `json:"owner"`              // Random per acquisition; only its holder renews or releases
+	JobID      string    `json:"job_id"`             // Job holding the lock
+	Host       string    `json:"host"`               // Worker holding the lock
+	AcquiredAt Timestamp `json:"acquired_at"`        // When the current holder took it
+	ExpiresAt  Timestamp `json:"expires_at"`         // Lease end unless renewed
+	Released   bool      `json:"released,omitempty"` // Unlocked: free to take at once
+}
+
+// lockManager takes and renews leases in the result store.
+type lockManager struct {
+	app  *App
+	ttl  time.Duration // LOCK_TTL: lease length
+	host string        // Recorded in leases for operators
+}
+
+// newLockManager returns a lockManager with the lease length from LOCK_TTL.
+func newLockManager(a *App) *lockManager {
+	host, _ := os.Hostname()
+	return &lockManager{
+		app:  a,
+		ttl:  max(envDuration("LOCK_TTL", 30*time.Second), 3*time.Second),
+		host: host,
+	}
+}
+
+// Lock is a held lock. Unlock releases it; Lost is closed if the lease could
+// not be renewed.
+type Lock struct {
+	name  string
+	key   string
+	owner string
+	jobID string
+	m     *lockManager // nil for a dry run's lock
+
+	mu       sync.Mutex
+	etag     string // ETag of the holder's latest lease write
+	acquired Timestamp
+	released bool
+	stop     chan struct{} // Closed by Unlock to end renewal
+	lost     chan struct{} // Closed when renewal fails
+	renewed  sync.WaitGroup
+}
+
+// Lock takes the named lock, waiting while another job holds it until jc's
+// deadline. Names are 1 to 128 letters, digits, '.', '_' or '-'.
+func (jc *JobContext) Lock(name string) (*Lock, error) {
+	backoff := lockRetryInitial
+	for {
+		l, err := jc.TryLock(name)
+		if !errors.Is(err, ErrLockHeld) {
+			return l, err
+		}
+		// Jittered, so waiters on a popular lock do not retry in step.
+		wait := backoff/2 + rand.N(backoff/2+1)
+		select {
+		case <-jc.Done():
+			return nil, fmt.Errorf("lock %s: %w", name, context.Cause(jc))
+		case <-time.After(wait):
+		}
+		backoff = min(backoff*2, lockRetryMax)
+	}
+}
+
+// TryLock takes the named lock, or returns ErrLockHeld at once if another job
+// holds it.
+func (jc *JobContext) TryLock(name string) (*Lock, error) {
+	if !lockNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("invalid lock name %q", name)
+	}
+	l := &Lock{
+		name:  name,
+		key:   locksPrefix + name + ".json",
+		owner: uuid.NewString(),
+		jobID: jc.JobID,
+		m:     jc.locks,
+		stop:  make(chan struct{}),
+		lost:  make(chan struct{}),
+	}
+	if l.m != nil {
+		if err := l.m.acquire(jc, l); err != nil {
+			return nil, err
+		}
+		l.renewed.Go(l.renewLoop)
+	}
+	jc.heldMu.Lock()
+	jc.held = append(jc.held, l)
+	jc.heldMu.Unlock()
+	return l, nil
+}
+
+// releaseLocks releases the locks the processor left held.
+func (jc *JobContext) releaseLocks() {
+	jc.heldMu.Lock()
+	held := jc.held
+	jc.held = nil
+	jc.heldMu.Unlock()
+	for _, l := range held {
+		if err := l.Unlock(); err != nil {
+			jc.Logger.WarnContext(jc, "failed to release lock", "lock", l.name, "error", err)
+		}
+	}
+}
+
+// Lost is closed when the lease could not be renewed: the lock may now be
+// held by another job.
+func (l *Lock) Lost() <-chan struct{} { return l.lost }
+
+// Unlock releases the lock. It is safe to call more than once; only the
+// first call releases.
+func (l *Lock) Unlock() error {
+	l.mu.Lock()
+	if l.released {
+		l.mu.Unlock()
+		return nil
+	}
+	l.released = true
+	l.mu.Unlock()
+	if l.m == nil {
+		return nil
+	}
+	close(l.stop)
+	l.renewed.Wait()
+	select {
+	case <-l.lost:
+		return nil // Nothing of ours left to release
+	default:
+	}
+	// Mark the lease released rather than delete it: the write is
+	// conditional on our ETag, so a lease taken over since is left alone.
+	ctx, cancel := context.WithTimeout(context.Background(), awsOpTimeout)
+	defer cancel()
+	err := l.m.write(ctx, l, true)
+	if errors.Is(err, errLockLost) {
+		return nil
+	}
+	return err
+}
+
+// acquire claims l's lease: a fresh one with a conditional create, or a
+// released or expired one by overwriting the exact version read.
+func (m *lockManager) acquire(ctx context.Context, l *Lock) error {
+	ctx, cancel := context.WithTimeout(ctx, awsOpTimeout)
+	defer cancel()
+	l.acquired = Now()
+	rec := m.record(l)
+	err := m.put(ctx, l.key, rec, PutOptions{IfNoneMatch: true})
+	if err != nil {
+		if classifyS3Error(err).Status != http.StatusPreconditionFailed {
+			return fmt.Errorf("lock %s: %w", l.name, err)
+		}
+		prior, etag, err := m.read(ctx, l.key)
+		switch {
+		case err != nil && classifyS3Error(err).Kind == s3NotFound:
+			return ErrLockHeld // Deleted since our put; try again shortly
+		case err != nil:
+			return fmt.Errorf("lock %s: %w", l.name, err)
+		case !prior.Released && time.Since(prior.ExpiresAt.Time) < m.app.clock.tolerance:
+			return ErrLockHeld
+		}
+		if err := m.put(ctx, l.key, rec, PutOptions{IfMatch: etag}); err != nil {
+			if classifyS3Error(err).Status == http.StatusPreconditionFailed {
+				return ErrLockHeld // Another waiter took it over first
+			}
+			return fmt.Errorf("lock %s: %w", l.name, err)
+		}
+	}
+	if err := m.confirm(ctx, l); err != nil {
+		if errors.Is(err, errLockLost) {
+			return ErrLockHeld
+		}
+		return err
+	}
+	return nil
+}
+
+// confirm reads back l's lease and records its ETag for the next
+// conditional write, failing with errLockLost if another owner's is there.
+func (m *lockManager) confirm(ctx context.Context, l *Lock) error {
+	rec, etag, err := m.read(ctx, l.key)
+	if err != nil {
+		return fmt.Errorf("lock %s: %w", l.name, err)
+	}
+	if rec.Owner != l.owner {
+		return errLockLost
+	}
+	l.etag = etag
+	return nil
+}
+
+// write renews l's lease, or marks it released, conditional on the holder's
+// latest version.
+func (m *lockManager) write(ctx context.Context, l *Lock, release bool) error {
+	rec := m.record(l)
+	rec.Released = release
+	if err := m.put(ctx, l.key, rec, PutOptions{IfMatch: l.etag}); err != nil {
+		if classifyS3Error(err).Status == http.StatusPreconditionFailed {
+			return errLockLost
+		}
+		return err
+	}
+	return m.confirm(ctx, l)
+}
+
+// renewLoop extends l's lease every third of the TTL until Unlock, closing
+// Lost when a renewal fails.
+func (l *Lock) renewLoop() {
+	ticker := time.NewTicker(l.m.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), awsOpTimeout)
+		err := l.m.write(ctx, l, false)
+		cancel()
+		if err != nil {
+			slog.Warn("lock lease renewal failed; the lock may be taken over", "lock", l.name, "job_id", l.jobID, "error", err)
+			close(l.lost)
+			return
+		}
+	}
+}
+
+// record is the lease l's holder writes, expiring one TTL from now.
+func (m *lockManager) record(l *Lock) LockRecord {
+	return LockRecord{
+		Owner:      l.owner,
+		JobID:      l.jobID,
+		Host:       m.host,
+		AcquiredAt: l.acquired,
+		ExpiresAt:  Timestamp{Time: time.Now().Add(m.ttl).UTC()},
+	}
+}
+
+// put writes rec to key with the conditions in opts.
+func (m *lockManager) put(ctx context.Context, key string, rec LockRecord, opts PutOptions) error {
+	body, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("encode %s: %w", key, err)
+	}
+	opts.ContentType = "application/json"
+	return m.app.store.Put(ctx, key, body, opts)
+}
+
+// read returns the lease at key and its ETag.
+func (m *lockManager) read(ctx context.Context, key string) (LockRecord, string, error) {
+	body, info, err := m.app.store.Get(ctx, key)
+	if err != nil {
+		return LockRecord{}, "", err
+	}
+	defer body.Close()
+	var rec LockRecord
+	if err := json.NewDecoder(body).Decode(&rec); err != nil {
+		return LockRecord{}, "", fmt.Errorf("decode %s: %w", key, err)
+	}
+	return rec, info.ETag, nil
+}
@@ -0,0 +1,199 @@
+// Busy-loop detection in the worker. Some failures make the worker spin
+// rather than stop — each turn cheap and quiet, together a bill and a noisy
+// neighbour — so the loop guard watches for them by rate and heals what it
+// can on its own:
+//
+//   - Receive errors: LOOP_RECEIVE_ERRORS failed receives within LOOP_WINDOW
+//     (a deleted queue, a revoked permission, a broken endpoint) open a
+//     receive circuit: the worker stops receiving for LOOP_PAUSE instead of
+//     retrying every few seconds.
+//   - Empty receives that return at once: a long poll of 20 seconds that
+//     comes back empty in under fastEmptyReceive means polling is not
+//     waiting (an emulator without long polling, a proxy cutting the
+//     connection). LOOP_FAST_EMPTY_RECEIVES of them within LOOP_WINDOW open
+//     the receive circuit the same way.
+//   - Cycling messages: a job message on its LOOP_MESSAGE_RECEIVES'th
+//     attempt or later, its attempts on average less than LOOP_MESSAGE_CYCLE
+//     apart since it was sent, is coming back every visibility timeout
+//     without being deleted — its processing outlasts the timeout, or it
+//     kills the process. The retry backoff (retry.go) spaces genuine retries
+//     further apart than that. Such a message is quarantined before its
+//     processor runs again: given up on like a job out of attempts, with a
+//     failure record and a forward to DLQ_URL when set, from where it can be
+//     redriven once the cause is fixed. Only deliveries that reached
+//     processing are attempts (deliveries.go): a message released behind
+//     its FIFO group's head or held for a disabled type comes back quickly
+//     and often by design, and is never taken for cycling.
+//
+// Every detection logs an error and counts in loops.detected{kind}
+// (receive_errors, fast_empty_receives, cycling_message), an alert signal of
+// its own apart from job failures. The guard is on by default; LOOP_GUARD=false
+// turns it off. Dry-run workers (shadow.go), which release every message
+// they see by design, never quarantine.
+package service
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// fastEmptyReceive is how quickly an empty long poll must return to count
+// as not having waited.
+const fastEmptyReceive = time.Second
+
+// Kinds of busy loop, as counted in loops.detected.
+const (
+	loopReceiveErrors     = "receive_errors"
+	loopFastEmptyReceives = "fast_empty_receives"
+	loopCyclingMessage    = "cycling_message"
+)
+
+// loopGuard detects the worker's busy loops. Safe for concurrent use.
+type loopGuard struct {
+	window        time.Duration // LOOP_WINDOW: span the receive rates are counted over
+	maxErrors     int           // LOOP_RECEIVE_ERRORS
+	maxFastEmpty  int           // LOOP_FAST_EMPTY_RECEIVES
+	pause         time.Duration // LOOP_PAUSE: how long an open receive circuit stays open
+	cycleReceives int           // LOOP_MESSAGE_RECEIVES
+	cyclePeriod   time.Duration // LOOP_MESSAGE_CYCLE
+
+	mu        sync.Mutex
+	errors    []time.Time // Failed receives within the window
+	fastEmpty []time.Time // Fast empty receives within the window
+}
+
+// newLoopGuard returns the guard configured by the LOOP_* variables, or nil
+// when LOOP_GUARD=false.
+func newLoopGuard() (*loopGuard, error) {
+	if getenv("LOOP_GUARD") == "false" {
+		return nil, nil
+	}
+	g := &loopGuard{
+		window:        envDuration("LOOP_WINDOW", time.Minute),
+		maxErrors:     envInt("LOOP_RECEIVE_ERRORS", 10),
+		maxFastEmpty:  envInt("LOOP_FAST_EMPTY_RECEIVES", 30),
+		pause:         envDuration("LOOP_PAUSE", time.Minute),
+		cycleReceives: envInt("LOOP_MESSAGE_RECEIVES", 10),
+		cyclePeriod:   envDuration("LOOP_MESSAGE_CYCLE", 2*time.Minute),
+	}
+	if g.window <= 0 || g.pause <= 0 || g.cyclePeriod <= 0 {
+		return nil, fmt.Errorf("LOOP_WINDOW, LOOP_PAUSE and LOOP_MESSAGE_CYCLE must be positive")
+	}
+	if g.maxErrors < 2 || g.maxFastEmpty < 2 || g.cycleReceives < 2 {
+		return nil, fmt.Errorf("LOOP_RECEIVE_ERRORS, LOOP_FAST_EMPTY_RECEIVES and LOOP_MESSAGE_RECEIVES must be at least 2")
+	}
+	return g, nil
+}
+
+// receiveFailed records a failed receive, returning how long to stop
+// receiving: LOOP_PAUSE when that makes a loop, else 0. A nil guard never
+// pauses.
+func (g *loopGuard) receiveFailed(ctx context.Context) time.Duration {
+	if g == nil {
+		return 0
+	}
+	return g.count(ctx, &g.errors, g.maxErrors, loopReceiveErrors)
+}
+
+// receivedNothing records an empty receive that took took, returning how
+// long to stop receiving, like receiveFailed.
+func (g *loopGuard) receivedNothing(ctx context.Context, took time.Duration) time.Duration {
+	if g == nil || took >= fastEmptyReceive {
+		return 0
+	}
+	return g.count(ctx, &g.fastEmpty, g.maxFastEmpty, loopFastEmptyReceives)
+}
+
+// count adds an event now to events, the recent ones of kind, and opens the
+// receive circuit once limit of them fall within the window.
+func (g *loopGuard) count(ctx context.Context, events *[]time.Time, limit int, kind string) time.Duration {
+	now := time.Now()
+	g.mu.Lock()
+	kept := (*events)[:0]
+	for _, t := range *events {
+		if now.Sub(t) < g.window {
+			kept = append(kept, t)
+		}
+	}
+	*events = append(kept, now)
+	tripped := len(*events) >= limit
+	if tripped {
+		*events = (*events)[:0]
+	}
+	g.mu.Unlock()
+	if !tripped {
+		return 0
+	}
+	loopsDetected.Add(ctx, 1, metric.WithAttributes(attribute.String("kind", kind)))
+	slog.ErrorContext(ctx, "worker busy loop detected; pausing receives", "kind", kind, "count", limit,
+		"window", g.window.String(), "pause", g.pause.String())
+	return g.pause
+}
+
+// cycling reports whether message, on its attempt'th attempt, is coming
+// round again and again without being deleted, with the average time
+// between its attempts. A nil guard reports none.
+func (g *loopGuard) cycling(message types.Message, attempt int) (time.Duration, bool) {
+	if g == nil || attempt < g.cycleReceives {
+		return 0, false
+	}
+	sent := sentTime(message)
+	if sent.IsZero() {
+		return 0, false
+	}
+	period := time.Since(sent) / time.Duration(attempt)
+	return period, period < g.cyclePeriod
+}
+
+// cyclingError is returned by processMessage, before the processor runs,
+// for a message the guard found cycling.
+type cyclingError struct {
+	attempt int
+	period  time.Duration // Average time between its attempts
+}
+
+func (e *cyclingError) Error() string {
+	return fmt.Sprintf("quarantined: attempted %d times, every %s on average, without completing", e.attempt, e.period.Round(time.Second))
+}
+
+// quarantineMessage gives up on a message the guard found cycling, so it
+// stops being redelivered; on failure it is left for the next delivery to
+// try again.
+func (a *App) quarantineMessage(ctx context.Context, message types.Message, env Envelope, cycling *cyclingError) {
+	ctx, cancel := context.WithTimeout(ctx, awsOpTimeout)
+	defer cancel()
+	loopsDetected.Add(ctx, 1, metric.WithAttributes(attribute.String("kind", loopCyclingMessage)))
+	jobFailures.Add(ctx, 1, metric.WithAttributes(attribute.Bool("final", true)))
+	slog.ErrorContext(ctx, "message cycling without being deleted; quarantining it", "message_id", aws.ToString(message.MessageId),
+		"attempt", cycling.attempt, "period", cycling.period.Round(time.Second).String())
+	if err := a.giveUp(ctx, message, env, cycling.attempt, cycling); err != nil {
+		slog.ErrorContext(ctx, "failed to quarantine message, leaving it for redelivery", "attempt", cycling.attempt, "error", err)
+	}
+}
+
+// pauseWorker waits d before the worker's next receive, still counting as
+// progress for the stall watchdog (systemd.go). It reports false when ctx
+// was cancelled first.
+func (a *App) pauseWorker(ctx context.Context, d time.Duration) bool {
+	deadline := time.Now().Add(d)
+	for {
+		a.workerBeat.Store(time.Now().UnixNano())
+		left := time.Until(deadline)
+		if left <= 0 {
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(min(left, 10*time.Second)):
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package service
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+func TestLoopGuardCycling(t *testing.T) {
+	g := &loopGuard{cycleReceives: 3, cyclePeriod: time.Minute}
+	sentAgo := func(d time.Duration) types.Message {
+		ms := strconv.FormatInt(time.Now().Add(-d).UnixMilli(), 10)
+		return types.Message{Attributes: map[string]string{string(types.MessageSystemAttributeNameSentTimestamp): ms}}
+	}
+	for _, tc := range []struct {
+		name    string
+		guard   *loopGuard
+		message types.Message
+		attempt int
+		want    bool
+	}{
+		{"cycling", g, sentAgo(30 * time.Second), 3, true},
+		{"too few attempts", g, sentAgo(30 * time.Second), 2, false},
+		{"attempts spaced out", g, sentAgo(10 * time.Minute), 3, false},
+		{"no sent time", g, types.Message{}, 3, false},
+		{"disabled", nil, sentAgo(30 * time.Second), 3, false},
+	} {
+		if _, got := tc.guard.cycling(tc.message, tc.attempt); got != tc.want {
+			t.Errorf("%s: cycling = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestCyclingMessageIsQuarantined(t *testing.T) {
+	h := newDeliveryHarness(t)
+	h.app.loops = &loopGuard{cycleReceives: 3, cyclePeriod: time.Minute}
+	id, _ := h.submit("")
+	message := h.receive()
+
+	// Two earlier attempts of this message were cut short without an outcome.
+	rec := h.record(id)
+	for i := range 2 {
+		rec.Attempts = append(rec.Attempts, JobAttempt{Attempt: i + 1, MessageID: aws.ToString(message.MessageId), Outcome: attemptAbandoned})
+	}
+	if err := h.app.putJobRecord(h.ctx, &rec, createProcessing); err != nil {
+		t.Fatal(err)
+	}
+	h.wait(h.handle(message))
+
+	var failure FailureRecord
+	if err := h.app.getJSON(h.ctx, failureKey(id), &failure); err != nil {
+		t.Fatalf("no failure record: %v", err)
+	}
+	if rec := h.record(id); rec.State != createFailed || rec.Attempt != 3 {
+		t.Errorf("record %s on attempt %d, want %s on attempt 3", rec.State, rec.Attempt, createFailed)
+	}
+	var result JobResult
+	if err := h.app.getJSON(h.ctx, jobsPrefix+id+".json", &result); err == nil {
+		t.Error("the processor ran on a quarantined message")
+	}
+	if depth, _ := h.app.queue.Depth(h.ctx, h.app.sqsURL); depth != (QueueDepth{}) {
+		t.Errorf("queue left with %+v", depth)
+	}
+}
+
+func TestReleasedAndHeldMessagesAreNotCycling(t *testing.T) {
+	h := newDeliveryHarness(t)
+	h.app.sqsURL = memoryQueueURL + fifoSuffix
+	h.app.loops = &loopGuard{cycleReceives: 3, cyclePeriod: time.Minute}
+	h.app.typeFlags.requeueDelay = 0
+	h.group = "acme"
+	id, _ := h.submit("")
+
+	// Released behind a group head, then held while its type is disabled:
+	// received far more often than LOOP_MESSAGE_RECEIVES, within moments.
+	for range 4 {
+		h.expire(h.receive())
+	}
+	h.app.typeFlags.current.Store(&JobTypeFlags{Disabled: map[string]DisabledJobType{defaultProcessorType: {Reason: "maintenance"}}})
+	for range 4 {
+		h.wait(h.handle(h.receive()))
+	}
+	h.app.typeFlags.current.Store(&JobTypeFlags{})
+	message := h.receive()
+	if n := receiveAttempt(message); n < 9 {
+		t.Fatalf("receive count %d: the releases and holds were not exercised", n)
+	}
+	h.wait(h.handle(message))
+
+	h.assertAttempts(id, JobAttempt{Attempt: 1, Outcome: attemptCompleted})
+	h.assertSingleResult(id, "HELLO")
+}
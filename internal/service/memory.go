@@ -0,0 +1,293 @@
+// Garbage-collector tuning and runtime memory metrics. GOGC and GOMEMLIMIT
+// are the standard runtime knobs; they are re-applied after APP_PROFILE so
+// profiles can set them too. With GOMEMLIMIT_FROM_CGROUP the soft memory
+// limit is derived from the container's cgroup limit instead, so the GC works
+// harder before the kernel OOM-kills a worker in a small Kubernetes or ECS
+// memory limit. A soft limit replaces the old memory-ballast trick; no ballast
+// is allocated. Heap, GC cycle and GC pause metrics come from runtime/metrics,
+// which reads them without stopping the world.
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"runtime/debug"
+	"runtime/metrics"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Cgroup memory limit files: v2 (unified) first, then v1.
+const (
+	cgroupV2MemoryMax = "/sys/fs/cgroup/memory.max"
+	cgroupV1MemoryMax = "/sys/fs/cgroup/memory/memory.limit_in_bytes"
+)
+
+// errNoCgroupLimit is returned when the process has no cgroup memory limit.
+var errNoCgroupLimit = errors.New("no cgroup memory limit")
+
+// byteUnits are the GOMEMLIMIT suffixes the runtime accepts.
+var byteUnits = []struct {
+	suffix string
+	scale  int64
+}{
+	{"TiB", 1 << 40}, {"GiB", 1 << 30}, {"MiB", 1 << 20}, {"KiB", 1 << 10}, {"B", 1},
+}
+
+// memorySettings are the effective GC settings, for the startup report.
+type memorySettings struct {
+	GOGC             int64  `json:"gogc"` // -1 when off
+	LimitBytes       int64  `json:"memory_limit_bytes"`
+	LimitSource      string `json:"memory_limit_source"` // default, GOMEMLIMIT or cgroup
+	CgroupLimitBytes int64  `json:"cgroup_limit_bytes,omitempty"`
+	cgroupErr        error  // Why GOMEMLIMIT_FROM_CGROUP found no limit
+}
+
+// configureMemory applies GOGC and the soft memory limit (GOMEMLIMIT, or a
+// percentage of the cgroup limit with GOMEMLIMIT_FROM_CGROUP=true) and
+// returns the effective settings. Invalid values exit the process.
+func configureMemory() memorySettings {
+	if v := getenv("GOGC"); v != "" {
+		percent := -1
+		if v != "off" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				slog.Error("invalid GOGC", "value", v)
+				os.Exit(1)
+			}
+			percent = n
+		}
+		debug.SetGCPercent(percent)
+	}
+
+	mem := memorySettings{LimitSource: "default"}
+	switch {
+	case getenv("GOMEMLIMIT") != "":
+		limit, err := parseMemoryLimit(getenv("GOMEMLIMIT"))
+		if err != nil {
+			slog.Error("invalid GOMEMLIMIT", "value", getenv("GOMEMLIMIT"), "error", err)
+			os.Exit(1)
+		}
+		debug.SetMemoryLimit(limit)
+		mem.LimitSource = "GOMEMLIMIT"
+	case getenv("GOMEMLIMIT_FROM_CGROUP") == "true":
+		percent := envInt("GOMEMLIMIT_PERCENT", 90)
+		if percent < 1 || percent > 100 {
+			slog.Error("GOMEMLIMIT_PERCENT must be between 1 and 100", "value", percent)
+			os.Exit(1)
+		}
+		limit, err := cgroupMemoryLimit()
+		if err != nil {
+			mem.cgroupErr = err
+			break
+		}
+		mem.CgroupLimitBytes = limit
+		debug.SetMemoryLimit(limit / 100 * int64(percent))
+		mem.LimitSource = "cgroup"
+	}
+
+	mem.GOGC, mem.LimitBytes = runtimeGCSettings()
+	return mem
+}
+
+// parseMemoryLimit parses a GOMEMLIMIT value: "off" or a byte count with an
+// optional B, KiB, MiB, GiB or TiB suffix.
+func parseMemoryLimit(v string) (int64, error) {
+	if v == "off" {
+		return math.MaxInt64, nil
+	}
+	scale := int64(1)
+	for _, u := range byteUnits {
+		if num, ok := strings.CutSuffix(v, u.suffix); ok {
+			v, scale = num, u.scale
+			break
+		}
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("want a non-negative byte count like 512MiB")
+	}
+	if n > math.MaxInt64/scale {
+		return 0, fmt.Errorf("limit overflows")
+	}
+	return n * scale, nil
+}
+
+// cgroupMemoryLimit returns the memory limit of the process's cgroup, or
+// errNoCgroupLimit when it is unlimited or not running under one.
+func cgroupMemoryLimit() (int64, error) {
+	for _, path := range []string{cgroupV2MemoryMax, cgroupV1MemoryMax} {
+		b, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		v := strings.TrimSpace(string(b))
+		if v == "max" {
+			return 0, errNoCgroupLimit
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("parse %s: %w", path, err)
+		}
+		// cgroup v1 reports "unlimited" as a huge page-aligned number.
+		if n <= 0 || n >= 1<<62 {
+			return 0, errNoCgroupLimit
+		}
+		return n, nil
+	}
+	return 0, errNoCgroupLimit
+}
+
+// runtimeGCSettings returns the effective GOGC percentage (-1 when off) and
+// soft memory limit. Both setters return the previous value; a negative
+// limit only reads it.
+func runtimeGCSettings() (gogc, memLimit int64) {
+	percent := debug.SetGCPercent(-1)
+	debug.SetGCPercent(percent)
+	return int64(percent), debug.SetMemoryLimit(-1)
+}
+
+// Runtime metric names read on every collection, in the order of
+// runtimeMetrics.samples.
+const (
+	sampleHeapObjects = iota
+	sampleTotal
+	sampleHeapGoal
+	sampleMemLimit
+	sampleGCCycles
+	sampleGCCPU
+	sampleGCPauses
+)
+
+var runtimeSampleNames = []string{
+	sampleHeapObjects: "/memory/classes/heap/objects:bytes",
+	sampleTotal:       "/memory/classes/total:bytes",
+	sampleHeapGoal:    "/gc/heap/goal:bytes",
+	sampleMemLimit:    "/gc/gomemlimit:bytes",
+	sampleGCCycles:    "/gc/cycles/total:gc-cycles",
+	sampleGCCPU:       "/cpu/classes/gc/total:cpu-seconds",
+	sampleGCPauses:    "/sched/pauses/total/gc:seconds",
+}
+
+// runtimeMetrics reads runtime/metrics for the observable instruments and
+// tracks the GC pause histogram between collections.
+type runtimeMetrics struct {
+	mu         sync.Mutex
+	samples    []metrics.Sample
+	lastPauses []uint64 // Pause histogram counts at the previous collection
+}
+
+// pauseStats returns the number of GC pauses since the previous call and the
+// upper bound of the longest of them (the runtime records pauses in buckets).
+func (rm *runtimeMetrics) pauseStats(h *metrics.Float64Histogram) (count uint64, longest float64) {
+	for i, c := range h.Counts {
+		var prev uint64
+		if i < len(rm.lastPauses) {
+			prev = rm.lastPauses[i]
+		}
+		if c <= prev {
+			continue
+		}
+		count += c - prev
+		longest = h.Buckets[i+1]
+		if math.IsInf(longest, 1) {
+			longest = h.Buckets[i]
+		}
+	}
+	rm.lastPauses = append(rm.lastPauses[:0], h.Counts...)
+	return count, longest
+}
+
+// initRuntimeMetrics registers the heap and GC instruments on the global
+// meter. Like initInstruments, it binds to no-ops if setupOTel failed.
+func initRuntimeMetrics() error {
+	m := otel.Meter(instrumentationScope)
+	rm := &runtimeMetrics{samples: make([]metrics.Sample, len(runtimeSampleNames))}
+	for i, name := range runtimeSampleNames {
+		rm.samples[i].Name = name
+	}
+
+	heapObjects, err := m.Int64ObservableGauge("runtime.go.mem.heap_objects",
+		metric.WithDescription("Bytes in live and not-yet-swept heap objects"), metric.WithUnit("By"))
+	if err != nil {
+		return err
+	}
+	total, err := m.Int64ObservableGauge("runtime.go.mem.total",
+		metric.WithDescription("All memory mapped by the Go runtime"), metric.WithUnit("By"))
+	if err != nil {
+		return err
+	}
+	heapGoal, err := m.Int64ObservableGauge("runtime.go.mem.heap_goal",
+		metric.WithDescription("Heap size target for the end of the current GC cycle"), metric.WithUnit("By"))
+	if err != nil {
+		return err
+	}
+	memLimit, err := m.Int64ObservableGauge("runtime.go.mem.limit",
+		metric.WithDescription("Soft memory limit (GOMEMLIMIT)"), metric.WithUnit("By"))
+	if err != nil {
+		return err
+	}
+	gcCycles, err := m.Int64ObservableCounter("runtime.go.gc.count",
+		metric.WithDescription("Completed GC cycles"), metric.WithUnit("{gc_cycle}"))
+	if err != nil {
+		return err
+	}
+	gcCPU, err := m.Float64ObservableCounter("runtime.go.gc.cpu",
+		metric.WithDescription("CPU time spent in the garbage collector"), metric.WithUnit("s"))
+	if err != nil {
+		return err
+	}
+	gcPauses, err := m.Int64ObservableCounter("runtime.go.gc.pauses",
+		metric.WithDescription("Stop-the-world GC pauses"), metric.WithUnit("{pause}"))
+	if err != nil {
+		return err
+	}
+	gcPauseMax, err := m.Float64ObservableGauge("runtime.go.gc.pause.max",
+		metric.WithDescription("Upper bound of the longest GC pause since the previous collection"), metric.WithUnit("s"))
+	if err != nil {
+		return err
+	}
+
+	var totalPauses int64
+	_, err = m.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+		rm.mu.Lock()
+		defer rm.mu.Unlock()
+		metrics.Read(rm.samples)
+		o.ObserveInt64(heapObjects, uint64Sample(rm.samples[sampleHeapObjects]))
+		o.ObserveInt64(total, uint64Sample(rm.samples[sampleTotal]))
+		o.ObserveInt64(heapGoal, uint64Sample(rm.samples[sampleHeapGoal]))
+		o.ObserveInt64(memLimit, uint64Sample(rm.samples[sampleMemLimit]))
+		o.ObserveInt64(gcCycles, uint64Sample(rm.samples[sampleGCCycles]))
+		if s := rm.samples[sampleGCCPU]; s.Value.Kind() == metrics.KindFloat64 {
+			o.ObserveFloat64(gcCPU, s.Value.Float64())
+		}
+		if s := rm.samples[sampleGCPauses]; s.Value.Kind() == metrics.KindFloat64Histogram {
+			count, longest := rm.pauseStats(s.Value.Float64Histogram())
+			totalPauses += int64(count)
+			o.ObserveInt64(gcPauses, totalPauses)
+			o.ObserveFloat64(gcPauseMax, longest)
+		}
+		return nil
+	}, heapObjects, total, heapGoal, memLimit, gcCycles, gcCPU, gcPauses, gcPauseMax)
+	return err
+}
+
+// uint64Sample returns a uint64 runtime sample as an int64, or 0 when the
+// metric is unsupported by this runtime.
+func uint64Sample(s metrics.Sample) int64 {
+	if s.Value.Kind() != metrics.KindUint64 {
+		return 0
+	}
+	return int64(min(s.Value.Uint64(), math.MaxInt64))
+}
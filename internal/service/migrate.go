@@ -0,0 +1,549 @@
+// Storage migration. Copies the service's data — results and artifacts,
+// sort index, lineage, creation records, tombstones and views — from one
+// S3-compatible store to another, optionally changing the key layout by
+// re-rooting every key under a different prefix. Used by cmd/migrate (any
+// two endpoints, e.g. when moving clouds) and by POST /admin/migrations
+// (same account, e.g. adopting a new bucket or key partitioning).
+//
+// A migration is throttled to a maximum object rate, skips objects already
+// present at the destination with the same size (and ETag, when verifying),
+// verifies each copy with a HeadObject, and checkpoints its position to the
+// destination every few hundred objects, so rerunning it with the same name
+// resumes where it stopped. The final report doubles as the cutover check:
+// CutoverReady means every object is present and verified.
+//
+// With a Scrubber the migration is an export to a lower environment instead:
+// JSON objects are rewritten through it (scrub.go), empty objects such as
+// index entries are copied as they are, and anything else — artifacts — is
+// withheld, since it cannot be scrubbed. Existing destination objects are
+// kept, as their size no longer says whether they match.
+package service
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const (
+	// migrationsPrefix holds checkpoints and reports, under the destination
+	// prefix.
+	migrationsPrefix = "migrations/"
+	// migrationCheckpointEvery is how many objects are copied between
+	// checkpoints.
+	migrationCheckpointEvery = 500
+)
+
+// migratePrefixes are the logical key prefixes a migration copies by
+// default. Diagnostics and payloads are deliberately left behind.
+var migratePrefixes = []string{"jobs/", indexPrefix, "lineage/", statusPrefix, tombstonesPrefix, viewsPrefix}
+
+// MigrationEndpoint is one side of a migration.
+type MigrationEndpoint struct {
+	Client *s3.Client `json:"-"`                // S3 client for the store
+	Bucket string     `json:"bucket"`           // Bucket name
+	Prefix string     `json:"prefix,omitempty"` // Key layout root: a logical key k is stored at Prefix+k
+}
+
+// MigrationConfig describes a migration.
+type MigrationConfig struct {
+	Name        string            // Identifies the checkpoint; reuse it to resume
+	Source      MigrationEndpoint // Where data is read from
+	Destination MigrationEndpoint // Where data is written to
+	Prefixes    []string          // Logical prefixes to copy; nil for migratePrefixes
+	Rate        float64           // Maximum objects per second; 0 for no limit
+	Verify      bool              // HeadObject each copy and compare size and ETag
+	Scrub       *Scrubber         // Export mode: scrub JSON objects, withhold other non-empty ones
+}
+
+// MigrationPrefixStats counts one prefix's objects in a MigrationReport.
+type MigrationPrefixStats struct {
+	Copied   int   `json:"copied"`             // Written to the destination this run
+	Skipped  int   `json:"skipped"`            // Already present and matching
+	Failed   int   `json:"failed"`             // Copy or verification failed
+	Withheld int   `json:"withheld,omitempty"` // Not copied: cannot be scrubbed
+	Bytes    int64 `json:"bytes"`              // Bytes copied this run
+	Done     bool  `json:"done"`               // Every object under the prefix was visited
+}
+
+// MigrationReport is a migration's progress and, once finished, its cutover
+// report.
+type MigrationReport struct {
+	Name         string                           `json:"name"`
+	Source       MigrationEndpoint                `json:"source"`
+	Destination  MigrationEndpoint                `json:"destination"`
+	StartedAt    Timestamp                        `json:"started_at"`
+	FinishedAt   Timestamp                        `json:"finished_at,omitzero"`
+	ResumedAfter string                           `json:"resumed_after,omitempty"` // Checkpointed key the run continued from
+	Scrubbed     bool                             `json:"scrubbed"`                // Export mode: payloads were scrubbed
+	Prefixes     map[string]*MigrationPrefixStats `json:"prefixes"`
+	Failures     []string                         `json:"failures,omitempty"` // First few failed keys with reasons
+	Error        string                           `json:"error,omitempty"`    // Why the run stopped early
+	CutoverReady bool                             `json:"cutover_ready"`      // Every prefix done with no failures
+}
+
+// migrationCheckpoint is the resumable position of a migration.
+type migrationCheckpoint struct {
+	Prefix string   `json:"prefix"` // Prefix being copied
+	After  string   `json:"after"`  // Last logical key handled under Prefix
+	Failed int      `json:"failed"` // Failures so far under Prefix, across resumes
+	Done   []string `json:"done"`   // Prefixes finished without failures
+}
+
+// migration is one run, with its progress readable while it runs.
+type migration struct {
+	cfg MigrationConfig
+
+	mu  sync.Mutex
+	rep MigrationReport
+}
+
+// Migrate runs cfg to completion (or ctx cancellation) and returns the
+// report, which is also stored at the destination.
+func Migrate(ctx context.Context, cfg MigrationConfig) (*MigrationReport, error) {
+	m := newMigration(cfg)
+	err := m.run(ctx)
+	rep := m.snapshot()
+	return &rep, err
+}
+
+// newMigration validates nothing; callers check names and buckets.
+func newMigration(cfg MigrationConfig) *migration {
+	if cfg.Prefixes == nil {
+		cfg.Prefixes = migratePrefixes
+	}
+	m := &migration{cfg: cfg}
+	m.rep = MigrationReport{
+		Name:        cfg.Name,
+		Source:      cfg.Source,
+		Destination: cfg.Destination,
+		StartedAt:   Now(),
+		Scrubbed:    cfg.Scrub != nil,
+		Prefixes:    make(map[string]*MigrationPrefixStats, len(cfg.Prefixes)),
+	}
+	for _, p := range cfg.Prefixes {
+		m.rep.Prefixes[p] = &MigrationPrefixStats{}
+	}
+	return m
+}
+
+// snapshot returns a copy of the current report.
+func (m *migration) snapshot() MigrationReport {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rep := m.rep
+	rep.Prefixes = make(map[string]*MigrationPrefixStats, len(m.rep.Prefixes))
+	for p, st := range m.rep.Prefixes {
+		c := *st
+		rep.Prefixes[p] = &c
+	}
+	rep.Failures = slices.Clone(m.rep.Failures)
+	return rep
+}
+
+// update applies fn to the report under the lock.
+func (m *migration) update(fn func(*MigrationReport)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fn(&m.rep)
+}
+
+// metaKey is the destination key of the migration's checkpoint or report.
+func (m *migration) metaKey(name string) string {
+	return m.cfg.Destination.Prefix + migrationsPrefix + m.cfg.Name + "/" + name
+}
+
+// run copies every prefix, resuming from the stored checkpoint, and stores
+// the final report.
+func (m *migration) run(ctx context.Context) error {
+	dst := m.cfg.Destination
+	var cp migrationCheckpoint
+	if err := getJSONFrom(ctx, newS3Store(dst.Client, dst.Bucket), m.metaKey("checkpoint.json"), &cp); err != nil && classifyS3Error(err).Kind != s3NotFound {
+		return m.finish(ctx, fmt.Errorf("read checkpoint: %w", err))
+	}
+	if cp.After != "" {
+		m.update(func(r *MigrationReport) { r.ResumedAfter = cp.After })
+		slog.Info("migration resuming", "name", m.cfg.Name, "prefix", cp.Prefix, "after", cp.After)
+	}
+
+	var tick <-chan time.Time
+	if m.cfg.Rate > 0 {
+		t := time.NewTicker(time.Duration(float64(time.Second) / m.cfg.Rate))
+		defer t.Stop()
+		tick = t.C
+	}
+
+	for _, prefix := range m.cfg.Prefixes {
+		if slices.Contains(cp.Done, prefix) {
+			m.update(func(r *MigrationReport) { r.Prefixes[prefix].Done = true })
+			continue
+		}
+		if cp.Prefix != prefix {
+			cp.Prefix, cp.After, cp.Failed = prefix, "", 0
+		}
+		if err := m.copyPrefix(ctx, prefix, cp.After, &cp, tick); err != nil {
+			return m.finish(ctx, err)
+		}
+		// A prefix with failures anywhere, this run or before a resume, is
+		// revisited from the start next time; matching objects are skipped.
+		if cp.Failed == 0 {
+			cp.Done = append(cp.Done, prefix)
+		} else {
+			m.update(func(r *MigrationReport) { r.Prefixes[prefix].Failed = max(r.Prefixes[prefix].Failed, cp.Failed) })
+		}
+		cp.Prefix, cp.After, cp.Failed = "", "", 0
+		if err := m.saveCheckpoint(ctx, cp); err != nil {
+			return m.finish(ctx, err)
+		}
+		m.update(func(r *MigrationReport) { r.Prefixes[prefix].Done = true })
+	}
+	return m.finish(ctx, nil)
+}
+
+// copyPrefix copies the objects under one logical prefix after the given
+// logical key, checkpointing as it goes.
+func (m *migration) copyPrefix(ctx context.Context, prefix, after string, cp *migrationCheckpoint, tick <-chan time.Time) error {
+	src := m.cfg.Source
+	in := &s3.ListObjectsV2Input{Bucket: aws.String(src.Bucket), Prefix: aws.String(src.Prefix + prefix)}
+	if after != "" {
+		in.StartAfter = aws.String(src.Prefix + after)
+	}
+	p := s3.NewListObjectsV2Paginator(src.Client, in)
+	sinceCheckpoint := 0
+	for p.HasMorePages() {
+		pageCtx, cancel := context.WithTimeout(ctx, awsOpTimeout)
+		page, err := p.NextPage(pageCtx)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("list %s: %w", prefix, err)
+		}
+		for _, obj := range page.Contents {
+			if tick != nil {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-tick:
+				}
+			} else if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			key := strings.TrimPrefix(aws.ToString(obj.Key), src.Prefix)
+			copied, err := m.copyObject(ctx, key, obj)
+			withheld := errors.Is(err, errWithheld)
+			if err != nil && !withheld {
+				cp.Failed++
+			}
+			m.update(func(r *MigrationReport) {
+				st := r.Prefixes[prefix]
+				switch {
+				case withheld:
+					st.Withheld++
+				case err != nil:
+					st.Failed++
+					if len(r.Failures) < janitorSampleSize {
+						r.Failures = append(r.Failures, key+": "+err.Error())
+					}
+				case copied:
+					st.Copied++
+					st.Bytes += aws.ToInt64(obj.Size)
+				default:
+					st.Skipped++
+				}
+			})
+			cp.Prefix, cp.After = prefix, key
+			if sinceCheckpoint++; sinceCheckpoint >= migrationCheckpointEvery {
+				if err := m.saveCheckpoint(ctx, *cp); err != nil {
+					return err
+				}
+				sinceCheckpoint = 0
+			}
+		}
+	}
+	return nil
+}
+
+// copyObject copies one logical key unless the destination already has a
+// matching object, and reports whether it wrote anything.
+func (m *migration) copyObject(ctx context.Context, key string, obj s3types.Object) (bool, error) {
+	if m.cfg.Scrub != nil {
+		return m.copyScrubbed(ctx, key, obj)
+	}
+	src, dst := m.cfg.Source, m.cfg.Destination
+	dstKey := dst.Prefix + key
+	if match, err := m.matches(ctx, dstKey, obj); err != nil || match {
+		return false, err
+	}
+
+	opCtx, cancel := context.WithTimeout(ctx, awsOpTimeout)
+	defer cancel()
+	if src.Client == dst.Client {
+		// Same store: copy server-side.
+		_, err := dst.Client.CopyObject(opCtx, &s3.CopyObjectInput{
+			Bucket:     aws.String(dst.Bucket),
+			Key:        aws.String(dstKey),
+			CopySource: aws.String(url.PathEscape(src.Bucket) + "/" + escapeKey(aws.ToString(obj.Key))),
+		})
+		if err != nil {
+			return false, fmt.Errorf("copy: %w", err)
+		}
+	} else {
+		out, err := src.Client.GetObject(opCtx, &s3.GetObjectInput{Bucket: aws.String(src.Bucket), Key: obj.Key})
+		if err != nil {
+			return false, fmt.Errorf("get: %w", err)
+		}
+		defer out.Body.Close()
+		_, err = dst.Client.PutObject(opCtx, &s3.PutObjectInput{
+			Bucket:        aws.String(dst.Bucket),
+			Key:           aws.String(dstKey),
+			Body:          out.Body,
+			ContentLength: out.ContentLength,
+			ContentType:   out.ContentType,
+		})
+		if err != nil {
+			return false, fmt.Errorf("put: %w", err)
+		}
+	}
+
+	if m.cfg.Verify {
+		match, err := m.matches(ctx, dstKey, obj)
+		if err != nil {
+			return false, fmt.Errorf("verify: %w", err)
+		}
+		if !match {
+			return false, errors.New("verify: destination differs from source")
+		}
+	}
+	return true, nil
+}
+
+// errWithheld is returned for objects an export cannot scrub.
+var errWithheld = errors.New("withheld: cannot be scrubbed")
+
+// copyScrubbed copies one logical key through the scrubber unless the
+// destination already has it, and reports whether it wrote anything.
+func (m *migration) copyScrubbed(ctx context.Context, key string, obj s3types.Object) (bool, error) {
+	src, dst := m.cfg.Source, m.cfg.Destination
+	dstKey := dst.Prefix + key
+	if aws.ToInt64(obj.Size) > 0 && !strings.HasSuffix(key, ".json") {
+		return false, errWithheld
+	}
+	ctx, cancel := context.WithTimeout(ctx, awsOpTimeout)
+	defer cancel()
+	if _, err := dst.Client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String(dst.Bucket), Key: aws.String(dstKey)}); err == nil {
+		return false, nil
+	} else if classifyS3Error(err).Kind != s3NotFound {
+		return false, err
+	}
+
+	out, err := src.Client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(src.Bucket), Key: obj.Key})
+	if err != nil {
+		return false, fmt.Errorf("get: %w", err)
+	}
+	body, err := io.ReadAll(out.Body)
+	out.Body.Close()
+	if err != nil {
+		return false, fmt.Errorf("get: %w", err)
+	}
+	if len(body) > 0 {
+		if body, err = m.cfg.Scrub.JSON(body); err != nil {
+			return false, fmt.Errorf("scrub: %w", err)
+		}
+	}
+	_, err = dst.Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(dst.Bucket),
+		Key:         aws.String(dstKey),
+		Body:        bytes.NewReader(body),
+		ContentType: out.ContentType,
+	})
+	if err != nil {
+		return false, fmt.Errorf("put: %w", err)
+	}
+	if m.cfg.Verify {
+		head, err := dst.Client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String(dst.Bucket), Key: aws.String(dstKey)})
+		if err != nil {
+			return false, fmt.Errorf("verify: %w", err)
+		}
+		if aws.ToInt64(head.ContentLength) != int64(len(body)) {
+			return false, errors.New("verify: destination differs from the scrubbed object")
+		}
+	}
+	return true, nil
+}
+
+// matches reports whether dstKey exists with obj's size, and with its ETag
+// when verifying. ETags are only compared when neither side was a multipart
+// upload, whose ETags depend on the part size rather than the content.
+func (m *migration) matches(ctx context.Context, dstKey string, obj s3types.Object) (bool, error) {
+	dst := m.cfg.Destination
+	ctx, cancel := context.WithTimeout(ctx, awsOpTimeout)
+	defer cancel()
+	head, err := dst.Client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String(dst.Bucket), Key: aws.String(dstKey)})
+	if err != nil {
+		if classifyS3Error(err).Kind == s3NotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	if aws.ToInt64(head.ContentLength) != aws.ToInt64(obj.Size) {
+		return false, nil
+	}
+	srcTag, dstTag := aws.ToString(obj.ETag), aws.ToString(head.ETag)
+	if m.cfg.Verify && !strings.Contains(srcTag, "-") && !strings.Contains(dstTag, "-") {
+		return srcTag == dstTag, nil
+	}
+	return true, nil
+}
+
+// saveCheckpoint stores cp at the destination.
+func (m *migration) saveCheckpoint(ctx context.Context, cp migrationCheckpoint) error {
+	dst := m.cfg.Destination
+	if err := putJSONTo(context.WithoutCancel(ctx), newS3Store(dst.Client, dst.Bucket), m.metaKey("checkpoint.json"), cp); err != nil {
+		return fmt.Errorf("save checkpoint: %w", err)
+	}
+	return nil
+}
+
+// finish completes the report, stores it at the destination and returns
+// err.
+func (m *migration) finish(ctx context.Context, err error) error {
+	m.update(func(r *MigrationReport) {
+		r.FinishedAt = Now()
+		if err != nil {
+			r.Error = err.Error()
+		}
+		r.CutoverReady = err == nil
+		for _, st := range r.Prefixes {
+			if !st.Done || st.Failed > 0 {
+				r.CutoverReady = false
+			}
+		}
+	})
+	rep := m.snapshot()
+	dst := m.cfg.Destination
+	if putErr := putJSONTo(context.WithoutCancel(ctx), newS3Store(dst.Client, dst.Bucket), m.metaKey("report.json"), rep); putErr != nil {
+		slog.Warn("failed to store migration report", "name", m.cfg.Name, "error", putErr)
+	}
+	slog.Info("migration finished", "name", m.cfg.Name, "cutover_ready", rep.CutoverReady, "error", rep.Error)
+	return err
+}
+
+// escapeKey URL-escapes each segment of an S3 key for CopySource.
+func escapeKey(key string) string {
+	parts := strings.Split(key, "/")
+	for i, p := range parts {
+		parts[i] = url.PathEscape(p)
+	}
+	return strings.Join(parts, "/")
+}
+
+// MigrationRequest is the POST /admin/migrations request body.
+type MigrationRequest struct {
+	Name              string   `json:"name"`                         // Migration name; reuse to resume
+	SourcePrefix      string   `json:"source_prefix,omitempty"`      // Current key layout root
+	DestinationBucket string   `json:"destination_bucket,omitempty"` // Defaults to S3_BUCKET
+	DestinationPrefix string   `json:"destination_prefix,omitempty"` // New key layout root
+	Prefixes          []string `json:"prefixes,omitempty"`           // Logical prefixes; default all
+	Rate              float64  `json:"rate,omitempty"`               // Objects per second; 0 for no limit
+	Verify            *bool    `json:"verify,omitempty"`             // Default true
+	Scrub             bool     `json:"scrub,omitempty"`              // Export through SCRUB_RULES (see scrub.go)
+}
+
+// migrationRunner runs one admin-triggered migration at a time and keeps
+// every migration started by this process for GET.
+type migrationRunner struct {
+	running sync.Mutex
+	mu      sync.Mutex
+	byName  map[string]*migration
+}
+
+// errMigrationBusy is returned when a migration is requested while one runs.
+var errMigrationBusy = errors.New("a migration is already running")
+
+// startMigration handles POST /admin/migrations requests.
+// Starts a migration within this service's account in the background → 202
+// with the initial report; 409 while another runs. Poll
+// GET /admin/migrations/{name} for progress and the cutover report.
+func (a *App) startMigration(w http.ResponseWriter, r *http.Request) {
+	var req MigrationRequest
+	if err := a.decodeJSON(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Name == "" || strings.ContainsAny(req.Name, "/ ") {
+		http.Error(w, "name is required and must not contain / or spaces", http.StatusBadRequest)
+		return
+	}
+	for _, p := range req.Prefixes {
+		if !slices.Contains(migratePrefixes, p) {
+			http.Error(w, "prefixes must be among "+strings.Join(migratePrefixes, ", "), http.StatusBadRequest)
+			return
+		}
+	}
+	if !a.onS3() {
+		http.Error(w, "migrations copy between S3 buckets; STORAGE_BACKEND is not s3", http.StatusConflict)
+		return
+	}
+	dstBucket := cmp.Or(req.DestinationBucket, a.s3Bucket)
+	if dstBucket == a.s3Bucket && req.DestinationPrefix == req.SourcePrefix {
+		http.Error(w, "destination must differ from source in bucket or prefix", http.StatusBadRequest)
+		return
+	}
+	if req.Scrub && a.scrubber == nil {
+		http.Error(w, "scrub requested but SCRUB_RULES is not configured", http.StatusBadRequest)
+		return
+	}
+	if !a.migrations.running.TryLock() {
+		http.Error(w, errMigrationBusy.Error(), http.StatusConflict)
+		return
+	}
+	cfg := MigrationConfig{
+		Name:        req.Name,
+		Source:      MigrationEndpoint{Client: a.s3Client, Bucket: a.s3Bucket, Prefix: req.SourcePrefix},
+		Destination: MigrationEndpoint{Client: a.s3Client, Bucket: dstBucket, Prefix: req.DestinationPrefix},
+		Prefixes:    req.Prefixes,
+		Rate:        req.Rate,
+		Verify:      req.Verify == nil || *req.Verify,
+	}
+	if req.Scrub {
+		cfg.Scrub = a.scrubber
+	}
+	m := newMigration(cfg)
+	a.migrations.mu.Lock()
+	a.migrations.byName[req.Name] = m
+	a.migrations.mu.Unlock()
+
+	// Detached from the request: the migration outlives the response.
+	go func() {
+		defer a.migrations.running.Unlock()
+		m.run(context.WithoutCancel(r.Context()))
+	}()
+	writeJSON(w, http.StatusAccepted, m.snapshot())
+}
+
+// getMigration handles GET /admin/migrations/{name} requests.
+// Returns the progress or final report of a migration started by this
+// process, or 404.
+func (a *App) getMigration(w http.ResponseWriter, r *http.Request) {
+	a.migrations.mu.Lock()
+	m, ok := a.migrations.byName[r.PathValue("name")]
+	a.migrations.mu.Unlock()
+	if !ok {
+		http.Error(w, "no such migration in this process", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, m.snapshot())
+}
@@ -0,0 +1,188 @@
+// Traffic mirroring. With MIRROR_URL set, a sampled MIRROR_PERCENT of POST
+// /jobs requests is copied asynchronously to the same path on that base URL —
+// a staging deployment running a new version — so it sees real traffic.
+// The production response never waits for, or depends on, the mirror: copies
+// run in the background with their own timeout, at most MIRROR_MAX_INFLIGHT
+// at once, and are dropped rather than queued when that many are pending.
+//
+// Copies carry X-Mirrored-From (this host) and X-Mirror-Token. A receiving
+// service with the same MIRROR_TOKEN trusts the mark and sets
+// Principal.Mirrored, so per-client accounting can exempt mirrored jobs;
+// without a matching token the mark is stripped, so clients cannot claim it.
+// Mirrored requests are never mirrored again. Bodies pass through the
+// SCRUB_RULES scrubber (scrub.go) before they leave; mirroring without one
+// must be allowed explicitly with MIRROR_UNSCRUBBED=true.
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Mirroring headers.
+const (
+	headerMirroredFrom = "X-Mirrored-From"
+	headerMirrorToken  = "X-Mirror-Token"
+)
+
+// mirroredHeaders are the request headers copied to the mirror. Credentials
+// are deliberately left out.
+var mirroredHeaders = []string{"Content-Type", "Accept", headerClientID, headerTenantID}
+
+// mirror copies sampled requests to a staging base URL.
+type mirror struct {
+	base    *url.URL
+	percent float64       // Share of requests mirrored, 0–100
+	token   string        // Sent as X-Mirror-Token
+	source  string        // Sent as X-Mirrored-From
+	timeout time.Duration // Per-copy deadline
+	client  *http.Client
+	scrub   *Scrubber     // Applied to every body; nil only with MIRROR_UNSCRUBBED
+	limit   int64         // MAX_BODY_BYTES: larger bodies are left to the handler to reject
+	slots   chan struct{} // Bounds copies in flight
+}
+
+// newMirror returns the configured mirror, or nil when MIRROR_URL is unset.
+// Bodies up to bodyLimit are mirrored.
+func newMirror(client *http.Client, scrub *Scrubber, bodyLimit int64) (*mirror, error) {
+	raw := getenv("MIRROR_URL")
+	if raw == "" {
+		return nil, nil
+	}
+	if scrub == nil && getenv("MIRROR_UNSCRUBBED") != "true" {
+		return nil, errors.New("MIRROR_URL needs SCRUB_RULES (or MIRROR_UNSCRUBBED=true to send raw payloads)")
+	}
+	base, err := url.Parse(raw)
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+		return nil, fmt.Errorf("MIRROR_URL must be an absolute http(s) URL, got %q", raw)
+	}
+	percent := 1.0
+	if v := getenv("MIRROR_PERCENT"); v != "" {
+		percent, err = strconv.ParseFloat(v, 64)
+		if err != nil || percent < 0 || percent > 100 {
+			return nil, fmt.Errorf("MIRROR_PERCENT must be between 0 and 100, got %q", v)
+		}
+	}
+	source, _ := os.Hostname()
+	return &mirror{
+		base:    base,
+		percent: percent,
+		token:   getenv("MIRROR_TOKEN"),
+		source:  source,
+		timeout: envDuration("MIRROR_TIMEOUT", 5*time.Second),
+		client:  client,
+		scrub:   scrub,
+		limit:   bodyLimit,
+		slots:   make(chan struct{}, max(envInt("MIRROR_MAX_INFLIGHT", 32), 1)),
+	}, nil
+}
+
+// wrap mirrors a sample of the requests to next. A nil mirror passes every
+// request straight through.
+func (m *mirror) wrap(next http.HandlerFunc) http.HandlerFunc {
+	if m == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(headerMirroredFrom) != "" || rand.Float64()*100 >= m.percent {
+			next(w, r)
+			return
+		}
+		// Buffer the body for both copies. An oversized body is put back
+		// untouched for the handler to reject, and not mirrored.
+		body, err := io.ReadAll(io.LimitReader(r.Body, m.limit+1))
+		r.Body = readCloser{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		if err != nil || int64(len(body)) > m.limit {
+			next(w, r)
+			return
+		}
+		select {
+		case m.slots <- struct{}{}:
+			ctx := context.WithoutCancel(r.Context())
+			go m.send(ctx, r.Method, r.URL, r.Header.Clone(), body)
+		default:
+			mirrorRequests.Add(r.Context(), 1, metric.WithAttributes(attribute.String("outcome", "dropped")))
+		}
+		next(w, r)
+	}
+}
+
+// send delivers one copy and releases its slot.
+func (m *mirror) send(ctx context.Context, method string, u *url.URL, header http.Header, body []byte) {
+	defer func() { <-m.slots }()
+	ctx, cancel := context.WithTimeout(ctx, m.timeout)
+	defer cancel()
+
+	target := m.base.JoinPath(u.Path)
+	target.RawQuery = u.RawQuery
+	outcome := "sent"
+	defer func() {
+		mirrorRequests.Add(ctx, 1, metric.WithAttributes(attribute.String("outcome", outcome)))
+	}()
+	if m.scrub != nil {
+		var err error
+		if body, err = m.scrub.Body(header.Get("Content-Type"), body); err != nil {
+			// Never fall back to the raw body.
+			outcome = "unscrubbable"
+			return
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target.String(), bytes.NewReader(body))
+	if err != nil {
+		outcome = "failed"
+		return
+	}
+	for _, name := range mirroredHeaders {
+		if v := header.Get(name); v != "" {
+			req.Header.Set(name, v)
+		}
+	}
+	req.Header.Set(headerMirroredFrom, m.source)
+	req.Header.Set(headerMirrorToken, m.token)
+	resp, err := m.client.Do(req)
+	if err != nil {
+		outcome = "failed"
+		slog.DebugContext(ctx, "mirror request failed", "target", m.base.Host, "error", err)
+		return
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		outcome = "failed"
+	}
+}
+
+// trustMirrored strips the mirroring mark from requests that do not carry a
+// matching MIRROR_TOKEN, so only a real mirror can set Principal.Mirrored.
+func (a *App) trustMirrored(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(headerMirroredFrom) != "" {
+			token := r.Header.Get(headerMirrorToken)
+			if a.mirrorToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(a.mirrorToken)) != 1 {
+				r.Header.Del(headerMirroredFrom)
+			}
+		}
+		r.Header.Del(headerMirrorToken)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// readCloser pairs a replacement Reader with the original body's Closer.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
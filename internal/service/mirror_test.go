@@ -0,0 +1,71 @@
+package service
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMirrorBodyLimit(t *testing.T) {
+	if err := initInstruments(); err != nil {
+		t.Fatal(err)
+	}
+	const limit = 2 << 20 // Above the 1 MiB default
+	for _, tc := range []struct {
+		name     string
+		size     int
+		mirrored bool
+	}{
+		{"under the default", 1 << 10, true},
+		{"over the default, under MAX_BODY_BYTES", 3 << 19, true},
+		{"at MAX_BODY_BYTES", limit, true},
+		{"over MAX_BODY_BYTES", limit + 1, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			copies := make(chan int, 1)
+			staging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				copies <- len(body)
+			}))
+			defer staging.Close()
+			t.Setenv("MIRROR_URL", staging.URL)
+			t.Setenv("MIRROR_UNSCRUBBED", "true")
+			t.Setenv("MIRROR_PERCENT", "100")
+			m, err := newMirror(staging.Client(), nil, limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			body := strings.Repeat("x", tc.size)
+			var handled int
+			h := m.wrap(func(w http.ResponseWriter, r *http.Request) {
+				b, _ := io.ReadAll(r.Body)
+				handled = len(b)
+			})
+			r := httptest.NewRequest(http.MethodPost, "/jobs", bytes.NewReader([]byte(body)))
+			r.Header.Set("Content-Type", "text/plain")
+			h(httptest.NewRecorder(), r)
+			if handled != tc.size {
+				t.Errorf("handler read %d bytes, want %d", handled, tc.size)
+			}
+
+			select {
+			case n := <-copies:
+				if !tc.mirrored {
+					t.Fatalf("mirrored a %d-byte body over the limit", n)
+				}
+				if n != tc.size {
+					t.Errorf("mirror received %d bytes, want %d", n, tc.size)
+				}
+			case <-time.After(time.Second):
+				if tc.mirrored {
+					t.Fatal("body was not mirrored")
+				}
+			}
+		})
+	}
+}
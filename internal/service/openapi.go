@@ -0,0 +1,523 @@
+// OpenAPI document and Swagger UI. GET /openapi.json serves an OpenAPI 3.1
+// document of every route the process registered, and GET /docs a Swagger UI
+// (embedded, no CDN) for reading it and trying requests out.
+//
+// The document is built from code when it is first requested: the paths and
+// methods from the router's registrations, so no route can be missing, and
+// the request and response schemas by reflection from the Go types the
+// handlers encode, so they follow the types as they change. What reflection
+// cannot tell — summaries, query parameters, which type each status carries —
+// comes from apiOperations, keyed by route pattern. A route without an entry
+// there is still listed, with only its path parameters and the error
+// envelope; add one when adding a route. The job API's unversioned paths
+// share their /v1 entries and are marked deprecated (versioning.go).
+//
+// Field names and required-ness follow the json tags: a field without
+// omitempty or omitzero is required. Timestamps are date-time strings.
+package service
+
+import (
+	"encoding"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	swaggerFiles "github.com/swaggo/files/v2"
+)
+
+// openAPIVersion is the OpenAPI version of the document.
+const openAPIVersion = "3.1.0"
+
+// apiOperation is what the document says about one route beyond its path.
+type apiOperation struct {
+	id         string // operationId; the name its span has
+	summary    string
+	tag        string
+	admin      bool // Needs the ADMIN_TOKEN bearer token
+	deprecated bool // Set for the unversioned paths; not in apiOperations
+	query      []apiParam
+	body       any // Value of the JSON request body type; nil for none
+	responses  []apiResponse
+}
+
+// apiParam is a query parameter.
+type apiParam struct {
+	name        string
+	typ         string // JSON Schema type
+	description string
+}
+
+// apiResponse is one documented status of an operation. Errors not listed
+// are covered by the operation's default response, the error envelope.
+type apiResponse struct {
+	status      int
+	description string
+	body        any    // Value of the JSON body type; nil for none
+	contentType string // For a body that is not JSON; body is then ignored
+}
+
+// pathParamDescriptions describe the route wildcards.
+var pathParamDescriptions = map[string]string{
+	"id":      "Job ID",
+	"name":    "Artifact or migration name",
+	"type":    "Job type",
+	"version": "Worker version (WORKER_VERSION)",
+}
+
+// apiOperations documents the routes, by pattern as registered.
+var apiOperations = map[string]apiOperation{
+	"GET /healthz": {id: "healthz", summary: "Liveness probe", tag: "health",
+		responses: []apiResponse{{status: http.StatusOK, description: "The process is up", contentType: "text/plain"}}},
+	"GET /readyz": {id: "readyz", summary: "Readiness probe: live queue and storage checks", tag: "health",
+		query: []apiParam{{name: "stage", typ: "string", description: "active: also require the worker to be past its observe stage"}},
+		responses: []apiResponse{
+			{status: http.StatusOK, description: "Ready", body: ReadinessReport{}},
+			{status: http.StatusServiceUnavailable, description: "Not ready, draining, or still observing", body: ReadinessReport{}},
+		}},
+	"GET /metrics": {id: "metrics", summary: "Metrics in the Prometheus text format", tag: "health",
+		responses: []apiResponse{{status: http.StatusOK, description: "Every instrument", contentType: "text/plain"}}},
+
+	"POST /v1/jobs": {id: "createJob", summary: "Submit a job", tag: "jobs", body: JobRequest{},
+		responses: []apiResponse{
+			{status: http.StatusCreated, description: "Accepted and enqueued", body: CreateJobResponse{}},
+			{status: http.StatusOK, description: "A duplicate or an Idempotency-Key replay of an earlier job", body: CreateJobResponse{}},
+			{status: http.StatusAccepted, description: "Accepted into the local send buffer, or with Prefer: respond-async (JOB_CREATE_RESPONSE=async): Location names the status monitor to poll", body: CreateJobResponse{}},
+		}},
+	"PUT /v1/jobs/{id}": {id: "putJob", summary: "Submit a job under the caller's own ID (CLIENT_JOB_IDS)", tag: "jobs", body: JobRequest{},
+		responses: []apiResponse{
+			{status: http.StatusCreated, description: "Accepted and enqueued", body: CreateJobResponse{}},
+			{status: http.StatusOK, description: "A repeat of the same submission; nothing enqueued", body: CreateJobResponse{}},
+			{status: http.StatusAccepted, description: "Accepted into the local send buffer", body: CreateJobResponse{}},
+		}},
+	"POST /v1/jobs/import": {id: "importJob", summary: "Register an externally computed result", tag: "jobs", admin: true, body: ImportRequest{},
+		responses: []apiResponse{{status: http.StatusCreated, description: "Stored and indexed", body: ImportResponse{}}}},
+	"POST /v1/jobs/validate": {id: "validateJob", summary: "Validate a job without submitting it", tag: "jobs", body: JobRequest{},
+		query:     []apiParam{{name: "dry_run", typ: "boolean", description: "Also run the processor on it"}},
+		responses: []apiResponse{{status: http.StatusOK, description: "The verdict", body: ValidationResponse{}}}},
+	"GET /v1/jobs": {id: "listJobs", summary: "List jobs", tag: "jobs",
+		query: []apiParam{
+			{name: "limit", typ: "integer", description: "Page size"},
+			{name: "sort", typ: "string", description: "created_at, completed_at, duration or size"},
+			{name: "order", typ: "string", description: "asc or desc (default)"},
+			{name: "view", typ: "string", description: "Apply a saved view"},
+			{name: "page_token", typ: "string", description: "next_page_token of the previous page"},
+		},
+		responses: []apiResponse{{status: http.StatusOK, description: "A page of the caller's tenant's jobs; possibly short, with a next_page_token, when the request's scan bound was reached", body: JobListResponse{}}}},
+	"GET /v1/jobs/{id}": {id: "getJob", summary: "Get a job's result, or its status until there is one", tag: "jobs",
+		query: []apiParam{{name: "tz", typ: "string", description: "IANA time zone for the *_local renderings"}},
+		responses: []apiResponse{
+			{status: http.StatusOK, description: "The result", body: JobResultView{}},
+			{status: http.StatusAccepted, description: "Not finished yet", body: JobStatus{}},
+			{status: http.StatusGone, description: "The result was purged or deleted", body: JobStatus{}},
+		}},
+	"HEAD /v1/jobs/{id}": {id: "headJob", summary: "Check whether a job's result exists", tag: "jobs",
+		responses: []apiResponse{
+			{status: http.StatusOK, description: "The result exists; ETag, Last-Modified and X-Result-Size describe it"},
+			{status: http.StatusNotFound, description: "No result yet"},
+		}},
+	"DELETE /v1/jobs/{id}": {id: "deleteJob", summary: "Cancel a job, or delete its result", tag: "jobs",
+		responses: []apiResponse{
+			{status: http.StatusAccepted, description: "Cancelled before it ran", body: JobStatus{}},
+			{status: http.StatusNoContent, description: "Its result or failure record is deleted"},
+		}},
+	"GET /v1/jobs/{id}/status": {id: "getJobStatus", summary: "Get a job's status", tag: "jobs",
+		query: []apiParam{{name: "redirect", typ: "boolean", description: "Act as the status monitor of an asynchronous create: 303 once the job is final"}},
+		responses: []apiResponse{
+			{status: http.StatusOK, description: "The status; with redirect, only while the job is under way, with Retry-After", body: JobStatus{}},
+			{status: http.StatusSeeOther, description: "With redirect, once final: Location is the result when completed, else the status without redirect (cancelled, deleted, failed after MAX_ATTEMPTS, or past SQS retention)", body: JobStatus{}},
+		}},
+	"GET /v1/jobs/{id}/download": {id: "downloadJob", summary: "Get a presigned S3 URL for a job's result", tag: "jobs",
+		responses: []apiResponse{
+			{status: http.StatusOK, description: "The URL, to fetch the result from S3 directly", body: DownloadLink{}},
+			{status: http.StatusAccepted, description: "Not finished yet", body: JobStatus{}},
+		}},
+	"GET /v1/jobs/{id}/artifacts": {id: "listArtifacts", summary: "List a job's artifacts", tag: "jobs",
+		responses: []apiResponse{{status: http.StatusOK, description: "The artifacts", body: ArtifactListResponse{}}}},
+	"GET /v1/jobs/{id}/artifacts/{name}": {id: "getArtifact", summary: "Download an artifact", tag: "jobs",
+		responses: []apiResponse{{status: http.StatusOK, description: "The artifact, with its stored content type", contentType: "application/octet-stream"}}},
+	"GET /v1/jobs/{id}/lineage": {id: "getLineage", summary: "Get a job's ancestors and descendants", tag: "jobs",
+		responses: []apiResponse{{status: http.StatusOK, description: "The lineage", body: LineageResponse{}}}},
+	"GET /v1/jobs/{id}/callback": {id: "getJobCallback", summary: "Get the delivery of a job's callback", tag: "jobs",
+		responses: []apiResponse{{status: http.StatusOK, description: "The delivery record", body: CallbackDelivery{}}}},
+	"GET /v1/ws": {id: "serveWS", summary: "WebSocket of job updates: send WSCommand messages, receive WSFrame messages", tag: "jobs",
+		responses: []apiResponse{{status: http.StatusSwitchingProtocols, description: "Upgraded to a WebSocket"}}},
+	"GET /v1/job-types": {id: "listJobTypes", summary: "List the job types and their schemas", tag: "jobs",
+		responses: []apiResponse{{status: http.StatusOK, description: "The job types", body: JobTypesResponse{}}}},
+
+	"POST /v1/views": {id: "createView", summary: "Save a job list view", tag: "views", body: ViewRequest{},
+		responses: []apiResponse{{status: http.StatusCreated, description: "The stored view", body: View{}}}},
+	"GET /v1/views": {id: "listViews", summary: "List your views and those shared in your tenant", tag: "views",
+		responses: []apiResponse{{status: http.StatusOK, description: "The views", body: ViewListResponse{}}}},
+	"GET /v1/views/{id}": {id: "getView", summary: "Get a view", tag: "views",
+		responses: []apiResponse{{status: http.StatusOK, description: "The view", body: View{}}}},
+	"DELETE /v1/views/{id}": {id: "deleteView", summary: "Delete one of your views", tag: "views",
+		responses: []apiResponse{{status: http.StatusNoContent, description: "Deleted"}}},
+
+	"GET /stats/storage": {id: "getStorageStats", summary: "Latest bucket usage scan", tag: "admin", admin: true,
+		responses: []apiResponse{{status: http.StatusOK, description: "Usage by prefix", body: StorageStats{}}}},
+	"POST /admin/janitor/run": {id: "runJanitor", summary: "Run a storage cleanup pass", tag: "admin", admin: true,
+		query:     []apiParam{{name: "dry_run", typ: "boolean", description: "false to actually delete; a dry run by default"}},
+		responses: []apiResponse{{status: http.StatusOK, description: "The report", body: JanitorReport{}}}},
+	"GET /admin/janitor/report": {id: "getJanitorReport", summary: "Last janitor report", tag: "admin", admin: true,
+		responses: []apiResponse{{status: http.StatusOK, description: "The report", body: JanitorReport{}}}},
+	"POST /admin/redrive/run": {id: "runRedrive", summary: "Move dead-lettered jobs back to the job queue", tag: "admin", admin: true,
+		query:     []apiParam{{name: "limit", typ: "integer", description: "Messages to redrive, instead of REDRIVE_BATCH"}},
+		responses: []apiResponse{{status: http.StatusOK, description: "The report", body: RedriveReport{}}}},
+	"GET /admin/redrive/report": {id: "getRedriveReport", summary: "Last redrive report", tag: "admin", admin: true,
+		responses: []apiResponse{{status: http.StatusOK, description: "The report", body: RedriveReport{}}}},
+	"GET /admin/hooks/failed": {id: "listHookFailures", summary: "Result hooks out of attempts", tag: "admin", admin: true,
+		query:     []apiParam{{name: "job_id", typ: "string", description: "Only this job's"}},
+		responses: []apiResponse{{status: http.StatusOK, description: "The failures", body: HookFailuresResponse{}}}},
+	"POST /admin/hooks/failed/retry": {id: "retryHookFailures", summary: "Retry failed result hooks", tag: "admin", admin: true,
+		query:     []apiParam{{name: "job_id", typ: "string", description: "Only this job's"}},
+		responses: []apiResponse{{status: http.StatusOK, description: "What was requeued", body: HookRetryResponse{}}}},
+	"POST /admin/migrations": {id: "startMigration", summary: "Start a storage migration", tag: "admin", admin: true, body: MigrationRequest{},
+		responses: []apiResponse{{status: http.StatusAccepted, description: "Started", body: MigrationReport{}}}},
+	"GET /admin/migrations/{name}": {id: "getMigration", summary: "Progress of a migration", tag: "admin", admin: true,
+		responses: []apiResponse{{status: http.StatusOK, description: "The report", body: MigrationReport{}}}},
+	"POST /admin/reconciler/run": {id: "runReconciler", summary: "Run a reconciliation pass", tag: "admin", admin: true,
+		query:     []apiParam{{name: "repair", typ: "boolean", description: "false to only report drift"}},
+		responses: []apiResponse{{status: http.StatusOK, description: "The report", body: ReconcileReport{}}}},
+	"GET /admin/reconciler/report": {id: "getReconcileReport", summary: "Last reconciler report", tag: "admin", admin: true,
+		responses: []apiResponse{{status: http.StatusOK, description: "The report", body: ReconcileReport{}}}},
+	"GET /admin/throughput": {id: "getThroughput", summary: "Job throughput over a window", tag: "admin", admin: true,
+		query: []apiParam{
+			{name: "window", typ: "string", description: "Duration, e.g. 1h"},
+			{name: "format", typ: "string", description: "prometheus for the text format"},
+		},
+		responses: []apiResponse{{status: http.StatusOK, description: "The report", body: ThroughputReport{}}}},
+	"POST /admin/jobs/{id}/restore": {id: "restoreJob", summary: "Restore an archived result", tag: "admin", admin: true,
+		responses: []apiResponse{
+			{status: http.StatusAccepted, description: "Restore started", body: RestoreInfo{}},
+			{status: http.StatusOK, description: "Already restoring or restored", body: RestoreInfo{}},
+		}},
+	"GET /admin/job-types/flags": {id: "getJobTypeFlags", summary: "Job types disabled at runtime", tag: "admin", admin: true,
+		responses: []apiResponse{{status: http.StatusOK, description: "The flags", body: JobTypeFlags{}}}},
+	"PUT /admin/job-types/{type}/disabled": {id: "disableJobType", summary: "Disable a job type", tag: "admin", admin: true, body: DisableJobTypeRequest{},
+		responses: []apiResponse{{status: http.StatusOK, description: "Disabled", body: DisabledJobType{}}}},
+	"DELETE /admin/job-types/{type}/disabled": {id: "enableJobType", summary: "Enable a job type and requeue its parked messages", tag: "admin", admin: true,
+		responses: []apiResponse{{status: http.StatusOK, description: "Enabled", body: EnableJobTypeResponse{}}}},
+	"POST /admin/processors/{type}/test": {id: "testProcessor", summary: "Run a processor on a sample", tag: "admin", admin: true, body: JobRequest{},
+		responses: []apiResponse{{status: http.StatusOK, description: "Its output and timing", body: ProcessorTestResponse{}}}},
+	"GET /admin/diagnostics": {id: "getDiagnostics", summary: "Diagnostics bundle of this process", tag: "admin", admin: true,
+		responses: []apiResponse{{status: http.StatusOK, description: "A zip attachment", contentType: "application/zip"}}},
+	"POST /admin/diagnostics/profile": {id: "captureProfile", summary: "Capture profiles to S3", tag: "admin", admin: true,
+		query:     []apiParam{{name: "duration", typ: "string", description: "CPU profile and trace length, e.g. 30s"}},
+		responses: []apiResponse{{status: http.StatusAccepted, description: "Capture started", body: ProfileCaptureResponse{}}}},
+	"GET /admin/clock": {id: "getClock", summary: "Clock skew against the trusted time source", tag: "admin", admin: true,
+		responses: []apiResponse{{status: http.StatusOK, description: "The report", body: ClockReport{}}}},
+	"GET /admin/worker-stage": {id: "getWorkerStage", summary: "This worker's stage and what it observed", tag: "admin", admin: true,
+		responses: []apiResponse{{status: http.StatusOK, description: "The report", body: WorkerStageReport{}}}},
+	"GET /admin/worker-versions": {id: "getWorkerVersions", summary: "Promoted worker versions", tag: "admin", admin: true,
+		responses: []apiResponse{{status: http.StatusOK, description: "The promotions", body: WorkerVersionFlags{}}}},
+	"POST /admin/worker-versions/{version}/promote": {id: "promoteWorkerVersion", summary: "Promote a worker version's observers to processing", tag: "admin", admin: true,
+		responses: []apiResponse{{status: http.StatusOK, description: "Promoted", body: PromotedWorkerVersion{}}}},
+	"GET /admin/budgets": {id: "getBudgets", summary: "Today's AWS usage against the budgets", tag: "admin", admin: true,
+		responses: []apiResponse{{status: http.StatusOK, description: "The report", body: BudgetReport{}}}},
+	"GET /admin/config": {id: "getConfig", summary: "Effective settings", tag: "admin", admin: true,
+		responses: []apiResponse{{status: http.StatusOK, description: "Every setting read", body: ConfigReport{}}}},
+
+	"GET /openapi.json": {id: "getOpenAPI", summary: "This document", tag: "docs",
+		responses: []apiResponse{{status: http.StatusOK, description: "OpenAPI document", contentType: "application/json"}}},
+	"GET /docs": {id: "getDocs", summary: "Swagger UI for this document", tag: "docs",
+		responses: []apiResponse{{status: http.StatusOK, description: "HTML page", contentType: "text/html"}}},
+}
+
+// registerDocs registers GET /openapi.json and the Swagger UI on mux. The
+// document covers whatever mux holds when it is first requested.
+func (a *App) registerDocs(mux *router) {
+	doc := sync.OnceValues(func() ([]byte, error) {
+		return json.Marshal(buildOpenAPI(mux.patterns, a.startup.Version))
+	})
+	mux.HandleFunc("GET /openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		body, err := doc()
+		if err != nil {
+			http.Error(w, "failed to build the OpenAPI document", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	})
+	mux.HandleFunc("GET /docs", serveSwaggerUI)
+	mux.HandleFunc("GET /docs/{file}", serveSwaggerAsset)
+}
+
+// swaggerUIPage is GET /docs: Swagger UI on the document, with assets from
+// GET /docs/{file}. URLs are relative, so it works behind a path prefix.
+const swaggerUIPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>API documentation</title>
+<link rel="stylesheet" href="docs/swagger-ui.css">
+<link rel="icon" type="image/png" href="docs/favicon-32x32.png">
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="docs/swagger-ui-bundle.js"></script>
+<script src="docs/swagger-ui-standalone-preset.js"></script>
+<script>
+window.ui = SwaggerUIBundle({
+  url: "openapi.json",
+  dom_id: "#swagger-ui",
+  deepLinking: true,
+  presets: [SwaggerUIBundle.presets.apis, SwaggerUIStandalonePreset],
+  layout: "StandaloneLayout"
+});
+</script>
+</body>
+</html>
+`
+
+// serveSwaggerUI handles GET /docs requests.
+func serveSwaggerUI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(swaggerUIPage))
+}
+
+// serveSwaggerAsset handles GET /docs/{file} requests: the embedded Swagger
+// UI scripts, styles and icons.
+func serveSwaggerAsset(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("file")
+	switch {
+	case strings.HasSuffix(name, ".js"), strings.HasSuffix(name, ".css"), strings.HasSuffix(name, ".png"):
+	default:
+		// index.html and the initializer would show the upstream demo.
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	body, err := swaggerFiles.FS.Open(name)
+	if err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	body.Close()
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	http.ServeFileFS(w, r, swaggerFiles.FS, name)
+}
+
+// buildOpenAPI returns the OpenAPI document of the routes registered as
+// patterns.
+func buildOpenAPI(patterns []string, version string) map[string]any {
+	g := &schemaGen{components: map[string]any{}}
+	errSchema := g.schema(reflect.TypeFor[ErrorBody]())
+	registered := map[string]bool{}
+	for _, pattern := range patterns {
+		registered[pattern] = true
+	}
+	paths := map[string]map[string]any{}
+	for _, pattern := range patterns {
+		method, path, ok := strings.Cut(pattern, " ")
+		if !ok {
+			// A pattern for every method; documented as GET.
+			method, path = http.MethodGet, pattern
+		}
+		path = strings.TrimSuffix(path, "{$}")
+		op := apiOperations[pattern]
+		if current := method + " " + apiV1 + path; registered[current] {
+			// An unversioned path of the job API (versioning.go).
+			op = apiOperations[current]
+			op.deprecated = true
+			if op.id != "" {
+				op.id += "Unversioned"
+			}
+		}
+		item := paths[openAPIPath(path)]
+		if item == nil {
+			item = map[string]any{}
+			paths[openAPIPath(path)] = item
+		}
+		item[strings.ToLower(method)] = g.operation(op, path, errSchema)
+	}
+	return map[string]any{
+		"openapi": openAPIVersion,
+		"info": map[string]any{
+			"title":       "Job processing API",
+			"version":     version,
+			"description": "Submit text jobs, follow their progress and fetch their results. Errors use the envelope {\"error\":{\"code\",\"message\",…}}.",
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": g.components,
+			"securitySchemes": map[string]any{
+				"adminToken": map[string]any{"type": "http", "scheme": "bearer", "description": "ADMIN_TOKEN"},
+			},
+		},
+	}
+}
+
+// openAPIPath returns a mux path with its wildcards as OpenAPI parameters:
+// {name...} becomes {name}.
+func openAPIPath(path string) string {
+	return strings.ReplaceAll(path, "...}", "}")
+}
+
+// operation returns the OpenAPI operation of op on path.
+func (g *schemaGen) operation(op apiOperation, path string, errSchema map[string]any) map[string]any {
+	out := map[string]any{}
+	if op.id != "" {
+		out["operationId"] = op.id
+	}
+	if op.summary != "" {
+		out["summary"] = op.summary
+	}
+	if op.tag != "" {
+		out["tags"] = []string{op.tag}
+	}
+	if op.deprecated {
+		out["deprecated"] = true
+	}
+	if op.admin {
+		out["security"] = []map[string][]string{{"adminToken": {}}}
+	}
+	var params []map[string]any
+	for _, seg := range strings.Split(path, "/") {
+		if !strings.HasPrefix(seg, "{") || seg == "{$}" {
+			continue
+		}
+		name := strings.TrimSuffix(strings.Trim(seg, "{}"), "...")
+		p := map[string]any{"name": name, "in": "path", "required": true, "schema": map[string]any{"type": "string"}}
+		if d := pathParamDescriptions[name]; d != "" {
+			if name == "id" && strings.HasPrefix(unversionedPath(path), "/views/") {
+				d = "View ID"
+			}
+			p["description"] = d
+		}
+		params = append(params, p)
+	}
+	for _, q := range op.query {
+		params = append(params, map[string]any{
+			"name": q.name, "in": "query", "description": q.description, "schema": map[string]any{"type": q.typ},
+		})
+	}
+	if len(params) > 0 {
+		out["parameters"] = params
+	}
+	if op.body != nil {
+		out["requestBody"] = map[string]any{
+			"required": true,
+			"content":  map[string]any{"application/json": map[string]any{"schema": g.schema(reflect.TypeOf(op.body))}},
+		}
+	}
+	responses := map[string]any{
+		"default": map[string]any{
+			"description": "Error",
+			"content":     map[string]any{"application/json": map[string]any{"schema": errSchema}},
+		},
+	}
+	for _, r := range op.responses {
+		resp := map[string]any{"description": r.description}
+		switch {
+		case r.contentType != "":
+			resp["content"] = map[string]any{r.contentType: map[string]any{}}
+		case r.body != nil:
+			resp["content"] = map[string]any{"application/json": map[string]any{"schema": g.schema(reflect.TypeOf(r.body))}}
+		}
+		responses[strconv.Itoa(r.status)] = resp
+	}
+	out["responses"] = responses
+	return out
+}
+
+// schemaGen builds JSON Schemas of Go types, collecting named struct types
+// as components.
+type schemaGen struct {
+	components map[string]any
+}
+
+// Types with schemas of their own rather than their Go shape.
+var (
+	timestampType     = reflect.TypeFor[Timestamp]()
+	rawMessageType    = reflect.TypeFor[json.RawMessage]()
+	textMarshalerType = reflect.TypeFor[encoding.TextMarshaler]()
+)
+
+// schema returns the JSON Schema of t: a $ref for named structs, inline
+// otherwise.
+func (g *schemaGen) schema(t reflect.Type) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch {
+	case t == timestampType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case t == rawMessageType:
+		return map[string]any{}
+	case t.Implements(textMarshalerType):
+		return map[string]any{"type": "string"}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "contentEncoding": "base64"}
+		}
+		return map[string]any{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.object(t)
+		}
+		if _, ok := g.components[t.Name()]; !ok {
+			g.components[t.Name()] = map[string]any{} // Placeholder for recursive types
+			g.components[t.Name()] = g.object(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return map[string]any{}
+}
+
+// object returns the schema of struct type t, following encoding/json:
+// embedded structs are flattened and fields tagged "-" left out.
+func (g *schemaGen) object(t reflect.Type) map[string]any {
+	props := map[string]any{}
+	var required []string
+	var walk func(t reflect.Type)
+	walk = func(t reflect.Type) {
+		for f := range t.Fields() {
+			tag := f.Tag.Get("json")
+			if tag == "-" || (!f.IsExported() && !f.Anonymous) {
+				continue
+			}
+			name, opts, _ := strings.Cut(tag, ",")
+			if f.Anonymous && name == "" {
+				ft := f.Type
+				if ft.Kind() == reflect.Pointer {
+					ft = ft.Elem()
+				}
+				if ft.Kind() == reflect.Struct {
+					walk(ft)
+					continue
+				}
+			}
+			if !f.IsExported() {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			props[name] = g.schema(f.Type)
+			if !strings.Contains(opts, "omitempty") && !strings.Contains(opts, "omitzero") {
+				required = append(required, name)
+			}
+		}
+	}
+	walk(t)
+	s := map[string]any{"type": "object", "properties": props}
+	if len(required) > 0 {
+		s["required"] = required
+	}
+	return s
+}
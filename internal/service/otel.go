@@ -0,0 +1,596 @@
+// OpenTelemetry wiring for the service: tracer/meter providers, OTLP exporters
+// pointed at the ADOT collector sidecar, X-Ray-compatible trace IDs and
+// propagation, an ECS resource detector, the metric instruments and their
+// optional Prometheus endpoint. (Trace
+// context crosses the SQS hop in the message envelope, envelope.go.) Kept
+// separate from main.go because it is a distinct concern with its own
+// dependency surface.
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/contrib/detectors/aws/ecs"
+	"go.opentelemetry.io/contrib/propagators/aws/xray"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	otelprom "go.opentelemetry.io/otel/exporters/prometheus"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationScope names the tracer/meter so telemetry is attributable to
+// this service.
+const instrumentationScope = "go-microservice"
+
+// setupLogging installs a JSON slog handler as the default logger, wrapped so
+// that records carrying a recording span also get trace_id/span_id, and
+// warnings and errors are kept for diagnostics bundles (diagbundle.go). Call
+// once, before anything logs.
+func setupLogging() {
+	base := slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelInfo})
+	slog.SetDefault(slog.New(&traceHandler{&sampleHandler{Handler: base}}))
+}
+
+// traceHandler decorates a slog.Handler, adding the current trace_id/span_id
+// (when a valid span is in the record's context) so logs correlate with traces.
+// Use the *Context log variants (slog.InfoContext, slog.ErrorContext, ...) to
+// feed it the span-carrying context.
+type traceHandler struct{ slog.Handler }
+
+func (h *traceHandler) Handle(ctx context.Context, r slog.Record) error {
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		// X-Ray-formatted trace id (1-{8 hex}-{24 hex}) so log lines join to the
+		// trace in X-Ray / CloudWatch rather than the raw 32-hex OTel form.
+		r.AddAttrs(
+			slog.String("trace_id", xrayTraceID(sc.TraceID())),
+			slog.String("span_id", sc.SpanID().String()),
+		)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *traceHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &traceHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h *traceHandler) WithGroup(name string) slog.Handler {
+	return &traceHandler{h.Handler.WithGroup(name)}
+}
+
+// xrayTraceID renders an OpenTelemetry trace ID in AWS X-Ray's textual form:
+// "1-" + first 8 hex digits + "-" + the remaining 24. The X-Ray ID generator
+// puts the request epoch in those first 8 digits, so this is the value X-Ray and
+// CloudWatch use to key a trace.
+func xrayTraceID(t trace.TraceID) string {
+	s := t.String() // 32 lowercase hex chars
+	return "1-" + s[0:8] + "-" + s[8:32]
+}
+
+// tracer is the package-wide tracer. It delegates to the global provider, so it
+// picks up the real provider installed by setupOTel (and is a safe no-op until
+// then).
+var tracer = otel.Tracer(instrumentationScope)
+
+// Metric instruments, initialised by initInstruments. They bind to whatever
+// MeterProvider is global at init time (the real one after setupOTel, otherwise
+// a no-op), so call sites never need nil checks.
+var (
+	jobsCreated           metric.Int64Counter
+	jobProcessingDuration metric.Float64Histogram
+	jobsProcessed         metric.Int64Counter
+	jobFailures           metric.Int64Counter
+	s3Errors              metric.Int64Counter
+	sqsErrors             metric.Int64Counter
+	brokerPublished       metric.Int64Counter
+	brokerDelivered       metric.Int64Counter
+	brokerEvictions       metric.Int64Counter
+	brokerSubscribers     metric.Int64UpDownCounter
+	createCompensations   metric.Int64Counter
+	reconcileDrift        metric.Int64Gauge
+	reconcileRepairs      metric.Int64Counter
+	mirrorRequests        metric.Int64Counter
+	shedRequests          metric.Int64Counter
+	shedLevel             metric.Int64Gauge
+	resultReads           metric.Int64Counter
+	resultPrefetches      metric.Int64Counter
+	throttleEngaged       metric.Int64Gauge
+	throttleWorkers       metric.Int64Gauge
+	throttleCPU           metric.Float64Gauge
+	throttleRSS           metric.Int64Gauge
+	throttleRejections    metric.Int64Counter
+	heldJobs              metric.Int64Counter
+	hookRuns              metric.Int64Counter
+	breakerTransitions    metric.Int64Counter
+	breakerRejections     metric.Int64Counter
+	storageDivergence     metric.Int64Counter
+	streamRecords         metric.Int64Counter
+	rateLimited           metric.Int64Counter
+	callbackDeliveries    metric.Int64Counter
+	tailSampled           metric.Int64Counter
+	wsConnections         metric.Int64UpDownCounter
+	wsFrames              metric.Int64Counter
+	legacyRequests        metric.Int64Counter
+	budgetConsumed        metric.Int64Counter
+	budgetAlerts          metric.Int64Counter
+	loopsDetected         metric.Int64Counter
+	awsTimeoutsHit        metric.Int64Counter
+	workerObserved        metric.Int64Counter
+	messagesOffloaded     metric.Int64Counter
+	messageAge            metric.Float64Histogram
+	messageReceiveCount   metric.Int64Histogram
+	tenantDispatched      metric.Int64Counter
+	tenantInFlight        metric.Int64UpDownCounter
+	tenantStaged          metric.Int64UpDownCounter
+	tenantReleased        metric.Int64Counter
+	tenantStageWait       metric.Float64Histogram
+)
+
+// metricsHandler serves every instrument in the Prometheus text format at
+// GET /metrics; nil unless PROMETHEUS_METRICS=true and setupOTel succeeded.
+var metricsHandler http.Handler
+
+// metricsReader reads every instrument on demand, for diagnostics bundles;
+// nil unless setupOTel succeeded.
+var metricsReader *sdkmetric.ManualReader
+
+// setupOTel installs global trace and metric providers that export via OTLP/gRPC
+// to the ADOT collector sidecar (endpoint taken from OTEL_EXPORTER_OTLP_ENDPOINT,
+// defaulting to localhost:4317). Traces use X-Ray-compatible IDs and the X-Ray
+// propagator so they show up correctly in X-Ray and propagate across SQS.
+//
+// With PROMETHEUS_METRICS=true the same instruments are also exposed for
+// scraping (metricsHandler), alongside the OTLP export. A non-nil sampling
+// replaces the SDK's sampler with latency-based sampling (tailsample.go).
+//
+// It returns a shutdown function that flushes and stops both providers. Exporter
+// creation does not dial eagerly, so this succeeds even when the collector is not
+// yet reachable.
+func setupOTel(ctx context.Context, sampling *tailSampling) (func(context.Context) error, error) {
+	// resource.New returns a usable resource even when a detector fails (e.g. the
+	// ECS detector when running off-ECS), so detector errors here are non-fatal.
+	res, err := resource.New(ctx,
+		resource.WithDetectors(ecs.NewResourceDetector()),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+		resource.WithAttributes(semconv.ServiceName(instrumentationScope)),
+	)
+	if res == nil {
+		res = resource.Default()
+	}
+	_ = err // partial resource detection is expected off-ECS
+
+	traceExp, err := otlptracegrpc.New(ctx, otlptracegrpc.WithInsecure())
+	if err != nil {
+		return nil, fmt.Errorf("otlp trace exporter: %w", err)
+	}
+	tpOpts := []sdktrace.TracerProviderOption{
+		sdktrace.WithResource(res),
+		sdktrace.WithIDGenerator(xray.NewIDGenerator()),
+	}
+	if sampling != nil {
+		// Deliveries are decided when they end (tailsample.go).
+		tpOpts = append(tpOpts,
+			sdktrace.WithSampler(sampling.sampler()),
+			sdktrace.WithSpanProcessor(sampling.processor(sdktrace.NewBatchSpanProcessor(traceExp))))
+	} else {
+		tpOpts = append(tpOpts, sdktrace.WithBatcher(traceExp))
+	}
+	tp := sdktrace.NewTracerProvider(tpOpts...)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(xray.Propagator{})
+
+	metricExp, err := otlpmetricgrpc.New(ctx, otlpmetricgrpc.WithInsecure())
+	if err != nil {
+		return nil, fmt.Errorf("otlp metric exporter: %w", err)
+	}
+	opts := []sdkmetric.Option{
+		sdkmetric.WithResource(res),
+		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(metricExp)),
+	}
+	if getenv("PROMETHEUS_METRICS") == "true" {
+		// A private registry, so /metrics carries exactly the OTel instruments.
+		reg := prometheus.NewRegistry()
+		promExp, err := otelprom.New(otelprom.WithRegisterer(reg))
+		if err != nil {
+			return nil, fmt.Errorf("prometheus exporter: %w", err)
+		}
+		opts = append(opts, sdkmetric.WithReader(promExp))
+		metricsHandler = promhttp.HandlerFor(reg, promhttp.HandlerOpts{})
+	}
+	reader := sdkmetric.NewManualReader()
+	opts = append(opts, sdkmetric.WithReader(reader))
+	mp := sdkmetric.NewMeterProvider(opts...)
+	metricsReader = reader
+	otel.SetMeterProvider(mp)
+
+	shutdown := func(ctx context.Context) error {
+		return errors.Join(tp.Shutdown(ctx), mp.Shutdown(ctx))
+	}
+	return shutdown, nil
+}
+
+// initInstruments creates the metric instruments from the global meter. Safe to
+// call even if setupOTel failed — it then binds to no-op instruments.
+func initInstruments() error {
+	m := otel.Meter(instrumentationScope)
+	var err error
+	if jobsCreated, err = m.Int64Counter(
+		"jobs.created",
+		metric.WithDescription("Number of jobs accepted via POST /jobs"),
+		metric.WithUnit("{job}"),
+	); err != nil {
+		return err
+	}
+	if jobProcessingDuration, err = m.Float64Histogram(
+		"job.processing.duration",
+		metric.WithDescription("Time to process a job in the worker"),
+		metric.WithUnit("s"),
+	); err != nil {
+		return err
+	}
+	if jobsProcessed, err = m.Int64Counter(
+		"jobs.processed",
+		metric.WithDescription("Messages the worker handled, by outcome (completed, failed)"),
+		metric.WithUnit("{job}"),
+	); err != nil {
+		return err
+	}
+	if jobFailures, err = m.Int64Counter(
+		"job.failures",
+		metric.WithDescription("Failed job attempts; final=true when the worker gave up on the job"),
+		metric.WithUnit("{attempt}"),
+	); err != nil {
+		return err
+	}
+	if s3Errors, err = m.Int64Counter(
+		"s3.errors",
+		metric.WithDescription("Failed S3 calls by operation and error kind"),
+		metric.WithUnit("{error}"),
+	); err != nil {
+		return err
+	}
+	if sqsErrors, err = m.Int64Counter(
+		"sqs.errors",
+		metric.WithDescription("Failed SQS calls by operation"),
+		metric.WithUnit("{error}"),
+	); err != nil {
+		return err
+	}
+	if breakerTransitions, err = m.Int64Counter(
+		"aws.breaker.transitions",
+		metric.WithDescription("AWS circuit breakers opening or closing, by service (SQS, S3) and state (open, closed)"),
+		metric.WithUnit("{transition}"),
+	); err != nil {
+		return err
+	}
+	if breakerRejections, err = m.Int64Counter(
+		"aws.breaker.rejected",
+		metric.WithDescription("AWS calls failed at once by an open circuit breaker, by service"),
+		metric.WithUnit("{call}"),
+	); err != nil {
+		return err
+	}
+	if budgetConsumed, err = m.Int64Counter(
+		"aws.budget.consumed",
+		metric.WithDescription("AWS usage counted against the daily budgets, by budget (sqs_calls, s3_calls in calls; transfer_bytes in bytes)"),
+		metric.WithUnit("1"),
+	); err != nil {
+		return err
+	}
+	if budgetAlerts, err = m.Int64Counter(
+		"aws.budget.alerts",
+		metric.WithDescription("Daily AWS budgets crossing a threshold, by budget and level (warning, exhausted)"),
+		metric.WithUnit("{alert}"),
+	); err != nil {
+		return err
+	}
+	if loopsDetected, err = m.Int64Counter(
+		"loops.detected",
+		metric.WithDescription("Worker busy loops detected and broken, by kind (receive_errors, fast_empty_receives, cycling_message)"),
+		metric.WithUnit("{loop}"),
+	); err != nil {
+		return err
+	}
+	if messageAge, err = m.Float64Histogram(
+		"queue.message.age",
+		metric.WithDescription("Time from a message being sent to the worker receiving it, by redelivered"),
+		metric.WithUnit("s"),
+	); err != nil {
+		return err
+	}
+	if messageReceiveCount, err = m.Int64Histogram(
+		"queue.message.receive_count",
+		metric.WithDescription("SQS receive count of the messages the worker receives, by redelivered"),
+		metric.WithUnit("{delivery}"),
+	); err != nil {
+		return err
+	}
+	if workerObserved, err = m.Int64Counter(
+		"worker.observed",
+		metric.WithDescription("Messages an observing worker validated without processing, by outcome (valid, invalid) and reason"),
+		metric.WithUnit("{message}"),
+	); err != nil {
+		return err
+	}
+	if messagesOffloaded, err = m.Int64Counter(
+		"queue.messages.offloaded",
+		metric.WithDescription("Sent message bodies stored in S3 and replaced by an Extended Client pointer, by reason (size_limit, threshold)"),
+		metric.WithUnit("{message}"),
+	); err != nil {
+		return err
+	}
+	if awsTimeoutsHit, err = m.Int64Counter(
+		"aws.timeouts",
+		metric.WithDescription("AWS calls cut off by their operation timeout, by operation"),
+		metric.WithUnit("{call}"),
+	); err != nil {
+		return err
+	}
+	if storageDivergence, err = m.Int64Counter(
+		"storage.dual.divergence",
+		metric.WithDescription("Dual-write differences between the new and old store, by kind (fallback, mirror_failed, mismatch) and key prefix"),
+		metric.WithUnit("{object}"),
+	); err != nil {
+		return err
+	}
+	if rateLimited, err = m.Int64Counter(
+		"jobs.rate_limited",
+		metric.WithDescription("POST /jobs submissions refused by a rate limit, by scope (global, client)"),
+		metric.WithUnit("{request}"),
+	); err != nil {
+		return err
+	}
+	if tailSampled, err = m.Int64Counter(
+		"traces.tail_sampled",
+		metric.WithDescription("Job deliveries whose traces were kept or dropped by latency-based sampling, by decision (slow_processing, slow_queue_wait, error, baseline, dropped)"),
+		metric.WithUnit("{delivery}"),
+	); err != nil {
+		return err
+	}
+	if tenantDispatched, err = m.Int64Counter(
+		"scheduler.tenant.dispatched",
+		metric.WithDescription("Messages handed to a worker by the fair scheduler, by tenant"),
+		metric.WithUnit("{message}"),
+	); err != nil {
+		return err
+	}
+	if tenantInFlight, err = m.Int64UpDownCounter(
+		"scheduler.tenant.in_flight",
+		metric.WithDescription("Messages being processed, by tenant, under fair scheduling"),
+		metric.WithUnit("{message}"),
+	); err != nil {
+		return err
+	}
+	if tenantStaged, err = m.Int64UpDownCounter(
+		"scheduler.tenant.staged",
+		metric.WithDescription("Received messages waiting in the fair scheduler's staging buffer, by tenant"),
+		metric.WithUnit("{message}"),
+	); err != nil {
+		return err
+	}
+	if tenantReleased, err = m.Int64Counter(
+		"scheduler.tenant.released",
+		metric.WithDescription("Received messages of a tenant at its TENANT_MAX_IN_FLIGHT cap released back to the queue rather than staged, by tenant"),
+		metric.WithUnit("{message}"),
+	); err != nil {
+		return err
+	}
+	if tenantStageWait, err = m.Float64Histogram(
+		"scheduler.tenant.stage_wait",
+		metric.WithDescription("Time a received message waited in staging before a worker took it, by tenant"),
+		metric.WithUnit("s"),
+	); err != nil {
+		return err
+	}
+	if wsConnections, err = m.Int64UpDownCounter(
+		"websocket.connections",
+		metric.WithDescription("Open /ws connections"),
+		metric.WithUnit("{connection}"),
+	); err != nil {
+		return err
+	}
+	if wsFrames, err = m.Int64Counter(
+		"websocket.frames",
+		metric.WithDescription("Frames sent on /ws connections, by type (status, event, error)"),
+		metric.WithUnit("{frame}"),
+	); err != nil {
+		return err
+	}
+	if legacyRequests, err = m.Int64Counter(
+		"api.legacy_requests",
+		metric.WithDescription("Requests to the job API's unversioned paths, by route"),
+		metric.WithUnit("{request}"),
+	); err != nil {
+		return err
+	}
+	if callbackDeliveries, err = m.Int64Counter(
+		"callbacks.deliveries",
+		metric.WithDescription("Job completion callback attempts, by outcome (delivered, retrying, rejected)"),
+		metric.WithUnit("{request}"),
+	); err != nil {
+		return err
+	}
+	if streamRecords, err = m.Int64Counter(
+		"events.stream.records",
+		metric.WithDescription("Events for the Firehose stream, by kind (job, audit) and outcome (delivered, fallback, dropped, lost)"),
+		metric.WithUnit("{event}"),
+	); err != nil {
+		return err
+	}
+	if brokerPublished, err = m.Int64Counter(
+		"broker.events.published",
+		metric.WithDescription("Job lifecycle events published on the in-process broker"),
+		metric.WithUnit("{event}"),
+	); err != nil {
+		return err
+	}
+	if brokerDelivered, err = m.Int64Counter(
+		"broker.events.delivered",
+		metric.WithDescription("Job lifecycle events buffered for a subscriber"),
+		metric.WithUnit("{event}"),
+	); err != nil {
+		return err
+	}
+	if brokerEvictions, err = m.Int64Counter(
+		"broker.evictions",
+		metric.WithDescription("Subscribers dropped because their buffer was full"),
+		metric.WithUnit("{subscriber}"),
+	); err != nil {
+		return err
+	}
+	if brokerSubscribers, err = m.Int64UpDownCounter(
+		"broker.subscribers",
+		metric.WithDescription("Current event broker subscribers"),
+		metric.WithUnit("{subscriber}"),
+	); err != nil {
+		return err
+	}
+	if createCompensations, err = m.Int64Counter(
+		"jobs.create.compensations",
+		metric.WithDescription("POST /jobs writes rolled back after a failed enqueue, by outcome"),
+		metric.WithUnit("{job}"),
+	); err != nil {
+		return err
+	}
+	if reconcileDrift, err = m.Int64Gauge(
+		"reconciler.drift",
+		metric.WithDescription("Inconsistencies found by the last reconciler run, by kind"),
+		metric.WithUnit("{job}"),
+	); err != nil {
+		return err
+	}
+	if reconcileRepairs, err = m.Int64Counter(
+		"reconciler.repairs",
+		metric.WithDescription("Inconsistencies repaired by the reconciler"),
+		metric.WithUnit("{job}"),
+	); err != nil {
+		return err
+	}
+	if resultReads, err = m.Int64Counter(
+		"results.reads",
+		metric.WithDescription("GET /jobs/{id} result reads by source: hit (cache), miss (own S3 read), coalesced (shared S3 read)"),
+		metric.WithUnit("{read}"),
+	); err != nil {
+		return err
+	}
+	if resultPrefetches, err = m.Int64Counter(
+		"results.prefetches",
+		metric.WithDescription("Results read into the cache on job completion, by outcome: prefetched, cached, skipped, failed"),
+		metric.WithUnit("{result}"),
+	); err != nil {
+		return err
+	}
+	if shedRequests, err = m.Int64Counter(
+		"shed.requests",
+		metric.WithDescription("Requests rejected by the load shedder, by priority"),
+		metric.WithUnit("{request}"),
+	); err != nil {
+		return err
+	}
+	if shedLevel, err = m.Int64Gauge(
+		"shed.level",
+		metric.WithDescription("Load shedding level: 0 sheds nothing, 1 low, 2 normal and below, 3 high and below"),
+		metric.WithUnit("{level}"),
+	); err != nil {
+		return err
+	}
+	if throttleEngaged, err = m.Int64Gauge(
+		"throttle.engaged",
+		metric.WithDescription("Intake throttle state: 1 while over a resource watermark, else 0"),
+		metric.WithUnit("{state}"),
+	); err != nil {
+		return err
+	}
+	if throttleWorkers, err = m.Int64Gauge(
+		"throttle.worker_concurrency",
+		metric.WithDescription("Messages the worker may process at once under the intake throttle"),
+		metric.WithUnit("{message}"),
+	); err != nil {
+		return err
+	}
+	if throttleCPU, err = m.Float64Gauge(
+		"throttle.cpu",
+		metric.WithDescription("Process CPU use over the last throttle interval, as a share of GOMAXPROCS"),
+		metric.WithUnit("1"),
+	); err != nil {
+		return err
+	}
+	if throttleRSS, err = m.Int64Gauge(
+		"throttle.rss",
+		metric.WithDescription("Process resident memory at the last throttle sample"),
+		metric.WithUnit("By"),
+	); err != nil {
+		return err
+	}
+	if throttleRejections, err = m.Int64Counter(
+		"throttle.rejected",
+		metric.WithDescription("Inline processing requests refused by the intake throttle, by endpoint"),
+		metric.WithUnit("{request}"),
+	); err != nil {
+		return err
+	}
+	if heldJobs, err = m.Int64Counter(
+		"jobs.held",
+		metric.WithDescription("Messages of disabled job types taken off the queue unprocessed, by type and action (requeue, park)"),
+		metric.WithUnit("{message}"),
+	); err != nil {
+		return err
+	}
+	if hookRuns, err = m.Int64Counter(
+		"hooks.runs",
+		metric.WithDescription("Result hook runs, by hook and outcome (ok, retry, failed)"),
+		metric.WithUnit("{run}"),
+	); err != nil {
+		return err
+	}
+	if mirrorRequests, err = m.Int64Counter(
+		"mirror.requests",
+		metric.WithDescription("POST /jobs copies sent to the mirror, by outcome (sent, failed, dropped, unscrubbable)"),
+		metric.WithUnit("{request}"),
+	); err != nil {
+		return err
+	}
+	return nil
+}
+
+// recordSQSError counts one failed SQS call.
+func recordSQSError(ctx context.Context, op string) {
+	sqsErrors.Add(ctx, 1, metric.WithAttributes(attribute.String("operation", op)))
+}
+
+// startConsumerSpan starts the span for one delivery of message from the
+// queue at queueURL, as a child of the trace in ctx (the envelope's), with the
+// OpenTelemetry messaging attributes and the message's time in the queue.
+func startConsumerSpan(ctx context.Context, queueURL string, message sqstypes.Message, attempt int) (context.Context, trace.Span) {
+	queue := path.Base(queueURL)
+	attrs := []attribute.KeyValue{
+		semconv.MessagingSystemAWSSqs,
+		semconv.MessagingOperationTypeDeliver, // "process"
+		semconv.MessagingDestinationName(queue),
+		semconv.MessagingMessageID(aws.ToString(message.MessageId)),
+		attribute.Int("messaging.aws_sqs.receive_count", attempt),
+	}
+	if sent, err := strconv.ParseInt(message.Attributes[string(sqstypes.MessageSystemAttributeNameSentTimestamp)], 10, 64); err == nil {
+		attrs = append(attrs, attribute.Int64(attrQueueWait, max(time.Since(time.UnixMilli(sent)).Milliseconds(), 0)))
+	}
+	return tracer.Start(ctx, queue+" process", trace.WithSpanKind(trace.SpanKindConsumer), trace.WithAttributes(attrs...))
+}
@@ -0,0 +1,142 @@
+// Outbound connection settings. Every HTTP client the service builds — the
+// AWS SDK's, and the one kept for third-party calls such as webhooks and OIDC
+// discovery — shares one proxy and TLS configuration, so a locked-down
+// network with a TLS-intercepting proxy needs only:
+//
+//   - HTTPS_PROXY / HTTP_PROXY / NO_PROXY, the standard variables;
+//   - TLS_CA_BUNDLE, a PEM file of extra trusted roots (typically the
+//     proxy's CA), added to the system pool rather than replacing it;
+//   - TLS_MIN_VERSION, 1.2 (default) or 1.3.
+//
+// The OTLP exporter talks to the collector sidecar on localhost, which no
+// proxy applies to, and is not affected.
+package service
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+)
+
+// outboundTimeout bounds a whole request made with the third-party client.
+const outboundTimeout = 30 * time.Second
+
+// tlsVersions are the accepted TLS_MIN_VERSION values.
+var tlsVersions = map[string]uint16{"1.2": tls.VersionTLS12, "1.3": tls.VersionTLS13}
+
+// outboundTLSConfig builds the client TLS configuration from TLS_CA_BUNDLE
+// and TLS_MIN_VERSION.
+func outboundTLSConfig() (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if v := getenv("TLS_MIN_VERSION"); v != "" {
+		version, ok := tlsVersions[v]
+		if !ok {
+			return nil, fmt.Errorf("TLS_MIN_VERSION must be 1.2 or 1.3, got %q", v)
+		}
+		cfg.MinVersion = version
+	}
+	if path := getenv("TLS_CA_BUNDLE"); path != "" {
+		pem, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read TLS_CA_BUNDLE: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("TLS_CA_BUNDLE %s contains no PEM certificates", path)
+		}
+		cfg.RootCAs = pool
+	}
+	return cfg, nil
+}
+
+// AWSHTTPClient returns the HTTP client for AWS SDK configs (pass it with
+// config.WithHTTPClient): the SDK's default transport with the outbound proxy
+// and TLS settings applied.
+func AWSHTTPClient() (*awshttp.BuildableClient, error) {
+	tlsCfg, err := outboundTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	return awshttp.NewBuildableClient().WithTransportOptions(func(tr *http.Transport) {
+		tr.Proxy = http.ProxyFromEnvironment
+		tr.TLSClientConfig = tlsCfg
+	}), nil
+}
+
+// newOutboundHTTPClient returns the client for non-AWS outbound calls
+// (webhooks, OIDC), with the outbound proxy and TLS settings applied.
+func newOutboundHTTPClient() (*http.Client, error) {
+	tlsCfg, err := outboundTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.Proxy = http.ProxyFromEnvironment
+	tr.TLSClientConfig = tlsCfg
+	return &http.Client{Transport: tr, Timeout: outboundTimeout}, nil
+}
+
+// outboundProxyAddrs returns the host:port addresses of HTTPS_PROXY and
+// HTTP_PROXY, as the transport dials them.
+func outboundProxyAddrs() map[string]bool {
+	addrs := make(map[string]bool)
+	for _, raw := range []string{firstEnv("HTTPS_PROXY", "https_proxy"), firstEnv("HTTP_PROXY", "http_proxy")} {
+		if raw == "" {
+			continue
+		}
+		if !strings.Contains(raw, "://") {
+			raw = "http://" + raw // As http.ProxyFromEnvironment reads it
+		}
+		u, err := url.Parse(raw)
+		if err != nil || u.Hostname() == "" {
+			continue
+		}
+		port := u.Port()
+		if port == "" {
+			port = map[string]string{"https": "443", "socks5": "1080", "socks5h": "1080"}[u.Scheme]
+			if port == "" {
+				port = "80"
+			}
+		}
+		addrs[net.JoinHostPort(u.Hostname(), port)] = true
+	}
+	return addrs
+}
+
+// outboundSettings returns the effective outbound settings for the startup
+// report, so a proxy or CA misconfiguration is visible before the first
+// failed call.
+func outboundSettings() map[string]any {
+	minVersion := getenv("TLS_MIN_VERSION")
+	if minVersion == "" {
+		minVersion = "1.2"
+	}
+	return map[string]any{
+		"https_proxy":     getenv("HTTPS_PROXY") != "" || getenv("https_proxy") != "",
+		"http_proxy":      getenv("HTTP_PROXY") != "" || getenv("http_proxy") != "",
+		"no_proxy":        firstEnv("NO_PROXY", "no_proxy"),
+		"ca_bundle":       getenv("TLS_CA_BUNDLE"),
+		"tls_min_version": minVersion,
+	}
+}
+
+// firstEnv returns the first non-empty value among names.
+func firstEnv(names ...string) string {
+	for _, name := range names {
+		if v := getenv(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,62 @@
+// Caller identity. The service has no authentication of its own; it runs
+// behind a gateway/ALB that is expected to set the identity headers below.
+// Features that need "who is calling" (duplicate detection, per-client limits)
+// use principalFromRequest so the derivation lives in one place.
+package service
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Headers carrying caller identity, set by the upstream gateway.
+const (
+	headerClientID = "X-Client-ID"
+	headerTenantID = "X-Tenant-ID"
+)
+
+// defaultTenant is the tenant of callers that do not send X-Tenant-ID.
+const defaultTenant = "default"
+
+// Principal identifies the caller of a request.
+type Principal struct {
+	ID     string // X-Client-ID, or the client IP when absent
+	Tenant string // X-Tenant-ID, or defaultTenant when absent
+	// Mirrored marks a copy of production traffic (mirror.go). Per-client
+	// accounting such as quotas should not charge it.
+	Mirrored bool
+}
+
+// principalFromRequest derives the caller's Principal. Without X-Client-ID the
+// client IP stands in: the first X-Forwarded-For hop (set by the ALB), else
+// the connection's remote address.
+func principalFromRequest(r *http.Request) Principal {
+	p := Principal{
+		ID:       strings.TrimSpace(r.Header.Get(headerClientID)),
+		Tenant:   strings.TrimSpace(r.Header.Get(headerTenantID)),
+		Mirrored: r.Header.Get(headerMirroredFrom) != "",
+	}
+	if p.ID == "" {
+		p.ID = clientIP(r)
+	}
+	if p.Tenant == "" {
+		p.Tenant = defaultTenant
+	}
+	return p
+}
+
+// clientIP returns the originating client IP for r.
+func clientIP(r *http.Request) string {
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		first, _, _ := strings.Cut(xff, ",")
+		if ip := strings.TrimSpace(first); ip != "" {
+			return ip
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
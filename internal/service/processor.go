@@ -0,0 +1,158 @@
+// Job processors: turn a job's text into its output and artifacts. A job
+// names its processor with JobRequest.Type (default "uppercase"); processors
+// get everything else from a JobContext, so the worker, dry runs
+// (POST /jobs/validate) and operator tests (POST /admin/processors/{type}/test)
+// all run exactly the same code. New behaviours are added by registering a
+// Processor, without touching the worker.
+package service
+
+import (
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Processor is a job processor. It should return promptly once jc is done;
+// an error fails the attempt and the job is redelivered.
+type Processor interface {
+	Process(jc *JobContext, text string) (output string, artifacts []Artifact, err error)
+}
+
+// ProcessorFunc adapts a function to a Processor.
+type ProcessorFunc func(jc *JobContext, text string) (output string, artifacts []Artifact, err error)
+
+// Process calls f.
+func (f ProcessorFunc) Process(jc *JobContext, text string) (string, []Artifact, error) {
+	return f(jc, text)
+}
+
+// defaultProcessorType is the processor of jobs that name none, including
+// every job from before job types.
+const defaultProcessorType = "uppercase"
+
+// processors maps job types to processors.
+var processors = map[string]Processor{
+	defaultProcessorType: ProcessorFunc(processUppercase),
+	"lowercase":          ProcessorFunc(processLowercase),
+	"wordcount":          ProcessorFunc(processWordCount),
+}
+
+// RegisterProcessor makes p available as job type typ. Call it before Run,
+// e.g. from a binary's init function; registering a type twice panics. A p
+// that implements Describer documents the type on GET /job-types.
+func RegisterProcessor(typ string, p Processor) {
+	if _, dup := processors[typ]; dup || typ == "" {
+		panic(fmt.Sprintf("processor type %q registered twice or empty", typ))
+	}
+	processors[typ] = p
+}
+
+// lookupProcessor returns the processor for job type typ, "" meaning the
+// default.
+func lookupProcessor(typ string) (Processor, bool) {
+	if typ == "" {
+		typ = defaultProcessorType
+	}
+	p, ok := processors[typ]
+	return p, ok
+}
+
+// processorTypes returns the registered job types, sorted.
+func processorTypes() []string {
+	return slices.Sorted(maps.Keys(processors))
+}
+
+// validateJobType checks a requested job type and fills in the default.
+func validateJobType(typ *string) *FieldError {
+	if *typ == "" {
+		*typ = defaultProcessorType
+	}
+	if _, ok := processors[*typ]; !ok {
+		return &FieldError{Field: "type", Message: "type must be one of " + strings.Join(processorTypes(), ", ")}
+	}
+	return nil
+}
+
+// processUppercase is the default processor: the output is the text in upper
+// case, with a summary.json artifact of basic input counts.
+func processUppercase(jc *JobContext, text string) (output string, artifacts []Artifact, err error) {
+	return strings.ToUpper(text), []Artifact{summaryArtifact(text)}, nil
+}
+
+// processLowercase outputs the text in lower case, with the same summary.
+func processLowercase(jc *JobContext, text string) (output string, artifacts []Artifact, err error) {
+	return strings.ToLower(text), []Artifact{summaryArtifact(text)}, nil
+}
+
+// processWordCount outputs the number of whitespace-separated words in the
+// text, with the same summary.
+func processWordCount(jc *JobContext, text string) (output string, artifacts []Artifact, err error) {
+	return strconv.Itoa(len(strings.Fields(text))), []Artifact{summaryArtifact(text)}, nil
+}
+
+// ProcessorTestArtifact is an artifact in a ProcessorTestResponse.
+type ProcessorTestArtifact struct {
+	Name        string `json:"name"`
+	ContentType string `json:"content_type"`
+	SizeBytes   int    `json:"size_bytes"`
+	Content     string `json:"content,omitempty"` // Inline when valid UTF-8
+}
+
+// ProcessorTestResponse is the POST /admin/processors/{type}/test response body.
+type ProcessorTestResponse struct {
+	Type       string                  `json:"type"`            // Processor type
+	Output     string                  `json:"output"`          // Processor output
+	Artifacts  []ProcessorTestArtifact `json:"artifacts"`       // Attached artifacts
+	Error      string                  `json:"error,omitempty"` // Processor error; the job would be retried
+	DurationMs float64                 `json:"duration_ms"`     // Processing time
+}
+
+// testProcessor handles POST /admin/processors/{type}/test requests.
+// Runs the processor synchronously on the sample in the body (same formats as
+// POST /jobs) and returns its output and timing. Nothing is enqueued or
+// stored. 503 while the intake throttle is engaged.
+func (a *App) testProcessor(w http.ResponseWriter, r *http.Request) {
+	typ := r.PathValue("type")
+	process, ok := processors[typ]
+	if !ok {
+		http.Error(w, "unknown processor type", http.StatusNotFound)
+		return
+	}
+	if a.throttle.refuseInline(w, r, "processor_test") {
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, a.bodyLimit)
+	req, err := a.decodeJobRequest(r)
+	if err != nil {
+		status, detail := jobRequestError(err)
+		writeError(w, status, detail)
+		return
+	}
+
+	jc, cancel := newDryRunContext(r.Context(), principalFromRequest(r).Tenant)
+	defer cancel()
+	start := time.Now()
+	output, artifacts, err := process.Process(jc, req.Text)
+	resp := ProcessorTestResponse{
+		Type:       typ,
+		Output:     output,
+		Artifacts:  make([]ProcessorTestArtifact, 0, len(artifacts)),
+		DurationMs: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	for _, art := range artifacts {
+		ta := ProcessorTestArtifact{Name: art.Name, ContentType: art.ContentType, SizeBytes: len(art.Body)}
+		if utf8.Valid(art.Body) {
+			ta.Content = string(art.Body)
+		}
+		resp.Artifacts = append(resp.Artifacts, ta)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
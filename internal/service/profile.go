@@ -0,0 +1,104 @@
+// Config profiles. APP_PROFILE selects a named set of defaults for the tunable
+// environment variables (dev, staging, prod), so environments differ by one
+// variable instead of copy-pasted env blocks. Profiles layer: a profile may
+// extend another, and a variable set in the real environment always wins
+// over every profile. The base profile is the built-in defaults; everything a
+// profile changes from it is logged at startup.
+package service
+
+import (
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+)
+
+// configProfile is a named layer of environment defaults.
+type configProfile struct {
+	parent string            // Profile this one extends; "" for the base
+	values map[string]string // Environment variable defaults
+}
+
+// configProfiles are the selectable profiles. Only divergences from the
+// built-in defaults belong here.
+var configProfiles = map[string]configProfile{
+	"dev": {values: map[string]string{
+		"RUN_MODE":               "both",
+		"RESULT_CACHE_TTL":       "10s",
+		"DUPLICATE_WINDOW":       "2s",
+		"STORAGE_STATS_INTERVAL": "0",
+		"PAGE_TOKEN_TTL":         "1h",
+		"JSON_STRICT":            "true",
+	}},
+	"prod": {values: map[string]string{
+		"RESULT_CACHE_SIZE":      "5000",
+		"JANITOR_INTERVAL":       "6h",
+		"GOMEMLIMIT_FROM_CGROUP": "true",
+		"LOAD_SHEDDING":          "true",
+	}},
+	"staging": {parent: "prod", values: map[string]string{
+		"RESULT_CACHE_SIZE":      "1000",
+		"STORAGE_STATS_INTERVAL": "6h",
+		"JANITOR_DRY_RUN":        "false",
+	}},
+}
+
+// resolveProfile flattens name and its ancestors, nearer layers winning.
+func resolveProfile(name string) (map[string]string, error) {
+	var chain []configProfile
+	for n := name; n != ""; {
+		p, ok := configProfiles[n]
+		if !ok {
+			return nil, fmt.Errorf("unknown profile %q", n)
+		}
+		if len(chain) > len(configProfiles) {
+			return nil, fmt.Errorf("profile %q extends itself", name)
+		}
+		chain = append(chain, p)
+		n = p.parent
+	}
+	merged := map[string]string{}
+	for _, p := range slices.Backward(chain) {
+		for k, v := range p.values {
+			merged[k] = v
+		}
+	}
+	return merged, nil
+}
+
+// applyProfile sets the defaults of the APP_PROFILE profile for variables not
+// already in the environment and logs each divergence from the base profile.
+// An unknown profile exits the process.
+func applyProfile() {
+	name := getenv("APP_PROFILE")
+	if name == "" {
+		return
+	}
+	values, err := resolveProfile(name)
+	if err != nil {
+		slog.Error("invalid APP_PROFILE", "profile", name, "error", err, "available", profileNames())
+		os.Exit(1)
+	}
+	keys := slices.Sorted(maps.Keys(values))
+	for _, k := range keys {
+		if env, set := os.LookupEnv(k); set {
+			from := "environment"
+			if settingSource(k) == sourceFile {
+				from = "config file"
+			}
+			slog.Info("config profile setting overridden by "+from, "profile", name, "name", k, "profile_value", values[k], "value", redactSetting(k, env))
+			continue
+		}
+		os.Setenv(k, values[k])
+		setSettingSource(k, sourceProfile)
+		slog.Info("config profile setting differs from base", "profile", name, "name", k, "value", values[k])
+	}
+	slog.Info("config profile applied", "profile", name, "settings", len(keys))
+}
+
+// profileNames lists the selectable profiles.
+func profileNames() string {
+	return strings.Join(slices.Sorted(maps.Keys(configProfiles)), ", ")
+}
@@ -0,0 +1,387 @@
+// Message queues behind a Queue. The worker, retries, the dead-letter queue,
+// redrive and job submission go through App.queue, selected by
+// QUEUE_BACKEND:
+//
+//	sqs     Amazon SQS at SQS_QUEUE_URL (default)
+//	memory  in-process queues, for tests and local runs without AWS
+//
+// Queues are named by URL, so DLQ_URL works with either backend; the memory
+// backend creates a queue on first use and, without SQS_QUEUE_URL, calls the
+// job queue memoryQueueURL. Its messages carry the same system attributes
+// the worker reads from SQS (receive count, sent time) and reappear after
+// memoryVisibilityTimeout unless deleted, but they live only as long as the
+// process: producers and the worker must share it (RUN_MODE=both), and a
+// restart loses whatever was queued. Messages are held as SQS types, so the
+// envelope, adapters and retry code are the same for both backends.
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/google/uuid"
+)
+
+// Queue backends selectable with QUEUE_BACKEND.
+const (
+	queueSQS    = "sqs"
+	queueMemory = "memory"
+)
+
+const (
+	// memoryQueueURL is the job queue of the memory backend when
+	// SQS_QUEUE_URL is unset.
+	memoryQueueURL = "memory://job-queue"
+	// memoryVisibilityTimeout is how long a received message stays hidden,
+	// the SQS default.
+	memoryVisibilityTimeout = 30 * time.Second
+)
+
+// errInvalidReceipt is returned for a receipt handle the memory backend does
+// not know, e.g. one superseded by a later receive of the same message.
+var errInvalidReceipt = errors.New("receipt handle is invalid")
+
+// QueueDepth counts a queue's messages.
+type QueueDepth struct {
+	Visible  int64 // Waiting to be received
+	InFlight int64 // Received and not yet deleted or visible again
+	Delayed  int64 // Sent with a delay that has not passed
+}
+
+// SendOptions are the optional parts of a send.
+type SendOptions struct {
+	Delay           time.Duration // Hidden for this long first (at most 15 minutes); standard queues only
+	GroupID         string        // FIFO message group (fifo.go); required by, and only allowed on, FIFO queues
+	DeduplicationID string        // FIFO deduplication ID; a repeat within fifoDedupWindow is dropped
+}
+
+// Queue is where job messages wait for a worker.
+type Queue interface {
+	// Send enqueues body.
+	Send(ctx context.Context, queueURL, body string, attrs map[string]types.MessageAttributeValue, opts SendOptions) error
+	// Receive returns up to max messages with their attributes, waiting up
+	// to wait for one to arrive.
+	Receive(ctx context.Context, queueURL string, max int, wait time.Duration) ([]types.Message, error)
+	// Delete removes a received message.
+	Delete(ctx context.Context, queueURL, receiptHandle string) error
+	// ChangeVisibility makes a received message visible again after timeout.
+	ChangeVisibility(ctx context.Context, queueURL, receiptHandle string, timeout time.Duration) error
+	// Depth counts the queue's messages.
+	Depth(ctx context.Context, queueURL string) (QueueDepth, error)
+}
+
+// newQueue returns the backend conf selects.
+func newQueue(conf Config, client *sqs.Client) Queue {
+	if conf.QueueBackend == queueMemory {
+		return newMemoryQueue()
+	}
+	return &sqsQueue{client: client}
+}
+
+// onSQS reports whether messages go through SQS, so SQS-only features apply.
+func (a *App) onSQS() bool {
+	_, ok := a.queue.(*sqsQueue)
+	return ok
+}
+
+// sqsQueue sends and receives through SQS.
+type sqsQueue struct {
+	client *sqs.Client
+}
+
+func (q *sqsQueue) Send(ctx context.Context, queueURL, body string, attrs map[string]types.MessageAttributeValue, opts SendOptions) error {
+	in := &sqs.SendMessageInput{
+		QueueUrl:          aws.String(queueURL),
+		MessageBody:       aws.String(body),
+		MessageAttributes: attrs,
+		DelaySeconds:      int32(opts.Delay.Seconds()),
+	}
+	if opts.GroupID != "" {
+		in.MessageGroupId = aws.String(opts.GroupID)
+	}
+	if opts.DeduplicationID != "" {
+		in.MessageDeduplicationId = aws.String(opts.DeduplicationID)
+	}
+	_, err := q.client.SendMessage(ctx, in)
+	return err
+}
+
+func (q *sqsQueue) Receive(ctx context.Context, queueURL string, max int, wait time.Duration) ([]types.Message, error) {
+	out, err := q.client.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+		QueueUrl:            aws.String(queueURL),
+		MaxNumberOfMessages: int32(max),
+		WaitTimeSeconds:     int32(wait.Seconds()),
+		// Return custom attributes so the worker can recover the trace
+		// context that createJob injected.
+		MessageAttributeNames: []string{"All"},
+		// The receive count is the job's delivery attempt; the sent time
+		// dates jobs built by message adapters; the first receive dates the
+		// job's deliveries (deliveries.go); the group orders FIFO messages
+		// (fifo.go).
+		MessageSystemAttributeNames: []types.MessageSystemAttributeName{
+			types.MessageSystemAttributeNameApproximateReceiveCount,
+			types.MessageSystemAttributeNameSentTimestamp,
+			types.MessageSystemAttributeNameApproximateFirstReceiveTimestamp,
+			types.MessageSystemAttributeNameMessageGroupId,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Messages, nil
+}
+
+func (q *sqsQueue) Delete(ctx context.Context, queueURL, receiptHandle string) error {
+	_, err := q.client.DeleteMessage(ctx, &sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(queueURL),
+		ReceiptHandle: aws.String(receiptHandle),
+	})
+	return err
+}
+
+func (q *sqsQueue) ChangeVisibility(ctx context.Context, queueURL, receiptHandle string, timeout time.Duration) error {
+	_, err := q.client.ChangeMessageVisibility(ctx, &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(queueURL),
+		ReceiptHandle:     aws.String(receiptHandle),
+		VisibilityTimeout: int32(timeout / time.Second),
+	})
+	return err
+}
+
+func (q *sqsQueue) Depth(ctx context.Context, queueURL string) (QueueDepth, error) {
+	out, err := q.client.GetQueueAttributes(ctx, &sqs.GetQueueAttributesInput{
+		QueueUrl: aws.String(queueURL),
+		AttributeNames: []types.QueueAttributeName{
+			types.QueueAttributeNameApproximateNumberOfMessages,
+			types.QueueAttributeNameApproximateNumberOfMessagesNotVisible,
+			types.QueueAttributeNameApproximateNumberOfMessagesDelayed,
+		},
+	})
+	if err != nil {
+		return QueueDepth{}, err
+	}
+	var d QueueDepth
+	for name, n := range map[types.QueueAttributeName]*int64{
+		types.QueueAttributeNameApproximateNumberOfMessages:           &d.Visible,
+		types.QueueAttributeNameApproximateNumberOfMessagesNotVisible: &d.InFlight,
+		types.QueueAttributeNameApproximateNumberOfMessagesDelayed:    &d.Delayed,
+	} {
+		v := out.Attributes[string(name)]
+		if *n, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return QueueDepth{}, fmt.Errorf("parse %s %q: %w", name, v, err)
+		}
+	}
+	return d, nil
+}
+
+// memoryQueue holds queues in process memory.
+type memoryQueue struct {
+	mu     sync.Mutex
+	queues map[string]*memQueue // By URL
+}
+
+// memQueue is one in-memory queue.
+type memQueue struct {
+	messages []*memMessage        // In send order
+	ready    chan struct{}        // Signalled when a message may have become receivable
+	dedup    map[string]time.Time // FIFO deduplication IDs by send time
+}
+
+// memMessage is a queued message and its delivery state.
+type memMessage struct {
+	msg       types.Message // Body, attributes and ID; ReceiptHandle of the latest receive
+	group     string        // FIFO message group; "" on a standard queue
+	sent      time.Time
+	visibleAt time.Time // Hidden until then: delayed or in flight
+	received  int       // Deliveries so far
+	firstRecv time.Time // First delivery; zero until then
+}
+
+// newMemoryQueue returns an empty memory backend.
+func newMemoryQueue() *memoryQueue {
+	return &memoryQueue{queues: map[string]*memQueue{}}
+}
+
+// queue returns the queue at url, creating it; q.mu must be held.
+func (q *memoryQueue) queue(url string) *memQueue {
+	mq, ok := q.queues[url]
+	if !ok {
+		mq = &memQueue{ready: make(chan struct{}, 1), dedup: map[string]time.Time{}}
+		q.queues[url] = mq
+	}
+	return mq
+}
+
+// wake signals a receiver waiting on mq, if any; q.mu must be held.
+func (mq *memQueue) wake() {
+	select {
+	case mq.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (q *memoryQueue) Send(ctx context.Context, queueURL, body string, attrs map[string]types.MessageAttributeValue, opts SendOptions) error {
+	now := time.Now()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	mq := q.queue(queueURL)
+	if opts.DeduplicationID != "" {
+		maps.DeleteFunc(mq.dedup, func(_ string, sent time.Time) bool { return now.Sub(sent) >= fifoDedupWindow })
+		if _, ok := mq.dedup[opts.DeduplicationID]; ok {
+			return nil // Accepted, as SQS does, but not queued again
+		}
+		mq.dedup[opts.DeduplicationID] = now
+	}
+	mq.messages = append(mq.messages, &memMessage{
+		msg: types.Message{
+			MessageId:         aws.String(uuid.NewString()),
+			Body:              aws.String(body),
+			MessageAttributes: maps.Clone(attrs),
+		},
+		group:     opts.GroupID,
+		sent:      now,
+		visibleAt: now.Add(opts.Delay),
+	})
+	mq.wake()
+	return nil
+}
+
+func (q *memoryQueue) Receive(ctx context.Context, queueURL string, max int, wait time.Duration) ([]types.Message, error) {
+	deadline := time.Now().Add(wait)
+	for {
+		msgs, next, ready := q.take(queueURL, max)
+		if len(msgs) > 0 {
+			return msgs, nil
+		}
+		now := time.Now()
+		if !now.Before(deadline) {
+			return nil, nil
+		}
+		// Sleep until a send, the next message becoming visible, or the
+		// end of the wait.
+		timeout := deadline.Sub(now)
+		if !next.IsZero() {
+			timeout = min(timeout, next.Sub(now))
+		}
+		timer := time.NewTimer(timeout)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-ready:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// take hides and returns up to max visible messages. With none, it returns
+// when the next hidden one becomes visible (zero if none is hidden) and the
+// channel a send signals. A FIFO message is held back while an earlier one
+// of its group is hidden.
+func (q *memoryQueue) take(queueURL string, max int) ([]types.Message, time.Time, <-chan struct{}) {
+	now := time.Now()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	mq := q.queue(queueURL)
+	var msgs []types.Message
+	var next time.Time
+	blocked := map[string]bool{} // Groups with an earlier message hidden
+	for _, m := range mq.messages {
+		if m.group != "" && blocked[m.group] {
+			continue
+		}
+		if m.visibleAt.After(now) {
+			if next.IsZero() || m.visibleAt.Before(next) {
+				next = m.visibleAt
+			}
+			if m.group != "" {
+				blocked[m.group] = true
+			}
+			continue
+		}
+		if len(msgs) == max {
+			break
+		}
+		m.received++
+		if m.firstRecv.IsZero() {
+			m.firstRecv = now
+		}
+		m.visibleAt = now.Add(memoryVisibilityTimeout)
+		m.msg.ReceiptHandle = aws.String(uuid.NewString())
+		msg := m.msg
+		msg.MessageAttributes = maps.Clone(m.msg.MessageAttributes)
+		msg.Attributes = map[string]string{
+			string(types.MessageSystemAttributeNameApproximateReceiveCount):          strconv.Itoa(m.received),
+			string(types.MessageSystemAttributeNameSentTimestamp):                    strconv.FormatInt(m.sent.UnixMilli(), 10),
+			string(types.MessageSystemAttributeNameApproximateFirstReceiveTimestamp): strconv.FormatInt(m.firstRecv.UnixMilli(), 10),
+		}
+		if m.group != "" {
+			msg.Attributes[string(types.MessageSystemAttributeNameMessageGroupId)] = m.group
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, next, mq.ready
+}
+
+// find returns the index of the message last received with receiptHandle;
+// q.mu must be held.
+func (mq *memQueue) find(receiptHandle string) (int, error) {
+	for i, m := range mq.messages {
+		if aws.ToString(m.msg.ReceiptHandle) == receiptHandle {
+			return i, nil
+		}
+	}
+	return 0, errInvalidReceipt
+}
+
+func (q *memoryQueue) Delete(ctx context.Context, queueURL, receiptHandle string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	mq := q.queue(queueURL)
+	i, err := mq.find(receiptHandle)
+	if err != nil {
+		return err
+	}
+	mq.messages = append(mq.messages[:i], mq.messages[i+1:]...)
+	return nil
+}
+
+func (q *memoryQueue) ChangeVisibility(ctx context.Context, queueURL, receiptHandle string, timeout time.Duration) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	mq := q.queue(queueURL)
+	i, err := mq.find(receiptHandle)
+	if err != nil {
+		return err
+	}
+	mq.messages[i].visibleAt = time.Now().Add(timeout)
+	mq.wake()
+	return nil
+}
+
+func (q *memoryQueue) Depth(ctx context.Context, queueURL string) (QueueDepth, error) {
+	now := time.Now()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var d QueueDepth
+	for _, m := range q.queue(queueURL).messages {
+		switch {
+		case !m.visibleAt.After(now):
+			d.Visible++
+		case m.received > 0:
+			d.InFlight++
+		default:
+			d.Delayed++
+		}
+	}
+	return d, nil
+}
@@ -0,0 +1,313 @@
+// Rate limiting of job submissions. POST /jobs draws on two token buckets,
+// each refilling at a steady rate up to a burst:
+//
+//	JOB_RATE_LIMIT / JOB_RATE_BURST                 every submission to this process
+//	JOB_CLIENT_RATE_LIMIT / JOB_CLIENT_RATE_BURST   one bucket per client key
+//
+// Rates are jobs per second, 0 (the default) leaving that bucket out; a
+// burst defaults to one second's worth. The client key is, by
+// JOB_RATE_LIMIT_KEY, the caller's client ID (X-Client-ID, else its IP) or
+// its tenant. A submission needs a token from both buckets; without one it is
+// refused before its body is read with a retryable 429 "rate_limited" whose
+// Retry-After says when a token will be there. Mirrored copies of production
+// traffic are not charged to a client.
+//
+// Every response of an API process with a limit set reports the caller's
+// budget, so a client can pace itself instead of finding the limit by its
+// 429s. The headers follow the IETF RateLimit header fields draft, for the
+// tighter of the caller's buckets — after the token of a submission is taken:
+//
+//	RateLimit-Limit      the bucket's burst
+//	RateLimit-Remaining  whole tokens left: submissions that would pass now
+//	RateLimit-Reset      seconds until the bucket is full again
+//	RateLimit-Policy     every bucket that applies, as
+//	                     <burst>;w=<seconds to refill it>;comment="global|client"
+//
+// An empty bucket refills one token every Reset/Limit seconds; a client that
+// spaces its submissions that far apart never sees a 429
+// (contract.RateLimit.Wait). The budget is a snapshot of this process's
+// buckets: behind a load balancer the next request may land on another
+// replica, whose buckets are its own.
+//
+// The buckets are per API process: behind a load balancer the service as a
+// whole admits the limits times the number of replicas. Idle client buckets
+// are forgotten once full again.
+package service
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+
+	"go-microservice/pkg/contract"
+)
+
+// errCodeRateLimited means a submission was refused by a rate limit; it is
+// safe to retry after Retry-After.
+const errCodeRateLimited = "rate_limited"
+
+// Keys of the client buckets, for JOB_RATE_LIMIT_KEY.
+const (
+	rateKeyClient = "client"
+	rateKeyTenant = "tenant"
+)
+
+// Headers reporting a caller's submission budget, shared with clients
+// through the contract (contract.ParseRateLimit).
+const (
+	headerRateLimit          = contract.HeaderRateLimit
+	headerRateLimitRemaining = contract.HeaderRateLimitRemaining
+	headerRateLimitReset     = contract.HeaderRateLimitReset
+	headerRateLimitPolicy    = contract.HeaderRateLimitPolicy
+)
+
+// rateLimitPruneInterval is how often idle client buckets are dropped.
+const rateLimitPruneInterval = time.Minute
+
+// tokenBucket holds up to burst tokens, refilled at rate per second.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time // When tokens was last brought up to date
+}
+
+// refill brings b's tokens up to now.
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// wait returns how long until b has a token; 0 when it has one.
+func (b *tokenBucket) wait() time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// full returns how long until b is full again.
+func (b *tokenBucket) full() time.Duration {
+	return time.Duration((b.burst - b.tokens) / b.rate * float64(time.Second))
+}
+
+// rateBudget is what the RateLimit headers report of one bucket.
+type rateBudget struct {
+	limit     int           // Burst
+	remaining int           // Whole tokens left
+	reset     time.Duration // Until the bucket is full again
+}
+
+// budget returns b's budget.
+func (b *tokenBucket) budget() rateBudget {
+	return rateBudget{limit: int(b.burst), remaining: int(max(b.tokens, 0)), reset: b.full()}
+}
+
+// tighter returns whichever of x and y leaves fewer submissions, the one
+// that takes longer to refill on a tie.
+func tighter(x, y rateBudget) rateBudget {
+	if y.remaining < x.remaining || y.remaining == x.remaining && y.reset > x.reset {
+		return y
+	}
+	return x
+}
+
+// rateLimiter is the submission buckets of this process.
+type rateLimiter struct {
+	global      *tokenBucket // nil without JOB_RATE_LIMIT
+	clientRate  float64      // JOB_CLIENT_RATE_LIMIT; 0 for no client buckets
+	clientBurst float64      // JOB_CLIENT_RATE_BURST
+	key         string       // JOB_RATE_LIMIT_KEY: client or tenant
+	policy      string       // RateLimit-Policy value
+
+	mu        sync.Mutex
+	clients   map[string]*tokenBucket
+	lastPrune time.Time
+}
+
+// newRateLimiter returns the limiter configured by the JOB_*RATE_* variables,
+// or nil when no rate is set.
+func newRateLimiter() (*rateLimiter, error) {
+	rate, clientRate := envFloat("JOB_RATE_LIMIT", 0), envFloat("JOB_CLIENT_RATE_LIMIT", 0)
+	if rate < 0 || clientRate < 0 {
+		return nil, fmt.Errorf("JOB_RATE_LIMIT and JOB_CLIENT_RATE_LIMIT must not be negative")
+	}
+	l := &rateLimiter{
+		clientRate:  clientRate,
+		clientBurst: math.Max(envFloat("JOB_CLIENT_RATE_BURST", math.Ceil(clientRate)), 1),
+		key:         getenv("JOB_RATE_LIMIT_KEY"),
+		clients:     map[string]*tokenBucket{},
+		lastPrune:   time.Now(),
+	}
+	switch l.key {
+	case "":
+		l.key = rateKeyClient
+	case rateKeyClient, rateKeyTenant:
+	default:
+		return nil, fmt.Errorf("JOB_RATE_LIMIT_KEY must be %s or %s, not %q", rateKeyClient, rateKeyTenant, l.key)
+	}
+	if rate > 0 {
+		burst := math.Max(envFloat("JOB_RATE_BURST", math.Ceil(rate)), 1)
+		l.global = &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+	}
+	if l.global == nil && clientRate == 0 {
+		return nil, nil
+	}
+	var policies []string
+	if l.global != nil {
+		policies = append(policies, ratePolicy(l.global.burst, rate, "global"))
+	}
+	if clientRate > 0 {
+		policies = append(policies, ratePolicy(l.clientBurst, clientRate, "client"))
+	}
+	l.policy = strings.Join(policies, ", ")
+	return l, nil
+}
+
+// ratePolicy renders a bucket as a RateLimit-Policy item.
+func ratePolicy(burst, rate float64, scope string) string {
+	return fmt.Sprintf("%d;w=%d;comment=%q", int(burst), int(math.Ceil(burst/rate)), scope)
+}
+
+// take takes a token for a submission from client (empty for none) and the
+// global bucket, or returns which bucket refused it and when to retry. The
+// budget is the tighter bucket's afterwards.
+func (l *rateLimiter) take(client string) (scope string, retryAfter time.Duration, left rateBudget, ok bool) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastPrune) >= rateLimitPruneInterval {
+		l.prune(now)
+	}
+	var cb *tokenBucket
+	if l.clientRate > 0 && client != "" {
+		if cb = l.clients[client]; cb == nil {
+			cb = &tokenBucket{rate: l.clientRate, burst: l.clientBurst, tokens: l.clientBurst, last: now}
+			l.clients[client] = cb
+		}
+		cb.refill(now)
+		if d := cb.wait(); d > 0 {
+			return "client", d, cb.budget(), true
+		}
+	}
+	if l.global != nil {
+		l.global.refill(now)
+		if d := l.global.wait(); d > 0 {
+			return "global", d, l.global.budget(), true
+		}
+		l.global.tokens--
+	}
+	if cb != nil {
+		cb.tokens--
+	}
+	left, ok = l.budgetLocked(cb)
+	return "", 0, left, ok
+}
+
+// budget returns client's budget (empty for none) without taking a token;
+// false when no bucket applies.
+func (l *rateLimiter) budget(client string) (rateBudget, bool) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var cb *tokenBucket
+	if l.clientRate > 0 && client != "" {
+		// A client without a bucket has a full one.
+		if cb = l.clients[client]; cb == nil {
+			cb = &tokenBucket{rate: l.clientRate, burst: l.clientBurst, tokens: l.clientBurst, last: now}
+		}
+		cb.refill(now)
+	}
+	if l.global != nil {
+		l.global.refill(now)
+	}
+	return l.budgetLocked(cb)
+}
+
+// budgetLocked returns the tighter of client bucket cb (nil for none) and
+// the global bucket, both up to date; false when neither applies. l.mu must
+// be held.
+func (l *rateLimiter) budgetLocked(cb *tokenBucket) (rateBudget, bool) {
+	switch {
+	case cb == nil && l.global == nil:
+		return rateBudget{}, false
+	case cb == nil:
+		return l.global.budget(), true
+	case l.global == nil:
+		return cb.budget(), true
+	}
+	return tighter(cb.budget(), l.global.budget()), true
+}
+
+// setHeaders reports b in h, unless no bucket applies.
+func (l *rateLimiter) setHeaders(h http.Header, b rateBudget, ok bool) {
+	if !ok {
+		return
+	}
+	h.Set(headerRateLimit, strconv.Itoa(b.limit))
+	h.Set(headerRateLimitRemaining, strconv.Itoa(b.remaining))
+	// Whole seconds, rounded up: the bucket is full by then.
+	h.Set(headerRateLimitReset, strconv.Itoa(int(math.Ceil(b.reset.Seconds()))))
+	h.Set(headerRateLimitPolicy, l.policy)
+}
+
+// headers reports the caller's budget on every response.
+func (l *rateLimiter) headers(next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, ok := l.budget(l.clientKey(r))
+		l.setHeaders(w.Header(), b, ok)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// prune drops the client buckets that have refilled completely: a new one
+// would be the same. l.mu must be held.
+func (l *rateLimiter) prune(now time.Time) {
+	for client, b := range l.clients {
+		if b.refill(now); b.tokens >= b.burst {
+			delete(l.clients, client)
+		}
+	}
+	l.lastPrune = now
+}
+
+// clientKey returns the bucket key of r's caller; empty for a mirrored copy.
+func (l *rateLimiter) clientKey(r *http.Request) string {
+	p := principalFromRequest(r)
+	switch {
+	case p.Mirrored:
+		return ""
+	case l.key == rateKeyTenant:
+		return p.Tenant
+	}
+	return p.ID
+}
+
+// wrap refuses submissions over the limits before they reach next.
+func (l *rateLimiter) wrap(next http.HandlerFunc) http.HandlerFunc {
+	if l == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		scope, retryAfter, left, ok := l.take(l.clientKey(r))
+		l.setHeaders(w.Header(), left, ok)
+		if scope == "" {
+			next(w, r)
+			return
+		}
+		rateLimited.Add(r.Context(), 1, metric.WithAttributes(attribute.String("scope", scope)))
+		// Retry-After is in whole seconds: round up, so the retry finds a token.
+		writeRetryableError(w, http.StatusTooManyRequests, errCodeRateLimited,
+			fmt.Sprintf("too many job submissions (%s limit); retry later", scope), retryAfter.Truncate(time.Second)+time.Second)
+	}
+}
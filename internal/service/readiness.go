@@ -0,0 +1,161 @@
+// Deep readiness. GET /readyz checks the queue and storage with one cheap
+// live call each — GetQueueAttributes on SQS_QUEUE_URL and HeadBucket on
+// S3_BUCKET, or their equivalents on the memory and filesystem backends —
+// run in parallel under READINESS_TIMEOUT. The result is cached for
+// READINESS_CACHE_TTL, so frequent probes from several load balancers and
+// the orchestrator cost one pair of calls per interval rather than one per
+// probe. A dependency that fails its check makes the process not ready (503);
+// one that passes while recent request-path calls failed is reported as
+// degraded but stays ready, as before.
+package service
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Readiness statuses of a dependency.
+const (
+	dependencyOK       = "ok"
+	dependencyDegraded = "degraded" // Live check passed, but recent calls failed
+	dependencyFailed   = "failed"
+)
+
+// readinessProbeKey is the object the readiness check heads on backends
+// without a bucket-level check; it need not exist.
+const readinessProbeKey = "readyz-probe"
+
+// ReadinessReport is the body of GET /readyz.
+type ReadinessReport struct {
+	Status       string                      `json:"status"`                 // ready, ready (storage degraded), not ready, draining or observing
+	WorkerStage  string                      `json:"worker_stage,omitempty"` // observe or active, for a worker started observing (workerstage.go)
+	CheckedAt    Timestamp                   `json:"checked_at,omitzero"`    // When the dependencies were last checked
+	Dependencies map[string]DependencyStatus `json:"dependencies,omitempty"` // queue, storage
+}
+
+// DependencyStatus is the outcome of one dependency's live check.
+type DependencyStatus struct {
+	Status    string `json:"status"` // ok, degraded or failed
+	LatencyMs int64  `json:"latency_ms"`
+	Error     string `json:"error,omitempty"`
+}
+
+// readinessChecker runs and caches the live dependency checks.
+type readinessChecker struct {
+	timeout time.Duration // READINESS_TIMEOUT: bound on one round of checks
+	ttl     time.Duration // READINESS_CACHE_TTL: how long a round is reused
+
+	mu        sync.Mutex // Held for a round, so concurrent probes share it
+	checkedAt time.Time
+	deps      map[string]DependencyStatus
+}
+
+// newReadinessChecker returns a checker with the settings from
+// READINESS_TIMEOUT and READINESS_CACHE_TTL.
+func newReadinessChecker() *readinessChecker {
+	return &readinessChecker{
+		timeout: max(envDuration("READINESS_TIMEOUT", 2*time.Second), 100*time.Millisecond),
+		ttl:     max(envDuration("READINESS_CACHE_TTL", 5*time.Second), 0),
+	}
+}
+
+// check returns the latest round of checks, running a new one when the cached
+// round is older than the TTL.
+func (rc *readinessChecker) check(ctx context.Context, a *App) (map[string]DependencyStatus, time.Time) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.deps != nil && time.Since(rc.checkedAt) < rc.ttl {
+		return rc.deps, rc.checkedAt
+	}
+	// Detached from the probe's context: the round is shared with other
+	// probes and cached, so one caller hanging up must not fail it.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), rc.timeout)
+	defer cancel()
+	checks := map[string]func(context.Context) error{
+		"queue":   a.checkQueue,
+		"storage": a.checkStorage,
+	}
+	deps := make(map[string]DependencyStatus, len(checks))
+	var (
+		wg    sync.WaitGroup
+		depMu sync.Mutex
+	)
+	for name, fn := range checks {
+		wg.Go(func() {
+			start := time.Now()
+			err := fn(ctx)
+			st := DependencyStatus{Status: dependencyOK, LatencyMs: time.Since(start).Milliseconds()}
+			if err != nil {
+				st.Status, st.Error = dependencyFailed, err.Error()
+			}
+			depMu.Lock()
+			deps[name] = st
+			depMu.Unlock()
+		})
+	}
+	wg.Wait()
+	rc.deps, rc.checkedAt = deps, time.Now()
+	return deps, rc.checkedAt
+}
+
+// checkQueue reads the job queue's depth: GetQueueAttributes on SQS.
+func (a *App) checkQueue(ctx context.Context) error {
+	_, err := a.queue.Depth(ctx, a.sqsURL)
+	return err
+}
+
+// checkStorage reaches the result store: HeadBucket on S3, a head of
+// readinessProbeKey elsewhere (missing is fine).
+func (a *App) checkStorage(ctx context.Context) error {
+	if a.onS3() {
+		_, err := a.s3Client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(a.s3Bucket)})
+		return err
+	}
+	if _, err := a.store.Head(ctx, readinessProbeKey); err != nil && !errors.Is(err, ErrObjectNotFound) {
+		return err
+	}
+	return nil
+}
+
+// readyz handles GET /readyz requests.
+// → 200 ReadinessReport when the queue and storage pass their live checks
+// ("ready (storage degraded)" while recent S3 calls on request paths fail —
+// every replica shares the same bucket, so pulling this one out of rotation
+// would not help); 503 "not ready" when a check fails, and 503 "draining"
+// once shutdown has begun (see alb.go), without checking. With
+// ?stage=active, 503 "observing" while the worker has yet to be promoted.
+func (a *App) readyz(w http.ResponseWriter, r *http.Request) {
+	rep := ReadinessReport{Status: a.readinessStatus()}
+	if a.stage != nil {
+		rep.WorkerStage = a.stage.name()
+	}
+	if rep.Status == "not ready" || rep.Status == "draining" {
+		writeJSON(w, http.StatusServiceUnavailable, rep)
+		return
+	}
+	if r.URL.Query().Get("stage") == stageActive && a.stage.observing() {
+		rep.Status = "observing"
+		writeJSON(w, http.StatusServiceUnavailable, rep)
+		return
+	}
+	deps, checkedAt := a.readiness.check(r.Context(), a)
+	rep.Dependencies, rep.CheckedAt = maps.Clone(deps), Timestamp{Time: checkedAt.UTC()}
+	code := http.StatusOK
+	for name, dep := range rep.Dependencies {
+		switch {
+		case dep.Status == dependencyFailed:
+			rep.Status, code = "not ready", http.StatusServiceUnavailable
+		case name == "storage" && a.storageHealth.degraded():
+			dep.Status = dependencyDegraded
+			rep.Dependencies[name] = dep
+		}
+	}
+	writeJSON(w, code, rep)
+}
@@ -0,0 +1,307 @@
+// Anti-entropy reconciliation. Index entries and creation records are written
+// best effort next to the results they describe, so they can drift: a crash
+// between the result and its index writes leaves a job missing from sorted
+// listings, a purged result leaves stale index entries, and a record can say
+// a job is still pending, queued, processing or failed after its result
+// exists. The reconciler periodically (RECONCILE_INTERVAL) or on demand
+// cross-checks the index, the creation records and the results against each
+// other, repairs what it can, and compares outstanding jobs with the queue's depth — drift that can
+// only be reported, since a lost message cannot be rebuilt. Every run
+// publishes its drift counts as metrics.
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// reconcileSettle skips results and records younger than this, so a run does
+// not race the worker's own index and record writes.
+const reconcileSettle = 5 * time.Minute
+
+// reconcilerConfig controls what the reconciler does.
+type reconcilerConfig struct {
+	repair bool // Fix repairable drift; otherwise report only
+}
+
+// DriftCategory summarises one kind of inconsistency in a ReconcileReport.
+type DriftCategory struct {
+	Found    int      `json:"found"`            // Inconsistencies found
+	Repaired int      `json:"repaired"`         // Fixed (0 without repair)
+	Sample   []string `json:"sample,omitempty"` // First few job IDs, for inspection
+}
+
+// add records one inconsistency.
+func (c *DriftCategory) add(id string) {
+	c.Found++
+	if len(c.Sample) < janitorSampleSize {
+		c.Sample = append(c.Sample, id)
+	}
+}
+
+// ReconcileReport is the outcome of one reconciler run.
+type ReconcileReport struct {
+	StartedAt       Timestamp     `json:"started_at"`
+	FinishedAt      Timestamp     `json:"finished_at"`
+	Repair          bool          `json:"repair"`
+	ResultsChecked  int           `json:"results_checked"`
+	MissingIndex    DriftCategory `json:"missing_index"`    // Result exists, index entries missing
+	StaleIndex      DriftCategory `json:"stale_index"`      // Index entries for a result that no longer exists
+	StaleRecords    DriftCategory `json:"stale_records"`    // Record says pending/queued but the result exists
+	Outstanding     int           `json:"outstanding"`      // Queued or buffered records with no result yet
+	QueueDepth      int64         `json:"queue_depth"`      // Visible + in-flight + delayed messages
+	UnaccountedJobs int64         `json:"unaccounted_jobs"` // Outstanding beyond queue depth: possibly lost messages
+	Errors          []string      `json:"errors,omitempty"`
+}
+
+// reconciler runs reconciliation passes and keeps the last report. A run in
+// progress blocks another from starting.
+type reconciler struct {
+	app *App
+	cfg reconcilerConfig
+
+	running sync.Mutex
+	mu      sync.Mutex
+	last    *ReconcileReport
+}
+
+// errReconcilerBusy is returned when a run is requested while one is in
+// progress.
+var errReconcilerBusy = errors.New("reconciler run already in progress")
+
+// storedResult is a result object seen by a reconciliation pass.
+type storedResult struct {
+	size     int64
+	modified time.Time
+}
+
+// run performs one reconciliation pass; repair overrides the configured mode.
+func (rc *reconciler) run(ctx context.Context, repair bool) (*ReconcileReport, error) {
+	if !rc.running.TryLock() {
+		return nil, errReconcilerBusy
+	}
+	defer rc.running.Unlock()
+
+	rep := &ReconcileReport{StartedAt: Now(), Repair: repair}
+	now := time.Now()
+	results, err := rc.listResults(ctx)
+	if err != nil {
+		// Every check is relative to the results; without them there is nothing
+		// to compare.
+		rep.Errors = append(rep.Errors, "results: "+err.Error())
+	} else {
+		rep.ResultsChecked = len(results)
+		if err := rc.checkIndex(ctx, rep, results, now); err != nil {
+			rep.Errors = append(rep.Errors, "index: "+err.Error())
+		}
+		if err := rc.checkRecords(ctx, rep, results, now); err != nil {
+			rep.Errors = append(rep.Errors, "records: "+err.Error())
+		}
+		if err := rc.checkQueue(ctx, rep); err != nil {
+			rep.Errors = append(rep.Errors, "queue: "+err.Error())
+		}
+	}
+	rep.FinishedAt = Now()
+	rc.record(ctx, rep)
+
+	rc.mu.Lock()
+	rc.last = rep
+	rc.mu.Unlock()
+	slog.Info("reconciler run complete", "repair", repair, "results", rep.ResultsChecked,
+		"missing_index", rep.MissingIndex.Found, "stale_index", rep.StaleIndex.Found,
+		"stale_records", rep.StaleRecords.Found, "unaccounted_jobs", rep.UnaccountedJobs,
+		"errors", len(rep.Errors))
+	return rep, nil
+}
+
+// listResults returns every stored result by job ID.
+func (rc *reconciler) listResults(ctx context.Context) (map[string]storedResult, error) {
+	results := map[string]storedResult{}
+	err := rc.app.listObjects(ctx, "jobs/", func(obj ObjectInfo) error {
+		id := resultKeyID(obj.Key)
+		if id == "" {
+			return nil // artifacts, failure records
+		}
+		results[id] = storedResult{size: obj.Size, modified: obj.LastModified}
+		return nil
+	})
+	return results, err
+}
+
+// checkIndex compares index entries with results: settled results with too
+// few entries get theirs rewritten from the result, and entries of missing
+// results are deleted.
+func (rc *reconciler) checkIndex(ctx context.Context, rep *ReconcileReport, results map[string]storedResult, now time.Time) error {
+	a := rc.app
+	entries := map[string][]string{}
+	if err := a.listObjects(ctx, indexPrefix, func(obj ObjectInfo) error {
+		key := obj.Key
+		if sum, ok := parseIndexKey(key); ok {
+			entries[sum.ID] = append(entries[sum.ID], key)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	var stale []string
+	for id, keys := range entries {
+		if _, ok := results[id]; !ok {
+			rep.StaleIndex.add(id)
+			stale = append(stale, keys...)
+		}
+	}
+	if rep.Repair && len(stale) > 0 {
+		if _, err := a.deleteKeys(ctx, stale); err != nil {
+			return fmt.Errorf("delete stale entries: %w", err)
+		}
+		rep.StaleIndex.Repaired = rep.StaleIndex.Found
+	}
+
+	for id, res := range results {
+		// A complete set is two entries per field. Results without a
+		// created_at have fewer by design, so those are read to tell.
+		if len(entries[id]) == 2*len(sortFields) || now.Sub(res.modified) < reconcileSettle {
+			continue
+		}
+		var result JobResult
+		if err := a.getJSON(ctx, fmt.Sprintf("jobs/%s.json", id), &result); err != nil {
+			return err
+		}
+		sum := newJobSummary(result, res.size)
+		if len(entries[id]) == len(indexKeys(sum)) {
+			continue
+		}
+		rep.MissingIndex.add(id)
+		if rep.Repair {
+			a.writeIndex(ctx, sum)
+			rep.MissingIndex.Repaired++
+		}
+	}
+	return nil
+}
+
+// checkRecords moves creation records whose result exists to completed and
+// counts the rest that are still outstanding.
+func (rc *reconciler) checkRecords(ctx context.Context, rep *ReconcileReport, results map[string]storedResult, now time.Time) error {
+	a := rc.app
+	return a.listObjects(ctx, statusPrefix, func(obj ObjectInfo) error {
+		if now.Sub(obj.LastModified) < reconcileSettle {
+			return nil
+		}
+		key := obj.Key
+		var rec JobRecord
+		if err := a.getJSON(ctx, key, &rec); err != nil {
+			return err
+		}
+		switch rec.State {
+		case createCompleted, createCancelled, createDeleted:
+			// Nothing outstanding: cancelled jobs' messages are dropped.
+			return nil
+		}
+		if _, done := results[rec.ID]; !done {
+			// Everything past pending still has a message in the queue (a
+			// failed attempt's is redelivered).
+			if rec.State != createPending {
+				rep.Outstanding++
+			}
+			return nil
+		}
+		rep.StaleRecords.add(rec.ID)
+		if rep.Repair {
+			rec.Error = ""
+			if err := a.putJobRecord(ctx, &rec, createCompleted); err != nil {
+				return err
+			}
+			rep.StaleRecords.Repaired++
+		}
+		return nil
+	})
+}
+
+// checkQueue compares outstanding jobs with every message the queue holds.
+// More outstanding jobs than messages means some were lost (or expired).
+func (rc *reconciler) checkQueue(ctx context.Context, rep *ReconcileReport) error {
+	a := rc.app
+	ctx, cancel := context.WithTimeout(ctx, awsOpTimeout)
+	defer cancel()
+	d, err := a.queue.Depth(ctx, a.sqsURL)
+	if err != nil {
+		return err
+	}
+	rep.QueueDepth = d.Visible + d.InFlight + d.Delayed
+	rep.UnaccountedJobs = max(0, int64(rep.Outstanding)-rep.QueueDepth)
+	return nil
+}
+
+// record publishes rep's drift counts.
+func (rc *reconciler) record(ctx context.Context, rep *ReconcileReport) {
+	for kind, n := range map[string]int64{
+		"missing_index":    int64(rep.MissingIndex.Found),
+		"stale_index":      int64(rep.StaleIndex.Found),
+		"stale_records":    int64(rep.StaleRecords.Found),
+		"unaccounted_jobs": rep.UnaccountedJobs,
+	} {
+		reconcileDrift.Record(ctx, n, metric.WithAttributes(attribute.String("kind", kind)))
+	}
+	reconcileRepairs.Add(ctx, int64(rep.MissingIndex.Repaired+rep.StaleIndex.Repaired+rep.StaleRecords.Repaired))
+}
+
+// loop runs the reconciler every interval until ctx is cancelled.
+func (rc *reconciler) loop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if _, err := rc.run(ctx, rc.cfg.repair); err != nil {
+			slog.Warn("scheduled reconciler run skipped", "error", err)
+		}
+	}
+}
+
+// runReconciler handles POST /admin/reconciler/run requests.
+// Runs a reconciliation pass synchronously and returns its report. Repairs
+// unless ?repair=false.
+func (a *App) runReconciler(w http.ResponseWriter, r *http.Request) {
+	repair := true
+	if v := r.URL.Query().Get("repair"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, "repair must be a boolean", http.StatusBadRequest)
+			return
+		}
+		repair = b
+	}
+	rep, err := a.reconciler.run(r.Context(), repair)
+	if errors.Is(err, errReconcilerBusy) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	writeJSON(w, http.StatusOK, rep)
+}
+
+// getReconcileReport handles GET /admin/reconciler/report requests.
+// Returns the last reconciler report, or 404 if none has run yet.
+func (a *App) getReconcileReport(w http.ResponseWriter, r *http.Request) {
+	a.reconciler.mu.Lock()
+	rep := a.reconciler.last
+	a.reconciler.mu.Unlock()
+	if rep == nil {
+		http.Error(w, "no reconciler run yet", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, rep)
+}
@@ -0,0 +1,257 @@
+// Dead-letter queue redrive. Jobs that ran out of attempts wait in DLQ_URL
+// (retry.go). The cause is often transient — a dependency outage, a bad
+// deploy since rolled back — so the scheduler can move them back to the job
+// queue by policy instead of an operator doing it by hand. Every
+// REDRIVE_INTERVAL it redrives up to REDRIVE_BATCH messages; of the messages
+// it looks at, it:
+//
+//   - leaves those that reached the DLQ less than REDRIVE_COOLDOWN ago,
+//     hidden until their cool-down ends;
+//   - leaves those that have had REDRIVE_MAX_ATTEMPTS deliveries in total,
+//     across every trip through the job queue, hidden for 12 hours so they do
+//     not crowd out the batch — they are for an operator to inspect;
+//   - leaves messages that are not job envelopes, hidden likewise;
+//   - sends the rest back to the job queue, where they get a fresh
+//     MAX_ATTEMPTS, and deletes them from the DLQ.
+//
+// Lifetime deliveries are counted in the envelope's prior-attempts header,
+// which the worker updates each time it gives up on a message. Messages moved
+// by the queue's own redrive policy carry no header; their DLQ receive count,
+// carried over from the job queue, stands in for it. A redrive that is sent
+// but not deleted is redriven again: the job may run twice.
+//
+// The last run's report is kept for GET /admin/redrive/report; POST
+// /admin/redrive/run runs one on demand.
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// redriveScanFactor bounds a run to this many received messages per message
+// it may redrive, so messages that keep reappearing cannot stall it.
+const redriveScanFactor = 10
+
+// redriveConfig is the redrive policy.
+type redriveConfig struct {
+	cooldown    time.Duration // Time a message spends in the DLQ before it may be redriven
+	batch       int           // Messages redriven per run
+	maxAttempts int           // Lifetime deliveries after which a message is left; 0 for no cap
+}
+
+// newRedriveConfig returns the policy configured by REDRIVE_COOLDOWN,
+// REDRIVE_BATCH and REDRIVE_MAX_ATTEMPTS.
+func newRedriveConfig() redriveConfig {
+	return redriveConfig{
+		cooldown:    max(envDuration("REDRIVE_COOLDOWN", time.Hour), 0),
+		batch:       max(envInt("REDRIVE_BATCH", 10), 1),
+		maxAttempts: max(envInt("REDRIVE_MAX_ATTEMPTS", 20), 0),
+	}
+}
+
+// DLQMessage identifies a dead-lettered message in a RedriveReport.
+type DLQMessage struct {
+	JobID     string `json:"job_id,omitempty"` // Job the message carries
+	MessageID string `json:"message_id"`       // DLQ message ID
+	Attempts  int    `json:"attempts"`         // Lifetime deliveries so far
+}
+
+// RedriveReport is the outcome of one redrive run.
+type RedriveReport struct {
+	StartedAt   Timestamp    `json:"started_at"`
+	FinishedAt  Timestamp    `json:"finished_at"`
+	Redriven    []DLQMessage `json:"redriven"`             // Moved back to the job queue
+	OverLimit   []DLQMessage `json:"over_limit,omitempty"` // Left: at REDRIVE_MAX_ATTEMPTS
+	CoolingDown int          `json:"cooling_down"`         // Left: in the DLQ for less than REDRIVE_COOLDOWN
+	Unreadable  int          `json:"unreadable"`           // Left: not a job envelope
+	Errors      []string     `json:"errors,omitempty"`
+}
+
+// redriver moves dead-lettered messages back to the job queue and keeps the
+// last report. A run in progress blocks another from starting.
+type redriver struct {
+	app *App
+	cfg redriveConfig
+
+	running sync.Mutex
+	mu      sync.Mutex
+	last    *RedriveReport
+}
+
+// Errors returned instead of a redrive report.
+var (
+	errRedriveBusy  = errors.New("redrive already in progress")
+	errRedriveNoDLQ = errors.New("no dead-letter queue configured (DLQ_URL)")
+)
+
+// run redrives up to limit messages.
+func (d *redriver) run(ctx context.Context, limit int) (*RedriveReport, error) {
+	if d.app.retries.dlqURL == "" {
+		return nil, errRedriveNoDLQ
+	}
+	if !d.running.TryLock() {
+		return nil, errRedriveBusy
+	}
+	defer d.running.Unlock()
+
+	rep := &RedriveReport{StartedAt: Now(), Redriven: []DLQMessage{}}
+	for scanned := 0; len(rep.Redriven) < limit && scanned < limit*redriveScanFactor; {
+		rctx, cancel := context.WithTimeout(ctx, awsOpTimeout)
+		msgs, err := d.app.queue.Receive(rctx, d.app.retries.dlqURL, min(limit-len(rep.Redriven), maxReceiveBatch), 0)
+		cancel()
+		if err != nil {
+			recordSQSError(ctx, "ReceiveMessage")
+			rep.Errors = append(rep.Errors, "receive: "+err.Error())
+			break
+		}
+		if len(msgs) == 0 {
+			break
+		}
+		scanned += len(msgs)
+		for _, m := range msgs {
+			if err := d.redriveMessage(ctx, rep, m); err != nil {
+				rep.Errors = append(rep.Errors, aws.ToString(m.MessageId)+": "+err.Error())
+			}
+		}
+	}
+	rep.FinishedAt = Now()
+
+	d.mu.Lock()
+	d.last = rep
+	d.mu.Unlock()
+	slog.Info("redrive run complete", "redriven", len(rep.Redriven), "over_limit", len(rep.OverLimit),
+		"cooling_down", rep.CoolingDown, "unreadable", rep.Unreadable, "errors", len(rep.Errors))
+	return rep, nil
+}
+
+// redriveMessage applies the policy to one DLQ message, recording the
+// outcome in rep.
+func (d *redriver) redriveMessage(ctx context.Context, rep *RedriveReport, m types.Message) error {
+	ctx, cancel := context.WithTimeout(ctx, awsOpTimeout)
+	defer cancel()
+	m, _, err := d.app.resolvePayload(ctx, m)
+	if err != nil {
+		return err
+	}
+	var env Envelope
+	if m, err = d.app.adapters.adapt(m); err == nil {
+		env, err = openEnvelope(m)
+	}
+	if err != nil || env.Type != messageTypeJob {
+		rep.Unreadable++
+		return d.hide(ctx, m, maxVisibilityTimeout)
+	}
+	if wait := d.cfg.cooldown - time.Since(sentTime(m)); wait > 0 {
+		rep.CoolingDown++
+		return d.hide(ctx, m, wait)
+	}
+	var job JobMessage
+	_ = json.Unmarshal(env.Body, &job)
+	dm := DLQMessage{JobID: job.ID, MessageID: aws.ToString(m.MessageId), Attempts: env.priorAttempts()}
+	if _, ok := env.Headers[envelopeHeaderPriorAttempts]; !ok {
+		dm.Attempts = receiveAttempt(m)
+	}
+	if d.cfg.maxAttempts > 0 && dm.Attempts >= d.cfg.maxAttempts {
+		rep.OverLimit = append(rep.OverLimit, dm)
+		return d.hide(ctx, m, maxVisibilityTimeout)
+	}
+
+	body, err := json.Marshal(env.withPriorAttempts(dm.Attempts))
+	if err != nil {
+		return err
+	}
+	if err := d.app.sendWith(ctx, d.app.sqsURL, dm.JobID, string(body), nil, SendOptions{DeduplicationID: dm.MessageID}); err != nil {
+		return err
+	}
+	rep.Redriven = append(rep.Redriven, dm)
+	if err := d.app.queue.Delete(ctx, d.app.retries.dlqURL, aws.ToString(m.ReceiptHandle)); err != nil {
+		recordSQSError(ctx, "DeleteMessage")
+		return err
+	}
+	return nil
+}
+
+// hide keeps a DLQ message out of later receives for wait, rounded up to a
+// whole second.
+func (d *redriver) hide(ctx context.Context, m types.Message, wait time.Duration) error {
+	wait = min(wait, maxVisibilityTimeout)
+	err := d.app.queue.ChangeVisibility(ctx, d.app.retries.dlqURL, aws.ToString(m.ReceiptHandle), (wait + time.Second - 1).Truncate(time.Second))
+	if err != nil {
+		recordSQSError(ctx, "ChangeMessageVisibility")
+	}
+	return err
+}
+
+// sentTime returns when a message was sent to its queue, or the zero time
+// when SQS did not say.
+func sentTime(m types.Message) time.Time {
+	ms, err := strconv.ParseInt(m.Attributes[string(types.MessageSystemAttributeNameSentTimestamp)], 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.UnixMilli(ms)
+}
+
+// loop redrives a batch every interval until ctx is cancelled.
+func (d *redriver) loop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if _, err := d.run(ctx, d.cfg.batch); err != nil {
+			slog.Warn("scheduled redrive skipped", "error", err)
+		}
+	}
+}
+
+// runRedrive handles POST /admin/redrive/run requests.
+// Redrives synchronously and returns the report. ?limit=N overrides
+// REDRIVE_BATCH; the rest of the policy applies as configured.
+func (a *App) runRedrive(w http.ResponseWriter, r *http.Request) {
+	limit := a.redriver.cfg.batch
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	rep, err := a.redriver.run(r.Context(), limit)
+	switch {
+	case errors.Is(err, errRedriveNoDLQ):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, errRedriveBusy):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	writeJSON(w, http.StatusOK, rep)
+}
+
+// getRedriveReport handles GET /admin/redrive/report requests.
+// Returns the last redrive report, or 404 if none has run yet.
+func (a *App) getRedriveReport(w http.ResponseWriter, r *http.Request) {
+	a.redriver.mu.Lock()
+	rep := a.redriver.last
+	a.redriver.mu.Unlock()
+	if rep == nil {
+		http.Error(w, "no redrive run yet", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, rep)
+}
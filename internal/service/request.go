@@ -0,0 +1,174 @@
+// Request-body decoding for job submission. POST /jobs accepts JSON (the
+// default), plain text, and form-encoded bodies so simple scripts and legacy
+// systems can submit jobs without building JSON.
+package service
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+)
+
+// Error codes for rejected job submissions.
+const (
+	errCodeInvalidRequest       = "invalid_request"        // A field failed validation; see fields
+	errCodeInvalidBody          = "invalid_body"           // The body could not be decoded
+	errCodePayloadTooLarge      = "payload_too_large"      // The body is over MAX_BODY_BYTES, or the job too large for SQS
+	errCodeUnsupportedMediaType = "unsupported_media_type" // The Content-Type is not accepted
+)
+
+// errUnsupportedMediaType is returned by decodeJobRequest for a Content-Type it
+// does not understand, so the handler can answer 415 instead of 400.
+var errUnsupportedMediaType = errors.New("unsupported content type: use application/json, text/plain, or application/x-www-form-urlencoded")
+
+// bodyTooLargeError is returned by readBody for a body over its cap.
+type bodyTooLargeError struct{ limit int64 }
+
+func (e *bodyTooLargeError) Error() string {
+	return fmt.Sprintf("request body exceeds %d bytes", e.limit)
+}
+
+// decodeJobRequest reads a JobRequest from r according to its Content-Type:
+//
+//   - application/json (also assumed when the header is absent): {"text":"..."}
+//   - text/plain: the whole body is the text; it must be UTF-8
+//   - application/x-www-form-urlencoded: the "text" form field; every field
+//     must decode to UTF-8
+//
+// A form-typed body that starts with "{" is decoded as JSON, because that is
+// what `curl -d '{"text":"..."}'` sends without an explicit Content-Type.
+// JSON goes through the hardened decoder (jsonbody.go), with unknown fields
+// rejected whatever JSON_STRICT says. The body must already be capped
+// (http.MaxBytesReader, at a.bodyLimit) by the caller.
+func (a *App) decodeJobRequest(r *http.Request) (JobRequest, error) {
+	mediaType := "application/json"
+	var params map[string]string
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		var err error
+		if mediaType, params, err = mime.ParseMediaType(ct); err != nil {
+			return JobRequest{}, errUnsupportedMediaType
+		}
+	}
+
+	body, err := readBody(r)
+	if err != nil {
+		return JobRequest{}, err
+	}
+
+	var req JobRequest
+	strict := a.jsonBodies
+	strict.strict = true
+	switch mediaType {
+	case "application/json":
+		if err := strict.decode(body, &req); err != nil {
+			return JobRequest{}, err
+		}
+	case "text/plain":
+		if cs := strings.ToLower(params["charset"]); cs != "" && cs != "utf-8" && cs != "us-ascii" {
+			return JobRequest{}, errUnsupportedMediaType
+		}
+		if !utf8.Valid(body) {
+			return JobRequest{}, errors.New("text must be valid UTF-8")
+		}
+		req.Text = string(body)
+	case "application/x-www-form-urlencoded":
+		if bytes.HasPrefix(bytes.TrimSpace(body), []byte("{")) {
+			if err := strict.decode(body, &req); err != nil {
+				return JobRequest{}, err
+			}
+			break
+		}
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return JobRequest{}, errors.New("invalid form body")
+		}
+		for name, values := range form {
+			for _, v := range values {
+				if !utf8.ValidString(v) {
+					return JobRequest{}, fmt.Errorf("form field %q must be valid UTF-8", name)
+				}
+			}
+		}
+		req.Text = form.Get("text")
+		req.Type = form.Get("type")
+		req.ParentID = form.Get("parent_id")
+		req.Relation = form.Get("relation")
+		req.CallbackURL = form.Get("callback_url")
+	default:
+		return JobRequest{}, errUnsupportedMediaType
+	}
+	return req, nil
+}
+
+// decodeJSON decodes a JSON request body into v, for endpoints that accept
+// JSON only. The body must already be capped by the caller.
+func (a *App) decodeJSON(r *http.Request, v any) error {
+	body, err := readBody(r)
+	if err != nil {
+		return err
+	}
+	return a.jsonBodies.decode(body, v)
+}
+
+// readBody reads a capped request body, naming the limit when it is hit.
+func readBody(r *http.Request) ([]byte, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			return nil, &bodyTooLargeError{limit: maxErr.Limit}
+		}
+		return nil, errors.New("failed to read request body")
+	}
+	return body, nil
+}
+
+// validateJobRequest checks a decoded job request and normalises its type and
+// lineage fields. A failure is a fieldErrors naming every invalid field, or a
+// jobTypeDisabledError for a valid request of a disabled type (jobflags.go).
+func (a *App) validateJobRequest(req *JobRequest) error {
+	var errs fieldErrors
+	if strings.TrimSpace(req.Text) == "" {
+		errs = append(errs, FieldError{Field: "text", Message: "text is required"})
+	}
+	if err := validateJobType(&req.Type); err != nil {
+		errs = append(errs, *err)
+	}
+	if err := validateLineage(req, a.jobIDs); err != nil {
+		errs = append(errs, *err)
+	}
+	if req.CallbackURL != "" {
+		if err := a.webhooks.checkURL(req.CallbackURL); err != nil {
+			errs = append(errs, FieldError{Field: "callback_url", Message: err.Error()})
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return a.typeFlags.checkJobType(req.Type)
+}
+
+// jobRequestError returns the status and JSON error for a job submission
+// that decodeJobRequest or validateJobRequest rejected.
+func jobRequestError(err error) (int, ErrorDetail) {
+	var tooLarge *bodyTooLargeError
+	var fields fieldErrors
+	var disabled *jobTypeDisabledError
+	switch {
+	case errors.As(err, &disabled):
+		return http.StatusForbidden, ErrorDetail{Code: errCodeJobTypeDisabled, Message: err.Error()}
+	case errors.Is(err, errUnsupportedMediaType):
+		return http.StatusUnsupportedMediaType, ErrorDetail{Code: errCodeUnsupportedMediaType, Message: err.Error()}
+	case errors.As(err, &tooLarge):
+		return http.StatusRequestEntityTooLarge, ErrorDetail{Code: errCodePayloadTooLarge, Message: err.Error()}
+	case errors.As(err, &fields):
+		return http.StatusBadRequest, ErrorDetail{Code: errCodeInvalidRequest, Message: err.Error(), Fields: fields}
+	}
+	return http.StatusBadRequest, ErrorDetail{Code: errCodeInvalidBody, Message: err.Error()}
+}
@@ -0,0 +1,204 @@
+// Retries and circuit breakers for AWS calls. Every SDK call retries
+// transient failures (throttling, 5xx, dropped connections) up to
+// AWS_RETRY_MAX_ATTEMPTS attempts with full-jitter exponential backoff capped
+// at AWS_RETRY_BACKOFF_MAX, drawing on the SDK's client-side retry quota so a
+// long outage stops costing retries. The SDK's own AWS_MAX_ATTEMPTS and
+// AWS_RETRY_MODE are ignored.
+//
+// Around that, SQS and S3 each have a circuit breaker. A call that still
+// fails transiently after its retries counts against its service's breaker;
+// AWS_BREAKER_FAILURES such failures in a row open it. While open, calls to
+// the service fail at once with errCircuitOpen instead of waiting out
+// timeouts and retries, so handlers answer a retryable 503 straight away and
+// the worker backs off instead of spinning. After AWS_BREAKER_COOLDOWN one
+// trial call is let through: its success closes the breaker, its failure
+// opens it for another cooldown. Any response from the service, including a
+// 404 or 403, counts as success, and cancelled calls do not count at all.
+package service
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/smithy-go/middleware"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// errCircuitOpen is returned, wrapped, for calls a breaker refused.
+var errCircuitOpen = errors.New("circuit breaker is open")
+
+// awsResilience is the retry policy and the breakers of the AWS clients.
+type awsResilience struct {
+	maxAttempts     int                        // AWS_RETRY_MAX_ATTEMPTS: attempts per call, the first included
+	backoffMax      time.Duration              // AWS_RETRY_BACKOFF_MAX: cap on the wait between attempts
+	breakerFailures int                        // AWS_BREAKER_FAILURES: failed calls in a row that open a breaker; 0 for none
+	breakerCooldown time.Duration              // AWS_BREAKER_COOLDOWN: how long an open breaker refuses calls
+	breakers        map[string]*circuitBreaker // By SDK service ID
+}
+
+// newAWSResilience returns the settings from AWS_RETRY_MAX_ATTEMPTS,
+// AWS_RETRY_BACKOFF_MAX, AWS_BREAKER_FAILURES and AWS_BREAKER_COOLDOWN.
+func newAWSResilience() *awsResilience {
+	r := &awsResilience{
+		maxAttempts:     max(envInt("AWS_RETRY_MAX_ATTEMPTS", retry.DefaultMaxAttempts), 1),
+		backoffMax:      max(envDuration("AWS_RETRY_BACKOFF_MAX", retry.DefaultMaxBackoff), time.Second),
+		breakerFailures: max(envInt("AWS_BREAKER_FAILURES", 5), 0),
+		breakerCooldown: max(envDuration("AWS_BREAKER_COOLDOWN", 30*time.Second), time.Second),
+		breakers:        map[string]*circuitBreaker{},
+	}
+	if r.breakerFailures > 0 {
+		for _, service := range []string{sqs.ServiceID, s3.ServiceID} {
+			r.breakers[service] = &circuitBreaker{service: service, threshold: r.breakerFailures, cooldown: r.breakerCooldown}
+		}
+	}
+	return r
+}
+
+// apply installs the retry policy and the breakers on cfg, for every client
+// built from it afterwards.
+func (r *awsResilience) apply(cfg *aws.Config) {
+	cfg.Retryer = func() aws.Retryer {
+		return retry.NewStandard(func(o *retry.StandardOptions) {
+			o.MaxAttempts = r.maxAttempts
+			o.MaxBackoff = r.backoffMax
+		})
+	}
+	cfg.RetryMaxAttempts = 0 // AWS_MAX_ATTEMPTS would override the policy
+	if len(r.breakers) > 0 {
+		cfg.APIOptions = append(cfg.APIOptions, func(stack *middleware.Stack) error {
+			// After the service metadata is registered, and outside the
+			// retry loop, so a call counts once however many attempts it
+			// took.
+			return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("CircuitBreaker", r.handleInitialize), middleware.After)
+		})
+	}
+}
+
+// handleInitialize runs one SDK call through its service's breaker.
+func (r *awsResilience) handleInitialize(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+	b := r.breakers[awsmiddleware.GetServiceID(ctx)]
+	if b == nil {
+		return next.HandleInitialize(ctx, in)
+	}
+	trial, err := b.allow()
+	if err != nil {
+		breakerRejections.Add(ctx, 1, metric.WithAttributes(attribute.String("service", b.service)))
+		return middleware.InitializeOutput{}, middleware.Metadata{}, err
+	}
+	out, md, err := next.HandleInitialize(ctx, in)
+	b.record(ctx, trial, callOutcome(ctx, err))
+	return out, md, err
+}
+
+// Outcomes of a call, as a breaker counts them.
+const (
+	callOK        = "ok"        // The service answered
+	callFailed    = "failed"    // A transient failure outlasted the retries
+	callAbandoned = "abandoned" // Cancelled by the caller: says nothing about the service
+)
+
+// callOutcome classifies the error of a call made under ctx.
+func callOutcome(ctx context.Context, err error) string {
+	switch {
+	case err == nil:
+		return callOK
+	case errors.Is(err, context.Canceled) || errors.Is(ctx.Err(), context.Canceled):
+		return callAbandoned
+	case errors.Is(err, context.DeadlineExceeded):
+		return callFailed // The service did not answer in time
+	case retry.IsErrorRetryables(retry.DefaultRetryables).IsErrorRetryable(err) == aws.TrueTernary:
+		return callFailed
+	}
+	return callOK
+}
+
+// circuitBreaker tracks one service's recent calls.
+type circuitBreaker struct {
+	service   string
+	threshold int           // Consecutive failures that open it
+	cooldown  time.Duration // How long it stays open before a trial call
+
+	mu       sync.Mutex
+	failures int       // Consecutive failed calls
+	openedAt time.Time // Zero while closed
+	trying   bool      // A trial call is in flight
+}
+
+// allow reports whether a call may go ahead, and whether it is the trial
+// call of an open breaker.
+func (b *circuitBreaker) allow() (trial bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case b.openedAt.IsZero():
+		return false, nil
+	case b.trying || time.Since(b.openedAt) < b.cooldown:
+		return false, errCircuitOpen // The SDK names the service
+	}
+	b.trying = true
+	return true, nil
+}
+
+// record counts a call's outcome, opening or closing the breaker.
+func (b *circuitBreaker) record(ctx context.Context, trial bool, outcome string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if trial {
+		b.trying = false
+	}
+	switch outcome {
+	case callOK:
+		b.failures = 0
+		if !b.openedAt.IsZero() {
+			b.openedAt = time.Time{}
+			b.transition(ctx, "closed")
+		}
+	case callFailed:
+		b.failures++
+		switch {
+		case trial:
+			b.openedAt = time.Now() // Another cooldown
+		case b.openedAt.IsZero() && b.failures >= b.threshold:
+			b.openedAt = time.Now()
+			b.transition(ctx, "open")
+		}
+	}
+}
+
+// states returns the state of each breaker by service: closed, open, or
+// half_open while its trial call is let through.
+func (r *awsResilience) states() map[string]string {
+	states := map[string]string{}
+	for service, b := range r.breakers {
+		b.mu.Lock()
+		switch {
+		case b.openedAt.IsZero():
+			states[service] = "closed"
+		case b.trying:
+			states[service] = "half_open"
+		default:
+			states[service] = "open"
+		}
+		b.mu.Unlock()
+	}
+	return states
+}
+
+// transition logs and counts the breaker entering state; b.mu must be held.
+func (b *circuitBreaker) transition(ctx context.Context, state string) {
+	breakerTransitions.Add(ctx, 1, metric.WithAttributes(attribute.String("service", b.service), attribute.String("state", state)))
+	if state == "open" {
+		slog.WarnContext(ctx, "AWS circuit breaker opened; failing calls fast", "service", b.service, "failures", b.failures, "cooldown", b.cooldown.String())
+		return
+	}
+	slog.InfoContext(ctx, "AWS circuit breaker closed", "service", b.service)
+}
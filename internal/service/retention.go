@@ -0,0 +1,211 @@
+// Results past retention. Bucket lifecycle rules may move old results under
+// jobs/ to an archive storage class (Glacier Flexible Retrieval, Deep Archive,
+// Intelligent-Tiering archive tiers) or delete them. Either way the job's
+// creation record (status/{id}.json) remains, so GET /jobs/{id} can tell a
+// job that aged out from one that never existed:
+//
+//   - archived: 200 with the job's metadata, "result_state": "archived", the
+//     storage class and the state of a restore. POST
+//     /admin/jobs/{id}/restore starts one for RESTORE_DAYS days at
+//     RESTORE_TIER; once it completes GET returns the result as usual.
+//   - purged: the record says completed but there is no result: 410 Gone
+//     with the metadata and "result_state": "purged".
+//
+// Only a job without a record (never created, or from before status
+// tracking with its result gone) is a 404. HEAD /jobs/{id} reports an
+// archived result with X-Result-State: archived.
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// Result states reported for a job whose result is gone.
+const (
+	resultArchived = "archived" // In an archive storage class; restorable
+	resultPurged   = "purged"   // Deleted; not recoverable
+)
+
+// Restore states of an archived result.
+const (
+	restoreNotStarted = "not_started"
+	restoreInProgress = "in_progress"
+	restoreAvailable  = "available" // Restored copy readable until ExpiresAt
+)
+
+// headerResultState reports an archived result on HEAD /jobs/{id}.
+const headerResultState = "X-Result-State"
+
+// RetainedJob is the GET /jobs/{id} body for a job whose result has been
+// archived or purged.
+type RetainedJob struct {
+	JobStatus
+	ResultState  string       `json:"result_state"`            // archived or purged
+	StorageClass string       `json:"storage_class,omitempty"` // Storage class of an archived result
+	Restore      *RestoreInfo `json:"restore,omitempty"`       // Restore state of an archived result
+	Message      string       `json:"message"`                 // What the client can do about it
+}
+
+// RestoreInfo describes the restore of an archived result.
+type RestoreInfo struct {
+	Status    string    `json:"status"`              // not_started, in_progress or available
+	ExpiresAt Timestamp `json:"expires_at,omitzero"` // When a restored copy is removed again
+	Endpoint  string    `json:"endpoint"`            // Admin request that starts a restore
+}
+
+// restoreConfig is how archived results are restored.
+type restoreConfig struct {
+	days int          // Days a restored copy stays readable
+	tier s3types.Tier // Retrieval tier: Standard, Bulk or Expedited
+}
+
+// newRestoreConfig returns the settings from RESTORE_DAYS and RESTORE_TIER.
+func newRestoreConfig() (restoreConfig, error) {
+	c := restoreConfig{days: max(envInt("RESTORE_DAYS", 7), 1), tier: s3types.TierStandard}
+	if v := getenv("RESTORE_TIER"); v != "" {
+		c.tier = s3types.Tier(v)
+		if !slices.Contains(c.tier.Values(), c.tier) {
+			return restoreConfig{}, fmt.Errorf("RESTORE_TIER must be Standard, Bulk or Expedited, not %q", v)
+		}
+	}
+	return c, nil
+}
+
+// restoreInfo reads the restore state of an archived result from its
+// x-amz-restore header.
+func restoreInfo(jobID string, head ObjectInfo) *RestoreInfo {
+	info := &RestoreInfo{Status: restoreNotStarted, Endpoint: "POST /admin/jobs/" + jobID + "/restore"}
+	restore := head.Restore
+	switch {
+	case restore == "":
+	case strings.Contains(restore, `ongoing-request="true"`):
+		info.Status = restoreInProgress
+	default:
+		info.Status = restoreAvailable
+		if _, expiry, ok := strings.Cut(restore, `expiry-date="`); ok {
+			expiry, _, _ = strings.Cut(expiry, `"`)
+			if t, err := http.ParseTime(expiry); err == nil {
+				info.ExpiresAt = Timestamp{Time: t.UTC()}
+			}
+		}
+	}
+	return info
+}
+
+// headResult describes jobID's result.
+func (a *App) headResult(ctx context.Context, jobID string) (ObjectInfo, error) {
+	ctx, cancel := context.WithTimeout(ctx, awsOpTimeout)
+	defer cancel()
+	return a.store.Head(ctx, fmt.Sprintf("jobs/%s.json", jobID))
+}
+
+// writeArchivedJob answers GET /jobs/{id} for a job whose result is in an
+// archive storage class: 200 with its metadata and restore state.
+func (a *App) writeArchivedJob(w http.ResponseWriter, r *http.Request, jobID string) {
+	ctx := r.Context()
+	head, err := a.headResult(ctx, jobID)
+	if err != nil {
+		writeStorageError(ctx, w, "HeadObject", "failed to look up archived result", err)
+		return
+	}
+	var rec JobRecord
+	if err := a.getJSON(ctx, statusKey(jobID), &rec); err != nil {
+		if classifyS3Error(err).Kind != s3NotFound {
+			writeStorageError(ctx, w, "GetObject", "failed to read job status", err)
+			return
+		}
+		// Jobs from before status tracking: the result's age is all there is.
+		rec = JobRecord{FinishedAt: Timestamp{Time: head.LastModified.UTC()}}
+		rec.UpdatedAt = rec.FinishedAt
+	}
+	rec.ID, rec.State = jobID, createCompleted
+
+	job := RetainedJob{
+		JobStatus:    newJobStatus(rec),
+		ResultState:  resultArchived,
+		StorageClass: head.StorageClass,
+		Restore:      restoreInfo(jobID, head),
+	}
+	switch job.Restore.Status {
+	case restoreNotStarted:
+		job.Message = fmt.Sprintf("the result has been archived; an operator can restore it with %s, after which GET /jobs/%s returns it", job.Restore.Endpoint, jobID)
+	case restoreInProgress:
+		job.Message = "the result has been archived and is being restored; retry later"
+	default:
+		job.Message = "the result has been restored; retry now"
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+// writePurgedJob answers GET /jobs/{id} for a completed job whose result no
+// longer exists: 410 with its metadata.
+func writePurgedJob(w http.ResponseWriter, status JobStatus) {
+	writeJSON(w, http.StatusGone, RetainedJob{
+		JobStatus:   status,
+		ResultState: resultPurged,
+		Message:     "the result has been deleted under the retention policy and cannot be restored",
+	})
+}
+
+// restoreJob handles POST /admin/jobs/{id}/restore requests.
+// Starts restoring an archived result for RESTORE_DAYS days at RESTORE_TIER
+// → 202 RestoreInfo; 200 when a restore is already in progress or done, 404
+// when there is no result and 409 when it is not archived.
+func (a *App) restoreJob(w http.ResponseWriter, r *http.Request) {
+	jobID, ok := a.pathJobID(w, r)
+	if !ok {
+		return
+	}
+	ctx := r.Context()
+	head, err := a.headResult(ctx, jobID)
+	if err != nil {
+		if classifyS3Error(err).Kind == s3NotFound {
+			http.Error(w, "job result not found", http.StatusNotFound)
+			return
+		}
+		writeStorageError(ctx, w, "HeadObject", "failed to look up job result", err)
+		return
+	}
+	if !head.Archived {
+		http.Error(w, "job result is not archived", http.StatusConflict)
+		return
+	}
+	info := restoreInfo(jobID, head)
+	if info.Status != restoreNotStarted {
+		writeJSON(w, http.StatusOK, info)
+		return
+	}
+
+	req := &s3types.RestoreRequest{GlacierJobParameters: &s3types.GlacierJobParameters{Tier: a.restore.tier}}
+	if head.StorageClass != string(s3types.StorageClassIntelligentTiering) {
+		// Intelligent-Tiering moves a restored object back to a frequent
+		// access tier instead of keeping a copy for a number of days.
+		req.Days = aws.Int32(int32(a.restore.days))
+	}
+	rctx, cancel := context.WithTimeout(ctx, awsOpTimeout)
+	defer cancel()
+	_, err = a.s3Client.RestoreObject(rctx, &s3.RestoreObjectInput{
+		Bucket:         aws.String(a.s3Bucket),
+		Key:            aws.String(fmt.Sprintf("jobs/%s.json", jobID)),
+		RestoreRequest: req,
+	})
+	if err != nil {
+		if classifyS3Error(err).Code == "RestoreAlreadyInProgress" {
+			info.Status = restoreInProgress
+			writeJSON(w, http.StatusOK, info)
+			return
+		}
+		writeStorageError(ctx, w, "RestoreObject", "failed to start restore", err)
+		return
+	}
+	info.Status = restoreInProgress
+	writeJSON(w, http.StatusAccepted, info)
+}
@@ -0,0 +1,159 @@
+// Retry limits for failed jobs. SQS redelivers a message the worker did not
+// delete once its visibility timeout expires, so without a limit a job that
+// always fails is retried forever. The worker counts deliveries with
+// ApproximateReceiveCount and, when an attempt fails:
+//
+//   - below MAX_ATTEMPTS, sets the message's visibility timeout to an
+//     exponential backoff — RETRY_BACKOFF_BASE, doubling per attempt, capped
+//     at RETRY_BACKOFF_MAX — so retries spread out instead of following the
+//     queue's fixed timeout;
+//   - at MAX_ATTEMPTS, gives up: it writes a failure record to
+//     jobs/{id}.failed.json, forwards the message to DLQ_URL when set, and
+//     deletes it from the queue. The forwarded envelope's prior-attempts
+//     header counts the job's deliveries across every trip through the queue,
+//     for the redrive policy (redrive.go).
+//
+// Giving up only deletes the message once the record and the forward have
+// succeeded; otherwise the message is redelivered and the next attempt past
+// the limit tries again. A message that cannot even be opened has no job ID
+// and so no failure record; without DLQ_URL it is logged and dropped.
+// MAX_ATTEMPTS=0 disables the limit, leaving it to the queue's redrive
+// policy; with both, keep MAX_ATTEMPTS below the policy's maxReceiveCount or
+// SQS moves the message first.
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// maxVisibilityTimeout is the longest visibility timeout SQS accepts.
+const maxVisibilityTimeout = 12 * time.Hour
+
+// FailureRecord is stored at jobs/{id}.failed.json when a job runs out of
+// attempts.
+type FailureRecord struct {
+	ID              string    `json:"id"`                          // Job ID
+	Tenant          string    `json:"tenant,omitempty"`            // Submitting tenant, when known
+	Attempts        int       `json:"attempts"`                    // Deliveries made, the last included, across redrives
+	Error           string    `json:"error"`                       // Why the last attempt failed
+	FailedAt        Timestamp `json:"failed_at"`                   // When the worker gave up
+	DeadLetterQueue string    `json:"dead_letter_queue,omitempty"` // DLQ_URL the message was forwarded to
+	Message         string    `json:"message"`                     // The message body as received, for replay
+}
+
+// failureKey returns the key of jobID's failure record.
+func failureKey(jobID string) string { return jobsPrefix + jobID + ".failed.json" }
+
+// retryPolicy decides what happens to a message whose processing failed.
+type retryPolicy struct {
+	maxAttempts int           // Deliveries before giving up; 0 retries forever
+	backoffBase time.Duration // Visibility timeout after the first failure
+	backoffMax  time.Duration // Cap on the backoff
+	dlqURL      string        // Queue given-up messages are forwarded to; "" for none
+}
+
+// newRetryPolicy returns the policy configured by MAX_ATTEMPTS,
+// RETRY_BACKOFF_BASE, RETRY_BACKOFF_MAX and DLQ_URL.
+func newRetryPolicy() retryPolicy {
+	return retryPolicy{
+		maxAttempts: max(envInt("MAX_ATTEMPTS", 5), 0),
+		backoffBase: max(envDuration("RETRY_BACKOFF_BASE", 10*time.Second), 0),
+		backoffMax:  min(envDuration("RETRY_BACKOFF_MAX", 15*time.Minute), maxVisibilityTimeout),
+		dlqURL:      getenv("DLQ_URL"),
+	}
+}
+
+// exhausted reports whether a failed attempt was the last one allowed.
+func (p retryPolicy) exhausted(attempt int) bool {
+	return p.maxAttempts > 0 && attempt >= p.maxAttempts
+}
+
+// backoff returns how long to hide a message after its attempt'th delivery
+// failed.
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	d := p.backoffBase
+	for i := 1; i < attempt && d < p.backoffMax; i++ {
+		d *= 2
+	}
+	return min(d, p.backoffMax)
+}
+
+// handleFailure retries or gives up on a message whose attempt'th delivery
+// failed with jobErr. env is the zero Envelope when the message could not be
+// opened.
+func (a *App) handleFailure(ctx context.Context, message types.Message, env Envelope, attempt int, jobErr error) {
+	ctx, cancel := context.WithTimeout(ctx, awsOpTimeout)
+	defer cancel()
+	final := a.retries.exhausted(attempt)
+	jobFailures.Add(ctx, 1, metric.WithAttributes(attribute.Bool("final", final)))
+	if !final {
+		backoff := a.retries.backoff(attempt)
+		err := a.queue.ChangeVisibility(ctx, a.sqsURL, aws.ToString(message.ReceiptHandle), backoff)
+		if err != nil {
+			recordSQSError(ctx, "ChangeMessageVisibility")
+			// The queue's own visibility timeout still brings it back.
+			slog.WarnContext(ctx, "failed to set retry backoff", "attempt", attempt, "backoff", backoff, "error", err)
+		}
+		return
+	}
+	if err := a.giveUp(ctx, message, env, attempt, jobErr); err != nil {
+		slog.ErrorContext(ctx, "failed to give up on message, leaving it for redelivery", "attempt", attempt, "error", err)
+	}
+}
+
+// giveUp records a job that ran out of attempts, forwards its message to the
+// dead-letter queue when one is configured, and deletes it from the job
+// queue.
+func (a *App) giveUp(ctx context.Context, message types.Message, env Envelope, attempt int, jobErr error) error {
+	var job JobMessage
+	if env.Type == messageTypeJob {
+		_ = json.Unmarshal(env.Body, &job)
+	}
+	attempts := env.priorAttempts() + attempt
+	if job.ID != "" {
+		rec := FailureRecord{
+			ID:              job.ID,
+			Tenant:          job.Tenant,
+			Attempts:        attempts,
+			Error:           jobErr.Error(),
+			FailedAt:        Now(),
+			DeadLetterQueue: a.retries.dlqURL,
+			Message:         aws.ToString(message.Body),
+		}
+		if err := a.putJSON(ctx, failureKey(job.ID), rec); err != nil {
+			return fmt.Errorf("failed to write failure record: %w", err)
+		}
+	}
+	if a.retries.dlqURL != "" {
+		// A message that could not be opened is forwarded as received.
+		body := message.Body
+		if env.Type != "" {
+			raw, err := json.Marshal(env.withPriorAttempts(attempts))
+			if err != nil {
+				return fmt.Errorf("failed to marshal dead-letter message: %w", err)
+			}
+			body = aws.String(string(raw))
+		}
+		opts := SendOptions{DeduplicationID: aws.ToString(message.MessageId)}
+		if err := a.sendWith(ctx, a.retries.dlqURL, job.ID, aws.ToString(body), message.MessageAttributes, opts); err != nil {
+			return fmt.Errorf("failed to forward to dead-letter queue: %w", err)
+		}
+	}
+	err := a.queue.Delete(ctx, a.sqsURL, aws.ToString(message.ReceiptHandle))
+	if err != nil {
+		recordSQSError(ctx, "DeleteMessage")
+		return fmt.Errorf("failed to delete message: %w", err)
+	}
+	slog.ErrorContext(ctx, "job failed permanently", "job_id", job.ID, "message_id", aws.ToString(message.MessageId),
+		"attempts", attempts, "dead_letter_queue", a.retries.dlqURL, "error", jobErr)
+	return nil
+}
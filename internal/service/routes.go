@@ -0,0 +1,174 @@
+// Route registration and unmatched requests. router is the http.ServeMux
+// every process serves, with four differences:
+//
+//   - A duplicate or conflicting pattern does not panic mid-registration:
+//     the conflict is recorded, registration carries on, and Run reports
+//     every conflict at once and exits.
+//   - Requests no route matches get the JSON error envelope — 404
+//     not_found, or 405 method_not_allowed with the mux's Allow header —
+//     instead of the mux's plain-text replies.
+//   - OPTIONS on any route answers 204 with its Allow methods and Link
+//     headers to related resources (discovery.go).
+//   - route registers a handler behind its middleware (admin token, rate
+//     limit, mirroring), in a server span named after the handler.
+//   - Paths are matched the same way on every route: case-sensitively, and
+//     with a trailing slash ignored ("/jobs/" is "/jobs"), except on
+//     subtree patterns such as /debug/pprof/ where the slash is part of the
+//     route. A path that only matches in lower case gets a 404 naming the
+//     route it probably meant.
+package service
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// Error codes for requests no route matches.
+const (
+	errCodeNotFound         = "not_found"
+	errCodeMethodNotAllowed = "method_not_allowed"
+)
+
+// router is an http.ServeMux that records registration conflicts and
+// answers unmatched requests with JSON errors.
+type router struct {
+	*http.ServeMux
+	conflicts []error  // Patterns the mux refused
+	patterns  []string // Patterns registered, in order, for the OpenAPI document
+}
+
+// newRouter returns an empty router.
+func newRouter() *router {
+	return &router{ServeMux: http.NewServeMux()}
+}
+
+// Handle registers handler for pattern, recording a conflict instead of
+// panicking when the mux refuses the pattern.
+func (rt *router) Handle(pattern string, handler http.Handler) {
+	defer func() {
+		if p := recover(); p != nil {
+			rt.conflicts = append(rt.conflicts, fmt.Errorf("route %q: %v", pattern, p))
+		}
+	}()
+	rt.ServeMux.Handle(pattern, handler)
+	rt.patterns = append(rt.patterns, pattern)
+}
+
+// HandleFunc registers handler for pattern, like Handle.
+func (rt *router) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	rt.Handle(pattern, http.HandlerFunc(handler))
+}
+
+// routeMiddleware wraps one route's handler, e.g. a.requireAdmin. Middleware for
+// every request wraps the router instead (Run).
+type routeMiddleware func(http.HandlerFunc) http.HandlerFunc
+
+// route registers handler for pattern behind mws, traced as name.
+func (rt *router) route(pattern, name string, handler http.HandlerFunc, mws ...routeMiddleware) {
+	rt.Handle(pattern, traced(name, handler, mws...))
+}
+
+// traced returns handler behind mws, the first outermost, in a server span
+// named name.
+func traced(name string, handler http.HandlerFunc, mws ...routeMiddleware) http.Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		handler = mws[i](handler)
+	}
+	return otelhttp.NewHandler(handler, name)
+}
+
+// err returns every registration conflict, or nil.
+func (rt *router) err() error {
+	return errors.Join(rt.conflicts...)
+}
+
+// ServeHTTP routes r, retrying without a trailing slash, answering OPTIONS
+// for routes that do not handle it themselves (see discovery.go), and
+// replacing the mux's plain-text 404 and 405 replies with JSON errors.
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reqs := []*http.Request{r}
+	if path := r.URL.Path; len(path) > 1 && strings.HasSuffix(path, "/") {
+		reqs = append(reqs, withPath(r, strings.TrimRight(path, "/")))
+	}
+	for _, req := range reqs {
+		if _, pattern := rt.Handler(req); pattern != "" {
+			rt.ServeMux.ServeHTTP(w, req)
+			return
+		}
+	}
+	if r.Method == http.MethodOptions {
+		for _, req := range reqs {
+			if rt.options(w, req) {
+				return
+			}
+		}
+	}
+	rt.ServeMux.ServeHTTP(&unmatchedWriter{ResponseWriter: w, router: rt, r: r}, r)
+}
+
+// suggest returns the path r probably meant when it only matches a route in
+// lower case, or "".
+func (rt *router) suggest(r *http.Request) string {
+	lower := strings.ToLower(strings.TrimRight(r.URL.Path, "/"))
+	if lower == "" || lower == r.URL.Path {
+		return ""
+	}
+	if _, pattern := rt.Handler(withPath(r, lower)); pattern != "" {
+		return lower
+	}
+	return ""
+}
+
+// withPath returns a shallow copy of r for path.
+func withPath(r *http.Request, path string) *http.Request {
+	u := *r.URL
+	u.Path, u.RawPath = path, ""
+	r2 := r.WithContext(r.Context())
+	r2.URL = &u
+	return r2
+}
+
+// unmatchedWriter turns the mux's 404 and 405 replies into JSON errors. The
+// mux sets Allow itself before writing a 405; only the body is replaced.
+type unmatchedWriter struct {
+	http.ResponseWriter
+	router   *router
+	r        *http.Request
+	replaced bool // The mux's body is being discarded
+}
+
+// WriteHeader writes the JSON error instead of the mux's status line and
+// body for 404 and 405.
+func (w *unmatchedWriter) WriteHeader(status int) {
+	switch status {
+	case http.StatusNotFound:
+		w.replaced = true
+		msg := "no route for " + w.r.Method + " " + w.r.URL.Path
+		if s := w.router.suggest(w.r); s != "" {
+			msg += " (paths are case-sensitive; did you mean " + s + "?)"
+		} else if s := w.router.successor(w.r); s != "" {
+			msg += " (unversioned paths are retired; use " + s + ")"
+		}
+		writeError(w.ResponseWriter, status, ErrorDetail{Code: errCodeNotFound, Message: msg})
+	case http.StatusMethodNotAllowed:
+		w.replaced = true
+		writeError(w.ResponseWriter, status, ErrorDetail{
+			Code:    errCodeMethodNotAllowed,
+			Message: fmt.Sprintf("method %s not allowed for %s; allowed: %s", w.r.Method, w.r.URL.Path, w.Header().Get("Allow")),
+		})
+	default:
+		w.ResponseWriter.WriteHeader(status)
+	}
+}
+
+// Write discards the mux's body once the JSON error has been written.
+func (w *unmatchedWriter) Write(b []byte) (int, error) {
+	if w.replaced {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
@@ -0,0 +1,47 @@
+// Run modes of the single binary. RUN_MODE selects what an app process runs,
+// so one image can be deployed as separate API and worker deployments (two
+// Kubernetes Deployments, two ECS services) that scale independently:
+//
+//	api     the job API and scheduled maintenance
+//	worker  the SQS consumer, with only the health probes served
+//	both    all of them in one process
+//
+// Without RUN_MODE the older WORKER_ENABLED switch applies: "true" is both,
+// anything else api. The cmd/ binaries fix their components and ignore both
+// variables.
+package service
+
+import (
+	"fmt"
+	"log/slog"
+)
+
+// Values of RUN_MODE.
+const (
+	runModeAPI    = "api"
+	runModeWorker = "worker"
+	runModeBoth   = "both"
+)
+
+// runModeComponents returns the components selected by RUN_MODE, falling
+// back to WORKER_ENABLED when it is unset.
+func runModeComponents() (Components, error) {
+	mode := getenv("RUN_MODE")
+	switch {
+	case mode == "" && getenv("WORKER_ENABLED") == "true":
+		mode = runModeBoth
+	case mode == "":
+		mode = runModeAPI
+	case getenv("WORKER_ENABLED") != "":
+		slog.Warn("WORKER_ENABLED is ignored because RUN_MODE is set", "run_mode", mode)
+	}
+	switch mode {
+	case runModeAPI:
+		return Components{API: true, Scheduler: true}, nil
+	case runModeWorker:
+		return Components{Worker: true}, nil
+	case runModeBoth:
+		return Components{API: true, Worker: true, Scheduler: true}, nil
+	}
+	return Components{}, fmt.Errorf("RUN_MODE must be api, worker or both, not %q", mode)
+}
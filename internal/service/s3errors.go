@@ -0,0 +1,213 @@
+// S3 error classification. The SDK surfaces every failure as a generic error;
+// this file turns it into a kind (not found, missing bucket, access denied,
+// throttled, server error, unreachable, archived) so handlers can pick the right status, metrics can be
+// broken down by cause, and logs carry the request/host IDs AWS support asks
+// for.
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// s3ErrorKind is the coarse cause of an S3 failure.
+type s3ErrorKind string
+
+const (
+	s3NotFound     s3ErrorKind = "not_found"     // NoSuchKey, or a 404 without an error code (HEAD)
+	s3NoBucket     s3ErrorKind = "no_bucket"     // NoSuchBucket: S3_BUCKET is wrong or the bucket is gone
+	s3AccessDenied s3ErrorKind = "access_denied" // 403: IAM or bucket policy
+	s3Throttled    s3ErrorKind = "throttled"     // SlowDown and other throttle codes
+	s3ServerError  s3ErrorKind = "server_error"  // 5xx from S3
+	s3ClientError  s3ErrorKind = "client_error"  // any other 4xx
+	s3Unreachable  s3ErrorKind = "unreachable"   // no response: network, DNS, timeout
+	s3Archived     s3ErrorKind = "archived"      // InvalidObjectState: object in an archive storage class
+)
+
+// Error codes returned to clients for S3 failures (see s3Failure.response).
+const (
+	errCodeStorageThrottled    = "storage_throttled"
+	errCodeStorageError        = "storage_error"
+	errCodeStorageAccessDenied = "storage_access_denied"
+	errCodeStorageNoBucket     = "storage_bucket_missing"
+	errCodeResultArchived      = "result_archived"
+)
+
+// s3Failure is a classified S3 error.
+type s3Failure struct {
+	Kind      s3ErrorKind
+	Code      string // S3 error code, e.g. "SlowDown"; empty when there was no response
+	Status    int    // HTTP status; 0 when there was no response
+	RequestID string // x-amz-request-id, for AWS support cases
+	HostID    string // x-amz-id-2, for AWS support cases
+}
+
+// classifyS3Error inspects err from an S3 call. It never returns a zero Kind;
+// anything without an HTTP response is s3Unreachable.
+func classifyS3Error(err error) s3Failure {
+	// The filesystem store's errors (store.go).
+	switch {
+	case errors.Is(err, ErrObjectNotFound):
+		return s3Failure{Kind: s3NotFound, Status: http.StatusNotFound}
+	case errors.Is(err, ErrPreconditionFailed):
+		return s3Failure{Kind: s3ClientError, Code: "PreconditionFailed", Status: http.StatusPreconditionFailed}
+	case errors.Is(err, fs.ErrPermission):
+		return s3Failure{Kind: s3AccessDenied}
+	case errors.Is(err, errCircuitOpen):
+		// Not sent: S3 has been failing (resilience.go).
+		return s3Failure{Kind: s3Unreachable, Code: "CircuitOpen"}
+	}
+
+	var f s3Failure
+	var respErr *awshttp.ResponseError
+	if errors.As(err, &respErr) {
+		f.Status = respErr.HTTPStatusCode()
+		f.RequestID = respErr.ServiceRequestID()
+	}
+	var s3Resp s3.ResponseError
+	if errors.As(err, &s3Resp) {
+		f.HostID = s3Resp.ServiceHostID()
+	}
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		f.Code = apiErr.ErrorCode()
+	}
+
+	var noSuchKey *s3types.NoSuchKey
+	var notFound *s3types.NotFound
+	var noSuchBucket *s3types.NoSuchBucket
+	var archived *s3types.InvalidObjectState
+	_, throttle := retry.DefaultThrottleErrorCodes[f.Code]
+	switch {
+	case errors.As(err, &noSuchBucket), f.Code == "NoSuchBucket":
+		// Every key "missing" would otherwise hide a misconfiguration.
+		f.Kind = s3NoBucket
+	case errors.As(err, &noSuchKey), f.Code == "NoSuchKey":
+		f.Kind = s3NotFound
+	case errors.As(err, &notFound), f.Status == http.StatusNotFound && (f.Code == "" || f.Code == "NotFound"):
+		// A HEAD response has no body, so no code; the SDK calls it NotFound.
+		f.Kind = s3NotFound
+	case errors.As(err, &archived), f.Code == "InvalidObjectState":
+		f.Kind = s3Archived
+	case f.Code == "AccessDenied", f.Status == http.StatusForbidden:
+		f.Kind = s3AccessDenied
+	case throttle, f.Status == http.StatusTooManyRequests:
+		f.Kind = s3Throttled
+	case f.Status >= 500:
+		f.Kind = s3ServerError
+	case f.Status >= 400:
+		f.Kind = s3ClientError
+	default:
+		f.Kind = s3Unreachable
+	}
+	return f
+}
+
+// response maps the failure to the HTTP status, error code, and retryability
+// reported to API clients. Not-found is handled by callers before this.
+func (f s3Failure) response() (status int, code string, retryable bool) {
+	switch f.Kind {
+	case s3Throttled:
+		return http.StatusServiceUnavailable, errCodeStorageThrottled, true
+	case s3ServerError:
+		return http.StatusBadGateway, errCodeStorageError, true
+	case s3AccessDenied:
+		return http.StatusBadGateway, errCodeStorageAccessDenied, false
+	case s3NoBucket:
+		return http.StatusBadGateway, errCodeStorageNoBucket, false
+	case s3ClientError:
+		return http.StatusBadGateway, errCodeStorageError, false
+	case s3Archived:
+		return http.StatusConflict, errCodeResultArchived, false
+	default:
+		return http.StatusServiceUnavailable, errCodeStorageUnavailable, true
+	}
+}
+
+// degradesStorage reports whether the failure means S3 itself is unhealthy or
+// unusable (as opposed to a valid "not found" answer or a bad request).
+func (f s3Failure) degradesStorage() bool {
+	return f.Kind != s3NotFound && f.Kind != s3ClientError && f.Kind != s3Archived
+}
+
+// logAttrs returns slog key/value pairs describing the failure.
+func (f s3Failure) logAttrs() []any {
+	return []any{
+		"s3_error_kind", string(f.Kind),
+		"s3_error_code", f.Code,
+		"s3_status", f.Status,
+		"s3_request_id", f.RequestID,
+		"s3_host_id", f.HostID,
+	}
+}
+
+// writeStorageError records err as a failed S3 operation op and writes the
+// matching JSON error, with message describing what the handler was doing.
+func writeStorageError(ctx context.Context, w http.ResponseWriter, op, message string, err error) {
+	f := classifyS3Error(err)
+	recordS3Error(ctx, op, f)
+	slog.ErrorContext(ctx, message, append([]any{"error", err}, f.logAttrs()...)...)
+	status, code, retryable := f.response()
+	if retryable {
+		writeRetryableError(w, status, code, message, storageRetryAfter)
+		return
+	}
+	writeError(w, status, ErrorDetail{Code: code, Message: message})
+}
+
+// recordS3Error counts a classified S3 failure for operation op (e.g.
+// "GetObject") in the s3.errors metric.
+func recordS3Error(ctx context.Context, op string, f s3Failure) {
+	s3Errors.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("operation", op),
+		attribute.String("kind", string(f.Kind)),
+	))
+}
+
+// checkBucketAccess issues a HeadBucket at startup and adds a startup hint if
+// the bucket is missing, in another region than the client's, or the task
+// role cannot reach it. It never fails startup: S3 may simply not be
+// reachable yet, and reads already degrade gracefully.
+func (a *App) checkBucketAccess(ctx context.Context, rep *StartupReport) {
+	if !a.onS3() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, awsOpTimeout)
+	defer cancel()
+	out, err := a.s3Client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(a.s3Bucket)})
+	if err == nil {
+		if region := aws.ToString(out.BucketRegion); region != "" && region != a.s3Client.Options().Region {
+			rep.hint("AWS_REGION",
+				fmt.Sprintf("bucket %s is in %s but the clients sign for %s; requests are redirected or rejected", a.s3Bucket, region, a.s3Client.Options().Region),
+				fmt.Sprintf("set AWS_REGION=%s, or use a bucket in %s", region, a.s3Client.Options().Region))
+		}
+		return
+	}
+	f := classifyS3Error(err)
+	recordS3Error(ctx, "HeadBucket", f)
+	switch f.Kind {
+	case s3AccessDenied:
+		rep.hint("S3_BUCKET", fmt.Sprintf("access to bucket %s is denied: %v", a.s3Bucket, err),
+			"grant the task role s3:GetObject, s3:PutObject and s3:ListBucket, and check the bucket policy")
+	case s3NotFound, s3NoBucket:
+		rep.hint("S3_BUCKET", fmt.Sprintf("bucket %s does not exist", a.s3Bucket),
+			"create the bucket, or correct S3_BUCKET")
+	default:
+		rep.hint("S3_BUCKET", fmt.Sprintf("checking bucket %s failed: %v", a.s3Bucket, err),
+			"check the S3 endpoint, network path and region")
+	}
+}
@@ -0,0 +1,55 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// s3ResponseError is err as the SDK returns it for an S3 answer of status.
+func s3ResponseError(status int, err error) error {
+	return &awshttp.ResponseError{
+		ResponseError: &smithyhttp.ResponseError{
+			Response: &smithyhttp.Response{Response: &http.Response{StatusCode: status}},
+			Err:      err,
+		},
+	}
+}
+
+func TestClassifyS3Error(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want s3ErrorKind
+	}{
+		{"no such key", s3ResponseError(404, &s3types.NoSuchKey{}), s3NotFound},
+		{"head 404", s3ResponseError(404, &s3types.NotFound{}), s3NotFound},
+		{"404 without code", s3ResponseError(404, errors.New("not found")), s3NotFound},
+		{"no such bucket", s3ResponseError(404, &s3types.NoSuchBucket{}), s3NoBucket},
+		{"no such bucket by code", s3ResponseError(404, &smithy.GenericAPIError{Code: "NoSuchBucket"}), s3NoBucket},
+		{"other 404 code", s3ResponseError(404, &smithy.GenericAPIError{Code: "NoSuchUpload"}), s3ClientError},
+		{"access denied", s3ResponseError(403, &smithy.GenericAPIError{Code: "AccessDenied"}), s3AccessDenied},
+		{"filesystem not found", fmt.Errorf("get: %w", ErrObjectNotFound), s3NotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := classifyS3Error(tt.err)
+			if f.Kind != tt.want {
+				t.Errorf("kind = %s, want %s", f.Kind, tt.want)
+			}
+		})
+	}
+	f := classifyS3Error(s3ResponseError(404, &s3types.NoSuchBucket{}))
+	if !f.degradesStorage() {
+		t.Error("a missing bucket does not degrade storage")
+	}
+	if status, code, _ := f.response(); status != http.StatusBadGateway || code != errCodeStorageNoBucket {
+		t.Errorf("missing bucket answered %d %s", status, code)
+	}
+}
@@ -0,0 +1,199 @@
+// Payload scrubbing for data leaving production. Mirrored requests
+// (mirror.go) and scrubbed migrations (migrate.go, cmd/migrate -scrub) pass
+// their payloads through a Scrubber first, so lower environments never
+// receive raw production data. SCRUB_RULES is a JSON object:
+//
+//	{"hash": ["parent_id"], "drop": ["notes"], "redact": ["[\\w.+-]+@[\\w-]+\\.[\\w.]+"]}
+//
+// hash replaces the string values of those keys with a keyed hash
+// (HMAC-SHA256 with SCRUB_HASH_KEY), so equal inputs still correlate across
+// scrubbed data without being recoverable; drop removes the keys; redact
+// replaces every match of the patterns, in any remaining string, with
+// "[redacted]". Keys match at any depth of a JSON document. A text/plain job
+// body is scrubbed as the "text" key.
+package service
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/url"
+	"os"
+	"regexp"
+)
+
+// redactedValue replaces matches of redact patterns.
+const redactedValue = "[redacted]"
+
+// ScrubRules configures a Scrubber.
+type ScrubRules struct {
+	Hash   []string `json:"hash,omitempty"`   // Keys whose string values are replaced with a keyed hash
+	Drop   []string `json:"drop,omitempty"`   // Keys removed entirely
+	Redact []string `json:"redact,omitempty"` // Regular expressions replaced in every string value
+}
+
+// Scrubber transforms payloads according to ScrubRules. It is safe for
+// concurrent use.
+type Scrubber struct {
+	hash    map[string]bool
+	drop    map[string]bool
+	redact  []*regexp.Regexp
+	hashKey []byte
+}
+
+// NewScrubber compiles rules. A hash key is required when rules hash
+// anything: unkeyed hashes of IDs and short strings are easily reversed.
+func NewScrubber(rules ScrubRules, hashKey []byte) (*Scrubber, error) {
+	s := &Scrubber{hash: map[string]bool{}, drop: map[string]bool{}, hashKey: hashKey}
+	for _, k := range rules.Hash {
+		s.hash[k] = true
+	}
+	for _, k := range rules.Drop {
+		s.drop[k] = true
+	}
+	if len(s.hash) > 0 && len(hashKey) == 0 {
+		return nil, errors.New("hash rules need a hash key")
+	}
+	for _, p := range rules.Redact {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("redact pattern %q: %w", p, err)
+		}
+		s.redact = append(s.redact, re)
+	}
+	return s, nil
+}
+
+// ScrubberFromEnv builds the Scrubber configured by SCRUB_RULES and
+// SCRUB_HASH_KEY, or returns nil when SCRUB_RULES is unset. SCRUB_RULES may
+// also be "@path" to read the rules from a file.
+func ScrubberFromEnv() (*Scrubber, error) {
+	raw := getenv("SCRUB_RULES")
+	if raw == "" {
+		return nil, nil
+	}
+	return ParseScrubRules(raw, []byte(getenv("SCRUB_HASH_KEY")))
+}
+
+// ParseScrubRules builds a Scrubber from JSON rules, or "@path" naming a
+// file that holds them.
+func ParseScrubRules(raw string, hashKey []byte) (*Scrubber, error) {
+	data := []byte(raw)
+	if path, ok := cutAt(raw); ok {
+		var err error
+		if data, err = os.ReadFile(path); err != nil {
+			return nil, fmt.Errorf("read scrub rules: %w", err)
+		}
+	}
+	var rules ScrubRules
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("parse scrub rules: %w", err)
+	}
+	return NewScrubber(rules, hashKey)
+}
+
+// cutAt reports whether s is "@path" and returns the path.
+func cutAt(s string) (string, bool) {
+	if len(s) > 1 && s[0] == '@' {
+		return s[1:], true
+	}
+	return "", false
+}
+
+// JSON scrubs a JSON document.
+func (s *Scrubber) JSON(body []byte) ([]byte, error) {
+	// Numbers stay json.Number so large integers survive the round trip.
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	return json.Marshal(s.value("", doc))
+}
+
+// Body scrubs a request body by content type: JSON documents, form fields,
+// and plain text as the "text" key. A form-typed body that starts with "{"
+// is scrubbed as JSON, as decodeJobRequest reads it (curl -d '{...}'). Other
+// types cannot be scrubbed and are refused.
+func (s *Scrubber) Body(contentType string, body []byte) ([]byte, error) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType == "application/x-www-form-urlencoded" && bytes.HasPrefix(bytes.TrimSpace(body), []byte("{")) {
+		mediaType = "application/json"
+	}
+	switch mediaType {
+	case "", "application/json":
+		return s.JSON(body)
+	case "text/plain":
+		text, keep := s.field("text", string(body))
+		if !keep {
+			return nil, nil
+		}
+		return []byte(text.(string)), nil
+	case "application/x-www-form-urlencoded":
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return nil, err
+		}
+		out := url.Values{}
+		for key, vals := range form {
+			for _, v := range vals {
+				if sv, keep := s.field(key, v); keep {
+					out.Add(key, sv.(string))
+				}
+			}
+		}
+		return []byte(out.Encode()), nil
+	}
+	return nil, fmt.Errorf("cannot scrub %s bodies", mediaType)
+}
+
+// value scrubs v, found under key (strings directly under a hashed key, or
+// in an array under one, are hashed).
+func (s *Scrubber) value(key string, v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, child := range v {
+			if scrubbed, keep := s.field(k, child); keep {
+				v[k] = scrubbed
+			} else {
+				delete(v, k)
+			}
+		}
+		return v
+	case []any:
+		for i, child := range v {
+			v[i] = s.value(key, child)
+		}
+		return v
+	case string:
+		if s.hash[key] {
+			return s.hashString(v)
+		}
+		for _, re := range s.redact {
+			v = re.ReplaceAllString(v, redactedValue)
+		}
+		return v
+	}
+	return v
+}
+
+// field scrubs the value of key, reporting false when it is dropped.
+func (s *Scrubber) field(key string, v any) (any, bool) {
+	if s.drop[key] {
+		return nil, false
+	}
+	return s.value(key, v), true
+}
+
+// hashString returns the keyed hash of v.
+func (s *Scrubber) hashString(v string) string {
+	mac := hmac.New(sha256.New, s.hashKey)
+	mac.Write([]byte(v))
+	return "hmac:" + hex.EncodeToString(mac.Sum(nil))[:32]
+}
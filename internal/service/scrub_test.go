@@ -0,0 +1,54 @@
+package service
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestScrubberBody(t *testing.T) {
+	s, err := NewScrubber(ScrubRules{
+		Hash:   []string{"parent_id"},
+		Drop:   []string{"callback_url"},
+		Redact: []string{`[\w.+-]+@[\w-]+\.[\w.]+`},
+	}, []byte("test-key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name, contentType, body string
+		want                    []string // Substrings of the scrubbed body
+		notWant                 []string // Must not survive scrubbing
+	}{
+		{"json", "application/json", `{"text":"mail bob@example.com","parent_id":"p1","callback_url":"https://x"}`,
+			[]string{`"text":"mail [redacted]"`, `"parent_id":"hmac:`}, []string{"bob@example.com", `"p1"`, "callback_url"}},
+		{"text", "text/plain; charset=utf-8", "mail bob@example.com",
+			[]string{"mail [redacted]"}, []string{"bob@example.com"}},
+		{"form", "application/x-www-form-urlencoded", "text=mail+bob%40example.com&parent_id=p1&callback_url=https%3A%2F%2Fx",
+			[]string{"text=mail+%5Bredacted%5D", "parent_id=hmac%3A"}, []string{"bob", "p1", "callback_url"}},
+		// curl -d '{...}' sends JSON with a form content type; decodeJobRequest
+		// reads it as JSON, so the scrubber must too.
+		{"json sent as form", "application/x-www-form-urlencoded", ` {"text":"secret bob@example.com","callback_url":"https://x"}`,
+			[]string{`"text":"secret [redacted]"`}, []string{"bob", "callback_url", "%7B"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := s.Body(tt.contentType, []byte(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, w := range tt.want {
+				if !strings.Contains(string(out), w) {
+					t.Errorf("scrubbed body %s lacks %q", out, w)
+				}
+			}
+			for _, nw := range tt.notWant {
+				if strings.Contains(string(out), nw) {
+					t.Errorf("scrubbed body %s still holds %q", out, nw)
+				}
+			}
+		})
+	}
+	if _, err := s.Body("application/octet-stream", []byte("raw")); err == nil {
+		t.Error("an unscrubbable content type was scrubbed")
+	}
+}
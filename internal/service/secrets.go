@@ -0,0 +1,209 @@
+// Per-job secrets. A job type that calls a third-party API declares the
+// credentials it needs in its JobTypeSpec, by name and Secrets Manager ARN,
+// instead of reading them from the process environment:
+//
+//	RegisterProcessor("translate", DescribedProcessor{
+//		Processor: ProcessorFunc(translate),
+//		Spec: JobTypeSpec{
+//			Description: "Translates the text.",
+//			Secrets:     map[string]string{"api_key": "arn:aws:secretsmanager:us-east-1:123456789012:secret:job/translate-AbCdEf"},
+//		},
+//	})
+//
+// Before each attempt the worker resolves the declared secrets and hands
+// their values to the processor through jc.Secret(name); an attempt whose
+// secrets cannot be fetched fails and is retried like any other. Values are
+// cached by ARN for SECRETS_CACHE_TTL, so workers call GetSecretValue once
+// per secret per interval rather than once per job, and a rotation reaches
+// every worker within that interval. A processor whose credential is
+// rejected mid-rotation calls jc.RefreshSecret(name) to fetch the current
+// version at once and retries with it.
+//
+// When Secrets Manager cannot be reached, a cached value is kept past its
+// TTL rather than failing every job. Dry runs get no secrets: jc.Secret
+// reports false, so processors must not reach third parties then.
+package service
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"golang.org/x/sync/singleflight"
+)
+
+// secretRefreshInterval is the least time between two forced fetches of the
+// same secret, so a processor retrying a rejected credential in a loop
+// cannot hammer Secrets Manager.
+const secretRefreshInterval = 10 * time.Second
+
+// secretCache fetches secret values from Secrets Manager and keeps them for
+// the TTL.
+type secretCache struct {
+	client *secretsmanager.Client
+	ttl    time.Duration // SECRETS_CACHE_TTL: how long a value is reused
+
+	mu      sync.Mutex
+	entries map[string]cachedSecret // By ARN
+	fetches singleflight.Group      // Coalesces concurrent fetches of one ARN
+}
+
+// cachedSecret is a fetched secret value.
+type cachedSecret struct {
+	value     string
+	version   string // Secrets Manager VersionId, which a rotation changes
+	fetchedAt time.Time
+}
+
+// newSecretCache returns a cache fetching with client, keeping values for
+// SECRETS_CACHE_TTL.
+func newSecretCache(client *secretsmanager.Client) *secretCache {
+	return &secretCache{
+		client:  client,
+		ttl:     max(envDuration("SECRETS_CACHE_TTL", 5*time.Minute), 0),
+		entries: map[string]cachedSecret{},
+	}
+}
+
+// processorSecrets returns the secrets the processor registered as typ
+// declares, by name.
+func processorSecrets(typ string, p Processor) map[string]string {
+	return describeProcessor(typ, p).Secrets
+}
+
+// checkDeclaredSecrets verifies that every declared secret is a Secrets
+// Manager ARN, and returns the job types that declare any.
+func checkDeclaredSecrets() ([]string, error) {
+	var types []string
+	for _, typ := range processorTypes() {
+		secrets := processorSecrets(typ, processors[typ])
+		for _, name := range slices.Sorted(maps.Keys(secrets)) {
+			a, err := arn.Parse(secrets[name])
+			if err != nil || a.Service != "secretsmanager" {
+				return nil, fmt.Errorf("job type %s: secret %s: %q is not a Secrets Manager ARN", typ, name, secrets[name])
+			}
+		}
+		if len(secrets) > 0 {
+			types = append(types, typ)
+		}
+	}
+	return types, nil
+}
+
+// get returns the value of the secret at secretARN, from the cache unless it
+// is older than the TTL, or than minAge when minAge is not negative.
+func (sc *secretCache) get(ctx context.Context, secretARN string, minAge time.Duration) (string, error) {
+	sc.mu.Lock()
+	cached, ok := sc.entries[secretARN]
+	sc.mu.Unlock()
+	maxAge := sc.ttl
+	if minAge >= 0 {
+		maxAge = minAge
+	}
+	if ok && time.Since(cached.fetchedAt) < maxAge {
+		return cached.value, nil
+	}
+	v, err, _ := sc.fetches.Do(secretARN, func() (any, error) {
+		return sc.fetch(context.WithoutCancel(ctx), secretARN)
+	})
+	if err != nil {
+		if ok {
+			slog.WarnContext(ctx, "failed to refresh secret; using the cached value", "secret", secretARN, "age", time.Since(cached.fetchedAt).Round(time.Second).String(), "error", err)
+			return cached.value, nil
+		}
+		return "", err
+	}
+	return v.(string), nil
+}
+
+// fetch reads the current version of the secret at secretARN and caches it.
+func (sc *secretCache) fetch(ctx context.Context, secretARN string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, awsOpTimeout)
+	defer cancel()
+	// Sent to the secret's own region, which need not be AWS_REGION.
+	var opts []func(*secretsmanager.Options)
+	if a, err := arn.Parse(secretARN); err == nil && a.Region != "" {
+		opts = append(opts, func(o *secretsmanager.Options) { o.Region = a.Region })
+	}
+	out, err := sc.client.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{SecretId: aws.String(secretARN)}, opts...)
+	if err != nil {
+		return "", fmt.Errorf("get secret %s: %w", secretARN, err)
+	}
+	value := aws.ToString(out.SecretString)
+	if out.SecretString == nil {
+		value = string(out.SecretBinary)
+	}
+	version := aws.ToString(out.VersionId)
+
+	sc.mu.Lock()
+	prior, had := sc.entries[secretARN]
+	sc.entries[secretARN] = cachedSecret{value: value, version: version, fetchedAt: time.Now()}
+	sc.mu.Unlock()
+	if had && prior.version != version {
+		slog.InfoContext(ctx, "secret rotated", "secret", secretARN, "version", version, "previous_version", prior.version)
+	}
+	return value, nil
+}
+
+// jobSecrets are the secrets a JobContext carries.
+type jobSecrets struct {
+	cache *secretCache
+	arns  map[string]string // Declared ARNs by name
+
+	mu     sync.Mutex
+	values map[string]string
+}
+
+// resolve fetches the secrets declared by name in arns for a job.
+func (sc *secretCache) resolve(ctx context.Context, arns map[string]string) (*jobSecrets, error) {
+	js := &jobSecrets{cache: sc, arns: arns, values: make(map[string]string, len(arns))}
+	for name, secretARN := range arns {
+		v, err := sc.get(ctx, secretARN, -1)
+		if err != nil {
+			return nil, fmt.Errorf("secret %s: %w", name, err)
+		}
+		js.values[name] = v
+	}
+	return js, nil
+}
+
+// Secret returns the value of the secret the job type declares as name. It
+// reports false for an undeclared name, and in dry runs.
+func (jc *JobContext) Secret(name string) (string, bool) {
+	if jc.secrets == nil {
+		return "", false
+	}
+	jc.secrets.mu.Lock()
+	defer jc.secrets.mu.Unlock()
+	v, ok := jc.secrets.values[name]
+	return v, ok
+}
+
+// RefreshSecret fetches the current version of the secret declared as name,
+// bypassing the cache unless it was fetched in the last few seconds, and
+// returns it; later Secret calls return it too. Call it when a third party
+// rejects the cached credential, which may have been rotated since.
+func (jc *JobContext) RefreshSecret(name string) (string, error) {
+	if jc.secrets == nil {
+		return "", fmt.Errorf("secret %s: no secrets in a dry run", name)
+	}
+	secretARN, ok := jc.secrets.arns[name]
+	if !ok {
+		return "", fmt.Errorf("secret %s is not declared by the job type", name)
+	}
+	v, err := jc.secrets.cache.get(jc, secretARN, secretRefreshInterval)
+	if err != nil {
+		return "", fmt.Errorf("secret %s: %w", name, err)
+	}
+	jc.secrets.mu.Lock()
+	jc.secrets.values[name] = v
+	jc.secrets.mu.Unlock()
+	return v, nil
+}
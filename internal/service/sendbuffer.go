@@ -0,0 +1,192 @@
+// Disk-backed buffer for SQS sends. When enabled (SQS_BUFFER_DIR), POST /jobs
+// still accepts a job while SQS is briefly unavailable: the message is written
+// to a bounded local spool and a background loop flushes it to the queue once
+// SQS recovers. This trades strict durability (the spool lives on the task's
+// local disk) for availability, so it is off by default.
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// errBufferFull is returned by sendBuffer.enqueue when the spool is at capacity.
+var errBufferFull = errors.New("send buffer full")
+
+// bufferedMessage is one spooled SQS message: the body and the string message
+// attributes (trace context) it would have been sent with.
+type bufferedMessage struct {
+	JobID      string            `json:"job_id"`
+	Body       string            `json:"body"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	BufferedAt Timestamp         `json:"buffered_at"`
+}
+
+// sendBuffer is a bounded FIFO spool of bufferedMessages, one JSON file per
+// message in dir. File names sort in enqueue order. Safe for concurrent use.
+type sendBuffer struct {
+	dir string
+	max int
+
+	mu    sync.Mutex
+	count int // files currently in dir
+}
+
+// newSendBuffer opens (creating if needed) a spool in dir holding at most max
+// messages. Messages left over from a previous run are kept and flushed.
+func newSendBuffer(dir string, max int) (*sendBuffer, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("create send buffer dir: %w", err)
+	}
+	b := &sendBuffer{dir: dir, max: max}
+	names, err := b.pending()
+	if err != nil {
+		return nil, err
+	}
+	b.count = len(names)
+	return b, nil
+}
+
+// enqueue spools msg. The write is atomic (temp file + rename) so a crash
+// never leaves a half-written message for the flusher.
+func (b *sendBuffer) enqueue(msg bufferedMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("marshal buffered message: %w", err)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.count >= b.max {
+		return errBufferFull
+	}
+	name := fmt.Sprintf("%020d-%s.json", time.Now().UnixNano(), msg.JobID)
+	tmp := filepath.Join(b.dir, "."+name+".tmp")
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("write buffered message: %w", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(b.dir, name)); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("commit buffered message: %w", err)
+	}
+	b.count++
+	return nil
+}
+
+// pending lists spooled message files in enqueue order.
+func (b *sendBuffer) pending() ([]string, error) {
+	entries, err := os.ReadDir(b.dir)
+	if err != nil {
+		return nil, fmt.Errorf("read send buffer dir: %w", err)
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".json") && !strings.HasPrefix(e.Name(), ".") {
+			names = append(names, e.Name())
+		}
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+// flush sends spooled messages in order via send, removing each once sent. It
+// stops at the first send failure (SQS is presumably still down) and returns
+// the number flushed. Unreadable files are dropped with an error log so one
+// corrupt file cannot wedge the spool.
+func (b *sendBuffer) flush(ctx context.Context, send func(context.Context, bufferedMessage) error) (int, error) {
+	names, err := b.pending()
+	if err != nil {
+		return 0, err
+	}
+	flushed := 0
+	for _, name := range names {
+		if ctx.Err() != nil {
+			return flushed, ctx.Err()
+		}
+		path := filepath.Join(b.dir, name)
+		var msg bufferedMessage
+		data, err := os.ReadFile(path)
+		if err == nil {
+			err = json.Unmarshal(data, &msg)
+		}
+		if err != nil {
+			slog.Error("dropping unreadable buffered message", "file", name, "error", err)
+			b.remove(path)
+			continue
+		}
+		if err := send(ctx, msg); err != nil {
+			return flushed, err
+		}
+		b.remove(path)
+		flushed++
+	}
+	return flushed, nil
+}
+
+// remove deletes a spooled file and updates the count.
+func (b *sendBuffer) remove(path string) {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Error("failed to remove buffered message", "file", path, "error", err)
+		return
+	}
+	b.mu.Lock()
+	b.count--
+	b.mu.Unlock()
+}
+
+// run flushes the spool every interval until ctx is cancelled.
+func (b *sendBuffer) run(ctx context.Context, interval time.Duration, send func(context.Context, bufferedMessage) error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		n, err := b.flush(ctx, send)
+		if n > 0 {
+			slog.Info("flushed buffered messages to SQS", "count", n)
+		}
+		if err != nil && ctx.Err() == nil {
+			slog.Warn("send buffer flush paused, SQS still failing", "error", err)
+		}
+	}
+}
+
+// stringAttributes flattens SQS string message attributes for spooling.
+func stringAttributes(attrs map[string]sqstypes.MessageAttributeValue) map[string]string {
+	if len(attrs) == 0 {
+		return nil
+	}
+	out := make(map[string]string, len(attrs))
+	for k, v := range attrs {
+		if v.StringValue != nil {
+			out[k] = *v.StringValue
+		}
+	}
+	return out
+}
+
+// sqsStringAttributes is the inverse of stringAttributes.
+func sqsStringAttributes(m map[string]string) map[string]sqstypes.MessageAttributeValue {
+	if len(m) == 0 {
+		return nil
+	}
+	out := make(map[string]sqstypes.MessageAttributeValue, len(m))
+	for k, v := range m {
+		out[k] = sqstypes.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(v)}
+	}
+	return out
+}
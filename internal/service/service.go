@@ -0,0 +1,1738 @@
+// Package service implements a minimal Go microservice with SQS and S3
+// integration. It provides HTTP endpoints for job creation and retrieval, a
+// background worker for processing jobs asynchronously, and periodic storage
+// maintenance. The binaries under app/ and cmd/ each run a selection of these
+// components via Run.
+package service
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/firehose"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/google/uuid"
+	"golang.org/x/sync/singleflight"
+
+	"go.opentelemetry.io/contrib/instrumentation/github.com/aws/aws-sdk-go-v2/otelaws"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+
+	"go-microservice/pkg/contract"
+)
+
+const (
+	// maxBodyBytes caps the size of an incoming request body to guard against
+	// oversized or malicious payloads; MAX_BODY_BYTES overrides it for job
+	// submissions.
+	maxBodyBytes = 1 << 20 // 1 MiB
+
+	// defaultShutdownTimeout bounds graceful shutdown — draining HTTP
+	// requests and the worker's in-flight message — when SHUTDOWN_TIMEOUT is
+	// unset; worker processes allow at least the processing they let go on
+	// (WORKER_SHUTDOWN_GRACE, at most JOB_TIMEOUT) plus awsOpTimeout.
+	defaultShutdownTimeout = 15 * time.Second
+
+	// maxReceiveBatch is the most messages SQS returns from one ReceiveMessage.
+	maxReceiveBatch = 10
+
+	// storageRetryAfter is the Retry-After hint sent when S3 is unavailable.
+	storageRetryAfter = 5 * time.Second
+)
+
+// App holds the application state and AWS service clients.
+type App struct {
+	sqsClient *sqs.Client // SQS client for sending and receiving messages
+	s3Client  *s3.Client  // S3 client for storing job results
+	queue     Queue       // Where job messages wait for a worker (queue.go)
+	sqsURL    string      // SQS queue URL
+	s3Bucket  string      // S3 bucket name for storing job results
+	store     ResultStore // Where results and every other object are kept (store.go)
+	conf      Config      // Settings Run was started with (config.go)
+
+	results       *resultCache           // Cache of completed results; nil when disabled
+	jsonBodies    jsonDecoder            // Limits for JSON request bodies
+	bodyLimit     int64                  // MAX_BODY_BYTES cap on job submission bodies
+	sendBuffer    *sendBuffer            // Local spool for failed SQS sends; nil when disabled
+	duplicates    *duplicateDetector     // Recent submission fingerprints; nil when disabled
+	idempotency   time.Duration          // IDEMPOTENCY_TTL: how long an Idempotency-Key is held
+	restore       restoreConfig          // How archived results are restored (retention.go)
+	jobTypes      jobTypeCatalog         // Cached GET /job-types catalog and result retention
+	typeFlags     *jobTypeSwitches       // Job types disabled at runtime (jobflags.go)
+	readiness     *readinessChecker      // Cached live dependency checks for /readyz (readiness.go)
+	locks         *lockManager           // Leases behind JobContext.Lock (locks.go)
+	secrets       *secretCache           // Secret values behind JobContext.Secret (secrets.go)
+	hooks         *hookRunner            // Post-store result hooks (hooks.go)
+	shadow        *shadowWorker          // WORKER_DRY_RUN state; nil in a production worker (shadow.go)
+	stage         *workerStage           // Observe-stage state; nil in a worker started active (workerstage.go)
+	throughput    *throughputTracker     // Per-minute job event counts for /admin/throughput
+	adminToken    string                 // Bearer token for /admin/ endpoints; empty disables them
+	jobTimeout    time.Duration          // Deadline of one processing attempt
+	workerCount   int                    // Messages the worker processes at once (WORKER_CONCURRENCY)
+	retries       retryPolicy            // Backoff and attempt limit for failed messages
+	jobIDs        jobIDScheme            // JOB_ID_SCHEME client-supplied job IDs must follow
+	payloads      extendedPayloads       // SQS Extended Client pointer settings
+	adapters      messageAdapters        // MESSAGE_ADAPTERS for messages that are not envelopes
+	clock         clockConfig            // Trusted time source and tolerated clock skew
+	events        *eventBroker           // Job lifecycle events for in-process subscribers
+	stream        *eventStream           // Job and audit events for Firehose; nil when disabled (eventstream.go)
+	webhooks      *webhookSender         // Job completion callbacks; nil when disabled (webhook.go)
+	fair          *fairScheduler         // Per-tenant staging and dispatch in the worker; nil when disabled (fairsched.go)
+	ws            *wsHub                 // Job updates over WebSocket at /v1/ws; nil when disabled (websocket.go)
+	legacy        *legacyAPI             // Serves the job API at its unversioned paths; nil when off (versioning.go)
+	downloads     *downloadLinks         // Presigns GET /jobs/{id}/download; nil when off or not on S3 (downloads.go)
+	resilience    *awsResilience         // Retry policy and circuit breakers of the AWS clients (resilience.go)
+	budget        *awsBudget             // Daily AWS call and transfer budgets; nil when none is set (budget.go)
+	loops         *loopGuard             // Detects the worker's busy loops; nil when disabled (loopguard.go)
+	startup       *StartupReport         // The report logged at startup, for diagnostics bundles
+	httpClient    *http.Client           // Proxy/CA-aware client for non-AWS outbound calls (webhooks, OIDC)
+	workerBeat    atomic.Int64           // Unix nanos of the worker loop's last progress; 0 when not running
+	draining      atomic.Bool            // Shutdown started; readyz fails so load balancers stop routing here
+	albTarget     *albTarget             // Target group entry deregistered on shutdown; nil when disabled
+	mirror        *mirror                // Copies sampled POST /jobs to staging; nil when disabled
+	mirrorToken   string                 // Shared secret that makes X-Mirrored-From trusted
+	scrubber      *Scrubber              // SCRUB_RULES transform for data leaving production; nil when unset
+	shedder       *loadShedder           // Rejects low-priority requests under overload; nil when disabled
+	limiter       *rateLimiter           // Token buckets of POST /jobs; nil when no rate is set (ratelimit.go)
+	throttle      *intakeThrottle        // Limits intake over CPU/memory watermarks; nil when disabled
+	storageStats  *storageStatsCollector // Latest bucket usage scan; nil when disabled
+	janitor       *janitor               // Storage cleanup (orphans, stale uploads, tombstones)
+	redriver      *redriver              // Moves dead-lettered jobs back to the job queue
+	reconciler    *reconciler            // Index/record/queue drift detection and repair
+	migrations    migrationRunner        // Admin-triggered storage migrations
+	pageTokens    *pageTokenSigner       // Signs and verifies list page tokens
+	profiler      profileCapturer        // Serialises profile captures to S3
+	storageHealth dependencyHealth       // Recent S3 outcomes, surfaced by readyz
+	resultFetches singleflight.Group     // Coalesces concurrent S3 reads of the same result
+}
+
+// JobRequest represents the request body for creating a new job.
+type JobRequest struct {
+	Text     string `json:"text"`                // Text to be processed
+	Type     string `json:"type,omitempty"`      // Processor to run: uppercase (default), lowercase, wordcount
+	ParentID string `json:"parent_id,omitempty"` // Optional parent job for lineage tracking
+	Relation string `json:"relation,omitempty"`  // Relation to the parent: retry, chain (default), replay, workflow
+
+	CallbackURL string `json:"callback_url,omitempty"` // Optional URL the result is POSTed to once stored (webhook.go)
+}
+
+// JobMessage is the body of a job message on the queue, as defined by the
+// queue contract (pkg/contract).
+type JobMessage = contract.JobMessage
+
+// CreateJobResponse is the POST /jobs response body.
+type CreateJobResponse struct {
+	ID        string `json:"id"`                  // Unique job identifier
+	Buffered  bool   `json:"buffered,omitempty"`  // Accepted into the local send buffer, not yet on SQS
+	Duplicate bool   `json:"duplicate,omitempty"` // Repeat of a recent identical submission; ID is the original job
+	Replayed  bool   `json:"replayed,omitempty"`  // Repeat of an earlier Idempotency-Key or PUT /jobs/{id}; ID is the original job
+}
+
+// JobResult represents the processed job result stored in S3.
+type JobResult struct {
+	ID          string      `json:"id"`                   // Unique job identifier
+	Text        string      `json:"text"`                 // Original text
+	Type        string      `json:"type,omitempty"`       // Processor that ran; absent on older results (uppercase)
+	Output      string      `json:"output"`               // Processed output
+	Artifacts   []string    `json:"artifacts,omitempty"`  // Names of attached artifacts (GET /jobs/{id}/artifacts)
+	CreatedAt   Timestamp   `json:"created_at"`           // When the job was accepted; null for older results
+	ProcessedAt Timestamp   `json:"processed_at"`         // When the job was processed (UTC, RFC 3339)
+	Provenance  *Provenance `json:"provenance,omitempty"` // Set on results registered via POST /jobs/import
+}
+
+// JobResultView is the GET /jobs/{id} response body: the stored JobResult plus
+// client-convenience renderings of its timestamps.
+type JobResultView struct {
+	JobResult
+	Status            string `json:"status"`                       // Always "completed"; see JobStatus for jobs without a result
+	CreatedAtUnixMs   int64  `json:"created_at_unix_ms"`           // created_at as Unix milliseconds (0 when unknown)
+	CreatedAtLocal    string `json:"created_at_local,omitempty"`   // created_at in the requested tz/locale
+	ProcessedAtUnixMs int64  `json:"processed_at_unix_ms"`         // processed_at as Unix milliseconds
+	ProcessedAtLocal  string `json:"processed_at_local,omitempty"` // processed_at in the requested tz/locale
+	TimeZone          string `json:"time_zone,omitempty"`          // Zone used for *_local fields
+}
+
+// Components selects what a process runs. Every process serves /healthz and
+// /readyz on its listeners (LISTEN_ADDRS, default :8080).
+type Components struct {
+	API       bool // Job HTTP API, with its send-buffer flusher, backlog sampler and storage stats
+	Worker    bool // SQS consumer that processes jobs
+	Scheduler bool // Scheduled maintenance (JANITOR_INTERVAL, RECONCILE_INTERVAL, REDRIVE_INTERVAL)
+}
+
+// Run initializes the application, sets up AWS clients, registers HTTP
+// handlers, starts the selected components, and blocks until SIGINT/SIGTERM,
+// then shuts down gracefully. The zero Components is the single binary: its
+// components come from RUN_MODE (runmode.go).
+func Run(c Components) {
+	// Install the structured, trace-correlated JSON logger before anything logs.
+	setupLogging()
+
+	// Apply CONFIG_FILE, then APP_PROFILE defaults, before any setting is
+	// read (config.go).
+	if err := loadConfigFile(); err != nil {
+		slog.Error("invalid config file", "error", err)
+		os.Exit(1)
+	}
+	applyProfile()
+	// GC tuning, including profile-supplied GOGC/GOMEMLIMIT.
+	mem := configureMemory()
+	conf, err := LoadConfig()
+	if err != nil {
+		slog.Error("invalid configuration", "error", err)
+		os.Exit(1)
+	}
+	if c == (Components{}) {
+		if c, err = runModeComponents(); err != nil {
+			slog.Error("invalid run mode", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	// Proxy and TLS settings for every outbound connection; a bad CA bundle or
+	// TLS version exits rather than silently falling back.
+	awsHTTP, err := AWSHTTPClient()
+	if err != nil {
+		slog.Error("invalid outbound TLS settings", "error", err)
+		os.Exit(1)
+	}
+	outboundHTTP, err := newOutboundHTTPClient()
+	if err != nil {
+		slog.Error("invalid outbound TLS settings", "error", err)
+		os.Exit(1)
+	}
+
+	// Load AWS configuration using default credential chain
+	cfg, err := config.LoadDefaultConfig(context.Background(), config.WithRegion(conf.Region), config.WithHTTPClient(awsHTTP))
+	if err != nil {
+		slog.Error("failed to load AWS config", "error", err)
+		os.Exit(1)
+	}
+	// Settings, subsystems and misconfiguration hints, logged as one record
+	// once startup is done (startupreport.go).
+	rep := newStartupReport(conf, c, cfg.Region)
+	rep.Config["memory"] = mem
+	rep.Config["outbound"] = outboundSettings()
+	if mem.cgroupErr != nil {
+		rep.hint("GOMEMLIMIT_FROM_CGROUP", fmt.Sprintf("no cgroup memory limit was found (%v), so no soft memory limit is set", mem.cgroupErr),
+			"set GOMEMLIMIT, or run under a container memory limit")
+	}
+
+	// Initialize OpenTelemetry (traces + metrics), exporting via OTLP to the
+	// ADOT collector sidecar. Non-fatal: if setup fails the service still runs
+	// and telemetry falls back to no-ops.
+	sampling, err := newTailSampling()
+	if err != nil {
+		slog.Error("invalid trace sampling settings", "error", err)
+		os.Exit(1)
+	}
+	if sampling != nil {
+		rep.enable("tail_sampling", "rate", sampling.rate, "slow_processing", sampling.slowProcessing.String(),
+			"slow_queue_wait", sampling.slowQueueWait.String())
+	}
+	otelShutdown, err := setupOTel(context.Background(), sampling)
+	if err != nil {
+		slog.Warn("OpenTelemetry setup failed, continuing without telemetry", "error", err)
+		otelShutdown = func(context.Context) error { return nil }
+	}
+	if err := initInstruments(); err != nil {
+		slog.Warn("failed to initialize metric instruments", "error", err)
+	}
+	if err := initRuntimeMetrics(); err != nil {
+		slog.Warn("failed to initialize runtime metrics", "error", err)
+	}
+
+	// Trace every AWS SDK call (SQS, S3). Must be appended before the clients are
+	// constructed so they capture the middleware.
+	otelaws.AppendMiddlewares(&cfg.APIOptions)
+	// Request IDs and timings of the calls of X-Debug requests (debug.go).
+	appendDebugMiddleware(&cfg.APIOptions)
+	// Operation timeouts, around the retries of each call (timeouts.go).
+	timeouts, err := newAWSTimeouts()
+	if err != nil {
+		slog.Error("invalid AWS timeout settings", "error", err)
+		os.Exit(1)
+	}
+	timeouts.apply(&cfg.APIOptions)
+	rep.Config["aws_op_timeouts"] = timeouts.settings()
+	// Retries and circuit breakers for the same calls (resilience.go).
+	resilience := newAWSResilience()
+	resilience.apply(&cfg)
+	// Daily budgets metering every attempt of those calls (budget.go).
+	budget, err := newAWSBudget()
+	if err != nil {
+		slog.Error("invalid AWS budget settings", "error", err)
+		os.Exit(1)
+	}
+	if budget != nil {
+		budget.apply(&cfg.APIOptions)
+	}
+
+	// Initialize application with AWS clients
+	app := &App{
+		sqsClient:   sqs.NewFromConfig(cfg, conf.sqsOptions),
+		s3Client:    s3.NewFromConfig(cfg, conf.s3Options),
+		sqsURL:      conf.QueueURL,
+		s3Bucket:    conf.Bucket,
+		conf:        conf,
+		results:     newResultCache(conf.ResultCacheSize, conf.ResultCacheTTL),
+		duplicates:  newDuplicateDetector(conf.DuplicateWindow),
+		idempotency: conf.IdempotencyTTL,
+		throughput:  newThroughputTracker(),
+		adminToken:  conf.AdminToken,
+		jobTimeout:  conf.JobTimeout,
+		workerCount: conf.WorkerConcurrency,
+		retries:     newRetryPolicy(),
+		events:      newEventBroker(),
+		jsonBodies:  newJSONDecoder(),
+		bodyLimit:   int64(conf.MaxBodyBytes),
+		httpClient:  outboundHTTP,
+		albTarget:   newALBTarget(cfg),
+		mirrorToken: conf.MirrorToken,
+		migrations:  migrationRunner{byName: map[string]*migration{}},
+		typeFlags:   newJobTypeSwitches(),
+		readiness:   newReadinessChecker(),
+		secrets:     newSecretCache(secretsmanager.NewFromConfig(cfg)),
+		resilience:  resilience,
+		budget:      budget,
+		startup:     rep,
+	}
+	app.locks = newLockManager(app)
+	// Callbacks before the hook runner, whose chain ends with theirs.
+	app.webhooks, err = newWebhookSender(app)
+	if err != nil {
+		slog.Error("invalid webhook settings", "error", err)
+		os.Exit(1)
+	}
+	if app.webhooks != nil {
+		rep.enable("job_callbacks", "allow_http", app.webhooks.allowHTTP, "allow_private", app.webhooks.allowPrivate, "allowed_hosts", app.webhooks.allowedHosts)
+	}
+	app.hooks = newHookRunner(app)
+	app.stream = newEventStream(app, firehose.NewFromConfig(cfg))
+
+	// Secrets declared by job types are fetched per job (secrets.go); a
+	// malformed ARN is caught here rather than on every attempt.
+	secretTypes, err := checkDeclaredSecrets()
+	if err != nil {
+		slog.Error("invalid job secrets", "error", err)
+		os.Exit(1)
+	}
+
+	// Objects go to S3, or to a local directory without AWS (store.go).
+	if app.store, err = newResultStore(conf, app.s3Client); err != nil {
+		slog.Error("invalid storage settings", "error", err)
+		os.Exit(1)
+	}
+	if app.payloads, err = newExtendedPayloads(conf.Bucket); err != nil {
+		slog.Error("invalid extended payload settings", "error", err)
+		os.Exit(1)
+	}
+	if !app.onS3() {
+		if app.payloads.produce == produceAlways {
+			slog.Error("SQS_EXTENDED_PRODUCE offloads bodies to S3 and requires STORAGE_BACKEND=s3")
+			os.Exit(1)
+		}
+		// Nowhere to offload to: too large a message fails as it would
+		// with offloading off.
+		app.payloads.produce = produceNever
+	}
+	rep.Config["sqs_extended_produce"] = app.payloads.produce
+	if d, ok := app.store.(*dualStore); ok {
+		rep.enable("storage_dual_write", "from", d.from, "verify_percent", d.verify)
+	}
+
+	// Messages go through SQS, or in-process queues without AWS (queue.go).
+	app.queue = newQueue(conf, app.sqsClient)
+	if !app.onSQS() {
+		app.sqsURL = cmp.Or(conf.QueueURL, memoryQueueURL)
+		rep.Config["queue_url"] = app.sqsURL
+	}
+	// FIFO queues are known by their name (fifo.go).
+	if isFIFOQueue(app.sqsURL) {
+		rep.enable("fifo_queue", "group_by", cmp.Or(conf.FIFOGroupBy, "job"))
+	} else if conf.FIFOGroupBy != "" {
+		rep.hint("FIFO_GROUP_BY", "the job queue is not a FIFO queue, so jobs are neither grouped nor ordered",
+			"use a queue whose URL ends in "+fifoSuffix+", or unset FIFO_GROUP_BY")
+	}
+	// Lifecycle and audit events for the data lake (eventstream.go).
+	if app.stream != nil {
+		app.events.addSink(app.stream.recordJob)
+		app.stream.start()
+		rep.enable("event_stream", "firehose_stream", app.stream.name, "batch_size", app.stream.batchSize,
+			"flush_interval", app.stream.flushInterval.String(), "buffer", cap(app.stream.events))
+		if !app.onS3() {
+			rep.hint("EVENTS_FIREHOSE_STREAM", "events Firehose does not take are written under STORAGE_DIR rather than to a bucket",
+				"use STORAGE_BACKEND=s3, or collect events/failed/ from STORAGE_DIR")
+		}
+	}
+	if app.onSQS() || app.onS3() {
+		rep.enable("aws_resilience", "max_attempts", resilience.maxAttempts, "backoff_max", resilience.backoffMax.String(),
+			"breaker_failures", resilience.breakerFailures, "breaker_cooldown", resilience.breakerCooldown.String())
+	}
+	if b := app.budget; b != nil {
+		rep.enable("aws_budgets", "sqs_calls", b.limits[budgetSQSCalls], "s3_calls", b.limits[budgetS3Calls],
+			"transfer_bytes", b.limits[budgetTransferBytes], "warn_percent", b.warnAt*100, "max_poll_delay", b.maxPollDelay.String())
+		if limit := b.limits[budgetSQSCalls]; c.Worker && app.onSQS() && limit > 0 && limit < budgetIdleSQSCalls {
+			rep.hint("AWS_BUDGET_SQS_CALLS", fmt.Sprintf("an idle worker long-polling all day makes %d SQS calls, more than the budget of %d", budgetIdleSQSCalls, limit),
+				"raise AWS_BUDGET_SQS_CALLS; the worker will otherwise spend most of the day at AWS_BUDGET_MAX_POLL_DELAY")
+		}
+	}
+
+	// Job IDs from clients are validated before they reach storage keys.
+	if app.jobIDs, err = newJobIDScheme(); err != nil {
+		slog.Error("invalid job ID settings", "error", err)
+		os.Exit(1)
+	}
+
+	if app.clock, err = newClockConfig(); err != nil {
+		slog.Error("invalid clock settings", "error", err)
+		os.Exit(1)
+	}
+	switch {
+	case app.onS3():
+	case app.onSQS():
+		app.clock.source = "sqs" // There is no bucket to ask
+	default:
+		app.clock.source = "" // Nor a queue
+	}
+
+	if app.restore, err = newRestoreConfig(); err != nil {
+		slog.Error("invalid restore settings", "error", err)
+		os.Exit(1)
+	}
+
+	// Adapters for producers that do not send envelopes.
+	if app.adapters, err = newMessageAdapters(); err != nil {
+		slog.Error("invalid message adapters", "error", err)
+		os.Exit(1)
+	}
+
+	// Scrubbing for data leaving production (mirroring, scrubbed migrations).
+	if app.scrubber, err = ScrubberFromEnv(); err != nil {
+		slog.Error("invalid SCRUB_RULES", "error", err)
+		os.Exit(1)
+	}
+
+	// Optional mirroring of sampled POST /jobs traffic to staging.
+	if app.mirror, err = newMirror(outboundHTTP, app.scrubber, app.bodyLimit); err != nil {
+		slog.Error("invalid mirror settings", "error", err)
+		os.Exit(1)
+	}
+	if app.mirror != nil {
+		if app.mirrorToken == "" {
+			rep.hint("MIRROR_TOKEN", "the mirror target will treat mirrored copies as ordinary traffic",
+				"set the same MIRROR_TOKEN here and on the target")
+		}
+		rep.enable("mirror", "target", app.mirror.base.Host, "percent", app.mirror.percent)
+	}
+
+	// Page tokens must be signed with a shared secret for cursors to work
+	// across replicas and restarts; fall back to a per-process key.
+	var ephemeralKey bool
+	app.pageTokens, ephemeralKey = newPageTokenSigner(conf.PaginationSecret, conf.PageTokenTTL, app.clock.tolerance)
+	if ephemeralKey && c.API {
+		rep.hint("PAGINATION_SECRET", "page tokens are only valid on this instance until restart",
+			"set the same PAGINATION_SECRET on every replica")
+	}
+
+	// Submission rate limits, applied as the routes are registered.
+	if c.API {
+		if app.limiter, err = newRateLimiter(); err != nil {
+			slog.Error("invalid rate limit settings", "error", err)
+			os.Exit(1)
+		}
+		if l := app.limiter; l != nil {
+			var rate, burst float64
+			if l.global != nil {
+				rate, burst = l.global.rate, l.global.burst
+			}
+			rep.enable("job_rate_limit", "rate", rate, "burst", burst, "client_rate", l.clientRate, "client_burst", l.clientBurst, "client_key", l.key)
+		}
+	}
+
+	// Job updates over WebSocket.
+	if c.API {
+		if app.ws, err = newWSHub(app); err != nil {
+			slog.Error("invalid WebSocket settings", "error", err)
+			os.Exit(1)
+		}
+		if h := app.ws; h != nil {
+			rep.enable("websocket", "max_connections", h.maxConnections, "max_subscriptions", h.maxSubscriptions,
+				"ping_interval", h.pingInterval.String(), "allowed_origins", h.origins)
+			if !c.Worker {
+				// Events are in-process: a separate worker's completions never arrive.
+				rep.hint("WS_MAX_CONNECTIONS", "/v1/ws only sends events for jobs this process's worker runs, and this process runs none",
+					"run the API and worker together (RUN_MODE=both), or have clients poll GET /v1/jobs/{id}/status")
+			}
+		}
+	}
+
+	// The job API's unversioned paths, kept while clients move to /v1.
+	if c.API {
+		if app.legacy, err = newLegacyAPI(); err != nil {
+			slog.Error("invalid legacy API settings", "error", err)
+			os.Exit(1)
+		}
+		if l := app.legacy; l != nil {
+			sunset := "unannounced"
+			if !l.sunset.IsZero() {
+				sunset = l.sunset.Format(time.RFC3339)
+			}
+			rep.enable("legacy_api_paths", "sunset", sunset)
+		}
+	}
+
+	// Presigned result downloads, straight from S3.
+	if c.API {
+		if app.downloads, err = newDownloadLinks(app.primaryS3()); err != nil {
+			slog.Error("invalid download settings", "error", err)
+			os.Exit(1)
+		}
+		if d := app.downloads; d != nil {
+			rep.enable("presigned_downloads", "ttl", d.ttl.String())
+		}
+	}
+
+	// Optionally wait for the queue and bucket to come up (compose, CI).
+	if conf.StartupWaitTimeout > 0 {
+		app.waitForDependencies(conf.StartupWaitTimeout)
+	}
+
+	// Surface IAM/bucket misconfiguration early; non-fatal.
+	app.checkBucketAccess(context.Background(), rep)
+	app.checkClockSkew(context.Background(), rep)
+
+	// Register HTTP handlers using method-based routing (Go 1.22+). Every
+	// process serves the health/readiness probes and, when enabled, /metrics,
+	// left untraced to keep span volume low; only API processes serve the job
+	// endpoints.
+	mux := newRouter()
+	mux.HandleFunc("GET /healthz", app.healthz)
+	mux.HandleFunc("GET /readyz", app.readyz)
+	if metricsHandler != nil {
+		mux.Handle("GET /metrics", metricsHandler)
+	}
+	if c.API {
+		app.registerAPI(mux)
+		app.registerDocs(mux)
+	}
+	// Profiling is available in every process; the worker is the hot path.
+	app.registerPprof(mux)
+	mux.route("GET /admin/diagnostics", "getDiagnostics", app.getDiagnostics, app.requireAdmin)
+	mux.route("POST /admin/diagnostics/profile", "captureProfile", app.captureProfile, app.requireAdmin)
+	mux.route("GET /admin/clock", "getClock", app.getClock, app.requireAdmin)
+	mux.route("GET /admin/config", "getConfig", app.getConfig, app.requireAdmin)
+	mux.route("GET /admin/budgets", "getBudgets", app.getBudgets, app.requireAdmin)
+	mux.route("GET /admin/worker-stage", "getWorkerStage", app.getWorkerStage, app.requireAdmin)
+	if err := mux.err(); err != nil {
+		slog.Error("conflicting routes", "error", err)
+		os.Exit(1)
+	}
+
+	// Root context cancelled on SIGINT/SIGTERM, used to stop the worker loop
+	// and trigger graceful HTTP shutdown.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// Storage janitor: available on demand via the admin API, and on a
+	// schedule in the scheduler when JANITOR_INTERVAL is set. Dry-run unless
+	// JANITOR_DRY_RUN=false.
+	app.janitor = &janitor{app: app, cfg: janitorConfig{
+		dryRun:         conf.JanitorDryRun,
+		payloadGrace:   conf.JanitorPayloadGrace,
+		uploadGrace:    conf.JanitorUploadGrace,
+		tombstoneGrace: conf.JanitorTombstoneGrace,
+		createGrace:    conf.JanitorCreateGrace,
+	}}
+	// Reconciler: on demand via the admin API, and on a schedule in the
+	// scheduler when RECONCILE_INTERVAL is set.
+	app.reconciler = &reconciler{app: app, cfg: reconcilerConfig{repair: conf.ReconcileRepair}}
+	// DLQ redrive: on demand via the admin API, and on a schedule in the
+	// scheduler when REDRIVE_INTERVAL and DLQ_URL are set.
+	app.redriver = &redriver{app: app, cfg: newRedriveConfig()}
+	// Job type switches: read now and kept fresh, so an operator's switch
+	// reaches the API and the worker of every process.
+	if c.API || c.Worker {
+		app.refreshJobTypeFlags(ctx)
+		go app.typeFlags.loop(ctx, app)
+	}
+	if c.API {
+		app.startAPIBackground(ctx)
+	}
+	if c.API && conf.ResultPrefetch {
+		window := conf.ResultPrefetchWindow
+		if app.results == nil {
+			rep.hint("RESULT_PREFETCH", "prefetch needs the result cache, so it is off",
+				"set RESULT_CACHE_SIZE and RESULT_CACHE_TTL")
+		} else {
+			go app.prefetchResults(ctx, window)
+			rep.enable("result_prefetch", "window", window.String())
+			if !c.Worker {
+				// Events are in-process: a separate worker's completions never arrive.
+				rep.hint("RESULT_PREFETCH", "prefetch only sees jobs completed by this process's worker, and this process runs none",
+					"run the API and worker together (RUN_MODE=both), or unset RESULT_PREFETCH")
+			}
+		}
+	}
+	if c.API && conf.LoadShedding {
+		app.shedder = newLoadShedder(&app.storageHealth)
+		go app.shedder.loop(ctx)
+		rep.enable("load_shedding", "p99_threshold", app.shedder.cfg.p99Threshold.String(), "s3_error_rate", app.shedder.cfg.s3ErrorRate)
+	}
+	if conf.IntakeThrottle {
+		cfg, err := newThrottleConfig(max(app.workerCount, 1))
+		if err != nil {
+			slog.Error("invalid intake throttle settings", "error", err)
+			os.Exit(1)
+		}
+		app.throttle = newIntakeThrottle(cfg)
+		go app.throttle.loop(ctx)
+		rep.enable("intake_throttle", "cpu_high", cfg.cpuHigh, "cpu_low", cfg.cpuLow,
+			"rss_high_bytes", cfg.rssHigh, "rss_low_bytes", cfg.rssLow, "min_concurrency", cfg.minWorkers)
+	}
+	if conf.CaptureProfileOnSIGUSR1 {
+		go app.profileOnSignal(ctx, conf.ProfileCPUDuration)
+	}
+	if c.Scheduler {
+		janitorInterval := conf.JanitorInterval
+		if janitorInterval > 0 {
+			go app.janitor.loop(ctx, janitorInterval)
+			rep.enable("janitor", "interval", janitorInterval.String(), "dry_run", app.janitor.cfg.dryRun)
+		}
+		reconcileInterval := conf.ReconcileInterval
+		if reconcileInterval > 0 {
+			go app.reconciler.loop(ctx, reconcileInterval)
+			rep.enable("reconciler", "interval", reconcileInterval.String(), "repair", app.reconciler.cfg.repair)
+		}
+		redriveInterval := conf.RedriveInterval
+		switch {
+		case redriveInterval > 0 && app.retries.dlqURL == "":
+			rep.hint("REDRIVE_INTERVAL", "redrive needs a dead-letter queue, so it is not scheduled", "set DLQ_URL, or unset REDRIVE_INTERVAL")
+			redriveInterval = 0
+		case redriveInterval > 0:
+			go app.redriver.loop(ctx, redriveInterval)
+			rep.enable("redrive", "interval", redriveInterval.String(), "batch", app.redriver.cfg.batch,
+				"cooldown", app.redriver.cfg.cooldown.String(), "max_attempts", app.redriver.cfg.maxAttempts)
+		}
+		if janitorInterval <= 0 && reconcileInterval <= 0 && redriveInterval <= 0 && !c.API {
+			rep.hint("RUN_MODE", "the scheduler has nothing to run", "set JANITOR_INTERVAL, RECONCILE_INTERVAL or REDRIVE_INTERVAL")
+		}
+	}
+	// A worker process waits out the processing it lets go on after the
+	// signal, and the release or delete after it, by default.
+	shutdownTimeout := defaultShutdownTimeout
+	workerShutdown := min(conf.WorkerShutdownGrace, app.jobTimeout) + awsOpTimeout
+	if c.Worker {
+		shutdownTimeout = max(shutdownTimeout, workerShutdown)
+	}
+	if conf.ShutdownTimeout > 0 {
+		shutdownTimeout = conf.ShutdownTimeout
+	}
+	// Closed once the worker loop has returned, its last message finished.
+	workerDone := make(chan struct{})
+	if c.Worker {
+		if conf.WorkerDryRun {
+			// A shadow worker leaves production's results, hooks included,
+			// alone (shadow.go).
+			app.shadow = newShadowWorker(conf.WorkerDryRunPrefix)
+			rep.enable("worker_dry_run", "prefix", conf.WorkerDryRunPrefix)
+		} else {
+			// Hook runners first, so results stored by the worker go to them.
+			app.hooks.start(ctx)
+			rep.enable("result_hooks", "hooks", app.hooks.names(), "concurrency", app.hooks.concurrency,
+				"max_attempts", app.hooks.policy.maxAttempts, "sweep_interval", app.hooks.sweep.String())
+		}
+		if app.fair, err = newFairScheduler(max(app.workerCount, 1)); err != nil {
+			slog.Error("invalid fair scheduling settings", "error", err)
+			os.Exit(1)
+		}
+		if f := app.fair; f != nil {
+			rep.enable("fair_scheduling", "staging_size", f.capacity, "max_in_flight", f.maxInFlight, "weights", f.weights, "staging_visibility", f.visibility.String())
+		}
+		if app.loops, err = newLoopGuard(); err != nil {
+			slog.Error("invalid loop guard settings", "error", err)
+			os.Exit(1)
+		}
+		if app.stage, err = newWorkerStage(app.startup.Version); err != nil {
+			slog.Error("invalid worker stage settings", "error", err)
+			os.Exit(1)
+		}
+		if s := app.stage; s != nil {
+			// A version promoted already starts active.
+			app.checkPromotion(ctx)
+			go app.watchWorkerStage(ctx)
+			rep.enable("worker_stage", "start", stageObserve, "now", s.name(), "version", s.version, "refresh", s.refresh.String())
+		}
+		if g := app.loops; g != nil {
+			rep.enable("loop_guard", "window", g.window.String(), "receive_errors", g.maxErrors, "fast_empty_receives", g.maxFastEmpty,
+				"pause", g.pause.String(), "message_receives", g.cycleReceives, "message_cycle", g.cyclePeriod.String())
+		}
+		go func() {
+			defer close(workerDone)
+			app.workerLoop(ctx)
+		}()
+		rep.enable("worker", "concurrency", app.workerCount, "shutdown_grace", conf.WorkerShutdownGrace.String())
+		if app.hooks.sweep <= 0 && app.shadow == nil {
+			rep.hint("HOOK_SWEEP_INTERVAL", "result hooks are only run where the result was stored, never retried, and imported results get none",
+				"unset HOOK_SWEEP_INTERVAL, or set a positive interval")
+		}
+		if len(secretTypes) > 0 {
+			rep.enable("job_secrets", "types", secretTypes, "cache_ttl", app.secrets.ttl.String())
+		}
+		if shutdownTimeout < workerShutdown {
+			rep.hint("SHUTDOWN_TIMEOUT",
+				fmt.Sprintf("%s is shorter than the worker's shutdown (WORKER_SHUTDOWN_GRACE %s plus %s to release or delete its messages), so a message in flight at shutdown may be left to its visibility timeout",
+					shutdownTimeout, conf.WorkerShutdownGrace, awsOpTimeout),
+				"raise SHUTDOWN_TIMEOUT, lower WORKER_SHUTDOWN_GRACE, or leave SHUTDOWN_TIMEOUT unset")
+		}
+	} else {
+		close(workerDone)
+		if conf.WorkerDryRun {
+			rep.hint("WORKER_DRY_RUN", "this process runs no worker, so the setting has no effect", "set it on the worker deployment")
+		}
+	}
+	rep.Config["shutdown_timeout"] = shutdownTimeout.String()
+	hintUnreadConfigFile(rep)
+	rep.log()
+
+	// Open every listener before serving on any, so a bad address or
+	// certificate fails startup instead of leaving a partial server. Sockets
+	// passed by systemd replace the default listener.
+	activated, err := systemdListeners()
+	if err != nil {
+		slog.Error("failed to use systemd sockets", "error", err)
+		os.Exit(1)
+	}
+	listenAddrs := conf.ListenAddrs
+	if listenAddrs == "" {
+		listenAddrs = defaultListenAddr
+		if len(activated) > 0 {
+			var names []string
+			for name := range activated {
+				names = append(names, "systemd://"+name)
+			}
+			listenAddrs = strings.Join(names, ",")
+		}
+	}
+	specs, err := parseListenAddrs(listenAddrs)
+	if err != nil {
+		slog.Error("invalid LISTEN_ADDRS", "error", err)
+		os.Exit(1)
+	}
+	var listeners []net.Listener
+	var listenerSpecs []listenerSpec
+	for _, spec := range specs {
+		lns, err := spec.listen(activated)
+		if err != nil {
+			slog.Error("failed to listen", "listener", spec.String(), "error", err)
+			os.Exit(1)
+		}
+		for _, ln := range lns {
+			listeners = append(listeners, ln)
+			listenerSpecs = append(listenerSpecs, spec)
+		}
+	}
+	for name, lns := range activated {
+		slog.Warn("systemd socket not in LISTEN_ADDRS, closing it", "name", name)
+		for _, ln := range lns {
+			ln.Close()
+		}
+	}
+
+	server := &http.Server{
+		Handler:           app.trustMirrored(app.limiter.headers(app.shedder.wrap(app.debugMode(mux)))),
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       15 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		IdleTimeout:       60 * time.Second,
+	}
+	if app.ws != nil {
+		server.RegisterOnShutdown(app.ws.shutdown)
+	}
+
+	// Serve each listener in the background so Run can wait for a shutdown
+	// signal; Shutdown closes them all.
+	serverErr := make(chan error, len(listeners))
+	for i, ln := range listeners {
+		spec := listenerSpecs[i]
+		go func() {
+			slog.Info("server starting", "listener", spec.String(), "addr", ln.Addr().String(), "tls", spec.tls != nil)
+			if err := server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				serverErr <- fmt.Errorf("%s: %w", spec, err)
+			}
+		}()
+	}
+	// Listeners are open, so connections queue until Serve picks them up:
+	// safe to tell systemd (Type=notify) the service is ready.
+	go app.notifyReady(ctx)
+
+	// Wait for either a fatal server error or a shutdown signal.
+	select {
+	case err := <-serverErr:
+		slog.Error("server failed", "error", err)
+		os.Exit(1)
+	case <-ctx.Done():
+		slog.Info("shutdown signal received, draining connections")
+	}
+	sdNotify("STOPPING=1")
+	// Leave the load balancer before closing the listeners (see alb.go).
+	app.drain(conf.ShutdownDrainDelay)
+
+	// Graceful shutdown: stop accepting new connections and let in-flight
+	// requests finish, bounded by SHUTDOWN_TIMEOUT. The worker saw ctx end as
+	// well; it cancels processing after WORKER_SHUTDOWN_GRACE and releases or
+	// deletes its in-flight messages, within the same bound, before the
+	// process exits.
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("graceful shutdown failed", "error", err)
+	}
+	select {
+	case <-workerDone:
+	case <-shutdownCtx.Done():
+		// Not deleted, so SQS redelivers it after its visibility timeout.
+		slog.Error("worker did not finish its in-flight message before SHUTDOWN_TIMEOUT", "timeout", shutdownTimeout)
+	}
+
+	// Flush and stop telemetry exporters so buffered spans/metrics are not lost.
+	flushCtx, flushCancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer flushCancel()
+	app.stream.close(flushCtx)
+	if err := otelShutdown(flushCtx); err != nil {
+		slog.Error("OpenTelemetry shutdown failed", "error", err)
+	}
+	slog.Info("server stopped")
+}
+
+// registerAPI registers the job API routes on mux. The {id} wildcard matches
+// a single path segment, so nested paths do not leak through, and unmatched
+// methods return a JSON 405 (see routes.go). Each route is traced as its
+// handler's name, behind its own middleware (router.route). The job API is
+// served under /v1, and at its old unversioned paths while the shim is on
+// (versioning.go).
+func (a *App) registerAPI(mux *router) {
+	a.routeVersioned(mux, "POST /jobs", "createJob", a.createJob, a.limiter.wrap, a.mirror.wrap)
+	a.routeVersioned(mux, "PUT /jobs/{id}", "putJob", a.putJob, a.limiter.wrap, a.mirror.wrap)
+	a.routeVersioned(mux, "POST /jobs/import", "importJob", a.importJob, a.requireAdmin)
+	a.routeVersioned(mux, "POST /jobs/validate", "validateJob", a.validateJob)
+	a.routeVersioned(mux, "GET /jobs", "listJobs", a.listJobs)
+	a.routeVersioned(mux, "POST /views", "createView", a.createView)
+	a.routeVersioned(mux, "GET /job-types", "listJobTypes", a.listJobTypes)
+	a.routeVersioned(mux, "GET /views", "listViews", a.listViews)
+	a.routeVersioned(mux, "GET /views/{id}", "getView", a.getView)
+	a.routeVersioned(mux, "DELETE /views/{id}", "deleteView", a.deleteView)
+	a.routeVersioned(mux, "GET /jobs/{id}", "getJob", a.getJob)
+	a.routeVersioned(mux, "HEAD /jobs/{id}", "headJob", a.headJob)
+	a.routeVersioned(mux, "DELETE /jobs/{id}", "deleteJob", a.deleteJob)
+	a.routeVersioned(mux, "GET /jobs/{id}/status", "getJobStatus", a.getJobStatus)
+	a.routeVersioned(mux, "GET /jobs/{id}/download", "downloadJob", a.downloadJob)
+	a.routeVersioned(mux, "GET /jobs/{id}/artifacts", "listArtifacts", a.listArtifacts)
+	a.routeVersioned(mux, "GET /jobs/{id}/artifacts/{name}", "getArtifact", a.getArtifact)
+	a.routeVersioned(mux, "GET /jobs/{id}/lineage", "getLineage", a.getLineage)
+	a.routeVersioned(mux, "GET /jobs/{id}/callback", "getJobCallback", a.getJobCallback)
+	if a.ws != nil {
+		a.routeVersioned(mux, "GET /ws", "serveWS", a.serveWS)
+	}
+	mux.route("GET /stats/storage", "getStorageStats", a.getStorageStats, a.requireAdmin)
+	mux.route("POST /admin/janitor/run", "runJanitor", a.runJanitor, a.requireAdmin)
+	mux.route("GET /admin/janitor/report", "getJanitorReport", a.getJanitorReport, a.requireAdmin)
+	mux.route("POST /admin/redrive/run", "runRedrive", a.runRedrive, a.requireAdmin)
+	mux.route("GET /admin/redrive/report", "getRedriveReport", a.getRedriveReport, a.requireAdmin)
+	mux.route("GET /admin/hooks/failed", "listHookFailures", a.listHookFailures, a.requireAdmin)
+	mux.route("POST /admin/hooks/failed/retry", "retryHookFailures", a.retryHookFailures, a.requireAdmin)
+	mux.route("POST /admin/migrations", "startMigration", a.startMigration, a.requireAdmin)
+	mux.route("GET /admin/migrations/{name}", "getMigration", a.getMigration, a.requireAdmin)
+	mux.route("POST /admin/reconciler/run", "runReconciler", a.runReconciler, a.requireAdmin)
+	mux.route("GET /admin/reconciler/report", "getReconcileReport", a.getReconcileReport, a.requireAdmin)
+	mux.route("GET /admin/throughput", "getThroughput", a.getThroughput, a.requireAdmin)
+	mux.route("POST /admin/jobs/{id}/restore", "restoreJob", a.restoreJob, a.requireAdmin)
+	mux.route("GET /admin/job-types/flags", "getJobTypeFlags", a.getJobTypeFlags, a.requireAdmin)
+	mux.route("PUT /admin/job-types/{type}/disabled", "disableJobType", a.disableJobType, a.requireAdmin)
+	mux.route("DELETE /admin/job-types/{type}/disabled", "enableJobType", a.enableJobType, a.requireAdmin)
+	mux.route("GET /admin/worker-versions", "getWorkerVersions", a.getWorkerVersions, a.requireAdmin)
+	mux.route("POST /admin/worker-versions/{version}/promote", "promoteWorkerVersion", a.promoteWorkerVersion, a.requireAdmin)
+	mux.route("POST /admin/processors/{type}/test", "testProcessor", a.testProcessor, a.requireAdmin)
+}
+
+// startAPIBackground starts the background tasks that serve the API: the SQS
+// send-buffer flusher, the backlog sampler, and the storage usage scan.
+func (a *App) startAPIBackground(ctx context.Context) {
+	// Optional local spool for SQS sends (trades durability for availability).
+	if dir := a.conf.SQSBufferDir; dir != "" {
+		buf, err := newSendBuffer(dir, a.conf.SQSBufferMaxMessages)
+		if err != nil {
+			slog.Error("failed to open SQS send buffer", "dir", dir, "error", err)
+			os.Exit(1)
+		}
+		a.sendBuffer = buf
+		go buf.run(ctx, a.conf.SQSBufferFlushInterval, a.flushBuffered)
+		slog.Warn("SQS send buffer enabled; accepted jobs may be lost if this task's disk is lost before flush", "dir", dir)
+	}
+
+	// Sample queue depth for the throughput report's backlog delta.
+	go a.sampleBacklog(ctx)
+
+	// Periodic bucket usage scan for /stats/storage.
+	if interval := a.conf.StorageStatsInterval; interval > 0 {
+		a.storageStats = &storageStatsCollector{
+			depth:      a.conf.StorageStatsPrefixDepth,
+			maxObjects: int64(a.conf.StorageStatsMaxObjects),
+		}
+		go a.runStorageStats(ctx, a.storageStats, interval)
+	}
+}
+
+// healthz handles GET /healthz requests.
+// Returns 200 OK with "ok" response for health checks.
+func (a *App) healthz(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+// createJob handles POST /jobs requests.
+// Accepts JSON {"text":"..."}, a text/plain body, or a form-encoded "text"
+// field (see decodeJobRequest), generates a job ID, sends message to SQS,
+// and returns the job ID with 201 Created status. The request body is capped
+// at MAX_BODY_BYTES (413) and unknown JSON fields are rejected; invalid fields
+// get a 400 invalid_request listing each one. If the send fails and
+// the local send buffer is enabled, the message is spooled for later delivery
+// and the job is accepted with 202 and "buffered": true. An identical body from
+// the same principal within DUPLICATE_WINDOW returns 200 with the original
+// job's ID and "duplicate": true instead of enqueuing again; with an
+// Idempotency-Key header, a retry gets the original job's ID and "replayed":
+// true for IDEMPOTENCY_TTL instead (see idempotency.go). Creation is
+// all-or-nothing (see createtx.go): a failure leaves no record or lineage
+// behind and returns a JSON error.
+func (a *App) createJob(w http.ResponseWriter, r *http.Request) {
+	a.submitJob(w, r, "")
+}
+
+// submitJob creates a job from r's body under jobID, the client's own for PUT
+// /jobs/{id} (jobput.go), or under a new ID when it is empty.
+func (a *App) submitJob(w http.ResponseWriter, r *http.Request, jobID string) {
+	// Cap the request body to guard against oversized payloads.
+	r.Body = http.MaxBytesReader(w, r.Body, a.bodyLimit)
+
+	// Decode (JSON, plain text, or form-encoded) and validate the body.
+	endValidation := debugPhase(r.Context(), "validation")
+	req, err := a.decodeJobRequest(r)
+	if err == nil {
+		if principalFromRequest(r).Mirrored {
+			// Production delivers the callback; the copy must not call it again.
+			req.CallbackURL = ""
+		}
+		err = a.validateJobRequest(&req)
+	}
+	endValidation()
+	if err != nil {
+		status, detail := jobRequestError(err)
+		writeError(w, status, detail)
+		return
+	}
+
+	// Generate unique job ID, unless this is a repeat of a submission from the
+	// same principal: one with the same Idempotency-Key or, without a key,
+	// within the duplicate window. A client's own ID makes the repeat check
+	// itself (claimJobID).
+	put := jobID != ""
+	if !put {
+		jobID = uuid.New().String()
+	}
+	fingerprint := submissionFingerprint(principalFromRequest(r), req)
+	var idem *idempotencyClaim
+	if put {
+		fingerprint = putFingerprint(principalFromRequest(r), req)
+	} else if key := r.Header.Get(headerIdempotencyKey); key != "" {
+		// An explicit key replaces the duplicate window (idempotency.go).
+		if !validIdempotencyKey(key) {
+			writeError(w, http.StatusBadRequest, ErrorDetail{Code: errCodeInvalidIdempotencyKey, Message: fmt.Sprintf("%s must be 1 to %d printable ASCII characters", headerIdempotencyKey, maxIdempotencyKeyLen)})
+			return
+		}
+		claim, priorID, err := a.claimIdempotencyKey(r.Context(), idempotencyRecordKey(principalFromRequest(r), key), fingerprint, jobID)
+		if err != nil {
+			idempotencyError(r.Context(), w, err)
+			return
+		}
+		if claim == nil {
+			w.Header().Set(headerIdempotentReplayed, "true")
+			a.writeCreateResponse(w, r, http.StatusOK, CreateJobResponse{ID: priorID, Replayed: true})
+			return
+		}
+		idem = claim
+	} else if priorID, dup := a.duplicates.claim(fingerprint, jobID); dup {
+		a.writeCreateResponse(w, r, http.StatusOK, CreateJobResponse{ID: priorID, Duplicate: true})
+		return
+	}
+	message := JobMessage{
+		ID:        jobID,
+		Text:      req.Text,
+		CreatedAt: Now(),
+		Tenant:    principalFromRequest(r).Tenant,
+		Type:      req.Type,
+	}
+
+	// Send message to SQS queue, bounded by a per-request timeout. The
+	// envelope carries the current trace context through the queue so the
+	// worker can continue the same trace when it processes this job.
+	ctx, cancel := context.WithTimeout(r.Context(), awsOpTimeout)
+	defer cancel()
+	env, err := newEnvelope(ctx, messageTypeJob, message, map[string]string{
+		envelopeHeaderTenant:    message.Tenant,
+		envelopeHeaderRequestID: r.Header.Get(headerRequestID),
+		envelopeHeaderGroup:     a.fifoGroup(req, message),
+	})
+	var messageBody []byte
+	if err == nil {
+		messageBody, err = json.Marshal(env)
+	}
+	if err != nil {
+		a.duplicates.release(fingerprint, jobID)
+		idem.release(ctx, a)
+		http.Error(w, "failed to encode message", http.StatusInternalServerError)
+		return
+	}
+
+	// Record lineage and the pending creation record before enqueueing so a
+	// job never exists without them. A client's ID is claimed first, so a
+	// taken one is left alone.
+	rec := JobRecord{ID: jobID, Tenant: message.Tenant, Type: message.Type, ParentID: req.ParentID, CreatedAt: message.CreatedAt, CallbackURL: req.CallbackURL}
+	endWrite := debugPhase(ctx, "storage_write")
+	if put {
+		rec.Fingerprint = fingerprint
+		if !a.claimJobID(ctx, w, r, &rec) {
+			endWrite()
+			return
+		}
+	}
+	if req.ParentID != "" {
+		if err := a.recordLineage(ctx, LineageNode{ID: jobID, ParentID: req.ParentID, Relation: req.Relation, CreatedAt: Now()}); err != nil {
+			a.duplicates.release(fingerprint, jobID)
+			idem.release(ctx, a)
+			a.compensateCreate(ctx, rec)
+			f := classifyS3Error(err)
+			recordS3Error(ctx, "PutObject", f)
+			slog.ErrorContext(ctx, "failed to record lineage", append([]any{"job_id", jobID, "error", err}, f.logAttrs()...)...)
+			status, code, retryable := f.response()
+			writeError(w, status, ErrorDetail{Code: code, Message: "failed to record job lineage", Retryable: retryable})
+			return
+		}
+	}
+	if !put {
+		err = a.putJobRecord(ctx, &rec, createPending)
+	}
+	endWrite()
+	if err != nil {
+		a.duplicates.release(fingerprint, jobID)
+		idem.release(ctx, a)
+		a.compensateCreate(ctx, rec)
+		writeStorageError(ctx, w, "PutObject", "failed to record job", err)
+		return
+	}
+
+	endSend := debugPhase(ctx, "queue_send")
+	err = a.sendMessage(ctx, jobID, string(messageBody), nil)
+	endSend()
+	if err != nil && a.sendBuffer != nil && !errors.Is(err, errMessageTooLarge) {
+		// SQS is failing but buffering is enabled: spool the message for the
+		// background flusher and accept the job anyway.
+		slog.WarnContext(ctx, "failed to send message, buffering locally", "job_id", jobID, "error", err)
+		bufErr := a.sendBuffer.enqueue(bufferedMessage{
+			JobID:      jobID,
+			Body:       string(messageBody),
+			BufferedAt: Now(),
+		})
+		if bufErr == nil {
+			a.markEnqueued(ctx, &rec, createBuffered)
+			jobsCreated.Add(ctx, 1)
+			a.throughput.record(eventEnqueued)
+			a.events.publish(ctx, JobEvent{Type: eventEnqueued, JobID: jobID, Tenant: message.Tenant, At: message.CreatedAt})
+			a.writeCreateResponse(w, r, http.StatusAccepted, CreateJobResponse{ID: jobID, Buffered: true})
+			return
+		}
+		slog.ErrorContext(ctx, "failed to buffer message", "job_id", jobID, "error", bufErr)
+	}
+	if errors.Is(err, errMessageTooLarge) {
+		a.duplicates.release(fingerprint, jobID)
+		idem.release(ctx, a)
+		a.compensateCreate(ctx, rec)
+		writeError(w, http.StatusRequestEntityTooLarge, ErrorDetail{Code: errCodePayloadTooLarge, Message: "job is too large to enqueue: " + err.Error()})
+		return
+	}
+	if err != nil {
+		a.duplicates.release(fingerprint, jobID)
+		idem.release(ctx, a)
+		slog.ErrorContext(ctx, "failed to send message", "job_id", jobID, "error", err)
+		a.compensateCreate(ctx, rec)
+		writeRetryableError(w, http.StatusServiceUnavailable, errCodeQueueUnavailable, "failed to enqueue job", queueRetryAfter)
+		return
+	}
+	a.markEnqueued(ctx, &rec, createQueued)
+	jobsCreated.Add(ctx, 1)
+	a.throughput.record(eventEnqueued)
+	a.events.publish(ctx, JobEvent{Type: eventEnqueued, JobID: jobID, Tenant: message.Tenant, At: message.CreatedAt})
+
+	// Return job ID
+	a.writeCreateResponse(w, r, http.StatusCreated, CreateJobResponse{ID: jobID})
+}
+
+// sendMessage sends one message body for jobID with the given attributes to
+// the job queue.
+func (a *App) sendMessage(ctx context.Context, jobID, body string, attrs map[string]types.MessageAttributeValue) error {
+	return a.sendTo(ctx, a.sqsURL, jobID, body, attrs)
+}
+
+// sendTo sends one message body for jobID to queueURL, first offloading it to
+// S3 when it is too large for SQS or, under SQS_EXTENDED_PRODUCE=true, over
+// the SQS_EXTENDED_THRESHOLD (extended.go). A message too large for SQS that
+// is not offloaded fails with errMessageTooLarge.
+func (a *App) sendTo(ctx context.Context, queueURL, jobID, body string, attrs map[string]types.MessageAttributeValue) error {
+	return a.sendWith(ctx, queueURL, jobID, body, attrs, SendOptions{})
+}
+
+// sendWith is sendTo with options. To a FIFO queue the delay is dropped and
+// the group and deduplication ID default as fifoOptions sets them; to a
+// standard queue the FIFO options are dropped.
+func (a *App) sendWith(ctx context.Context, queueURL, jobID, body string, attrs map[string]types.MessageAttributeValue, opts SendOptions) error {
+	if isFIFOQueue(queueURL) {
+		opts = fifoOptions(jobID, body, opts)
+	} else {
+		opts.GroupID, opts.DeduplicationID = "", ""
+	}
+	size := messageSize(body, attrs)
+	if reason := a.payloads.offloadReason(len(body), size); reason != "" {
+		var err error
+		if body, attrs, err = a.offloadPayload(ctx, jobID, body, attrs); err != nil {
+			return err
+		}
+		countOffloaded(ctx, reason)
+	} else if size > sqsMaxMessageBytes {
+		return fmt.Errorf("%w (%d bytes) and cannot be offloaded to S3", errMessageTooLarge, size)
+	}
+	err := a.queue.Send(ctx, queueURL, body, attrs, opts)
+	if err != nil {
+		recordSQSError(ctx, "SendMessage")
+	}
+	return err
+}
+
+// flushBuffered is the sendBuffer flush callback: it sends a spooled message
+// with its original trace attributes, under its own timeout.
+func (a *App) flushBuffered(ctx context.Context, msg bufferedMessage) error {
+	ctx, cancel := context.WithTimeout(ctx, awsOpTimeout)
+	defer cancel()
+	return a.sendMessage(ctx, msg.JobID, msg.Body, sqsStringAttributes(msg.Attributes))
+}
+
+// writeJSON writes v as a JSON response with the given status.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// getJob handles GET /jobs/{id} requests.
+// Serves the job result from the in-memory cache when present, otherwise
+// fetches it from S3 and caches it. Returns 404 only when the job never
+// existed; a job whose result has been archived or purged gets its metadata
+// with a result_state instead (retention.go). Other S3 failures map by cause
+// (see s3Failure.response): 503 for throttling or an unreachable S3, 502 for
+// S3 5xx or access denied.
+// Timestamps are always UTC; ?tz= and Accept-Language add localized *_local
+// renderings alongside them.
+func (a *App) getJob(w http.ResponseWriter, r *http.Request) {
+	// Extract job ID from the path wildcard.
+	jobID, ok := a.pathJobID(w, r)
+	if !ok {
+		return
+	}
+	loc, err := newLocalizer(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// From the cache, or from S3 with concurrent readers of the same job
+	// sharing one fetch (see loadResult).
+	ctx := r.Context()
+	endRead := debugPhase(ctx, "storage_read")
+	jobResult, source, err := a.loadResult(ctx, jobID)
+	endRead()
+	switch {
+	case errors.Is(err, errJobNotFound):
+		// No result yet: report the job's status, or 404 if it never existed.
+		a.writePendingJob(w, r, jobID)
+		return
+	case errors.Is(err, errResultArchived):
+		a.writeArchivedJob(w, r, jobID)
+		return
+	case errors.Is(err, errDecodeResult):
+		slog.ErrorContext(ctx, "failed to decode job result", "job_id", jobID, "error", err)
+		http.Error(w, "failed to decode job", http.StatusInternalServerError)
+		return
+	case err != nil:
+		// The job may well exist: report the S3 failure by cause (throttled,
+		// 5xx, denied, unreachable) instead of a 404.
+		status, code, retryable := classifyS3Error(err).response()
+		if retryable {
+			writeRetryableError(w, status, code, "result storage is temporarily unavailable", storageRetryAfter)
+		} else {
+			writeError(w, status, ErrorDetail{Code: code, Message: "result storage rejected the request"})
+		}
+		return
+	}
+	w.Header().Set("X-Cache", source)
+	writeJobResult(w, loc, jobResult)
+}
+
+// headJob handles HEAD /jobs/{id} requests.
+// Reports whether the job's result exists without transferring it: 200 with
+// the stored result's ETag, Last-Modified and size (X-Result-Size, in bytes),
+// 404 when there is none yet, and the usual storage error statuses otherwise.
+// An archived result adds X-Result-State: archived (retention.go).
+// Backed by a HeadObject, so repeated existence polls stay cheap.
+func (a *App) headJob(w http.ResponseWriter, r *http.Request) {
+	jobID, ok := a.pathJobID(w, r)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), awsOpTimeout)
+	defer cancel()
+	head, err := a.store.Head(ctx, fmt.Sprintf("jobs/%s.json", jobID))
+	if err != nil {
+		f := classifyS3Error(err)
+		if f.Kind == s3NotFound {
+			a.storageHealth.recordOK()
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if f.degradesStorage() {
+			a.storageHealth.recordError()
+		}
+		writeStorageError(ctx, w, "HeadObject", "failed to look up job", err)
+		return
+	}
+	a.storageHealth.recordOK()
+	if head.Archived && restoreInfo(jobID, head).Status != restoreAvailable {
+		w.Header().Set(headerResultState, resultArchived)
+	}
+	if head.ETag != "" {
+		w.Header().Set("ETag", head.ETag)
+	}
+	if !head.LastModified.IsZero() {
+		w.Header().Set("Last-Modified", head.LastModified.UTC().Format(http.TimeFormat))
+	}
+	w.Header().Set("X-Result-Size", strconv.FormatInt(head.Size, 10))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+}
+
+// errJobNotFound, errDecodeResult and errResultArchived classify fetchResult
+// failures; any other error is an infrastructure failure talking to S3.
+var (
+	errJobNotFound    = errors.New("job not found")
+	errDecodeResult   = errors.New("failed to decode job result")
+	errResultArchived = errors.New("job result is archived")
+)
+
+// fetchResult reads jobs/{id}.json from S3. It returns errJobNotFound when the
+// object does not exist, an error wrapping errDecodeResult when the object is
+// not a valid JobResult, an error wrapping errResultArchived when it has moved
+// to an archive storage class (retention.go), and otherwise the S3 error (classify it with
+// classifyS3Error). Failures are logged with their S3 request IDs and counted,
+// and outcomes feed the storage health used by readiness.
+func (a *App) fetchResult(ctx context.Context, jobID string) (JobResult, error) {
+	key := fmt.Sprintf("jobs/%s.json", jobID)
+	result, _, err := a.store.Get(ctx, key)
+	if err != nil {
+		// Distinguish a genuine "not found" from infrastructure errors
+		// (permissions, throttling, network) so callers are not misled.
+		f := classifyS3Error(err)
+		if f.Kind == s3NotFound {
+			a.storageHealth.recordOK()
+			return JobResult{}, errJobNotFound
+		}
+		if f.Kind == s3Archived {
+			a.storageHealth.recordOK()
+			return JobResult{}, fmt.Errorf("%w: %w", errResultArchived, err)
+		}
+		recordS3Error(ctx, "GetObject", f)
+		if f.degradesStorage() {
+			a.storageHealth.recordError()
+		}
+		slog.ErrorContext(ctx, "failed to get object", append([]any{"key", key, "error", err}, f.logAttrs()...)...)
+		return JobResult{}, fmt.Errorf("failed to get object %s: %w", key, err)
+	}
+	defer result.Close()
+	a.storageHealth.recordOK()
+
+	// Decode job result from JSON
+	var jobResult JobResult
+	if err := json.NewDecoder(result).Decode(&jobResult); err != nil {
+		return JobResult{}, fmt.Errorf("%w: %w", errDecodeResult, err)
+	}
+	return jobResult, nil
+}
+
+// writeJobResult writes a job result as a JobResultView with the convenience
+// time fields rendered for loc.
+func writeJobResult(w http.ResponseWriter, loc localizer, jobResult JobResult) {
+	view := JobResultView{
+		JobResult:         jobResult,
+		Status:            statusCompleted,
+		CreatedAtUnixMs:   jobResult.CreatedAt.UnixMilli(),
+		ProcessedAtUnixMs: jobResult.ProcessedAt.UnixMilli(),
+	}
+	if loc.enabled() {
+		if !jobResult.CreatedAt.IsZero() {
+			view.CreatedAtLocal = loc.format(jobResult.CreatedAt)
+		}
+		view.ProcessedAtLocal = loc.format(jobResult.ProcessedAt)
+		view.TimeZone = loc.zone()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(view)
+}
+
+// errWorkerStopping is the cause of processing cancelled at shutdown.
+var errWorkerStopping = errors.New("worker is shutting down")
+
+// workerLoop runs continuously to process messages from SQS queue.
+// Uses long polling (20 seconds) to receive messages and hands them to a pool
+// of WORKER_CONCURRENCY goroutines, which process each message, store the
+// result in S3, and delete the message after successful processing. Each
+// ReceiveMessage asks for at most one message per worker (and at most
+// maxReceiveBatch), so received messages never wait long for a free worker.
+// It stops when ctx is cancelled (e.g. on shutdown). Processing in flight
+// is cancelled WORKER_SHUTDOWN_GRACE later (at once by default) and its
+// messages released back to the queue, as are those received but not yet
+// started; processing that finishes first is deleted as usual.
+// Only runs in the worker component (RUN_MODE worker or both, or cmd/worker).
+func (a *App) workerLoop(ctx context.Context) {
+	defer a.workerBeat.Store(0)
+	workers := max(a.workerCount, 1)
+	work, stopWork := context.WithCancel(context.WithoutCancel(ctx))
+	defer stopWork()
+	context.AfterFunc(ctx, func() { time.AfterFunc(a.conf.WorkerShutdownGrace, stopWork) })
+	messages := make(chan types.Message)
+	// Handed-off messages not yet finished, and a wake-up for a throttled
+	// loop waiting for one to finish.
+	var busy atomic.Int32
+	freed := make(chan struct{}, 1)
+	var pool sync.WaitGroup
+	for range workers {
+		pool.Go(func() {
+			for message := range messages {
+				a.handleMessage(work, message)
+				a.fair.finished(work, message)
+				busy.Add(-1)
+				select {
+				case freed <- struct{}{}:
+				default:
+				}
+			}
+		})
+	}
+	defer pool.Wait()
+	defer close(messages)
+	// With fair scheduling (fairsched.go) received messages are staged, and
+	// a dispatcher hands them to the workers.
+	if a.fair != nil {
+		stop := make(chan struct{})
+		dispatched := make(chan struct{})
+		go func() {
+			defer close(dispatched)
+			a.dispatch(ctx, stop, messages, &busy, freed, workers)
+		}()
+		hiding := make(chan struct{})
+		go func() {
+			defer close(hiding)
+			a.keepStagedHidden(ctx, stop)
+		}()
+		defer func() {
+			close(stop)
+			<-dispatched
+			<-hiding
+			for _, message := range a.fair.drain(ctx) {
+				a.releaseMessage(ctx, message)
+			}
+		}()
+	}
+
+	for {
+		a.workerBeat.Store(time.Now().UnixNano())
+		// Stop promptly if shutdown was requested.
+		if ctx.Err() != nil {
+			slog.Info("worker stopping")
+			return
+		}
+
+		// Under the intake throttle (throttle.go), receive only for the
+		// slots its reduced concurrency leaves free.
+		want := min(workers, maxReceiveBatch)
+		if a.fair != nil {
+			// Receive only what staging has room for.
+			space := a.fair.space()
+			if space <= 0 {
+				select {
+				case <-ctx.Done():
+				case <-a.fair.room:
+				}
+				continue
+			}
+			want = min(maxReceiveBatch, space)
+		} else if limit := a.throttle.concurrency(workers); limit < workers {
+			free := limit - int(busy.Load())
+			if free <= 0 {
+				select {
+				case <-ctx.Done():
+				case <-freed:
+				case <-time.After(throttleWait):
+				}
+				continue
+			}
+			want = min(want, free)
+		}
+
+		// Poll less often as the day's SQS budget runs out (budget.go).
+		if delay := a.budget.pollDelay(); delay > 0 && !a.pauseWorker(ctx, delay) {
+			continue
+		}
+
+		// Receive messages with long polling (20 seconds). The cancellable
+		// context lets shutdown interrupt the long poll.
+		start := time.Now()
+		received, err := a.queue.Receive(ctx, a.sqsURL, want, 20*time.Second)
+		if err != nil {
+			if ctx.Err() != nil {
+				slog.Info("worker stopping")
+				return
+			}
+			recordSQSError(ctx, "ReceiveMessage")
+			slog.Error("failed to receive message", "error", err)
+			// Back off before retrying, longer once the errors make a loop
+			// (loopguard.go), but stay responsive to shutdown.
+			if !a.pauseWorker(ctx, max(a.loops.receiveFailed(ctx), 5*time.Second)) {
+				return
+			}
+			continue
+		}
+		if len(received) == 0 {
+			if pause := a.loops.receivedNothing(ctx, time.Since(start)); pause > 0 && !a.pauseWorker(ctx, pause) {
+				return
+			}
+		}
+		if isFIFOQueue(a.sqsURL) {
+			// One message per group at a time, so a group's jobs run in order.
+			received = a.headsOfGroups(ctx, received)
+		}
+
+		if a.fair != nil {
+			a.releaseSurplus(ctx, a.fair.stage(ctx, received))
+			continue
+		}
+
+		// Hand each message to the next free worker. This blocks while all
+		// are busy, even during shutdown: a received message is always
+		// processed, or released once processing is cancelled, rather than
+		// left to reappear after its visibility timeout.
+		for _, message := range received {
+			busy.Add(1)
+			messages <- message
+			a.workerBeat.Store(time.Now().UnixNano())
+		}
+	}
+}
+
+// handleMessage processes one received message and deletes it from the queue
+// on success; on failure it is retried or given up on (retry.go). It
+// continues the trace started in createJob (carried in the message envelope).
+// Processing runs until work is cancelled at shutdown, which releases the
+// message for another worker instead of counting a failed attempt; the
+// retry decision and the delete are not cut short.
+func (a *App) handleMessage(work context.Context, message types.Message) {
+	if work.Err() != nil {
+		// Received, but shutdown cancelled processing before it started.
+		a.releaseMessage(work, message)
+		return
+	}
+	attempt := receiveAttempt(message)
+	recordDelivery(work, message, attempt)
+	// A message from an Extended Client producer is read from S3 first.
+	message, payload, err := a.resolvePayload(work, message)
+	if err == nil {
+		message, err = a.adapters.adapt(message)
+	}
+	var env Envelope
+	if err == nil {
+		env, err = openEnvelope(message)
+	}
+	// One consumer span per delivery covers processing, the retry decision
+	// and the delete; a message that cannot be opened starts a new trace.
+	msgCtx, span := startConsumerSpan(env.traceContext(context.WithoutCancel(work)), a.sqsURL, message, attempt)
+	defer span.End()
+	if a.stage.observing() {
+		a.observeMessage(msgCtx, message, env, err)
+		return
+	}
+	procCtx, stop := context.WithCancelCause(msgCtx)
+	defer stop(nil)
+	defer context.AfterFunc(work, func() { stop(errWorkerStopping) })()
+	if a.shadow != nil {
+		a.handleShadowMessage(procCtx, message, env, attempt, err)
+		return
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		a.throughput.record(eventFailed)
+		jobsProcessed.Add(msgCtx, 1, metric.WithAttributes(attribute.String("outcome", statusFailed)))
+		slog.ErrorContext(msgCtx, "failed to open message", "message_id", aws.ToString(message.MessageId), "attempt", attempt, "error", err)
+		a.handleFailure(msgCtx, message, Envelope{}, attempt, err)
+		return
+	}
+	if jobID, typ, d, held := a.heldJobType(env); held {
+		a.holdMessage(msgCtx, message, payload, env, jobID, typ, d)
+		return
+	}
+	err = a.processMessage(procCtx, message, env, &attempt)
+	var cycling *cyclingError
+	switch {
+	case err != nil && errors.Is(context.Cause(procCtx), errWorkerStopping):
+		slog.WarnContext(msgCtx, "processing cancelled by shutdown, releasing message", "request_id", env.Headers[envelopeHeaderRequestID], "attempt", attempt)
+		a.releaseMessage(msgCtx, message)
+		return
+	case errors.Is(err, errJobCancelled):
+		// Cancelled with DELETE /jobs/{id} while queued: drop the message.
+		jobsProcessed.Add(msgCtx, 1, metric.WithAttributes(attribute.String("outcome", statusCancelled)))
+		slog.InfoContext(msgCtx, "job cancelled, dropping message", "request_id", env.Headers[envelopeHeaderRequestID], "attempt", attempt)
+	case errors.Is(err, errJobFinished):
+		// A duplicate delivery of a job another one finished: drop it.
+		slog.InfoContext(msgCtx, "job already finished, dropping duplicate message", "request_id", env.Headers[envelopeHeaderRequestID], "attempt", attempt)
+	case errors.As(err, &cycling):
+		span.SetStatus(codes.Error, err.Error())
+		a.throughput.record(eventFailed)
+		jobsProcessed.Add(msgCtx, 1, metric.WithAttributes(attribute.String("outcome", statusFailed)))
+		a.quarantineMessage(msgCtx, message, env, cycling)
+		return
+	case err != nil:
+		span.SetStatus(codes.Error, err.Error())
+		a.throughput.record(eventFailed)
+		jobsProcessed.Add(msgCtx, 1, metric.WithAttributes(attribute.String("outcome", statusFailed)))
+		slog.ErrorContext(msgCtx, "failed to process message", "request_id", env.Headers[envelopeHeaderRequestID], "attempt", attempt, "error", err)
+		a.handleFailure(msgCtx, message, env, attempt, err)
+		return
+	default:
+		a.throughput.record(eventCompleted)
+		jobsProcessed.Add(msgCtx, 1, metric.WithAttributes(attribute.String("outcome", statusCompleted)))
+	}
+
+	// Delete message from queue after successful processing.
+	delCtx, cancel := context.WithTimeout(msgCtx, awsOpTimeout)
+	defer cancel()
+	err = a.queue.Delete(delCtx, a.sqsURL, aws.ToString(message.ReceiptHandle))
+	if err != nil {
+		recordSQSError(msgCtx, "DeleteMessage")
+		slog.ErrorContext(msgCtx, "failed to delete message", "error", err)
+		return
+	}
+	if payload != nil {
+		if err := a.deletePayload(msgCtx, *payload); err != nil {
+			slog.WarnContext(msgCtx, "failed to delete extended payload", "bucket", payload.Bucket, "key", payload.Key, "error", err)
+		}
+	}
+}
+
+// processMessage processes a single job message. *attempt is the delivery's
+// receive count on the way in and the attempt's number (markProcessing) on
+// the way out. Decodes the job, converts text to uppercase, creates a job
+// result, and stores it in S3 at jobs/{id}.json.
+// Returns an error if any step fails.
+func (a *App) processMessage(ctx context.Context, message types.Message, env Envelope, attempt *int) (err error) {
+	// Span continuing the job's trace; record processing duration on the way out
+	// and mark the span failed on error.
+	ctx, span := tracer.Start(ctx, "processMessage")
+	defer span.End()
+	start := time.Now()
+	var jobMsg JobMessage
+	var rec *JobRecord
+	defer func() {
+		// Neither a cancelled job nor processing cut short by shutdown, which
+		// is redelivered, records an outcome; a duplicate delivery only
+		// closes its attempt.
+		if errors.Is(err, errJobCancelled) || (err != nil && errors.Is(context.Cause(ctx), errWorkerStopping)) {
+			return
+		}
+		if errors.Is(err, errJobFinished) {
+			if rec != nil {
+				a.markFinished(ctx, rec, err)
+			}
+			return
+		}
+		jobProcessingDuration.Record(ctx, time.Since(start).Seconds(),
+			metric.WithAttributes(attribute.Bool("error", err != nil)))
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		if jobMsg.ID == "" || a.shadow != nil {
+			return
+		}
+		ev := JobEvent{Type: eventCompleted, JobID: jobMsg.ID, Tenant: jobMsg.Tenant, At: Now()}
+		if err != nil {
+			ev.Type, ev.Error = eventFailed, err.Error()
+		}
+		a.events.publish(ctx, ev)
+		if rec != nil {
+			a.markFinished(ctx, rec, err)
+		}
+	}()
+
+	// Unmarshal message body
+	if err := env.decodeBody(messageTypeJob, &jobMsg); err != nil {
+		return err
+	}
+	if jobMsg.Tenant == "" {
+		jobMsg.Tenant = env.Headers[envelopeHeaderTenant]
+	}
+	// Producers outside the API (pkg/contract) choose their own job IDs.
+	id, err := a.jobIDs.canonical(jobMsg.ID)
+	if err != nil {
+		return fmt.Errorf("job id %q %s", jobMsg.ID, err)
+	}
+	jobMsg.ID = id
+	// A dry-run worker leaves the job's status to production workers.
+	if a.shadow == nil {
+		if rec, err = a.markProcessing(ctx, jobMsg, message); err != nil {
+			return err
+		}
+		if rec != nil {
+			*attempt = rec.Attempt
+			// Checked on attempts only: a receive that never reached
+			// processing says nothing about a message cycling.
+			if period, ok := a.loops.cycling(message, *attempt); ok {
+				return &cyclingError{attempt: *attempt, period: period}
+			}
+		}
+	}
+	span.SetAttributes(attribute.String("job.id", jobMsg.ID), attribute.Int("job.attempt", *attempt))
+
+	// Everything from here on, storage included, shares the job's deadline.
+	jc, cancel := newJobContext(ctx, jobMsg.ID, jobMsg.Tenant, *attempt, a.jobTimeout)
+	defer cancel()
+	ctx = jc
+
+	if jobMsg.Type == "" {
+		jobMsg.Type = defaultProcessorType
+	}
+	process, ok := lookupProcessor(jobMsg.Type)
+	if !ok {
+		// Probably submitted through a newer API; a later delivery may land
+		// on an upgraded worker.
+		return fmt.Errorf("unknown processor type %q", jobMsg.Type)
+	}
+	if a.shadow != nil {
+		jc.DryRun = true
+	} else {
+		jc.locks = a.locks
+		if jc.secrets, err = a.secrets.resolve(jc, processorSecrets(jobMsg.Type, process)); err != nil {
+			return fmt.Errorf("processor %s: %w", jobMsg.Type, err)
+		}
+	}
+	output, artifacts, err := process.Process(jc, jobMsg.Text)
+	jc.releaseLocks()
+	if err != nil {
+		return fmt.Errorf("processor %s: %w", jobMsg.Type, err)
+	}
+
+	// Store artifacts before the result, so a visible result always has them.
+	artifactNames, err := a.putArtifacts(ctx, a.keyPrefix(), jobMsg.ID, artifacts)
+	if err != nil {
+		f := classifyS3Error(err)
+		recordS3Error(ctx, "PutObject", f)
+		if f.degradesStorage() {
+			a.storageHealth.recordError()
+		}
+		slog.ErrorContext(ctx, "failed to store artifacts", append([]any{"job_id", jobMsg.ID, "error", err}, f.logAttrs()...)...)
+		return fmt.Errorf("failed to store artifacts: %w", err)
+	}
+
+	// Create job result with processed output
+	jobResult := JobResult{
+		ID:          jobMsg.ID,
+		Text:        jobMsg.Text,
+		Type:        jobMsg.Type,
+		Output:      output,
+		Artifacts:   artifactNames,
+		CreatedAt:   jobMsg.CreatedAt,
+		ProcessedAt: Now(),
+	}
+
+	// Marshal result to JSON
+	resultBody, err := json.Marshal(jobResult)
+	if err != nil {
+		return fmt.Errorf("failed to marshal result: %w", err)
+	}
+
+	// Store result in S3, bounded by a per-operation timeout so a hung put
+	// cannot stall the worker indefinitely. Derived from the span context so the
+	// S3 call appears as a child span in the trace. Only the first delivery
+	// to finish stores it: a duplicate's result is discarded.
+	putCtx, cancel := context.WithTimeout(ctx, awsOpTimeout)
+	defer cancel()
+	var callbackURL string
+	if rec != nil {
+		callbackURL = rec.CallbackURL
+	}
+	key := a.keyPrefix() + fmt.Sprintf("jobs/%s.json", jobMsg.ID)
+	err = a.store.Put(putCtx, key, resultBody, PutOptions{ContentType: "application/json", IfNoneMatch: a.shadow == nil})
+	if err != nil {
+		f := classifyS3Error(err)
+		if f.Status == http.StatusPreconditionFailed {
+			a.storageHealth.recordOK()
+			// Stored by a delivery that may not have got as far as
+			// recording the result's hooks.
+			if err := a.hooks.resume(ctx, jobMsg.ID, callbackURL); err != nil {
+				return err
+			}
+			return errJobFinished
+		}
+		recordS3Error(ctx, "PutObject", f)
+		if f.degradesStorage() {
+			a.storageHealth.recordError()
+		}
+		slog.ErrorContext(ctx, "failed to put object", append([]any{"key", key}, f.logAttrs()...)...)
+		return fmt.Errorf("failed to put object: %w", err)
+	}
+	a.storageHealth.recordOK()
+
+	// Sort index entries and other post-store work run as hooks, outside
+	// the job (hooks.go); a dry run's result has none. Unrecorded, they
+	// would never run: the attempt fails, and its retry finds the result
+	// stored and records them (hookRunner.resume).
+	if a.shadow == nil {
+		return a.hooks.enqueue(ctx, jobResult, int64(len(resultBody)), callbackURL)
+	}
+
+	return nil
+}
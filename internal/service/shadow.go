@@ -0,0 +1,148 @@
+// Dry-run ("shadow") workers. With WORKER_DRY_RUN=true a worker validates a
+// new version against production traffic without taking part in it: it
+// receives and processes job messages as usual, but
+//
+//   - writes results and artifacts under WORKER_DRY_RUN_PREFIX (shadow/jobs/…)
+//     instead of jobs/, and runs no result hooks;
+//   - never deletes, retries, dead-letters, parks or requeues a message: after
+//     processing it resets the message's visibility so a production worker
+//     receives it at once;
+//   - leaves creation records, lifecycle events and extended payloads alone,
+//     and runs processors with jc.DryRun set, so they skip side effects (and
+//     get no secrets and always-free locks, as in other dry runs).
+//
+// A shadow worker remembers the messages it has processed for
+// shadowSeenTTL and releases them unprocessed when they come round again,
+// after shadowRevisitDelay so it does not spin on a queue production workers
+// have yet to drain. Each receive still counts towards a message's
+// ApproximateReceiveCount, so jobs reach MAX_ATTEMPTS and the queue's
+// maxReceiveCount sooner while a shadow worker runs; raise them for the
+// duration, and keep the shadow's WORKER_CONCURRENCY low.
+package service
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// shadowSeenTTL is how long a shadow worker remembers a processed message.
+const shadowSeenTTL = time.Hour
+
+// shadowRevisitDelay is how long a shadow worker holds a message it has
+// already processed before releasing it again.
+const shadowRevisitDelay = 2 * time.Second
+
+// shadowSeenMax bounds the remembered messages; the oldest are forgotten
+// first.
+const shadowSeenMax = 100_000
+
+// serviceOwnPrefixes are the key prefixes the service writes outside
+// WORKER_DRY_RUN; a shadow prefix must not overlap them.
+var serviceOwnPrefixes = []string{
+	jobsPrefix, indexPrefix, "lineage/", statusPrefix, tombstonesPrefix, viewsPrefix, payloadsPrefix,
+	diagnosticsPrefix, migrationsPrefix, idempotencyPrefix, "flags/", parkedPrefix, locksPrefix, "hooks/",
+	"events/", callbacksPrefix,
+}
+
+// validShadowPrefix reports whether prefix can hold a shadow worker's
+// output.
+func validShadowPrefix(prefix string) bool {
+	if !strings.HasSuffix(prefix, "/") || strings.HasPrefix(prefix, "/") {
+		return false
+	}
+	for _, own := range serviceOwnPrefixes {
+		if strings.HasPrefix(prefix, own) || strings.HasPrefix(own, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// shadowWorker is the state of a dry-run worker.
+type shadowWorker struct {
+	prefix string // WORKER_DRY_RUN_PREFIX, prepended to every key written
+	seenMessages
+}
+
+// newShadowWorker returns a dry-run worker writing under prefix.
+func newShadowWorker(prefix string) *shadowWorker {
+	return &shadowWorker{prefix: prefix}
+}
+
+// seenMessages remembers the messages a worker that releases them (a
+// shadow, or one observing, workerstage.go) has already handled.
+type seenMessages struct {
+	mu    sync.Mutex
+	seen  map[string]time.Time // Handled message IDs and when
+	order []string             // seen's keys, oldest first
+}
+
+// firstSeen records messageID as handled, reporting false when it already
+// was within shadowSeenTTL.
+func (s *seenMessages) firstSeen(messageID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.seen == nil {
+		s.seen = map[string]time.Time{}
+	}
+	now := time.Now()
+	for len(s.order) > 0 && (len(s.order) >= shadowSeenMax || now.Sub(s.seen[s.order[0]]) > shadowSeenTTL) {
+		delete(s.seen, s.order[0])
+		s.order = s.order[1:]
+	}
+	if _, ok := s.seen[messageID]; ok {
+		return false
+	}
+	s.seen[messageID] = now
+	s.order = append(s.order, messageID)
+	return true
+}
+
+// handleShadowMessage processes one received message as a dry run and
+// releases it back to the queue; openErr is why it could not be opened.
+func (a *App) handleShadowMessage(ctx context.Context, message types.Message, env Envelope, attempt int, openErr error) {
+	defer a.releaseMessage(ctx, message)
+	if !a.shadow.firstSeen(aws.ToString(message.MessageId)) {
+		time.Sleep(shadowRevisitDelay)
+		return
+	}
+	err := openErr
+	if err == nil {
+		err = a.processMessage(ctx, message, env, &attempt)
+	}
+	outcome := statusCompleted
+	if err != nil {
+		outcome = statusFailed
+		slog.WarnContext(ctx, "dry-run processing failed", "message_id", aws.ToString(message.MessageId), "attempt", attempt, "error", err)
+	}
+	jobsProcessed.Add(ctx, 1, metric.WithAttributes(attribute.String("outcome", outcome), attribute.Bool("dry_run", true)))
+}
+
+// releaseMessage makes message visible again at once, for a production
+// worker to take.
+func (a *App) releaseMessage(ctx context.Context, message types.Message) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), awsOpTimeout)
+	defer cancel()
+	if err := a.queue.ChangeVisibility(ctx, a.sqsURL, aws.ToString(message.ReceiptHandle), 0); err != nil {
+		recordSQSError(ctx, "ChangeMessageVisibility")
+		// It comes back after the queue's visibility timeout instead.
+		slog.WarnContext(ctx, "failed to release message", "message_id", aws.ToString(message.MessageId), "error", err)
+	}
+}
+
+// keyPrefix is prepended to the keys processMessage writes: the shadow
+// prefix in a dry-run worker.
+func (a *App) keyPrefix() string {
+	if a.shadow == nil {
+		return ""
+	}
+	return a.shadow.prefix
+}
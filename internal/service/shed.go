@@ -0,0 +1,225 @@
+// Adaptive load shedding. With LOAD_SHEDDING=true every API request is given
+// a priority, and when the service is overloaded the lowest priorities are
+// rejected first, so the requests that matter keep their latency:
+//
+//	critical  /healthz, /readyz, /metrics, /admin/*,  never shed
+//	          /debug/*
+//	high      GET/HEAD /jobs/{id}/…                   result and artifact reads
+//	normal    POST /jobs, PUT /jobs/{id}              submissions
+//	low       everything else                         listings, views, stats, validation, imports, /ws
+//
+// Job API paths are classified the same under /v1 and unversioned
+// (versioning.go). A caller may lower (never raise) its priority with "X-Priority: low".
+//
+// Every SHED_INTERVAL the shedder compares the interval's p99 handler latency
+// with SHED_P99_THRESHOLD and the S3 error rate (from the same outcomes that
+// drive readiness) with SHED_S3_ERROR_RATE. Either one over its threshold
+// raises the shedding level by one priority; three consecutive intervals
+// comfortably under both (80%) lower it again. Shed requests get a retryable
+// 503 with the "overloaded" code; the level and every shed request are
+// exported as metrics.
+package service
+
+import (
+	"context"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// errCodeOverloaded means the request was shed; it is safe to retry later.
+const errCodeOverloaded = "overloaded"
+
+const (
+	// shedRetryAfter is the Retry-After hint on shed requests.
+	shedRetryAfter = 2 * time.Second
+	// shedLatencySamples bounds the latencies kept per interval (reservoir).
+	shedLatencySamples = 4096
+	// shedMinS3Calls is the fewest S3 outcomes an interval needs before its
+	// error rate counts.
+	shedMinS3Calls = 20
+	// shedCalmIntervals is how many calm intervals lower the level by one.
+	shedCalmIntervals = 3
+	// shedHysteresis is the share of a threshold a signal must fall under to
+	// count as calm.
+	shedHysteresis = 0.8
+)
+
+// requestPriority orders requests for shedding; lower is shed first.
+type requestPriority int32
+
+const (
+	priorityLow requestPriority = iota
+	priorityNormal
+	priorityHigh
+	priorityCritical
+)
+
+// String returns the priority's name, as used in metrics and responses.
+func (p requestPriority) String() string {
+	switch p {
+	case priorityLow:
+		return "low"
+	case priorityNormal:
+		return "normal"
+	case priorityHigh:
+		return "high"
+	}
+	return "critical"
+}
+
+// classifyPriority returns r's shedding priority.
+func classifyPriority(r *http.Request) requestPriority {
+	path := unversionedPath(r.URL.Path)
+	if path == "/healthz" || path == "/readyz" || path == "/metrics" || strings.HasPrefix(path, "/admin/") || strings.HasPrefix(path, "/debug/") {
+		return priorityCritical
+	}
+	p := priorityLow
+	switch {
+	case (r.Method == http.MethodGet || r.Method == http.MethodHead) && strings.HasPrefix(path, "/jobs/"):
+		p = priorityHigh
+	case r.Method == http.MethodPost && path == "/jobs", r.Method == http.MethodPut && strings.HasPrefix(path, "/jobs/"):
+		p = priorityNormal
+	}
+	if strings.EqualFold(r.Header.Get("X-Priority"), "low") {
+		p = priorityLow
+	}
+	return p
+}
+
+// shedConfig holds the overload thresholds.
+type shedConfig struct {
+	p99Threshold time.Duration // Handler latency p99 that counts as overloaded
+	s3ErrorRate  float64       // S3 failure share that counts as overloaded
+	interval     time.Duration // Evaluation period
+}
+
+// loadShedder rejects low-priority requests while the service is
+// overloaded.
+type loadShedder struct {
+	cfg     shedConfig
+	storage *dependencyHealth
+	level   atomic.Int32 // Priorities below this are shed; 0 sheds nothing
+	calm    int          // Consecutive calm intervals; evaluate only
+
+	mu        sync.Mutex
+	latencies []time.Duration // Reservoir sample of this interval's latencies
+	seen      int             // Requests observed this interval
+}
+
+// newLoadShedder returns the shedder configured by the SHED_* variables.
+func newLoadShedder(storage *dependencyHealth) *loadShedder {
+	return &loadShedder{
+		cfg: shedConfig{
+			p99Threshold: envDuration("SHED_P99_THRESHOLD", time.Second),
+			s3ErrorRate:  envFloat("SHED_S3_ERROR_RATE", 0.2),
+			interval:     envDuration("SHED_INTERVAL", 5*time.Second),
+		},
+		storage:   storage,
+		latencies: make([]time.Duration, 0, shedLatencySamples),
+	}
+}
+
+// wrap sheds requests below the current level and times the rest. A nil
+// shedder passes every request through.
+func (s *loadShedder) wrap(next http.Handler) http.Handler {
+	if s == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := classifyPriority(r)
+		if p == priorityCritical {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if p < requestPriority(s.level.Load()) {
+			shedRequests.Add(r.Context(), 1, metric.WithAttributes(attribute.String("priority", p.String())))
+			writeRetryableError(w, http.StatusServiceUnavailable, errCodeOverloaded,
+				"service overloaded; "+p.String()+"-priority requests are being shed", shedRetryAfter)
+			return
+		}
+		if isWebSocketUpgrade(r) {
+			// Its latency is the connection's lifetime.
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		next.ServeHTTP(w, r)
+		s.observe(time.Since(start))
+	})
+}
+
+// observe adds one handler latency to the interval's sample.
+func (s *loadShedder) observe(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seen++
+	if len(s.latencies) < shedLatencySamples {
+		s.latencies = append(s.latencies, d)
+	} else if i := rand.IntN(s.seen); i < shedLatencySamples {
+		s.latencies[i] = d
+	}
+}
+
+// evaluate ends an interval: it reads the signals and moves the level.
+func (s *loadShedder) evaluate(ctx context.Context) {
+	s.mu.Lock()
+	var p99 time.Duration
+	if n := len(s.latencies); n > 0 {
+		slices.Sort(s.latencies)
+		p99 = s.latencies[(n*99)/100]
+	}
+	s.latencies, s.seen = s.latencies[:0], 0
+	s.mu.Unlock()
+
+	var errRate float64
+	if oks, errs := s.storage.takeCounts(); oks+errs >= shedMinS3Calls {
+		errRate = float64(errs) / float64(oks+errs)
+	}
+
+	prev := s.level.Load()
+	level := prev
+	switch {
+	case p99 > s.cfg.p99Threshold || errRate > s.cfg.s3ErrorRate:
+		s.calm = 0
+		level = min(level+1, int32(priorityCritical))
+	case float64(p99) < shedHysteresis*float64(s.cfg.p99Threshold) && errRate < shedHysteresis*s.cfg.s3ErrorRate:
+		if s.calm++; s.calm >= shedCalmIntervals && level > 0 {
+			s.calm = 0
+			level--
+		}
+	default:
+		s.calm = 0
+	}
+	s.level.Store(level)
+	shedLevel.Record(ctx, int64(level))
+	if level != prev {
+		shedding := "nothing"
+		if level > 0 {
+			shedding = requestPriority(level-1).String() + " and below"
+		}
+		slog.Warn("load shedding level changed", "level", level, "shedding", shedding, "p99", p99, "s3_error_rate", errRate)
+	}
+}
+
+// loop evaluates the signals every interval until ctx is cancelled.
+func (s *loadShedder) loop(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.evaluate(ctx)
+		}
+	}
+}
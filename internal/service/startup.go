@@ -0,0 +1,77 @@
+// Startup dependency wait. When infrastructure and the service start together
+// (compose, CI, LocalStack), the queue and bucket may not exist for the first
+// few seconds. With STARTUP_WAIT_TIMEOUT set, boot polls both with
+// exponential backoff, logging progress, and only gives up (exiting) once the
+// deadline passes, instead of starting against missing dependencies.
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Backoff bounds between dependency checks.
+const (
+	startupWaitInitialBackoff = 500 * time.Millisecond
+	startupWaitMaxBackoff     = 15 * time.Second
+)
+
+// checkDependencies returns nil when both the queue and the bucket are
+// reachable, else an error naming what is not.
+func (a *App) checkDependencies(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, awsOpTimeout)
+	defer cancel()
+	var errs []error
+	if _, err := a.queue.Depth(ctx, a.sqsURL); err != nil {
+		errs = append(errs, fmt.Errorf("queue: %w", err))
+	}
+	if a.onS3() { // The filesystem store's directory exists once Run gets here
+		if _, err := a.s3Client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(a.s3Bucket)}); err != nil {
+			errs = append(errs, fmt.Errorf("bucket: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// waitForDependencies polls checkDependencies until it succeeds or timeout
+// passes, in which case (or on SIGINT/SIGTERM) the process exits.
+func (a *App) waitForDependencies(timeout time.Duration) {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	backoff := startupWaitInitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := a.checkDependencies(ctx)
+		if err == nil {
+			if attempt > 1 {
+				slog.Info("dependencies reachable", "attempts", attempt, "waited", time.Since(start).Round(time.Millisecond).String())
+			}
+			return
+		}
+		slog.Warn("waiting for dependencies", "attempt", attempt, "error", err,
+			"retry_in", backoff.String(), "remaining", time.Until(start.Add(timeout)).Round(time.Second).String())
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.Canceled) {
+				slog.Info("shutdown requested while waiting for dependencies")
+				os.Exit(1)
+			}
+			slog.Error("dependencies not reachable before STARTUP_WAIT_TIMEOUT", "timeout", timeout.String(), "attempts", attempt, "error", err)
+			os.Exit(1)
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, startupWaitMaxBackoff)
+	}
+}
@@ -0,0 +1,214 @@
+// Startup report. Once Run has configured the process it logs one
+// structured "startup report" record instead of a line per subsystem: the
+// build and the versions of the AWS SDK and telemetry modules, the
+// components, the region the clients sign for and the account the job
+// queue belongs to, a summary of the effective settings, the optional
+// subsystems that are enabled, and hints for misconfigurations that would
+// otherwise only surface as failed calls — a queue in another region than
+// AWS_REGION, a dead-letter queue in another account, an emulator endpoint
+// without path-style addressing, a secret left unset. The record is logged at
+// WARN when there are hints and at INFO otherwise.
+package service
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// reportedModules are the dependencies whose versions the report carries.
+var reportedModules = []string{
+	"github.com/aws/aws-sdk-go-v2",
+	"github.com/aws/aws-sdk-go-v2/service/sqs",
+	"github.com/aws/aws-sdk-go-v2/service/s3",
+	"go.opentelemetry.io/otel",
+}
+
+// StartupReport is the record Run logs once the process is configured.
+type StartupReport struct {
+	Version    string                    `json:"version"`           // Module version, or VCS revision of a development build
+	GoVersion  string                    `json:"go_version"`        // Toolchain the binary was built with
+	Components map[string]bool           `json:"components"`        // api, worker, scheduler
+	Region     string                    `json:"region"`            // Region the AWS clients sign for
+	Account    string                    `json:"account,omitempty"` // Account of SQS_QUEUE_URL
+	Config     map[string]any            `json:"config"`            // Effective settings that shape behaviour
+	Subsystems map[string]map[string]any `json:"subsystems"`        // Enabled optional subsystems and their settings
+	Modules    map[string]string         `json:"modules"`           // Versions of reportedModules
+	Hints      []StartupHint             `json:"hints"`             // Likely misconfigurations
+}
+
+// StartupHint is a likely misconfiguration and what to do about it.
+type StartupHint struct {
+	Setting string `json:"setting"` // Setting to look at
+	Problem string `json:"problem"` // What goes wrong with the current value
+	Fix     string `json:"fix"`     // What to change
+}
+
+// newStartupReport starts a report for conf and the components c, with the
+// hints that follow from the settings alone.
+func newStartupReport(conf Config, c Components, region string) *StartupReport {
+	rep := &StartupReport{
+		Version:    "unknown",
+		GoVersion:  runtime.Version(),
+		Components: map[string]bool{"api": c.API, "worker": c.Worker, "scheduler": c.Scheduler},
+		Region:     region,
+		Config: map[string]any{
+			"queue_backend":      conf.QueueBackend,
+			"queue_url":          conf.QueueURL,
+			"storage_backend":    conf.StorageBackend,
+			"bucket":             conf.Bucket,
+			"worker_concurrency": conf.WorkerConcurrency,
+			"job_timeout":        conf.JobTimeout.String(),
+			"max_body_bytes":     conf.MaxBodyBytes,
+			"listen_addrs":       conf.ListenAddrs,
+			"admin_api":          conf.AdminToken != "",
+		},
+		Subsystems: map[string]map[string]any{},
+		Modules:    map[string]string{},
+		Hints:      []StartupHint{},
+	}
+	if v := getenv("CONFIG_FILE"); v != "" {
+		rep.Config["config_file"] = v
+	}
+	if v := getenv("APP_PROFILE"); v != "" {
+		rep.Config["profile"] = v
+	}
+	if conf.StorageBackend == storageFilesystem {
+		rep.Config["storage_dir"] = conf.StorageDir
+	}
+	if ep := conf.sqsEndpoint(); ep != "" {
+		rep.Config["sqs_endpoint"] = ep
+	}
+	if ep := conf.s3Endpoint(); ep != "" {
+		rep.Config["s3_endpoint"] = ep
+		rep.Config["s3_path_style"] = conf.S3PathStyle
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		rep.Version = buildVersion(bi)
+		for _, dep := range bi.Deps {
+			for _, path := range reportedModules {
+				if dep.Path == path {
+					rep.Modules[path] = dep.Version
+				}
+			}
+		}
+	}
+	if conf.QueueBackend == queueSQS {
+		_, rep.Account = queueURLLocation(conf.QueueURL)
+	}
+	rep.configHints(conf, c)
+	return rep
+}
+
+// buildVersion returns the main module's version, or for a development
+// build its VCS revision.
+func buildVersion(bi *debug.BuildInfo) string {
+	if v := bi.Main.Version; v != "" && v != "(devel)" {
+		return v
+	}
+	var rev, dirty string
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			rev = s.Value
+		case "vcs.modified":
+			if s.Value == "true" {
+				dirty = "-dirty"
+			}
+		}
+	}
+	if rev == "" {
+		return "devel"
+	}
+	return rev[:min(len(rev), 12)] + dirty
+}
+
+// queueURLLocation returns the region and account of an SQS queue URL
+// (https://sqs.{region}.amazonaws.com/{account}/{name}). Either is empty when
+// the URL does not say, e.g. an emulator's has no region.
+func queueURLLocation(raw string) (region, account string) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", ""
+	}
+	if parts := strings.Split(strings.Trim(u.Path, "/"), "/"); len(parts) == 2 {
+		account = parts[0]
+	}
+	host := u.Hostname()
+	switch {
+	case strings.HasPrefix(host, "sqs.") && strings.Contains(host, ".amazonaws.com"):
+		region = strings.Split(host, ".")[1]
+	case strings.HasSuffix(host, ".queue.amazonaws.com"): // Legacy form
+		region = strings.TrimSuffix(host, ".queue.amazonaws.com")
+	}
+	return region, account
+}
+
+// configHints adds the hints that follow from the settings alone.
+func (rep *StartupReport) configHints(conf Config, c Components) {
+	onAWS := conf.QueueBackend == queueSQS || conf.StorageBackend == storageS3
+	if rep.Region == "" && onAWS {
+		rep.hint("AWS_REGION", "no region is configured, so every SQS and S3 call fails",
+			"set AWS_REGION, or a region in the AWS profile")
+	}
+	if conf.QueueBackend == queueSQS && conf.sqsEndpoint() == "" && rep.Region != "" {
+		queueRegion, queueAccount := queueURLLocation(conf.QueueURL)
+		if queueRegion != "" && queueRegion != rep.Region {
+			rep.hint("AWS_REGION",
+				fmt.Sprintf("SQS_QUEUE_URL is in %s but the clients sign for %s, so every queue call fails (\"The specified queue does not exist\" or a signature error)", queueRegion, rep.Region),
+				fmt.Sprintf("set AWS_REGION=%s, or use a queue in %s", queueRegion, rep.Region))
+		}
+		dlqRegion, dlqAccount := queueURLLocation(getenv("DLQ_URL"))
+		if dlqRegion != "" && dlqRegion != rep.Region {
+			rep.hint("DLQ_URL",
+				fmt.Sprintf("DLQ_URL is in %s but the clients sign for %s, so forwarding dead-lettered jobs fails", dlqRegion, rep.Region),
+				fmt.Sprintf("use a dead-letter queue in %s", rep.Region))
+		}
+		if dlqAccount != "" && queueAccount != "" && dlqAccount != queueAccount {
+			rep.hint("DLQ_URL",
+				fmt.Sprintf("DLQ_URL belongs to account %s and SQS_QUEUE_URL to %s; the task role needs sqs:SendMessage granted by the other account's queue policy", dlqAccount, queueAccount),
+				"use a dead-letter queue in the job queue's account, or grant the task role in its queue policy")
+		}
+	}
+	if ep := conf.s3Endpoint(); ep != "" && !conf.S3PathStyle && conf.StorageBackend == storageS3 {
+		// The SDK already addresses buckets by path on an IP endpoint.
+		if u, err := url.Parse(ep); err == nil && net.ParseIP(u.Hostname()) == nil && !strings.HasSuffix(u.Hostname(), ".amazonaws.com") {
+			rep.hint("S3_FORCE_PATH_STYLE",
+				fmt.Sprintf("the S3 endpoint %s is not AWS, and emulators rarely resolve virtual-hosted {bucket}.%s names", ep, u.Host),
+				"set S3_FORCE_PATH_STYLE=true")
+		}
+	}
+	if conf.QueueBackend == queueMemory && (!c.API || !c.Worker) {
+		rep.hint("QUEUE_BACKEND",
+			"memory queues only deliver within one process, and this one does not run both the API and the worker",
+			"run with RUN_MODE=both, or use QUEUE_BACKEND=sqs")
+	}
+}
+
+// hint records a likely misconfiguration.
+func (rep *StartupReport) hint(setting, problem, fix string) {
+	rep.Hints = append(rep.Hints, StartupHint{Setting: setting, Problem: problem, Fix: fix})
+}
+
+// enable records an enabled subsystem with its settings as key/value pairs.
+func (rep *StartupReport) enable(name string, kv ...any) {
+	settings := map[string]any{}
+	for i := 0; i+1 < len(kv); i += 2 {
+		settings[fmt.Sprint(kv[i])] = kv[i+1]
+	}
+	rep.Subsystems[name] = settings
+}
+
+// log emits the report: at WARN when there are hints, so they are noticed.
+func (rep *StartupReport) log() {
+	level := slog.LevelInfo
+	if len(rep.Hints) > 0 {
+		level = slog.LevelWarn
+	}
+	slog.Log(context.Background(), level, "startup report", "report", rep, "hints", len(rep.Hints))
+}
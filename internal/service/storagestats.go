@@ -0,0 +1,150 @@
+// Storage usage reporting. A background scan lists the bucket with
+// ListObjectsV2 and aggregates object counts and bytes per key prefix (the
+// first STORAGE_STATS_PREFIX_DEPTH path segments, e.g. depth 2 turns
+// "tenants/acme/jobs/x.json" into "tenants/acme/"), so retention and cost can
+// be attributed per tenant or job type once keys are partitioned that way.
+// GET /stats/storage serves the latest completed scan.
+package service
+
+import (
+	"cmp"
+	"context"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errCodeStatsPending means no storage scan has completed yet.
+const errCodeStatsPending = "stats_pending"
+
+// PrefixUsage is the storage used under one key prefix.
+type PrefixUsage struct {
+	Prefix  string `json:"prefix"`  // Key prefix, ending in "/" (or the bare key for top-level objects)
+	Objects int64  `json:"objects"` // Number of objects
+	Bytes   int64  `json:"bytes"`   // Total object size in bytes
+}
+
+// StorageStats is the GET /stats/storage response body.
+type StorageStats struct {
+	Bucket      string        `json:"bucket"`       // Scanned bucket
+	PrefixDepth int           `json:"prefix_depth"` // Path segments used for grouping
+	GeneratedAt Timestamp     `json:"generated_at"` // When the scan finished
+	DurationMs  int64         `json:"duration_ms"`  // How long the scan took
+	Truncated   bool          `json:"truncated"`    // Scan stopped at STORAGE_STATS_MAX_OBJECTS
+	Total       PrefixUsage   `json:"total"`        // Whole bucket (Prefix is "")
+	Prefixes    []PrefixUsage `json:"prefixes"`     // Largest first
+}
+
+// storageStatsCollector periodically scans the bucket and keeps the latest
+// result. Safe for concurrent use.
+type storageStatsCollector struct {
+	depth      int
+	maxObjects int64
+
+	mu     sync.RWMutex
+	latest *StorageStats
+}
+
+// usagePrefix returns the grouping prefix of key for the given depth.
+func usagePrefix(key string, depth int) string {
+	parts := strings.SplitN(key, "/", depth+1)
+	if len(parts) <= depth {
+		// Fewer segments than depth: group by the object's directory.
+		if i := strings.LastIndex(key, "/"); i >= 0 {
+			return key[:i+1]
+		}
+		return key
+	}
+	return strings.Join(parts[:depth], "/") + "/"
+}
+
+// scanStorage lists the whole bucket and aggregates usage by prefix.
+func (a *App) scanStorage(ctx context.Context, c *storageStatsCollector) (*StorageStats, error) {
+	start := time.Now()
+	byPrefix := map[string]*PrefixUsage{}
+	stats := &StorageStats{Bucket: a.s3Bucket, PrefixDepth: c.depth}
+
+	for obj, err := range a.store.List(ctx, "", ListOptions{}) {
+		if err != nil {
+			return nil, err
+		}
+		if stats.Total.Objects >= c.maxObjects {
+			stats.Truncated = true
+			break
+		}
+		prefix := usagePrefix(obj.Key, c.depth)
+		u, ok := byPrefix[prefix]
+		if !ok {
+			u = &PrefixUsage{Prefix: prefix}
+			byPrefix[prefix] = u
+		}
+		u.Objects++
+		u.Bytes += obj.Size
+		stats.Total.Objects++
+		stats.Total.Bytes += obj.Size
+	}
+
+	stats.Prefixes = make([]PrefixUsage, 0, len(byPrefix))
+	for _, u := range byPrefix {
+		stats.Prefixes = append(stats.Prefixes, *u)
+	}
+	slices.SortFunc(stats.Prefixes, func(x, y PrefixUsage) int {
+		if c := cmp.Compare(y.Bytes, x.Bytes); c != 0 {
+			return c
+		}
+		return strings.Compare(x.Prefix, y.Prefix)
+	})
+	stats.GeneratedAt = Now()
+	stats.DurationMs = time.Since(start).Milliseconds()
+	return stats, nil
+}
+
+// runStorageStats scans immediately and then every interval until ctx is
+// cancelled. Failed scans keep the previous result.
+func (a *App) runStorageStats(ctx context.Context, c *storageStatsCollector, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		stats, err := a.scanStorage(ctx, c)
+		switch {
+		case err != nil && ctx.Err() != nil:
+			return
+		case err != nil:
+			f := classifyS3Error(err)
+			recordS3Error(ctx, "ListObjectsV2", f)
+			slog.Warn("storage usage scan failed", append([]any{"error", err}, f.logAttrs()...)...)
+		default:
+			c.mu.Lock()
+			c.latest = stats
+			c.mu.Unlock()
+			slog.Info("storage usage scan complete", "objects", stats.Total.Objects, "bytes", stats.Total.Bytes,
+				"prefixes", len(stats.Prefixes), "duration_ms", stats.DurationMs, "truncated", stats.Truncated)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// getStorageStats handles GET /stats/storage requests.
+// Returns the latest storage usage scan, or 503 stats_pending before the
+// first scan completes (404 when the collector is disabled).
+func (a *App) getStorageStats(w http.ResponseWriter, r *http.Request) {
+	if a.storageStats == nil {
+		http.Error(w, "storage stats disabled", http.StatusNotFound)
+		return
+	}
+	a.storageStats.mu.RLock()
+	stats := a.storageStats.latest
+	a.storageStats.mu.RUnlock()
+	if stats == nil {
+		writeRetryableError(w, http.StatusServiceUnavailable, errCodeStatsPending, "storage usage scan has not completed yet", time.Minute)
+		return
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
@@ -0,0 +1,462 @@
+// Object storage behind a ResultStore. Results, artifacts, job records,
+// indexes and every other object the service keeps go through App.store,
+// selected by STORAGE_BACKEND:
+//
+//	s3          the S3_BUCKET bucket (default)
+//	filesystem  files under STORAGE_DIR, for development and tests without AWS
+//
+// The filesystem backend maps key a/b.json to STORAGE_DIR/a/b.json, writes
+// through a temporary file and a rename so readers never see a partial
+// object, and honours conditional puts within the process. It is meant for
+// one process: several processes sharing a directory can race on
+// conditional puts. Content types are derived from the key's extension, and
+// nothing is ever archived. Features that are S3 by nature — restoring
+// archived results, lifecycle retention, multipart upload cleanup, SQS
+// extended payloads and storage migrations — keep using the S3 client.
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"iter"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// Storage backends selectable with STORAGE_BACKEND.
+const (
+	storageS3         = "s3"
+	storageFilesystem = "filesystem"
+)
+
+// deleteBatch is the most keys one DeleteObjects call takes.
+const deleteBatch = 1000
+
+// ErrObjectNotFound and ErrPreconditionFailed are returned by the
+// filesystem backend; classifyS3Error maps them like their S3 counterparts.
+var (
+	ErrObjectNotFound     = errors.New("object not found")
+	ErrPreconditionFailed = errors.New("precondition failed")
+)
+
+// ObjectInfo describes a stored object.
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ETag         string // Quoted, as S3 returns it; empty in listings from the filesystem
+	LastModified time.Time
+	ContentType  string // Empty in listings
+	StorageClass string // S3 storage class; empty on the filesystem
+	Archived     bool   // Must be restored before it can be read (retention.go)
+	Restore      string // S3 x-amz-restore header of an archived object
+}
+
+// PutOptions are the conditions and metadata of a put.
+type PutOptions struct {
+	ContentType string
+	IfNoneMatch bool   // Fail with a 412 when the key exists
+	IfMatch     string // Fail with a 412 unless the key's ETag is this
+}
+
+// ListOptions bound a listing.
+type ListOptions struct {
+	StartAfter string // List keys after this one
+	PageSize   int    // Keys fetched per request; 0 for the backend's default
+}
+
+// ResultStore is where the service keeps its objects. Errors are classified
+// with classifyS3Error whatever the backend.
+type ResultStore interface {
+	// Put writes body to key.
+	Put(ctx context.Context, key string, body []byte, opts PutOptions) error
+	// Get opens key; the caller closes the body.
+	Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error)
+	// Head describes key without reading it.
+	Head(ctx context.Context, key string) (ObjectInfo, error)
+	// List yields the objects under prefix in key order.
+	List(ctx context.Context, prefix string, opts ListOptions) iter.Seq2[ObjectInfo, error]
+	// Delete deletes keys in order and returns how many were deleted. Keys
+	// that do not exist count as deleted.
+	Delete(ctx context.Context, keys []string) (int, error)
+}
+
+// newResultStore returns the backend conf selects, writing through to the
+// STORAGE_DUAL_WRITE_FROM store when one is set (dualstore.go).
+func newResultStore(conf Config, client *s3.Client) (ResultStore, error) {
+	var store ResultStore = newS3Store(client, conf.Bucket)
+	if conf.StorageBackend == storageFilesystem {
+		fs, err := newFilesystemStore(conf.StorageDir)
+		if err != nil {
+			return nil, err
+		}
+		store = fs
+	}
+	if conf.StorageDualFrom != "" {
+		return newDualStore(store, conf.StorageDualFrom, client)
+	}
+	return store, nil
+}
+
+// onS3 reports whether objects are stored in S3, so S3-only features apply.
+// Under dual-write it is the new store that counts.
+func (a *App) onS3() bool {
+	return a.primaryS3() != nil
+}
+
+// primaryS3 returns the S3 store results are read from, or nil when that is
+// not S3.
+func (a *App) primaryS3() *s3Store {
+	store := a.store
+	if d, ok := store.(*dualStore); ok {
+		store = d.primary
+	}
+	s, _ := store.(*s3Store)
+	return s
+}
+
+// s3Store keeps objects in a bucket.
+type s3Store struct {
+	client *s3.Client
+	bucket string
+}
+
+// newS3Store returns a store for bucket.
+func newS3Store(client *s3.Client, bucket string) *s3Store {
+	return &s3Store{client: client, bucket: bucket}
+}
+
+func (s *s3Store) Put(ctx context.Context, key string, body []byte, opts PutOptions) error {
+	in := &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(body),
+	}
+	if opts.ContentType != "" {
+		in.ContentType = aws.String(opts.ContentType)
+	}
+	if opts.IfNoneMatch {
+		in.IfNoneMatch = aws.String("*")
+	}
+	if opts.IfMatch != "" {
+		in.IfMatch = aws.String(opts.IfMatch)
+	}
+	_, err := s.client.PutObject(ctx, in)
+	return err
+}
+
+func (s *s3Store) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(key)})
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	return out.Body, ObjectInfo{
+		Key:          key,
+		Size:         aws.ToInt64(out.ContentLength),
+		ETag:         aws.ToString(out.ETag),
+		LastModified: aws.ToTime(out.LastModified),
+		ContentType:  aws.ToString(out.ContentType),
+		StorageClass: string(out.StorageClass),
+	}, nil
+}
+
+func (s *s3Store) Head(ctx context.Context, key string) (ObjectInfo, error) {
+	out, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(key)})
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	archived := out.ArchiveStatus != ""
+	switch out.StorageClass {
+	case s3types.StorageClassGlacier, s3types.StorageClassDeepArchive:
+		archived = true
+	}
+	return ObjectInfo{
+		Key:          key,
+		Size:         aws.ToInt64(out.ContentLength),
+		ETag:         aws.ToString(out.ETag),
+		LastModified: aws.ToTime(out.LastModified),
+		ContentType:  aws.ToString(out.ContentType),
+		StorageClass: string(out.StorageClass),
+		Archived:     archived,
+		Restore:      aws.ToString(out.Restore),
+	}, nil
+}
+
+func (s *s3Store) List(ctx context.Context, prefix string, opts ListOptions) iter.Seq2[ObjectInfo, error] {
+	return func(yield func(ObjectInfo, error) bool) {
+		in := &s3.ListObjectsV2Input{Bucket: aws.String(s.bucket), Prefix: aws.String(prefix)}
+		if opts.StartAfter != "" {
+			in.StartAfter = aws.String(opts.StartAfter)
+		}
+		if opts.PageSize > 0 {
+			in.MaxKeys = aws.Int32(int32(opts.PageSize))
+		}
+		p := s3.NewListObjectsV2Paginator(s.client, in)
+		for p.HasMorePages() {
+			pageCtx, cancel := context.WithTimeout(ctx, awsOpTimeout)
+			page, err := p.NextPage(pageCtx)
+			cancel()
+			if err != nil {
+				yield(ObjectInfo{}, err)
+				return
+			}
+			for _, obj := range page.Contents {
+				info := ObjectInfo{
+					Key:          aws.ToString(obj.Key),
+					Size:         aws.ToInt64(obj.Size),
+					ETag:         aws.ToString(obj.ETag),
+					LastModified: aws.ToTime(obj.LastModified),
+					StorageClass: string(obj.StorageClass),
+				}
+				if !yield(info, nil) {
+					return
+				}
+			}
+		}
+	}
+}
+
+func (s *s3Store) Delete(ctx context.Context, keys []string) (int, error) {
+	deleted := 0
+	for len(keys) > 0 {
+		batch := keys[:min(len(keys), deleteBatch)]
+		keys = keys[len(batch):]
+		ids := make([]s3types.ObjectIdentifier, len(batch))
+		for i, k := range batch {
+			ids[i] = s3types.ObjectIdentifier{Key: aws.String(k)}
+		}
+		delCtx, cancel := context.WithTimeout(ctx, awsOpTimeout)
+		out, err := s.client.DeleteObjects(delCtx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(s.bucket),
+			Delete: &s3types.Delete{Objects: ids, Quiet: aws.Bool(true)},
+		})
+		cancel()
+		if err != nil {
+			return deleted, err
+		}
+		deleted += len(batch) - len(out.Errors)
+		if len(out.Errors) > 0 {
+			e := out.Errors[0]
+			return deleted, fmt.Errorf("delete %s: %s", aws.ToString(e.Key), aws.ToString(e.Message))
+		}
+	}
+	return deleted, nil
+}
+
+// fsTempPrefix marks files being written; they are never listed.
+const fsTempPrefix = ".tmp-"
+
+// fsStore keeps objects as files under a directory.
+type fsStore struct {
+	root string
+	mu   sync.Mutex // Serialises writes, so conditional puts are atomic in the process
+}
+
+// newFilesystemStore returns a store under dir, creating it if needed.
+func newFilesystemStore(dir string) (*fsStore, error) {
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, fmt.Errorf("STORAGE_DIR: %w", err)
+	}
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, fmt.Errorf("STORAGE_DIR: %w", err)
+	}
+	return &fsStore{root: root}, nil
+}
+
+// path returns the file holding key. Keys must be slash-separated relative
+// paths without . or .. elements, so none escapes the root.
+func (s *fsStore) path(key string) (string, error) {
+	if !fs.ValidPath(key) || key == "." || strings.HasPrefix(path.Base(key), fsTempPrefix) {
+		return "", fmt.Errorf("invalid object key %q", key)
+	}
+	return filepath.Join(s.root, filepath.FromSlash(key)), nil
+}
+
+// fsETag returns the ETag of body: its quoted MD5, as S3 reports for
+// single-part uploads.
+func fsETag(body []byte) string {
+	sum := md5.Sum(body)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// fsContentType returns the content type of key from its extension.
+func fsContentType(key string) string {
+	if t := mime.TypeByExtension(path.Ext(key)); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+// notFound wraps a missing file's error as ErrObjectNotFound.
+func notFound(key string, err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%s: %w", key, ErrObjectNotFound)
+	}
+	return err
+}
+
+func (s *fsStore) Put(ctx context.Context, key string, body []byte, opts PutOptions) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if opts.IfNoneMatch || opts.IfMatch != "" {
+		cur, err := os.ReadFile(p)
+		switch {
+		case err != nil && !errors.Is(err, fs.ErrNotExist):
+			return err
+		case opts.IfNoneMatch && err == nil:
+			return fmt.Errorf("%s exists: %w", key, ErrPreconditionFailed)
+		case opts.IfMatch != "" && (err != nil || fsETag(cur) != opts.IfMatch):
+			return fmt.Errorf("%s changed: %w", key, ErrPreconditionFailed)
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(p), fsTempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // No-op once renamed
+	if _, err := tmp.Write(body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+func (s *fsStore) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	info, body, err := s.read(key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	return io.NopCloser(bytes.NewReader(body)), info, nil
+}
+
+func (s *fsStore) Head(ctx context.Context, key string) (ObjectInfo, error) {
+	info, _, err := s.read(key)
+	return info, err
+}
+
+// read returns key's contents and description.
+func (s *fsStore) read(key string) (ObjectInfo, []byte, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return ObjectInfo{}, nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return ObjectInfo{}, nil, notFound(key, err)
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return ObjectInfo{}, nil, err
+	}
+	if st.IsDir() {
+		return ObjectInfo{}, nil, fmt.Errorf("%s: %w", key, ErrObjectNotFound)
+	}
+	body, err := io.ReadAll(f)
+	if err != nil {
+		return ObjectInfo{}, nil, err
+	}
+	return ObjectInfo{
+		Key:          key,
+		Size:         int64(len(body)),
+		ETag:         fsETag(body),
+		LastModified: st.ModTime().UTC(),
+		ContentType:  fsContentType(key),
+	}, body, nil
+}
+
+func (s *fsStore) List(ctx context.Context, prefix string, opts ListOptions) iter.Seq2[ObjectInfo, error] {
+	return func(yield func(ObjectInfo, error) bool) {
+		// Walk the deepest directory the prefix names, then filter: a prefix
+		// may end mid-name ("index/created/2024-").
+		dir := s.root
+		if i := strings.LastIndex(prefix, "/"); i >= 0 {
+			dir = filepath.Join(s.root, filepath.FromSlash(prefix[:i]))
+		}
+		var objs []ObjectInfo
+		err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					return nil
+				}
+				return err
+			}
+			if d.IsDir() || strings.HasPrefix(d.Name(), fsTempPrefix) {
+				return nil
+			}
+			rel, err := filepath.Rel(s.root, p)
+			if err != nil {
+				return err
+			}
+			key := filepath.ToSlash(rel)
+			if !strings.HasPrefix(key, prefix) || key <= opts.StartAfter {
+				return nil
+			}
+			st, err := d.Info()
+			if err != nil {
+				return notFound(key, err)
+			}
+			objs = append(objs, ObjectInfo{Key: key, Size: st.Size(), LastModified: st.ModTime().UTC()})
+			return ctx.Err()
+		})
+		if err != nil {
+			yield(ObjectInfo{}, err)
+			return
+		}
+		// Directory order is not key order: "a/b" sorts after "a.json".
+		slices.SortFunc(objs, func(x, y ObjectInfo) int { return strings.Compare(x.Key, y.Key) })
+		for _, obj := range objs {
+			if !yield(obj, nil) {
+				return
+			}
+		}
+	}
+}
+
+func (s *fsStore) Delete(ctx context.Context, keys []string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, key := range keys {
+		p, err := s.path(key)
+		if err != nil {
+			return i, err
+		}
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return i, err
+		}
+		// Prune directories left empty, so listings stay cheap; Remove
+		// fails on the first one that is not.
+		for dir := filepath.Dir(p); dir != s.root; dir = filepath.Dir(dir) {
+			if os.Remove(dir) != nil {
+				break
+			}
+		}
+	}
+	return len(keys), nil
+}
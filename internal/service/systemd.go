@@ -0,0 +1,163 @@
+// systemd integration for bare-metal and VM deployments. Three parts of the
+// protocol are supported, each a no-op when the process is not started by
+// systemd:
+//
+//   - Socket activation: sockets passed in LISTEN_FDS (a .socket unit) are
+//     served instead of opening LISTEN_ADDRS. To add TLS, or to serve only
+//     some of them, list them in LISTEN_ADDRS as systemd://<FileDescriptorName>
+//     with the usual listener options.
+//   - Readiness: READY=1 is sent once every listener is serving, so units
+//     with Type=notify start dependents only when the service can take
+//     requests. STATUS= mirrors /readyz (including storage degradation) and
+//     STOPPING=1 is sent when shutdown begins.
+//   - Watchdog: with WatchdogSec= set, WATCHDOG=1 is sent at half the
+//     interval while the process is healthy — the AWS clients exist and, in
+//     worker processes, the worker loop has made progress within
+//     workerStallTimeout. A stalled worker stops the pings and systemd
+//     restarts the service.
+package service
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sdListenFDsStart is the first file descriptor systemd passes.
+const sdListenFDsStart = 3
+
+// systemdListeners returns the sockets passed by systemd socket activation,
+// by FileDescriptorName, or nil when there are none. The LISTEN_* variables
+// are cleared so child processes do not inherit them.
+func systemdListeners() (map[string][]net.Listener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	activated := map[string][]net.Listener{}
+	for i := range n {
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(sdListenFDsStart+i), name)
+		ln, err := net.FileListener(f)
+		f.Close() // FileListener holds its own duplicate
+		if err != nil {
+			return nil, fmt.Errorf("activated socket %d (%s): %w", sdListenFDsStart+i, name, err)
+		}
+		activated[name] = append(activated[name], ln)
+	}
+	return activated, nil
+}
+
+// sdNotify sends state to the systemd notification socket. It is a no-op
+// without NOTIFY_SOCKET.
+func sdNotify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	if path[0] == '@' {
+		path = "\x00" + path[1:] // abstract namespace
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// sdWatchdogInterval returns the watchdog timeout systemd expects pings
+// within, or 0 when the watchdog is not enabled for this process.
+func sdWatchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// readinessStatus is the /readyz verdict as a systemd STATUS line.
+func (a *App) readinessStatus() string {
+	switch {
+	case a.sqsClient == nil || a.s3Client == nil:
+		return "not ready"
+	case a.draining.Load():
+		return "draining"
+	case a.storageHealth.degraded():
+		return "ready (storage degraded)"
+	}
+	return "ready"
+}
+
+// healthy reports whether the watchdog should be fed.
+func (a *App) healthy() bool {
+	if a.sqsClient == nil || a.s3Client == nil {
+		return false
+	}
+	if beat := a.workerBeat.Load(); beat != 0 && time.Since(time.Unix(0, beat)) > a.workerStallTimeout() {
+		return false
+	}
+	return true
+}
+
+// workerStallTimeout is how long the worker loop may go without progress: a
+// long poll, one processing attempt and the delete, with slack.
+func (a *App) workerStallTimeout() time.Duration {
+	return 2 * (20*time.Second + a.jobTimeout + awsOpTimeout)
+}
+
+// notifyReady reports readiness to systemd and, when the watchdog is on,
+// feeds it until ctx is cancelled.
+func (a *App) notifyReady(ctx context.Context) {
+	if err := sdNotify("READY=1\nSTATUS=" + a.readinessStatus()); err != nil {
+		slog.Warn("sd_notify READY failed", "error", err)
+	}
+	interval := sdWatchdogInterval()
+	if interval <= 0 {
+		return
+	}
+	slog.Info("systemd watchdog enabled", "timeout", interval)
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	status := ""
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if !a.healthy() {
+			slog.Warn("unhealthy, withholding systemd watchdog ping")
+			continue
+		}
+		state := "WATCHDOG=1"
+		if s := a.readinessStatus(); s != status {
+			status = s
+			state += "\nSTATUS=" + s
+		}
+		if err := sdNotify(state); err != nil {
+			slog.Warn("sd_notify WATCHDOG failed", "error", err)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+// Latency-based trace sampling. With TRACE_SAMPLE_RATE set, traces are kept
+// at that baseline probability, except that a job's worker-side trace — the
+// "<queue> process" consumer span and everything under it — is always kept
+// when the delivery was slow:
+//
+//	TRACE_SLOW_PROCESSING    the delivery took longer than this to process
+//	TRACE_SLOW_QUEUE_WAIT    the message waited longer than this in the queue
+//	                         (since it was first sent, so retries count)
+//
+// or failed. Deciding that needs the whole delivery, so its spans are
+// recorded whatever the sampling flag the envelope carried, held in memory
+// until the consumer span ends, then exported or dropped together. Other
+// spans — API requests, the scheduler — are sampled when they start, at the
+// baseline rate and following a sampled parent. The baseline is decided on
+// the trace ID, so a job whose API request was sampled keeps its worker side
+// too; for a slow job whose request was not, only the worker side is in the
+// tracing backend.
+//
+// Without TRACE_SAMPLE_RATE the SDK's own sampling applies (OTEL_TRACES_SAMPLER,
+// by default every trace), and nothing is held back.
+package service
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// attrQueueWait is the consumer span attribute with the message's time in
+// the queue, for TRACE_SLOW_QUEUE_WAIT.
+const attrQueueWait = "job.queue_wait_ms"
+
+// tailMaxSpans bounds the spans held for one delivery; later ones are
+// dropped, whatever the decision.
+const tailMaxSpans = 2048
+
+// Tail sampling decisions, in the traces.tail_sampled metric.
+const (
+	tailKeptSlowProcessing = "slow_processing"
+	tailKeptSlowQueueWait  = "slow_queue_wait"
+	tailKeptError          = "error"
+	tailKeptBaseline       = "baseline"
+	tailDropped            = "dropped"
+)
+
+// tailSampling is the sampling configured by the TRACE_* variables.
+type tailSampling struct {
+	rate           float64       // TRACE_SAMPLE_RATE: baseline probability
+	slowProcessing time.Duration // TRACE_SLOW_PROCESSING
+	slowQueueWait  time.Duration // TRACE_SLOW_QUEUE_WAIT
+	baseline       sdktrace.Sampler
+}
+
+// newTailSampling returns the sampling configured by TRACE_SAMPLE_RATE and
+// the thresholds, or nil when TRACE_SAMPLE_RATE is unset.
+func newTailSampling() (*tailSampling, error) {
+	raw := getenv("TRACE_SAMPLE_RATE")
+	if raw == "" {
+		return nil, nil
+	}
+	rate, err := strconv.ParseFloat(raw, 64)
+	if err != nil || rate < 0 || rate > 1 {
+		return nil, fmt.Errorf("TRACE_SAMPLE_RATE must be a number from 0 to 1, got %q", raw)
+	}
+	ts := &tailSampling{
+		rate:           rate,
+		slowProcessing: envDuration("TRACE_SLOW_PROCESSING", 10*time.Second),
+		slowQueueWait:  envDuration("TRACE_SLOW_QUEUE_WAIT", time.Minute),
+		baseline:       sdktrace.TraceIDRatioBased(rate),
+	}
+	if ts.slowProcessing <= 0 || ts.slowQueueWait <= 0 {
+		return nil, fmt.Errorf("TRACE_SLOW_PROCESSING and TRACE_SLOW_QUEUE_WAIT must be positive")
+	}
+	return ts, nil
+}
+
+// sampler returns the head sampler: deliveries are always recorded, for the
+// tail decision; everything else at the baseline.
+func (ts *tailSampling) sampler() sdktrace.Sampler {
+	return &deliverySampler{other: sdktrace.ParentBased(ts.baseline)}
+}
+
+// processor returns a span processor holding deliveries' spans for the tail
+// decision, passing what it keeps to next.
+func (ts *tailSampling) processor(next sdktrace.SpanProcessor) sdktrace.SpanProcessor {
+	return &tailProcessor{
+		sampling:   ts,
+		next:       next,
+		deliveries: map[trace.SpanID]*tailDelivery{},
+		owner:      map[trace.SpanID]trace.SpanID{},
+	}
+}
+
+// decide returns whether to keep the delivery whose consumer span is root,
+// and why.
+func (ts *tailSampling) decide(root sdktrace.ReadOnlySpan) string {
+	if root.EndTime().Sub(root.StartTime()) > ts.slowProcessing {
+		return tailKeptSlowProcessing
+	}
+	for _, kv := range root.Attributes() {
+		if kv.Key == attrQueueWait && time.Duration(kv.Value.AsInt64())*time.Millisecond > ts.slowQueueWait {
+			return tailKeptSlowQueueWait
+		}
+	}
+	if root.Status().Code == codes.Error {
+		return tailKeptError
+	}
+	res := ts.baseline.ShouldSample(sdktrace.SamplingParameters{TraceID: root.SpanContext().TraceID()})
+	if res.Decision == sdktrace.RecordAndSample {
+		return tailKeptBaseline
+	}
+	return tailDropped
+}
+
+// deliverySampler records every consumer span, leaving the decision to the
+// tailProcessor, and samples other spans with other.
+type deliverySampler struct{ other sdktrace.Sampler }
+
+func (s *deliverySampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	if p.Kind == trace.SpanKindConsumer {
+		return sdktrace.SamplingResult{
+			Decision:   sdktrace.RecordAndSample,
+			Tracestate: trace.SpanContextFromContext(p.ParentContext).TraceState(),
+		}
+	}
+	return s.other.ShouldSample(p)
+}
+
+func (s *deliverySampler) Description() string {
+	return "DeliverySampler{" + s.other.Description() + "}"
+}
+
+// tailDelivery is the spans of one delivery, held until its consumer span
+// ends.
+type tailDelivery struct {
+	spans   []sdktrace.ReadOnlySpan // Ended, waiting for the decision
+	open    int                     // Started and not yet ended, the consumer span included
+	decided bool
+	keep    bool
+}
+
+// tailProcessor holds the spans of each delivery until its consumer span
+// ends, then passes them all to next or drops them. Other spans go straight
+// through.
+type tailProcessor struct {
+	sampling *tailSampling
+	next     sdktrace.SpanProcessor
+
+	mu         sync.Mutex
+	deliveries map[trace.SpanID]*tailDelivery // By consumer span
+	owner      map[trace.SpanID]trace.SpanID  // Open spans of deliveries → their consumer span
+}
+
+func (p *tailProcessor) OnStart(parent context.Context, s sdktrace.ReadWriteSpan) {
+	id := s.SpanContext().SpanID()
+	p.mu.Lock()
+	if s.SpanKind() == trace.SpanKindConsumer {
+		p.deliveries[id] = &tailDelivery{open: 1}
+		p.owner[id] = id
+	} else if root, ok := p.owner[s.Parent().SpanID()]; ok && s.Parent().TraceID() == s.SpanContext().TraceID() {
+		p.deliveries[root].open++
+		p.owner[id] = root
+	}
+	p.mu.Unlock()
+	p.next.OnStart(parent, s)
+}
+
+func (p *tailProcessor) OnEnd(s sdktrace.ReadOnlySpan) {
+	id := s.SpanContext().SpanID()
+	p.mu.Lock()
+	root, ok := p.owner[id]
+	if !ok {
+		p.mu.Unlock()
+		p.next.OnEnd(s)
+		return
+	}
+	delete(p.owner, id)
+	d := p.deliveries[root]
+	d.open--
+	var export []sdktrace.ReadOnlySpan
+	switch {
+	case d.decided:
+		// Outlived its consumer span, e.g. detached work.
+		if d.keep {
+			export = []sdktrace.ReadOnlySpan{s}
+		}
+	case id == root:
+		decision := p.sampling.decide(s)
+		d.decided, d.keep = true, decision != tailDropped
+		if d.keep {
+			export = append(d.spans, s)
+		}
+		d.spans = nil
+		tailSampled.Add(context.Background(), 1, metric.WithAttributes(attribute.String("decision", decision)))
+	case len(d.spans) < tailMaxSpans:
+		d.spans = append(d.spans, s)
+	}
+	if d.decided && d.open == 0 {
+		delete(p.deliveries, root)
+	}
+	p.mu.Unlock()
+	for _, s := range export {
+		p.next.OnEnd(s)
+	}
+}
+
+// Shutdown drops the deliveries still open and shuts next down.
+func (p *tailProcessor) Shutdown(ctx context.Context) error {
+	return p.next.Shutdown(ctx)
+}
+
+// ForceFlush flushes next; deliveries still open are not decided yet.
+func (p *tailProcessor) ForceFlush(ctx context.Context) error {
+	return p.next.ForceFlush(ctx)
+}
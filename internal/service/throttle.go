@@ -0,0 +1,228 @@
+// Intake throttling on resource watermarks. With INTAKE_THROTTLE=true the
+// process samples its own CPU use (user and system time over the interval,
+// as a share of GOMAXPROCS cores) and resident memory every THROTTLE_INTERVAL
+// and compares them with high and low watermarks:
+//
+//	THROTTLE_CPU_HIGH / THROTTLE_CPU_LOW  share of GOMAXPROCS (0.85 / 0.6)
+//	THROTTLE_RSS_HIGH / THROTTLE_RSS_LOW  bytes, e.g. 1536MiB; by default 85%
+//	                                      and 70% of the cgroup memory limit
+//	                                      (low: 80% of an explicit high)
+//
+// While either signal is over its high watermark the throttle engages and
+// halves the worker's effective concurrency every interval, down to
+// THROTTLE_MIN_CONCURRENCY: the worker then receives only as many messages as
+// it has free slots under the reduced limit. Processors run inline in API
+// requests (POST /jobs/validate?dry_run=true, POST
+// /admin/processors/{type}/test) are refused with a retryable 503
+// "overloaded". Once both signals are under their low watermarks the throttle
+// releases and the full WORKER_CONCURRENCY applies again. The signals, the
+// effective concurrency and every refused request are exported as metrics.
+package service
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/metrics"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+const (
+	// throttleRetryAfter is the Retry-After hint on refused inline requests.
+	throttleRetryAfter = 5 * time.Second
+	// throttleWait bounds how long a throttled worker waits for a free slot
+	// before checking the limit again.
+	throttleWait = time.Second
+	// procStatm reports the process's memory use in pages on Linux.
+	procStatm = "/proc/self/statm"
+)
+
+// throttleConfig holds the watermarks.
+type throttleConfig struct {
+	interval    time.Duration // Sampling period
+	cpuHigh     float64       // CPU share of GOMAXPROCS that engages the throttle
+	cpuLow      float64       // CPU share under which it may release
+	rssHigh     int64         // Resident bytes that engage the throttle; 0 disables
+	rssLow      int64         // Resident bytes under which it may release
+	minWorkers  int           // Floor of the reduced concurrency
+	fullWorkers int           // WORKER_CONCURRENCY
+}
+
+// newThrottleConfig returns the settings from the THROTTLE_* variables.
+func newThrottleConfig(workers int) (throttleConfig, error) {
+	c := throttleConfig{
+		interval:    envDuration("THROTTLE_INTERVAL", 5*time.Second),
+		cpuHigh:     envFloat("THROTTLE_CPU_HIGH", 0.85),
+		cpuLow:      envFloat("THROTTLE_CPU_LOW", 0.6),
+		minWorkers:  min(max(envInt("THROTTLE_MIN_CONCURRENCY", 1), 1), workers),
+		fullWorkers: workers,
+	}
+	if c.interval <= 0 {
+		return throttleConfig{}, fmt.Errorf("THROTTLE_INTERVAL must be positive")
+	}
+	if c.cpuHigh <= 0 || c.cpuLow < 0 || c.cpuLow > c.cpuHigh {
+		return throttleConfig{}, fmt.Errorf("THROTTLE_CPU_LOW must be between 0 and THROTTLE_CPU_HIGH, which must be positive")
+	}
+
+	high, low := getenv("THROTTLE_RSS_HIGH"), getenv("THROTTLE_RSS_LOW")
+	if high == "" {
+		limit, err := cgroupMemoryLimit()
+		if err != nil {
+			slog.Info("no cgroup memory limit; memory watermark disabled unless THROTTLE_RSS_HIGH is set")
+			return c, nil
+		}
+		c.rssHigh, c.rssLow = limit/100*85, limit/100*70
+	} else {
+		n, err := parseMemoryLimit(high)
+		if err != nil {
+			return throttleConfig{}, fmt.Errorf("THROTTLE_RSS_HIGH: %w", err)
+		}
+		c.rssHigh, c.rssLow = n, n/100*80
+	}
+	if low != "" {
+		n, err := parseMemoryLimit(low)
+		if err != nil {
+			return throttleConfig{}, fmt.Errorf("THROTTLE_RSS_LOW: %w", err)
+		}
+		c.rssLow = n
+	}
+	if c.rssLow > c.rssHigh {
+		return throttleConfig{}, fmt.Errorf("THROTTLE_RSS_LOW must not exceed THROTTLE_RSS_HIGH")
+	}
+	return c, nil
+}
+
+// intakeThrottle limits how much work the process takes on while its CPU or
+// memory use is over the watermarks.
+type intakeThrottle struct {
+	cfg     throttleConfig
+	engaged atomic.Bool  // Over a high watermark and not yet under both low ones
+	workers atomic.Int32 // Effective worker concurrency
+
+	lastCPU  time.Duration // Process CPU time at the previous sample; loop only
+	lastWall time.Time     // When it was taken
+}
+
+// newIntakeThrottle returns a throttle that starts released.
+func newIntakeThrottle(cfg throttleConfig) *intakeThrottle {
+	t := &intakeThrottle{cfg: cfg, lastCPU: processCPUTime(), lastWall: time.Now()}
+	t.workers.Store(int32(cfg.fullWorkers))
+	return t
+}
+
+// concurrency returns how many messages the worker may process at once. A
+// nil throttle allows all of workers.
+func (t *intakeThrottle) concurrency(workers int) int {
+	if t == nil {
+		return workers
+	}
+	return min(int(t.workers.Load()), workers)
+}
+
+// refuseInline writes a 503 and returns true when the throttle is engaged,
+// so the caller must not run a processor in the request. A nil throttle
+// refuses nothing.
+func (t *intakeThrottle) refuseInline(w http.ResponseWriter, r *http.Request, endpoint string) bool {
+	if t == nil || !t.engaged.Load() {
+		return false
+	}
+	throttleRejections.Add(r.Context(), 1, metric.WithAttributes(attribute.String("endpoint", endpoint)))
+	writeRetryableError(w, http.StatusServiceUnavailable, errCodeOverloaded,
+		"resource use is over the intake watermarks; inline processing is paused", throttleRetryAfter)
+	return true
+}
+
+// evaluate takes one sample and engages, tightens or releases the throttle.
+func (t *intakeThrottle) evaluate(ctx context.Context) {
+	now, cpuTime := time.Now(), processCPUTime()
+	var cpu float64
+	if wall := now.Sub(t.lastWall); wall > 0 {
+		cpu = float64(cpuTime-t.lastCPU) / float64(wall) / float64(runtime.GOMAXPROCS(0))
+	}
+	t.lastCPU, t.lastWall = cpuTime, now
+	rss := residentBytes()
+
+	overCPU := cpu > t.cfg.cpuHigh
+	overRSS := t.cfg.rssHigh > 0 && rss > t.cfg.rssHigh
+	under := cpu < t.cfg.cpuLow && (t.cfg.rssHigh == 0 || rss < t.cfg.rssLow)
+
+	prev, workers := t.engaged.Load(), t.workers.Load()
+	engaged := prev
+	switch {
+	case overCPU || overRSS:
+		engaged = true
+		workers = max(workers/2, int32(t.cfg.minWorkers))
+	case prev && under:
+		engaged = false
+		workers = int32(t.cfg.fullWorkers)
+	}
+	switch {
+	case engaged && (!prev || workers != t.workers.Load()):
+		reason := "cpu"
+		if overRSS {
+			reason = "memory"
+		}
+		slog.Warn("intake throttled", "reason", reason, "worker_concurrency", workers, "cpu", cpu, "rss_bytes", rss)
+	case prev && !engaged:
+		slog.Info("intake throttle released", "worker_concurrency", workers, "cpu", cpu, "rss_bytes", rss)
+	}
+	t.engaged.Store(engaged)
+	t.workers.Store(workers)
+
+	state := int64(0)
+	if engaged {
+		state = 1
+	}
+	throttleEngaged.Record(ctx, state)
+	throttleWorkers.Record(ctx, int64(workers))
+	throttleCPU.Record(ctx, cpu)
+	throttleRSS.Record(ctx, rss)
+}
+
+// loop samples every interval until ctx is cancelled.
+func (t *intakeThrottle) loop(ctx context.Context) {
+	ticker := time.NewTicker(t.cfg.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			t.evaluate(ctx)
+		}
+	}
+}
+
+// processCPUTime returns the user and system CPU time the process has used.
+func processCPUTime() time.Duration {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return 0
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
+
+// residentBytes returns the process's resident memory from /proc, or the
+// memory mapped by the Go runtime where /proc is unavailable.
+func residentBytes() int64 {
+	if b, err := os.ReadFile(procStatm); err == nil {
+		if fields := strings.Fields(string(b)); len(fields) > 1 {
+			if pages, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+				return pages * int64(os.Getpagesize())
+			}
+		}
+	}
+	sample := []metrics.Sample{{Name: "/memory/classes/total:bytes"}}
+	metrics.Read(sample)
+	return int64(sample[0].Value.Uint64())
+}
@@ -0,0 +1,249 @@
+// Time-windowed throughput reporting. Job events (enqueued, completed, failed)
+// are counted into per-minute buckets covering the last 24h, and a background
+// sampler records SQS queue depth each minute, so GET /admin/throughput can
+// report rates and backlog change over any window up to a day. Counts are for
+// this instance only; aggregate across replicas in the metrics backend.
+package service
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// throughputBuckets is the retained history, one bucket per minute.
+	throughputBuckets = 24 * 60
+	// minThroughputWindow and maxThroughputWindow bound ?window=.
+	minThroughputWindow = time.Minute
+	maxThroughputWindow = throughputBuckets * time.Minute
+)
+
+// jobEvent is a job lifecycle event, counted by the throughput tracker and
+// published on the event broker.
+type jobEvent int
+
+const (
+	eventEnqueued jobEvent = iota
+	eventCompleted
+	eventFailed
+)
+
+// jobEventNames are the wire names of job events.
+var jobEventNames = [...]string{eventEnqueued: "enqueued", eventCompleted: "completed", eventFailed: "failed"}
+
+func (e jobEvent) String() string {
+	if int(e) < len(jobEventNames) {
+		return jobEventNames[e]
+	}
+	return "unknown"
+}
+
+// MarshalText encodes the event by name, so JobEvent serialises readably.
+func (e jobEvent) MarshalText() ([]byte, error) {
+	return []byte(e.String()), nil
+}
+
+// throughputBucket holds one minute of counts and the last backlog sample.
+type throughputBucket struct {
+	minute    int64 // Unix minute this bucket currently represents
+	enqueued  int64
+	completed int64
+	failed    int64
+	backlog   int64 // approximate queue depth sampled during this minute
+	sampled   bool  // backlog holds a sample
+}
+
+// throughputTracker is a ring of per-minute buckets. Safe for concurrent use.
+type throughputTracker struct {
+	mu      sync.Mutex
+	started time.Time
+	buckets [throughputBuckets]throughputBucket
+}
+
+// newThroughputTracker returns an empty tracker starting now.
+func newThroughputTracker() *throughputTracker {
+	return &throughputTracker{started: time.Now()}
+}
+
+// bucket returns the bucket for minute, resetting it if it holds stale data.
+// Caller holds t.mu.
+func (t *throughputTracker) bucket(minute int64) *throughputBucket {
+	b := &t.buckets[minute%throughputBuckets]
+	if b.minute != minute {
+		*b = throughputBucket{minute: minute}
+	}
+	return b
+}
+
+// record counts one event in the current minute.
+func (t *throughputTracker) record(ev jobEvent) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b := t.bucket(time.Now().Unix() / 60)
+	switch ev {
+	case eventEnqueued:
+		b.enqueued++
+	case eventCompleted:
+		b.completed++
+	case eventFailed:
+		b.failed++
+	}
+}
+
+// recordBacklog stores a queue-depth sample in the current minute.
+func (t *throughputTracker) recordBacklog(depth int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b := t.bucket(time.Now().Unix() / 60)
+	b.backlog, b.sampled = depth, true
+}
+
+// ThroughputReport is the GET /admin/throughput response body.
+type ThroughputReport struct {
+	Window          string    `json:"window"`               // Requested window, e.g. "1h0m0s"
+	CoveredSeconds  float64   `json:"covered_seconds"`      // Window actually observed (capped by uptime)
+	Since           Timestamp `json:"since"`                // Start of the covered window
+	Scope           string    `json:"scope"`                // Always "instance": counts are per replica
+	Enqueued        int64     `json:"enqueued"`             // Jobs accepted by POST /jobs
+	Completed       int64     `json:"completed"`            // Jobs processed successfully by the worker
+	Failed          int64     `json:"failed"`               // Worker processing failures
+	EnqueueRate     float64   `json:"enqueue_rate_per_sec"` // Enqueued / covered seconds
+	CompletionRate  float64   `json:"completion_rate_per_sec"`
+	FailureRate     float64   `json:"failure_rate_per_sec"`
+	FailureRatio    float64   `json:"failure_ratio"`           // Failed / (completed + failed); 0 when none
+	BacklogStart    *int64    `json:"backlog_start,omitempty"` // First queue-depth sample in the window
+	BacklogEnd      *int64    `json:"backlog_end,omitempty"`   // Latest queue-depth sample
+	BacklogDelta    *int64    `json:"backlog_delta,omitempty"` // BacklogEnd - BacklogStart
+	BacklogSampling string    `json:"backlog_sampling"`        // How backlog was sampled
+}
+
+// report summarises the last window.
+func (t *throughputTracker) report(window time.Duration) ThroughputReport {
+	now := time.Now()
+	covered := window
+	if up := now.Sub(t.started); up < covered {
+		covered = up
+	}
+	nowMinute := now.Unix() / 60
+	firstMinute := nowMinute - int64(window/time.Minute) + 1
+
+	rep := ThroughputReport{
+		Window:          window.String(),
+		CoveredSeconds:  covered.Seconds(),
+		Since:           Timestamp{Time: now.Add(-covered).UTC()},
+		Scope:           "instance",
+		BacklogSampling: "SQS ApproximateNumberOfMessages, once per minute",
+	}
+	t.mu.Lock()
+	for m := firstMinute; m <= nowMinute; m++ {
+		b := &t.buckets[m%throughputBuckets]
+		if b.minute != m {
+			continue
+		}
+		rep.Enqueued += b.enqueued
+		rep.Completed += b.completed
+		rep.Failed += b.failed
+		if b.sampled {
+			depth := b.backlog
+			if rep.BacklogStart == nil {
+				rep.BacklogStart = &depth
+			}
+			rep.BacklogEnd = &depth
+		}
+	}
+	t.mu.Unlock()
+
+	if secs := covered.Seconds(); secs > 0 {
+		rep.EnqueueRate = float64(rep.Enqueued) / secs
+		rep.CompletionRate = float64(rep.Completed) / secs
+		rep.FailureRate = float64(rep.Failed) / secs
+	}
+	if done := rep.Completed + rep.Failed; done > 0 {
+		rep.FailureRatio = float64(rep.Failed) / float64(done)
+	}
+	if rep.BacklogStart != nil {
+		delta := *rep.BacklogEnd - *rep.BacklogStart
+		rep.BacklogDelta = &delta
+	}
+	return rep
+}
+
+// sampleBacklog records the queue depth every minute until ctx is cancelled.
+func (a *App) sampleBacklog(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		depth, err := a.queueDepth(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			slog.Warn("failed to sample queue depth", "error", err)
+		} else {
+			a.throughput.recordBacklog(depth)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// queueDepth returns the approximate number of visible messages in the queue.
+func (a *App) queueDepth(ctx context.Context) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, awsOpTimeout)
+	defer cancel()
+	d, err := a.queue.Depth(ctx, a.sqsURL)
+	if err != nil {
+		return 0, err
+	}
+	return d.Visible, nil
+}
+
+// getThroughput handles GET /admin/throughput?window=1h requests.
+// Returns JSON by default, or Prometheus text exposition format with
+// ?format=prometheus (or an Accept header preferring text/plain).
+func (a *App) getThroughput(w http.ResponseWriter, r *http.Request) {
+	window := time.Hour
+	if v := r.URL.Query().Get("window"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < minThroughputWindow || d > maxThroughputWindow {
+			http.Error(w, fmt.Sprintf("window must be a duration between %s and %s", minThroughputWindow, maxThroughputWindow), http.StatusBadRequest)
+			return
+		}
+		window = d.Truncate(time.Minute)
+	}
+	rep := a.throughput.report(window)
+
+	if r.URL.Query().Get("format") == "prometheus" || strings.HasPrefix(r.Header.Get("Accept"), "text/plain") {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeThroughputPrometheus(w, rep)
+		return
+	}
+	writeJSON(w, http.StatusOK, rep)
+}
+
+// writeThroughputPrometheus renders rep as Prometheus gauges labelled with the
+// window, for scraping by a Prometheus-compatible agent.
+func writeThroughputPrometheus(w http.ResponseWriter, rep ThroughputReport) {
+	gauge := func(name, help string, v float64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s{window=%q,scope=%q} %g\n",
+			name, help, name, name, rep.Window, rep.Scope, v)
+	}
+	gauge("job_throughput_enqueue_rate", "Jobs enqueued per second over the window.", rep.EnqueueRate)
+	gauge("job_throughput_completion_rate", "Jobs completed per second over the window.", rep.CompletionRate)
+	gauge("job_throughput_failure_rate", "Job failures per second over the window.", rep.FailureRate)
+	gauge("job_throughput_failure_ratio", "Failed / (completed + failed) over the window.", rep.FailureRatio)
+	gauge("job_throughput_enqueued", "Jobs enqueued in the window.", float64(rep.Enqueued))
+	gauge("job_throughput_completed", "Jobs completed in the window.", float64(rep.Completed))
+	gauge("job_throughput_failed", "Job failures in the window.", float64(rep.Failed))
+	if rep.BacklogDelta != nil {
+		gauge("job_throughput_backlog_delta", "Change in approximate queue depth over the window.", float64(*rep.BacklogDelta))
+	}
+}
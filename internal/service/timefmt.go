@@ -0,0 +1,122 @@
+// Timestamp handling for API responses. Everything is stored and emitted in UTC
+// as RFC 3339; callers may additionally ask for a localized rendering via
+// ?tz=<IANA zone> and Accept-Language, which is purely presentational and never
+// replaces the canonical UTC value.
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // embed the zone database; the distroless image ships none
+
+	"go-microservice/pkg/contract"
+)
+
+// Timestamp is a point in time that always serialises as RFC 3339 in UTC; the
+// type is shared with the queue contract.
+type Timestamp = contract.Timestamp
+
+// Now returns the current time as a UTC Timestamp.
+func Now() Timestamp { return contract.Now() }
+
+// localeLayouts maps Accept-Language tags (full tag first, then primary
+// language) to a display layout. Only numeric layouts are used outside English
+// because Go formats month and day names in English only.
+var localeLayouts = map[string]string{
+	"en":    "Jan 2, 2006 3:04:05 PM MST",
+	"en-us": "Jan 2, 2006 3:04:05 PM MST",
+	"en-gb": "2 Jan 2006 15:04:05 MST",
+	"de":    "02.01.2006 15:04:05 MST",
+	"fr":    "02/01/2006 15:04:05 MST",
+	"es":    "02/01/2006 15:04:05 MST",
+	"it":    "02/01/2006 15:04:05 MST",
+	"nl":    "02-01-2006 15:04:05 MST",
+	"ja":    "2006/01/02 15:04:05 MST",
+	"zh":    "2006-01-02 15:04:05 MST",
+	"ko":    "2006. 01. 02. 15:04:05 MST",
+	"th":    "02/01/2006 15:04:05 MST",
+}
+
+// localizer renders timestamps for a single request. The zero value (no tz,
+// no recognised locale) renders nothing, so responses stay canonical-only.
+type localizer struct {
+	loc    *time.Location // requested zone; nil when ?tz= was not given
+	locale string         // matched localeLayouts key; "" when none matched
+}
+
+// newLocalizer builds a localizer from ?tz= and Accept-Language. An unknown
+// zone is a client error; an unrecognised language simply falls back to the
+// RFC 3339 rendering in the requested zone.
+func newLocalizer(r *http.Request) (localizer, error) {
+	var l localizer
+	if tz := r.URL.Query().Get("tz"); tz != "" {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			return localizer{}, fmt.Errorf("unknown time zone %q", tz)
+		}
+		l.loc = loc
+	}
+	l.locale = matchLocale(r.Header.Get("Accept-Language"))
+	return l, nil
+}
+
+// enabled reports whether the caller asked for any localized rendering.
+func (l localizer) enabled() bool { return l.loc != nil || l.locale != "" }
+
+// zone returns the requested zone name, defaulting to UTC.
+func (l localizer) zone() string {
+	if l.loc == nil {
+		return "UTC"
+	}
+	return l.loc.String()
+}
+
+// format renders t in the requested zone using the matched locale layout, or
+// RFC 3339 in that zone when no locale matched. Returns "" for the zero time.
+func (l localizer) format(t Timestamp) string {
+	if t.IsZero() || !l.enabled() {
+		return ""
+	}
+	loc := l.loc
+	if loc == nil {
+		loc = time.UTC
+	}
+	layout := time.RFC3339
+	if l.locale != "" {
+		layout = localeLayouts[l.locale]
+	}
+	return t.In(loc).Format(layout)
+}
+
+// matchLocale picks the highest-weighted Accept-Language entry that has a
+// layout in localeLayouts, trying the full tag before its primary language.
+// Returns "" when nothing matches (including "*").
+func matchLocale(header string) string {
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		if q <= bestQ {
+			continue
+		}
+		primary, _, _ := strings.Cut(tag, "-")
+		for _, candidate := range []string{tag, primary} {
+			if _, ok := localeLayouts[candidate]; ok {
+				best, bestQ = candidate, q
+				break
+			}
+		}
+	}
+	return best
+}
@@ -0,0 +1,151 @@
+// Timeouts of AWS calls. Every SDK call is bounded, retries included, by its
+// operation's timeout, so a hung dependency fails the call instead of holding
+// a request or the worker:
+//
+//	AWS_OP_TIMEOUT   every operation's timeout (default 10s)
+//	AWS_OP_TIMEOUTS  per-operation overrides by API name, e.g.
+//	                 PutObject=30s,GetObject=5s,DeleteMessage=3s
+//
+// ReceiveMessage, a long poll of 20 seconds, is bounded only by the worker's
+// shutdown unless AWS_OP_TIMEOUTS names it, and then must allow more than the
+// poll. A call cut off by its timeout fails with context.DeadlineExceeded and
+// counts in aws.timeouts{operation}.
+//
+// Call sites bound each step — a call, or the few calls of one page or
+// lookup — by awsOpTimeout, the longest of these, on a context derived from
+// the request (r.Context()) or the message being processed, so a client that
+// goes away or a worker shutting down cancels the calls made for it too.
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go/middleware"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// defaultAWSOpTimeout is AWS_OP_TIMEOUT when unset.
+const defaultAWSOpTimeout = 10 * time.Second
+
+// awsOpTimeout bounds each step of AWS calls at its call site so a hung
+// dependency cannot block a request or the worker indefinitely: the longest
+// operation timeout, set at startup (awsTimeouts.apply).
+var awsOpTimeout = defaultAWSOpTimeout
+
+// awsTimeouts is the operation timeouts of the AWS clients.
+type awsTimeouts struct {
+	standard time.Duration            // AWS_OP_TIMEOUT
+	ops      map[string]time.Duration // AWS_OP_TIMEOUTS, by operation name
+}
+
+// newAWSTimeouts returns the timeouts configured by AWS_OP_TIMEOUT and
+// AWS_OP_TIMEOUTS.
+func newAWSTimeouts() (*awsTimeouts, error) {
+	t := &awsTimeouts{
+		standard: envDuration("AWS_OP_TIMEOUT", defaultAWSOpTimeout),
+		ops:      map[string]time.Duration{},
+	}
+	if t.standard <= 0 {
+		return nil, fmt.Errorf("AWS_OP_TIMEOUT must be positive")
+	}
+	for _, entry := range strings.Split(getenv("AWS_OP_TIMEOUTS"), ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		op, raw, ok := strings.Cut(entry, "=")
+		d, err := time.ParseDuration(strings.TrimSpace(raw))
+		if op = strings.TrimSpace(op); !ok || op == "" || err != nil || d <= 0 {
+			return nil, fmt.Errorf("AWS_OP_TIMEOUTS entry %q must be Operation=duration with a positive duration", entry)
+		}
+		t.ops[op] = d
+	}
+	if d, ok := t.ops["ReceiveMessage"]; ok && d <= 20*time.Second {
+		return nil, fmt.Errorf("the ReceiveMessage timeout must be longer than its 20s long poll, not %s", d)
+	}
+	return t, nil
+}
+
+// forOperation returns op's timeout, or 0 for none.
+func (t *awsTimeouts) forOperation(op string) time.Duration {
+	if d, ok := t.ops[op]; ok {
+		return d
+	}
+	if op == "ReceiveMessage" {
+		return 0
+	}
+	return t.standard
+}
+
+// longest returns the longest operation timeout, bounding each step.
+func (t *awsTimeouts) longest() time.Duration {
+	longest := t.standard
+	for op, d := range t.ops {
+		if op != "ReceiveMessage" {
+			longest = max(longest, d)
+		}
+	}
+	return longest
+}
+
+// settings returns the timeouts for the startup report.
+func (t *awsTimeouts) settings() map[string]string {
+	s := map[string]string{"default": t.standard.String()}
+	for op, d := range t.ops {
+		s[op] = d.String()
+	}
+	return s
+}
+
+// apply bounds every call of the clients built from apiOptions afterwards
+// and sets awsOpTimeout for the call sites.
+func (t *awsTimeouts) apply(apiOptions *[]func(*middleware.Stack) error) {
+	awsOpTimeout = t.longest()
+	*apiOptions = append(*apiOptions, func(stack *middleware.Stack) error {
+		// Outside the retry loop: the timeout covers every attempt.
+		return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("OperationTimeout", t.handleInitialize), middleware.After)
+	})
+}
+
+// handleInitialize runs one call under its operation's timeout.
+func (t *awsTimeouts) handleInitialize(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+	op := awsmiddleware.GetOperationName(ctx)
+	d := t.forOperation(op)
+	if d <= 0 {
+		return next.HandleInitialize(ctx, in)
+	}
+	callCtx, cancel := context.WithTimeout(ctx, d)
+	out, md, err := next.HandleInitialize(callCtx, in)
+	// Only this timeout, not the caller's deadline or cancellation.
+	if err != nil && ctx.Err() == nil && errors.Is(callCtx.Err(), context.DeadlineExceeded) {
+		awsTimeoutsHit.Add(ctx, 1, metric.WithAttributes(attribute.String("operation", op)))
+		err = fmt.Errorf("timed out after %s: %w", d, err)
+	}
+	// A body streamed from the response is read under the timeout too, so
+	// it is released when the caller closes it rather than here.
+	if o, ok := out.Result.(*s3.GetObjectOutput); ok && err == nil && o.Body != nil {
+		o.Body = &cancelOnClose{ReadCloser: o.Body, cancel: cancel}
+		return out, md, err
+	}
+	cancel()
+	return out, md, err
+}
+
+// cancelOnClose is a response body that releases its call's context when
+// closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
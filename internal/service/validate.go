@@ -0,0 +1,102 @@
+// Job validation without submission. POST /jobs/validate accepts exactly what
+// POST /jobs accepts and reports what submitting it would do — validation
+// errors, the status code, whether it would collapse into a recent duplicate —
+// and, with ?dry_run=true, runs the processor on a truncated copy of the text.
+// Nothing is enqueued, stored, or claimed, so clients can check a large batch
+// before sending it.
+package service
+
+import (
+	"net/http"
+	"time"
+	"unicode/utf8"
+)
+
+// dryRunMaxBytes bounds the text a dry run processes.
+const dryRunMaxBytes = 4096
+
+// ValidationResponse is the POST /jobs/validate response body.
+type ValidationResponse struct {
+	Valid       bool          `json:"valid"`                  // Submitting would be accepted
+	Errors      []string      `json:"errors,omitempty"`       // Why not, when invalid
+	Fields      []FieldError  `json:"fields,omitempty"`       // The invalid fields, when validation failed
+	Status      int           `json:"status"`                 // Status POST /jobs would return (barring queue failures)
+	DuplicateOf string        `json:"duplicate_of,omitempty"` // Job a submission would collapse into
+	DryRun      *DryRunResult `json:"dry_run,omitempty"`      // Present with ?dry_run=true on a valid request
+}
+
+// DryRunResult is the processor's output on the (possibly truncated) text.
+type DryRunResult struct {
+	Output     string   `json:"output"`          // Processor output
+	Artifacts  []string `json:"artifacts"`       // Names of artifacts that would be attached
+	InputBytes int      `json:"input_bytes"`     // Bytes of text processed
+	Truncated  bool     `json:"truncated"`       // Text was cut to dryRunMaxBytes
+	Error      string   `json:"error,omitempty"` // Processor error; the job would be retried
+	DurationMs float64  `json:"duration_ms"`     // Processing time
+}
+
+// truncateUTF8 cuts s to at most n bytes without splitting a rune.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// validateJob handles POST /jobs/validate requests.
+// Always 200 with a ValidationResponse; the verdict is in the body. A dry run
+// is refused with 503 while the intake throttle is engaged (throttle.go).
+func (a *App) validateJob(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, a.bodyLimit)
+
+	req, err := a.decodeJobRequest(r)
+	if err == nil {
+		err = a.validateJobRequest(&req)
+	}
+	if err != nil {
+		status, detail := jobRequestError(err)
+		resp := ValidationResponse{Errors: []string{err.Error()}, Fields: detail.Fields, Status: status}
+		if len(detail.Fields) > 0 {
+			resp.Errors = resp.Errors[:0]
+			for _, f := range detail.Fields {
+				resp.Errors = append(resp.Errors, f.Message)
+			}
+		}
+		writeJSON(w, http.StatusOK, resp)
+		return
+	}
+
+	resp := ValidationResponse{Valid: true, Status: http.StatusCreated}
+	if id, dup := a.duplicates.peek(submissionFingerprint(principalFromRequest(r), req)); dup {
+		resp.Status, resp.DuplicateOf = http.StatusOK, id
+	}
+
+	if r.URL.Query().Get("dry_run") == "true" {
+		if a.throttle.refuseInline(w, r, "validate") {
+			return
+		}
+		text := truncateUTF8(req.Text, dryRunMaxBytes)
+		jc, cancel := newDryRunContext(r.Context(), principalFromRequest(r).Tenant)
+		defer cancel()
+		start := time.Now()
+		output, artifacts, err := processors[req.Type].Process(jc, text)
+		dr := &DryRunResult{
+			Output:     output,
+			Artifacts:  make([]string, 0, len(artifacts)),
+			InputBytes: len(text),
+			Truncated:  len(text) < len(req.Text),
+			DurationMs: float64(time.Since(start).Microseconds()) / 1000,
+		}
+		if err != nil {
+			dr.Error = err.Error()
+		}
+		for _, art := range artifacts {
+			dr.Artifacts = append(dr.Artifacts, art.Name)
+		}
+		resp.DryRun = dr
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
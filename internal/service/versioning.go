@@ -0,0 +1,104 @@
+// API versioning. The job API — /jobs, /views, /job-types and /ws — is
+// served under a version prefix, /v1, so a later breaking change to a
+// request or response can ship as /v2 alongside it. Operational routes
+// (/healthz, /readyz, /metrics, /admin/*, /debug/*, /openapi.json, /docs)
+// are not versioned.
+//
+// The unversioned paths the API had before are kept working by a
+// compatibility shim, on by default (LEGACY_API_PATHS=false turns it off):
+// they route to the same handlers as /v1 and behave identically, but every
+// response carries the RFC 9745 Deprecation header, a Link to the /v1 path
+// (rel="successor-version") and, once LEGACY_API_SUNSET announces a date,
+// the RFC 8594 Sunset header. Each use is counted in api.legacy_requests by
+// route, to tell when the shim can go. With the shim off the unversioned
+// paths answer 404 naming their /v1 path.
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// apiV1 is the path prefix of version 1 of the job API.
+const apiV1 = "/v1"
+
+// legacyDeprecatedAt is when the unversioned paths were deprecated, for the
+// Deprecation header.
+var legacyDeprecatedAt = time.Date(2026, time.October, 16, 0, 0, 0, 0, time.UTC)
+
+// legacyAPI serves the job API at its unversioned paths.
+type legacyAPI struct {
+	sunset time.Time // LEGACY_API_SUNSET; zero until a date is announced
+}
+
+// newLegacyAPI returns the shim configured by LEGACY_API_PATHS and
+// LEGACY_API_SUNSET, or nil when it is off.
+func newLegacyAPI() (*legacyAPI, error) {
+	if getenv("LEGACY_API_PATHS") == "false" {
+		return nil, nil
+	}
+	l := &legacyAPI{}
+	if raw := getenv("LEGACY_API_SUNSET"); raw != "" {
+		t, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return nil, fmt.Errorf("LEGACY_API_SUNSET must be an RFC 3339 time: %w", err)
+		}
+		l.sunset = t
+	}
+	return l, nil
+}
+
+// routeVersioned registers handler for pattern, an unversioned route such
+// as "GET /jobs/{id}", under /v1 and, with the shim on, at pattern itself;
+// like router.route otherwise.
+func (a *App) routeVersioned(mux *router, pattern, name string, handler http.HandlerFunc, mws ...routeMiddleware) {
+	h := traced(name, handler, mws...)
+	method, path, _ := strings.Cut(pattern, " ")
+	mux.Handle(method+" "+apiV1+path, h)
+	if a.legacy != nil {
+		mux.Handle(pattern, a.legacy.wrap(pattern, h))
+	}
+}
+
+// wrap marks next's responses as deprecated in favour of /v1.
+func (l *legacyAPI) wrap(route string, next http.Handler) http.Handler {
+	attrs := metric.WithAttributes(attribute.String("route", route))
+	deprecation := "@" + strconv.FormatInt(legacyDeprecatedAt.Unix(), 10)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		legacyRequests.Add(r.Context(), 1, attrs)
+		h := w.Header()
+		h.Set("Deprecation", deprecation)
+		h.Add("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", apiV1+r.URL.EscapedPath()))
+		if !l.sunset.IsZero() {
+			h.Set("Sunset", l.sunset.UTC().Format(http.TimeFormat))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// unversionedPath returns path without its API version prefix, if any.
+func unversionedPath(path string) string {
+	if rest, ok := strings.CutPrefix(path, apiV1); ok && (rest == "" || rest[0] == '/') {
+		return rest
+	}
+	return path
+}
+
+// successor returns the /v1 path of r when r's path is unversioned and only
+// matches a route under /v1, or "".
+func (rt *router) successor(r *http.Request) string {
+	path := strings.TrimRight(r.URL.Path, "/")
+	if path == "" || unversionedPath(path) != path {
+		return ""
+	}
+	if _, pattern := rt.Handler(withPath(r, apiV1+path)); pattern != "" {
+		return apiV1 + path
+	}
+	return ""
+}
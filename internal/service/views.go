@@ -0,0 +1,250 @@
+// Saved views: named job-list filters an operator can store with POST /views
+// and apply with GET /jobs?view={id}. A view belongs to the principal that
+// created it and is private unless shared, in which case everyone in the same
+// tenant can read (but not delete) it. Views live at views/{tenant}/{id}.json.
+package service
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// viewsPrefix is the key prefix of saved views.
+	viewsPrefix = "views/"
+	// maxViewNameLen bounds View.Name.
+	maxViewNameLen = 100
+)
+
+// errViewNotFound means a view does not exist or is not visible to the caller.
+var errViewNotFound = errors.New("view not found")
+
+// viewStatuses are the statuses a view can filter on.
+var viewStatuses = []string{statusQueued, statusProcessing, statusCompleted, statusFailed, statusCancelled, statusDeleted}
+
+// ViewFilter selects jobs for a saved view. Zero fields match everything.
+type ViewFilter struct {
+	Status        string    `json:"status,omitempty"`        // Job status; other than completed, jobs are listed in ID order
+	Type          string    `json:"type,omitempty"`          // Job type, as submitted
+	Tag           string    `json:"tag,omitempty"`           // Job tag; not supported, jobs carry no tags
+	CreatedAfter  Timestamp `json:"created_after,omitzero"`  // Inclusive lower bound on created_at
+	CreatedBefore Timestamp `json:"created_before,omitzero"` // Exclusive upper bound on created_at
+}
+
+// ViewRequest is the POST /views request body.
+type ViewRequest struct {
+	Name   string     `json:"name"`            // Display name
+	Shared bool       `json:"shared"`          // Visible to the whole tenant
+	Filter ViewFilter `json:"filter"`          // Jobs to include
+	Order  string     `json:"order,omitempty"` // created_at order: desc (default) or asc
+}
+
+// View is a stored saved view.
+type View struct {
+	ID        string     `json:"id"`         // View ID
+	Name      string     `json:"name"`       // Display name
+	Owner     string     `json:"owner"`      // Principal ID of the creator
+	Tenant    string     `json:"tenant"`     // Tenant the view belongs to
+	Shared    bool       `json:"shared"`     // Visible to the whole tenant
+	Filter    ViewFilter `json:"filter"`     // Jobs to include
+	Order     string     `json:"order"`      // created_at order: desc or asc
+	CreatedAt Timestamp  `json:"created_at"` // When the view was saved
+}
+
+// ViewListResponse is the GET /views response body.
+type ViewListResponse struct {
+	Views []View `json:"views"`
+}
+
+// viewKey is the S3 key of a saved view. The tenant is path-escaped because
+// it comes from a request header.
+func viewKey(tenant, id string) string {
+	return viewsPrefix + url.PathEscape(tenant) + "/" + id + ".json"
+}
+
+// visibleTo reports whether p may read the view.
+func (v View) visibleTo(p Principal) bool {
+	return v.Tenant == p.Tenant && (v.Shared || v.Owner == p.ID)
+}
+
+// validateViewRequest checks req and defaults its order.
+func validateViewRequest(req *ViewRequest) error {
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > maxViewNameLen {
+		return fmt.Errorf("name is required and must be at most %d bytes", maxViewNameLen)
+	}
+	switch req.Order {
+	case "":
+		req.Order = "desc"
+	case "asc", "desc":
+	default:
+		return errors.New("order must be asc or desc")
+	}
+	f := req.Filter
+	if f.Status != "" && !slices.Contains(viewStatuses, f.Status) {
+		return fmt.Errorf("status must be one of %s", strings.Join(viewStatuses, ", "))
+	}
+	if _, ok := lookupProcessor(f.Type); !ok {
+		return fmt.Errorf("type must be one of %s", strings.Join(processorTypes(), ", "))
+	}
+	if f.Tag != "" {
+		return errors.New("tag filters are not supported: jobs do not carry tags")
+	}
+	if !f.CreatedAfter.IsZero() && !f.CreatedBefore.IsZero() && !f.CreatedBefore.After(f.CreatedAfter.Time) {
+		return errors.New("created_before must be after created_after")
+	}
+	return nil
+}
+
+// createView handles POST /views requests.
+// Saves a named job filter owned by the caller → 201 with the stored view.
+func (a *App) createView(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+	var req ViewRequest
+	if err := a.decodeJSON(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateViewRequest(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	p := principalFromRequest(r)
+	view := View{
+		ID:        uuid.New().String(),
+		Name:      req.Name,
+		Owner:     p.ID,
+		Tenant:    p.Tenant,
+		Shared:    req.Shared,
+		Filter:    req.Filter,
+		Order:     req.Order,
+		CreatedAt: Now(),
+	}
+	if err := a.putJSON(r.Context(), viewKey(view.Tenant, view.ID), view); err != nil {
+		writeStorageError(r.Context(), w, "PutObject", "failed to save view", err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, view)
+}
+
+// listViews handles GET /views requests.
+// Returns the caller's own views and views shared within their tenant.
+func (a *App) listViews(w http.ResponseWriter, r *http.Request) {
+	p := principalFromRequest(r)
+	resp := ViewListResponse{Views: []View{}}
+	err := a.listObjects(r.Context(), viewsPrefix+url.PathEscape(p.Tenant)+"/", func(obj ObjectInfo) error {
+		var v View
+		if err := a.getJSON(r.Context(), obj.Key, &v); err != nil {
+			return err
+		}
+		if v.visibleTo(p) {
+			resp.Views = append(resp.Views, v)
+		}
+		return nil
+	})
+	if err != nil {
+		writeStorageError(r.Context(), w, "GetObject", "failed to list views", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// loadView reads view id for p. It returns errViewNotFound when the view does
+// not exist or is not visible to p.
+func (a *App) loadView(r *http.Request, p Principal, id string) (View, error) {
+	if id == "" || strings.ContainsAny(id, "/\\") {
+		return View{}, errViewNotFound
+	}
+	var v View
+	if err := a.getJSON(r.Context(), viewKey(p.Tenant, id), &v); err != nil {
+		if classifyS3Error(err).Kind == s3NotFound {
+			return View{}, errViewNotFound
+		}
+		return View{}, err
+	}
+	if !v.visibleTo(p) {
+		return View{}, errViewNotFound
+	}
+	return v, nil
+}
+
+// getView handles GET /views/{id} requests.
+func (a *App) getView(w http.ResponseWriter, r *http.Request) {
+	v, err := a.loadView(r, principalFromRequest(r), r.PathValue("id"))
+	switch {
+	case errors.Is(err, errViewNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case err != nil:
+		writeStorageError(r.Context(), w, "GetObject", "failed to read view", err)
+	default:
+		writeJSON(w, http.StatusOK, v)
+	}
+}
+
+// deleteView handles DELETE /views/{id} requests.
+// Only the owner may delete a view → 204; others get 403 (shared) or 404.
+func (a *App) deleteView(w http.ResponseWriter, r *http.Request) {
+	p := principalFromRequest(r)
+	v, err := a.loadView(r, p, r.PathValue("id"))
+	switch {
+	case errors.Is(err, errViewNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		writeStorageError(r.Context(), w, "GetObject", "failed to read view", err)
+		return
+	}
+	if v.Owner != p.ID {
+		writeError(w, http.StatusForbidden, ErrorDetail{Code: errCodeForbidden, Message: "only the owner can delete a view"})
+		return
+	}
+	if _, err := a.deleteKeys(r.Context(), []string{viewKey(v.Tenant, v.ID)}); err != nil {
+		writeStorageError(r.Context(), w, "DeleteObjects", "failed to delete view", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// viewRange returns the created_at bounds of the view's filter.
+func (v View) viewRange() createdRange {
+	return createdRange{after: v.Filter.CreatedAfter.Time, before: v.Filter.CreatedBefore.Time}
+}
+
+// createdRange bounds a created_at-sorted listing; zero bounds are open.
+type createdRange struct {
+	after, before time.Time
+}
+
+// startKey returns the index key to list after so the listing begins at the
+// range's near bound, or "" when that bound is open. Entries for a value v are
+// valueKey(v)+"_…", which sort after valueKey(v) itself.
+func (c createdRange) startKey(s jobSort) string {
+	switch {
+	case s.desc && !c.before.IsZero():
+		return s.valueKey(c.before.UnixMilli() - 1)
+	case !s.desc && !c.after.IsZero():
+		return s.valueKey(c.after.UnixMilli())
+	}
+	return ""
+}
+
+// contains reports whether t lies within the range.
+func (c createdRange) contains(t time.Time) bool {
+	return (c.after.IsZero() || !t.Before(c.after)) && (c.before.IsZero() || t.Before(c.before))
+}
+
+// past reports whether sum lies beyond the range's far end in s's direction,
+// so the listing can stop.
+func (c createdRange) past(s jobSort, sum JobSummary) bool {
+	if s.desc {
+		return !c.after.IsZero() && sum.CreatedAt.Before(c.after)
+	}
+	return !c.before.IsZero() && !sum.CreatedAt.Before(c.before)
+}
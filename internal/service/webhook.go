@@ -0,0 +1,374 @@
+// Job completion callbacks. POST /jobs takes an optional callback_url; once a
+// worker has stored the job's result, the built-in "callback" result hook
+// (hooks.go) POSTs the JobResult there, signed:
+//
+//	POST <callback_url>
+//	Content-Type: application/json
+//	X-Webhook-ID: <job id>
+//	X-Webhook-Timestamp: <Unix seconds>
+//	X-Webhook-Signature: sha256=<hex HMAC-SHA256 of "<timestamp>.<body>">
+//
+//	{"id":"…","text":"…","output":"…","processed_at":"…",…}
+//
+// The HMAC key is WEBHOOK_SIGNING_SECRET; receivers recompute the signature
+// and refuse stale timestamps, so a captured request cannot be replayed.
+// A 2xx answer is a delivery. A network error, a timeout (HOOK_TIMEOUT), 408,
+// 429 or a 5xx is retried with the hook backoff (HOOK_RETRY_BACKOFF_BASE
+// doubling to HOOK_RETRY_BACKOFF_MAX) until HOOK_MAX_ATTEMPTS, after which
+// the callback is listed by GET /admin/hooks/failed and can be retried from
+// there. Any other answer, redirects included, is a rejection and is not
+// retried. Every attempt updates the job's delivery record,
+// callbacks/{id}.json, which GET /jobs/{id}/callback returns.
+//
+// Callbacks are off until WEBHOOK_SIGNING_SECRET is set; POST /jobs then
+// rejects a callback_url. URLs must be https (WEBHOOK_ALLOW_HTTP=true admits
+// http, for development) and, with WEBHOOK_ALLOWED_HOSTS, on one of the
+// listed hosts or their subdomains. Whatever the host, a callback connects
+// only to public addresses: the check is on the address dialled, after DNS
+// resolution, so a name resolving to a loopback, private or link-local
+// address (the cloud metadata endpoint among them) is refused however it was
+// set up. Connections to the outbound proxy (outbound.go) are exempt; the
+// proxy then stands between callbacks and the network.
+// WEBHOOK_ALLOW_PRIVATE=true lifts the check, for receivers on a development
+// machine. Delivery is at least once: receivers
+// deduplicate on X-Webhook-ID. Jobs that fail store no result and do not
+// call back.
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// callbacksPrefix holds the delivery records.
+const callbacksPrefix = "callbacks/"
+
+// callbackHookName is the built-in hook delivering callbacks.
+const callbackHookName = "callback"
+
+// maxCallbackURLLen bounds callback_url.
+const maxCallbackURLLen = 2048
+
+// minWebhookSecretLen is the shortest WEBHOOK_SIGNING_SECRET accepted.
+const minWebhookSecretLen = 16
+
+// Headers of a callback request.
+const (
+	headerWebhookID        = "X-Webhook-ID"
+	headerWebhookTimestamp = "X-Webhook-Timestamp"
+	headerWebhookSignature = "X-Webhook-Signature"
+)
+
+// Delivery states of a callback.
+const (
+	callbackPending   = "pending"   // Not attempted yet: the job has no stored result
+	callbackRetrying  = "retrying"  // The last attempt failed; another follows
+	callbackDelivered = "delivered" // The receiver answered 2xx
+	callbackRejected  = "rejected"  // The receiver refused it; not retried
+	callbackFailed    = "failed"    // Out of attempts; see GET /admin/hooks/failed
+)
+
+// CallbackDelivery is callbacks/{id}.json, the delivery record of a job's
+// callback, and the GET /jobs/{id}/callback response body.
+type CallbackDelivery struct {
+	JobID         string    `json:"job_id"`
+	URL           string    `json:"url"`
+	State         string    `json:"state"`                    // pending, retrying, delivered, rejected or failed
+	Attempts      int       `json:"attempts"`                 // Requests made, over every retry
+	LastStatus    int       `json:"last_status,omitempty"`    // HTTP status of the last attempt; absent when it got none
+	LastError     string    `json:"last_error,omitempty"`     // Why the last attempt failed
+	LastAttemptAt Timestamp `json:"last_attempt_at,omitzero"` // When the last attempt was made
+	DeliveredAt   Timestamp `json:"delivered_at,omitzero"`    // When the receiver accepted it
+}
+
+// webhookSender signs and delivers callbacks.
+type webhookSender struct {
+	app          *App
+	client       *http.Client // a.httpClient, not following redirects
+	secret       []byte       // WEBHOOK_SIGNING_SECRET
+	allowHTTP    bool         // WEBHOOK_ALLOW_HTTP
+	allowPrivate bool         // WEBHOOK_ALLOW_PRIVATE: connect to non-public addresses too
+	allowedHosts []string     // WEBHOOK_ALLOWED_HOSTS, lower case; empty for any
+}
+
+// errPrivateAddress is returned for a callback that would connect to an
+// address that is not public.
+var errPrivateAddress = errors.New("callback address is not public")
+
+// sharedAddressSpace is 100.64.0.0/10, carrier-grade NAT, which netip does
+// not count as private.
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// publicAddr reports whether ip may receive callbacks: not loopback,
+// private, link-local, shared, multicast or unspecified.
+func publicAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return ip.IsValid() && ip.IsGlobalUnicast() && !ip.IsPrivate() && !sharedAddressSpace.Contains(ip) &&
+		!(ip.Is4() && ip.As4()[0] == 0)
+}
+
+// newWebhookSender returns the sender configured by the WEBHOOK_* variables,
+// or nil when WEBHOOK_SIGNING_SECRET is unset.
+func newWebhookSender(a *App) (*webhookSender, error) {
+	secret := getenv("WEBHOOK_SIGNING_SECRET")
+	if secret == "" {
+		return nil, nil
+	}
+	if len(secret) < minWebhookSecretLen {
+		return nil, fmt.Errorf("WEBHOOK_SIGNING_SECRET must be at least %d bytes", minWebhookSecretLen)
+	}
+	// A redirect would carry the signed result somewhere the submitter did
+	// not name.
+	client := *a.httpClient
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	s := &webhookSender{
+		app:          a,
+		client:       &client,
+		secret:       []byte(secret),
+		allowHTTP:    getenv("WEBHOOK_ALLOW_HTTP") == "true",
+		allowPrivate: getenv("WEBHOOK_ALLOW_PRIVATE") == "true",
+	}
+	if !s.allowPrivate {
+		client.Transport = publicOnlyTransport(client.Transport)
+	}
+	for _, host := range strings.Split(getenv("WEBHOOK_ALLOWED_HOSTS"), ",") {
+		if host = strings.ToLower(strings.Trim(strings.TrimSpace(host), ".")); host != "" {
+			s.allowedHosts = append(s.allowedHosts, host)
+		}
+	}
+	return s, nil
+}
+
+// checkURL reports why raw cannot be a callback_url, or nil. A nil sender
+// accepts none.
+func (s *webhookSender) checkURL(raw string) error {
+	if s == nil {
+		return errors.New("callback_url is not accepted: callbacks are not enabled on this service")
+	}
+	if len(raw) > maxCallbackURLLen {
+		return fmt.Errorf("callback_url must be at most %d characters", maxCallbackURLLen)
+	}
+	u, err := url.Parse(raw)
+	if err != nil || !u.IsAbs() || u.Host == "" {
+		return errors.New("callback_url must be an absolute URL")
+	}
+	switch {
+	case u.Scheme == "https":
+	case u.Scheme == "http" && s.allowHTTP:
+	default:
+		return errors.New("callback_url must be an https URL")
+	}
+	if u.User != nil {
+		return errors.New("callback_url must not contain credentials")
+	}
+	if !s.hostAllowed(u.Hostname()) {
+		return fmt.Errorf("callback_url host %q is not allowed", u.Hostname())
+	}
+	// Names are checked when the callback connects; literal addresses can
+	// be refused now.
+	if ip, err := netip.ParseAddr(u.Hostname()); err == nil && !s.allowPrivate && !publicAddr(ip) {
+		return fmt.Errorf("callback_url host %q is not a public address", u.Hostname())
+	}
+	return nil
+}
+
+// publicOnlyTransport returns a copy of base, an *http.Transport, whose
+// connections other than to the outbound proxy fail with errPrivateAddress
+// unless the address dialled is public.
+func publicOnlyTransport(base http.RoundTripper) http.RoundTripper {
+	tr, ok := base.(*http.Transport)
+	if !ok {
+		tr = http.DefaultTransport.(*http.Transport)
+	}
+	tr = tr.Clone()
+	proxies := outboundProxyAddrs()
+	direct := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	checked := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		// Run on each resolved address before connecting to it.
+		Control: func(network, address string, _ syscall.RawConn) error {
+			ap, err := netip.ParseAddrPort(address)
+			if err != nil || !publicAddr(ap.Addr()) {
+				return fmt.Errorf("%w: %s", errPrivateAddress, address)
+			}
+			return nil
+		},
+	}
+	tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if proxies[addr] {
+			return direct.DialContext(ctx, network, addr)
+		}
+		return checked.DialContext(ctx, network, addr)
+	}
+	return tr
+}
+
+// hostAllowed reports whether host is in WEBHOOK_ALLOWED_HOSTS, or a
+// subdomain of one of them; any host is without the setting.
+func (s *webhookSender) hostAllowed(host string) bool {
+	if len(s.allowedHosts) == 0 {
+		return true
+	}
+	host = strings.ToLower(host)
+	for _, allowed := range s.allowedHosts {
+		if host == allowed || strings.HasSuffix(host, "."+allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// deliver is the callback hook: it POSTs result to its callback URL and
+// records the attempt. Only failures worth retrying are returned.
+func (s *webhookSender) deliver(ctx context.Context, result StoredResult) error {
+	if result.CallbackURL == "" {
+		return nil
+	}
+	d := CallbackDelivery{JobID: result.ID}
+	if err := s.app.getJSON(ctx, callbackKey(result.ID), &d); err != nil && classifyS3Error(err).Kind != s3NotFound {
+		return fmt.Errorf("read delivery record: %w", err)
+	}
+	if d.State == callbackDelivered || d.State == callbackRejected {
+		return nil // A rerun of the task: this hook already finished
+	}
+	d.URL, d.State = result.CallbackURL, callbackRetrying
+	d.Attempts++
+	d.LastAttemptAt = Now()
+	d.LastStatus, d.LastError = 0, ""
+	status, err := s.post(ctx, result)
+	d.LastStatus = status
+	switch {
+	case err == nil:
+		d.State, d.DeliveredAt = callbackDelivered, Now()
+	case status != 0 && !retryableCallbackStatus(status):
+		d.State, d.LastError = callbackRejected, err.Error()
+	default:
+		d.LastError = err.Error()
+	}
+	// Recorded even when the attempt used up the hook's time.
+	if perr := s.app.putJSON(context.WithoutCancel(ctx), callbackKey(result.ID), d); perr != nil {
+		slog.WarnContext(ctx, "failed to record callback delivery", "job_id", result.ID, "state", d.State, "error", perr)
+	}
+	callbackDeliveries.Add(ctx, 1, metric.WithAttributes(attribute.String("outcome", d.State)))
+	switch d.State {
+	case callbackRetrying:
+		return err
+	case callbackRejected:
+		slog.WarnContext(ctx, "callback rejected, not retrying", "job_id", result.ID, "status", status, "attempts", d.Attempts)
+	}
+	return nil
+}
+
+// post sends one signed callback request with result, returning the
+// receiver's status (0 without an answer) and an error unless it was 2xx.
+func (s *webhookSender) post(ctx context.Context, result StoredResult) (int, error) {
+	body, err := json.Marshal(result.JobResult)
+	if err != nil {
+		return 0, fmt.Errorf("encode result: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, result.CallbackURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(headerWebhookID, result.ID)
+	req.Header.Set(headerWebhookTimestamp, timestamp)
+	req.Header.Set(headerWebhookSignature, "sha256="+s.sign(timestamp, body))
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// Drained, within reason, so the connection can be reused.
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("receiver answered %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// sign returns the hex HMAC-SHA256 of "<timestamp>.<body>".
+func (s *webhookSender) sign(timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// retryableCallbackStatus reports whether a receiver's status is worth
+// another attempt.
+func retryableCallbackStatus(status int) bool {
+	return status == http.StatusRequestTimeout || status == http.StatusTooManyRequests || status >= 500
+}
+
+// callbackKey returns the key of jobID's delivery record.
+func callbackKey(jobID string) string { return callbacksPrefix + jobID + ".json" }
+
+// getJobCallback handles GET /jobs/{id}/callback requests.
+// → 200 CallbackDelivery for a job submitted with a callback_url; 404 when
+// the job does not exist or has no callback.
+func (a *App) getJobCallback(w http.ResponseWriter, r *http.Request) {
+	jobID, ok := a.pathJobID(w, r)
+	if !ok {
+		return
+	}
+	ctx := r.Context()
+	var d CallbackDelivery
+	err := a.getJSON(ctx, callbackKey(jobID), &d)
+	switch {
+	case err == nil:
+		if d.State != callbackRetrying {
+			break
+		}
+		// Out of attempts once the hook runner has moved it to hooks/failed/.
+		failed, err := a.objectExists(ctx, hookFailureKey(jobID, callbackHookName))
+		if err != nil {
+			writeStorageError(ctx, w, "HeadObject", "failed to read callback delivery", err)
+			return
+		}
+		if failed {
+			d.State = callbackFailed
+		}
+	case classifyS3Error(err).Kind == s3NotFound:
+		var rec JobRecord
+		if err := a.getJSON(ctx, statusKey(jobID), &rec); err != nil {
+			if classifyS3Error(err).Kind == s3NotFound {
+				http.Error(w, "job not found", http.StatusNotFound)
+				return
+			}
+			writeStorageError(ctx, w, "GetObject", "failed to read job status", err)
+			return
+		}
+		if rec.CallbackURL == "" {
+			http.Error(w, "job has no callback", http.StatusNotFound)
+			return
+		}
+		d = CallbackDelivery{JobID: jobID, URL: rec.CallbackURL, State: callbackPending}
+	default:
+		writeStorageError(ctx, w, "GetObject", "failed to read callback delivery", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, d)
+}
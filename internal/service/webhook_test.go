@@ -0,0 +1,94 @@
+package service
+
+import (
+	"errors"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestPublicAddr(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"93.184.215.14":   true,
+		"2606:4700::1111": true,
+		"127.0.0.1":       false,
+		"::1":             false,
+		"10.1.2.3":        false,
+		"172.16.0.1":      false,
+		"192.168.1.1":     false,
+		"169.254.169.254": false, // Cloud metadata
+		"fe80::1":         false,
+		"fd00:ec2::254":   false,
+		"100.64.0.1":      false,
+		"0.0.0.0":         false,
+		"0.1.2.3":         false,
+		"::":              false,
+		"224.0.0.1":       false,
+		"::ffff:10.0.0.1": false,
+	} {
+		if got := publicAddr(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("publicAddr(%s) = %v, want %v", addr, got, want)
+		}
+	}
+}
+
+func TestCallbackURLLiteralAddresses(t *testing.T) {
+	t.Setenv("WEBHOOK_SIGNING_SECRET", strings.Repeat("s", minWebhookSecretLen))
+	s, err := newWebhookSender(&App{httpClient: &http.Client{Transport: http.DefaultTransport}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for raw, ok := range map[string]bool{
+		"https://example.com/hook":                 true,
+		"https://93.184.215.14/hook":               true,
+		"https://169.254.169.254/latest/meta-data": false,
+		"https://[::1]:8443/hook":                  false,
+		"https://10.0.0.5/hook":                    false,
+	} {
+		if err := s.checkURL(raw); (err == nil) != ok {
+			t.Errorf("checkURL(%s) = %v, want accepted %v", raw, err, ok)
+		}
+	}
+}
+
+func TestCallbackConnectsToPublicAddressesOnly(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer receiver.Close()
+	// A name, so the address is only known once it is resolved.
+	callbackURL := strings.Replace(receiver.URL, "127.0.0.1", "localhost", 1)
+	result := StoredResult{JobResult: JobResult{ID: "job-1"}, CallbackURL: callbackURL}
+
+	t.Setenv("WEBHOOK_SIGNING_SECRET", strings.Repeat("s", minWebhookSecretLen))
+	t.Setenv("WEBHOOK_ALLOW_HTTP", "true")
+	a := &App{httpClient: &http.Client{Transport: http.DefaultTransport}}
+	s, err := newWebhookSender(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.checkURL(callbackURL); err != nil {
+		t.Fatalf("checkURL(%s) = %v", callbackURL, err)
+	}
+	if status, err := s.post(t.Context(), result); !errors.Is(err, errPrivateAddress) {
+		t.Errorf("callback to loopback answered %d, %v; want %v", status, err, errPrivateAddress)
+	}
+
+	t.Setenv("WEBHOOK_ALLOW_PRIVATE", "true")
+	if s, err = newWebhookSender(a); err != nil {
+		t.Fatal(err)
+	}
+	if status, err := s.post(t.Context(), result); err != nil || status != http.StatusOK {
+		t.Errorf("callback with WEBHOOK_ALLOW_PRIVATE answered %d, %v", status, err)
+	}
+}
+
+func TestOutboundProxyAddrs(t *testing.T) {
+	t.Setenv("HTTPS_PROXY", "https://proxy.internal")
+	t.Setenv("HTTP_PROXY", "10.0.0.8:3128")
+	want := map[string]bool{"proxy.internal:443": true, "10.0.0.8:3128": true}
+	if got := outboundProxyAddrs(); !maps.Equal(got, want) {
+		t.Errorf("outboundProxyAddrs() = %v, want %v", got, want)
+	}
+}
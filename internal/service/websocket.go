@@ -0,0 +1,374 @@
+// Job updates over a WebSocket. GET /ws upgrades to a WebSocket on which a
+// client follows any number of jobs without polling. It sends commands as
+// JSON text messages:
+//
+//	{"action":"subscribe","job_ids":["…","…"]}
+//	{"action":"unsubscribe","job_ids":["…"]}
+//
+// and receives one JSON text frame per update:
+//
+//	{"type":"status","job_id":"…","status":{…JobStatus…}}
+//	{"type":"event","job_id":"…","event":{"type":"completed",…}}
+//	{"type":"error","job_id":"…","error":{"code":"…","message":"…"}}
+//
+// Subscribing answers with the job's current status, so nothing that
+// happened before the subscription is missed; an event may still arrive
+// just ahead of that snapshot. Events are the broker's (broker.go):
+// enqueued, and completed or failed once the worker reports an attempt's
+// outcome. A failed job may run again, so subscriptions last until
+// unsubscribed or the connection closes. A command that cannot be carried
+// out — an invalid or unknown job ID, too many subscriptions, a malformed
+// message — gets an error frame and the connection stays open.
+//
+// The server pings every WS_PING_INTERVAL and closes a connection whose pong
+// does not come within WS_PING_TIMEOUT; client pings are answered. A
+// connection follows at most WS_MAX_SUBSCRIPTIONS jobs, and a process serves
+// at most WS_MAX_CONNECTIONS connections (0 turns /ws off). Browsers must
+// connect from the service's own origin or one matching WS_ALLOWED_ORIGINS.
+// A connection that falls behind the broker is caught up with fresh status
+// frames, and shutdown closes every connection with 1001 (going away).
+//
+// Events only reach subscribers in the same process: an API process without
+// a worker sends status frames but no events.
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coder/websocket"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// errCodeTooManySubscriptions is the error frame code for a subscribe over
+// WS_MAX_SUBSCRIPTIONS.
+const errCodeTooManySubscriptions = "too_many_subscriptions"
+
+// wsReadLimit bounds a client message.
+const wsReadLimit = 64 << 10
+
+// wsWriteTimeout bounds sending one frame.
+const wsWriteTimeout = 10 * time.Second
+
+// wsRetryAfter is the Retry-After of a refused connection.
+const wsRetryAfter = 5 * time.Second
+
+// Commands a client sends.
+const (
+	wsSubscribe   = "subscribe"
+	wsUnsubscribe = "unsubscribe"
+)
+
+// Types of frame the server sends.
+const (
+	wsFrameStatus = "status"
+	wsFrameEvent  = "event"
+	wsFrameError  = "error"
+)
+
+// WSCommand is a message a client sends on /ws.
+type WSCommand struct {
+	Action string   `json:"action"`  // subscribe or unsubscribe
+	JobIDs []string `json:"job_ids"` // Jobs to start or stop following
+}
+
+// WSFrame is a message the server sends on /ws.
+type WSFrame struct {
+	Type   string       `json:"type"`             // status, event or error
+	JobID  string       `json:"job_id,omitempty"` // Job the frame is about; absent for errors about the whole message
+	Status *JobStatus   `json:"status,omitempty"` // The job's current status, for status frames
+	Event  *JobEvent    `json:"event,omitempty"`  // What happened to the job, for event frames
+	Error  *ErrorDetail `json:"error,omitempty"`  // Why a command failed, for error frames
+}
+
+// wsHub serves /ws connections.
+type wsHub struct {
+	app              *App
+	maxConnections   int           // WS_MAX_CONNECTIONS
+	maxSubscriptions int           // WS_MAX_SUBSCRIPTIONS
+	pingInterval     time.Duration // WS_PING_INTERVAL
+	pingTimeout      time.Duration // WS_PING_TIMEOUT
+	origins          []string      // WS_ALLOWED_ORIGINS: host patterns besides the service's own
+
+	connections atomic.Int64
+	closing     context.Context // Done once the server shuts down
+	close       context.CancelFunc
+}
+
+// newWSHub returns the hub configured by the WS_* variables, or nil when
+// WS_MAX_CONNECTIONS is 0.
+func newWSHub(a *App) (*wsHub, error) {
+	h := &wsHub{
+		app:              a,
+		maxConnections:   envInt("WS_MAX_CONNECTIONS", 1000),
+		maxSubscriptions: envInt("WS_MAX_SUBSCRIPTIONS", 100),
+		pingInterval:     envDuration("WS_PING_INTERVAL", 30*time.Second),
+		pingTimeout:      envDuration("WS_PING_TIMEOUT", 10*time.Second),
+	}
+	if h.maxConnections == 0 {
+		return nil, nil
+	}
+	if h.maxConnections < 0 || h.maxSubscriptions <= 0 {
+		return nil, errors.New("WS_MAX_CONNECTIONS must not be negative and WS_MAX_SUBSCRIPTIONS must be positive")
+	}
+	if h.pingInterval <= 0 || h.pingTimeout <= 0 {
+		return nil, errors.New("WS_PING_INTERVAL and WS_PING_TIMEOUT must be positive")
+	}
+	for _, origin := range strings.Split(getenv("WS_ALLOWED_ORIGINS"), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			h.origins = append(h.origins, origin)
+		}
+	}
+	h.closing, h.close = context.WithCancel(context.Background())
+	return h, nil
+}
+
+// shutdown closes every connection, for http.Server.RegisterOnShutdown:
+// the server does not track hijacked connections.
+func (h *wsHub) shutdown() {
+	h.close()
+}
+
+// isWebSocketUpgrade reports whether r asks for a WebSocket.
+func isWebSocketUpgrade(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// serveWS handles GET /ws requests.
+// → 101 and a WebSocket carrying job updates (see above); 503 overloaded
+// with Retry-After when the process already serves WS_MAX_CONNECTIONS; 426
+// when the request is not a WebSocket handshake, 403 when its Origin is not
+// allowed.
+func (a *App) serveWS(w http.ResponseWriter, r *http.Request) {
+	h := a.ws
+	if h.connections.Add(1) > int64(h.maxConnections) {
+		h.connections.Add(-1)
+		writeRetryableError(w, http.StatusServiceUnavailable, errCodeOverloaded, "too many WebSocket connections", wsRetryAfter)
+		return
+	}
+	defer h.connections.Add(-1)
+
+	// The server's read and write timeouts would cut the connection off
+	// after the handshake.
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Time{})
+	rc.SetWriteDeadline(time.Time{})
+	conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{OriginPatterns: h.origins})
+	if err != nil {
+		// Accept has answered the request.
+		slog.DebugContext(r.Context(), "websocket handshake refused", "error", err)
+		return
+	}
+	defer conn.CloseNow()
+	conn.SetReadLimit(wsReadLimit)
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	wsConnections.Add(ctx, 1)
+	defer wsConnections.Add(context.WithoutCancel(ctx), -1)
+
+	s := &wsSession{hub: h, conn: conn, jobs: map[string]struct{}{}}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.pump(ctx)
+	}()
+	s.read(ctx)
+	cancel()
+	<-done
+}
+
+// wsSession is one /ws connection.
+type wsSession struct {
+	hub  *wsHub
+	conn *websocket.Conn
+
+	mu   sync.Mutex
+	jobs map[string]struct{} // Subscribed job IDs
+}
+
+// watching reports whether ev is about a subscribed job; the broker's filter.
+func (s *wsSession) watching(ev JobEvent) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.jobs[ev.JobID]
+	return ok
+}
+
+// read carries out the client's commands until the connection closes.
+func (s *wsSession) read(ctx context.Context) {
+	for {
+		typ, msg, err := s.conn.Read(ctx)
+		if err != nil {
+			return
+		}
+		var cmd WSCommand
+		if typ != websocket.MessageText {
+			s.sendError(ctx, "", ErrorDetail{Code: errCodeInvalidBody, Message: "commands must be JSON text messages"})
+			continue
+		}
+		if err := json.Unmarshal(msg, &cmd); err != nil {
+			s.sendError(ctx, "", ErrorDetail{Code: errCodeInvalidBody, Message: "command is not valid JSON: " + err.Error()})
+			continue
+		}
+		switch cmd.Action {
+		case wsSubscribe:
+			for _, id := range cmd.JobIDs {
+				s.subscribe(ctx, id)
+			}
+		case wsUnsubscribe:
+			for _, id := range cmd.JobIDs {
+				s.unsubscribe(id)
+			}
+		default:
+			s.sendError(ctx, "", ErrorDetail{Code: errCodeInvalidRequest, Message: fmt.Sprintf("action must be %q or %q", wsSubscribe, wsUnsubscribe)})
+		}
+	}
+}
+
+// subscribe follows raw and sends its current status, or an error frame.
+func (s *wsSession) subscribe(ctx context.Context, raw string) {
+	id, err := s.hub.app.jobIDs.canonical(raw)
+	if err != nil {
+		s.sendError(ctx, raw, ErrorDetail{Code: errCodeInvalidJobID, Message: "job id " + err.Error()})
+		return
+	}
+	s.mu.Lock()
+	_, already := s.jobs[id]
+	full := !already && len(s.jobs) >= s.hub.maxSubscriptions
+	if !full {
+		// Before reading the status, so no event falls between the two.
+		s.jobs[id] = struct{}{}
+	}
+	s.mu.Unlock()
+	if full {
+		s.sendError(ctx, id, ErrorDetail{
+			Code:    errCodeTooManySubscriptions,
+			Message: fmt.Sprintf("a connection follows at most %d jobs; unsubscribe from some first", s.hub.maxSubscriptions),
+		})
+		return
+	}
+	if errors.Is(s.sendStatus(ctx, id), errJobNotFound) {
+		s.unsubscribe(id)
+	}
+}
+
+// unsubscribe stops following id.
+func (s *wsSession) unsubscribe(raw string) {
+	id, err := s.hub.app.jobIDs.canonical(raw)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	delete(s.jobs, id)
+	s.mu.Unlock()
+}
+
+// sendStatus sends id's current status, or an error frame saying why it
+// could not be read. It returns errJobNotFound for a job that never existed.
+func (s *wsSession) sendStatus(ctx context.Context, id string) error {
+	readCtx, cancel := context.WithTimeout(ctx, awsOpTimeout)
+	status, err := s.hub.app.loadJobStatus(readCtx, id)
+	cancel()
+	switch {
+	case errors.Is(err, errJobNotFound):
+		s.sendError(ctx, id, ErrorDetail{Code: errCodeNotFound, Message: "job not found"})
+		return err
+	case err != nil:
+		slog.WarnContext(ctx, "websocket status read failed", "job_id", id, "error", err)
+		_, code, retryable := classifyS3Error(err).response()
+		s.sendError(ctx, id, ErrorDetail{Code: code, Message: "failed to read job status", Retryable: retryable})
+		return err
+	}
+	s.send(ctx, WSFrame{Type: wsFrameStatus, JobID: id, Status: &status})
+	return nil
+}
+
+// pump sends the subscribed jobs' events and pings the client until ctx is
+// done, the client stops answering pings or the server shuts down.
+func (s *wsSession) pump(ctx context.Context) {
+	events := s.hub.app.events
+	sub, unsubscribe := events.subscribe(s.watching, 0)
+	defer func() { unsubscribe() }()
+	ping := time.NewTicker(s.hub.pingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.hub.closing.Done():
+			s.conn.Close(websocket.StatusGoingAway, "server shutting down")
+			return
+		case ev, ok := <-sub.Events():
+			if !ok {
+				if !events.wasEvicted(sub) {
+					return
+				}
+				// Fell behind: renew, and catch up from storage.
+				sub, unsubscribe = events.subscribe(s.watching, 0)
+				s.resync(ctx)
+				continue
+			}
+			s.send(ctx, WSFrame{Type: wsFrameEvent, JobID: ev.JobID, Event: &ev})
+		case <-ping.C:
+			pingCtx, cancel := context.WithTimeout(ctx, s.hub.pingTimeout)
+			err := s.conn.Ping(pingCtx)
+			cancel()
+			if err != nil {
+				if ctx.Err() == nil {
+					slog.DebugContext(ctx, "websocket client stopped answering pings", "error", err)
+				}
+				s.conn.CloseNow()
+				return
+			}
+		}
+	}
+}
+
+// resync sends the current status of every subscribed job.
+func (s *wsSession) resync(ctx context.Context) {
+	s.mu.Lock()
+	ids := make([]string, 0, len(s.jobs))
+	for id := range s.jobs {
+		ids = append(ids, id)
+	}
+	s.mu.Unlock()
+	slices.Sort(ids)
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			return
+		}
+		s.sendStatus(ctx, id)
+	}
+}
+
+// sendError sends an error frame about jobID ("" for the whole command).
+func (s *wsSession) sendError(ctx context.Context, jobID string, detail ErrorDetail) {
+	s.send(ctx, WSFrame{Type: wsFrameError, JobID: jobID, Error: &detail})
+}
+
+// send writes f, bounded by wsWriteTimeout; a connection that cannot take
+// it is closed by the write.
+func (s *wsSession) send(ctx context.Context, f WSFrame) {
+	body, err := json.Marshal(f)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to encode websocket frame", "type", f.Type, "error", err)
+		return
+	}
+	writeCtx, cancel := context.WithTimeout(ctx, wsWriteTimeout)
+	defer cancel()
+	if err := s.conn.Write(writeCtx, websocket.MessageText, body); err != nil {
+		return
+	}
+	wsFrames.Add(ctx, 1, metric.WithAttributes(attribute.String("type", f.Type)))
+}
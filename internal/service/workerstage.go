@@ -0,0 +1,355 @@
+// Worker stages, for phased (blue/green) rollouts of the worker fleet
+// independent of the API. With WORKER_START_STAGE=observe a new worker
+// version starts in the observe stage: it receives job messages as usual but
+// only validates them — opens the envelope, decodes the job, checks its ID
+// and that this build has a processor for its type — and releases each back
+// to the queue at once for the active fleet, processing nothing and writing
+// nothing. Each observation counts in worker.observed{outcome,reason}, and
+// the counts and latest problems are shown at GET /admin/worker-stage. GET
+// /readyz reports worker_stage, and with ?stage=active answers 503 while the
+// worker is observing, for a deploy pipeline to wait on.
+//
+// Observers are promoted by version — WORKER_VERSION, by default the build's
+// version from the startup report. POST /admin/worker-versions/{version}/promote
+// on any API process records the promotion in flags/worker-versions.json;
+// observers re-read it every WORKER_STAGE_REFRESH (default 15s) and start
+// processing once their version is in it. A process of a promoted version
+// starts active, so the fleet can still scale out afterwards. Promotion is
+// one way: roll back by deploying the old version again.
+//
+// Like a shadow worker (shadow.go), an observer remembers the messages it
+// has validated and releases them after shadowRevisitDelay when they come
+// round again. Each receive still counts towards a message's receive count,
+// so MAX_ATTEMPTS, the queue's maxReceiveCount and LOOP_MESSAGE_RECEIVES
+// (loopguard.go) are reached sooner while observers run: keep the observe
+// stage short and the observers' WORKER_CONCURRENCY low.
+package service
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// workerVersionsKey is the S3 key of the promotions.
+const workerVersionsKey = "flags/worker-versions.json"
+
+// Worker stages.
+const (
+	stageObserve = "observe"
+	stageActive  = "active"
+)
+
+// Why an observed message would fail processing, as counted in
+// worker.observed.
+const (
+	observedOpen    = "open"     // Envelope, payload or adapter
+	observedDecode  = "decode"   // Not a job message this build can decode
+	observedJobID   = "job_id"   // ID not in the configured scheme
+	observedJobType = "job_type" // No processor for its type
+)
+
+// maxObservedProblems bounds the problems an observer keeps for its report.
+const maxObservedProblems = 20
+
+// WorkerVersionFlags is flags/worker-versions.json.
+type WorkerVersionFlags struct {
+	Promoted map[string]PromotedWorkerVersion `json:"promoted"` // By worker version
+}
+
+// PromotedWorkerVersion is the promotion of one worker version.
+type PromotedWorkerVersion struct {
+	PromotedBy string    `json:"promoted_by,omitempty"` // X-Client-ID of the operator
+	PromotedAt Timestamp `json:"promoted_at"`
+}
+
+// WorkerStageReport is the GET /admin/worker-stage response.
+type WorkerStageReport struct {
+	Stage      string            `json:"stage"`                // observe or active
+	Version    string            `json:"version"`              // WORKER_VERSION
+	Since      Timestamp         `json:"since"`                // When the worker started observing
+	PromotedAt Timestamp         `json:"promoted_at,omitzero"` // When its version was promoted
+	Valid      int64             `json:"valid"`                // Messages observed that it could process
+	Invalid    int64             `json:"invalid"`              // Messages observed that it could not
+	Problems   []ObservedProblem `json:"problems,omitempty"`   // The latest invalid ones, oldest first
+	RefreshMs  int64             `json:"refresh_ms,omitempty"` // How often promotions are re-read while observing
+}
+
+// ObservedProblem is a message an observer could not have processed.
+type ObservedProblem struct {
+	MessageID string    `json:"message_id"`
+	JobID     string    `json:"job_id,omitempty"`
+	Reason    string    `json:"reason"` // open, decode, job_id or job_type
+	Error     string    `json:"error"`
+	At        Timestamp `json:"at"`
+}
+
+// workerStage is the stage of a worker started observing. Safe for
+// concurrent use.
+type workerStage struct {
+	version string        // WORKER_VERSION
+	refresh time.Duration // WORKER_STAGE_REFRESH
+	since   time.Time
+	active  atomic.Bool
+	seenMessages
+
+	mu         sync.Mutex
+	promotedAt Timestamp
+	valid      int64
+	invalid    int64
+	problems   []ObservedProblem
+}
+
+// newWorkerStage returns the stage configured by WORKER_START_STAGE,
+// WORKER_VERSION and WORKER_STAGE_REFRESH for a build of version, or nil
+// when the worker starts active.
+func newWorkerStage(version string) (*workerStage, error) {
+	switch getenv("WORKER_START_STAGE") {
+	case "", stageActive:
+		return nil, nil
+	case stageObserve:
+	default:
+		return nil, fmt.Errorf("WORKER_START_STAGE must be %s or %s", stageObserve, stageActive)
+	}
+	s := &workerStage{
+		version: cmp.Or(getenv("WORKER_VERSION"), version),
+		refresh: envDuration("WORKER_STAGE_REFRESH", 15*time.Second),
+		since:   time.Now(),
+	}
+	if s.refresh <= 0 {
+		return nil, fmt.Errorf("WORKER_STAGE_REFRESH must be positive")
+	}
+	return s, nil
+}
+
+// observing reports whether the worker only validates messages. A nil
+// stage is active.
+func (s *workerStage) observing() bool {
+	return s != nil && !s.active.Load()
+}
+
+// name returns the current stage.
+func (s *workerStage) name() string {
+	if s.observing() {
+		return stageObserve
+	}
+	return stageActive
+}
+
+// promote makes the worker active, once.
+func (s *workerStage) promote(ctx context.Context, p PromotedWorkerVersion) {
+	if !s.active.CompareAndSwap(false, true) {
+		return
+	}
+	s.mu.Lock()
+	s.promotedAt = p.PromotedAt
+	valid, invalid := s.valid, s.invalid
+	s.mu.Unlock()
+	slog.InfoContext(ctx, "worker version promoted; processing messages", "version", s.version, "by", p.PromotedBy,
+		"observed_valid", valid, "observed_invalid", invalid)
+}
+
+// record counts an observed message; reason is "" when it was valid.
+func (s *workerStage) record(ctx context.Context, message types.Message, jobID, reason string, err error) {
+	outcome := "valid"
+	if reason != "" {
+		outcome = "invalid"
+	}
+	workerObserved.Add(ctx, 1, metric.WithAttributes(attribute.String("outcome", outcome), attribute.String("reason", reason)))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if reason == "" {
+		s.valid++
+		return
+	}
+	s.invalid++
+	s.problems = append(s.problems, ObservedProblem{
+		MessageID: aws.ToString(message.MessageId), JobID: jobID, Reason: reason, Error: err.Error(), At: Now(),
+	})
+	if n := len(s.problems); n > maxObservedProblems {
+		s.problems = s.problems[n-maxObservedProblems:]
+	}
+	slog.WarnContext(ctx, "observed a message this worker version could not process", "message_id", aws.ToString(message.MessageId),
+		"job_id", jobID, "reason", reason, "error", err)
+}
+
+// report returns the stage and what was observed.
+func (s *workerStage) report() WorkerStageReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rep := WorkerStageReport{
+		Stage:      s.name(),
+		Version:    s.version,
+		Since:      Timestamp{Time: s.since},
+		PromotedAt: s.promotedAt,
+		Valid:      s.valid,
+		Invalid:    s.invalid,
+		Problems:   append([]ObservedProblem(nil), s.problems...),
+	}
+	if s.observing() {
+		rep.RefreshMs = s.refresh.Milliseconds()
+	}
+	return rep
+}
+
+// observeMessage validates one received message without processing it and
+// releases it back to the queue; openErr is why it could not be opened.
+func (a *App) observeMessage(ctx context.Context, message types.Message, env Envelope, openErr error) {
+	defer a.releaseMessage(ctx, message)
+	if !a.stage.firstSeen(aws.ToString(message.MessageId)) {
+		time.Sleep(shadowRevisitDelay)
+		return
+	}
+	jobID, reason, err := a.validateObserved(env, openErr)
+	a.stage.record(ctx, message, jobID, reason, err)
+}
+
+// validateObserved runs the checks processMessage makes before processing,
+// returning the job ID and why the message would fail, or "" and nil.
+func (a *App) validateObserved(env Envelope, openErr error) (jobID, reason string, err error) {
+	if openErr != nil {
+		return "", observedOpen, openErr
+	}
+	var job JobMessage
+	if err := env.decodeBody(messageTypeJob, &job); err != nil {
+		return "", observedDecode, err
+	}
+	id, err := a.jobIDs.canonical(job.ID)
+	if err != nil {
+		return job.ID, observedJobID, fmt.Errorf("job id %q %s", job.ID, err)
+	}
+	if _, ok := lookupProcessor(job.Type); !ok {
+		return id, observedJobType, fmt.Errorf("unknown processor type %q", job.Type)
+	}
+	return id, "", nil
+}
+
+// loadWorkerVersionFlags reads the promotions and their ETag; a missing
+// object is none and an empty ETag.
+func (a *App) loadWorkerVersionFlags(ctx context.Context) (WorkerVersionFlags, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, awsOpTimeout)
+	defer cancel()
+	body, info, err := a.store.Get(ctx, workerVersionsKey)
+	if err != nil {
+		if classifyS3Error(err).Kind == s3NotFound {
+			return WorkerVersionFlags{Promoted: map[string]PromotedWorkerVersion{}}, "", nil
+		}
+		return WorkerVersionFlags{}, "", err
+	}
+	defer body.Close()
+	var flags WorkerVersionFlags
+	if err := json.NewDecoder(body).Decode(&flags); err != nil {
+		return WorkerVersionFlags{}, "", fmt.Errorf("decode %s: %w", workerVersionsKey, err)
+	}
+	if flags.Promoted == nil {
+		flags.Promoted = map[string]PromotedWorkerVersion{}
+	}
+	return flags, info.ETag, nil
+}
+
+// checkPromotion promotes the worker when its version has been.
+func (a *App) checkPromotion(ctx context.Context) {
+	flags, _, err := a.loadWorkerVersionFlags(ctx)
+	if err != nil {
+		slog.WarnContext(ctx, "failed to read worker version promotions", "error", err)
+		return
+	}
+	if p, ok := flags.Promoted[a.stage.version]; ok {
+		a.stage.promote(ctx, p)
+	}
+}
+
+// watchWorkerStage re-reads the promotions every refresh interval until the
+// worker is promoted or ctx is cancelled.
+func (a *App) watchWorkerStage(ctx context.Context) {
+	ticker := time.NewTicker(a.stage.refresh)
+	defer ticker.Stop()
+	for a.stage.observing() {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.checkPromotion(ctx)
+		}
+	}
+}
+
+// getWorkerStage handles GET /admin/worker-stage requests.
+// → 200 WorkerStageReport; 404 when the worker started active.
+func (a *App) getWorkerStage(w http.ResponseWriter, r *http.Request) {
+	if a.stage == nil {
+		http.Error(w, "worker stages disabled", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, a.stage.report())
+}
+
+// getWorkerVersions handles GET /admin/worker-versions requests.
+// Reads the promotions → 200 WorkerVersionFlags.
+func (a *App) getWorkerVersions(w http.ResponseWriter, r *http.Request) {
+	flags, _, err := a.loadWorkerVersionFlags(r.Context())
+	if err != nil {
+		writeStorageError(r.Context(), w, "GetObject", "failed to read worker version promotions", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, flags)
+}
+
+// promoteWorkerVersion handles POST /admin/worker-versions/{version}/promote
+// requests. Promotes the version's observers → 200 PromotedWorkerVersion,
+// the existing promotion when it already was; 409 when the promotions keep
+// changing underneath.
+func (a *App) promoteWorkerVersion(w http.ResponseWriter, r *http.Request) {
+	version := strings.TrimSpace(r.PathValue("version"))
+	if version == "" {
+		http.Error(w, "version is required", http.StatusBadRequest)
+		return
+	}
+	ctx := r.Context()
+	for range flagUpdateAttempts {
+		flags, etag, err := a.loadWorkerVersionFlags(ctx)
+		if err != nil {
+			writeStorageError(ctx, w, "GetObject", "failed to read worker version promotions", err)
+			return
+		}
+		if p, ok := flags.Promoted[version]; ok {
+			writeJSON(w, http.StatusOK, p)
+			return
+		}
+		p := PromotedWorkerVersion{PromotedBy: r.Header.Get("X-Client-ID"), PromotedAt: Now()}
+		flags.Promoted[version] = p
+		body, err := json.Marshal(flags)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		pctx, cancel := context.WithTimeout(ctx, awsOpTimeout)
+		err = a.store.Put(pctx, workerVersionsKey, body, PutOptions{ContentType: "application/json", IfNoneMatch: etag == "", IfMatch: etag})
+		cancel()
+		if err == nil {
+			slog.WarnContext(ctx, "worker version promoted", "version", version, "by", p.PromotedBy)
+			if a.stage != nil && a.stage.version == version {
+				a.stage.promote(ctx, p)
+			}
+			writeJSON(w, http.StatusOK, p)
+			return
+		}
+		if classifyS3Error(err).Status != http.StatusPreconditionFailed {
+			writeStorageError(ctx, w, "PutObject", "failed to update worker version promotions", err)
+			return
+		}
+	}
+	writeError(w, http.StatusConflict, ErrorDetail{Code: "flags_contended", Message: "worker version promotions are being changed concurrently; retry", Retryable: true})
+}
@@ -0,0 +1,104 @@
+// Package contract is the job queue's message contract, for services that
+// enqueue jobs straight to SQS instead of through the HTTP API: the Envelope
+// every queue message is wrapped in, the JobMessage it carries for a job, and
+// a Producer that sends one.
+//
+// Clients of the HTTP API can pace their submissions by the budget its
+// responses report (ParseRateLimit).
+//
+// The job service uses these same types, so a message built here is what
+// POST /jobs sends. What the API does around the send is skipped: duplicate
+// detection, lineage, and the creation record, so a job sent directly has no
+// status until a worker picks it up. The worker still rejects job IDs that do
+// not fit the service's JOB_ID_SCHEME. Tenant is taken on trust.
+package contract
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// EnvelopeVersion is the envelope format this version writes, and the newest
+// the worker reads.
+const EnvelopeVersion = 1
+
+// Message types.
+const TypeJob = "job" // Body is a JobMessage
+
+// Envelope header names, besides the trace context.
+const (
+	HeaderTenant        = "tenant"         // Submitting tenant
+	HeaderRequestID     = "request-id"     // The submitting client's X-Request-ID
+	HeaderPriorAttempts = "prior-attempts" // Deliveries before the message last left the job queue
+	HeaderGroup         = "message_group"  // FIFO message group of the job, on a FIFO job queue
+)
+
+// Envelope is the body of every queue message:
+//
+//	{"v":1,"type":"job","headers":{"traceparent":"…","tenant":"acme"},"body":{"id":"…",…}}
+type Envelope struct {
+	Version int               `json:"v"`                 // Envelope format; 0 on a pre-envelope message
+	Type    string            `json:"type"`              // What Body holds, e.g. "job"
+	Headers map[string]string `json:"headers,omitempty"` // Trace context and other cross-cutting metadata
+	Body    json.RawMessage   `json:"body"`              // The typed payload
+}
+
+// JobMessage is the body of a job message.
+type JobMessage struct {
+	ID        string    `json:"id"`               // Unique job identifier
+	Text      string    `json:"text"`             // Text to be processed
+	CreatedAt Timestamp `json:"created_at"`       // When the job was submitted
+	Tenant    string    `json:"tenant,omitempty"` // Submitting tenant; absent on messages from older versions
+	Type      string    `json:"type,omitempty"`   // Processor to run; absent on messages from older versions (uppercase)
+}
+
+// timestampLayout is the RFC 3339 profile every timestamp is written in: UTC,
+// fixed millisecond precision, "Z" suffix.
+const timestampLayout = "2006-01-02T15:04:05.000Z07:00"
+
+// Timestamp is a point in time that always serialises as RFC 3339 in UTC and
+// only accepts RFC 3339 on decode, so stored records and responses never carry
+// local offsets or ambiguous formats.
+type Timestamp struct{ time.Time }
+
+// Now returns the current time as a UTC Timestamp.
+func Now() Timestamp { return Timestamp{time.Now().UTC()} }
+
+// UnixMilli returns the timestamp as milliseconds since the Unix epoch (0 for
+// the zero time).
+func (t Timestamp) UnixMilli() int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Time.UnixMilli()
+}
+
+// MarshalJSON renders the timestamp as an RFC 3339 UTC string, or null when unset.
+func (t Timestamp) MarshalJSON() ([]byte, error) {
+	if t.IsZero() {
+		return []byte("null"), nil
+	}
+	return []byte(strconv.Quote(t.UTC().Format(timestampLayout))), nil
+}
+
+// UnmarshalJSON accepts an RFC 3339 string (any fractional precision, any
+// offset — normalised to UTC) or null, and rejects everything else.
+func (t *Timestamp) UnmarshalJSON(b []byte) error {
+	if bytes.Equal(b, []byte("null")) {
+		*t = Timestamp{}
+		return nil
+	}
+	s, err := strconv.Unquote(string(b))
+	if err != nil {
+		return fmt.Errorf("timestamp must be an RFC 3339 string: %w", err)
+	}
+	parsed, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return fmt.Errorf("timestamp must be RFC 3339: %w", err)
+	}
+	*t = Timestamp{parsed.UTC()}
+	return nil
+}
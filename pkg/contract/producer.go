@@ -0,0 +1,118 @@
+// Producer: sends jobs to the job queue directly.
+package contract
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// MaxMessageBytes is the largest message body SQS accepts.
+const MaxMessageBytes = 256 << 10
+
+// fifoSuffix ends the name of every FIFO queue.
+const fifoSuffix = ".fifo"
+
+// fifoIDPattern is what SQS accepts as a group or deduplication ID.
+var fifoIDPattern = regexp.MustCompile("^[!-~]{1,128}$")
+
+// SQSSender is the part of an SQS client a Producer uses; *sqs.Client
+// implements it.
+type SQSSender interface {
+	SendMessage(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error)
+}
+
+// Producer sends jobs to the job queue.
+type Producer struct {
+	client   SQSSender // SQS client
+	queueURL string    // The job queue, the service's SQS_QUEUE_URL
+}
+
+// NewProducer returns a Producer that sends to queueURL with client.
+func NewProducer(client SQSSender, queueURL string) *Producer {
+	return &Producer{client: client, queueURL: queueURL}
+}
+
+// NewEnvelope wraps body as a message of type typ, with ctx's trace context
+// (from the global OpenTelemetry propagator) and the non-empty headers given.
+func NewEnvelope(ctx context.Context, typ string, body any, headers map[string]string) (Envelope, error) {
+	raw, err := json.Marshal(body)
+	if err != nil {
+		return Envelope{}, err
+	}
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	for k, v := range headers {
+		if v != "" {
+			carrier[k] = v
+		}
+	}
+	env := Envelope{Version: EnvelopeVersion, Type: typ, Body: raw}
+	if len(carrier) > 0 {
+		env.Headers = carrier
+	}
+	return env, nil
+}
+
+// SendJob enqueues job and returns its ID. A job without an ID gets a new
+// UUID, and one without CreatedAt the current time; Text is required. The
+// envelope carries ctx's trace context and the job's tenant. On a FIFO queue
+// the job is its own message group, as the service's API sends jobs without
+// FIFO_GROUP_BY, and its ID is the deduplication ID, so a resend of the job
+// within SQS's deduplication window is dropped.
+func (p *Producer) SendJob(ctx context.Context, job JobMessage) (string, error) {
+	if strings.TrimSpace(job.Text) == "" {
+		return "", errors.New("text is required")
+	}
+	if job.ID == "" {
+		job.ID = uuid.New().String()
+	}
+	if job.CreatedAt.IsZero() {
+		job.CreatedAt = Now()
+	}
+	env, err := NewEnvelope(ctx, TypeJob, job, map[string]string{HeaderTenant: job.Tenant})
+	if err != nil {
+		return "", err
+	}
+	body, err := json.Marshal(env)
+	if err != nil {
+		return "", err
+	}
+	if len(body) > MaxMessageBytes {
+		return "", fmt.Errorf("job message is %d bytes, over the SQS limit of %d", len(body), MaxMessageBytes)
+	}
+	input := &sqs.SendMessageInput{
+		QueueUrl:    aws.String(p.queueURL),
+		MessageBody: aws.String(string(body)),
+	}
+	if strings.HasSuffix(p.queueURL, fifoSuffix) {
+		input.MessageGroupId = aws.String(fifoID(job.ID))
+		input.MessageDeduplicationId = aws.String(fifoID(job.ID))
+	}
+	_, err = p.client.SendMessage(ctx, input)
+	if err != nil {
+		return "", fmt.Errorf("failed to send job %s: %w", job.ID, err)
+	}
+	return job.ID, nil
+}
+
+// fifoID returns v as a group or deduplication ID, hashing one SQS would
+// reject, as the service does.
+func fifoID(v string) string {
+	if fifoIDPattern.MatchString(v) {
+		return v
+	}
+	sum := sha256.Sum256([]byte(v))
+	return hex.EncodeToString(sum[:])
+}
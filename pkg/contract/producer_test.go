@@ -0,0 +1,43 @@
+package contract
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+// recordingSender keeps the last message sent.
+type recordingSender struct {
+	input *sqs.SendMessageInput
+}
+
+func (r *recordingSender) SendMessage(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+	r.input = params
+	return &sqs.SendMessageOutput{}, nil
+}
+
+func TestSendJobFIFO(t *testing.T) {
+	long := strings.Repeat("x", 200)
+	for _, tc := range []struct {
+		queueURL, jobID, wantID string
+	}{
+		{"https://sqs.eu-west-1.amazonaws.com/123456789012/jobs", "order-17", ""},
+		{"https://sqs.eu-west-1.amazonaws.com/123456789012/jobs.fifo", "order-17", "order-17"},
+		{"https://sqs.eu-west-1.amazonaws.com/123456789012/jobs.fifo", long, fifoID(long)},
+	} {
+		sender := &recordingSender{}
+		if _, err := NewProducer(sender, tc.queueURL).SendJob(t.Context(), JobMessage{ID: tc.jobID, Text: "hello"}); err != nil {
+			t.Fatal(err)
+		}
+		group, dedup := aws.ToString(sender.input.MessageGroupId), aws.ToString(sender.input.MessageDeduplicationId)
+		if group != tc.wantID || dedup != tc.wantID {
+			t.Errorf("%s: group %q, deduplication ID %q; want %q", tc.queueURL, group, dedup, tc.wantID)
+		}
+	}
+	if id := fifoID(long); len(id) != 64 || !fifoIDPattern.MatchString(id) {
+		t.Errorf("fifoID of a %d-byte ID = %q", len(long), id)
+	}
+}
@@ -0,0 +1,55 @@
+// RateLimit: the submission budget the HTTP API reports on its responses.
+package contract
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Response headers reporting the caller's POST /jobs budget, after the IETF
+// RateLimit header fields draft. Sent only while the service has a rate
+// limit set.
+const (
+	HeaderRateLimit          = "RateLimit-Limit"     // Burst of the tighter bucket
+	HeaderRateLimitRemaining = "RateLimit-Remaining" // Submissions that would pass now
+	HeaderRateLimitReset     = "RateLimit-Reset"     // Seconds until the bucket is full again
+	HeaderRateLimitPolicy    = "RateLimit-Policy"    // Every bucket that applies
+)
+
+// RateLimit is the submission budget of one response.
+type RateLimit struct {
+	Limit     int           // Submissions the bucket holds when full
+	Remaining int           // Submissions that would pass now
+	Reset     time.Duration // Until the bucket is full again
+	Policy    string        // RateLimit-Policy, e.g. 20;w=2;comment="global", 3;w=6;comment="client"
+}
+
+// ParseRateLimit reads the budget from a response's headers; false when the
+// response carries none or a malformed one.
+func ParseRateLimit(h http.Header) (RateLimit, bool) {
+	limit, err1 := strconv.Atoi(strings.TrimSpace(h.Get(HeaderRateLimit)))
+	remaining, err2 := strconv.Atoi(strings.TrimSpace(h.Get(HeaderRateLimitRemaining)))
+	reset, err3 := strconv.Atoi(strings.TrimSpace(h.Get(HeaderRateLimitReset)))
+	if err1 != nil || err2 != nil || err3 != nil || limit <= 0 || remaining < 0 || reset < 0 {
+		return RateLimit{}, false
+	}
+	return RateLimit{
+		Limit:     limit,
+		Remaining: remaining,
+		Reset:     time.Duration(reset) * time.Second,
+		Policy:    h.Get(HeaderRateLimitPolicy),
+	}, true
+}
+
+// Wait returns how long to wait before the next submission so it is not
+// refused: nothing while submissions remain, else the time the bucket takes
+// to refill one. The budget is one API process's; behind a load balancer it
+// is a guide, not a promise.
+func (l RateLimit) Wait() time.Duration {
+	if l.Remaining > 0 || l.Limit <= 0 {
+		return 0
+	}
+	return (l.Reset + time.Duration(l.Limit) - 1) / time.Duration(l.Limit)
+}